@@ -19,10 +19,11 @@ use micro_http::{HttpServer, MediaType, Request, Response, StatusCode};
 use vmm_sys_util::eventfd::EventFd;
 
 use crate::http_endpoint::{
-    error_response, ApiError, ApiRequest, ApiResponse, EventsHandler, ExitHandler, FsBackendInfo,
-    HttpError, HttpResult, InfoHandler, MetricsBackendHandler, MetricsBlobcacheHandler,
-    MetricsFilesHandler, MetricsHandler, MetricsInflightHandler, MetricsPatternHandler,
-    MountHandler, SendFuseFdHandler, TakeoverHandler,
+    error_response, ApiError, ApiRequest, ApiResponse, CacheHandler, CredentialHandler,
+    EventsHandler, ExitHandler, FsBackendInfo, HttpError, HttpResult, InfoHandler,
+    MetricsBackendHandler, MetricsBlobcacheHandler, MetricsFilesHandler, MetricsHandler,
+    MetricsInflightHandler, MetricsMemoryHandler, MetricsPatternHandler, MetricsTenantsHandler,
+    MountHandler, PrefetchHandler, SendFuseFdHandler, TakeoverHandler,
 };
 
 const HTTP_ROOT: &str = "/api/v1";
@@ -63,16 +64,21 @@ lazy_static! {
         r.routes.insert(endpoint!("/daemon"), Box::new(InfoHandler{}));
         r.routes.insert(endpoint!("/daemon/events"), Box::new(EventsHandler{}));
         r.routes.insert(endpoint!("/daemon/backend"), Box::new(FsBackendInfo{}));
+        r.routes.insert(endpoint!("/daemon/cache"), Box::new(CacheHandler{}));
+        r.routes.insert(endpoint!("/daemon/credential"), Box::new(CredentialHandler{}));
         r.routes.insert(endpoint!("/daemon/exit"), Box::new(ExitHandler{}));
         r.routes.insert(endpoint!("/daemon/fuse/sendfd"), Box::new(SendFuseFdHandler{}));
         r.routes.insert(endpoint!("/daemon/fuse/takeover"), Box::new(TakeoverHandler{}));
         r.routes.insert(endpoint!("/mount"), Box::new(MountHandler{}));
+        r.routes.insert(endpoint!("/mount/prefetch"), Box::new(PrefetchHandler{}));
         r.routes.insert(endpoint!("/metrics"), Box::new(MetricsHandler{}));
         r.routes.insert(endpoint!("/metrics/files"), Box::new(MetricsFilesHandler{}));
         r.routes.insert(endpoint!("/metrics/pattern"), Box::new(MetricsPatternHandler{}));
         r.routes.insert(endpoint!("/metrics/backend"), Box::new(MetricsBackendHandler{}));
         r.routes.insert(endpoint!("/metrics/blobcache"), Box::new(MetricsBlobcacheHandler{}));
         r.routes.insert(endpoint!("/metrics/inflight"), Box::new(MetricsInflightHandler{}));
+        r.routes.insert(endpoint!("/metrics/tenants"), Box::new(MetricsTenantsHandler{}));
+        r.routes.insert(endpoint!("/metrics/memory"), Box::new(MetricsMemoryHandler{}));
         r
     };
 }
@@ -79,6 +79,14 @@ pub enum ApiResponsePayload {
     BackendMetrics(String),
     BlobcacheMetrics(String),
     InflightMetrics(String),
+    /// Disk usage of local cache directories.
+    CacheUsage(String),
+    /// Mounted filesystem instances with their stats.
+    MountsInfo(String),
+    /// Stats of the instances of each tenant.
+    TenantsMetrics(String),
+    /// Memory usage of the daemon by subsystem.
+    MemoryMetrics(String),
 }
 
 /// This is the response sent by the API server through the mpsc channel.
@@ -92,6 +100,8 @@ pub enum ApiRequest {
     Mount(String, ApiMountCmd),
     Remount(String, ApiMountCmd),
     Umount(String),
+    Prefetch(String, ApiPrefetchCmd),
+    ExportMountsInfo(Option<String>),
     ConfigureDaemon(DaemonConf),
     ExportGlobalMetrics(Option<String>),
     ExportFilesMetrics(Option<String>, bool),
@@ -99,7 +109,12 @@ pub enum ApiRequest {
     ExportBackendMetrics(Option<String>),
     ExportBlobcacheMetrics(Option<String>),
     ExportInflightMetrics,
+    ExportTenantsMetrics(Option<String>),
+    ExportMemoryMetrics,
     ExportFsBackendInfo(String),
+    ExportCacheUsage,
+    TrimCache(CacheTrimCmd),
+    UpdateCredential(CredentialCmd),
     SendFuseFd,
     Takeover,
     Exit,
@@ -113,6 +128,22 @@ pub struct ApiMountCmd {
     pub config: String,
     #[serde(default)]
     pub prefetch_files: Option<Vec<String>>,
+    /// Tenant owning the instance on a daemon shared by multiple tenants.
+    #[serde(default)]
+    pub tenant: Option<String>,
+    /// Writable overlay to mount over the instance, the instance is its lower directory.
+    #[serde(default)]
+    pub overlay: Option<ApiMountOverlay>,
+}
+
+#[derive(Clone, Deserialize, Debug)]
+pub struct ApiMountOverlay {
+    /// Upper directory of overlayfs, created if missing and removed on umount.
+    pub upper_dir: String,
+    /// Work directory of overlayfs, created if missing and removed on umount.
+    pub work_dir: String,
+    /// Where the overlay is mounted, created if missing.
+    pub target: String,
 }
 
 #[derive(Clone, Deserialize, Debug)]
@@ -120,13 +151,51 @@ pub struct ApiUmountCmd {
     pub mountpoint: String,
 }
 
+#[derive(Clone, Deserialize, Debug)]
+pub struct ApiPrefetchCmd {
+    /// Files and directories to prefetch, the paths are absolute in the filesystem instance.
+    pub files: Vec<String>,
+}
+
+#[derive(Clone, Default, Deserialize, Debug)]
+pub struct CacheTrimCmd {
+    /// Target disk usage in bytes of each cache directory, the size quota by default.
+    #[serde(default)]
+    pub target: Option<u64>,
+}
+
+#[derive(Clone, Deserialize, Debug)]
+pub struct CredentialCmd {
+    /// Host of the registry whose backends get the credential.
+    pub host: String,
+    /// Only update the backends of this repository, all repositories of the host by default.
+    #[serde(default)]
+    pub repo: Option<String>,
+    /// Base64 encoded `username:password`.
+    #[serde(default)]
+    pub auth: Option<String>,
+    /// Bearer token to use until it expires.
+    #[serde(default)]
+    pub registry_token: Option<String>,
+}
+
 fn parse_body<'a, F: Deserialize<'a>>(b: &'a Body) -> Result<F, HttpError> {
     serde_json::from_slice::<F>(b.raw()).map_err(HttpError::ParseBody)
 }
 
 #[derive(Clone, Deserialize, Debug)]
 pub struct DaemonConf {
-    pub log_level: String,
+    #[serde(default)]
+    pub log_level: Option<String>,
+    /// Download bandwidth of all storage backends in bytes per second, zero means unlimited.
+    #[serde(default)]
+    pub bandwidth_rate: Option<u64>,
+    /// Concurrent requests to all storage backends, zero means unlimited.
+    #[serde(default)]
+    pub fetch_concurrency: Option<usize>,
+    /// Memory budget of the daemon in bytes, zero means unlimited.
+    #[serde(default)]
+    pub memory_budget: Option<u64>,
 }
 
 /// Errors associated with Nydus management
@@ -153,6 +222,10 @@ pub enum HttpError {
     BackendMetrics(ApiError),
     FsBackendInfo(ApiError),
     InflightMetrics(ApiError),
+    TenantsMetrics(ApiError),
+    MemoryMetrics(ApiError),
+    Cache(ApiError),
+    Credential(ApiError),
 }
 
 fn success_response(body: Option<String>) -> Response {
@@ -224,6 +297,10 @@ fn convert_to_response<O: FnOnce(ApiError) -> HttpError>(api_resp: ApiResponse,
                 BlobcacheMetrics(d) => success_response(Some(d)),
                 FsBackendInfo(d) => success_response(Some(d)),
                 InflightMetrics(d) => success_response(Some(d)),
+                CacheUsage(d) => success_response(Some(d)),
+                MountsInfo(d) => success_response(Some(d)),
+                TenantsMetrics(d) => success_response(Some(d)),
+                MemoryMetrics(d) => success_response(Some(d)),
             }
         }
         Err(e) => {
@@ -279,7 +356,14 @@ impl EndpointHandler for MountHandler {
         req: &Request,
         kicker: &dyn Fn(ApiRequest) -> ApiResponse,
     ) -> HttpResult {
-        let mountpoint = extract_query_part(req, "mountpoint").ok_or_else(|| {
+        let mountpoint = extract_query_part(req, "mountpoint");
+        // List all instances if `mountpoint` isn't specified.
+        if let (Method::Get, None) = (req.method(), req.body.as_ref()) {
+            let r = kicker(ApiRequest::ExportMountsInfo(mountpoint));
+            return Ok(convert_to_response(r, HttpError::Mount));
+        }
+
+        let mountpoint = mountpoint.ok_or_else(|| {
             HttpError::QueryString("'mountpoint' should be specified in query string".to_string())
         })?;
         match (req.method(), req.body.as_ref()) {
@@ -302,6 +386,27 @@ impl EndpointHandler for MountHandler {
     }
 }
 
+pub struct PrefetchHandler {}
+impl EndpointHandler for PrefetchHandler {
+    fn handle_request(
+        &self,
+        req: &Request,
+        kicker: &dyn Fn(ApiRequest) -> ApiResponse,
+    ) -> HttpResult {
+        let mountpoint = extract_query_part(req, "mountpoint").ok_or_else(|| {
+            HttpError::QueryString("'mountpoint' should be specified in query string".to_string())
+        })?;
+        match (req.method(), req.body.as_ref()) {
+            (Method::Put, Some(body)) => {
+                let cmd = parse_body(body)?;
+                let r = kicker(ApiRequest::Prefetch(mountpoint, cmd));
+                Ok(convert_to_response(r, HttpError::Mount))
+            }
+            _ => Err(HttpError::BadRequest),
+        }
+    }
+}
+
 pub struct MetricsHandler {}
 impl EndpointHandler for MetricsHandler {
     fn handle_request(
@@ -411,6 +516,85 @@ impl EndpointHandler for MetricsInflightHandler {
     }
 }
 
+pub struct MetricsTenantsHandler {}
+impl EndpointHandler for MetricsTenantsHandler {
+    fn handle_request(
+        &self,
+        req: &Request,
+        kicker: &dyn Fn(ApiRequest) -> ApiResponse,
+    ) -> HttpResult {
+        match (req.method(), req.body.as_ref()) {
+            (Method::Get, None) => {
+                let tenant = extract_query_part(req, "tenant");
+                let r = kicker(ApiRequest::ExportTenantsMetrics(tenant));
+                Ok(convert_to_response(r, HttpError::TenantsMetrics))
+            }
+            _ => Err(HttpError::BadRequest),
+        }
+    }
+}
+
+pub struct MetricsMemoryHandler {}
+impl EndpointHandler for MetricsMemoryHandler {
+    fn handle_request(
+        &self,
+        req: &Request,
+        kicker: &dyn Fn(ApiRequest) -> ApiResponse,
+    ) -> HttpResult {
+        match (req.method(), req.body.as_ref()) {
+            (Method::Get, None) => {
+                let r = kicker(ApiRequest::ExportMemoryMetrics);
+                Ok(convert_to_response(r, HttpError::MemoryMetrics))
+            }
+            _ => Err(HttpError::BadRequest),
+        }
+    }
+}
+
+pub struct CacheHandler {}
+impl EndpointHandler for CacheHandler {
+    fn handle_request(
+        &self,
+        req: &Request,
+        kicker: &dyn Fn(ApiRequest) -> ApiResponse,
+    ) -> HttpResult {
+        match (req.method(), req.body.as_ref()) {
+            (Method::Get, None) => {
+                let r = kicker(ApiRequest::ExportCacheUsage);
+                Ok(convert_to_response(r, HttpError::Cache))
+            }
+            (Method::Put, None) => {
+                let r = kicker(ApiRequest::TrimCache(CacheTrimCmd::default()));
+                Ok(convert_to_response(r, HttpError::Cache))
+            }
+            (Method::Put, Some(body)) => {
+                let cmd = parse_body(body)?;
+                let r = kicker(ApiRequest::TrimCache(cmd));
+                Ok(convert_to_response(r, HttpError::Cache))
+            }
+            _ => Err(HttpError::BadRequest),
+        }
+    }
+}
+
+pub struct CredentialHandler {}
+impl EndpointHandler for CredentialHandler {
+    fn handle_request(
+        &self,
+        req: &Request,
+        kicker: &dyn Fn(ApiRequest) -> ApiResponse,
+    ) -> HttpResult {
+        match (req.method(), req.body.as_ref()) {
+            (Method::Put, Some(body)) => {
+                let cmd = parse_body(body)?;
+                let r = kicker(ApiRequest::UpdateCredential(cmd));
+                Ok(convert_to_response(r, HttpError::Credential))
+            }
+            _ => Err(HttpError::BadRequest),
+        }
+    }
+}
+
 pub struct SendFuseFdHandler {}
 impl EndpointHandler for SendFuseFdHandler {
     fn handle_request(
@@ -0,0 +1,129 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// The containerd-nydus-grpc serves a containerd remote snapshotter for nydus images, configured
+// as a proxy plugin of containerd:
+//
+//	[proxy_plugins]
+//	  [proxy_plugins.nydus]
+//	    type = "snapshot"
+//	    address = "/run/containerd-nydus-grpc/containerd-nydus-grpc.sock"
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/contrib/snapshotservice"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/snapshot"
+)
+
+var (
+	Version   = "development"
+	BuildTime = "unknown"
+)
+
+func run(c *cli.Context) error {
+	level, err := logrus.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return errors.Wrap(err, "parse log level")
+	}
+	logrus.SetLevel(level)
+
+	nydusdConfig, err := ioutil.ReadFile(c.String("nydusd-config"))
+	if err != nil {
+		return errors.Wrap(err, "read nydusd config template")
+	}
+	sn, err := snapshot.NewSnapshotter(snapshot.Config{
+		Root:         c.String("root"),
+		NydusdPath:   c.String("nydusd-path"),
+		NydusdConfig: nydusdConfig,
+	})
+	if err != nil {
+		return errors.Wrap(err, "create snapshotter")
+	}
+	defer sn.Close()
+
+	address := c.String("address")
+	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+		return errors.Wrap(err, "create directory of address")
+	}
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale address")
+	}
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return errors.Wrapf(err, "listen on %s", address)
+	}
+
+	rpc := grpc.NewServer()
+	snapshotsapi.RegisterSnapshotsServer(rpc, snapshotservice.FromSnapshotter(sn))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rpc.Serve(l)
+	}()
+	logrus.Infof("serve nydus snapshotter on %s", address)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		logrus.Infof("received signal %s, exiting", sig)
+		rpc.GracefulStop()
+		return nil
+	case err := <-errCh:
+		return errors.Wrap(err, "serve snapshotter")
+	}
+}
+
+func main() {
+	app := &cli.App{
+		Name:    "containerd-nydus-grpc",
+		Usage:   "containerd remote snapshotter for nydus images",
+		Version: Version + ", build " + BuildTime,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "address",
+				Value: "/run/containerd-nydus-grpc/containerd-nydus-grpc.sock",
+				Usage: "unix socket to serve the snapshots API of containerd",
+			},
+			&cli.StringFlag{
+				Name:  "root",
+				Value: "/var/lib/containerd-nydus-grpc",
+				Usage: "directory of the snapshots and their metadata",
+			},
+			&cli.StringFlag{
+				Name:  "nydusd-path",
+				Value: "nydusd",
+				Usage: "path of nydusd binary",
+			},
+			&cli.StringFlag{
+				Name:     "nydusd-config",
+				Required: true,
+				Usage:    "nydusd config template, the host and repo of registry backend are filled by the image reference if missing",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: "info",
+				Usage: "log level: trace, debug, info, warn, error",
+			},
+		},
+		Action: run,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
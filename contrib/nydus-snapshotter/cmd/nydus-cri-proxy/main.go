@@ -0,0 +1,115 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// The nydus-cri-proxy serves the CRI image service between kubelet and containerd, and pulls the
+// nydus image converted from the requested one if it exists. kubelet is started with:
+//
+//	--image-service-endpoint=unix:///run/nydus-cri-proxy/nydus-cri-proxy.sock
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/criproxy"
+)
+
+var (
+	Version   = "development"
+	BuildTime = "unknown"
+)
+
+func run(c *cli.Context) error {
+	level, err := logrus.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return errors.Wrap(err, "parse log level")
+	}
+	logrus.SetLevel(level)
+
+	proxy, err := criproxy.New(criproxy.Config{
+		Backend:   c.String("backend"),
+		Repo:      c.String("nydus-repo"),
+		TagSuffix: c.String("tag-suffix"),
+	})
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+
+	address := c.String("address")
+	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+		return errors.Wrap(err, "create directory of address")
+	}
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale address")
+	}
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return errors.Wrapf(err, "listen on %s", address)
+	}
+
+	server := proxy.Server()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(l)
+	}()
+	logrus.Infof("serve CRI image service proxy on %s", address)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		logrus.Infof("received signal %s, exiting", sig)
+		server.GracefulStop()
+		return nil
+	case err := <-errCh:
+		return errors.Wrap(err, "serve proxy")
+	}
+}
+
+func main() {
+	app := &cli.App{
+		Name:    "nydus-cri-proxy",
+		Usage:   "CRI image service proxy pulling converted nydus images",
+		Version: Version + ", build " + BuildTime,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "address",
+				Value: "/run/nydus-cri-proxy/nydus-cri-proxy.sock",
+				Usage: "unix socket to serve the CRI image service",
+			},
+			&cli.StringFlag{
+				Name:  "backend",
+				Value: "/run/containerd/containerd.sock",
+				Usage: "unix socket of the CRI image service of containerd",
+			},
+			&cli.StringFlag{
+				Name:  "nydus-repo",
+				Usage: "repository prefix of the converted images, e.g. registry.example.com/nydus, the repository of the original image by default",
+			},
+			&cli.StringFlag{
+				Name:  "tag-suffix",
+				Value: "-nydus",
+				Usage: "suffix appended to the tag of the original image to get the converted image",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: "info",
+				Usage: "log level: trace, debug, info, warn, error",
+			},
+		},
+		Action: run,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
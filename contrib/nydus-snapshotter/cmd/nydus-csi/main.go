@@ -0,0 +1,126 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// The nydus-csi is a CSI node plugin mounting nydus images as read-only volumes of pods, run by
+// a DaemonSet with the node-driver-registrar sidecar.
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/csi"
+)
+
+var (
+	Version   = "development"
+	BuildTime = "unknown"
+)
+
+func run(c *cli.Context) error {
+	level, err := logrus.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return errors.Wrap(err, "parse log level")
+	}
+	logrus.SetLevel(level)
+
+	nydusdConfig, err := ioutil.ReadFile(c.String("nydusd-config"))
+	if err != nil {
+		return errors.Wrap(err, "read nydusd config template")
+	}
+	driver, err := csi.New(csi.Config{
+		Root:         c.String("root"),
+		NodeID:       c.String("node-id"),
+		Version:      Version,
+		NydusdPath:   c.String("nydusd-path"),
+		NydusdConfig: nydusdConfig,
+	})
+	if err != nil {
+		return errors.Wrap(err, "create driver")
+	}
+
+	address := strings.TrimPrefix(c.String("endpoint"), "unix://")
+	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+		return errors.Wrap(err, "create directory of endpoint")
+	}
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale endpoint")
+	}
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return errors.Wrapf(err, "listen on %s", address)
+	}
+
+	server := driver.Server()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(l)
+	}()
+	logrus.Infof("serve CSI driver %s on %s", csi.DriverName, address)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		logrus.Infof("received signal %s, exiting", sig)
+		server.GracefulStop()
+		return nil
+	case err := <-errCh:
+		return errors.Wrap(err, "serve CSI driver")
+	}
+}
+
+func main() {
+	app := &cli.App{
+		Name:    "nydus-csi",
+		Usage:   "CSI node plugin mounting nydus images as read-only volumes",
+		Version: Version + ", build " + BuildTime,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "endpoint",
+				Value: "unix:///csi/csi.sock",
+				Usage: "unix socket to serve the CSI services, `unix://<path>` or the path",
+			},
+			&cli.StringFlag{
+				Name:     "node-id",
+				Required: true,
+				Usage:    "ID of the node, e.g. the node name",
+			},
+			&cli.StringFlag{
+				Name:  "root",
+				Value: "/var/lib/nydus-csi",
+				Usage: "directory of the volumes served by nydusd",
+			},
+			&cli.StringFlag{
+				Name:  "nydusd-path",
+				Value: "nydusd",
+				Usage: "path of nydusd binary",
+			},
+			&cli.StringFlag{
+				Name:     "nydusd-config",
+				Required: true,
+				Usage:    "nydusd config template, the host and repo of registry backend are filled by the image reference if missing",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: "info",
+				Usage: "log level: trace, debug, info, warn, error",
+			},
+		},
+		Action: run,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// The nydusd-grpc serves the management API of a nydusd over gRPC, i.e. service
+// `nydus.daemon.v1.Daemon` of pkg/mgmt/daemon.proto, translating the requests to the HTTP API on
+// the API socket of nydusd.
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/mgmt"
+)
+
+var (
+	Version   = "development"
+	BuildTime = "unknown"
+)
+
+func run(c *cli.Context) error {
+	level, err := logrus.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return errors.Wrap(err, "parse log level")
+	}
+	logrus.SetLevel(level)
+
+	address := c.String("address")
+	if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+		return errors.Wrap(err, "create directory of address")
+	}
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove stale address")
+	}
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return errors.Wrapf(err, "listen on %s", address)
+	}
+
+	server := mgmt.New(c.String("apisock")).Server()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(l)
+	}()
+	logrus.Infof("serve management API of nydusd %s on %s", c.String("apisock"), address)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		logrus.Infof("received signal %s, exiting", sig)
+		server.GracefulStop()
+		return nil
+	case err := <-errCh:
+		return errors.Wrap(err, "serve management API")
+	}
+}
+
+func main() {
+	app := &cli.App{
+		Name:    "nydusd-grpc",
+		Usage:   "gRPC management API of nydusd",
+		Version: Version + ", build " + BuildTime,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "apisock",
+				Required: true,
+				Usage:    "API socket of nydusd, i.e. its `--apisock` option",
+			},
+			&cli.StringFlag{
+				Name:  "address",
+				Value: "/run/nydusd-grpc/nydusd-grpc.sock",
+				Usage: "unix socket to serve the gRPC API",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: "info",
+				Usage: "log level: trace, debug, info, warn, error",
+			},
+		},
+		Action: run,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+module github.com/dragonflyoss/image-service/contrib/nydus-snapshotter
+
+go 1.16
+
+require (
+	github.com/containerd/containerd v1.5.9
+	github.com/containerd/continuity v0.1.0
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.2
+	github.com/pkg/errors v0.9.1
+	github.com/sirupsen/logrus v1.8.1
+	github.com/stretchr/testify v1.7.1
+	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/sys v0.0.0-20211007075335-d3039528d8ac
+	google.golang.org/grpc v1.33.2
+	google.golang.org/protobuf v1.27.1
+)
+
+replace (
+	github.com/containerd/containerd => github.com/containerd/containerd v1.5.9
+	github.com/opencontainers/image-spec => github.com/opencontainers/image-spec v1.0.2
+	github.com/opencontainers/runc => github.com/opencontainers/runc v1.0.3
+)
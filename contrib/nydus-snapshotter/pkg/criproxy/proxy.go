@@ -0,0 +1,254 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package criproxy implements a proxy of the CRI image service between kubelet and containerd,
+// which pulls the nydus image converted from the requested one if it exists.
+//
+// The converted image of `<registry>/<repo>:<tag>` is `<Repo>/<repo>:<tag><TagSuffix>`, or
+// `<registry>/<repo>:<tag><TagSuffix>` if Repo is empty, i.e. the nydus image pushed by nydusify
+// with the target reference. kubelet is pointed to the proxy by `--image-service-endpoint`, the
+// requests are forwarded to containerd as is, except the image reference of PullImage is replaced
+// by the converted image if it exists, and ImageStatus and RemoveImage of the pulled images are
+// replaced then. The image ID returned by PullImage is the converted one, which is used by
+// kubelet to create containers.
+package criproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	dockerremote "github.com/containerd/containerd/remotes/docker"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+const (
+	pullImageMethod   = "PullImage"
+	imageStatusMethod = "ImageStatus"
+	removeImageMethod = "RemoveImage"
+)
+
+var imageServices = []string{"/runtime.v1alpha2.ImageService/", "/runtime.v1.ImageService/"}
+
+type Config struct {
+	// Unix socket of the CRI image service of containerd.
+	Backend string
+	// Repository prefix of the converted images, e.g. `registry.example.com/nydus`, empty means
+	// the converted images are in the same repositories as the original ones.
+	Repo string
+	// Suffix appended to the tag of the original image, e.g. `-nydus`.
+	TagSuffix string
+}
+
+// Check whether image `ref` exists in its registry, with the auth config of the request.
+type existsFunc func(ctx context.Context, ref string, auth *AuthConfig) (bool, error)
+
+type Proxy struct {
+	config  Config
+	backend *grpc.ClientConn
+	exists  existsFunc
+
+	// Converted images pulled in place of the original ones.
+	mu        sync.Mutex
+	converted map[string]string
+}
+
+// New connects to the CRI image service of containerd and returns the proxy.
+func New(config Config) (*Proxy, error) {
+	conn, err := grpc.Dial(config.Backend,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connect to %s", config.Backend)
+	}
+
+	return &Proxy{
+		config:    config,
+		backend:   conn,
+		exists:    imageExists,
+		converted: map[string]string{},
+	}, nil
+}
+
+// Server returns a gRPC server forwarding all requests to containerd.
+func (p *Proxy) Server() *grpc.Server {
+	return grpc.NewServer(
+		grpc.CustomCodec(rawgrpc.Codec{}),
+		grpc.UnknownServiceHandler(p.handle),
+	)
+}
+
+func (p *Proxy) Close() error {
+	return p.backend.Close()
+}
+
+func (p *Proxy) handle(srv interface{}, stream grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return errors.New("no method in stream")
+	}
+	// All methods of the image service are unary.
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	req, err := p.rewrite(ctx, method, req)
+	if err != nil {
+		return err
+	}
+
+	var resp []byte
+	if err := p.backend.Invoke(ctx, method, &req, &resp, grpc.ForceCodec(rawgrpc.Codec{})); err != nil {
+		return err
+	}
+	return stream.SendMsg(&resp)
+}
+
+// Replace the image of the request with the converted one if needed.
+func (p *Proxy) rewrite(ctx context.Context, method string, req []byte) ([]byte, error) {
+	var name string
+	for _, service := range imageServices {
+		if strings.HasPrefix(method, service) {
+			name = strings.TrimPrefix(method, service)
+		}
+	}
+	if name != pullImageMethod && name != imageStatusMethod && name != removeImageMethod {
+		return req, nil
+	}
+
+	ref, err := getImage(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse request of %s", method)
+	}
+	if ref == "" {
+		return req, nil
+	}
+
+	var target string
+	if name == pullImageMethod {
+		if target, err = p.substitute(ctx, ref, req); err != nil {
+			logrus.WithError(err).Warnf("failed to find converted image of %s, pull it as is", ref)
+			return req, nil
+		}
+	} else {
+		p.mu.Lock()
+		target = p.converted[ref]
+		p.mu.Unlock()
+	}
+	if target == "" {
+		return req, nil
+	}
+
+	return setImage(req, target)
+}
+
+// Return the converted image of `ref` if it exists, otherwise empty.
+func (p *Proxy) substitute(ctx context.Context, ref string, req []byte) (string, error) {
+	target, err := p.convertedRef(ref)
+	if err != nil || target == "" {
+		return "", err
+	}
+
+	auth, err := getAuth(req)
+	if err != nil {
+		return "", errors.Wrap(err, "parse auth config")
+	}
+	exists, err := p.exists(ctx, target, auth)
+	if err != nil {
+		return "", errors.Wrapf(err, "check image %s", target)
+	}
+	if !exists {
+		logrus.Debugf("no converted image %s, pull %s as is", target, ref)
+		return "", nil
+	}
+
+	logrus.Infof("pull converted image %s in place of %s", target, ref)
+	p.mu.Lock()
+	p.converted[ref] = target
+	p.mu.Unlock()
+
+	return target, nil
+}
+
+// Get the reference of the image converted from `ref`, empty if it can't be converted, e.g. the
+// image is referenced by digest.
+func (p *Proxy) convertedRef(ref string) (string, error) {
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse image reference %s", ref)
+	}
+	tagged, ok := named.(docker.Tagged)
+	if !ok {
+		return "", nil
+	}
+
+	repo := p.config.Repo
+	if repo == "" {
+		repo = docker.Domain(named)
+	}
+	return strings.TrimSuffix(repo, "/") + "/" + docker.Path(named) + ":" + tagged.Tag() + p.config.TagSuffix, nil
+}
+
+// Check whether image `ref` exists by resolving its manifest. The auth config of the request is
+// only sent to the registry it's for.
+func imageExists(ctx context.Context, ref string, auth *AuthConfig) (bool, error) {
+	credentials := func(host string) (string, string, error) {
+		if auth == nil || (auth.ServerAddress != "" && !sameHost(auth.ServerAddress, host)) {
+			return "", "", nil
+		}
+		if auth.IdentityToken != "" {
+			return "", auth.IdentityToken, nil
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", errors.Wrap(err, "decode auth")
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return "", "", errors.New("invalid auth")
+			}
+			return parts[0], parts[1], nil
+		}
+		return auth.Username, auth.Password, nil
+	}
+
+	var resolver remotes.Resolver = dockerremote.NewResolver(dockerremote.ResolverOptions{
+		Hosts: dockerremote.ConfigureDefaultRegistries(
+			dockerremote.WithAuthorizer(dockerremote.NewDockerAuthorizer(dockerremote.WithAuthCreds(credentials))),
+			dockerremote.WithPlainHTTP(dockerremote.MatchLocalhost),
+		),
+	})
+	if _, _, err := resolver.Resolve(ctx, ref); err != nil {
+		if errdefs.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func sameHost(serverAddress, host string) bool {
+	serverAddress = strings.TrimPrefix(strings.TrimPrefix(serverAddress, "https://"), "http://")
+	serverAddress = strings.SplitN(serverAddress, "/", 2)[0]
+	if serverAddress == "docker.io" || serverAddress == "index.docker.io" {
+		serverAddress = "registry-1.docker.io"
+	}
+	return serverAddress == host
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package criproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+const pullImage = "/runtime.v1alpha2.ImageService/PullImage"
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// Build an image request with an annotation of the image spec and the auth config.
+func imageRequest(ref string) []byte {
+	var annotation []byte
+	annotation = appendString(annotation, 1, "key")
+	annotation = appendString(annotation, 2, "value")
+	var spec []byte
+	spec = appendString(spec, imageSpecRefField, ref)
+	spec = protowire.AppendTag(spec, 2, protowire.BytesType)
+	spec = protowire.AppendBytes(spec, annotation)
+	var auth []byte
+	auth = appendString(auth, authUsernameField, "user")
+	auth = appendString(auth, authPasswordField, "secret")
+
+	var req []byte
+	req = protowire.AppendTag(req, requestImageField, protowire.BytesType)
+	req = protowire.AppendBytes(req, spec)
+	req = protowire.AppendTag(req, requestAuthField, protowire.BytesType)
+	return protowire.AppendBytes(req, auth)
+}
+
+func TestWire(t *testing.T) {
+	req := imageRequest("docker.io/library/nginx:latest")
+	ref, err := getImage(req)
+	require.NoError(t, err)
+	require.Equal(t, "docker.io/library/nginx:latest", ref)
+
+	req, err = setImage(req, "docker.io/library/nginx:latest-nydus")
+	require.NoError(t, err)
+	ref, err = getImage(req)
+	require.NoError(t, err)
+	require.Equal(t, "docker.io/library/nginx:latest-nydus", ref)
+	auth, err := getAuth(req)
+	require.NoError(t, err)
+	require.Equal(t, "user", auth.Username)
+	require.Equal(t, "secret", auth.Password)
+	spec, _, err := rawgrpc.GetBytesField(req, requestImageField)
+	require.NoError(t, err)
+	_, ok, err := rawgrpc.GetBytesField(spec, 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = getImage([]byte{0xff})
+	require.Error(t, err)
+}
+
+func TestConvertedRef(t *testing.T) {
+	p := &Proxy{config: Config{TagSuffix: "-nydus"}}
+	ref, err := p.convertedRef("nginx")
+	require.NoError(t, err)
+	require.Equal(t, "docker.io/library/nginx:latest-nydus", ref)
+
+	p.config.Repo = "registry.example.com/nydus/"
+	ref, err = p.convertedRef("ghcr.io/org/app:v1")
+	require.NoError(t, err)
+	require.Equal(t, "registry.example.com/nydus/org/app:v1-nydus", ref)
+
+	ref, err = p.convertedRef("nginx@sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac")
+	require.NoError(t, err)
+	require.Equal(t, "", ref)
+}
+
+func TestProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-cri-proxy-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The backend echoes the image of the requests.
+	backendSock := filepath.Join(dir, "backend.sock")
+	l, err := net.Listen("unix", backendSock)
+	require.NoError(t, err)
+	backend := grpc.NewServer(grpc.CustomCodec(rawgrpc.Codec{}), grpc.UnknownServiceHandler(
+		func(srv interface{}, stream grpc.ServerStream) error {
+			var req []byte
+			if err := stream.RecvMsg(&req); err != nil {
+				return err
+			}
+			ref, err := getImage(req)
+			if err != nil {
+				return err
+			}
+			resp := []byte(ref)
+			return stream.SendMsg(&resp)
+		}))
+	go backend.Serve(l)
+	defer backend.Stop()
+
+	p, err := New(Config{Backend: backendSock, TagSuffix: "-nydus"})
+	require.NoError(t, err)
+	defer p.Close()
+	p.exists = func(ctx context.Context, ref string, auth *AuthConfig) (bool, error) {
+		require.Equal(t, "user", auth.Username)
+		return ref == "docker.io/library/nginx:latest-nydus", nil
+	}
+	proxySock := filepath.Join(dir, "proxy.sock")
+	l, err = net.Listen("unix", proxySock)
+	require.NoError(t, err)
+	server := p.Server()
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(proxySock, grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	require.NoError(t, err)
+	defer conn.Close()
+	call := func(method, ref string) string {
+		req := imageRequest(ref)
+		var resp []byte
+		require.NoError(t, conn.Invoke(context.Background(), method, &req, &resp, grpc.ForceCodec(rawgrpc.Codec{})))
+		return string(resp)
+	}
+
+	// Fall back to the original image without converted one.
+	require.Equal(t, "busybox:latest", call(pullImage, "busybox:latest"))
+	require.Equal(t, "busybox:latest", call("/runtime.v1alpha2.ImageService/ImageStatus", "busybox:latest"))
+
+	// The converted image is used after pulled.
+	require.Equal(t, "nginx:latest", call("/runtime.v1alpha2.ImageService/ImageStatus", "nginx:latest"))
+	require.Equal(t, "docker.io/library/nginx:latest-nydus", call(pullImage, "nginx:latest"))
+	require.Equal(t, "docker.io/library/nginx:latest-nydus", call("/runtime.v1.ImageService/ImageStatus", "nginx:latest"))
+	require.Equal(t, "docker.io/library/nginx:latest-nydus", call("/runtime.v1alpha2.ImageService/RemoveImage", "nginx:latest"))
+
+	// Other methods are forwarded as is.
+	require.Equal(t, "nginx:latest", call("/runtime.v1alpha2.ImageService/ListImages", "nginx:latest"))
+}
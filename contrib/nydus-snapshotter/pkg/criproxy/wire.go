@@ -0,0 +1,83 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package criproxy
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+// Field numbers of the CRI image service messages, the same in runtime.v1alpha2 and runtime.v1.
+// PullImageRequest, ImageStatusRequest and RemoveImageRequest have the ImageSpec as field 1, and
+// PullImageRequest has the AuthConfig as field 2.
+const (
+	requestImageField = 1
+	requestAuthField  = 2
+	imageSpecRefField = 1
+
+	authUsernameField      = 1
+	authPasswordField      = 2
+	authAuthField          = 3
+	authServerAddressField = 4
+	authIdentityTokenField = 5
+	authRegistryTokenField = 6
+)
+
+// AuthConfig of the registry passed by kubelet in PullImageRequest.
+type AuthConfig struct {
+	Username      string
+	Password      string
+	Auth          string
+	ServerAddress string
+	IdentityToken string
+	RegistryToken string
+}
+
+// getImage returns the image reference of the ImageSpec in the request.
+func getImage(req []byte) (string, error) {
+	spec, _, err := rawgrpc.GetBytesField(req, requestImageField)
+	if err != nil {
+		return "", err
+	}
+	ref, _, err := rawgrpc.GetBytesField(spec, imageSpecRefField)
+	return string(ref), err
+}
+
+// setImage replaces the image reference of the ImageSpec in the request, the other fields, e.g.
+// the annotations of the image and the auth config, are kept.
+func setImage(req []byte, ref string) ([]byte, error) {
+	spec, _, err := rawgrpc.GetBytesField(req, requestImageField)
+	if err != nil {
+		return nil, err
+	}
+	if spec, err = rawgrpc.SetBytesField(spec, imageSpecRefField, []byte(ref)); err != nil {
+		return nil, err
+	}
+	return rawgrpc.SetBytesField(req, requestImageField, spec)
+}
+
+// getAuth returns the auth config in PullImageRequest, nil if not specified.
+func getAuth(req []byte) (*AuthConfig, error) {
+	b, ok, err := rawgrpc.GetBytesField(req, requestAuthField)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	auth := &AuthConfig{}
+	err = rawgrpc.ParseStrings(b, map[protowire.Number]*string{
+		authUsernameField:      &auth.Username,
+		authPasswordField:      &auth.Password,
+		authAuthField:          &auth.Auth,
+		authServerAddressField: &auth.ServerAddress,
+		authIdentityTokenField: &auth.IdentityToken,
+		authRegistryTokenField: &auth.RegistryToken,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
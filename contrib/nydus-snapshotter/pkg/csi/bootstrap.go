@@ -0,0 +1,184 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package csi
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	dockerremote "github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+// Path of the bootstrap in the metadata layer of nydus image.
+const bootstrapPathInLayer = "image/image.boot"
+
+// Limit of the manifests, the same as containerd.
+const maxManifestSize = 4 << 20
+
+// Get the username and password of registry `host`.
+type credentialsFunc func(host string) (string, string, error)
+
+// Fetch the bootstrap of nydus image `ref` from its registry to file `dst`, and return the
+// annotations of the bootstrap layer. The image is either a manifest or an index, whose manifest
+// of the current platform is used.
+func fetchBootstrap(ctx context.Context, ref, dst string, credentials credentialsFunc) (map[string]string, error) {
+	var resolver remotes.Resolver = dockerremote.NewResolver(dockerremote.ResolverOptions{
+		Hosts: dockerremote.ConfigureDefaultRegistries(
+			dockerremote.WithAuthorizer(dockerremote.NewDockerAuthorizer(dockerremote.WithAuthCreds(credentials))),
+			dockerremote.WithPlainHTTP(dockerremote.MatchLocalhost),
+		),
+	})
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve image %s", ref)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get fetcher of image %s", ref)
+	}
+
+	manifest, err := fetchManifest(ctx, fetcher, desc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetch manifest of image %s", ref)
+	}
+	var layer *ocispec.Descriptor
+	for i := range manifest.Layers {
+		if manifest.Layers[i].Annotations[label.NydusMetaLayer] == "true" {
+			layer = &manifest.Layers[i]
+		}
+	}
+	if layer == nil {
+		return nil, errors.Errorf("image %s isn't a nydus image, no bootstrap layer", ref)
+	}
+
+	if err := fetchBootstrapLayer(ctx, fetcher, *layer, dst); err != nil {
+		return nil, errors.Wrapf(err, "fetch bootstrap layer %s", layer.Digest)
+	}
+	return layer.Annotations, nil
+}
+
+func fetchManifest(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) (*ocispec.Manifest, error) {
+	b, err := fetchBlob(ctx, fetcher, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, errors.Wrap(err, "parse manifest")
+		}
+		return &manifest, nil
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return nil, errors.Wrap(err, "parse index")
+		}
+		matcher := platforms.Default()
+		for _, m := range index.Manifests {
+			if m.Platform == nil || matcher.Match(*m.Platform) {
+				return fetchManifest(ctx, fetcher, m)
+			}
+		}
+		return nil, errors.Errorf("no manifest of platform %s", platforms.DefaultString())
+	default:
+		return nil, errors.Errorf("unsupported media type %s", desc.MediaType)
+	}
+}
+
+// Fetch the content of `desc` and check it by the digest.
+func fetchBlob(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	if desc.Size > maxManifestSize {
+		return nil, errors.Errorf("size %d of %s is too large", desc.Size, desc.Digest)
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(rc, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if desc.Digest.Algorithm().FromBytes(b) != desc.Digest {
+		return nil, errors.Errorf("digest mismatch of %s", desc.Digest)
+	}
+	return b, nil
+}
+
+// Extract the bootstrap from the bootstrap layer to `dst`. The layer is read to the end to check
+// its digest, and `dst` is only created if it matches.
+func fetchBootstrapLayer(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, dst string) error {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	verifier := desc.Digest.Verifier()
+	gz, err := gzip.NewReader(io.TeeReader(rc, verifier))
+	if err != nil {
+		return errors.Wrap(err, "decompress layer")
+	}
+	tmp := dst + ".tmp"
+	defer os.Remove(tmp)
+
+	found := false
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "read layer")
+		}
+		if found || strings.TrimPrefix(hdr.Name, "./") != bootstrapPathInLayer {
+			continue
+		}
+		if err := writeFile(tmp, tr); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return errors.Errorf("no %s in layer", bootstrapPathInLayer)
+	}
+	if _, err := io.Copy(ioutil.Discard, io.TeeReader(rc, verifier)); err != nil {
+		return errors.Wrap(err, "read layer")
+	}
+	if !verifier.Verified() {
+		return errors.New("digest mismatch")
+	}
+
+	return errors.Wrap(os.Rename(tmp, dst), "rename bootstrap")
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create bootstrap")
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return errors.Wrap(err, "write bootstrap")
+	}
+	return errors.Wrap(f.Close(), "write bootstrap")
+}
@@ -0,0 +1,383 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package csi implements a CSI node plugin mounting nydus images as read-only volumes, i.e. the
+// Identity and Node services of csi.v1, so images such as ML models are used as the data volumes
+// of pods without being unpacked. The image is given by the `image` attribute of the volume:
+//
+//	volumes:
+//	- name: model
+//	  csi:
+//	    driver: nydus.csi.dragonflyoss.io
+//	    volumeAttributes:
+//	      image: registry.example.com/models/bert:v1-nydus
+//
+// NodePublishVolume fetches the bootstrap of the image from its registry, starts a nydusd serving
+// it, and bind mounts the nydusd mountpoint to the target path read-only. The registry username
+// and password are taken from the `username` and `password` secrets of the volume if any.
+// NodeUnpublishVolume umounts the target path and stops the nydusd. There is no controller
+// service or staging, the volumes are ephemeral inline volumes or statically provisioned PVs.
+package csi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+// DriverName is the name of the CSI driver, referenced by `driver` of the volumes.
+const DriverName = "nydus.csi.dragonflyoss.io"
+
+const (
+	identityService = "/csi.v1.Identity/"
+	nodeService     = "/csi.v1.Node/"
+
+	// Attribute of the volume context for the image reference.
+	imageAttribute = "image"
+	// Secrets of the volume for the registry auth.
+	usernameSecret = "username"
+	passwordSecret = "password"
+
+	bootstrapName = "image.boot"
+	// CIDs of the blobs on IPFS from the bootstrap layer, kept with the bootstrap to restart nydusd.
+	cidsName       = "ipfs-cids.json"
+	fuseSuperMagic = 0x65735546
+)
+
+type Config struct {
+	// Directory of the volumes, each is served by a nydusd in its own subdirectory.
+	Root string
+	// ID of the node, returned by NodeGetInfo.
+	NodeID string
+	// Version of the driver, returned by GetPluginInfo.
+	Version    string
+	NydusdPath string
+	// Nydusd config template, the host and repo of registry backend are filled by the image
+	// reference if missing.
+	NydusdConfig []byte
+}
+
+type method func(ctx context.Context, req []byte) ([]byte, error)
+
+type Driver struct {
+	config  Config
+	methods map[string]method
+	fetch   func(ctx context.Context, ref, dst string, credentials credentialsFunc) (map[string]string, error)
+
+	// Daemons started for the published volumes, from the volume IDs. It's lost on restart,
+	// while the nydusd instances keep running and are stopped by umounting their mountpoints.
+	mu      sync.Mutex
+	daemons map[string]*daemon.Daemon
+}
+
+// New returns the driver serving volumes in `config.Root`.
+func New(config Config) (*Driver, error) {
+	if err := os.MkdirAll(filepath.Join(config.Root, "volumes"), 0700); err != nil {
+		return nil, errors.Wrap(err, "create root directory")
+	}
+
+	d := &Driver{
+		config:  config,
+		fetch:   fetchBootstrap,
+		daemons: map[string]*daemon.Daemon{},
+	}
+	d.methods = map[string]method{
+		identityService + "GetPluginInfo":         d.getPluginInfo,
+		identityService + "GetPluginCapabilities": empty,
+		identityService + "Probe":                 probe,
+		nodeService + "NodePublishVolume":         d.nodePublishVolume,
+		nodeService + "NodeUnpublishVolume":       d.nodeUnpublishVolume,
+		nodeService + "NodeGetCapabilities":       empty,
+		nodeService + "NodeGetInfo":               d.nodeGetInfo,
+	}
+	return d, nil
+}
+
+// Server returns a gRPC server of the Identity and Node services.
+func (d *Driver) Server() *grpc.Server {
+	return grpc.NewServer(
+		grpc.CustomCodec(rawgrpc.Codec{}),
+		grpc.UnknownServiceHandler(d.handle),
+	)
+}
+
+func (d *Driver) handle(srv interface{}, stream grpc.ServerStream) error {
+	name, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal, "no method in stream")
+	}
+	m, ok := d.methods[name]
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", name)
+	}
+	// All methods are unary.
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	resp, err := m(stream.Context(), req)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to handle %s", name)
+		if _, ok := status.FromError(err); !ok {
+			err = status.Error(codes.Internal, err.Error())
+		}
+		return err
+	}
+	return stream.SendMsg(&resp)
+}
+
+// No capabilities of the plugin and node, i.e. no controller service and no staging.
+func empty(_ context.Context, _ []byte) ([]byte, error) {
+	return nil, nil
+}
+
+func probe(_ context.Context, _ []byte) ([]byte, error) {
+	ready := rawgrpc.AppendBool(nil, boolValueField, true)
+	return rawgrpc.AppendBytes(nil, probeReadyField, ready), nil
+}
+
+func (d *Driver) getPluginInfo(_ context.Context, _ []byte) ([]byte, error) {
+	resp := rawgrpc.AppendString(nil, pluginInfoNameField, DriverName)
+	return rawgrpc.AppendString(resp, pluginInfoVersionField, d.config.Version), nil
+}
+
+func (d *Driver) nodeGetInfo(_ context.Context, _ []byte) ([]byte, error) {
+	return rawgrpc.AppendString(nil, nodeInfoNodeIDField, d.config.NodeID), nil
+}
+
+// Directory of volume `id`, named by its digest since the ID is any string. It's truncated to
+// keep the API socket of nydusd in it short.
+func (d *Driver) volumeDir(id string) string {
+	digest := sha256.Sum256([]byte(id))
+	return filepath.Join(d.config.Root, "volumes", hex.EncodeToString(digest[:16]))
+}
+
+func (d *Driver) nodePublishVolume(ctx context.Context, req []byte) ([]byte, error) {
+	r, err := parsePublishRequest(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "parse request: %s", err)
+	}
+	if r.VolumeID == "" || r.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and target path are required")
+	}
+	if r.Block {
+		return nil, status.Error(codes.InvalidArgument, "block volume isn't supported")
+	}
+	ref := r.VolumeContext[imageAttribute]
+	if ref == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume attribute %s is required", imageAttribute)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if mounted(r.TargetPath) {
+		return nil, nil
+	}
+	dir := d.volumeDir(r.VolumeID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create volume directory")
+	}
+	bootstrap := filepath.Join(dir, bootstrapName)
+	if _, err := os.Stat(bootstrap); err != nil {
+		credentials := func(string) (string, string, error) {
+			return r.Secrets[usernameSecret], r.Secrets[passwordSecret], nil
+		}
+		annotations, err := d.fetch(ctx, ref, bootstrap, credentials)
+		if err != nil {
+			os.RemoveAll(dir)
+			if errdefs.IsNotFound(err) {
+				return nil, status.Error(codes.NotFound, err.Error())
+			}
+			return nil, err
+		}
+		if cids := annotations[label.NydusIPFSCIDs]; cids != "" {
+			if err := ioutil.WriteFile(filepath.Join(dir, cidsName), []byte(cids), 0600); err != nil {
+				os.RemoveAll(dir)
+				return nil, errors.Wrap(err, "write CIDs of blobs")
+			}
+		}
+	}
+
+	dm, ok := d.daemons[r.VolumeID]
+	if !ok {
+		dm = d.newDaemon(r.VolumeID)
+		if !dm.Mounted() {
+			if err := d.startDaemon(dm, ref, r.Secrets); err != nil {
+				os.RemoveAll(dir)
+				return nil, err
+			}
+		} else if err := dm.Adopt(d.config.NydusdPath); err != nil {
+			// The volume is still served, only without being recovered.
+			logrus.WithError(err).Warnf("failed to supervise nydusd of volume %s", r.VolumeID)
+		}
+		d.daemons[r.VolumeID] = dm
+	}
+	if err := bindMount(dm.Mountpoint(), r.TargetPath); err != nil {
+		if err := d.stopDaemon(r.VolumeID); err != nil {
+			logrus.WithError(err).Warnf("failed to clean up volume %s", r.VolumeID)
+		}
+		return nil, err
+	}
+	logrus.Infof("published volume %s of image %s at %s", r.VolumeID, ref, r.TargetPath)
+
+	return nil, nil
+}
+
+func (d *Driver) newDaemon(id string) *daemon.Daemon {
+	dir := d.volumeDir(id)
+	dm := daemon.New(dir, filepath.Join(dir, bootstrapName))
+	dm.Notify = func(e daemon.Event) {
+		entry := logrus.WithField("volume", id).WithField("event", e.Type)
+		switch e.Type {
+		case daemon.EventFailed:
+			entry.Errorf("failed to recover nydusd: %s", e.Message)
+		case daemon.EventRemounted:
+			entry.Warnf("nydusd is recovered, pods using the volume must be restarted: %s", e.Message)
+		default:
+			entry.Info(e.Message)
+		}
+	}
+	return dm
+}
+
+func (d *Driver) startDaemon(dm *daemon.Daemon, ref string, secrets map[string]string) error {
+	template, err := withAuth(d.config.NydusdConfig, secrets[usernameSecret], secrets[passwordSecret])
+	if err != nil {
+		return err
+	}
+	cids, err := ioutil.ReadFile(filepath.Join(dm.Dir, cidsName))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "read CIDs of blobs")
+	}
+	if err := dm.WriteConfig(template, ref, string(cids)); err != nil {
+		return errors.Wrap(err, "write nydusd config")
+	}
+	return dm.Start(d.config.NydusdPath)
+}
+
+func (d *Driver) nodeUnpublishVolume(_ context.Context, req []byte) ([]byte, error) {
+	volumeID, targetPath, err := parseUnpublishRequest(req)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "parse request: %s", err)
+	}
+	if volumeID == "" || targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id and target path are required")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if mounted(targetPath) {
+		if err := unix.Unmount(targetPath, 0); err != nil {
+			return nil, errors.Wrapf(err, "umount %s", targetPath)
+		}
+	}
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "remove %s", targetPath)
+	}
+	if err := d.stopDaemon(volumeID); err != nil {
+		return nil, err
+	}
+	logrus.Infof("unpublished volume %s at %s", volumeID, targetPath)
+
+	return nil, nil
+}
+
+// Stop the nydusd of volume `id` and remove its directory.
+func (d *Driver) stopDaemon(id string) error {
+	dir := d.volumeDir(id)
+	dm, ok := d.daemons[id]
+	if !ok {
+		dm = d.newDaemon(id)
+	}
+	if err := dm.Stop(); err != nil {
+		return errors.Wrap(err, "stop nydusd")
+	}
+	delete(d.daemons, id)
+	return errors.Wrap(os.RemoveAll(dir), "remove volume directory")
+}
+
+// Set the auth of registry backend, or the fallback registry of IPFS backend, in the nydusd config
+// template, unless it's set already.
+func withAuth(template []byte, username, password string) ([]byte, error) {
+	if username == "" && password == "" {
+		return template, nil
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(template, &config); err != nil {
+		return nil, errors.Wrap(err, "parse nydusd config template")
+	}
+	device, _ := config["device"].(map[string]interface{})
+	backend, _ := device["backend"].(map[string]interface{})
+	if backend == nil {
+		return template, nil
+	}
+	var registryConfig map[string]interface{}
+	switch backend["type"] {
+	case "registry":
+		registryConfig = subConfig(backend, "config")
+	case "ipfs":
+		registryConfig = subConfig(subConfig(backend, "config"), "fallback")
+	default:
+		return template, nil
+	}
+	if v, _ := registryConfig["auth"].(string); v == "" {
+		registryConfig["auth"] = base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+	return json.Marshal(config)
+}
+
+// Get the object `key` of `config`, which is created if missing.
+func subConfig(config map[string]interface{}, key string) map[string]interface{} {
+	sub, _ := config[key].(map[string]interface{})
+	if sub == nil {
+		sub = map[string]interface{}{}
+		config[key] = sub
+	}
+	return sub
+}
+
+// Check whether `path` is a mountpoint of nydusd, the bind mounts are also FUSE.
+func mounted(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Type == fuseSuperMagic
+}
+
+// Bind mount `source` to `target` read-only, the read-only flag is only applied by remounting.
+func bindMount(source, target string) error {
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return errors.Wrapf(err, "create %s", target)
+	}
+	if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return errors.Wrapf(err, "bind mount %s to %s", source, target)
+	}
+	if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		unix.Unmount(target, 0)
+		return errors.Wrapf(err, "remount %s read-only", target)
+	}
+	return nil
+}
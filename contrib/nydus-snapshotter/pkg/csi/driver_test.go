@@ -0,0 +1,284 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package csi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+func bootstrapLayer(t *testing.T, bootstrap []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "image", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: bootstrapPathInLayer, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(bootstrap))}))
+	_, err := tw.Write(bootstrap)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// Serve image `repo:tag` as an index of a nydus manifest, with the blobs by digests.
+func fakeRegistry(t *testing.T, repo, tag string, layer []byte) *httptest.Server {
+	blobs := map[digest.Digest][]byte{}
+	add := func(mediaType string, b []byte, annotations map[string]string) ocispec.Descriptor {
+		d := digest.FromBytes(b)
+		blobs[d] = b
+		return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(b)), Annotations: annotations}
+	}
+	marshal := func(v interface{}) []byte {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return b
+	}
+
+	config := add(ocispec.MediaTypeImageConfig, []byte("{}"), nil)
+	blob := add(ocispec.MediaTypeImageLayerGzip, []byte("blob"), map[string]string{label.NydusDataLayer: "true"})
+	meta := add(ocispec.MediaTypeImageLayerGzip, layer, map[string]string{label.NydusMetaLayer: "true"})
+	manifest := ocispec.Manifest{Config: config, Layers: []ocispec.Descriptor{blob, meta}}
+	manifest.SchemaVersion = 2
+	m := add(ocispec.MediaTypeImageManifest, marshal(manifest), nil)
+	platform := platforms.DefaultSpec()
+	m.Platform = &platform
+	index := ocispec.Index{Manifests: []ocispec.Descriptor{m}}
+	index.SchemaVersion = 2
+	root := add(ocispec.MediaTypeImageIndex, marshal(index), nil)
+
+	mediaTypes := map[digest.Digest]string{m.Digest: m.MediaType, root.Digest: root.MediaType}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := "/v2/" + repo + "/"
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)
+		d := digest.Digest(parts[1])
+		if parts[0] == "manifests" && parts[1] == tag {
+			d = root.Digest
+		}
+		b, ok := blobs[d]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if mediaType, ok := mediaTypes[d]; ok {
+			w.Header().Set("Content-Type", mediaType)
+		}
+		w.Header().Set("Docker-Content-Digest", d.String())
+		if r.Method != http.MethodHead {
+			w.Write(b)
+		}
+	}))
+}
+
+func TestFetchBootstrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-csi-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	registry := fakeRegistry(t, "models/bert", "v1", bootstrapLayer(t, []byte("bootstrap")))
+	defer registry.Close()
+	host := strings.TrimPrefix(registry.URL, "http://")
+	noAuth := func(string) (string, string, error) { return "", "", nil }
+
+	dst := filepath.Join(dir, bootstrapName)
+	annotations, err := fetchBootstrap(context.Background(), host+"/models/bert:v1", dst, noAuth)
+	require.NoError(t, err)
+	require.Equal(t, "true", annotations[label.NydusMetaLayer])
+	b, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "bootstrap", string(b))
+
+	_, err = fetchBootstrap(context.Background(), host+"/models/bert:v2", dst, noAuth)
+	require.True(t, errdefs.IsNotFound(err))
+
+	// The bootstrap layer without the bootstrap.
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	require.NoError(t, tar.NewWriter(gz).Close())
+	require.NoError(t, gz.Close())
+	registry = fakeRegistry(t, "models/bert", "v1", buf.Bytes())
+	defer registry.Close()
+	host = strings.TrimPrefix(registry.URL, "http://")
+	_, err = fetchBootstrap(context.Background(), host+"/models/bert:v1", filepath.Join(dir, "empty"), noAuth)
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "empty"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestWithAuth(t *testing.T) {
+	template := []byte(`{"device":{"backend":{"type":"registry","config":{"scheme":"https"}}}}`)
+	config, err := withAuth(template, "user", "pass")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"device":{"backend":{"type":"registry","config":{"scheme":"https","auth":"dXNlcjpwYXNz"}}}}`, string(config))
+
+	config, err = withAuth(template, "", "")
+	require.NoError(t, err)
+	require.Equal(t, template, config)
+
+	template = []byte(`{"device":{"backend":{"type":"registry","config":{"auth":"b3RoZXI6cGFzcw=="}}}}`)
+	config, err = withAuth(template, "user", "pass")
+	require.NoError(t, err)
+	require.JSONEq(t, string(template), string(config))
+
+	template = []byte(`{"device":{"backend":{"type":"ipfs","config":{"gateway":"http://127.0.0.1:8080"}}}}`)
+	config, err = withAuth(template, "user", "pass")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"device":{"backend":{"type":"ipfs","config":{"gateway":"http://127.0.0.1:8080","fallback":{"auth":"dXNlcjpwYXNz"}}}}}`, string(config))
+}
+
+func publishRequestOf(volumeID, targetPath string, context map[string]string, block bool) []byte {
+	var req []byte
+	req = rawgrpc.AppendString(req, publishVolumeIDField, volumeID)
+	req = rawgrpc.AppendString(req, publishTargetPathField, targetPath)
+	var capability []byte
+	if block {
+		capability = rawgrpc.AppendBytes(capability, capabilityBlockField, nil)
+	} else {
+		capability = rawgrpc.AppendBytes(capability, 2, nil)
+	}
+	req = rawgrpc.AppendBytes(req, publishCapabilityField, capability)
+	for k, v := range context {
+		var entry []byte
+		entry = rawgrpc.AppendString(entry, 1, k)
+		entry = rawgrpc.AppendString(entry, 2, v)
+		req = rawgrpc.AppendBytes(req, publishContextField, entry)
+	}
+	return req
+}
+
+func TestDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-csi-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d, err := New(Config{Root: filepath.Join(dir, "root"), NodeID: "node-1", Version: "v1.0.0"})
+	require.NoError(t, err)
+	d.fetch = func(ctx context.Context, ref, dst string, credentials credentialsFunc) (map[string]string, error) {
+		return nil, errors.Wrapf(errdefs.ErrNotFound, "image %s", ref)
+	}
+
+	sock := filepath.Join(dir, "csi.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	server := d.Server()
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(sock,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	call := func(method string, req []byte) ([]byte, error) {
+		var resp []byte
+		err := conn.Invoke(context.Background(), method, &req, &resp, grpc.ForceCodec(rawgrpc.Codec{}))
+		return resp, err
+	}
+	getString := func(b []byte, num protowire.Number) string {
+		v, _, err := rawgrpc.GetBytesField(b, num)
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	resp, err := call(identityService+"GetPluginInfo", nil)
+	require.NoError(t, err)
+	require.Equal(t, DriverName, getString(resp, pluginInfoNameField))
+	require.Equal(t, "v1.0.0", getString(resp, pluginInfoVersionField))
+
+	resp, err = call(identityService+"Probe", nil)
+	require.NoError(t, err)
+	ready, ok, err := rawgrpc.GetBytesField(resp, probeReadyField)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, rawgrpc.AppendBool(nil, boolValueField, true), ready)
+
+	resp, err = call(nodeService+"NodeGetCapabilities", nil)
+	require.NoError(t, err)
+	require.Empty(t, resp)
+
+	resp, err = call(nodeService+"NodeGetInfo", nil)
+	require.NoError(t, err)
+	require.Equal(t, "node-1", getString(resp, nodeInfoNodeIDField))
+
+	target := filepath.Join(dir, "target")
+	image := map[string]string{imageAttribute: "registry.example.com/models/bert:v1"}
+	_, err = call(nodeService+"NodePublishVolume", publishRequestOf("vol-1", target, nil, false))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = call(nodeService+"NodePublishVolume", publishRequestOf("vol-1", target, image, true))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = call(nodeService+"NodePublishVolume", publishRequestOf("", target, image, false))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = call(nodeService+"NodePublishVolume", publishRequestOf("vol-1", target, image, false))
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = os.Stat(d.volumeDir("vol-1"))
+	require.True(t, os.IsNotExist(err))
+
+	// Unpublishing is idempotent.
+	var req []byte
+	req = rawgrpc.AppendString(req, unpublishVolumeIDField, "vol-1")
+	req = rawgrpc.AppendString(req, unpublishTargetPathField, target)
+	_, err = call(nodeService+"NodeUnpublishVolume", req)
+	require.NoError(t, err)
+	_, err = call(nodeService+"NodeUnpublishVolume", rawgrpc.AppendString(nil, unpublishVolumeIDField, "vol-1"))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = call(nodeService+"NodeStageVolume", nil)
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestParsePublishRequest(t *testing.T) {
+	req := publishRequestOf("vol-1", "/target", map[string]string{imageAttribute: "img", "k": "v"}, false)
+	var entry []byte
+	entry = rawgrpc.AppendString(entry, 1, usernameSecret)
+	entry = rawgrpc.AppendString(entry, 2, "user")
+	req = rawgrpc.AppendBytes(req, publishSecretsField, entry)
+
+	r, err := parsePublishRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, &publishRequest{
+		VolumeID:      "vol-1",
+		TargetPath:    "/target",
+		Secrets:       map[string]string{usernameSecret: "user"},
+		VolumeContext: map[string]string{imageAttribute: "img", "k": "v"},
+	}, r)
+
+	r, err = parsePublishRequest(publishRequestOf("vol-1", "/target", nil, true))
+	require.NoError(t, err)
+	require.True(t, r.Block)
+}
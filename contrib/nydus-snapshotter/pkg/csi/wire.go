@@ -0,0 +1,75 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package csi
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+// Field numbers of the messages of csi.v1 in csi.proto of the CSI spec.
+const (
+	pluginInfoNameField    = 1
+	pluginInfoVersionField = 2
+
+	probeReadyField = 1
+	boolValueField  = 1
+
+	nodeInfoNodeIDField = 1
+
+	publishVolumeIDField   = 1
+	publishTargetPathField = 4
+	publishCapabilityField = 5
+	publishSecretsField    = 7
+	publishContextField    = 8
+
+	capabilityBlockField = 1
+
+	unpublishVolumeIDField   = 1
+	unpublishTargetPathField = 2
+)
+
+type publishRequest struct {
+	VolumeID      string
+	TargetPath    string
+	Block         bool
+	Secrets       map[string]string
+	VolumeContext map[string]string
+}
+
+func parsePublishRequest(b []byte) (*publishRequest, error) {
+	r := &publishRequest{}
+	err := rawgrpc.ParseStrings(b, map[protowire.Number]*string{
+		publishVolumeIDField:   &r.VolumeID,
+		publishTargetPathField: &r.TargetPath,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	capability, _, err := rawgrpc.GetBytesField(b, publishCapabilityField)
+	if err != nil {
+		return nil, err
+	}
+	if _, r.Block, err = rawgrpc.GetBytesField(capability, capabilityBlockField); err != nil {
+		return nil, err
+	}
+	if r.Secrets, err = rawgrpc.ParseStringMap(b, publishSecretsField); err != nil {
+		return nil, err
+	}
+	if r.VolumeContext, err = rawgrpc.ParseStringMap(b, publishContextField); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func parseUnpublishRequest(b []byte) (volumeID, targetPath string, err error) {
+	err = rawgrpc.ParseStrings(b, map[protowire.Number]*string{
+		unpublishVolumeIDField:   &volumeID,
+		unpublishTargetPathField: &targetPath,
+	}, nil)
+	return
+}
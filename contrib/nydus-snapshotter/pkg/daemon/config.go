@@ -0,0 +1,97 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+)
+
+const (
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// WriteConfig writes the nydusd config of image `ref` to ConfigPath(). It's generated from the
+// config template, with the host and repo of the registry backend filled by the image reference
+// if missing in the template. For the IPFS backend, `cids` is the JSON object of the blob CIDs
+// from the metadata layer, and the registry of the image is the fallback of the blobs.
+func (d *Daemon) WriteConfig(template []byte, ref, cids string) error {
+	config, err := generateConfig(template, ref, cids)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.ConfigPath(), config, 0600)
+}
+
+func generateConfig(template []byte, ref, cids string) ([]byte, error) {
+	var config map[string]interface{}
+	if err := json.Unmarshal(template, &config); err != nil {
+		return nil, errors.Wrap(err, "parse nydusd config template")
+	}
+
+	device, _ := config["device"].(map[string]interface{})
+	backend, _ := device["backend"].(map[string]interface{})
+	if backend == nil {
+		return nil, errors.New("no device.backend in nydusd config template")
+	}
+
+	switch backend["type"] {
+	case "registry":
+		if err := fillRegistry(subConfig(backend, "config"), ref); err != nil {
+			return nil, err
+		}
+	case "ipfs":
+		backendConfig := subConfig(backend, "config")
+		if cids != "" {
+			var m map[string]string
+			if err := json.Unmarshal([]byte(cids), &m); err != nil {
+				return nil, errors.Wrap(err, "parse CIDs of blobs")
+			}
+			backendConfig["cids"] = m
+		}
+		if err := fillRegistry(subConfig(backendConfig, "fallback"), ref); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// Get the object `key` of `config`, which is created if missing.
+func subConfig(config map[string]interface{}, key string) map[string]interface{} {
+	sub, _ := config[key].(map[string]interface{})
+	if sub == nil {
+		sub = map[string]interface{}{}
+		config[key] = sub
+	}
+	return sub
+}
+
+// Fill the host and repo of registry backend config by image `ref` if missing.
+func fillRegistry(backendConfig map[string]interface{}, ref string) error {
+	if ref == "" {
+		return errors.New("image reference is required by registry backend")
+	}
+	named, err := docker.ParseDockerRef(ref)
+	if err != nil {
+		return errors.Wrapf(err, "parse image reference %s", ref)
+	}
+	host := docker.Domain(named)
+	if host == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+
+	if v, _ := backendConfig["host"].(string); v == "" {
+		backendConfig["host"] = host
+	}
+	if v, _ := backendConfig["repo"].(string); v == "" {
+		backendConfig["repo"] = docker.Path(named)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package daemon
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func backendConfig(t *testing.T, config []byte) map[string]interface{} {
+	var c struct {
+		Device struct {
+			Backend struct {
+				Config map[string]interface{} `json:"config"`
+			} `json:"backend"`
+		} `json:"device"`
+	}
+	require.NoError(t, json.Unmarshal(config, &c))
+	return c.Device.Backend.Config
+}
+
+func TestGenerateConfig(t *testing.T) {
+	template := []byte(`{"device": {"backend": {"type": "registry", "config": {"auth": "dGVzdDp0ZXN0"}}}, "mode": "direct"}`)
+
+	config, err := generateConfig(template, "nginx:latest", "")
+	require.NoError(t, err)
+	backend := backendConfig(t, config)
+	require.Equal(t, "registry-1.docker.io", backend["host"])
+	require.Equal(t, "library/nginx", backend["repo"])
+	require.Equal(t, "dGVzdDp0ZXN0", backend["auth"])
+
+	config, err = generateConfig(template, "ghcr.io/dragonflyoss/image-service/nginx:nydus-latest", "")
+	require.NoError(t, err)
+	backend = backendConfig(t, config)
+	require.Equal(t, "ghcr.io", backend["host"])
+	require.Equal(t, "dragonflyoss/image-service/nginx", backend["repo"])
+
+	// The host and repo in the template are kept.
+	template = []byte(`{"device": {"backend": {"type": "registry", "config": {"host": "mirror:5000", "repo": "nginx"}}}}`)
+	config, err = generateConfig(template, "nginx:latest", "")
+	require.NoError(t, err)
+	backend = backendConfig(t, config)
+	require.Equal(t, "mirror:5000", backend["host"])
+	require.Equal(t, "nginx", backend["repo"])
+
+	_, err = generateConfig(template, "", "")
+	require.Error(t, err)
+	_, err = generateConfig([]byte(`{"device": {}}`), "nginx:latest", "")
+	require.Error(t, err)
+
+	// Other backends don't need the image reference.
+	template = []byte(`{"device": {"backend": {"type": "localfs", "config": {"dir": "/blobs"}}}}`)
+	config, err = generateConfig(template, "", "")
+	require.NoError(t, err)
+	require.Nil(t, backendConfig(t, config)["host"])
+
+	// The CIDs and the fallback registry of IPFS backend.
+	template = []byte(`{"device": {"backend": {"type": "ipfs", "config": {"gateway": "http://127.0.0.1:8080", "fallback": {"auth": "dGVzdDp0ZXN0"}}}}}`)
+	config, err = generateConfig(template, "ghcr.io/dragonflyoss/nginx:nydus", `{"blob1": "bafkreiabc"}`)
+	require.NoError(t, err)
+	backend = backendConfig(t, config)
+	require.Equal(t, "http://127.0.0.1:8080", backend["gateway"])
+	require.Equal(t, map[string]interface{}{"blob1": "bafkreiabc"}, backend["cids"])
+	require.Equal(t, map[string]interface{}{
+		"host": "ghcr.io",
+		"repo": "dragonflyoss/nginx",
+		"auth": "dGVzdDp0ZXN0",
+	}, backend["fallback"])
+
+	_, err = generateConfig(template, "ghcr.io/dragonflyoss/nginx:nydus", "invalid")
+	require.Error(t, err)
+}
@@ -0,0 +1,296 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/supervisor"
+)
+
+const (
+	configFileName     = "nydusd.json"
+	apiSockName        = "api.sock"
+	logFileName        = "nydusd.log"
+	mountDirName       = "mnt"
+	supervisorSockName = "supervisor.sock"
+	mountsFileName     = "mounts.json"
+
+	fuseSuperMagic = 0x65735546
+
+	readyTimeout = 10 * time.Second
+)
+
+// How long to wait for nydusd to exit after the rootfs is umounted, shortened in tests.
+var stopTimeout = 10 * time.Second
+
+// Daemon is a nydusd instance serving the rootfs of an image from its bootstrap. The config,
+// API socket, log and mountpoint of the instance are kept in the directory `Dir`.
+//
+// The FUSE session and mount states of nydusd are kept by a supervisor, so that nydusd exiting
+// unexpectedly is recovered by a new nydusd taking over the session, see supervise.go.
+type Daemon struct {
+	Dir       string
+	Bootstrap string
+	// Notify is called with the events of recovering nydusd, if not nil.
+	Notify func(Event)
+
+	nydusd     string
+	supervisor *supervisor.Supervisor
+
+	mu       sync.Mutex
+	proc     *process
+	stopping bool
+}
+
+// A started nydusd process.
+type process struct {
+	cmd *exec.Cmd
+	// Closed when the process exits, with the result of Wait() in err.
+	exited chan struct{}
+	err    error
+}
+
+// New returns the nydusd instance serving the image of `bootstrap`, using directory `dir`.
+func New(dir, bootstrap string) *Daemon {
+	return &Daemon{
+		Dir:       dir,
+		Bootstrap: bootstrap,
+	}
+}
+
+func (d *Daemon) ConfigPath() string {
+	return filepath.Join(d.Dir, configFileName)
+}
+
+func (d *Daemon) APISock() string {
+	return filepath.Join(d.Dir, apiSockName)
+}
+
+func (d *Daemon) Mountpoint() string {
+	return filepath.Join(d.Dir, mountDirName)
+}
+
+func (d *Daemon) SupervisorSock() string {
+	return filepath.Join(d.Dir, supervisorSockName)
+}
+
+// Mounted checks whether the rootfs is mounted, e.g. by the nydusd started before the snapshotter
+// restarts.
+func (d *Daemon) Mounted() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(d.Mountpoint(), &st); err != nil {
+		return false
+	}
+	return st.Type == fuseSuperMagic
+}
+
+// Start nydusd with binary `nydusd` and wait until it's running. The config must have been
+// written to ConfigPath().
+func (d *Daemon) Start(nydusd string) error {
+	if err := d.supervise(nydusd); err != nil {
+		return err
+	}
+	d.umountStale()
+	p, err := d.spawn(false)
+	if err != nil {
+		return err
+	}
+	if err := d.waitReady(p, true); err != nil {
+		return err
+	}
+	d.keepSession()
+
+	return d.run(p)
+}
+
+// Start a nydusd process, which takes over the FUSE session from the supervisor if `upgrade`.
+func (d *Daemon) spawn(upgrade bool) (*process, error) {
+	if err := os.MkdirAll(d.Mountpoint(), 0755); err != nil {
+		return nil, errors.Wrap(err, "create mountpoint")
+	}
+	if err := os.Remove(d.APISock()); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "remove stale api socket")
+	}
+	logFile, err := os.OpenFile(filepath.Join(d.Dir, logFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open nydusd log")
+	}
+	defer logFile.Close()
+
+	args := []string{
+		"--config", d.ConfigPath(),
+		"--bootstrap", d.Bootstrap,
+		"--mountpoint", d.Mountpoint(),
+		"--apisock", d.APISock(),
+		"--log-level", "info",
+		"--id", filepath.Base(d.Dir),
+		"--supervisor", d.SupervisorSock(),
+	}
+	if upgrade {
+		args = append(args, "--upgrade")
+	}
+	cmd := exec.Command(d.nydusd, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Keep nydusd running when the snapshotter is stopped, the rootfs is used by containers.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	logrus.Infof("start nydusd: %s", cmd.String())
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "start nydusd")
+	}
+
+	p := &process{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+// Wait until nydusd serves its API, and its state is RUNNING if `running`. The process is killed
+// if it isn't ready in time.
+func (d *Daemon) waitReady(p *process, running bool) error {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		state, err := getDaemonState(d.APISock())
+		if err == nil && (!running || state == "RUNNING") {
+			return nil
+		}
+		if err == nil {
+			err = errors.Errorf("nydusd isn't ready, current state %s", state)
+		}
+		select {
+		case <-p.exited:
+			return errors.Wrapf(err, "nydusd exited: %v", p.err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			p.cmd.Process.Kill()
+			<-p.exited
+			return errors.Wrapf(err, "nydusd isn't running after %s", readyTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Stop umounts the rootfs, then nydusd exits since the FUSE session is closed.
+func (d *Daemon) Stop() error {
+	d.mu.Lock()
+	d.stopping = true
+	p := d.proc
+	d.mu.Unlock()
+
+	// The session kept by the supervisor would keep the FUSE connection after nydusd exits.
+	if d.supervisor != nil {
+		d.supervisor.Drop()
+	}
+	if d.Mounted() {
+		if err := unix.Unmount(d.Mountpoint(), 0); err != nil {
+			logrus.WithError(err).Warnf("umount %s, detach it instead", d.Mountpoint())
+			if err := unix.Unmount(d.Mountpoint(), unix.MNT_DETACH); err != nil {
+				return errors.Wrapf(err, "umount %s", d.Mountpoint())
+			}
+		}
+	}
+	if d.supervisor != nil {
+		if err := d.supervisor.Close(true); err != nil {
+			logrus.WithError(err).Warnf("close supervisor of %s", d.Mountpoint())
+		}
+	}
+	if p == nil {
+		return nil
+	}
+
+	select {
+	case <-p.exited:
+	case <-time.After(stopTimeout):
+		logrus.Warnf("nydusd of %s doesn't exit after %s, kill it", d.Bootstrap, stopTimeout)
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+	d.mu.Lock()
+	d.proc = nil
+	d.mu.Unlock()
+
+	return nil
+}
+
+type daemonInfo struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
+type errorMessage struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Send a request to `path` of the API of nydusd on `socket` with the JSON body `in`, and decode
+// the JSON response into `out` if it's not nil.
+func apiRequest(socket, method, path string, in, out interface{}) error {
+	transport := http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: 5 * time.Second}
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	client := http.Client{Transport: &transport, Timeout: 5 * time.Second}
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://unix/api/v1"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var message errorMessage
+		json.Unmarshal(b, &message)
+		return errors.Errorf("request error, status = %d, message %s", resp.StatusCode, message.Message)
+	}
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+func getDaemonState(socket string) (string, error) {
+	var info daemonInfo
+	if err := apiRequest(socket, http.MethodGet, "/daemon", nil, &info); err != nil {
+		return "", err
+	}
+	return info.State, nil
+}
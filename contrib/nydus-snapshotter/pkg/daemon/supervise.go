@@ -0,0 +1,295 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/supervisor"
+)
+
+const (
+	recoverRetries = 3
+	recoverBackoff = time.Second
+
+	// Interval to check the nydusd adopted after the snapshotter restarts, which isn't a child
+	// process to wait for.
+	pollInterval = 5 * time.Second
+	pollFailures = 3
+)
+
+var errStopping = errors.New("nydusd is being stopped")
+
+// EventType is the type of an event of recovering nydusd.
+type EventType string
+
+const (
+	// nydusd exited unexpectedly, or stopped serving its API.
+	EventExited EventType = "exited"
+	// A new nydusd took over the FUSE session kept by the supervisor, so the mounts used by
+	// containers keep working.
+	EventTakenOver EventType = "taken-over"
+	// The FUSE session was lost, a new nydusd mounted the instances again. The containers using
+	// the previous mount have to be restarted.
+	EventRemounted EventType = "remounted"
+	// nydusd can't be recovered.
+	EventFailed EventType = "failed"
+)
+
+// Event of recovering nydusd, passed to Daemon.Notify.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Mountpoint of the nydusd.
+	Mountpoint string
+	Message    string
+}
+
+// Filesystem types of the mount API by the backend types in the mount states.
+var fsTypes = map[string]string{
+	"Rafs":          "rafs",
+	"PassthroughFs": "passthrough_fs",
+}
+
+// Adopt the running nydusd started before the snapshotter restarts, which is recovered with the
+// binary `nydusd` if it exits.
+func (d *Daemon) Adopt(nydusd string) error {
+	if err := d.supervise(nydusd); err != nil {
+		return err
+	}
+	d.keepSession()
+	go d.poll()
+
+	return nil
+}
+
+// Listen on the supervisor socket, with the mount states persisted by the previous supervisor.
+func (d *Daemon) supervise(nydusd string) error {
+	d.mu.Lock()
+	d.nydusd = nydusd
+	d.stopping = false
+	d.mu.Unlock()
+	if d.supervisor != nil {
+		return nil
+	}
+
+	s, err := supervisor.New(d.SupervisorSock(), filepath.Join(d.Dir, mountsFileName))
+	if err != nil {
+		return errors.Wrap(err, "create supervisor")
+	}
+	d.supervisor = s
+
+	return nil
+}
+
+// Let the supervisor keep the FUSE session and mount states of nydusd.
+func (d *Daemon) keepSession() {
+	err := d.supervisor.Receive(func() error {
+		return apiRequest(d.APISock(), http.MethodPut, "/daemon/fuse/sendfd", nil, nil)
+	})
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to keep FUSE session of %s, it can't be taken over", d.Mountpoint())
+	}
+}
+
+// Set the running process and watch it, the process is killed if nydusd is being stopped.
+func (d *Daemon) run(p *process) error {
+	d.mu.Lock()
+	if d.stopping {
+		d.mu.Unlock()
+		p.cmd.Process.Kill()
+		<-p.exited
+		return errStopping
+	}
+	d.proc = p
+	d.mu.Unlock()
+
+	go func() {
+		<-p.exited
+		d.mu.Lock()
+		current := !d.stopping && d.proc == p
+		d.mu.Unlock()
+		if current {
+			d.recover(fmt.Sprintf("nydusd exited: %v", p.err))
+		}
+	}()
+
+	return nil
+}
+
+// Check the adopted nydusd until it stops serving its API.
+func (d *Daemon) poll() {
+	failures := 0
+	for {
+		time.Sleep(pollInterval)
+		d.mu.Lock()
+		stopping := d.stopping || d.proc != nil
+		d.mu.Unlock()
+		if stopping {
+			return
+		}
+
+		_, err := getDaemonState(d.APISock())
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if failures++; failures >= pollFailures {
+			d.recover(fmt.Sprintf("nydusd doesn't serve its API: %v", err))
+			return
+		}
+	}
+}
+
+// Recover the exited nydusd. A new nydusd takes over the FUSE session kept by the supervisor,
+// otherwise the stale mountpoint is umounted and the instances are mounted again.
+func (d *Daemon) recover(reason string) {
+	logrus.Warnf("%s of %s, recover it", reason, d.Mountpoint())
+	d.notify(EventExited, reason)
+
+	var err error
+	if d.supervisor.HasSession() {
+		for i := 0; i < recoverRetries; i++ {
+			if err = d.retry(i, d.takeover); err == nil {
+				d.notify(EventTakenOver, "FUSE session is taken over by a new nydusd")
+				return
+			} else if err == errStopping {
+				return
+			}
+			logrus.WithError(err).Warnf("failed to take over FUSE session of %s", d.Mountpoint())
+		}
+	}
+
+	// The requests waiting for the lost session fail, then the mountpoint can be umounted.
+	d.supervisor.Drop()
+	for i := 0; i < recoverRetries; i++ {
+		if err = d.retry(i, d.remount); err == nil {
+			d.notify(EventRemounted, "instances are mounted again by a new nydusd")
+			return
+		} else if err == errStopping {
+			return
+		}
+		logrus.WithError(err).Warnf("failed to mount %s again", d.Mountpoint())
+	}
+
+	logrus.WithError(err).Errorf("failed to recover nydusd of %s", d.Mountpoint())
+	d.notify(EventFailed, err.Error())
+}
+
+// Run the `i`th attempt of `fn` after a backoff, unless nydusd is being stopped.
+func (d *Daemon) retry(i int, fn func() error) error {
+	if i > 0 {
+		time.Sleep(recoverBackoff << i)
+	}
+	d.mu.Lock()
+	stopping := d.stopping
+	d.mu.Unlock()
+	if stopping {
+		return errStopping
+	}
+	return fn()
+}
+
+// Start a new nydusd taking over the FUSE session kept by the supervisor.
+func (d *Daemon) takeover() error {
+	p, err := d.spawn(true)
+	if err != nil {
+		return err
+	}
+	if err := d.waitReady(p, false); err != nil {
+		return err
+	}
+	err = d.supervisor.Send(func() error {
+		return apiRequest(d.APISock(), http.MethodPut, "/daemon/fuse/takeover", nil, nil)
+	})
+	if err == nil {
+		err = d.waitReady(p, true)
+	}
+	if err != nil {
+		p.cmd.Process.Kill()
+		<-p.exited
+		return err
+	}
+
+	return d.run(p)
+}
+
+// Start a new nydusd mounting the instances in the mount states again.
+func (d *Daemon) remount() error {
+	mounts, err := d.supervisor.Mounts()
+	if err != nil {
+		return err
+	}
+	d.umountStale()
+	p, err := d.spawn(false)
+	if err != nil {
+		return err
+	}
+	if err := d.waitReady(p, true); err != nil {
+		return err
+	}
+
+	// The instance at `/` is mounted by the bootstrap argument, the others by the mount API.
+	for _, m := range mounts {
+		if m.Cmd.Mountpoint == "/" {
+			continue
+		}
+		if err := d.mount(&m.Cmd); err != nil {
+			p.cmd.Process.Kill()
+			<-p.exited
+			return errors.Wrapf(err, "mount %s", m.Cmd.Mountpoint)
+		}
+	}
+	d.keepSession()
+
+	return d.run(p)
+}
+
+func (d *Daemon) mount(cmd *supervisor.MountCmd) error {
+	fsType, ok := fsTypes[cmd.FsType]
+	if !ok {
+		fsType = strings.ToLower(cmd.FsType)
+	}
+	body := map[string]interface{}{
+		"source":         cmd.Source,
+		"fs_type":        fsType,
+		"config":         cmd.Config,
+		"prefetch_files": cmd.PrefetchFiles,
+		"tenant":         cmd.Tenant,
+	}
+	if len(cmd.Overlay) > 0 {
+		body["overlay"] = cmd.Overlay
+	}
+	query := url.Values{"mountpoint": []string{cmd.Mountpoint}}
+
+	return apiRequest(d.APISock(), http.MethodPost, "/mount?"+query.Encode(), body, nil)
+}
+
+// Umount the mountpoint left by the nydusd exited without its FUSE session kept, whose FUSE
+// connection is aborted.
+func (d *Daemon) umountStale() {
+	var st unix.Statfs_t
+	if err := unix.Statfs(d.Mountpoint(), &st); err != unix.ENOTCONN {
+		return
+	}
+	if err := unix.Unmount(d.Mountpoint(), unix.MNT_DETACH); err != nil {
+		logrus.WithError(err).Warnf("umount stale mountpoint %s", d.Mountpoint())
+	}
+}
+
+func (d *Daemon) notify(t EventType, message string) {
+	if d.Notify != nil {
+		d.Notify(Event{Type: t, Time: time.Now(), Mountpoint: d.Mountpoint(), Message: message})
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/supervisor"
+)
+
+const fakeNydusdEnv = "FAKE_NYDUSD"
+
+func TestMain(m *testing.M) {
+	// The test binary runs as the fake nydusd started by the tests.
+	if os.Getenv(fakeNydusdEnv) != "" {
+		fakeNydusd(os.Args[1:])
+		return
+	}
+	stopTimeout = 100 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// Serve the API of nydusd used by the supervisor, the mount requests are appended to the file
+// `mounted` and the states received by takeover are written to `takeover.json`.
+func fakeNydusd(args []string) {
+	flags := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			flags[args[i]] = args[i+1]
+			i++
+		} else {
+			flags[args[i]] = ""
+		}
+	}
+	apiSock, supervisorSock := flags["--apisock"], flags["--supervisor"]
+	dir := filepath.Dir(apiSock)
+
+	var mu sync.Mutex
+	state := "RUNNING"
+	if _, ok := flags["--upgrade"]; ok {
+		state = "INIT"
+	}
+	mounts := []supervisor.MountState{{Cmd: supervisor.MountCmd{FsType: "Rafs", Source: flags["--bootstrap"], Config: "{}", Mountpoint: "/"}}}
+
+	dial := func() (*net.UnixConn, error) {
+		return net.DialUnix("unix", nil, &net.UnixAddr{Name: supervisorSock, Net: "unix"})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/daemon", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id": flags["--id"], "state": state})
+	})
+	mux.HandleFunc("/api/v1/daemon/fuse/sendfd", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		states, _ := json.Marshal(mounts)
+		mu.Unlock()
+		fuse, err := os.OpenFile(filepath.Join(dir, "fuse"), os.O_CREATE|os.O_RDWR, 0600)
+		if err == nil {
+			defer fuse.Close()
+			var conn *net.UnixConn
+			if conn, err = dial(); err == nil {
+				defer conn.Close()
+				_, _, err = conn.WriteMsgUnix(states, unix.UnixRights(int(fuse.Fd())), nil)
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/v1/daemon/fuse/takeover", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := dial()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 0x1000)
+		oob := make([]byte, unix.CmsgSpace(4))
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		rest, _ := ioutil.ReadAll(conn)
+		states := append(buf[:n], rest...)
+		if err != nil || oobn == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ioutil.WriteFile(filepath.Join(dir, "takeover.json"), states, 0600)
+		mu.Lock()
+		json.Unmarshal(states, &mounts)
+		state = "RUNNING"
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/v1/mount", func(w http.ResponseWriter, r *http.Request) {
+		var cmd supervisor.MountCmd
+		json.NewDecoder(r.Body).Decode(&cmd)
+		cmd.Mountpoint = r.URL.Query().Get("mountpoint")
+		cmd.FsType = "Rafs"
+		mu.Lock()
+		mounts = append(mounts, supervisor.MountState{Cmd: cmd, VfsIndex: uint8(len(mounts))})
+		mu.Unlock()
+		f, _ := os.OpenFile(filepath.Join(dir, "mounted"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		f.WriteString(cmd.Mountpoint + "\n")
+		f.Close()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	l, err := net.Listen("unix", apiSock)
+	if err != nil {
+		os.Exit(1)
+	}
+	http.Serve(l, mux)
+}
+
+func waitEvent(t *testing.T, events chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(20 * time.Second):
+		t.Fatal("no event of recovering nydusd")
+		return Event{}
+	}
+}
+
+func kill(t *testing.T, d *Daemon) {
+	d.mu.Lock()
+	p := d.proc
+	d.mu.Unlock()
+	require.NotNil(t, p)
+	require.NoError(t, p.cmd.Process.Kill())
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusd-supervise-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv(fakeNydusdEnv, "1")
+	defer os.Unsetenv(fakeNydusdEnv)
+
+	events := make(chan Event, 16)
+	d := New(dir, filepath.Join(dir, "bootstrap"))
+	d.Notify = func(e Event) { events <- e }
+	require.NoError(t, d.Start(os.Args[0]))
+	require.True(t, d.supervisor.HasSession())
+
+	// An instance mounted by the API is in the mount states kept by the supervisor.
+	require.NoError(t, d.mount(&supervisor.MountCmd{FsType: "Rafs", Source: "/boot", Config: "{}", Mountpoint: "/sub"}))
+	d.keepSession()
+	mounts, err := d.supervisor.Mounts()
+	require.NoError(t, err)
+	require.Len(t, mounts, 2)
+	persisted, err := ioutil.ReadFile(filepath.Join(dir, mountsFileName))
+	require.NoError(t, err)
+	require.Contains(t, string(persisted), `"/sub"`)
+
+	// A new nydusd takes over the kept session.
+	kill(t, d)
+	e := waitEvent(t, events)
+	require.Equal(t, EventExited, e.Type)
+	require.Equal(t, d.Mountpoint(), e.Mountpoint)
+	require.Equal(t, EventTakenOver, waitEvent(t, events).Type)
+	states, err := ioutil.ReadFile(filepath.Join(dir, "takeover.json"))
+	require.NoError(t, err)
+	require.Equal(t, persisted, states)
+
+	// Without the session, a new nydusd mounts the instances again.
+	d.supervisor.Drop()
+	kill(t, d)
+	require.Equal(t, EventExited, waitEvent(t, events).Type)
+	require.Equal(t, EventRemounted, waitEvent(t, events).Type)
+	mounted, err := ioutil.ReadFile(filepath.Join(dir, "mounted"))
+	require.NoError(t, err)
+	require.Equal(t, "/sub\n/sub\n", string(mounted))
+	require.True(t, d.supervisor.HasSession())
+
+	// nydusd stopped on purpose isn't recovered.
+	require.NoError(t, d.Stop())
+	_, err = os.Stat(filepath.Join(dir, mountsFileName))
+	require.True(t, os.IsNotExist(err))
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %s after stop", e.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package label
+
+// Labels of the snapshots passed by containerd when unpacking the layers of an image, the ones
+// prefixed with `containerd.io/snapshot/` are copied from the annotations of the layers.
+const (
+	// Name of the committed snapshot of the layer being unpacked.
+	TargetSnapshotLabel = "containerd.io/snapshot.ref"
+	// Reference of the image, appended by CRI or `ctr-remote images rpull`.
+	ImageRef = "containerd.io/snapshot/cri.image-ref"
+	// Digest of the layer, appended by CRI or `ctr-remote images rpull`.
+	CRIDigest = "containerd.io/snapshot/cri.layer-digest"
+	// Data layer of nydus image, whose blob is read lazily by nydusd.
+	NydusDataLayer = "containerd.io/snapshot/nydus-blob"
+	// Metadata layer of nydus image, containing the bootstrap.
+	NydusMetaLayer = "containerd.io/snapshot/nydus-bootstrap"
+	// CIDs of the blobs published to IPFS as a JSON object from the blob IDs, set on the metadata
+	// layer by `nydusify convert --backend-type ipfs`.
+	NydusIPFSCIDs = "containerd.io/snapshot/nydus-ipfs-cids"
+	// Set on the snapshots of data layers, which are never unpacked.
+	RemoteLabel = "containerd.io/snapshot/remote"
+)
@@ -0,0 +1,148 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mgmt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const requestTimeout = 30 * time.Second
+
+// Error returned by the HTTP API of nydusd.
+type apiError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("request error, status = %d, message %s", e.StatusCode, e.Message)
+}
+
+// Client of the HTTP API of nydusd on its API socket.
+type client struct {
+	http *http.Client
+}
+
+func newClient(socket string) *client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: 5 * time.Second}
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &client{http: &http.Client{Transport: transport, Timeout: requestTimeout}}
+}
+
+// Send a request to `path` of the API with the JSON body `in`, and decode the JSON response into
+// `out` if it's not nil.
+func (c *client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return errors.Wrap(err, "encode request")
+		}
+	}
+	u := "http://unix/api/v1" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		e := &apiError{StatusCode: resp.StatusCode}
+		json.Unmarshal(b, e)
+		return e
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return errors.Wrapf(json.Unmarshal(b, out), "decode response of %s", path)
+}
+
+type daemonInfo struct {
+	ID      string `json:"id"`
+	State   string `json:"state"`
+	Version struct {
+		PackageVer string `json:"package_ver"`
+		GitCommit  string `json:"git_commit"`
+	} `json:"version"`
+}
+
+type mountCmd struct {
+	Source        string        `json:"source"`
+	FsType        string        `json:"fs_type"`
+	Config        string        `json:"config"`
+	PrefetchFiles []string      `json:"prefetch_files,omitempty"`
+	Tenant        string        `json:"tenant,omitempty"`
+	Overlay       *mountOverlay `json:"overlay,omitempty"`
+}
+
+// Writable overlayfs mounted by nydusd over an instance.
+type mountOverlay struct {
+	UpperDir string `json:"upper_dir"`
+	WorkDir  string `json:"work_dir"`
+	Target   string `json:"target"`
+}
+
+type mountInfo struct {
+	BackendType string   `json:"backend_type"`
+	Mountpoint  string   `json:"mountpoint"`
+	Source      string   `json:"source"`
+	Tenant      string   `json:"tenant"`
+	Blobs       []string `json:"blobs"`
+	Backend     struct {
+		ReadCount       uint64 `json:"read_count"`
+		ReadErrors      uint64 `json:"read_errors"`
+		ReadAmountTotal uint64 `json:"read_amount_total"`
+	} `json:"backend"`
+	CacheSize uint64        `json:"cache_size"`
+	Overlay   *mountOverlay `json:"overlay"`
+}
+
+type cacheUsage struct {
+	WorkDir string `json:"work_dir"`
+	Quota   uint64 `json:"quota"`
+	Used    uint64 `json:"used"`
+	Blobs   []struct {
+		BlobID     string `json:"blob_id"`
+		Size       uint64 `json:"size"`
+		LastAccess uint64 `json:"last_access"`
+		InUse      bool   `json:"in_use"`
+		Pinned     bool   `json:"pinned"`
+	} `json:"blobs"`
+}
+
+type prefetchCmd struct {
+	Files []string `json:"files"`
+}
@@ -0,0 +1,239 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mgmt serves the management API of nydusd over gRPC, i.e. service
+// `nydus.daemon.v1.Daemon` of daemon.proto, for node agents orchestrating nydusd. The requests
+// are translated to the HTTP API of nydusd on its API socket:
+//
+//	GetStatus      GET    /api/v1/daemon
+//	Mount          POST   /api/v1/mount?mountpoint=, or PUT to remount
+//	Umount         DELETE /api/v1/mount?mountpoint=
+//	ListMounts     GET    /api/v1/mount
+//	GetCacheStats  GET    /api/v1/daemon/cache
+//	Prefetch       PUT    /api/v1/mount/prefetch?mountpoint=
+//
+// The errors of nydusd are returned with the gRPC codes of their HTTP status.
+package mgmt
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+// Service is the versioned gRPC service name, methods are `/<Service>/<Method>`.
+const Service = "nydus.daemon.v1.Daemon"
+
+type method func(ctx context.Context, req []byte) ([]byte, error)
+
+type Server struct {
+	client  *client
+	methods map[string]method
+}
+
+// New returns the server managing the nydusd serving API socket `apiSock`.
+func New(apiSock string) *Server {
+	s := &Server{client: newClient(apiSock)}
+	s.methods = map[string]method{
+		"GetStatus":     s.getStatus,
+		"Mount":         s.mount,
+		"Umount":        s.umount,
+		"ListMounts":    s.listMounts,
+		"GetCacheStats": s.getCacheStats,
+		"Prefetch":      s.prefetch,
+	}
+	return s
+}
+
+// Server returns a gRPC server of the management API.
+func (s *Server) Server() *grpc.Server {
+	return grpc.NewServer(
+		grpc.CustomCodec(rawgrpc.Codec{}),
+		grpc.UnknownServiceHandler(s.handle),
+	)
+}
+
+func (s *Server) handle(srv interface{}, stream grpc.ServerStream) error {
+	name, ok := grpc.MethodFromServerStream(stream)
+	if !ok {
+		return status.Error(codes.Internal, "no method in stream")
+	}
+	m, ok := s.methods[strings.TrimPrefix(name, "/"+Service+"/")]
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", name)
+	}
+	// All methods are unary.
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	resp, err := m(stream.Context(), req)
+	if err != nil {
+		logrus.WithError(err).Warnf("failed to handle %s", name)
+		return toStatus(err)
+	}
+	return stream.SendMsg(&resp)
+}
+
+// Convert err to the gRPC status by the HTTP status of nydusd, nydusd is unavailable if the
+// request isn't responded.
+func toStatus(err error) error {
+	var code codes.Code
+	var e *apiError
+	switch {
+	case errors.As(err, &e):
+		switch e.StatusCode {
+		case http.StatusBadRequest:
+			code = codes.InvalidArgument
+		case http.StatusNotFound:
+			code = codes.NotFound
+		case http.StatusNotImplemented:
+			code = codes.Unimplemented
+		case http.StatusServiceUnavailable:
+			code = codes.Unavailable
+		default:
+			code = codes.Internal
+		}
+	case errors.Is(err, errInvalidRequest):
+		code = codes.InvalidArgument
+	default:
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
+
+var errInvalidRequest = errors.New("invalid request")
+
+func mountpointQuery(mountpoint string) (url.Values, error) {
+	if mountpoint == "" {
+		return nil, errors.Wrap(errInvalidRequest, "mountpoint is required")
+	}
+	return url.Values{"mountpoint": []string{mountpoint}}, nil
+}
+
+func (s *Server) getStatus(ctx context.Context, _ []byte) ([]byte, error) {
+	var info daemonInfo
+	if err := s.client.do(ctx, http.MethodGet, "/daemon", nil, nil, &info); err != nil {
+		return nil, err
+	}
+
+	var resp []byte
+	resp = rawgrpc.AppendString(resp, statusIDField, info.ID)
+	resp = rawgrpc.AppendString(resp, statusStateField, info.State)
+	resp = rawgrpc.AppendString(resp, statusVersionField, info.Version.PackageVer)
+	return rawgrpc.AppendString(resp, statusGitCommitField, info.Version.GitCommit), nil
+}
+
+func (s *Server) mount(ctx context.Context, req []byte) ([]byte, error) {
+	r, err := parseMountRequest(req)
+	if err != nil {
+		return nil, errors.Wrap(errInvalidRequest, err.Error())
+	}
+	query, err := mountpointQuery(r.Mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if r.Source == "" {
+		return nil, errors.Wrap(errInvalidRequest, "source is required")
+	}
+	if r.FsType == "" {
+		r.FsType = "rafs"
+	}
+
+	method := http.MethodPost
+	if r.Remount {
+		method = http.MethodPut
+	}
+	cmd := mountCmd{
+		Source:        r.Source,
+		FsType:        r.FsType,
+		Config:        r.Config,
+		PrefetchFiles: r.PrefetchFiles,
+		Tenant:        r.Tenant,
+		Overlay:       r.Overlay,
+	}
+	return nil, s.client.do(ctx, method, "/mount", query, &cmd, nil)
+}
+
+func (s *Server) umount(ctx context.Context, req []byte) ([]byte, error) {
+	var mountpoint string
+	if err := rawgrpc.ParseStrings(req, map[protowire.Number]*string{umountMountpointField: &mountpoint}, nil); err != nil {
+		return nil, errors.Wrap(errInvalidRequest, err.Error())
+	}
+	query, err := mountpointQuery(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.client.do(ctx, http.MethodDelete, "/mount", query, nil, nil)
+}
+
+func (s *Server) listMounts(ctx context.Context, _ []byte) ([]byte, error) {
+	var mounts []mountInfo
+	if err := s.client.do(ctx, http.MethodGet, "/mount", nil, nil, &mounts); err != nil {
+		return nil, err
+	}
+
+	var resp []byte
+	for _, m := range mounts {
+		resp = rawgrpc.AppendBytes(resp, listMountsField, encodeMountInfo(&m))
+	}
+	return resp, nil
+}
+
+func (s *Server) getCacheStats(ctx context.Context, _ []byte) ([]byte, error) {
+	var dirs []cacheUsage
+	if err := s.client.do(ctx, http.MethodGet, "/daemon/cache", nil, nil, &dirs); err != nil {
+		return nil, err
+	}
+
+	var resp []byte
+	for _, d := range dirs {
+		resp = rawgrpc.AppendBytes(resp, cacheStatsDirField, encodeCacheDir(&d))
+	}
+	return resp, nil
+}
+
+func (s *Server) prefetch(ctx context.Context, req []byte) ([]byte, error) {
+	var mountpoint string
+	var files []string
+	err := rawgrpc.ParseStrings(req,
+		map[protowire.Number]*string{prefetchMountpointField: &mountpoint},
+		map[protowire.Number]*[]string{prefetchFilesField: &files})
+	if err != nil {
+		return nil, errors.Wrap(errInvalidRequest, err.Error())
+	}
+	query, err := mountpointQuery(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.Wrap(errInvalidRequest, "no file to prefetch")
+	}
+	return nil, s.client.do(ctx, http.MethodPut, "/mount/prefetch", query, &prefetchCmd{Files: files}, nil)
+}
+
+// Dial connects to the management API served on unix socket `address`, for clients calling
+// the methods with Invoke of the connection.
+func Dial(address string) (*grpc.ClientConn, error) {
+	conn, err := grpc.Dial(address,
+		grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawgrpc.Codec{})),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	return conn, errors.Wrapf(err, "connect to %s", address)
+}
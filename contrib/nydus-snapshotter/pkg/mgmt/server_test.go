@@ -0,0 +1,209 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mgmt
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+// Serve a fake HTTP API of nydusd recording the mount and prefetch requests.
+func fakeNydusd(t *testing.T, socket string, mounts map[string]mountCmd, prefetches map[string][]string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/daemon", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"d1","state":"RUNNING","version":{"package_ver":"2.0.0","git_commit":"abc"}}`))
+	})
+	mux.HandleFunc("/api/v1/mount", func(w http.ResponseWriter, r *http.Request) {
+		mountpoint := r.URL.Query().Get("mountpoint")
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`[{"backend_type":"Rafs","mountpoint":"/sub","source":"/boot","tenant":"team-a",` +
+				`"blobs":["b1","b2"],"backend":{"read_count":3,"read_errors":1,"read_amount_total":4096},"cache_size":8192,` +
+				`"overlay":{"upper_dir":"/ctr/upper","work_dir":"/ctr/work","target":"/ctr/rootfs"}}]`))
+		case http.MethodPost, http.MethodPut:
+			var cmd mountCmd
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&cmd))
+			mounts[r.Method+" "+mountpoint] = cmd
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if _, ok := mounts["POST "+mountpoint]; !ok {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"code":"MountFailure","message":"not found"}`))
+				return
+			}
+			delete(mounts, "POST "+mountpoint)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/api/v1/daemon/cache", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"work_dir":"/cache","quota":100,"used":50,` +
+			`"blobs":[{"blob_id":"b1","size":50,"last_access":7,"in_use":true,"pinned":false}]}]`))
+	})
+	mux.HandleFunc("/api/v1/mount/prefetch", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPut, r.Method)
+		var cmd prefetchCmd
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&cmd))
+		prefetches[r.URL.Query().Get("mountpoint")] = cmd.Files
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := &http.Server{Handler: mux}
+	go server.Serve(l)
+	return server
+}
+
+func getString(t *testing.T, b []byte, num protowire.Number) string {
+	v, _, err := rawgrpc.GetBytesField(b, num)
+	require.NoError(t, err)
+	return string(v)
+}
+
+func getUint64(t *testing.T, b []byte, num protowire.Number) uint64 {
+	var v uint64
+	require.NoError(t, rawgrpc.WalkFields(b, func(f rawgrpc.Field) error {
+		if f.Num == num && f.Type == protowire.VarintType {
+			v = f.Varint
+		}
+		return nil
+	}))
+	return v
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusd-grpc-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mounts := map[string]mountCmd{}
+	prefetches := map[string][]string{}
+	apiSock := filepath.Join(dir, "api.sock")
+	nydusd := fakeNydusd(t, apiSock, mounts, prefetches)
+	defer nydusd.Close()
+
+	sock := filepath.Join(dir, "grpc.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	server := New(apiSock).Server()
+	go server.Serve(l)
+	defer server.Stop()
+
+	conn, err := Dial(sock)
+	require.NoError(t, err)
+	defer conn.Close()
+	call := func(method string, req []byte) ([]byte, error) {
+		var resp []byte
+		err := conn.Invoke(context.Background(), "/"+Service+"/"+method, &req, &resp)
+		return resp, err
+	}
+
+	resp, err := call("GetStatus", nil)
+	require.NoError(t, err)
+	require.Equal(t, "d1", getString(t, resp, statusIDField))
+	require.Equal(t, "RUNNING", getString(t, resp, statusStateField))
+	require.Equal(t, "2.0.0", getString(t, resp, statusVersionField))
+	require.Equal(t, "abc", getString(t, resp, statusGitCommitField))
+
+	var req []byte
+	req = rawgrpc.AppendString(req, mountMountpointField, "/sub")
+	req = rawgrpc.AppendString(req, mountSourceField, "/boot")
+	req = rawgrpc.AppendString(req, mountConfigField, "{}")
+	req = rawgrpc.AppendString(req, mountPrefetchFilesField, "/usr")
+	req = rawgrpc.AppendString(req, mountPrefetchFilesField, "/etc")
+	_, err = call("Mount", req)
+	require.NoError(t, err)
+	require.Equal(t, mountCmd{Source: "/boot", FsType: "rafs", Config: "{}", PrefetchFiles: []string{"/usr", "/etc"}},
+		mounts["POST /sub"])
+	req = rawgrpc.AppendBool(req, mountRemountField, true)
+	_, err = call("Mount", req)
+	require.NoError(t, err)
+	require.Contains(t, mounts, "PUT /sub")
+
+	var overlay []byte
+	overlay = rawgrpc.AppendString(overlay, overlayUpperDirField, "/ctr/upper")
+	overlay = rawgrpc.AppendString(overlay, overlayWorkDirField, "/ctr/work")
+	overlay = rawgrpc.AppendString(overlay, overlayTargetField, "/ctr/rootfs")
+	req = rawgrpc.AppendString(nil, mountMountpointField, "/ctr")
+	req = rawgrpc.AppendString(req, mountSourceField, "/boot")
+	req = rawgrpc.AppendBytes(req, mountOverlayField, overlay)
+	_, err = call("Mount", req)
+	require.NoError(t, err)
+	require.Equal(t, &mountOverlay{UpperDir: "/ctr/upper", WorkDir: "/ctr/work", Target: "/ctr/rootfs"},
+		mounts["POST /ctr"].Overlay)
+
+	resp, err = call("ListMounts", nil)
+	require.NoError(t, err)
+	info, _, err := rawgrpc.GetBytesField(resp, listMountsField)
+	require.NoError(t, err)
+	require.Equal(t, "/sub", getString(t, info, mountInfoMountpointField))
+	require.Equal(t, "rafs", getString(t, info, mountInfoFsTypeField))
+	require.Equal(t, "team-a", getString(t, info, mountInfoTenantField))
+	var blobs []string
+	require.NoError(t, rawgrpc.ParseStrings(info, nil, map[protowire.Number]*[]string{mountInfoBlobsField: &blobs}))
+	require.Equal(t, []string{"b1", "b2"}, blobs)
+	require.Equal(t, uint64(8192), getUint64(t, info, mountInfoCacheSizeField))
+	require.Equal(t, uint64(1), getUint64(t, info, mountInfoBackendReadErrorsField))
+	require.Equal(t, uint64(4096), getUint64(t, info, mountInfoBackendReadBytesField))
+	overlay, _, err = rawgrpc.GetBytesField(info, mountInfoOverlayField)
+	require.NoError(t, err)
+	require.Equal(t, "/ctr/rootfs", getString(t, overlay, overlayTargetField))
+	require.Equal(t, "/ctr/upper", getString(t, overlay, overlayUpperDirField))
+
+	resp, err = call("GetCacheStats", nil)
+	require.NoError(t, err)
+	cacheDir, _, err := rawgrpc.GetBytesField(resp, cacheStatsDirField)
+	require.NoError(t, err)
+	require.Equal(t, "/cache", getString(t, cacheDir, cacheDirWorkDirField))
+	require.Equal(t, uint64(50), getUint64(t, cacheDir, cacheDirUsedField))
+	blob, _, err := rawgrpc.GetBytesField(cacheDir, cacheDirBlobsField)
+	require.NoError(t, err)
+	require.Equal(t, "b1", getString(t, blob, cachedBlobIDField))
+	require.Equal(t, uint64(1), getUint64(t, blob, cachedBlobInUseField))
+	require.Equal(t, uint64(0), getUint64(t, blob, cachedBlobPinnedField))
+
+	req = rawgrpc.AppendString(nil, prefetchMountpointField, "/sub")
+	_, err = call("Prefetch", req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	req = rawgrpc.AppendString(req, prefetchFilesField, "/usr/lib")
+	_, err = call("Prefetch", req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/usr/lib"}, prefetches["/sub"])
+
+	req = rawgrpc.AppendString(nil, umountMountpointField, "/sub")
+	_, err = call("Umount", req)
+	require.NoError(t, err)
+	_, err = call("Umount", req)
+	require.Equal(t, codes.Internal, status.Code(err))
+	_, err = call("Umount", nil)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = call("Unknown", nil)
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusd-grpc-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := New(filepath.Join(dir, "api.sock"))
+	_, err = s.getStatus(context.Background(), nil)
+	require.Error(t, err)
+	require.Equal(t, codes.Unavailable, status.Code(toStatus(err)))
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mgmt
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/rawgrpc"
+)
+
+// Field numbers of the messages in daemon.proto.
+const (
+	statusIDField        = 1
+	statusStateField     = 2
+	statusVersionField   = 3
+	statusGitCommitField = 4
+
+	mountMountpointField    = 1
+	mountSourceField        = 2
+	mountFsTypeField        = 3
+	mountConfigField        = 4
+	mountPrefetchFilesField = 5
+	mountTenantField        = 6
+	mountRemountField       = 7
+	mountOverlayField       = 8
+
+	overlayUpperDirField = 1
+	overlayWorkDirField  = 2
+	overlayTargetField   = 3
+
+	umountMountpointField = 1
+
+	listMountsField = 1
+
+	mountInfoMountpointField        = 1
+	mountInfoFsTypeField            = 2
+	mountInfoSourceField            = 3
+	mountInfoTenantField            = 4
+	mountInfoBlobsField             = 5
+	mountInfoCacheSizeField         = 6
+	mountInfoBackendReadCountField  = 7
+	mountInfoBackendReadErrorsField = 8
+	mountInfoBackendReadBytesField  = 9
+	mountInfoOverlayField           = 10
+
+	cacheStatsDirField = 1
+
+	cacheDirWorkDirField = 1
+	cacheDirQuotaField   = 2
+	cacheDirUsedField    = 3
+	cacheDirBlobsField   = 4
+
+	cachedBlobIDField         = 1
+	cachedBlobSizeField       = 2
+	cachedBlobLastAccessField = 3
+	cachedBlobInUseField      = 4
+	cachedBlobPinnedField     = 5
+
+	prefetchMountpointField = 1
+	prefetchFilesField      = 2
+)
+
+// Filesystem types of the mount API by the backend types listed by nydusd.
+var fsTypes = map[string]string{
+	"Rafs":          "rafs",
+	"PassthroughFs": "passthrough_fs",
+}
+
+type mountRequest struct {
+	Mountpoint    string
+	Source        string
+	FsType        string
+	Config        string
+	PrefetchFiles []string
+	Tenant        string
+	Remount       bool
+	Overlay       *mountOverlay
+}
+
+func parseMountRequest(b []byte) (*mountRequest, error) {
+	r := &mountRequest{}
+	err := rawgrpc.ParseStrings(b, map[protowire.Number]*string{
+		mountMountpointField: &r.Mountpoint,
+		mountSourceField:     &r.Source,
+		mountFsTypeField:     &r.FsType,
+		mountConfigField:     &r.Config,
+		mountTenantField:     &r.Tenant,
+	}, map[protowire.Number]*[]string{
+		mountPrefetchFilesField: &r.PrefetchFiles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = rawgrpc.WalkFields(b, func(f rawgrpc.Field) error {
+		if f.Num == mountRemountField && f.Type == protowire.VarintType {
+			r.Remount = f.Varint != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	overlay, ok, err := rawgrpc.GetBytesField(b, mountOverlayField)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		r.Overlay = &mountOverlay{}
+		err = rawgrpc.ParseStrings(overlay, map[protowire.Number]*string{
+			overlayUpperDirField: &r.Overlay.UpperDir,
+			overlayWorkDirField:  &r.Overlay.WorkDir,
+			overlayTargetField:   &r.Overlay.Target,
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func encodeMountInfo(m *mountInfo) []byte {
+	fsType, ok := fsTypes[m.BackendType]
+	if !ok {
+		fsType = strings.ToLower(m.BackendType)
+	}
+
+	var b []byte
+	b = rawgrpc.AppendString(b, mountInfoMountpointField, m.Mountpoint)
+	b = rawgrpc.AppendString(b, mountInfoFsTypeField, fsType)
+	b = rawgrpc.AppendString(b, mountInfoSourceField, m.Source)
+	b = rawgrpc.AppendString(b, mountInfoTenantField, m.Tenant)
+	for _, blob := range m.Blobs {
+		b = rawgrpc.AppendString(b, mountInfoBlobsField, blob)
+	}
+	b = rawgrpc.AppendUint64(b, mountInfoCacheSizeField, m.CacheSize)
+	b = rawgrpc.AppendUint64(b, mountInfoBackendReadCountField, m.Backend.ReadCount)
+	b = rawgrpc.AppendUint64(b, mountInfoBackendReadErrorsField, m.Backend.ReadErrors)
+	b = rawgrpc.AppendUint64(b, mountInfoBackendReadBytesField, m.Backend.ReadAmountTotal)
+	if m.Overlay != nil {
+		var o []byte
+		o = rawgrpc.AppendString(o, overlayUpperDirField, m.Overlay.UpperDir)
+		o = rawgrpc.AppendString(o, overlayWorkDirField, m.Overlay.WorkDir)
+		o = rawgrpc.AppendString(o, overlayTargetField, m.Overlay.Target)
+		b = rawgrpc.AppendBytes(b, mountInfoOverlayField, o)
+	}
+	return b
+}
+
+func encodeCacheDir(d *cacheUsage) []byte {
+	var b []byte
+	b = rawgrpc.AppendString(b, cacheDirWorkDirField, d.WorkDir)
+	b = rawgrpc.AppendUint64(b, cacheDirQuotaField, d.Quota)
+	b = rawgrpc.AppendUint64(b, cacheDirUsedField, d.Used)
+	for _, blob := range d.Blobs {
+		var e []byte
+		e = rawgrpc.AppendString(e, cachedBlobIDField, blob.BlobID)
+		e = rawgrpc.AppendUint64(e, cachedBlobSizeField, blob.Size)
+		e = rawgrpc.AppendUint64(e, cachedBlobLastAccessField, blob.LastAccess)
+		e = rawgrpc.AppendBool(e, cachedBlobInUseField, blob.InUse)
+		e = rawgrpc.AppendBool(e, cachedBlobPinnedField, blob.Pinned)
+		b = rawgrpc.AppendBytes(b, cacheDirBlobsField, e)
+	}
+	return b
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package rawgrpc serves and calls gRPC services without generated code. The messages are passed
+// as raw bytes by Codec, and the fields are parsed and built with protowire, so only the fields
+// of interest need to be known by their numbers.
+package rawgrpc
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec passing the messages as is, so they're forwarded without being parsed.
+type Codec struct{}
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, errors.Errorf("unexpected message type %T", v)
+	}
+	return *b, nil
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return errors.Errorf("unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (Codec) Name() string {
+	return "proto"
+}
+
+func (Codec) String() string {
+	return "proto"
+}
+
+// Field of a message, Bytes is set for the bytes type and Varint for the varint type.
+type Field struct {
+	Num    protowire.Number
+	Type   protowire.Type
+	Bytes  []byte
+	Varint uint64
+	// The encoded field with its tag.
+	Raw []byte
+}
+
+// WalkFields calls fn with each field of message b.
+func WalkFields(b []byte, fn func(f Field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "parse tag")
+		}
+		m := protowire.ConsumeFieldValue(num, typ, b[n:])
+		if m < 0 {
+			return errors.Wrap(protowire.ParseError(m), "parse field")
+		}
+		f := Field{Num: num, Type: typ, Raw: b[:n+m]}
+		switch typ {
+		case protowire.BytesType:
+			f.Bytes, _ = protowire.ConsumeBytes(b[n:])
+		case protowire.VarintType:
+			f.Varint, _ = protowire.ConsumeVarint(b[n:])
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+		b = b[n+m:]
+	}
+	return nil
+}
+
+// GetBytesField gets the bytes field `num` of message b, the last one wins as protobuf does.
+func GetBytesField(b []byte, num protowire.Number) ([]byte, bool, error) {
+	var found []byte
+	var ok bool
+	err := WalkFields(b, func(f Field) error {
+		if f.Num == num && f.Type == protowire.BytesType {
+			found, ok = f.Bytes, true
+		}
+		return nil
+	})
+	return found, ok, err
+}
+
+// SetBytesField replaces the bytes field `num` of message b with `value`.
+func SetBytesField(b []byte, num protowire.Number, value []byte) ([]byte, error) {
+	var out []byte
+	err := WalkFields(b, func(f Field) error {
+		if f.Num != num {
+			out = append(out, f.Raw...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return AppendBytes(out, num, value), nil
+}
+
+// ParseStrings parses the string fields of message b into `fields` by their numbers, the values
+// of repeated fields are appended to `repeated`. The other fields are ignored.
+func ParseStrings(b []byte, fields map[protowire.Number]*string, repeated map[protowire.Number]*[]string) error {
+	return WalkFields(b, func(f Field) error {
+		if f.Type != protowire.BytesType {
+			return nil
+		}
+		if field, ok := fields[f.Num]; ok {
+			*field = string(f.Bytes)
+		}
+		if field, ok := repeated[f.Num]; ok {
+			*field = append(*field, string(f.Bytes))
+		}
+		return nil
+	})
+}
+
+// ParseStringMap parses the map<string, string> field `num` of message b, whose entries are
+// embedded messages of the key as field 1 and the value as field 2.
+func ParseStringMap(b []byte, num protowire.Number) (map[string]string, error) {
+	m := map[string]string{}
+	err := WalkFields(b, func(f Field) error {
+		if f.Num != num || f.Type != protowire.BytesType {
+			return nil
+		}
+		var key, value string
+		if err := ParseStrings(f.Bytes, map[protowire.Number]*string{1: &key, 2: &value}, nil); err != nil {
+			return err
+		}
+		m[key] = value
+		return nil
+	})
+	return m, err
+}
+
+// AppendBytes appends the bytes field `num`, e.g. an embedded message.
+func AppendBytes(b []byte, num protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// AppendString appends the string field `num`, omitted if empty as proto3 does.
+func AppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// AppendUint64 appends the uint64 field `num`, omitted if zero as proto3 does.
+func AppendUint64(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// AppendBool appends the bool field `num`, omitted if false as proto3 does.
+func AppendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return AppendUint64(b, num, 1)
+}
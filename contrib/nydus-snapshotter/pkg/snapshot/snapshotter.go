@@ -0,0 +1,600 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package snapshot implements a containerd remote snapshotter for nydus images.
+//
+// When containerd unpacks a nydus image, the snapshots of its data layers are committed without
+// being unpacked, since their blobs are read lazily by nydusd, and the metadata layer is unpacked
+// as usual. When a container rootfs is prepared on the metadata layer, a nydusd instance is
+// started with its bootstrap, and the rootfs is an overlay on the nydusd mountpoint. The nydusd
+// instance is shared by all containers of the image, and stopped once the snapshot of the
+// metadata layer is removed. Snapshots of OCI images are handled as by the overlay snapshotter.
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+// Path of the bootstrap in the metadata layer of nydus image.
+const bootstrapPathInLayer = "image/image.boot"
+
+type Config struct {
+	// Root directory of the snapshots and their metadata.
+	Root string
+	// Path of nydusd binary.
+	NydusdPath string
+	// Template of nydusd config, see WriteConfig() of package daemon.
+	NydusdConfig []byte
+}
+
+type snapshotter struct {
+	root     string
+	ms       *storage.MetaStore
+	indexOff bool
+
+	nydusdPath   string
+	nydusdConfig []byte
+
+	// Running nydusd instances by the id of the snapshot of the metadata layer.
+	mu      sync.Mutex
+	daemons map[string]*daemon.Daemon
+	// Start, adopt and stop nydusd, replaced in tests.
+	startDaemon func(d *daemon.Daemon) error
+	adoptDaemon func(d *daemon.Daemon) error
+	stopDaemon  func(d *daemon.Daemon) error
+}
+
+// NewSnapshotter returns a Snapshotter for nydus images, storing the snapshots and their
+// metadata in directory `config.Root`.
+func NewSnapshotter(config Config) (snapshots.Snapshotter, error) {
+	return newSnapshotter(config)
+}
+
+func newSnapshotter(config Config) (*snapshotter, error) {
+	if err := os.MkdirAll(config.Root, 0700); err != nil {
+		return nil, err
+	}
+	supportsDType, err := fs.SupportsDType(config.Root)
+	if err != nil {
+		return nil, err
+	}
+	if !supportsDType {
+		return nil, fmt.Errorf("%s does not support d_type", config.Root)
+	}
+	ms, err := storage.NewMetaStore(filepath.Join(config.Root, "metadata.db"))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(filepath.Join(config.Root, "snapshots"), 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	// Figure out whether "index=off" option is recognized by the kernel.
+	var indexOff bool
+	if _, err = os.Stat("/sys/module/overlay/parameters/index"); err == nil {
+		indexOff = true
+	}
+
+	o := &snapshotter{
+		root:         config.Root,
+		ms:           ms,
+		indexOff:     indexOff,
+		nydusdPath:   config.NydusdPath,
+		nydusdConfig: config.NydusdConfig,
+		daemons:      map[string]*daemon.Daemon{},
+	}
+	o.startDaemon = func(d *daemon.Daemon) error {
+		return d.Start(o.nydusdPath)
+	}
+	o.adoptDaemon = func(d *daemon.Daemon) error {
+		return d.Adopt(o.nydusdPath)
+	}
+	o.stopDaemon = func(d *daemon.Daemon) error {
+		return d.Stop()
+	}
+
+	return o, nil
+}
+
+func (o *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	defer t.Rollback()
+	_, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+
+	return info, nil
+}
+
+func (o *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+
+	info, err = storage.UpdateInfo(ctx, info, fieldpaths...)
+	if err != nil {
+		t.Rollback()
+		return snapshots.Info{}, err
+	}
+
+	if err := t.Commit(); err != nil {
+		return snapshots.Info{}, err
+	}
+
+	return info, nil
+}
+
+func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+	id, info, usage, err := storage.GetInfo(ctx, key)
+	t.Rollback()
+	if err != nil {
+		return snapshots.Usage{}, err
+	}
+
+	if info.Kind == snapshots.KindActive {
+		du, err := fs.DiskUsage(ctx, o.upperPath(id))
+		if err != nil {
+			return snapshots.Usage{}, err
+		}
+		usage = snapshots.Usage(du)
+	}
+
+	return usage, nil
+}
+
+func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	return o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
+}
+
+func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	return o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
+}
+
+// Mounts returns the mounts of the snapshot identified by key, the nydusd instance serving it
+// is started again if it's not running, e.g. after the node reboots.
+func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	s, err := storage.GetSnapshot(ctx, key)
+	if err != nil {
+		t.Rollback()
+		return nil, errors.Wrap(err, "failed to get active mount")
+	}
+	_, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		t.Rollback()
+		return nil, err
+	}
+	var meta *metaLayer
+	if _, isUnpack := info.Labels[label.TargetSnapshotLabel]; !isUnpack {
+		meta, err = o.findMetaLayer(ctx, info.Parent)
+	}
+	t.Rollback()
+	if err != nil {
+		return nil, err
+	}
+
+	return o.mounts(s, meta)
+}
+
+func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+		}
+	}()
+
+	id, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	usage, err := fs.DiskUsage(ctx, o.upperPath(id))
+	if err != nil {
+		return err
+	}
+
+	if _, err = storage.CommitActive(ctx, key, name, snapshots.Usage(usage), opts...); err != nil {
+		return errors.Wrap(err, "failed to commit snapshot")
+	}
+	return t.Commit()
+}
+
+// Remove the snapshot identified by key, and stop the nydusd instance serving the image if it's
+// the snapshot of the metadata layer.
+func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+		}
+	}()
+
+	id, _, err := storage.Remove(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove")
+	}
+
+	// Umount the rootfs before its directory is removed.
+	o.mu.Lock()
+	d, ok := o.daemons[id]
+	if !ok {
+		d = o.newDaemon(id)
+	}
+	if ok || d.Mounted() {
+		if err = o.stopDaemon(d); err != nil {
+			o.mu.Unlock()
+			return errors.Wrapf(err, "failed to stop nydusd of snapshot %s", key)
+		}
+		delete(o.daemons, id)
+	}
+	o.mu.Unlock()
+
+	removals, err := o.getCleanupDirectories(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to get directories for removal")
+	}
+
+	// Remove directories after the transaction is closed, failures must not return error since
+	// the transaction is committed with the removal key no longer available.
+	defer func() {
+		if err == nil {
+			for _, dir := range removals {
+				if err := os.RemoveAll(dir); err != nil {
+					log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+				}
+			}
+		}
+	}()
+
+	return t.Commit()
+}
+
+func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...string) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	return storage.WalkInfo(ctx, fn, fs...)
+}
+
+// Close the metadata store. The nydusd instances are kept running, since their rootfs are used
+// by the running containers.
+func (o *snapshotter) Close() error {
+	return o.ms.Close()
+}
+
+func (o *snapshotter) getCleanupDirectories(ctx context.Context) ([]string, error) {
+	ids, err := storage.IDMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotDir := filepath.Join(o.root, "snapshots")
+	fd, err := os.Open(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	dirs, err := fd.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+
+	cleanup := []string{}
+	for _, d := range dirs {
+		if _, ok := ids[d]; ok {
+			continue
+		}
+		cleanup = append(cleanup, filepath.Join(snapshotDir, d))
+	}
+
+	return cleanup, nil
+}
+
+// metaLayer is the committed snapshot of the metadata layer of nydus image.
+type metaLayer struct {
+	id   string
+	ref  string
+	cids string
+}
+
+// Find the snapshot of the metadata layer of nydus image from snapshot `key` through its
+// parents, return nil if it's not a nydus image.
+func (o *snapshotter) findMetaLayer(ctx context.Context, key string) (*metaLayer, error) {
+	for key != "" {
+		id, info, _, err := storage.GetInfo(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := info.Labels[label.NydusMetaLayer]; ok {
+			if _, err := os.Stat(o.bootstrapPath(id)); err != nil {
+				return nil, errors.Wrapf(err, "no bootstrap in snapshot %s", key)
+			}
+			return &metaLayer{
+				id:   id,
+				ref:  info.Labels[label.ImageRef],
+				cids: info.Labels[label.NydusIPFSCIDs],
+			}, nil
+		}
+		key = info.Parent
+	}
+
+	return nil, nil
+}
+
+func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts []snapshots.Opt) (_ []mount.Mount, err error) {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var td, path string
+	defer func() {
+		if err != nil {
+			if td != "" {
+				if err1 := os.RemoveAll(td); err1 != nil {
+					log.G(ctx).WithError(err1).Warn("failed to cleanup temp snapshot directory")
+				}
+			}
+			if path != "" {
+				if err1 := os.RemoveAll(path); err1 != nil {
+					log.G(ctx).WithError(err1).WithField("path", path).Error("failed to reclaim snapshot directory, directory may need removal")
+					err = errors.Wrapf(err, "failed to remove path: %v", err1)
+				}
+			}
+		}
+	}()
+
+	snapshotDir := filepath.Join(o.root, "snapshots")
+	td, err = o.prepareDirectory(snapshotDir, kind)
+	if err != nil {
+		t.Rollback()
+		return nil, errors.Wrap(err, "failed to create prepare snapshot dir")
+	}
+	rollback := true
+	defer func() {
+		if rollback {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+		}
+	}()
+
+	s, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create snapshot")
+	}
+
+	if len(s.ParentIDs) > 0 {
+		st, err := os.Stat(o.upperPath(s.ParentIDs[0]))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to stat parent")
+		}
+		stat := st.Sys().(*syscall.Stat_t)
+		if err := os.Lchown(filepath.Join(td, "fs"), int(stat.Uid), int(stat.Gid)); err != nil {
+			return nil, errors.Wrap(err, "failed to chown")
+		}
+	}
+
+	path = filepath.Join(snapshotDir, s.ID)
+	if err = os.Rename(td, path); err != nil {
+		return nil, errors.Wrap(err, "failed to rename")
+	}
+	td = ""
+
+	// The data layer of nydus image is never unpacked, commit it as the target snapshot, and
+	// tell containerd that it exists already.
+	target, isUnpack := base.Labels[label.TargetSnapshotLabel]
+	if _, ok := base.Labels[label.NydusDataLayer]; ok && isUnpack && kind == snapshots.KindActive {
+		base.Labels[label.RemoteLabel] = "true"
+		if _, err = storage.CommitActive(ctx, key, target, snapshots.Usage{}, snapshots.WithLabels(base.Labels)); err != nil {
+			return nil, errors.Wrapf(err, "failed to commit remote snapshot %s", target)
+		}
+		rollback = false
+		if err = t.Commit(); err != nil {
+			return nil, errors.Wrap(err, "commit failed")
+		}
+		// Keep the directory of the committed snapshot.
+		path = ""
+		return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "target snapshot %q", target)
+	}
+
+	// Layers are unpacked on the snapshots of their lower layers as usual.
+	var meta *metaLayer
+	if !isUnpack {
+		if meta, err = o.findMetaLayer(ctx, parent); err != nil {
+			return nil, err
+		}
+	}
+
+	rollback = false
+	if err = t.Commit(); err != nil {
+		return nil, errors.Wrap(err, "commit failed")
+	}
+
+	return o.mounts(s, meta)
+}
+
+func (o *snapshotter) prepareDirectory(snapshotDir string, kind snapshots.Kind) (string, error) {
+	td, err := ioutil.TempDir(snapshotDir, "new-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create temp dir")
+	}
+
+	if err := os.Mkdir(filepath.Join(td, "fs"), 0755); err != nil {
+		return td, err
+	}
+
+	if kind == snapshots.KindActive {
+		if err := os.Mkdir(filepath.Join(td, "work"), 0711); err != nil {
+			return td, err
+		}
+	}
+
+	return td, nil
+}
+
+func (o *snapshotter) newDaemon(id string) *daemon.Daemon {
+	d := daemon.New(filepath.Join(o.root, "snapshots", id), o.bootstrapPath(id))
+	d.Notify = func(e daemon.Event) {
+		entry := log.L.WithField("snapshot", id).WithField("event", e.Type)
+		switch e.Type {
+		case daemon.EventFailed:
+			entry.Errorf("failed to recover nydusd: %s", e.Message)
+		case daemon.EventRemounted:
+			entry.Warnf("nydusd is recovered, containers using the rootfs must be restarted: %s", e.Message)
+		default:
+			entry.Info(e.Message)
+		}
+	}
+	return d
+}
+
+// Get the nydusd instance serving the image of the metadata layer, start it if not running.
+func (o *snapshotter) getDaemon(meta *metaLayer) (*daemon.Daemon, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if d, ok := o.daemons[meta.id]; ok {
+		return d, nil
+	}
+
+	d := o.newDaemon(meta.id)
+	if !d.Mounted() {
+		if err := d.WriteConfig(o.nydusdConfig, meta.ref, meta.cids); err != nil {
+			return nil, errors.Wrapf(err, "failed to write nydusd config of %s", meta.ref)
+		}
+		if err := o.startDaemon(d); err != nil {
+			return nil, errors.Wrapf(err, "failed to start nydusd of %s", meta.ref)
+		}
+	} else if err := o.adoptDaemon(d); err != nil {
+		// The rootfs is still served, only without being recovered.
+		log.L.WithError(err).Warnf("failed to supervise nydusd of %s", meta.ref)
+	}
+	o.daemons[meta.id] = d
+
+	return d, nil
+}
+
+func (o *snapshotter) mounts(s storage.Snapshot, meta *metaLayer) ([]mount.Mount, error) {
+	var lowerPaths []string
+	for _, id := range s.ParentIDs {
+		if meta != nil && id == meta.id {
+			d, err := o.getDaemon(meta)
+			if err != nil {
+				return nil, err
+			}
+			lowerPaths = append(lowerPaths, d.Mountpoint())
+			break
+		}
+		lowerPaths = append(lowerPaths, o.upperPath(id))
+	}
+
+	if len(lowerPaths) == 0 {
+		// With no parent, return a bind mount as overlay won't work.
+		roFlag := "rw"
+		if s.Kind == snapshots.KindView {
+			roFlag = "ro"
+		}
+		return []mount.Mount{
+			{
+				Source:  o.upperPath(s.ID),
+				Type:    "bind",
+				Options: []string{roFlag, "rbind"},
+			},
+		}, nil
+	}
+
+	var options []string
+	if o.indexOff {
+		options = append(options, "index=off")
+	}
+
+	if s.Kind == snapshots.KindActive {
+		options = append(options,
+			fmt.Sprintf("workdir=%s", o.workPath(s.ID)),
+			fmt.Sprintf("upperdir=%s", o.upperPath(s.ID)),
+		)
+	} else if len(lowerPaths) == 1 {
+		return []mount.Mount{
+			{
+				Source:  lowerPaths[0],
+				Type:    "bind",
+				Options: []string{"ro", "rbind"},
+			},
+		}, nil
+	}
+
+	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(lowerPaths, ":")))
+	return []mount.Mount{
+		{
+			Type:    "overlay",
+			Source:  "overlay",
+			Options: options,
+		},
+	}, nil
+}
+
+func (o *snapshotter) upperPath(id string) string {
+	return filepath.Join(o.root, "snapshots", id, "fs")
+}
+
+func (o *snapshotter) workPath(id string) string {
+	return filepath.Join(o.root, "snapshots", id, "work")
+}
+
+func (o *snapshotter) bootstrapPath(id string) string {
+	return filepath.Join(o.upperPath(id), bootstrapPathInLayer)
+}
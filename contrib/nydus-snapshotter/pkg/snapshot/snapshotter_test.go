@@ -0,0 +1,132 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package snapshot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/daemon"
+	"github.com/dragonflyoss/image-service/contrib/nydus-snapshotter/pkg/label"
+)
+
+const imageRef = "docker.io/library/nginx:latest"
+
+func newTestSnapshotter(t *testing.T) (*snapshotter, *int, *int) {
+	root, err := ioutil.TempDir("", "nydus-snapshotter-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	o, err := newSnapshotter(Config{
+		Root:         root,
+		NydusdConfig: []byte(`{"device": {"backend": {"type": "registry", "config": {}}}}`),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { o.Close() })
+
+	var started, stopped int
+	o.startDaemon = func(d *daemon.Daemon) error {
+		started++
+		return nil
+	}
+	o.stopDaemon = func(d *daemon.Daemon) error {
+		stopped++
+		return nil
+	}
+
+	return o, &started, &stopped
+}
+
+func layerLabels(target string, layerLabel string) map[string]string {
+	return map[string]string{
+		label.TargetSnapshotLabel: target,
+		label.ImageRef:            imageRef,
+		layerLabel:                "true",
+	}
+}
+
+func TestNydusImage(t *testing.T) {
+	ctx := context.Background()
+	o, started, stopped := newTestSnapshotter(t)
+
+	// The data layers aren't unpacked.
+	labels := layerLabels("data", label.NydusDataLayer)
+	_, err := o.Prepare(ctx, "extract-data", "", snapshots.WithLabels(labels))
+	require.True(t, errdefs.IsAlreadyExists(err))
+	info, err := o.Stat(ctx, "data")
+	require.NoError(t, err)
+	require.Equal(t, snapshots.KindCommitted, info.Kind)
+	require.Equal(t, "true", info.Labels[label.RemoteLabel])
+
+	// The metadata layer is unpacked as usual.
+	labels = layerLabels("meta", label.NydusMetaLayer)
+	mounts, err := o.Prepare(ctx, "extract-meta", "data", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	require.Equal(t, "overlay", mounts[0].Type)
+	tctx, tx, err := o.ms.TransactionContext(ctx, false)
+	require.NoError(t, err)
+	id, _, _, err := storage.GetInfo(tctx, "extract-meta")
+	tx.Rollback()
+	require.NoError(t, err)
+	bootstrap := o.bootstrapPath(id)
+	require.NoError(t, os.MkdirAll(filepath.Dir(bootstrap), 0755))
+	require.NoError(t, ioutil.WriteFile(bootstrap, []byte("bootstrap"), 0644))
+	require.NoError(t, o.Commit(ctx, "meta", "extract-meta", snapshots.WithLabels(labels)))
+	require.Equal(t, 0, *started)
+
+	// The containers of the image share a nydusd instance.
+	mounts, err = o.Prepare(ctx, "container1", "meta")
+	require.NoError(t, err)
+	d := o.newDaemon(id)
+	require.Len(t, mounts, 1)
+	require.Contains(t, mounts[0].Options, "lowerdir="+d.Mountpoint())
+	config, err := ioutil.ReadFile(d.ConfigPath())
+	require.NoError(t, err)
+	require.Contains(t, string(config), `"repo": "library/nginx"`)
+
+	mounts, err = o.View(ctx, "container2", "meta")
+	require.NoError(t, err)
+	require.Equal(t, "bind", mounts[0].Type)
+	require.Equal(t, d.Mountpoint(), mounts[0].Source)
+	mounts, err = o.Mounts(ctx, "container1")
+	require.NoError(t, err)
+	require.Contains(t, mounts[0].Options, "lowerdir="+d.Mountpoint())
+	require.Equal(t, 1, *started)
+
+	// The nydusd instance is stopped once the metadata layer is removed.
+	require.Error(t, o.Remove(ctx, "meta"))
+	require.NoError(t, o.Remove(ctx, "container1"))
+	require.NoError(t, o.Remove(ctx, "container2"))
+	require.Equal(t, 0, *stopped)
+	require.NoError(t, o.Remove(ctx, "meta"))
+	require.Equal(t, 1, *stopped)
+	_, err = os.Stat(d.Dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOCIImage(t *testing.T) {
+	ctx := context.Background()
+	o, started, _ := newTestSnapshotter(t)
+
+	mounts, err := o.Prepare(ctx, "extract-layer", "", snapshots.WithLabels(map[string]string{
+		label.TargetSnapshotLabel: "layer",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "bind", mounts[0].Type)
+	require.NoError(t, o.Commit(ctx, "layer", "extract-layer"))
+
+	mounts, err = o.Prepare(ctx, "container", "layer")
+	require.NoError(t, err)
+	require.Equal(t, "overlay", mounts[0].Type)
+	require.Equal(t, 0, *started)
+}
@@ -0,0 +1,296 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package supervisor keeps the FUSE session and the mount states of a nydusd, so that a new nydusd
+// takes over the session when the previous one exits, without umounting the filesystems used by
+// containers. It serves the `--supervisor` socket of nydusd: nydusd connects to it on a `sendfd`
+// request to send its mount states with the `/dev/fuse` fd attached, and on a `takeover` request
+// to receive them back.
+package supervisor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// How long to wait for nydusd to connect after it's requested to.
+	acceptTimeout = 10 * time.Second
+	ioTimeout     = 10 * time.Second
+)
+
+// ErrNoSession is returned by Send if no FUSE session is kept.
+var ErrNoSession = errors.New("no FUSE session is kept")
+
+// MountCmd is the mount command of an instance, as nydusd sends it.
+type MountCmd struct {
+	// `Rafs` or `PassthroughFs`.
+	FsType        string          `json:"fs_type"`
+	Source        string          `json:"source"`
+	Config        string          `json:"config"`
+	Mountpoint    string          `json:"mountpoint"`
+	PrefetchFiles []string        `json:"prefetch_files"`
+	Tenant        *string         `json:"tenant"`
+	Overlay       json.RawMessage `json:"overlay,omitempty"`
+}
+
+// MountState is an instance mounted by nydusd at the index `VfsIndex` of its VFS.
+type MountState struct {
+	Cmd      MountCmd `json:"cmd"`
+	VfsIndex uint8    `json:"vfs_index"`
+}
+
+// Supervisor of a nydusd, listening on the unix socket passed to nydusd by `--supervisor`.
+type Supervisor struct {
+	path      string
+	stateFile string
+	listener  *net.UnixListener
+
+	// Serializes the exchanges with nydusd on the socket.
+	op sync.Mutex
+
+	mu sync.Mutex
+	// Mount states in JSON, persisted in `stateFile`.
+	state []byte
+	// The `/dev/fuse` fd keeping the FUSE connection alive after nydusd exits.
+	fuse *os.File
+}
+
+// New listens on the unix socket `path`, with the mount states persisted in `stateFile` loaded.
+// The FUSE session isn't persisted, so it's kept only after Receive.
+func New(path, stateFile string) (*Supervisor, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, errors.Wrap(err, "create directory of supervisor socket")
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "remove stale supervisor socket")
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen on %s", path)
+	}
+	// The mount states include the credentials of the storage backends.
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "change mode of supervisor socket")
+	}
+
+	s := &Supervisor{path: path, stateFile: stateFile, listener: l}
+	state, err := ioutil.ReadFile(stateFile)
+	if err == nil {
+		s.state = state
+	} else if !os.IsNotExist(err) {
+		l.Close()
+		return nil, errors.Wrap(err, "read mount states")
+	}
+
+	return s, nil
+}
+
+// Path of the unix socket to pass to nydusd by `--supervisor`.
+func (s *Supervisor) Path() string {
+	return s.path
+}
+
+// HasSession checks whether a FUSE session is kept, so that a new nydusd can take it over.
+func (s *Supervisor) HasSession() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fuse != nil
+}
+
+// Mounts returns the mount states received from nydusd, or loaded from the state file.
+func (s *Supervisor) Mounts() ([]MountState, error) {
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+
+	var mounts []MountState
+	if len(state) == 0 {
+		return mounts, nil
+	}
+	if err := json.Unmarshal(state, &mounts); err != nil {
+		return nil, errors.Wrap(err, "parse mount states")
+	}
+	return mounts, nil
+}
+
+// Receive the mount states and the FUSE fd from nydusd, which connects to the supervisor after
+// `trigger` requests it to, i.e. by `PUT /api/v1/daemon/fuse/sendfd`. The states are persisted,
+// and the FUSE fd replaces the kept one.
+func (s *Supervisor) Receive(trigger func() error) error {
+	s.op.Lock()
+	defer s.op.Unlock()
+
+	var (
+		state []byte
+		fuse  *os.File
+	)
+	err := s.exchange(trigger, func(conn *net.UnixConn) error {
+		buf := make([]byte, 0x1000)
+		oob := make([]byte, unix.CmsgSpace(4))
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return errors.Wrap(err, "receive FUSE fd")
+		}
+		if fuse, err = parseFd(oob[:oobn]); err != nil {
+			return err
+		}
+		// The fd is attached to the first part of the states, the rest is sent until EOF.
+		rest, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return errors.Wrap(err, "receive mount states")
+		}
+		state = append(buf[:n], rest...)
+		return nil
+	})
+	if err == nil {
+		var mounts []MountState
+		if err = json.Unmarshal(state, &mounts); err != nil {
+			err = errors.Wrap(err, "parse mount states")
+		} else if err = writeFile(s.stateFile, state); err != nil {
+			err = errors.Wrap(err, "persist mount states")
+		}
+	}
+	if err != nil {
+		if fuse != nil {
+			fuse.Close()
+		}
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fuse != nil {
+		s.fuse.Close()
+	}
+	s.state, s.fuse = state, fuse
+
+	return nil
+}
+
+// Send the kept mount states and FUSE fd to nydusd started by `--upgrade`, which connects to the
+// supervisor after `trigger` requests it to, i.e. by `PUT /api/v1/daemon/fuse/takeover`. The FUSE
+// session is still kept, in case the new nydusd exits too.
+func (s *Supervisor) Send(trigger func() error) error {
+	s.op.Lock()
+	defer s.op.Unlock()
+
+	s.mu.Lock()
+	state, fuse := s.state, s.fuse
+	s.mu.Unlock()
+	if fuse == nil {
+		return ErrNoSession
+	}
+
+	return s.exchange(trigger, func(conn *net.UnixConn) error {
+		n, _, err := conn.WriteMsgUnix(state, unix.UnixRights(int(fuse.Fd())), nil)
+		if err != nil {
+			return errors.Wrap(err, "send FUSE fd")
+		}
+		if _, err := conn.Write(state[n:]); err != nil {
+			return errors.Wrap(err, "send mount states")
+		}
+		return nil
+	})
+}
+
+// Drop the kept FUSE session, then the kernel aborts the requests waiting for a new nydusd. The
+// mount states are still kept to mount the instances again.
+func (s *Supervisor) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fuse != nil {
+		s.fuse.Close()
+		s.fuse = nil
+	}
+}
+
+// Close the socket and drop the FUSE session. The state file is removed if `remove` is true,
+// i.e. the instances are umounted.
+func (s *Supervisor) Close(remove bool) error {
+	s.Drop()
+	err := s.listener.Close()
+	if remove {
+		if rerr := os.Remove(s.stateFile); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// Exchange with nydusd by `fn` on the connection it makes after `trigger` requests it to. The
+// request runs concurrently, as nydusd answers it only after the exchange.
+func (s *Supervisor) exchange(trigger func() error, fn func(*net.UnixConn) error) error {
+	if err := s.listener.SetDeadline(time.Now().Add(acceptTimeout)); err != nil {
+		return err
+	}
+	triggered := make(chan error, 1)
+	go func() {
+		err := trigger()
+		if err != nil {
+			// Wake up the pending accept.
+			s.listener.SetDeadline(time.Now())
+		}
+		triggered <- err
+	}()
+
+	conn, err := s.listener.AcceptUnix()
+	if err != nil {
+		if terr := <-triggered; terr != nil {
+			return terr
+		}
+		return errors.Wrap(err, "wait for nydusd to connect")
+	}
+	if err = conn.SetDeadline(time.Now().Add(ioTimeout)); err == nil {
+		err = fn(conn)
+	}
+	conn.Close()
+	if terr := <-triggered; err == nil {
+		err = terr
+	}
+
+	return err
+}
+
+// Get the fd attached to the control message `oob`, the unexpected ones are closed.
+func parseFd(oob []byte) (*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse control message")
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) == 0 {
+		return nil, errors.New("no FUSE fd is received")
+	}
+	for _, fd := range fds[1:] {
+		unix.Close(fd)
+	}
+
+	return os.NewFile(uintptr(fds[0]), "fuse"), nil
+}
+
+// Write `data` to file `path` atomically, the file is only accessible by the owner.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
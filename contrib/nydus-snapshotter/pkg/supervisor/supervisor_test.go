@@ -0,0 +1,145 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package supervisor
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// Send the states with fd `f` attached to the first `split` bytes as nydusd does.
+func sendStates(path string, states []byte, split int, f *os.File) error {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, _, err := conn.WriteMsgUnix(states[:split], unix.UnixRights(int(f.Fd())), nil); err != nil {
+		return err
+	}
+	_, err = conn.Write(states[split:])
+	return err
+}
+
+// Receive the states and fd as nydusd does.
+func recvStates(path string) ([]byte, *os.File, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 0x1000)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := parseFd(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, err := ioutil.ReadAll(conn)
+	return append(buf[:n], rest...), f, err
+}
+
+func TestSupervisor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydus-supervisor-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "supervisor.sock")
+	stateFile := filepath.Join(dir, "mounts.json")
+	s, err := New(sock, stateFile)
+	require.NoError(t, err)
+	require.Equal(t, sock, s.Path())
+	require.False(t, s.HasSession())
+	mounts, err := s.Mounts()
+	require.NoError(t, err)
+	require.Empty(t, mounts)
+	require.Equal(t, ErrNoSession, s.Send(func() error { return nil }))
+
+	fuse, err := ioutil.TempFile(dir, "fuse")
+	require.NoError(t, err)
+	_, err = fuse.WriteString("session")
+	require.NoError(t, err)
+	defer fuse.Close()
+
+	states := []byte(`[{"cmd":{"fs_type":"Rafs","source":"/boot","config":"{}","mountpoint":"/",` +
+		`"prefetch_files":null,"tenant":null},"vfs_index":0}]`)
+	require.NoError(t, s.Receive(func() error {
+		go sendStates(sock, states, 10, fuse)
+		return nil
+	}))
+	require.True(t, s.HasSession())
+	mounts, err = s.Mounts()
+	require.NoError(t, err)
+	require.Equal(t, []MountState{{Cmd: MountCmd{FsType: "Rafs", Source: "/boot", Config: "{}", Mountpoint: "/"}}}, mounts)
+	persisted, err := ioutil.ReadFile(stateFile)
+	require.NoError(t, err)
+	require.Equal(t, states, persisted)
+	st, err := os.Stat(stateFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), st.Mode().Perm())
+
+	// The new nydusd gets the same states and session.
+	type received struct {
+		states []byte
+		f      *os.File
+		err    error
+	}
+	ch := make(chan received, 1)
+	require.NoError(t, s.Send(func() error {
+		go func() {
+			states, f, err := recvStates(sock)
+			ch <- received{states, f, err}
+		}()
+		return nil
+	}))
+	r := <-ch
+	require.NoError(t, r.err)
+	require.Equal(t, states, r.states)
+	b := make([]byte, 7)
+	_, err = r.f.ReadAt(b, 0)
+	require.NoError(t, err)
+	require.Equal(t, "session", string(b))
+	r.f.Close()
+	require.True(t, s.HasSession())
+
+	// Failed triggers don't block.
+	require.Error(t, s.Receive(func() error { return errors.New("nydusd is gone") }))
+	require.Error(t, s.Receive(func() error {
+		go func() {
+			conn, err := net.Dial("unix", sock)
+			if err == nil {
+				conn.Write([]byte("[]"))
+				conn.Close()
+			}
+		}()
+		return nil
+	}))
+	require.True(t, s.HasSession())
+
+	s.Drop()
+	require.False(t, s.HasSession())
+	require.NoError(t, s.Close(false))
+
+	// The states are loaded again, without the session.
+	s, err = New(sock, stateFile)
+	require.NoError(t, err)
+	require.False(t, s.HasSession())
+	mounts, err = s.Mounts()
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+	require.NoError(t, s.Close(true))
+	_, err = os.Stat(stateFile)
+	require.True(t, os.IsNotExist(err))
+}
@@ -8,32 +8,96 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/reference/docker"
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/admin"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/autoconvert"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/batch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/bench"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/config"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/copier"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/diff"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/estargz"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/events"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/exitcode"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/export"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/gc"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/inspect"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics/fileexporter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics/httpexporter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/migrate"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mount"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/prefetch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/pullthrough"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/restore"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/sbom"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signature"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tlsconfig"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tracing"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/viewer"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/warmup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/webhook"
 )
 
 var versionGitCommit string
 var versionBuildTime string
 var maxCacheMaxRecords uint = 50
 
+// compressors are the chunk compression algorithms of `nydus-image create
+// --compressor`, empty means the default of nydus-image.
+var compressors = []string{"", "none", "lz4_block", "gzip", "zstd"}
+
+func checkCompressor(compressor string, level int) error {
+	if !isPossibleValue(compressors, compressor) {
+		return fmt.Errorf("unsupported compressor %s, should be none, lz4_block, gzip or zstd", compressor)
+	}
+	if level < 0 || level > 22 {
+		return fmt.Errorf("invalid compress level %d, should be between 0 and 22", level)
+	}
+	if level != 0 && compressor != "zstd" {
+		return fmt.Errorf("--compress-level is only supported by zstd compressor")
+	}
+	return nil
+}
+
+func checkEncryption(keyID, keyProvider string) error {
+	if (keyID == "") != (keyProvider == "") {
+		return fmt.Errorf("--encrypt-key-id and --key-provider should be specified together")
+	}
+	return nil
+}
+
 func isPossibleValue(excepted []string, value string) bool {
 	for _, v := range excepted {
 		if value == v {
@@ -43,6 +107,46 @@ func isPossibleValue(excepted []string, value string) bool {
 	return false
 }
 
+func parseOIDCConfig(path string) (*provider.OIDCConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return provider.ParseOIDCConfig(path)
+}
+
+func newSigners(c *cli.Context) ([]signature.Signer, error) {
+	signers := []signature.Signer{}
+	if keyPath := c.String("sign-cosign-key"); keyPath != "" {
+		signer, err := signature.NewCosignSigner(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	if key := c.String("sign-notation-key"); key != "" {
+		signer, err := signature.NewNotationSigner(c.String("notation"), key)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// newSignatureVerifier returns nil if no cosign verification option is specified.
+func newSignatureVerifier(c *cli.Context) (*signature.Verifier, error) {
+	if c.String("verify-cosign-key") == "" && c.String("verify-cosign-identity") == "" {
+		return nil, nil
+	}
+	return signature.NewVerifier(signature.VerifyOpt{
+		KeyPath:         c.String("verify-cosign-key"),
+		FulcioRootsPath: c.String("verify-cosign-fulcio-roots"),
+		RekorKeyPath:    c.String("verify-cosign-rekor-key"),
+		CertIdentity:    c.String("verify-cosign-identity"),
+		CertOIDCIssuer:  c.String("verify-cosign-oidc-issuer"),
+	})
+}
+
 func parseBackendConfig(backendConfigJSON, backendConfigFile string) (string, error) {
 	if backendConfigJSON != "" && backendConfigFile != "" {
 		return "", fmt.Errorf("--backend-config conflicts with --backend-config-file")
@@ -59,6 +163,123 @@ func parseBackendConfig(backendConfigJSON, backendConfigFile string) (string, er
 	return backendConfigJSON, nil
 }
 
+// backendRetryConfig returns the retry policy of storage backend requests from the flags.
+func backendRetryConfig(c *cli.Context) backend.RetryConfig {
+	return backend.RetryConfig{
+		Attempts:         c.Int("backend-retry-attempts"),
+		Interval:         c.Duration("backend-retry-interval"),
+		MaxInterval:      c.Duration("backend-retry-max-interval"),
+		Budget:           c.Float64("backend-retry-budget"),
+		BreakerThreshold: c.Int("backend-breaker-threshold"),
+		BreakerCooldown:  c.Duration("backend-breaker-cooldown"),
+	}
+}
+
+func registryTransportOptions(c *cli.Context) provider.TransportOptions {
+	return provider.TransportOptions{
+		KeepAlive:           c.Bool("registry-keep-alive"),
+		MaxIdleConns:        c.Int("registry-max-idle-conns"),
+		MaxConnsPerHost:     c.Int("registry-max-conns-per-host"),
+		HTTP2:               c.Bool("registry-http2"),
+		TLSSessionCacheSize: c.Int("registry-tls-session-cache"),
+	}
+}
+
+// annotationOpt edits the annotations and labels copied from source image.
+func annotationOpt(c *cli.Context) (converter.AnnotationOpt, error) {
+	annotations, err := converter.ParseKeyValues(c.StringSlice("annotation"))
+	if err != nil {
+		return converter.AnnotationOpt{}, errors.Wrap(err, "parse --annotation")
+	}
+	labels, err := converter.ParseKeyValues(c.StringSlice("label"))
+	if err != nil {
+		return converter.AnnotationOpt{}, errors.Wrap(err, "parse --label")
+	}
+	return converter.AnnotationOpt{
+		Annotations:      annotations,
+		Labels:           labels,
+		StripAnnotations: c.StringSlice("strip-annotation"),
+		StripLabels:      c.StringSlice("strip-label"),
+	}, nil
+}
+
+// chunkedUploadOpt enables the resumable chunked upload of target blobs, the
+// upload sessions are persisted in work directory.
+func chunkedUploadOpt(c *cli.Context) (*remote.ChunkedUploadOpt, error) {
+	if c.String("push-chunk-size") == "" {
+		return nil, nil
+	}
+	chunkSize, err := humanize.ParseBytes(c.String("push-chunk-size"))
+	if err != nil || chunkSize == 0 {
+		return nil, fmt.Errorf("invalid --push-chunk-size %s", c.String("push-chunk-size"))
+	}
+	return &remote.ChunkedUploadOpt{
+		ChunkSize: int64(chunkSize),
+		StateDir:  filepath.Join(c.String("work-dir"), "uploads"),
+	}, nil
+}
+
+// addMountSources adds the repositories to mount blobs from on push, they
+// must be in the registry of target.
+func addMountSources(target *remote.Remote, refs []string) error {
+	for _, ref := range refs {
+		source, err := remote.New(ref, nil)
+		if err != nil {
+			return errors.Wrapf(err, "parse repository %s to mount from", ref)
+		}
+		if !target.AddMountSource(source) {
+			return fmt.Errorf("repository %s to mount from isn't in the registry of target", ref)
+		}
+	}
+	return nil
+}
+
+// pushFile pushes the file as a blob to the repository of remote, the file
+// name is kept in the title annotation.
+func pushFile(ctx context.Context, r *remote.Remote, path, mediaType string) (*ocispec.Descriptor, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read file %s", path)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+		Annotations: map[string]string{
+			ocispec.AnnotationTitle: filepath.Base(path),
+		},
+	}
+	if err := r.Push(ctx, desc, true, bytes.NewReader(data)); err != nil {
+		return nil, errors.Wrapf(err, "push file %s", path)
+	}
+	return &desc, nil
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func newViewer(ctx context.Context, c *cli.Context) (*viewer.Viewer, error) {
+	_, arch, err := provider.ExtractOsArch(c.String("platform"))
+	if err != nil {
+		return nil, err
+	}
+	targetRemote, err := provider.DefaultRemote(c.String("target"), c.Bool("target-insecure"))
+	if err != nil {
+		return nil, err
+	}
+	bootstrap, err := dedup.PullImageBootstrap(ctx, targetRemote, arch)
+	if err != nil {
+		return nil, err
+	}
+	return viewer.New(targetRemote, bootstrap), nil
+}
+
 // Add suffix to source image reference as the target
 // image reference, like this:
 // Source: localhost:5000/nginx:latest
@@ -76,6 +297,31 @@ func addReferenceSuffix(source, suffix string) (string, error) {
 	return target, nil
 }
 
+// getPrefetchPatterns returns the prefetch patterns passed to builder, they
+// are the paths in prefetch file or the prefetch directory.
+func getPrefetchPatterns(c *cli.Context) (string, error) {
+	prefetchFile := c.String("prefetch-file")
+	if prefetchFile == "" {
+		return c.String("prefetch-dir"), nil
+	}
+	if c.IsSet("prefetch-dir") {
+		return "", fmt.Errorf("--prefetch-file conflicts with --prefetch-dir")
+	}
+	file, err := os.Open(prefetchFile)
+	if err != nil {
+		return "", errors.Wrap(err, "open prefetch file")
+	}
+	defer file.Close()
+	paths, err := prefetch.ReadList(file)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no path in prefetch file %s", prefetchFile)
+	}
+	return strings.Join(paths, "\n"), nil
+}
+
 func getTargetReference(c *cli.Context) (string, error) {
 	target := c.String("target")
 	targetSuffix := c.String("target-suffix")
@@ -111,6 +357,202 @@ func getCacheReference(c *cli.Context, target string) (string, error) {
 	return cache, nil
 }
 
+// platformCacheRemote uses `$cache-$platformID` as the cache image of a platform,
+// so that the conversions of platforms don't overwrite each other's cache.
+func platformCacheRemote(cacheRemote *remote.Remote, platformID string) (*remote.Remote, error) {
+	named, err := docker.ParseDockerRef(cacheRemote.Ref)
+	if err != nil {
+		return nil, err
+	}
+	tag := "latest"
+	if tagged, ok := docker.TagNameOnly(named).(docker.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return cacheRemote.WithTag(tag + "-" + platformID)
+}
+
+func sameRepository(ref1, ref2 string) bool {
+	named1, err := docker.ParseDockerRef(ref1)
+	if err != nil {
+		return false
+	}
+	named2, err := docker.ParseDockerRef(ref2)
+	if err != nil {
+		return false
+	}
+	return named1.Name() == named2.Name()
+}
+
+func setupLogging(c *cli.Context) error {
+	level, err := logrus.ParseLevel(c.String("log-level"))
+	if err != nil {
+		return err
+	}
+	moduleLevels, err := logging.ParseModuleLevels(c.String("log-module-level"))
+	if err != nil {
+		return err
+	}
+	return logging.Setup(level, c.String("log-format"), moduleLevels)
+}
+
+// setupProxy sets the default proxy from the proxy flags, which are exported
+// as environment variables as well for nydusd and nydus-image started later.
+func setupProxy(c *cli.Context) error {
+	override := proxy.Config{
+		HTTPProxy:  c.String("http-proxy"),
+		HTTPSProxy: c.String("https-proxy"),
+		NoProxy:    c.String("no-proxy"),
+	}
+	if override == (proxy.Config{}) {
+		return nil
+	}
+	config := proxy.FromEnvironment().Merge(override)
+	if err := proxy.SetDefault(config); err != nil {
+		return err
+	}
+	for name, value := range map[string]string{
+		"HTTP_PROXY":  config.HTTPProxy,
+		"HTTPS_PROXY": config.HTTPSProxy,
+		"NO_PROXY":    config.NoProxy,
+	} {
+		// The lowercase versions take precedence in some tools.
+		for _, key := range []string{name, strings.ToLower(name)} {
+			if err := os.Setenv(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configChoices are the possible values of flags checked in config file, keyed
+// by flag name, or by `<command> <flag>` if the flag has different meanings in
+// commands.
+var configChoices = map[string][]string{
+	"log-level":         {"panic", "fatal", "error", "warn", "warning", "info", "debug", "trace"},
+	"log-format":        {"text", "json"},
+	"target-format":     {"nydus", "estargz"},
+	"compressor":        compressors,
+	"prefetch-policy":   {"", "background", "eager", "on-demand"},
+	"sbom":              {"", string(sbom.FormatSPDX), string(sbom.FormatCycloneDX)},
+	"whiteout-strategy": {string(provider.StrategyPreserve), string(provider.StrategyResolve)},
+	"hardlink-strategy": {string(provider.StrategyPreserve), string(provider.StrategyResolve)},
+	"convert output":    {"text", "json"},
+	"inspect format":    {"table", "json"},
+	"export format":     {export.FormatOCIArchive, export.FormatRootfs},
+	"diff format":       {"text", "json"},
+	"bench format":      {"text", "json"},
+}
+
+// configOutputs are the file flags written by commands, which needn't exist
+// before running.
+var configOutputs = map[string]bool{
+	"output":   true,
+	"report":   true,
+	"db":       true,
+	"dedup-db": true,
+	"api-sock": true,
+}
+
+// walkCommands calls fn on commands and their subcommands, a subcommand is
+// named after its parent command, e.g. `dedup inspect`.
+func walkCommands(prefix string, commands []*cli.Command, fn func(name string, command *cli.Command) error) error {
+	for _, command := range commands {
+		name := strings.TrimSpace(prefix + " " + command.Name)
+		if err := fn(name, command); err != nil {
+			return err
+		}
+		if err := walkCommands(name, command.Subcommands, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configSchema describes the flags of commands to check config file.
+func configSchema(commands []*cli.Command) config.Schema {
+	schema := config.Schema{}
+	walkCommands("", commands, func(name string, command *cli.Command) error {
+		flags := []config.Flag{}
+		for _, flag := range command.Flags {
+			schemaFlag := config.Flag{Name: flag.Names()[0]}
+			switch f := flag.(type) {
+			case *cli.StringFlag:
+				schemaFlag.TakesFile = f.TakesFile && !configOutputs[schemaFlag.Name]
+			case *cli.BoolFlag:
+				schemaFlag.Kind = config.Bool
+			case *cli.IntFlag:
+				schemaFlag.Kind = config.Int
+			case *cli.UintFlag:
+				schemaFlag.Kind = config.Uint
+			case *cli.Float64Flag:
+				schemaFlag.Kind = config.Float
+			case *cli.DurationFlag:
+				schemaFlag.Kind = config.Duration
+			case *cli.StringSliceFlag:
+				schemaFlag.Kind = config.StringSlice
+				schemaFlag.TakesFile = f.TakesFile
+			}
+			if choices, ok := configChoices[name+" "+schemaFlag.Name]; ok {
+				schemaFlag.Choices = choices
+			} else if schemaFlag.Kind == config.String {
+				schemaFlag.Choices = configChoices[schemaFlag.Name]
+			}
+			flags = append(flags, schemaFlag)
+		}
+		schema[name] = flags
+		return nil
+	})
+	return schema
+}
+
+// applyConfigFile sets the flag defaults of commands to the values in config
+// file, so that the flags specified in command line or environment variables
+// still take precedence over config file.
+func applyConfigFile(commands []*cli.Command, path string) error {
+	file, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	schema := configSchema(commands)
+	for name := range file.Commands {
+		if _, ok := schema[name]; !ok {
+			return fmt.Errorf("unknown command %s in config file %s", name, path)
+		}
+	}
+
+	return walkCommands("", commands, func(name string, command *cli.Command) error {
+		values, err := file.Values(schema, name)
+		if err != nil {
+			return errors.Wrapf(err, "invalid config file %s", path)
+		}
+		for _, flag := range command.Flags {
+			value, ok := values[flag.Names()[0]]
+			if !ok {
+				continue
+			}
+			// The required flags are satisfied by config file.
+			switch f := flag.(type) {
+			case *cli.StringFlag:
+				f.Value, f.Required = value.String, false
+			case *cli.BoolFlag:
+				f.Value, f.Required = value.Bool, false
+			case *cli.IntFlag:
+				f.Value, f.Required = int(value.Int), false
+			case *cli.UintFlag:
+				f.Value, f.Required = uint(value.Uint), false
+			case *cli.Float64Flag:
+				f.Value, f.Required = value.Float, false
+			case *cli.DurationFlag:
+				f.Value, f.Required = value.Duration, false
+			case *cli.StringSliceFlag:
+				f.Value, f.Required = cli.NewStringSlice(value.Strings...), false
+			}
+		}
+		return nil
+	})
+}
+
 func main() {
 	logrus.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
@@ -122,6 +564,31 @@ func main() {
 		Name:    "Nydusify",
 		Usage:   "Nydus image converter tool",
 		Version: version,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config-file", Required: false, TakesFile: true, Usage: "Read the flags of commands from YAML (or JSON) config file, which are overridden by command line and environment variables", EnvVars: []string{"NYDUSIFY_CONFIG"}},
+			&cli.StringFlag{Name: "http-proxy", Required: false, Usage: "Proxy URL (http, https or socks5) of http requests to registries and storage backends, overrides HTTP_PROXY environment variable"},
+			&cli.StringFlag{Name: "https-proxy", Required: false, Usage: "Proxy URL (http, https or socks5) of https requests to registries and storage backends, tunneled by CONNECT for http proxy, overrides HTTPS_PROXY environment variable"},
+			&cli.StringFlag{Name: "no-proxy", Required: false, Usage: "Comma-separated hosts, domain suffixes, IPs or CIDRs bypassing proxy, overrides NO_PROXY environment variable"},
+			&cli.StringFlag{Name: "tls-config", Required: false, TakesFile: true, Usage: "Read the TLS config (CA file, client certificate and key for mTLS, insecure_skip_verify) of registry and storage backend hosts from JSON file", EnvVars: []string{"NYDUSIFY_TLS_CONFIG"}},
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := setupProxy(c); err != nil {
+			return exitcode.Wrap(exitcode.Usage, err)
+		}
+		if path := c.String("tls-config"); path != "" {
+			hosts, err := tlsconfig.Load(path)
+			if err != nil {
+				return exitcode.Wrap(exitcode.Usage, err)
+			}
+			tlsconfig.SetDefault(hosts)
+		}
+		// The config file is checked by `config validate` with all
+		// problems reported.
+		if path := c.String("config-file"); path != "" && c.Args().First() != "config" {
+			return exitcode.Wrap(exitcode.Usage, applyConfigFile(app.Commands, path))
+		}
+		return nil
 	}
 
 	logrus.Infof("Version: %s\n", version)
@@ -132,22 +599,66 @@ func main() {
 			Usage: "Convert source image to nydus image",
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
-				&cli.StringFlag{Name: "source", Required: true, Usage: "Source image reference", EnvVars: []string{"SOURCE"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+				&cli.StringFlag{Name: "log-module-level", Required: false, Usage: "Set log level of subsystems (registry, backend, cache, build), e.g. registry=debug,backend=warn", EnvVars: []string{"NYDUSIFY_LOG_MODULE_LEVEL"}},
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Source image reference, or docker-archive:/path/to/image.tar, oci-archive:/path/to/image.tar (use - as path to read from stdin)", EnvVars: []string{"SOURCE"}},
 				&cli.StringFlag{Name: "target", Required: false, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
+				&cli.StringFlag{Name: "target-format", Value: "nydus", Usage: "Format of target image (nydus, estargz), estargz image can be lazily pulled by stargz-snapshotter", EnvVars: []string{"NYDUSIFY_TARGET_FORMAT"}},
 				&cli.StringFlag{Name: "target-suffix", Required: false, Usage: "Add suffix to source image reference as target image reference, conflict with --target", EnvVars: []string{"TARGET_SUFFIX"}},
 				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
 				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
+				&cli.StringSliceFlag{Name: "target-mount-from", Required: false, Usage: "Mount the blobs existed in the repository of target registry instead of uploading again, can be repeated", EnvVars: []string{"NYDUSIFY_TARGET_MOUNT_FROM"}},
+				&cli.StringSliceFlag{Name: "source-mirror", Required: false, Usage: "Fetch source layers from the mirror URLs in order, fail over to next mirror or source registry if the mirror is unhealthy", EnvVars: []string{"NYDUSIFY_SOURCE_MIRRORS"}},
+				&cli.StringFlag{Name: "source-p2p-proxy", Required: false, Usage: "Fetch source layers through the HTTP proxy of P2P system like Dragonfly dfdaemon (e.g. http://127.0.0.1:65001), fall back to source registry if the proxy is unhealthy", EnvVars: []string{"NYDUSIFY_SOURCE_P2P_PROXY"}},
+				&cli.BoolFlag{Name: "registry-keep-alive", Required: false, Usage: "Reuse the connections to registry across requests", EnvVars: []string{"NYDUSIFY_REGISTRY_KEEP_ALIVE"}},
+				&cli.StringFlag{Name: "push-chunk-size", Required: false, Usage: "Push the blobs larger than the size (e.g. 64MiB) to registry in resumable chunks, an interrupted push continues where it left off in retry or next run with the same work directory", EnvVars: []string{"NYDUSIFY_PUSH_CHUNK_SIZE"}},
+				&cli.IntFlag{Name: "registry-max-idle-conns", Value: 10, Usage: "Maximum idle connections kept for reuse per registry host, with --registry-keep-alive", EnvVars: []string{"NYDUSIFY_REGISTRY_MAX_IDLE_CONNS"}},
+				&cli.IntFlag{Name: "registry-max-conns-per-host", Value: 0, Usage: "Maximum connections per registry host including the active ones, 0 means no limit", EnvVars: []string{"NYDUSIFY_REGISTRY_MAX_CONNS_PER_HOST"}},
+				&cli.BoolFlag{Name: "registry-http2", Required: false, Usage: "Enable HTTP/2 for the TLS connections to registry", EnvVars: []string{"NYDUSIFY_REGISTRY_HTTP2"}},
+				&cli.IntFlag{Name: "registry-tls-session-cache", Value: 0, Usage: "Resume TLS sessions to registry with a cache of the number of sessions, 0 means disabled", EnvVars: []string{"NYDUSIFY_REGISTRY_TLS_SESSION_CACHE"}},
+				&cli.StringFlag{Name: "source-credential-helper", Required: false, Usage: "Get source registry credentials by docker-credential-<helper>, such as ecr-login, gcloud, acr-env", EnvVars: []string{"NYDUSIFY_SOURCE_CREDENTIAL_HELPER"}},
+				&cli.StringFlag{Name: "target-credential-helper", Required: false, Usage: "Get target registry credentials by docker-credential-<helper>, such as ecr-login, gcloud, acr-env", EnvVars: []string{"NYDUSIFY_TARGET_CREDENTIAL_HELPER"}},
+				&cli.StringFlag{Name: "source-oidc-config", Required: false, TakesFile: true, Usage: "Authorize source registry requests with the bearer token from OIDC provider configured in the JSON file", EnvVars: []string{"NYDUSIFY_SOURCE_OIDC_CONFIG"}},
+				&cli.StringFlag{Name: "target-oidc-config", Required: false, TakesFile: true, Usage: "Authorize target registry requests with the bearer token from OIDC provider configured in the JSON file", EnvVars: []string{"NYDUSIFY_TARGET_OIDC_CONFIG"}},
+				&cli.StringSliceFlag{Name: "source-decryption-key", Required: false, TakesFile: true, Usage: "The PEM file of RSA private key to decrypt OCI encrypted source layers, can be specified multiple times", EnvVars: []string{"NYDUSIFY_SOURCE_DECRYPTION_KEYS"}},
 				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for image conversion", EnvVars: []string{"WORK_DIR"}},
 				&cli.StringFlag{Name: "prefetch-dir", Value: "/", Usage: "Prefetch directory for nydus image, use absolute path of rootfs", EnvVars: []string{"PREFETCH_DIR"}},
+				&cli.StringFlag{Name: "prefetch-file", Required: false, TakesFile: true, Usage: "Prefetch the files listed in the file (one absolute path of rootfs per line) for nydus image, which can be generated by `nydusify prefetch`, conflict with --prefetch-dir", EnvVars: []string{"NYDUSIFY_PREFETCH_FILE"}},
+				&cli.StringFlag{Name: "prefetch-policy", Value: "", Usage: "Write prefetch policy (background, eager, on-demand) to Nydus image, which overrides the policy selected by mount option", EnvVars: []string{"NYDUSIFY_PREFETCH_POLICY"}},
 				&cli.StringFlag{Name: "nydus-image", Value: "nydus-image", Usage: "The nydus-image binary path, if unset, search in PATH environment", EnvVars: []string{"NYDUS_IMAGE"}},
 				&cli.BoolFlag{Name: "multi-platform", Value: false, Usage: "Merge OCI & Nydus manifest to manifest index for target image, please ensure that OCI manifest already exists in target image", EnvVars: []string{"MULTI_PLATFORM"}},
-				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "compressor", Value: "", Usage: "Algorithm to compress chunk data in Nydus blob (none, lz4_block, gzip, zstd), use the default of nydus-image if not specified", EnvVars: []string{"NYDUSIFY_COMPRESSOR"}},
+				&cli.IntFlag{Name: "compress-level", Value: 0, Usage: "Level of zstd compressor between 1 and 22, 0 uses the default level 3", EnvVars: []string{"NYDUSIFY_COMPRESS_LEVEL"}},
+				&cli.BoolFlag{Name: "compress-auto", Value: false, Usage: "Store the already compressed files (e.g. gzip, zstd, zip archives and jpeg, png images) without compression, detected by file extension and magic number", EnvVars: []string{"NYDUSIFY_COMPRESS_AUTO"}},
+				&cli.StringFlag{Name: "encrypt-key-id", Value: "", Usage: "ID of the key to encrypt chunk data in Nydus blob with AES-256-GCM, the image is built in RAFS v5, requires --key-provider", EnvVars: []string{"NYDUSIFY_ENCRYPT_KEY_ID"}},
+				&cli.StringFlag{Name: "key-provider", Value: "", TakesFile: true, Usage: "Path to the key provider configuration file of nydus-image to get the key of --encrypt-key-id", EnvVars: []string{"NYDUSIFY_KEY_PROVIDER"}},
+				&cli.BoolFlag{Name: "flatten", Value: false, Usage: "Merge all source layers into one Nydus layer, the whiteouts in source layers are applied", EnvVars: []string{"NYDUSIFY_FLATTEN"}},
+				&cli.StringFlag{Name: "whiteout-strategy", Value: string(provider.StrategyPreserve), Usage: "How whiteouts and opaque directories of source layers are materialized: preserve them in Nydus layers, or resolve them at conversion time by merging source layers like --flatten", EnvVars: []string{"NYDUSIFY_WHITEOUT_STRATEGY"}},
+				&cli.StringFlag{Name: "hardlink-strategy", Value: string(provider.StrategyPreserve), Usage: "How hardlinks of source layers are materialized: preserve them, or resolve them into independent regular files so that no hardlink spans Nydus layers", EnvVars: []string{"NYDUSIFY_HARDLINK_STRATEGY"}},
+				&cli.StringSliceFlag{Name: "include-path", Required: false, Usage: "Only keep the paths of source layers matching the pattern (and their parent directories), an absolute path pattern like `/app` or name pattern like `*.so`, can be specified multiple times", EnvVars: []string{"NYDUSIFY_INCLUDE_PATHS"}},
+				&cli.StringSliceFlag{Name: "exclude-path", Required: false, Usage: "Drop the paths of source layers matching the pattern, an absolute path pattern like `/usr/share/doc` or name pattern like `*.pyc`, overrides --include-path, can be specified multiple times", EnvVars: []string{"NYDUSIFY_EXCLUDE_PATHS"}},
+				&cli.StringFlag{Name: "sbom", Required: false, Usage: "Generate SBOM of target image in the format (spdx, cyclonedx) and attach it as a referrer artifact", EnvVars: []string{"NYDUSIFY_SBOM"}},
+				&cli.StringSliceFlag{Name: "annotation", Required: false, Usage: "Add the annotation key=value to target manifest, which overrides the one copied from source manifest, can be repeated", EnvVars: []string{"NYDUSIFY_ANNOTATIONS"}},
+				&cli.StringSliceFlag{Name: "strip-annotation", Required: false, Usage: "Don't copy the annotation key of source manifest, key* matches the prefix, can be repeated", EnvVars: []string{"NYDUSIFY_STRIP_ANNOTATIONS"}},
+				&cli.StringSliceFlag{Name: "label", Required: false, Usage: "Add the label key=value to target image config, which overrides the one copied from source config, can be repeated", EnvVars: []string{"NYDUSIFY_LABELS"}},
+				&cli.StringSliceFlag{Name: "strip-label", Required: false, Usage: "Don't copy the label key of source image config, key* matches the prefix, can be repeated", EnvVars: []string{"NYDUSIFY_STRIP_LABELS"}},
+				&cli.BoolFlag{Name: "provenance", Value: false, Usage: "Attach an in-toto provenance attestation of the conversion to target image as a referrer artifact", EnvVars: []string{"NYDUSIFY_PROVENANCE"}},
+				&cli.BoolFlag{Name: "tar-split", Value: false, Usage: "Attach the tar-split metadata of source layers to target image as a referrer artifact, so that the source image can be reconstructed by `nydusify restore`", EnvVars: []string{"NYDUSIFY_TAR_SPLIT"}},
+				&cli.BoolFlag{Name: "dry-run", Value: false, Usage: "Build Nydus image locally and print the estimated size, chunks, dedup ratio against existing target image and upload volume in JSON, nothing is pushed", EnvVars: []string{"NYDUSIFY_DRY_RUN"}},
+				&cli.BoolFlag{Name: "all-platforms", Value: false, Usage: "Convert all supported platforms in source manifest index and push a manifest index for them, conflict with --platform", EnvVars: []string{"NYDUSIFY_ALL_PLATFORMS"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index, the OS is `linux` or `windows`, the architecture is `amd64` or `arm64`"},
 				&cli.BoolFlag{Name: "docker-v2-format", Value: false, Usage: "Use docker image manifest v2, schema 2 format", EnvVars: []string{"DOCKER_V2_FORMAT"}},
 				&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type", EnvVars: []string{"BACKEND_TYPE"}},
 				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
 				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
 				&cli.BoolFlag{Name: "backend-force-push", Value: false, Usage: "Force to push Nydus blob to storage backend, even if the blob already exists in storage backend", EnvVars: []string{"BACKEND_FORCE_PUSH"}},
 				&cli.BoolFlag{Name: "backend-aligned-chunk", Value: false, Usage: "Produce 4096 aligned decompressed_offset in Nydus bootstrap", EnvVars: []string{"BACKEND_ALIGNED_CHUNK"}},
+				&cli.IntFlag{Name: "backend-retry-attempts", Value: 3, Usage: "Maximum attempts to upload a blob to storage backend, client side errors aren't retried", EnvVars: []string{"NYDUSIFY_BACKEND_RETRY_ATTEMPTS"}},
+				&cli.DurationFlag{Name: "backend-retry-interval", Value: 2 * time.Second, Usage: "Backoff before the first retry of storage backend upload, doubled for each retry with jitter", EnvVars: []string{"NYDUSIFY_BACKEND_RETRY_INTERVAL"}},
+				&cli.DurationFlag{Name: "backend-retry-max-interval", Value: 30 * time.Second, Usage: "Maximum backoff between retries of storage backend upload", EnvVars: []string{"NYDUSIFY_BACKEND_RETRY_MAX_INTERVAL"}},
+				&cli.Float64Flag{Name: "backend-retry-budget", Value: 0.2, Usage: "Limit the retries of storage backend upload to the ratio of uploads (plus 10 retries)", EnvVars: []string{"NYDUSIFY_BACKEND_RETRY_BUDGET"}},
+				&cli.IntFlag{Name: "backend-breaker-threshold", Value: 5, Usage: "Open the circuit breaker of storage backend host after continuous failures, uploads fail fast until it cools down", EnvVars: []string{"NYDUSIFY_BACKEND_BREAKER_THRESHOLD"}},
+				&cli.DurationFlag{Name: "backend-breaker-cooldown", Value: 30 * time.Second, Usage: "Duration before an open circuit breaker allows a trial upload", EnvVars: []string{"NYDUSIFY_BACKEND_BREAKER_COOLDOWN"}},
 				&cli.StringFlag{Name: "build-cache", Value: "", Usage: "An remote image reference for accelerating nydus image build", EnvVars: []string{"BUILD_CACHE"}},
 				&cli.StringFlag{Name: "build-cache-tag", Value: "", Usage: "Use $target:$build-cache-tag as cache image reference, conflict with --build-cache", EnvVars: []string{"BUILD_CACHE_TAG"}},
 				&cli.StringFlag{Name: "build-cache-version", Value: "v1", Usage: "Specify the version of cache image, if the existed remote cache image does not match the version, cache records will be dropped", EnvVars: []string{"BUILD_CACHE_VERSION"}},
@@ -155,46 +666,131 @@ func main() {
 				&cli.StringFlag{Name: "chunk-dict", Required: false, Usage: "Specify a chunk dict expression for image chunk deduplication, " +
 					"for examples: bootstrap:registry:localhost:5000/namespace/app:chunk_dict, bootstrap:local:/path/to/chunk_dict.boot", EnvVars: []string{"CHUNK_DICT"}},
 				&cli.BoolFlag{Name: "chunk-dict-insecure", Required: false, Value: false, Usage: "Allow http/insecure registry communication of chunk dict", EnvVars: []string{"CHUNK_DICT_INSECURE"}},
+				&cli.StringFlag{Name: "base-image", Required: false, Usage: "Nydus image converted from previous version of source image, its chunks are reused instead of uploading again, conflict with --chunk-dict", EnvVars: []string{"NYDUSIFY_BASE_IMAGE"}},
+				&cli.StringFlag{Name: "dedup-db", Required: false, TakesFile: true, Usage: "Deduplicate chunks with the images recorded in the database file, the converted image is recorded in it, conflict with --chunk-dict and --base-image", EnvVars: []string{"NYDUSIFY_DEDUP_DB"}},
+				&cli.BoolFlag{Name: "base-image-insecure", Required: false, Value: false, Usage: "Allow http/insecure registry communication of base image", EnvVars: []string{"NYDUSIFY_BASE_IMAGE_INSECURE"}},
+				&cli.UintFlag{Name: "max-concurrency", Value: converter.PullWorkerCount, Usage: "Maximum number of layers pulled or pushed concurrently", EnvVars: []string{"NYDUSIFY_MAX_CONCURRENCY"}},
+				&cli.StringFlag{Name: "metrics-listen", Required: false, Usage: "Serve Prometheus metrics on the address (e.g. 127.0.0.1:9110) during conversion", EnvVars: []string{"NYDUSIFY_METRICS_LISTEN"}},
+				&cli.StringFlag{Name: "sign-cosign-key", Required: false, TakesFile: true, Usage: "Sign target image by the cosign private key after pushing, the key password is read from $COSIGN_PASSWORD", EnvVars: []string{"NYDUSIFY_SIGN_COSIGN_KEY"}},
+				&cli.StringFlag{Name: "sign-notation-key", Required: false, Usage: "Sign target image by notation with the signing key profile after pushing", EnvVars: []string{"NYDUSIFY_SIGN_NOTATION_KEY"}},
+				&cli.StringFlag{Name: "notation", Value: "notation", Usage: "The notation binary path, if unset, search in PATH environment", EnvVars: []string{"NYDUSIFY_NOTATION"}},
+				&cli.StringFlag{Name: "verify-cosign-key", Required: false, TakesFile: true, Usage: "Verify cosign signature of source image by the public key before conversion", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_KEY"}},
+				&cli.StringFlag{Name: "verify-cosign-identity", Required: false, Usage: "Verify keyless cosign signature of source image before conversion, the email or URI expected in Fulcio certificate", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_IDENTITY"}},
+				&cli.StringFlag{Name: "verify-cosign-oidc-issuer", Required: false, Usage: "The OIDC issuer expected in Fulcio certificate for keyless cosign verification", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_OIDC_ISSUER"}},
+				&cli.StringFlag{Name: "verify-cosign-fulcio-roots", Required: false, TakesFile: true, Usage: "The PEM file of Fulcio root certificates for keyless cosign verification", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_FULCIO_ROOTS"}},
+				&cli.StringFlag{Name: "verify-cosign-rekor-key", Required: false, TakesFile: true, Usage: "The PEM file of Rekor public key for keyless cosign verification", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_REKOR_KEY"}},
 				// The --build-cache-max-records flag represents the maximum number
 				// of layers in cache image. 50 (bootstrap + blob in one record) was
 				// chosen to make it compatible with the 127 max in graph driver of
 				// docker so that we can pull cache image using docker.
 				&cli.UintFlag{Name: "build-cache-max-records", Value: maxCacheMaxRecords, Usage: "Maximum cache records in cache image", EnvVars: []string{"BUILD_CACHE_MAX_RECORDS"}},
+				&cli.StringFlag{Name: "output", Value: "text", Usage: "Output format (text, json), json streams the progress events and result document as JSON lines to stdout", EnvVars: []string{"NYDUSIFY_OUTPUT"}},
+				&cli.StringSliceFlag{Name: "event-sink", Required: false, Usage: "Deliver lifecycle events as JSON to the webhook URL, or append them to the file as JSON lines, can be repeated", EnvVars: []string{"NYDUSIFY_EVENT_SINKS"}},
 			},
-			Action: func(c *cli.Context) error {
-				logLevel, err := logrus.ParseLevel(c.String("log-level"))
+			Action: func(c *cli.Context) (retErr error) {
+				start := time.Now()
+				// The failures before conversion starts are caused by the
+				// arguments or configuration, unless classified already.
+				converting := false
+				target := ""
+				var reporter *progress.Reporter
+				var detail interface{}
+				closeEvents := func() {}
+				defer func() {
+					if retErr != nil && !converting {
+						retErr = exitcode.Wrap(exitcode.Usage, retErr)
+					}
+					code := exitcode.Of(retErr)
+					event := events.Event{
+						Type:  events.TypeConversionFinished,
+						Image: target,
+						Data: map[string]interface{}{
+							"source":    c.String("source"),
+							"duration":  time.Since(start).Seconds(),
+							"exit_code": code,
+							"class":     exitcode.Name(code),
+						},
+					}
+					if retErr != nil {
+						event.Error = retErr.Error()
+					}
+					events.Emit(event)
+					closeEvents()
+					if reporter != nil {
+						result := &progress.ResultEvent{
+							Status:   progress.StatusSucceeded,
+							Source:   c.String("source"),
+							Target:   target,
+							Duration: time.Since(start).Seconds(),
+							ExitCode: code,
+							Class:    exitcode.Name(code),
+							Detail:   detail,
+						}
+						if retErr != nil {
+							result.Status = progress.StatusFailed
+							result.Error = retErr.Error()
+						}
+						reporter.Emit(result)
+					}
+				}()
+
+				switch c.String("output") {
+				case "text":
+				case "json":
+					reporter = progress.NewReporter(os.Stdout)
+				default:
+					return fmt.Errorf("--output should be text or json")
+				}
+
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				closeEvents, err := events.Setup(c.StringSlice("event-sink"))
 				if err != nil {
 					return err
 				}
-				logrus.SetLevel(logLevel)
 
-				target, err := getTargetReference(c)
+				target, err = getTargetReference(c)
 				if err != nil {
 					return err
 				}
 
+				targetFormat := c.String("target-format")
+				if targetFormat != "nydus" && targetFormat != "estargz" {
+					return fmt.Errorf("--target-format should be nydus or estargz")
+				}
+
 				backendType := c.String("backend-type")
-				possibleBackendTypes := []string{"registry", "oss"}
+				possibleBackendTypes := []string{"registry", "oss", "s3", "azure", "gcs", "localfs", "external", "ipfs"}
 				if !isPossibleValue(possibleBackendTypes, backendType) {
 					return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
 				}
 
-				// This only works for OSS backend rightnow
+				// This only works for object storage backends rightnow
 				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
 				if err != nil {
 					return err
 				}
-				if backendType != "registry" && strings.TrimSpace(backendConfig) == "" {
+				if backendType != "registry" && backendType != "ipfs" && strings.TrimSpace(backendConfig) == "" {
 					return fmt.Errorf("--backend-config or --backend-config-file required")
 				}
 
+				targetOIDC, err := parseOIDCConfig(c.String("target-oidc-config"))
+				if err != nil {
+					return err
+				}
+
 				var cacheRemote *remote.Remote
 				cache, err := getCacheReference(c, target)
 				if err != nil {
 					return err
 				}
 				if cache != "" {
-					cacheRemote, err = provider.DefaultRemote(cache, c.Bool("build-cache-insecure"))
+					cacheRemote, err = provider.DefaultRemoteWithOptions(cache, c.Bool("build-cache-insecure"), provider.RemoteOptions{
+						CredentialHelper: c.String("target-credential-helper"),
+						OIDC:             targetOIDC,
+						Transport:        registryTransportOptions(c),
+					})
 					if err != nil {
 						return err
 					}
@@ -209,10 +805,60 @@ func main() {
 				}
 				cacheVersion := c.String("build-cache-version")
 
+				prefetchPatterns, err := getPrefetchPatterns(c)
+				if err != nil {
+					return err
+				}
+				prefetchPolicy, err := prefetch.ParsePolicy(c.String("prefetch-policy"))
+				if err != nil {
+					return err
+				}
+
+				compressor, compressLevel := c.String("compressor"), c.Int("compress-level")
+				if err := checkCompressor(compressor, compressLevel); err != nil {
+					return err
+				}
+				encryptKeyID, keyProvider := c.String("encrypt-key-id"), c.String("key-provider")
+				if err := checkEncryption(encryptKeyID, keyProvider); err != nil {
+					return err
+				}
+
+				chunkDictArgs, chunkDictInsecure := c.String("chunk-dict"), c.Bool("chunk-dict-insecure")
+				if baseImage := c.String("base-image"); baseImage != "" {
+					if chunkDictArgs != "" {
+						return fmt.Errorf("--base-image conflicts with --chunk-dict")
+					}
+					// Reuse chunks of base image by taking its bootstrap as chunk dict
+					chunkDictArgs = "bootstrap:registry:" + baseImage
+					chunkDictInsecure = c.Bool("base-image-insecure")
+					if backendType == "registry" && !sameRepository(baseImage, target) {
+						logrus.Warnf("Base image %s isn't in the repository of target image, the reused blobs can't be pulled from target repository", baseImage)
+					}
+				}
+				if c.String("dedup-db") != "" && chunkDictArgs != "" {
+					return fmt.Errorf("--dedup-db conflicts with --chunk-dict and --base-image")
+				}
+				if c.Uint("max-concurrency") == 0 {
+					return fmt.Errorf("--max-concurrency should be greater than 0")
+				}
+
 				logger, err := provider.DefaultLogger()
 				if err != nil {
 					return err
 				}
+				if reporter != nil {
+					logger = reporter.Logger()
+				}
+
+				shutdownTracing, err := tracing.Init(context.Background(), version)
+				if err != nil {
+					return err
+				}
+				defer shutdownTracing(context.Background())
+				ctx, span := tracing.Start(tracing.ContextFromEnv(context.Background()), "nydusify convert")
+				defer func() {
+					tracing.End(span, retErr)
+				}()
 
 				sourceDir := filepath.Join(c.String("work-dir"), "source")
 				if err := os.RemoveAll(sourceDir); err != nil {
@@ -221,22 +867,177 @@ func main() {
 				if err := os.MkdirAll(sourceDir, 0755); err != nil {
 					return err
 				}
-				sourceRemote, err := provider.DefaultRemote(c.String("source"), c.Bool("source-insecure"))
+
+				exporters := []metrics.Exporter{fileexporter.New(filepath.Join(c.String("work-dir"), "conversion_metrics.prom"))}
+				if addr := c.String("metrics-listen"); addr != "" {
+					httpExporter, err := httpexporter.New(addr)
+					if err != nil {
+						return err
+					}
+					exporters = append(exporters, httpExporter)
+				}
+				metrics.Register(exporters...)
+				defer metrics.Export()
+
+				sourceOIDC, err := parseOIDCConfig(c.String("source-oidc-config"))
 				if err != nil {
-					return errors.Wrap(err, "Parse source reference")
+					return err
+				}
+				// The source image is read from docker-archive or oci-archive
+				// tarball instead of registry.
+				archiveSource := provider.IsArchiveSource(c.String("source"))
+				if archiveSource && (c.Bool("all-platforms") || c.Bool("multi-platform") || targetFormat == "estargz") {
+					return fmt.Errorf("--all-platforms, --multi-platform and estargz target aren't supported for archive source")
+				}
+				var sourceRemote *remote.Remote
+				if !archiveSource {
+					sourceRemote, err = provider.DefaultRemoteWithOptions(c.String("source"), c.Bool("source-insecure"), provider.RemoteOptions{
+						Mirrors:          c.StringSlice("source-mirror"),
+						CredentialHelper: c.String("source-credential-helper"),
+						OIDC:             sourceOIDC,
+						P2PProxy:         c.String("source-p2p-proxy"),
+						Transport:        registryTransportOptions(c),
+					})
+					if err != nil {
+						return errors.Wrap(err, "Parse source reference")
+					}
 				}
 				targetPlatform := c.String("platform")
 
-				sourceProviders, err := provider.DefaultSource(context.Background(), sourceRemote, sourceDir, targetPlatform)
+				verifier, err := newSignatureVerifier(c)
+				if err != nil {
+					return err
+				}
+				if verifier != nil {
+					if archiveSource {
+						return fmt.Errorf("signature verification isn't supported for archive source")
+					}
+					if err := verifier.Verify(ctx, sourceRemote); err != nil {
+						return exitcode.Wrap(exitcode.Verify, errors.Wrap(err, "Verify signature of source image"))
+					}
+				}
+
+				var decryptionKeys *provider.DecryptionKeys
+				if keyPaths := c.StringSlice("source-decryption-key"); len(keyPaths) > 0 {
+					decryptionKeys, err = provider.LoadDecryptionKeys(keyPaths)
+					if err != nil {
+						return err
+					}
+				}
+
+				allPlatforms := c.Bool("all-platforms")
+				if allPlatforms && c.IsSet("platform") {
+					return fmt.Errorf("--all-platforms conflicts with --platform")
+				}
+				if allPlatforms && targetFormat == "estargz" {
+					return fmt.Errorf("--all-platforms isn't supported for estargz target")
+				}
+				if c.Bool("flatten") && targetFormat == "estargz" {
+					return fmt.Errorf("--flatten isn't supported for estargz target")
+				}
+				whiteoutStrategy, err := provider.ParseStrategy(c.String("whiteout-strategy"))
+				if err != nil {
+					return errors.Wrap(err, "parse --whiteout-strategy")
+				}
+				if whiteoutStrategy == provider.StrategyPreserve && c.IsSet("whiteout-strategy") && c.Bool("flatten") {
+					return fmt.Errorf("--whiteout-strategy preserve conflicts with --flatten")
+				}
+				hardlinkStrategy, err := provider.ParseStrategy(c.String("hardlink-strategy"))
+				if err != nil {
+					return errors.Wrap(err, "parse --hardlink-strategy")
+				}
+				if (whiteoutStrategy == provider.StrategyResolve || hardlinkStrategy == provider.StrategyResolve) && targetFormat == "estargz" {
+					return fmt.Errorf("resolving whiteouts or hardlinks isn't supported for estargz target")
+				}
+				pathFilter, err := provider.NewPathFilter(c.StringSlice("include-path"), c.StringSlice("exclude-path"))
+				if err != nil {
+					return err
+				}
+				if !pathFilter.IsZero() && targetFormat == "estargz" {
+					return fmt.Errorf("--include-path and --exclude-path aren't supported for estargz target")
+				}
+				var sbomFormat sbom.Format
+				if format := c.String("sbom"); format != "" {
+					if targetFormat == "estargz" {
+						return fmt.Errorf("--sbom isn't supported for estargz target")
+					}
+					if sbomFormat, err = sbom.ParseFormat(format); err != nil {
+						return err
+					}
+				}
+				if c.Bool("provenance") && targetFormat == "estargz" {
+					return fmt.Errorf("--provenance isn't supported for estargz target")
+				}
+				if c.Bool("tar-split") {
+					if targetFormat == "estargz" {
+						return fmt.Errorf("--tar-split isn't supported for estargz target")
+					}
+					if c.Bool("flatten") || whiteoutStrategy == provider.StrategyResolve || hardlinkStrategy == provider.StrategyResolve {
+						return fmt.Errorf("--tar-split conflicts with --flatten and resolve strategies")
+					}
+				}
+				annotation, err := annotationOpt(c)
+				if err != nil {
+					return err
+				}
+				for _, name := range []string{"annotation", "strip-annotation", "label", "strip-label"} {
+					if c.IsSet(name) && targetFormat == "estargz" {
+						return fmt.Errorf("--%s isn't supported for estargz target", name)
+					}
+				}
+				if c.Bool("dry-run") && (allPlatforms || targetFormat == "estargz") {
+					return fmt.Errorf("--dry-run isn't supported for --all-platforms and estargz target")
+				}
+				var sourceProviders []provider.SourceProvider
+				if archiveSource {
+					sourceProviders, err = provider.ArchiveSource(ctx, c.String("source"), sourceDir, targetPlatform, decryptionKeys)
+					if err != nil {
+						return exitcode.Wrap(exitcode.Source, errors.Wrap(err, "Parse source image"))
+					}
+				} else if !allPlatforms && targetFormat == "nydus" {
+					sourceProviders, err = provider.DefaultSourceWithDecryption(ctx, sourceRemote, sourceDir, targetPlatform, decryptionKeys)
+					if err != nil {
+						return exitcode.Wrap(exitcode.Source, errors.Wrap(err, "Parse source image"))
+					}
+				}
+
+				chunkedUpload, err := chunkedUploadOpt(c)
 				if err != nil {
-					return errors.Wrap(err, "Parse source image")
+					return err
+				}
+				targetRemote, err := provider.DefaultRemoteWithOptions(target, c.Bool("target-insecure"), provider.RemoteOptions{
+					CredentialHelper: c.String("target-credential-helper"),
+					OIDC:             targetOIDC,
+					Transport:        registryTransportOptions(c),
+					ChunkedUpload:    chunkedUpload,
+				})
+				if err != nil {
+					return err
+				}
+				if err := addMountSources(targetRemote, c.StringSlice("target-mount-from")); err != nil {
+					return err
 				}
 
-				targetRemote, err := provider.DefaultRemote(target, c.Bool("target-insecure"))
+				signers, err := newSigners(c)
 				if err != nil {
 					return err
 				}
 
+				converting = true
+				if targetFormat == "estargz" {
+					return estargz.Convert(ctx, estargz.Opt{
+						WorkDir:        c.String("work-dir"),
+						SourceRemote:   sourceRemote,
+						TargetRemote:   targetRemote,
+						Platform:       targetPlatform,
+						DecryptionKeys: decryptionKeys,
+						DockerV2Format: c.Bool("docker-v2-format"),
+						MaxConcurrency: c.Uint("max-concurrency"),
+						Signers:        signers,
+						Retry:          backendRetryConfig(c),
+					})
+				}
+
 				opt := converter.Opt{
 					Logger:          logger,
 					SourceProviders: sourceProviders,
@@ -248,7 +1049,8 @@ func main() {
 					CacheVersion:    cacheVersion,
 
 					WorkDir:        c.String("work-dir"),
-					PrefetchDir:    c.String("prefetch-dir"),
+					PrefetchDir:    prefetchPatterns,
+					PrefetchPolicy: string(prefetchPolicy),
 					NydusImagePath: c.String("nydus-image"),
 					MultiPlatform:  c.Bool("multi-platform"),
 					DockerV2Format: c.Bool("docker-v2-format"),
@@ -257,15 +1059,81 @@ func main() {
 					BackendConfig:       backendConfig,
 					BackendForcePush:    c.Bool("backend-force-push"),
 					BackendAlignedChunk: c.Bool("backend-aligned-chunk"),
+					BackendRetry:        backendRetryConfig(c),
+					Compressor:          compressor,
+					CompressLevel:       compressLevel,
+					CompressAuto:        c.Bool("compress-auto"),
+					EncryptKeyID:        encryptKeyID,
+					KeyProvider:         keyProvider,
+					Flatten:             c.Bool("flatten"),
+					WhiteoutStrategy:    whiteoutStrategy,
+					HardlinkStrategy:    hardlinkStrategy,
+					PathFilter:          pathFilter,
 
 					NydusifyVersion: version,
 					Source:          c.String("source"),
 
 					ChunkDict: converter.ChunkDictOpt{
-						Args:     c.String("chunk-dict"),
-						Insecure: c.Bool("chunk-dict-insecure"),
+						Args:     chunkDictArgs,
+						Insecure: chunkDictInsecure,
 						Platform: targetPlatform,
 					},
+					DedupDB: c.String("dedup-db"),
+
+					MaxConcurrency: c.Uint("max-concurrency"),
+
+					Signers: signers,
+
+					SBOMFormat: sbomFormat,
+					Provenance: c.Bool("provenance"),
+					TarSplit:   c.Bool("tar-split"),
+
+					DryRun: c.Bool("dry-run"),
+
+					Progress: reporter,
+
+					Annotation: annotation,
+				}
+
+				if allPlatforms {
+					return converter.ConvertIndex(ctx, converter.IndexOpt{
+						SourceRemote:   sourceRemote,
+						TargetRemote:   targetRemote,
+						MultiPlatform:  opt.MultiPlatform,
+						DockerV2Format: opt.DockerV2Format,
+						MaxConcurrency: c.Uint("max-concurrency"),
+						Signers:        signers,
+						PlatformOpt: func(ctx context.Context, p ocispec.Platform) (*converter.Opt, error) {
+							platform := p.OS + "/" + p.Architecture
+							if _, _, err := provider.ExtractConvertibleOsArch(platform); err != nil {
+								return nil, err
+							}
+							// Each platform is converted in a dedicated work directory
+							platformID := converter.PlatformID(p)
+							platformOpt := opt
+							platformOpt.WorkDir = filepath.Join(opt.WorkDir, platformID)
+							platformOpt.ChunkDict.Platform = platform
+							sourceDir := filepath.Join(platformOpt.WorkDir, "source")
+							if err := os.RemoveAll(sourceDir); err != nil {
+								return nil, err
+							}
+							if err := os.MkdirAll(sourceDir, 0755); err != nil {
+								return nil, err
+							}
+							var err error
+							platformOpt.SourceProviders, err = provider.DefaultSourceOfPlatform(ctx, sourceRemote, sourceDir, p, decryptionKeys)
+							if err != nil {
+								return nil, exitcode.Wrap(exitcode.Source, errors.Wrapf(err, "Parse source image of platform %s", platform))
+							}
+							if cacheRemote != nil {
+								platformOpt.CacheRemote, err = platformCacheRemote(cacheRemote, platformID)
+								if err != nil {
+									return nil, err
+								}
+							}
+							return &platformOpt, nil
+						},
+					})
 				}
 
 				cvt, err := converter.New(opt)
@@ -273,18 +1141,241 @@ func main() {
 					return err
 				}
 
-				metrics.Register(fileexporter.New(filepath.Join(opt.WorkDir, "conversion_metrics.prom")))
-				defer metrics.Export()
-
-				return cvt.Convert(context.Background())
+				if err := cvt.Convert(ctx); err != nil {
+					return err
+				}
+				if opt.DryRun {
+					if reporter != nil {
+						detail = cvt.DryRunReport()
+						return nil
+					}
+					return printJSON(cvt.DryRunReport())
+				}
+				return nil
 			},
 		},
 		{
-			Name:  "check",
-			Usage: "Check nydus image",
+			Name:  "batch",
+			Usage: "Convert the images listed in a batch file (YAML or JSON) concurrently",
 			Flags: []cli.Flag{
-				&cli.StringFlag{Name: "source", Required: false, Usage: "Source image reference", EnvVars: []string{"SOURCE"}},
-				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
+				&cli.StringFlag{Name: "file", Required: true, TakesFile: true, Usage: "Batch file of the source and target images, and the defaults shared by them", EnvVars: []string{"NYDUSIFY_BATCH_FILE"}},
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory of the conversions and their logs", EnvVars: []string{"NYDUSIFY_BATCH_WORK_DIR"}},
+				&cli.IntFlag{Name: "concurrency", Value: 0, Usage: "Number of images converted concurrently, overrides the concurrency in batch file (defaults to 1)", EnvVars: []string{"NYDUSIFY_BATCH_CONCURRENCY"}},
+				&cli.StringFlag{Name: "report", Required: false, TakesFile: true, Usage: "Write the status of each image to the JSON file", EnvVars: []string{"NYDUSIFY_BATCH_REPORT"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				file, err := batch.ParseFile(c.String("file"))
+				if err != nil {
+					return err
+				}
+				tasks, err := file.Tasks()
+				if err != nil {
+					return err
+				}
+				concurrency := file.Concurrency
+				if c.IsSet("concurrency") {
+					concurrency = c.Int("concurrency")
+				}
+				if concurrency < 0 {
+					return fmt.Errorf("concurrency should not be negative")
+				}
+				binary, err := os.Executable()
+				if err != nil {
+					return errors.Wrap(err, "Get nydusify path")
+				}
+				workDir := c.String("work-dir")
+				if err := os.MkdirAll(workDir, 0755); err != nil {
+					return err
+				}
+
+				// The running conversions are killed on interrupt, and the
+				// images not started are failed.
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				go func() {
+					<-signals
+					logrus.Warnf("Interrupted, cancel the conversions")
+					cancel()
+				}()
+
+				report := batch.Run(ctx, tasks, concurrency, batch.ExecConvert(binary, workDir))
+				if path := c.String("report"); path != "" {
+					data, err := json.MarshalIndent(report, "", "  ")
+					if err != nil {
+						return err
+					}
+					if err := ioutil.WriteFile(path, data, 0644); err != nil {
+						return errors.Wrap(err, "Write report")
+					}
+				}
+
+				// Exit code 2 means some images failed, 3 means all failed.
+				summary := fmt.Sprintf("Converted %d of %d images, %d failed", report.Succeeded, report.Total, report.Failed)
+				switch {
+				case report.Failed == 0:
+					logrus.Info(summary)
+					return nil
+				case report.Succeeded == 0:
+					return cli.Exit(summary, 3)
+				default:
+					return cli.Exit(summary, 2)
+				}
+			},
+		},
+		{
+			Name:  "build",
+			Usage: "Build nydus image from rootfs directory or tarball",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "rootfs", Required: true, TakesFile: true, Usage: "Rootfs directory, or (compressed) tarball of rootfs (use - to read from stdin)", EnvVars: []string{"NYDUSIFY_BUILD_ROOTFS"}},
+				&cli.StringFlag{Name: "config", Required: false, TakesFile: true, Usage: "Path of image config JSON (OCI image configuration), the OS and architecture default to --platform", EnvVars: []string{"NYDUSIFY_BUILD_CONFIG"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_BUILD_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_BUILD_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "target-credential-helper", Required: false, Usage: "Get target registry credentials by docker-credential-<helper>, such as ecr-login, gcloud, acr-env", EnvVars: []string{"NYDUSIFY_BUILD_TARGET_CREDENTIAL_HELPER"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Platform of the built image, should match the OS and architecture in image config"},
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory path for image build", EnvVars: []string{"NYDUSIFY_BUILD_WORK_DIR"}},
+				&cli.StringFlag{Name: "prefetch-dir", Value: "/", Usage: "Prefetch directory for nydus image, use absolute path of rootfs", EnvVars: []string{"NYDUSIFY_BUILD_PREFETCH_DIR"}},
+				&cli.StringFlag{Name: "prefetch-file", Required: false, TakesFile: true, Usage: "Prefetch the files listed in the file (one absolute path of rootfs per line) for nydus image, which can be generated by `nydusify prefetch`, conflict with --prefetch-dir", EnvVars: []string{"NYDUSIFY_BUILD_PREFETCH_FILE"}},
+				&cli.StringFlag{Name: "prefetch-policy", Value: "", Usage: "Write prefetch policy (background, eager, on-demand) to Nydus image, which overrides the policy selected by mount option", EnvVars: []string{"NYDUSIFY_BUILD_PREFETCH_POLICY"}},
+				&cli.StringFlag{Name: "nydus-image", Value: "nydus-image", Usage: "The nydus-image binary path, if unset, search in PATH environment", EnvVars: []string{"NYDUS_IMAGE"}},
+				&cli.StringFlag{Name: "compressor", Value: "", Usage: "Algorithm to compress chunk data in Nydus blob (none, lz4_block, gzip, zstd), use the default of nydus-image if not specified", EnvVars: []string{"NYDUSIFY_BUILD_COMPRESSOR"}},
+				&cli.IntFlag{Name: "compress-level", Value: 0, Usage: "Level of zstd compressor between 1 and 22, 0 uses the default level 3", EnvVars: []string{"NYDUSIFY_BUILD_COMPRESS_LEVEL"}},
+				&cli.BoolFlag{Name: "compress-auto", Value: false, Usage: "Store the already compressed files (e.g. gzip, zstd, zip archives and jpeg, png images) without compression, detected by file extension and magic number", EnvVars: []string{"NYDUSIFY_BUILD_COMPRESS_AUTO"}},
+				&cli.StringFlag{Name: "encrypt-key-id", Value: "", Usage: "ID of the key to encrypt chunk data in Nydus blob with AES-256-GCM, the image is built in RAFS v5, requires --key-provider", EnvVars: []string{"NYDUSIFY_BUILD_ENCRYPT_KEY_ID"}},
+				&cli.StringFlag{Name: "key-provider", Value: "", TakesFile: true, Usage: "Path to the key provider configuration file of nydus-image to get the key of --encrypt-key-id", EnvVars: []string{"NYDUSIFY_BUILD_KEY_PROVIDER"}},
+				&cli.BoolFlag{Name: "docker-v2-format", Value: false, Usage: "Use docker image manifest v2, schema 2 format", EnvVars: []string{"NYDUSIFY_BUILD_DOCKER_V2_FORMAT"}},
+				&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_CONFIG_FILE"}},
+				&cli.BoolFlag{Name: "backend-force-push", Value: false, Usage: "Force to push Nydus blob to storage backend, even if the blob already exists in storage backend", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_FORCE_PUSH"}},
+				&cli.BoolFlag{Name: "backend-aligned-chunk", Value: false, Usage: "Produce 4096 aligned decompressed_offset in Nydus bootstrap", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_ALIGNED_CHUNK"}},
+				&cli.IntFlag{Name: "backend-retry-attempts", Value: 3, Usage: "Maximum attempts to upload a blob to storage backend, client side errors aren't retried", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_RETRY_ATTEMPTS"}},
+				&cli.DurationFlag{Name: "backend-retry-interval", Value: 2 * time.Second, Usage: "Backoff before the first retry of storage backend upload, doubled for each retry with jitter", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_RETRY_INTERVAL"}},
+				&cli.DurationFlag{Name: "backend-retry-max-interval", Value: 30 * time.Second, Usage: "Maximum backoff between retries of storage backend upload", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_RETRY_MAX_INTERVAL"}},
+				&cli.Float64Flag{Name: "backend-retry-budget", Value: 0.2, Usage: "Limit the retries of storage backend upload to the ratio of uploads (plus 10 retries)", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_RETRY_BUDGET"}},
+				&cli.IntFlag{Name: "backend-breaker-threshold", Value: 5, Usage: "Open the circuit breaker of storage backend host after continuous failures, uploads fail fast until it cools down", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_BREAKER_THRESHOLD"}},
+				&cli.DurationFlag{Name: "backend-breaker-cooldown", Value: 30 * time.Second, Usage: "Duration before an open circuit breaker allows a trial upload", EnvVars: []string{"NYDUSIFY_BUILD_BACKEND_BREAKER_COOLDOWN"}},
+				&cli.StringFlag{Name: "dedup-db", Required: false, TakesFile: true, Usage: "Deduplicate chunks with the images recorded in the database file, the built image is recorded in it", EnvVars: []string{"NYDUSIFY_BUILD_DEDUP_DB"}},
+				&cli.StringFlag{Name: "sign-cosign-key", Required: false, TakesFile: true, Usage: "Sign target image by the cosign private key after pushing, the key password is read from $COSIGN_PASSWORD", EnvVars: []string{"NYDUSIFY_BUILD_SIGN_COSIGN_KEY"}},
+				&cli.StringFlag{Name: "sign-notation-key", Required: false, Usage: "Sign target image by notation with the signing key profile after pushing", EnvVars: []string{"NYDUSIFY_BUILD_SIGN_NOTATION_KEY"}},
+				&cli.StringFlag{Name: "notation", Value: "notation", Usage: "The notation binary path, if unset, search in PATH environment", EnvVars: []string{"NYDUSIFY_BUILD_NOTATION"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+				&cli.StringFlag{Name: "log-module-level", Required: false, Usage: "Set log level of subsystems (registry, backend, cache, build), e.g. registry=debug,backend=warn", EnvVars: []string{"NYDUSIFY_LOG_MODULE_LEVEL"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				backendType := c.String("backend-type")
+				possibleBackendTypes := []string{"registry", "oss", "s3", "azure", "gcs", "localfs", "external", "ipfs"}
+				if !isPossibleValue(possibleBackendTypes, backendType) {
+					return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+				}
+				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+				if err != nil {
+					return err
+				}
+				if backendType != "registry" && backendType != "ipfs" && strings.TrimSpace(backendConfig) == "" {
+					return fmt.Errorf("--backend-config or --backend-config-file required")
+				}
+
+				prefetchPatterns, err := getPrefetchPatterns(c)
+				if err != nil {
+					return err
+				}
+				prefetchPolicy, err := prefetch.ParsePolicy(c.String("prefetch-policy"))
+				if err != nil {
+					return err
+				}
+
+				compressor, compressLevel := c.String("compressor"), c.Int("compress-level")
+				if err := checkCompressor(compressor, compressLevel); err != nil {
+					return err
+				}
+				encryptKeyID, keyProvider := c.String("encrypt-key-id"), c.String("key-provider")
+				if err := checkEncryption(encryptKeyID, keyProvider); err != nil {
+					return err
+				}
+
+				workDir := c.String("work-dir")
+				if err := os.MkdirAll(workDir, 0755); err != nil {
+					return err
+				}
+
+				ctx := context.Background()
+				sourceProvider, err := provider.RootfsSource(ctx, c.String("rootfs"), c.String("config"), workDir, c.String("platform"))
+				if err != nil {
+					return errors.Wrap(err, "Prepare rootfs")
+				}
+
+				targetRemote, err := provider.DefaultRemoteWithOptions(c.String("target"), c.Bool("target-insecure"), provider.RemoteOptions{
+					CredentialHelper: c.String("target-credential-helper"),
+				})
+				if err != nil {
+					return err
+				}
+
+				signers, err := newSigners(c)
+				if err != nil {
+					return err
+				}
+
+				logger, err := provider.DefaultLogger()
+				if err != nil {
+					return err
+				}
+
+				cvt, err := converter.New(converter.Opt{
+					Logger:          logger,
+					SourceProviders: []provider.SourceProvider{sourceProvider},
+
+					TargetRemote: targetRemote,
+
+					WorkDir:        workDir,
+					PrefetchDir:    prefetchPatterns,
+					PrefetchPolicy: string(prefetchPolicy),
+					NydusImagePath: c.String("nydus-image"),
+					DockerV2Format: c.Bool("docker-v2-format"),
+
+					BackendType:         backendType,
+					BackendConfig:       backendConfig,
+					BackendForcePush:    c.Bool("backend-force-push"),
+					BackendAlignedChunk: c.Bool("backend-aligned-chunk"),
+					BackendRetry:        backendRetryConfig(c),
+					Compressor:          compressor,
+					CompressLevel:       compressLevel,
+					CompressAuto:        c.Bool("compress-auto"),
+					EncryptKeyID:        encryptKeyID,
+					KeyProvider:         keyProvider,
+
+					NydusifyVersion: version,
+					Source:          c.String("rootfs"),
+					DedupDB:         c.String("dedup-db"),
+
+					Signers: signers,
+				})
+				if err != nil {
+					return err
+				}
+
+				return cvt.Convert(ctx)
+			},
+		},
+		{
+			Name:  "check",
+			Usage: "Check nydus image",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "source", Required: false, Usage: "Source image reference", EnvVars: []string{"SOURCE"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"TARGET"}},
 
 				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"SOURCE_INSECURE"}},
 				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"TARGET_INSECURE"}},
@@ -297,8 +1388,21 @@ func main() {
 				&cli.StringFlag{Name: "backend-type", Value: "", Usage: "Specify Nydus blob storage backend type, will check file data in Nydus image if specified", EnvVars: []string{"BACKEND_TYPE"}},
 				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"BACKEND_CONFIG"}},
 				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"BACKEND_CONFIG_FILE"}},
+				&cli.StringFlag{Name: "prefetch-policy", Value: "", Usage: "Prefetch policy (background, eager, on-demand) to mount Nydus image by nydusd, overridden by the policy written in image, background if unset", EnvVars: []string{"NYDUSIFY_PREFETCH_POLICY"}},
+				&cli.StringFlag{Name: "verify-cosign-key", Required: false, TakesFile: true, Usage: "Verify cosign signature of target image by the public key before mounting", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_KEY"}},
+				&cli.StringFlag{Name: "verify-cosign-identity", Required: false, Usage: "Verify keyless cosign signature of target image before mounting, the email or URI expected in Fulcio certificate", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_IDENTITY"}},
+				&cli.StringFlag{Name: "verify-cosign-oidc-issuer", Required: false, Usage: "The OIDC issuer expected in Fulcio certificate for keyless cosign verification", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_OIDC_ISSUER"}},
+				&cli.StringFlag{Name: "verify-cosign-fulcio-roots", Required: false, TakesFile: true, Usage: "The PEM file of Fulcio root certificates for keyless cosign verification", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_FULCIO_ROOTS"}},
+				&cli.StringFlag{Name: "verify-cosign-rekor-key", Required: false, TakesFile: true, Usage: "The PEM file of Rekor public key for keyless cosign verification", EnvVars: []string{"NYDUSIFY_VERIFY_COSIGN_REKOR_KEY"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+				&cli.StringFlag{Name: "log-module-level", Required: false, Usage: "Set log level of subsystems (registry, backend, cache, build), e.g. registry=debug,backend=warn", EnvVars: []string{"NYDUSIFY_LOG_MODULE_LEVEL"}},
 			},
 			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
 				backendType := c.String("backend-type")
 				backendConfig := ""
 				if backendType != "" {
@@ -316,6 +1420,16 @@ func main() {
 					return err
 				}
 
+				verifier, err := newSignatureVerifier(c)
+				if err != nil {
+					return err
+				}
+
+				prefetchPolicy, err := prefetch.ParsePolicy(c.String("prefetch-policy"))
+				if err != nil {
+					return err
+				}
+
 				checker, err := checker.New(checker.Opt{
 					WorkDir:        c.String("work-dir"),
 					Source:         c.String("source"),
@@ -328,6 +1442,9 @@ func main() {
 					BackendType:    backendType,
 					BackendConfig:  backendConfig,
 					ExpectedArch:   arch,
+					PrefetchPolicy: prefetchPolicy,
+
+					SignatureVerifier: verifier,
 				})
 				if err != nil {
 					return err
@@ -336,6 +1453,1432 @@ func main() {
 				return checker.Check(context.Background())
 			},
 		},
+		{
+			Name:  "prefetch",
+			Usage: "Generate prefetch list from the file access patterns recorded by nydusd",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "api-sock", Required: true, TakesFile: true, Usage: "The API socket of nydusd, which is started with `access_pattern` enabled in RAFS configuration", EnvVars: []string{"NYDUSIFY_PREFETCH_API_SOCK"}},
+				&cli.StringFlag{Name: "mountpoint", Required: true, Usage: "The mountpoint of nydus image in nydusd, used to resolve the paths of accessed files", EnvVars: []string{"NYDUSIFY_PREFETCH_MOUNTPOINT"}},
+				&cli.StringFlag{Name: "id", Required: false, Usage: "The RAFS instance ID in nydusd, only required if nydusd serves multiple instances", EnvVars: []string{"NYDUSIFY_PREFETCH_ID"}},
+				&cli.StringFlag{Name: "output", Value: "-", Usage: "Write the prefetch list to the file, use - for stdout", EnvVars: []string{"NYDUSIFY_PREFETCH_OUTPUT"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				patterns, err := prefetch.FetchAccessPatterns(context.Background(), c.String("api-sock"), c.String("id"))
+				if err != nil {
+					return err
+				}
+				paths, err := prefetch.ResolvePaths(c.String("mountpoint"), patterns)
+				if err != nil {
+					return err
+				}
+				logrus.Infof("Resolved %d accessed files from %d access patterns", len(paths), len(patterns))
+
+				if c.String("output") == "-" {
+					return prefetch.WriteList(os.Stdout, paths)
+				}
+				file, err := os.Create(c.String("output"))
+				if err != nil {
+					return err
+				}
+				if err := prefetch.WriteList(file, paths); err != nil {
+					file.Close()
+					return err
+				}
+				return file.Close()
+			},
+		},
+		{
+			Name:  "warmup",
+			Usage: "Download the blob data of Nydus image into nydusd cache directory without mounting",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_WARMUP_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_WARMUP_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "cache-dir", Required: true, Usage: "The `work_dir` of nydusd blob cache, which is configured with `cache_compressed` enabled", EnvVars: []string{"NYDUSIFY_WARMUP_CACHE_DIR"}},
+				&cli.BoolFlag{Name: "prefetch-only", Value: false, Usage: "Only download the files in prefetch table of Nydus image rather than all blobs", EnvVars: []string{"NYDUSIFY_WARMUP_PREFETCH_ONLY"}},
+				&cli.StringFlag{Name: "p2p-proxy", Required: false, Usage: "Fetch blobs through the HTTP proxy of P2P system like Dragonfly dfdaemon (e.g. http://127.0.0.1:65001), fall back to registry if the proxy is unhealthy", EnvVars: []string{"NYDUSIFY_WARMUP_P2P_PROXY"}},
+				&cli.StringSliceFlag{Name: "event-sink", Required: false, Usage: "Deliver lifecycle events as JSON to the webhook URL, or append them to the file as JSON lines, can be repeated", EnvVars: []string{"NYDUSIFY_WARMUP_EVENT_SINKS"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				closeEvents, err := events.Setup(c.StringSlice("event-sink"))
+				if err != nil {
+					return err
+				}
+				defer closeEvents()
+
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+				targetRemote, err := provider.DefaultRemoteWithOptions(c.String("target"), c.Bool("target-insecure"), provider.RemoteOptions{
+					P2PProxy: c.String("p2p-proxy"),
+				})
+				if err != nil {
+					return err
+				}
+
+				result, err := warmup.Warmup(context.Background(), warmup.Opt{
+					Remote:       targetRemote,
+					ExpectedArch: arch,
+					CacheDir:     c.String("cache-dir"),
+					PrefetchOnly: c.Bool("prefetch-only"),
+				})
+				if err != nil {
+					return err
+				}
+				logrus.Infof("Warmed up %d chunks (%d bytes) of %d blobs", result.Chunks, result.Size, result.Blobs)
+				events.Emit(events.Event{
+					Type:  events.TypePrefetchCompleted,
+					Image: c.String("target"),
+					Data: map[string]interface{}{
+						"cache_dir":     c.String("cache-dir"),
+						"prefetch_only": c.Bool("prefetch-only"),
+						"blobs":         result.Blobs,
+						"chunks":        result.Chunks,
+						"size":          result.Size,
+					},
+				})
+
+				return nil
+			},
+		},
+		{
+			Name:  "delta",
+			Usage: "Create and apply the delta of blob cache between Nydus image versions",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "create",
+					Usage: "Create the delta file of the chunks in target image but not in base image",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "base", Required: true, Usage: "Base (Nydus) image reference cached on nodes", EnvVars: []string{"NYDUSIFY_DELTA_CREATE_BASE"}},
+						&cli.BoolFlag{Name: "base-insecure", Required: false, Usage: "Allow http/insecure base registry communication", EnvVars: []string{"NYDUSIFY_DELTA_CREATE_BASE_INSECURE"}},
+						&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference to update to", EnvVars: []string{"NYDUSIFY_DELTA_CREATE_TARGET"}},
+						&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_DELTA_CREATE_TARGET_INSECURE"}},
+						&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+						&cli.StringFlag{Name: "output", Required: true, TakesFile: true, Usage: "Path of delta file", EnvVars: []string{"NYDUSIFY_DELTA_CREATE_OUTPUT"}},
+						&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+						&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+					},
+					Action: func(c *cli.Context) error {
+						if err := setupLogging(c); err != nil {
+							return err
+						}
+
+						_, arch, err := provider.ExtractOsArch(c.String("platform"))
+						if err != nil {
+							return err
+						}
+						baseRemote, err := provider.DefaultRemote(c.String("base"), c.Bool("base-insecure"))
+						if err != nil {
+							return err
+						}
+						targetRemote, err := provider.DefaultRemote(c.String("target"), c.Bool("target-insecure"))
+						if err != nil {
+							return err
+						}
+
+						result, err := warmup.CreateDelta(context.Background(), warmup.DeltaOpt{
+							Base:         baseRemote,
+							Target:       targetRemote,
+							ExpectedArch: arch,
+							Output:       c.String("output"),
+						})
+						if err != nil {
+							return err
+						}
+						logrus.Infof("Created delta of %d chunks in %d new blobs: %d chunks copied from base cache, %d chunks (%d bytes of %d bytes) fetched",
+							result.Chunks, result.Blobs, result.CopiedChunks, result.FetchedChunks, result.Size, result.TargetSize)
+
+						return nil
+					},
+				},
+				{
+					Name:  "apply",
+					Usage: "Build the blob cache of target image from delta file and the cache of base image",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "delta", Required: true, TakesFile: true, Usage: "Path of delta file created by `nydusify delta create`", EnvVars: []string{"NYDUSIFY_DELTA_APPLY_DELTA"}},
+						&cli.StringFlag{Name: "cache-dir", Required: true, Usage: "The `work_dir` of nydusd blob cache with the cache of base image, which is configured with `cache_compressed` enabled", EnvVars: []string{"NYDUSIFY_DELTA_APPLY_CACHE_DIR"}},
+						&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+						&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+					},
+					Action: func(c *cli.Context) error {
+						if err := setupLogging(c); err != nil {
+							return err
+						}
+
+						result, err := warmup.ApplyDelta(context.Background(), warmup.ApplyOpt{
+							Delta:    c.String("delta"),
+							CacheDir: c.String("cache-dir"),
+						})
+						if err != nil {
+							return err
+						}
+						logrus.Infof("Applied %d chunks (%d bytes) to %d blobs, %d chunks copied from base cache", result.Chunks, result.Size, result.Blobs, result.CopiedChunks)
+						if result.MissingChunks > 0 {
+							logrus.Warnf("%d chunks aren't in the cache of base image, they will be fetched by nydusd on demand", result.MissingChunks)
+						}
+
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "trim",
+			Usage: "Evict the nydusd blob cache of unmounted images before the node hits disk pressure",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "cache-dir", Required: true, Usage: "The `work_dir` of nydusd blob cache", EnvVars: []string{"NYDUSIFY_TRIM_CACHE_DIR"}},
+				&cli.StringFlag{Name: "min-free", Value: "15%", Usage: "Trim the cache once the free space of filesystem is less than it, in bytes (e.g. 10Gi) or percent of filesystem (e.g. 15%), like the eviction threshold of kubelet", EnvVars: []string{"NYDUSIFY_TRIM_MIN_FREE"}},
+				&cli.StringFlag{Name: "target-free", Value: "20%", Usage: "Free space to reach by trimming the cache, in bytes or percent of filesystem", EnvVars: []string{"NYDUSIFY_TRIM_TARGET_FREE"}},
+				&cli.BoolFlag{Name: "watch", Value: false, Usage: "Keep watching the free space, the cache is also trimmed on SIGUSR1, e.g. sent by the hook of disk pressure", EnvVars: []string{"NYDUSIFY_TRIM_WATCH"}},
+				&cli.DurationFlag{Name: "interval", Value: 10 * time.Second, Usage: "Interval to check the free space in watch mode", EnvVars: []string{"NYDUSIFY_TRIM_INTERVAL"}},
+				&cli.StringFlag{Name: "event-file", Value: "", TakesFile: true, Usage: "Append the event of each trim to the file as JSON lines", EnvVars: []string{"NYDUSIFY_TRIM_EVENT_FILE"}},
+				&cli.StringSliceFlag{Name: "event-sink", Required: false, Usage: "Deliver lifecycle events as JSON to the webhook URL, or append them to the file as JSON lines, can be repeated", EnvVars: []string{"NYDUSIFY_TRIM_EVENT_SINKS"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				closeEvents, err := events.Setup(c.StringSlice("event-sink"))
+				if err != nil {
+					return err
+				}
+				defer closeEvents()
+
+				minFree, err := warmup.ParseThreshold(c.String("min-free"))
+				if err != nil {
+					return err
+				}
+				targetFree, err := warmup.ParseThreshold(c.String("target-free"))
+				if err != nil {
+					return err
+				}
+				opt := warmup.TrimOpt{
+					CacheDir:   c.String("cache-dir"),
+					MinFree:    *minFree,
+					TargetFree: *targetFree,
+					OnTrim: func(event *warmup.TrimEvent) {
+						logrus.Infof("Trimmed %d blobs of cache directory %s (%s), free space %s -> %s",
+							len(event.Evicted), event.CacheDir, event.Reason, humanize.IBytes(event.FreeBefore), humanize.IBytes(event.FreeAfter))
+						events.Emit(events.Event{Type: events.TypeCacheEvicted, Time: event.Time, Data: event})
+					},
+				}
+				if path := c.String("event-file"); path != "" {
+					file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+					if err != nil {
+						return errors.Wrap(err, "open event file")
+					}
+					defer file.Close()
+					onTrim := opt.OnTrim
+					opt.OnTrim = func(event *warmup.TrimEvent) {
+						onTrim(event)
+						data, err := json.Marshal(event)
+						if err != nil {
+							return
+						}
+						if _, err := file.Write(append(data, '\n')); err != nil {
+							logrus.WithError(err).Warn("Failed to write trim event")
+						}
+					}
+				}
+
+				if !c.Bool("watch") {
+					event, err := warmup.Trim(context.Background(), opt, warmup.TrimReasonThreshold)
+					if err != nil {
+						return err
+					}
+					if event == nil {
+						logrus.Infof("Free space of cache directory %s is more than %s, nothing to trim", opt.CacheDir, minFree)
+					} else if event.Unresolved {
+						logrus.Warnf("Free space %s is still under target %s, the rest %d blobs are used by mounted images",
+							humanize.IBytes(event.FreeAfter), humanize.IBytes(event.Target), event.InUseBlobs)
+					}
+					return nil
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				trigger := make(chan struct{}, 1)
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+				defer signal.Stop(signals)
+				go func() {
+					for sig := range signals {
+						if sig != syscall.SIGUSR1 {
+							cancel()
+							return
+						}
+						select {
+						case trigger <- struct{}{}:
+						default:
+						}
+					}
+				}()
+
+				logrus.Infof("Watching free space of cache directory %s, trim under %s to %s", opt.CacheDir, minFree, targetFree)
+				return warmup.WatchTrim(ctx, opt, c.Duration("interval"), trigger)
+			},
+		},
+		{
+			Name:  "gc",
+			Usage: "Delete the blobs in storage backend which aren't referenced by the Nydus images",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{Name: "image", Required: true, Usage: "Nydus image reference whose blobs are kept, all images using the storage backend must be specified, can be specified multiple times", EnvVars: []string{"NYDUSIFY_GC_IMAGES"}},
+				&cli.BoolFlag{Name: "insecure", Required: false, Usage: "Allow http/insecure registry communication", EnvVars: []string{"NYDUSIFY_GC_INSECURE"}},
+				&cli.StringFlag{Name: "backend-type", Required: true, Usage: "Specify Nydus blob storage backend type (oss, s3, azure, gcs, localfs)", EnvVars: []string{"NYDUSIFY_GC_BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string", EnvVars: []string{"NYDUSIFY_GC_BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"NYDUSIFY_GC_BACKEND_CONFIG_FILE"}},
+				&cli.DurationFlag{Name: "grace-period", Value: 24 * time.Hour, Usage: "Keep the unreferenced blobs modified in the period, which may be uploaded by in-flight conversions", EnvVars: []string{"NYDUSIFY_GC_GRACE_PERIOD"}},
+				&cli.BoolFlag{Name: "dry-run", Value: false, Usage: "Only report the unreferenced blobs without deleting them", EnvVars: []string{"NYDUSIFY_GC_DRY_RUN"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				backendType := c.String("backend-type")
+				possibleBackendTypes := []string{"oss", "s3", "azure", "gcs", "localfs"}
+				if !isPossibleValue(possibleBackendTypes, backendType) {
+					return fmt.Errorf("--backend-type should be one of %v", possibleBackendTypes)
+				}
+				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+				if err != nil {
+					return err
+				}
+				if strings.TrimSpace(backendConfig) == "" {
+					return fmt.Errorf("--backend-config or --backend-config-file required")
+				}
+				blobBackend, err := backend.NewBackend(backendType, []byte(backendConfig), nil)
+				if err != nil {
+					return err
+				}
+				collector, ok := blobBackend.(backend.Collector)
+				if !ok {
+					return fmt.Errorf("garbage collection isn't supported by %s backend", backendType)
+				}
+
+				remotes := []*remote.Remote{}
+				for _, ref := range c.StringSlice("image") {
+					r, err := provider.DefaultRemote(ref, c.Bool("insecure"))
+					if err != nil {
+						return err
+					}
+					remotes = append(remotes, r)
+				}
+
+				ctx := context.Background()
+				referenced, err := gc.ReferencedBlobs(ctx, remotes)
+				if err != nil {
+					return err
+				}
+				result, err := gc.Collect(ctx, collector, referenced, c.Duration("grace-period"), c.Bool("dry-run"))
+				if err != nil {
+					return err
+				}
+				action := "Deleted"
+				if c.Bool("dry-run") {
+					action = "Found"
+				}
+				logrus.Infof("%s %d unreferenced blobs (%d bytes), kept %d referenced blobs and %d blobs in grace period",
+					action, len(result.Unreferenced), result.ReclaimedSize, result.Referenced, len(result.Recent))
+
+				return nil
+			},
+		},
+		{
+			Name:  "webhook",
+			Usage: "Serve Kubernetes mutating admission webhook to rewrite pod images to Nydus images",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: ":8443", Usage: "Address to serve the webhook on, the webhook path is /mutate", EnvVars: []string{"NYDUSIFY_WEBHOOK_LISTEN"}},
+				&cli.StringFlag{Name: "tls-cert", Required: false, TakesFile: true, Usage: "TLS certificate file of webhook server, serve plain http if unset", EnvVars: []string{"NYDUSIFY_WEBHOOK_TLS_CERT"}},
+				&cli.StringFlag{Name: "tls-key", Required: false, TakesFile: true, Usage: "TLS private key file of webhook server", EnvVars: []string{"NYDUSIFY_WEBHOOK_TLS_KEY"}},
+				&cli.StringFlag{Name: "policy", Required: true, TakesFile: true, Usage: "JSON file of the policy to map pod images to Nydus images", EnvVars: []string{"NYDUSIFY_WEBHOOK_POLICY"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Look up the Nydus image of specified platform when lookup is enabled by policy. Possible value is `amd64` or `arm64`"},
+				&cli.DurationFlag{Name: "lookup-cache-ttl", Value: 5 * time.Minute, Usage: "Cache the lookup result of Nydus image for the duration", EnvVars: []string{"NYDUSIFY_WEBHOOK_LOOKUP_CACHE_TTL"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				if (c.String("tls-cert") == "") != (c.String("tls-key") == "") {
+					return fmt.Errorf("--tls-cert and --tls-key should be specified together")
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+				policy, err := webhook.ParsePolicyFile(c.String("policy"))
+				if err != nil {
+					return err
+				}
+
+				mux := http.NewServeMux()
+				mux.Handle("/mutate", webhook.New(policy, webhook.RegistryLookup(arch, policy.Insecure), c.Duration("lookup-cache-ttl")))
+				mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				})
+				server := &http.Server{Addr: c.String("listen"), Handler: mux}
+
+				logrus.Infof("Serving webhook on %s", c.String("listen"))
+				if c.String("tls-cert") != "" {
+					return server.ListenAndServeTLS(c.String("tls-cert"), c.String("tls-key"))
+				}
+				return server.ListenAndServe()
+			},
+		},
+		{
+			Name:  "autoconvert",
+			Usage: "Serve registry webhook to convert the newly pushed images to Nydus images automatically",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: ":8080", Usage: "Address to serve the registry webhook on, the notification path is /events and the job list path is /jobs", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_LISTEN"}},
+				&cli.StringFlag{Name: "tls-cert", Required: false, TakesFile: true, Usage: "TLS certificate file of webhook server, serve plain http if unset", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_TLS_CERT"}},
+				&cli.StringFlag{Name: "tls-key", Required: false, TakesFile: true, Usage: "TLS private key file of webhook server", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_TLS_KEY"}},
+				&cli.StringFlag{Name: "config", Required: true, TakesFile: true, Usage: "JSON file of the rules to select and map pushed images, and the extra arguments of conversion", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_CONFIG"}},
+				&cli.StringFlag{Name: "secret", Required: false, Usage: "Only accept the notifications with the secret in Authorization header or secret query parameter", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_SECRET"}},
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory of the job queue, conversions and their logs", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_WORK_DIR"}},
+				&cli.IntFlag{Name: "workers", Value: 2, Usage: "Number of concurrent conversions", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_WORKERS"}},
+				&cli.IntFlag{Name: "max-attempts", Value: 3, Usage: "Maximum attempts of a conversion job", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_MAX_ATTEMPTS"}},
+				&cli.DurationFlag{Name: "retry-interval", Value: time.Minute, Usage: "Backoff before the first retry of failed job, doubled for each retry", EnvVars: []string{"NYDUSIFY_AUTOCONVERT_RETRY_INTERVAL"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				if (c.String("tls-cert") == "") != (c.String("tls-key") == "") {
+					return fmt.Errorf("--tls-cert and --tls-key should be specified together")
+				}
+				if c.Int("workers") < 1 || c.Int("max-attempts") < 1 {
+					return fmt.Errorf("--workers and --max-attempts should be greater than 0")
+				}
+				config, err := autoconvert.ParseConfigFile(c.String("config"))
+				if err != nil {
+					return err
+				}
+				var harbor *autoconvert.Harbor
+				if config.Harbor != nil {
+					if harbor, err = autoconvert.NewHarbor(*config.Harbor); err != nil {
+						return err
+					}
+				}
+				binary, err := os.Executable()
+				if err != nil {
+					return errors.Wrap(err, "Get nydusify path")
+				}
+
+				workDir := c.String("work-dir")
+				if err := os.MkdirAll(workDir, 0755); err != nil {
+					return err
+				}
+				queue, err := autoconvert.OpenQueue(filepath.Join(workDir, "queue.db"))
+				if err != nil {
+					return err
+				}
+				defer queue.Close()
+
+				service := autoconvert.New(autoconvert.Opt{
+					Config:        config,
+					Harbor:        harbor,
+					Queue:         queue,
+					Convert:       autoconvert.ExecConvert(binary, workDir, config.ConvertArgs),
+					Secret:        c.String("secret"),
+					Workers:       c.Int("workers"),
+					MaxAttempts:   c.Int("max-attempts"),
+					RetryInterval: c.Duration("retry-interval"),
+				})
+
+				mux := http.NewServeMux()
+				mux.Handle("/events", service)
+				mux.HandleFunc("/jobs", service.ServeJobs)
+				mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				})
+				server := &http.Server{Addr: c.String("listen"), Handler: mux}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				serveErr := make(chan error, 1)
+				go func() {
+					logrus.Infof("Serving registry webhook on %s", c.String("listen"))
+					if c.String("tls-cert") != "" {
+						serveErr <- server.ListenAndServeTLS(c.String("tls-cert"), c.String("tls-key"))
+					} else {
+						serveErr <- server.ListenAndServe()
+					}
+				}()
+				workersDone := make(chan struct{})
+				go func() {
+					service.Run(ctx)
+					close(workersDone)
+				}()
+
+				// The running jobs are interrupted on exit, and run again on
+				// next start.
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				select {
+				case err = <-serveErr:
+				case <-signals:
+					logrus.Infof("Shutting down")
+					server.Close()
+				}
+				cancel()
+				<-workersDone
+
+				return err
+			},
+		},
+		{
+			Name:  "pull-through",
+			Usage: "Serve a read-only registry which converts the pulled images to Nydus images on first pull and serves them thereafter",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "listen", Value: "127.0.0.1:5000", Usage: "Address to serve the registry API on, only loopback by default", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_LISTEN"}},
+				&cli.StringFlag{Name: "tls-cert", Required: false, TakesFile: true, Usage: "TLS certificate file of registry server, serve plain http if unset", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_TLS_CERT"}},
+				&cli.StringFlag{Name: "tls-key", Required: false, TakesFile: true, Usage: "TLS private key file of registry server", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_TLS_KEY"}},
+				&cli.StringFlag{Name: "default-registry", Value: "docker.io", Usage: "Upstream registry of the repository names without registry host", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_DEFAULT_REGISTRY"}},
+				&cli.StringSliceFlag{Name: "allowed-registry", Required: false, Usage: "Upstream registry host allowed to pull through the server, can be repeated, only --default-registry is allowed if unset", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_ALLOWED_REGISTRIES"}},
+				&cli.StringFlag{Name: "auth-username", Required: false, Usage: "Username of basic auth required by the server, with --auth-password", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_USERNAME"}},
+				&cli.StringFlag{Name: "auth-password", Required: false, Usage: "Password of basic auth required by the server, no auth if unset", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_PASSWORD"}},
+				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure upstream registry communication", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_SOURCE_INSECURE"}},
+				&cli.StringFlag{Name: "cache-repo", Required: true, Usage: "Repository prefix to push the converted images, e.g. myregistry/nydus-cache", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_CACHE_REPO"}},
+				&cli.BoolFlag{Name: "cache-insecure", Required: false, Usage: "Allow http/insecure cache registry communication", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_CACHE_INSECURE"}},
+				&cli.StringSliceFlag{Name: "convert-arg", Required: false, Usage: "Extra argument of `nydusify convert` for all conversions, can be specified multiple times", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_CONVERT_ARGS"}},
+				&cli.StringFlag{Name: "work-dir", Value: "./tmp", Usage: "Work directory of the conversions and their logs", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_WORK_DIR"}},
+				&cli.IntFlag{Name: "workers", Value: 2, Usage: "Number of concurrent conversions", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_WORKERS"}},
+				&cli.DurationFlag{Name: "wait", Value: 30 * time.Second, Usage: "Maximum time of a pull waiting for the conversion, the source image is served if it's exceeded", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_WAIT"}},
+				&cli.DurationFlag{Name: "convert-timeout", Value: time.Hour, Usage: "Timeout of a conversion", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_CONVERT_TIMEOUT"}},
+				&cli.DurationFlag{Name: "retry-interval", Value: 10 * time.Minute, Usage: "Backoff before converting the failed image again", EnvVars: []string{"NYDUSIFY_PULL_THROUGH_RETRY_INTERVAL"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				if (c.String("tls-cert") == "") != (c.String("tls-key") == "") {
+					return fmt.Errorf("--tls-cert and --tls-key should be specified together")
+				}
+				if c.Int("workers") < 1 {
+					return fmt.Errorf("--workers should be greater than 0")
+				}
+				binary, err := os.Executable()
+				if err != nil {
+					return errors.Wrap(err, "Get nydusify path")
+				}
+				workDir := c.String("work-dir")
+				if err := os.MkdirAll(workDir, 0755); err != nil {
+					return err
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				service, err := pullthrough.New(ctx, pullthrough.Opt{
+					DefaultRegistry:   c.String("default-registry"),
+					AllowedRegistries: c.StringSlice("allowed-registry"),
+					SourceInsecure:    c.Bool("source-insecure"),
+					Username:          c.String("auth-username"),
+					Password:          c.String("auth-password"),
+					CacheRepo:         c.String("cache-repo"),
+					CacheInsecure:     c.Bool("cache-insecure"),
+					Convert:           pullthrough.ExecConvert(binary, workDir, c.StringSlice("convert-arg")),
+					Workers:           c.Int("workers"),
+					Wait:              c.Duration("wait"),
+					ConvertTimeout:    c.Duration("convert-timeout"),
+					RetryInterval:     c.Duration("retry-interval"),
+				})
+				if err != nil {
+					return err
+				}
+				if c.String("auth-password") == "" {
+					logrus.Warnf("Basic auth isn't enabled, the server should only be reachable by trusted clients")
+				} else if c.String("tls-cert") == "" {
+					logrus.Warnf("Basic auth credentials are sent in plain http without --tls-cert")
+				}
+
+				mux := http.NewServeMux()
+				mux.Handle("/v2/", service)
+				mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				})
+				server := &http.Server{Addr: c.String("listen"), Handler: mux}
+
+				serveErr := make(chan error, 1)
+				go func() {
+					logrus.Infof("Serving pull-through registry on %s", c.String("listen"))
+					if c.String("tls-cert") != "" {
+						serveErr <- server.ListenAndServeTLS(c.String("tls-cert"), c.String("tls-key"))
+					} else {
+						serveErr <- server.ListenAndServe()
+					}
+				}()
+
+				// The running conversions are killed on exit, and resumed
+				// from checkpoint by the next pull.
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				select {
+				case err = <-serveErr:
+				case <-signals:
+					logrus.Infof("Shutting down")
+					server.Close()
+				}
+
+				return err
+			},
+		},
+		{
+			Name:  "admin",
+			Usage: "Serve the HTTP API of Nydusd on a TCP address or unix socket with token auth, and the health probes of Nydusd",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "apisock", Required: true, TakesFile: true, Usage: "API socket of Nydusd to forward the requests to", EnvVars: []string{"NYDUSIFY_ADMIN_APISOCK"}},
+				&cli.StringFlag{Name: "listen", Value: "127.0.0.1:8090", Usage: "Address to serve the API on, `host:port` or `unix://<path>`, only loopback by default", EnvVars: []string{"NYDUSIFY_ADMIN_LISTEN"}},
+				&cli.StringFlag{Name: "token-file", Required: false, TakesFile: true, Usage: "File of the token required by the `Authorization: Bearer` header of requests, no auth if unset", EnvVars: []string{"NYDUSIFY_ADMIN_TOKEN_FILE"}},
+				&cli.BoolFlag{Name: "read-only", Value: false, Usage: "Reject the mutating requests, e.g. mount, umount and exit, only GET and HEAD are allowed", EnvVars: []string{"NYDUSIFY_ADMIN_READ_ONLY"}},
+				&cli.StringFlag{Name: "mountpoint", Required: false, Usage: "FUSE mountpoint of Nydusd checked by /healthz and /readyz, the probes fail if it's dead", EnvVars: []string{"NYDUSIFY_ADMIN_MOUNTPOINT"}},
+				&cli.StringFlag{Name: "min-cache-free", Value: "1GiB", Usage: "Free space of cache directories required by /readyz", EnvVars: []string{"NYDUSIFY_ADMIN_MIN_CACHE_FREE"}},
+				&cli.DurationFlag{Name: "probe-timeout", Value: 5 * time.Second, Usage: "Timeout of /healthz and /readyz", EnvVars: []string{"NYDUSIFY_ADMIN_PROBE_TIMEOUT"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				var token string
+				if c.String("token-file") != "" {
+					data, err := ioutil.ReadFile(c.String("token-file"))
+					if err != nil {
+						return errors.Wrap(err, "read token file")
+					}
+					if token = strings.TrimSpace(string(data)); token == "" {
+						return fmt.Errorf("token file %s is empty", c.String("token-file"))
+					}
+				}
+				minCacheFree, err := humanize.ParseBytes(c.String("min-cache-free"))
+				if err != nil {
+					return errors.Wrap(err, "parse --min-cache-free")
+				}
+				service, err := admin.New(admin.Opt{
+					APISock:      c.String("apisock"),
+					Token:        token,
+					ReadOnly:     c.Bool("read-only"),
+					Mountpoint:   c.String("mountpoint"),
+					MinCacheFree: minCacheFree,
+					ProbeTimeout: c.Duration("probe-timeout"),
+				})
+				if err != nil {
+					return err
+				}
+				if token == "" {
+					logrus.Warnf("Token auth isn't enabled, the server should only be reachable by trusted clients")
+				}
+
+				listener, err := admin.Listen(c.String("listen"))
+				if err != nil {
+					return errors.Wrap(err, "listen admin address")
+				}
+				server := &http.Server{Handler: service}
+
+				serveErr := make(chan error, 1)
+				go func() {
+					logrus.Infof("Serving nydusd API on %s", c.String("listen"))
+					serveErr <- server.Serve(listener)
+				}()
+
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				select {
+				case err = <-serveErr:
+				case <-signals:
+					logrus.Infof("Shutting down")
+					server.Close()
+				}
+
+				return err
+			},
+		},
+		{
+			Name:  "dedup",
+			Usage: "Manage chunk deduplication database",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "inspect",
+					Usage: "Show images and chunks recorded in deduplication database",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "db", Required: true, TakesFile: true, Usage: "Path of deduplication database", EnvVars: []string{"NYDUSIFY_DEDUP_INSPECT_DB"}},
+					},
+					Action: func(c *cli.Context) error {
+						db, err := dedup.Open(c.String("db"))
+						if err != nil {
+							return err
+						}
+						defer db.Close()
+
+						stat, err := db.Stat()
+						if err != nil {
+							return err
+						}
+						for _, image := range stat.Images {
+							fmt.Printf("%s\tblobs: %d\tchunks: %d\tupdated: %s\n",
+								image.Reference, len(image.Blobs), image.Chunks, image.UpdatedAt.Format(time.RFC3339))
+						}
+						ratio := 1.0
+						if stat.Chunks > 0 {
+							ratio = float64(stat.ReferencedChunks) / float64(stat.Chunks)
+						}
+						fmt.Printf("images: %d, unique chunks: %d in %d blobs, referenced chunks: %d, dedup ratio: %.2f\n",
+							len(stat.Images), stat.Chunks, stat.Blobs, stat.ReferencedChunks, ratio)
+						return nil
+					},
+				},
+				{
+					Name:  "compact",
+					Usage: "Remove images from deduplication database and reclaim the space",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "db", Required: true, TakesFile: true, Usage: "Path of deduplication database", EnvVars: []string{"NYDUSIFY_DEDUP_COMPACT_DB"}},
+						&cli.StringSliceFlag{Name: "remove", Usage: "Image reference to be removed from database, can be specified multiple times"},
+					},
+					Action: func(c *cli.Context) error {
+						if refs := c.StringSlice("remove"); len(refs) > 0 {
+							db, err := dedup.Open(c.String("db"))
+							if err != nil {
+								return err
+							}
+							for _, ref := range refs {
+								if err := db.Remove(ref); err != nil {
+									db.Close()
+									return err
+								}
+							}
+							if err := db.Close(); err != nil {
+								return err
+							}
+						}
+						return dedup.Compact(c.String("db"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "inspect",
+			Usage: "Show chunk statistics of Nydus image",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_INSPECT_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_INSPECT_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.IntFlag{Name: "top", Value: 10, Usage: "Number of the largest files to show", EnvVars: []string{"NYDUSIFY_INSPECT_TOP"}},
+				&cli.StringFlag{Name: "format", Value: "table", Usage: "Output format (table, json)", EnvVars: []string{"NYDUSIFY_INSPECT_FORMAT"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				format := c.String("format")
+				if !isPossibleValue([]string{"table", "json"}, format) {
+					return fmt.Errorf("--format should be table or json")
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+				targetRemote, err := provider.DefaultRemote(c.String("target"), c.Bool("target-insecure"))
+				if err != nil {
+					return err
+				}
+				bootstrap, err := dedup.PullImageBootstrap(context.Background(), targetRemote, arch)
+				if err != nil {
+					return err
+				}
+
+				stat := inspect.Inspect(bootstrap, c.Int("top"))
+				if format == "json" {
+					return printJSON(stat)
+				}
+				return stat.WriteTable(os.Stdout)
+			},
+		},
+		{
+			Name:      "ls",
+			Usage:     "List directory in Nydus image without mounting",
+			ArgsUsage: "[PATH]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_LS_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_LS_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				dirPath := c.Args().First()
+				if dirPath == "" {
+					dirPath = "/"
+				}
+				v, err := newViewer(context.Background(), c)
+				if err != nil {
+					return err
+				}
+				files, err := v.List(dirPath)
+				if err != nil {
+					return err
+				}
+				for _, file := range files {
+					name := file.Path
+					if file.Symlink != "" {
+						name += " -> " + file.Symlink
+					}
+					fmt.Printf("%s\t%d\t%d\t%d\t%s\n", viewer.FileMode(file.Mode), file.UID, file.GID, file.Size, name)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "cat",
+			Usage:     "Print file in Nydus image without mounting, only the chunks of file are fetched",
+			ArgsUsage: "PATH",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_CAT_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_CAT_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				if c.Args().Len() != 1 {
+					return fmt.Errorf("a file path is required")
+				}
+				ctx := context.Background()
+				v, err := newViewer(ctx, c)
+				if err != nil {
+					return err
+				}
+				return v.Cat(ctx, c.Args().First(), os.Stdout)
+			},
+		},
+		{
+			Name:  "mount",
+			Usage: "Mount Nydus image read-only at local path by nydusd, umount on Ctrl-C",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_MOUNT_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_MOUNT_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "mountpoint", Required: true, Usage: "Local path to mount Nydus image", EnvVars: []string{"NYDUSIFY_MOUNT_MOUNTPOINT"}},
+				&cli.StringFlag{Name: "work-dir", Value: "", Usage: "Work directory to store bootstrap and blob cache, a temporary directory is used and removed on umount if unset", EnvVars: []string{"NYDUSIFY_MOUNT_WORK_DIR"}},
+				&cli.StringFlag{Name: "nydusd", Value: "nydusd", Usage: "The nydusd binary path, if unset, search in PATH environment", EnvVars: []string{"NYDUSD"}},
+				&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type", EnvVars: []string{"NYDUSIFY_MOUNT_BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string, generated from target reference for registry backend if unset", EnvVars: []string{"NYDUSIFY_MOUNT_BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"NYDUSIFY_MOUNT_BACKEND_CONFIG_FILE"}},
+				&cli.StringFlag{Name: "prefetch-policy", Value: "", Usage: "Prefetch policy (background, eager, on-demand) to mount Nydus image by nydusd, overridden by the policy written in image, on-demand if unset", EnvVars: []string{"NYDUSIFY_MOUNT_PREFETCH_POLICY"}},
+				&cli.StringSliceFlag{Name: "event-sink", Required: false, Usage: "Deliver lifecycle events as JSON to the webhook URL, or append them to the file as JSON lines, can be repeated", EnvVars: []string{"NYDUSIFY_MOUNT_EVENT_SINKS"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				closeEvents, err := events.Setup(c.StringSlice("event-sink"))
+				if err != nil {
+					return err
+				}
+				defer closeEvents()
+
+				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+				if err != nil {
+					return err
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+				prefetchPolicy, err := prefetch.ParsePolicy(c.String("prefetch-policy"))
+				if err != nil {
+					return err
+				}
+
+				mounter, err := mount.Mount(context.Background(), mount.Opt{
+					WorkDir:        c.String("work-dir"),
+					Target:         c.String("target"),
+					TargetInsecure: c.Bool("target-insecure"),
+					ExpectedArch:   arch,
+					NydusdPath:     c.String("nydusd"),
+					BackendType:    c.String("backend-type"),
+					BackendConfig:  backendConfig,
+					PrefetchPolicy: prefetchPolicy,
+					Mountpoint:     c.String("mountpoint"),
+				})
+				mountEvent := events.Event{
+					Type:  events.TypeMountCreated,
+					Image: c.String("target"),
+					Data:  map[string]string{"mountpoint": c.String("mountpoint")},
+				}
+				if err != nil {
+					mountEvent.Type, mountEvent.Error = events.TypeMountFailed, err.Error()
+				}
+				events.Emit(mountEvent)
+				if err != nil {
+					return err
+				}
+
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				logrus.Infof("Press Ctrl-C to umount")
+				<-signals
+
+				return mounter.Umount()
+			},
+		},
+		{
+			Name:  "mount-pod",
+			Usage: "Mount the Nydus images of a pod at the subdirectories of local path by a single nydusd, umount on Ctrl-C",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "pod", Required: false, TakesFile: true, Usage: "Read the images of containers from pod manifest (or workload with pod template) in YAML or JSON, mounted at the subdirectories of container names", EnvVars: []string{"NYDUSIFY_MOUNT_POD_MANIFEST"}},
+				&cli.StringSliceFlag{Name: "image", Required: false, Usage: "Nydus image to mount at the subdirectory name, in name=reference format, can be repeated", EnvVars: []string{"NYDUSIFY_MOUNT_POD_IMAGES"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_MOUNT_POD_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "mountpoint", Required: true, Usage: "Local path to mount Nydus images", EnvVars: []string{"NYDUSIFY_MOUNT_POD_MOUNTPOINT"}},
+				&cli.StringFlag{Name: "work-dir", Value: "", Usage: "Work directory to store bootstraps and the shared blob cache, a temporary directory is used and removed on umount if unset", EnvVars: []string{"NYDUSIFY_MOUNT_POD_WORK_DIR"}},
+				&cli.StringFlag{Name: "nydusd", Value: "nydusd", Usage: "The nydusd binary path, if unset, search in PATH environment", EnvVars: []string{"NYDUSD"}},
+				&cli.StringFlag{Name: "prefetch-policy", Value: "", Usage: "Prefetch policy (background, eager, on-demand) to mount Nydus images by nydusd, overridden by the policy written in image, on-demand if unset", EnvVars: []string{"NYDUSIFY_MOUNT_POD_PREFETCH_POLICY"}},
+				&cli.StringSliceFlag{Name: "event-sink", Required: false, Usage: "Deliver lifecycle events as JSON to the webhook URL, or append them to the file as JSON lines, can be repeated", EnvVars: []string{"NYDUSIFY_MOUNT_POD_EVENT_SINKS"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				closeEvents, err := events.Setup(c.StringSlice("event-sink"))
+				if err != nil {
+					return err
+				}
+				defer closeEvents()
+
+				images := []mount.PodImage{}
+				if c.String("pod") != "" {
+					podImages, err := mount.ParsePodImagesFile(c.String("pod"))
+					if err != nil {
+						return err
+					}
+					images = append(images, podImages...)
+				}
+				for _, pair := range c.StringSlice("image") {
+					parts := strings.SplitN(pair, "=", 2)
+					if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+						return fmt.Errorf("invalid --image %s, should be name=reference", pair)
+					}
+					images = append(images, mount.PodImage{Name: parts[0], Target: parts[1]})
+				}
+				if len(images) == 0 {
+					return fmt.Errorf("--pod or --image should be specified")
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+				prefetchPolicy, err := prefetch.ParsePolicy(c.String("prefetch-policy"))
+				if err != nil {
+					return err
+				}
+
+				mounter, err := mount.MountPod(context.Background(), mount.PodOpt{
+					WorkDir:        c.String("work-dir"),
+					Images:         images,
+					TargetInsecure: c.Bool("target-insecure"),
+					ExpectedArch:   arch,
+					NydusdPath:     c.String("nydusd"),
+					PrefetchPolicy: prefetchPolicy,
+					Mountpoint:     c.String("mountpoint"),
+				})
+				for _, image := range images {
+					mountEvent := events.Event{
+						Type:  events.TypeMountCreated,
+						Image: image.Target,
+						Data:  map[string]string{"mountpoint": filepath.Join(c.String("mountpoint"), image.Name)},
+					}
+					if err != nil {
+						mountEvent.Type, mountEvent.Error = events.TypeMountFailed, err.Error()
+					}
+					events.Emit(mountEvent)
+				}
+				if err != nil {
+					return err
+				}
+				logrus.Infof("Mounted %d images, %d blobs are shared by images", len(images), mounter.SharedBlobs)
+
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				logrus.Infof("Press Ctrl-C to umount")
+				<-signals
+
+				return mounter.Umount()
+			},
+		},
+		{
+			Name:  "bench",
+			Usage: "Cold-start Nydus image by nydusd, replay an access trace and report startup latency and fetched data",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_BENCH_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_BENCH_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "trace", Required: false, TakesFile: true, Usage: "Read the files listed in the file (one absolute path of rootfs per line) in order after mounted, which can be generated by `nydusify prefetch`, all files are read if unset", EnvVars: []string{"NYDUSIFY_BENCH_TRACE"}},
+				&cli.StringFlag{Name: "nydusd", Value: "nydusd", Usage: "The nydusd binary path, if unset, search in PATH environment", EnvVars: []string{"NYDUSD"}},
+				&cli.StringFlag{Name: "backend-type", Value: "registry", Usage: "Specify Nydus blob storage backend type", EnvVars: []string{"NYDUSIFY_BENCH_BACKEND_TYPE"}},
+				&cli.StringFlag{Name: "backend-config", Value: "", Usage: "Specify Nydus blob storage backend in JSON config string, generated from target reference for registry backend if unset", EnvVars: []string{"NYDUSIFY_BENCH_BACKEND_CONFIG"}},
+				&cli.StringFlag{Name: "backend-config-file", Value: "", TakesFile: true, Usage: "Specify Nydus blob storage backend config from path", EnvVars: []string{"NYDUSIFY_BENCH_BACKEND_CONFIG_FILE"}},
+				&cli.StringFlag{Name: "prefetch-policy", Value: "", Usage: "Prefetch policy (background, eager, on-demand) to mount Nydus image by nydusd, overridden by the policy written in image, on-demand if unset", EnvVars: []string{"NYDUSIFY_BENCH_PREFETCH_POLICY"}},
+				&cli.StringFlag{Name: "format", Value: "text", Usage: "Output format (text, json)", EnvVars: []string{"NYDUSIFY_BENCH_FORMAT"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				format := c.String("format")
+				if !isPossibleValue([]string{"text", "json"}, format) {
+					return fmt.Errorf("--format should be text or json")
+				}
+
+				backendConfig, err := parseBackendConfig(c.String("backend-config"), c.String("backend-config-file"))
+				if err != nil {
+					return err
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+				prefetchPolicy, err := prefetch.ParsePolicy(c.String("prefetch-policy"))
+				if err != nil {
+					return err
+				}
+				var trace []string
+				if tracePath := c.String("trace"); tracePath != "" {
+					file, err := os.Open(tracePath)
+					if err != nil {
+						return errors.Wrap(err, "open trace file")
+					}
+					defer file.Close()
+					if trace, err = prefetch.ReadList(file); err != nil {
+						return err
+					}
+				}
+
+				// Umount the image if interrupted during replay.
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				defer signal.Stop(signals)
+				go func() {
+					select {
+					case <-signals:
+						cancel()
+					case <-ctx.Done():
+					}
+				}()
+
+				result, err := bench.Run(ctx, bench.Opt{
+					Target:         c.String("target"),
+					TargetInsecure: c.Bool("target-insecure"),
+					ExpectedArch:   arch,
+					NydusdPath:     c.String("nydusd"),
+					BackendType:    c.String("backend-type"),
+					BackendConfig:  backendConfig,
+					PrefetchPolicy: prefetchPolicy,
+					Trace:          trace,
+				})
+				if err != nil {
+					return err
+				}
+
+				if format == "json" {
+					return printJSON(result)
+				}
+				fmt.Printf("image: %s\n", result.Image)
+				fmt.Printf("time to ready: %.3fs, time to first byte: %.3fs, time to finish: %.3fs\n",
+					result.TimeToReady, result.TimeToFirstByte, result.TimeToFinish)
+				fmt.Printf("files read: %d (%s), missing in image: %d\n",
+					result.FilesRead, humanize.IBytes(uint64(result.BytesRead)), result.FilesMissing)
+				fmt.Printf("fetched: %s of %s image, ratio: %.2f\n",
+					humanize.IBytes(result.BytesFetched), humanize.IBytes(uint64(result.ImageSize)), result.FetchRatio)
+				fmt.Printf("cache hits: %d of %d reads, hit rate: %.2f\n", result.CacheHits, result.CacheReads, result.CacheHitRate)
+				return nil
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "Export Nydus image to a flattened OCI image archive or rootfs tarball",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_EXPORT_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_EXPORT_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "output", Required: true, TakesFile: true, Usage: "Path of exported tarball, `-` means stdout", EnvVars: []string{"NYDUSIFY_EXPORT_OUTPUT"}},
+				&cli.StringFlag{Name: "format", Value: export.FormatOCIArchive, Usage: "Format of exported tarball (oci-archive, rootfs)", EnvVars: []string{"NYDUSIFY_EXPORT_FORMAT"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				format := c.String("format")
+				if !isPossibleValue([]string{export.FormatOCIArchive, export.FormatRootfs}, format) {
+					return fmt.Errorf("--format should be oci-archive or rootfs")
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+
+				opt := export.Opt{
+					Target:         c.String("target"),
+					TargetInsecure: c.Bool("target-insecure"),
+					ExpectedArch:   arch,
+					Format:         format,
+				}
+				output := c.String("output")
+				if output == "-" {
+					return export.Export(context.Background(), opt, os.Stdout)
+				}
+
+				file, err := os.Create(output)
+				if err != nil {
+					return errors.Wrap(err, "create output file")
+				}
+				if err := export.Export(context.Background(), opt, file); err != nil {
+					file.Close()
+					os.Remove(output)
+					return err
+				}
+				if err := file.Close(); err != nil {
+					return errors.Wrap(err, "close output file")
+				}
+				logrus.Infof("Exported Nydus image to %s", output)
+				return nil
+			},
+		},
+		{
+			Name:  "restore",
+			Usage: "Reconstruct the source image of Nydus image converted with --tar-split and push it",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_RESTORE_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_RESTORE_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Reference to push the reconstructed source image", EnvVars: []string{"NYDUSIFY_RESTORE_SOURCE"}},
+				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"NYDUSIFY_RESTORE_SOURCE_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+
+				result, err := restore.Restore(context.Background(), restore.Opt{
+					Target:         c.String("target"),
+					TargetInsecure: c.Bool("target-insecure"),
+					ExpectedArch:   arch,
+					Source:         c.String("source"),
+					SourceInsecure: c.Bool("source-insecure"),
+				})
+				if err != nil {
+					return err
+				}
+				if result.Identical {
+					logrus.Infof("Restored source image %s@%s with identical digest", c.String("source"), result.Digest)
+				} else {
+					logrus.Warnf("Restored source image %s@%s, %d of %d layers are recompressed", c.String("source"), result.Digest, result.RecompressedLayers, result.Layers)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "Annotate Nydus image converted by older nydusify with its RAFS version in place",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target (Nydus) image reference", EnvVars: []string{"NYDUSIFY_MIGRATE_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_MIGRATE_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.BoolFlag{Name: "dry-run", Required: false, Usage: "Only detect the RAFS version without pushing anything", EnvVars: []string{"NYDUSIFY_MIGRATE_DRY_RUN"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+
+				result, err := migrate.Migrate(context.Background(), migrate.Opt{
+					Target:         c.String("target"),
+					TargetInsecure: c.Bool("target-insecure"),
+					ExpectedArch:   arch,
+					DryRun:         c.Bool("dry-run"),
+				})
+				if err != nil {
+					return err
+				}
+				if !result.Migrated {
+					logrus.Infof("Nothing to migrate, %s@%s is RAFS v%s", c.String("target"), result.Digest, result.FsVersion)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "copy",
+			Usage: "Copy converted image with all its blobs between registries without converting again",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "source", Required: true, Usage: "Source (Nydus) image reference", EnvVars: []string{"NYDUSIFY_COPY_SOURCE"}},
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target image reference", EnvVars: []string{"NYDUSIFY_COPY_TARGET"}},
+				&cli.BoolFlag{Name: "source-insecure", Required: false, Usage: "Allow http/insecure source registry communication", EnvVars: []string{"NYDUSIFY_COPY_SOURCE_INSECURE"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_COPY_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "source-credential-helper", Required: false, Usage: "Get source registry credentials by docker-credential-<helper>, such as ecr-login, gcloud, acr-env", EnvVars: []string{"NYDUSIFY_COPY_SOURCE_CREDENTIAL_HELPER"}},
+				&cli.StringFlag{Name: "target-credential-helper", Required: false, Usage: "Get target registry credentials by docker-credential-<helper>, such as ecr-login, gcloud, acr-env", EnvVars: []string{"NYDUSIFY_COPY_TARGET_CREDENTIAL_HELPER"}},
+				&cli.IntFlag{Name: "concurrency", Value: 5, Usage: "Count of blobs copied in parallel", EnvVars: []string{"NYDUSIFY_COPY_CONCURRENCY"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				sourceRemote, err := provider.DefaultRemoteWithOptions(c.String("source"), c.Bool("source-insecure"), provider.RemoteOptions{
+					CredentialHelper: c.String("source-credential-helper"),
+				})
+				if err != nil {
+					return err
+				}
+				targetRemote, err := provider.DefaultRemoteWithOptions(c.String("target"), c.Bool("target-insecure"), provider.RemoteOptions{
+					CredentialHelper: c.String("target-credential-helper"),
+				})
+				if err != nil {
+					return err
+				}
+
+				result, err := copier.Copy(context.Background(), copier.Opt{
+					SourceRemote: sourceRemote,
+					TargetRemote: targetRemote,
+					Concurrency:  c.Int("concurrency"),
+				})
+				if err != nil {
+					return err
+				}
+				logrus.Infof("Copied image to %s: %d manifests, %d blobs, %d blobs (%d bytes) transferred, others existed or mounted",
+					targetRemote.Ref, result.Manifests, result.Blobs, result.CopiedBlobs, result.CopiedSize)
+				return nil
+			},
+		},
+		{
+			Name:  "attach",
+			Usage: "Attach files as an artifact referring to the image, such as SBOM or attestation",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target image reference to attach artifact to", EnvVars: []string{"NYDUSIFY_ATTACH_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_ATTACH_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "artifact-type", Required: true, Usage: "Artifact type of the attached files, such as application/spdx+json", EnvVars: []string{"NYDUSIFY_ATTACH_ARTIFACT_TYPE"}},
+				&cli.StringSliceFlag{Name: "file", Required: false, TakesFile: true, Usage: "File to attach as a layer of artifact, can be repeated", EnvVars: []string{"NYDUSIFY_ATTACH_FILE"}},
+				&cli.StringFlag{Name: "file-media-type", Value: "application/octet-stream", Usage: "Media type of the attached files", EnvVars: []string{"NYDUSIFY_ATTACH_FILE_MEDIA_TYPE"}},
+				&cli.StringSliceFlag{Name: "annotation", Required: false, Usage: "Annotation of artifact in key=value format, can be repeated", EnvVars: []string{"NYDUSIFY_ATTACH_ANNOTATION"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				annotations := map[string]string{}
+				for _, annotation := range c.StringSlice("annotation") {
+					parts := strings.SplitN(annotation, "=", 2)
+					if len(parts) != 2 || parts[0] == "" {
+						return fmt.Errorf("invalid annotation %s, should be key=value", annotation)
+					}
+					annotations[parts[0]] = parts[1]
+				}
+
+				ctx := context.Background()
+				targetRemote, err := provider.DefaultRemote(c.String("target"), c.Bool("target-insecure"))
+				if err != nil {
+					return err
+				}
+				subject, err := targetRemote.Resolve(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "resolve image %s", targetRemote.Ref)
+				}
+				layers := []ocispec.Descriptor{}
+				for _, file := range c.StringSlice("file") {
+					layer, err := pushFile(ctx, targetRemote, file, c.String("file-media-type"))
+					if err != nil {
+						return err
+					}
+					layers = append(layers, *layer)
+				}
+				referrer, err := targetRemote.Attach(ctx, *subject, c.String("artifact-type"), layers, annotations)
+				if err != nil {
+					return err
+				}
+				logrus.Infof("Attached artifact %s to %s@%s", referrer.Digest, targetRemote.Ref, subject.Digest)
+				return nil
+			},
+		},
+		{
+			Name:  "discover",
+			Usage: "List the artifacts referring to the image",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "target", Required: true, Usage: "Target image reference", EnvVars: []string{"NYDUSIFY_DISCOVER_TARGET"}},
+				&cli.BoolFlag{Name: "target-insecure", Required: false, Usage: "Allow http/insecure target registry communication", EnvVars: []string{"NYDUSIFY_DISCOVER_TARGET_INSECURE"}},
+				&cli.StringFlag{Name: "artifact-type", Required: false, Usage: "Only list the artifacts of the type", EnvVars: []string{"NYDUSIFY_DISCOVER_ARTIFACT_TYPE"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+
+				ctx := context.Background()
+				targetRemote, err := provider.DefaultRemote(c.String("target"), c.Bool("target-insecure"))
+				if err != nil {
+					return err
+				}
+				subject, err := targetRemote.Resolve(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "resolve image %s", targetRemote.Ref)
+				}
+				referrers, err := targetRemote.Referrers(ctx, subject.Digest, c.String("artifact-type"))
+				if err != nil {
+					return err
+				}
+				return printJSON(referrers)
+			},
+		},
+		{
+			Name:  "diff",
+			Usage: "Compare the files and chunks of two Nydus images",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "old", Required: true, Usage: "Old (Nydus) image reference", EnvVars: []string{"NYDUSIFY_DIFF_OLD"}},
+				&cli.StringFlag{Name: "new", Required: true, Usage: "New (Nydus) image reference", EnvVars: []string{"NYDUSIFY_DIFF_NEW"}},
+				&cli.BoolFlag{Name: "insecure", Required: false, Usage: "Allow http/insecure registry communication", EnvVars: []string{"NYDUSIFY_DIFF_INSECURE"}},
+				&cli.StringFlag{Name: "platform", Value: "linux/" + runtime.GOARCH, Usage: "Let nydusify choose image of specified platform from manifest index. Possible value is `amd64` or `arm64`"},
+				&cli.StringFlag{Name: "format", Value: "text", Usage: "Output format (text, json)", EnvVars: []string{"NYDUSIFY_DIFF_FORMAT"}},
+				&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (panic, fatal, error, warn, info, debug, trace)", EnvVars: []string{"LOG_LEVEL"}},
+				&cli.StringFlag{Name: "log-format", Value: "text", Usage: "Set log format (text, json)", EnvVars: []string{"NYDUSIFY_LOG_FORMAT"}},
+			},
+			Action: func(c *cli.Context) error {
+				if err := setupLogging(c); err != nil {
+					return err
+				}
+				format := c.String("format")
+				if !isPossibleValue([]string{"text", "json"}, format) {
+					return fmt.Errorf("--format should be text or json")
+				}
+				_, arch, err := provider.ExtractOsArch(c.String("platform"))
+				if err != nil {
+					return err
+				}
+
+				ctx := context.Background()
+				bootstraps := []*dedup.Bootstrap{}
+				for _, ref := range []string{c.String("old"), c.String("new")} {
+					r, err := provider.DefaultRemote(ref, c.Bool("insecure"))
+					if err != nil {
+						return err
+					}
+					bootstrap, err := dedup.PullImageBootstrap(ctx, r, arch)
+					if err != nil {
+						return err
+					}
+					bootstraps = append(bootstraps, bootstrap)
+				}
+
+				result := diff.Diff(bootstraps[0], bootstraps[1])
+				if format == "json" {
+					return printJSON(result)
+				}
+				signs := map[string]string{"added": "+", "removed": "-", "changed": "M"}
+				for _, change := range result.Changes {
+					fmt.Printf("%s %s\t%d\n", signs[change.Kind], change.Path, change.Size)
+				}
+				ratio := 0.0
+				if result.Chunks > 0 {
+					ratio = float64(result.SharedChunks) / float64(result.Chunks)
+				}
+				fmt.Printf("changes: %d, chunks: %d (%d bytes), shared chunks: %d (%d bytes), shared ratio: %.2f\n",
+					len(result.Changes), result.Chunks, result.Size, result.SharedChunks, result.SharedSize, ratio)
+				return nil
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Manage the config file of commands",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "validate",
+					Usage: "Check the commands, flags, values and files in config file before deploying",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "file", Required: false, TakesFile: true, Usage: "Path of config file, use --config-file if unset", EnvVars: []string{"NYDUSIFY_CONFIG_VALIDATE_FILE"}},
+					},
+					Action: func(c *cli.Context) error {
+						path := c.String("file")
+						if path == "" {
+							path = c.String("config-file")
+						}
+						if path == "" {
+							return exitcode.Wrap(exitcode.Usage, fmt.Errorf("--file or --config-file is required"))
+						}
+						file, err := config.Load(path)
+						if err != nil {
+							return exitcode.Wrap(exitcode.Usage, err)
+						}
+						errs := file.Validate(configSchema(app.Commands))
+						for _, err := range errs {
+							fmt.Println(err)
+						}
+						if len(errs) > 0 {
+							return exitcode.Wrap(exitcode.Usage, fmt.Errorf("found %d problems in config file %s", len(errs), path))
+						}
+						fmt.Printf("Config file %s is valid\n", path)
+						return nil
+					},
+				},
+			},
+		},
 	}
 
 	// Under platform linux/arm64, containerd/compression prioritizes using `unpigz`
@@ -347,7 +2890,10 @@ func main() {
 		logrus.Fatal("Nydusify can only work under architecture 'amd64' and 'arm64'")
 	}
 
+	// The failures of conversion exit with the code of failure class, see
+	// package exitcode.
 	if err := app.Run(os.Args); err != nil {
-		logrus.Fatal(err)
+		logrus.Error(err)
+		os.Exit(exitcode.Of(err))
 	}
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/client"
+)
+
+func main() {
+	// Cancel the conversion on Ctrl-C
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	// Search nydus-image and nydusd in PATH if the paths are unset
+	c, err := client.New(client.Opt{
+		NydusImagePath: "/path/to/nydus-image",
+		NydusdPath:     "/path/to/nydusd",
+		WorkDir:        "./tmp",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	result, err := c.Convert(ctx, client.ConvertOpt{
+		Source:         "localhost:5000/ubuntu:latest",
+		Target:         "localhost:5000/ubuntu:latest-nydus",
+		SourceInsecure: true,
+		TargetInsecure: true,
+		// Receive the progress of conversion instead of parsing the logs
+		OnEvent: func(event interface{}) {
+			switch e := event.(type) {
+			case *client.StageEvent:
+				fmt.Printf("%s %s\n", e.Stage, e.Status)
+			case *client.ProgressEvent:
+				fmt.Printf("layers %d/%d, uploads %d/%d\n", e.LayersProcessed, e.Layers, e.UploadsCompleted, e.Uploads)
+			}
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("Converted %s@%s in %s\n", result.Target, result.Manifest.Digest, result.Duration)
+
+	// Mount the Nydus image to look into it
+	m, err := c.Mount(ctx, client.MountOpt{
+		Target:         result.Target,
+		TargetInsecure: true,
+		Mountpoint:     "./mnt",
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer m.Umount()
+
+	entries, err := ioutil.ReadDir(m.Mountpoint())
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		fmt.Println(entry.Name())
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package admin serves the HTTP API of Nydusd on a TCP address or another
+// unix socket, so that the operators can curl the daemon without access to
+// its API socket. The requests are authenticated by a bearer token, and the
+// mutating requests (mount, umount, exit, log level and so on) can be
+// disabled. It also serves the liveness and readiness probes of Nydusd for
+// Kubernetes.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// APIPrefix is the path prefix of Nydusd API, only the paths under it are
+// forwarded.
+const APIPrefix = "/api/v1/"
+
+type Opt struct {
+	// APISock is the API socket of Nydusd.
+	APISock string
+	// Token is required by the `Authorization: Bearer` header of requests
+	// if set.
+	Token string
+	// ReadOnly rejects all requests except GET and HEAD.
+	ReadOnly bool
+	// Mountpoint is the FUSE mountpoint of Nydusd checked by probes, it's
+	// not checked if unset.
+	Mountpoint string
+	// MinCacheFree is the free bytes of cache directories required by the
+	// readiness probe.
+	MinCacheFree uint64
+	// ProbeTimeout is the timeout of probes, defaults to 5s.
+	ProbeTimeout time.Duration
+}
+
+// Server forwards the API requests to Nydusd.
+type Server struct {
+	Opt
+	proxy  *httputil.ReverseProxy
+	client *http.Client
+}
+
+// NewAPITransport returns the transport sending requests to the API socket
+// of Nydusd, the host of request URL is ignored.
+func NewAPITransport(apiSock string) *http.Transport {
+	return &http.Transport{
+		MaxIdleConns:    10,
+		IdleConnTimeout: 10 * time.Second,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: 5 * time.Second}
+			return dialer.DialContext(ctx, "unix", apiSock)
+		},
+	}
+}
+
+func New(opt Opt) (*Server, error) {
+	if opt.APISock == "" {
+		return nil, fmt.Errorf("API socket of nydusd is required")
+	}
+	target := &url.URL{Scheme: "http", Host: "unix"}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	transport := NewAPITransport(opt.APISock)
+	proxy.Transport = transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logrus.WithError(err).Warnf("Failed to forward %s %s to nydusd", r.Method, r.URL.Path)
+		http.Error(w, "nydusd is unavailable", http.StatusBadGateway)
+	}
+	return &Server{Opt: opt, proxy: proxy, client: &http.Client{Transport: transport}}, nil
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.Token)) == 1
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The probes are served without auth for kubelet, they don't expose
+	// anything but the health of checks.
+	switch r.URL.Path {
+	case HealthPath:
+		s.serveProbe(w, r, false)
+		return
+	case ReadyPath:
+		s.serveProbe(w, r, true)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, APIPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nydusd"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if s.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "mutating request is disabled", http.StatusForbidden)
+		return
+	}
+	// The token is for the admin server only.
+	r.Header.Del("Authorization")
+	logrus.Debugf("Forward %s %s to nydusd", r.Method, r.URL.Path)
+	s.proxy.ServeHTTP(w, r)
+}
+
+// Listen listens on the address of `host:port` or `unix://<path>`.
+func Listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix://") {
+		path := strings.TrimPrefix(address, "unix://")
+		// Remove the socket left by last run.
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
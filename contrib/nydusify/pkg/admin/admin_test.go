@@ -0,0 +1,99 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNydusd serves the handler on a unix socket in dir.
+func fakeNydusd(t *testing.T, dir string, handler http.Handler) string {
+	sock := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", sock)
+	assert.Nil(t, err)
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return sock
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-admin-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var forwarded []string
+	sock := fakeNydusd(t, dir, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		forwarded = append(forwarded, r.Method+" "+r.URL.RequestURI())
+		w.Write([]byte(`{"state":"RUNNING"}`))
+	}))
+
+	_, err = New(Opt{})
+	assert.NotNil(t, err)
+	server, err := New(Opt{APISock: sock, Token: "secret", ReadOnly: true})
+	assert.Nil(t, err)
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	resp := do(http.MethodGet, "/api/v1/daemon", "secret")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, `{"state":"RUNNING"}`, resp.Body.String())
+	resp = do(http.MethodGet, "/api/v1/metrics?id=/", "secret")
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/daemon", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/v1/daemon", "wrong").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/api/v1/daemon/exit", "secret").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/api/v1/mount?mountpoint=/", "secret").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/debug", "secret").Code)
+	assert.Equal(t, []string{"GET /api/v1/daemon", "GET /api/v1/metrics?id=/"}, forwarded)
+
+	server.ReadOnly = false
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/api/v1/mount?mountpoint=/", "secret").Code)
+	assert.Equal(t, "DELETE /api/v1/mount?mountpoint=/", forwarded[2])
+
+	// Nydusd isn't running.
+	server, err = New(Opt{APISock: filepath.Join(dir, "none.sock")})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadGateway, do(http.MethodGet, "/api/v1/daemon", "").Code)
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-admin-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "admin.sock")
+	listener, err := Listen("unix://" + sock)
+	assert.Nil(t, err)
+	// The stale socket is replaced.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = Listen("unix://" + sock)
+	assert.Nil(t, err)
+	listener.Close()
+
+	listener, err = Listen("127.0.0.1:0")
+	assert.Nil(t, err)
+	listener.Close()
+}
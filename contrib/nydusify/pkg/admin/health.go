@@ -0,0 +1,384 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// HealthPath is the liveness probe, it fails if Nydusd doesn't respond
+	// or the FUSE mountpoint is dead, then Nydusd should be restarted.
+	HealthPath = "/healthz"
+	// ReadyPath is the readiness probe, it also checks the daemon state,
+	// the mount table, the storage backends and the cache disks.
+	ReadyPath = "/readyz"
+
+	defaultProbeTimeout = 5 * time.Second
+)
+
+// Check is the result of a health check.
+type Check struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// Health is the response of probes.
+type Health struct {
+	Healthy bool    `json:"healthy"`
+	State   string  `json:"state,omitempty"`
+	Checks  []Check `json:"checks"`
+}
+
+// daemonInfo is the response of `/api/v1/daemon`, the mounted instances are
+// keyed by mountpoint in backend_collection.
+type daemonInfo struct {
+	State             string `json:"state"`
+	BackendCollection map[string]struct {
+		Config *rafsConfig `json:"config"`
+	} `json:"backend_collection"`
+}
+
+type rafsConfig struct {
+	Device struct {
+		Backend struct {
+			Type   string          `json:"type"`
+			Config json.RawMessage `json:"config"`
+		} `json:"backend"`
+		Cache struct {
+			Type   string `json:"type"`
+			Config struct {
+				WorkDir string `json:"work_dir"`
+			} `json:"config"`
+		} `json:"cache"`
+	} `json:"device"`
+}
+
+type backendConfig struct {
+	// registry
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	// oss, s3, azure and gcs
+	Endpoint    string `json:"endpoint"`
+	Region      string `json:"region"`
+	AccountName string `json:"account_name"`
+	// localfs
+	Dir      string `json:"dir"`
+	BlobFile string `json:"blob_file"`
+	// ipfs, the blobs are read from the fallback registry if the gateway
+	// fails.
+	Gateway  string         `json:"gateway"`
+	Fallback *backendConfig `json:"fallback"`
+	Proxy    struct {
+		URL      string `json:"url"`
+		Fallback *bool  `json:"fallback"`
+	} `json:"proxy"`
+}
+
+func (s *Server) probeTimeout() time.Duration {
+	if s.ProbeTimeout > 0 {
+		return s.ProbeTimeout
+	}
+	return defaultProbeTimeout
+}
+
+func (s *Server) getDaemonInfo(ctx context.Context) (*daemonInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unix"+APIPrefix+"daemon", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request nydusd API")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read nydusd API response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get daemon info: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var info daemonInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, errors.Wrap(err, "unmarshal daemon info")
+	}
+	return &info, nil
+}
+
+// checkInstance checks the instance in mount table is served by Nydusd.
+func (s *Server) checkInstance(ctx context.Context, mountpoint string) error {
+	endpoint := "http://unix" + APIPrefix + "daemon/backend?mountpoint=" + url.QueryEscape(mountpoint)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request nydusd API")
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("instance %s isn't found: %s", mountpoint, resp.Status)
+	}
+	return nil
+}
+
+// withTimeout runs fn in background, since the syscalls on a dead FUSE
+// mountpoint may hang.
+func withTimeout(timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timeout after %s", timeout)
+	}
+}
+
+// checkMountpoint checks the FUSE mountpoint is mounted and responding, a
+// mountpoint left by dead Nydusd fails with ENOTCONN.
+func checkMountpoint(mountpoint string, timeout time.Duration) error {
+	return withTimeout(timeout, func() error {
+		info, err := os.Stat(mountpoint)
+		if err != nil {
+			return err
+		}
+		parent, err := os.Stat(filepath.Dir(mountpoint))
+		if err != nil {
+			return err
+		}
+		if info.Sys().(*syscall.Stat_t).Dev == parent.Sys().(*syscall.Stat_t).Dev {
+			return fmt.Errorf("%s isn't mounted", mountpoint)
+		}
+		return nil
+	})
+}
+
+// backendAddresses returns the `host:port` addresses of backend to dial,
+// the backend is reachable if any of them is. It returns nil for the
+// backends without network address.
+func backendAddresses(backendType string, config backendConfig) []string {
+	hostPort := func(endpoint, defaultScheme string) string {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = defaultScheme + "://" + endpoint
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return ""
+		}
+		if u.Port() != "" {
+			return u.Host
+		}
+		if u.Scheme == "http" {
+			return net.JoinHostPort(u.Hostname(), "80")
+		}
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	var endpoint string
+	switch backendType {
+	case "registry":
+		scheme := config.Scheme
+		if scheme == "" {
+			scheme = "https"
+		}
+		endpoint = hostPort(scheme+"://"+config.Host, "https")
+	case "oss":
+		endpoint = hostPort(config.Endpoint, "https")
+	case "s3":
+		if config.Endpoint != "" {
+			endpoint = hostPort(config.Endpoint, "https")
+		} else if config.Region != "" {
+			endpoint = hostPort(fmt.Sprintf("s3.%s.amazonaws.com", config.Region), "https")
+		}
+	case "azure":
+		if config.Endpoint != "" {
+			endpoint = hostPort(config.Endpoint, "https")
+		} else if config.AccountName != "" {
+			endpoint = hostPort(fmt.Sprintf("%s.blob.core.windows.net", config.AccountName), "https")
+		}
+	case "gcs":
+		if config.Endpoint != "" {
+			endpoint = hostPort(config.Endpoint, "https")
+		} else {
+			endpoint = hostPort("storage.googleapis.com", "https")
+		}
+	case "ipfs":
+		gateway := config.Gateway
+		if gateway == "" {
+			gateway = "http://127.0.0.1:8080"
+		}
+		addresses := []string{}
+		if endpoint := hostPort(gateway, "http"); endpoint != "" {
+			addresses = append(addresses, endpoint)
+		}
+		if config.Fallback != nil {
+			addresses = append(addresses, backendAddresses("registry", *config.Fallback)...)
+		}
+		return addresses
+	default:
+		return nil
+	}
+
+	addresses := []string{}
+	if config.Proxy.URL != "" {
+		if proxy := hostPort(config.Proxy.URL, "http"); proxy != "" {
+			addresses = append(addresses, proxy)
+		}
+		// Nydusd falls back to the backend if proxy is unhealthy, unless
+		// fallback is disabled.
+		if config.Proxy.Fallback != nil && !*config.Proxy.Fallback {
+			return addresses
+		}
+	}
+	if endpoint != "" {
+		addresses = append(addresses, endpoint)
+	}
+	return addresses
+}
+
+func checkBackend(ctx context.Context, backendType string, rawConfig json.RawMessage) error {
+	var config backendConfig
+	if len(rawConfig) > 0 {
+		if err := json.Unmarshal(rawConfig, &config); err != nil {
+			return errors.Wrap(err, "unmarshal backend config")
+		}
+	}
+
+	if backendType == "localfs" {
+		path := config.Dir
+		if config.BlobFile != "" {
+			path = config.BlobFile
+		}
+		_, err := os.Stat(path)
+		return err
+	}
+
+	addresses := backendAddresses(backendType, config)
+	if len(addresses) == 0 {
+		return nil
+	}
+	var err error
+	for _, address := range addresses {
+		var conn net.Conn
+		dialer := &net.Dialer{}
+		if conn, err = dialer.DialContext(ctx, "tcp", address); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return errors.Wrapf(err, "connect %s backend", backendType)
+}
+
+// checkCacheDir checks the cache directory is writable and has enough free
+// space.
+func checkCacheDir(dir string, minFree uint64, timeout time.Duration) error {
+	return withTimeout(timeout, func() error {
+		file, err := ioutil.TempFile(dir, ".nydusify-probe-")
+		if err != nil {
+			return errors.Wrap(err, "write cache directory")
+		}
+		file.Close()
+		os.Remove(file.Name())
+
+		var stat unix.Statfs_t
+		if err := unix.Statfs(dir, &stat); err != nil {
+			return errors.Wrap(err, "stat cache filesystem")
+		}
+		if free := stat.Bavail * uint64(stat.Bsize); free < minFree {
+			return fmt.Errorf("free space %d of cache directory is less than %d", free, minFree)
+		}
+		return nil
+	})
+}
+
+// probe runs the liveness checks, and the readiness checks if ready is true.
+func (s *Server) probe(ctx context.Context, ready bool) Health {
+	ctx, cancel := context.WithTimeout(ctx, s.probeTimeout())
+	defer cancel()
+
+	health := Health{Healthy: true, Checks: []Check{}}
+	add := func(name string, err error) {
+		check := Check{Name: name}
+		if err != nil {
+			health.Healthy = false
+			check.Error = err.Error()
+		}
+		health.Checks = append(health.Checks, check)
+	}
+
+	info, err := s.getDaemonInfo(ctx)
+	add("daemon", err)
+	if info != nil {
+		health.State = info.State
+	}
+	if s.Mountpoint != "" {
+		add("mountpoint", checkMountpoint(s.Mountpoint, s.probeTimeout()))
+	}
+	if !ready || info == nil {
+		return health
+	}
+
+	if info.State != "RUNNING" {
+		add("state", fmt.Errorf("daemon state is %s", info.State))
+	}
+
+	mountpoints := []string{}
+	for mountpoint := range info.BackendCollection {
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	sort.Strings(mountpoints)
+	backends := map[string]bool{}
+	cacheDirs := map[string]bool{}
+	for _, mountpoint := range mountpoints {
+		add("instance:"+mountpoint, s.checkInstance(ctx, mountpoint))
+
+		config := info.BackendCollection[mountpoint].Config
+		if config == nil {
+			continue
+		}
+		backend := config.Device.Backend
+		key := backend.Type + string(backend.Config)
+		if !backends[key] {
+			backends[key] = true
+			add("backend:"+mountpoint, checkBackend(ctx, backend.Type, backend.Config))
+		}
+		if dir := config.Device.Cache.Config.WorkDir; dir != "" && !cacheDirs[dir] {
+			cacheDirs[dir] = true
+			add("cache:"+dir, checkCacheDir(dir, s.MinCacheFree, s.probeTimeout()))
+		}
+	}
+
+	return health
+}
+
+func (s *Server) serveProbe(w http.ResponseWriter, r *http.Request, ready bool) {
+	health := s.probe(r.Context(), ready)
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendAddresses(t *testing.T) {
+	fallback := false
+	for _, c := range []struct {
+		backendType string
+		config      backendConfig
+		addresses   []string
+	}{
+		{"registry", backendConfig{Host: "registry.example.com"}, []string{"registry.example.com:443"}},
+		{"registry", backendConfig{Scheme: "http", Host: "localhost:5000"}, []string{"localhost:5000"}},
+		{"oss", backendConfig{Endpoint: "oss-cn-hangzhou.aliyuncs.com"}, []string{"oss-cn-hangzhou.aliyuncs.com:443"}},
+		{"s3", backendConfig{Region: "us-east-1"}, []string{"s3.us-east-1.amazonaws.com:443"}},
+		{"azure", backendConfig{AccountName: "account"}, []string{"account.blob.core.windows.net:443"}},
+		{"gcs", backendConfig{}, []string{"storage.googleapis.com:443"}},
+		{"localfs", backendConfig{Dir: "/blobs"}, nil},
+		{"ipfs", backendConfig{}, []string{"127.0.0.1:8080"}},
+		{"ipfs", backendConfig{Gateway: "http://ipfs:8081", Fallback: &backendConfig{Host: "registry.example.com"}}, []string{"ipfs:8081", "registry.example.com:443"}},
+	} {
+		assert.Equal(t, c.addresses, backendAddresses(c.backendType, c.config), c.backendType)
+	}
+
+	config := backendConfig{Host: "registry.example.com"}
+	config.Proxy.URL = "http://127.0.0.1:65001"
+	assert.Equal(t, []string{"127.0.0.1:65001", "registry.example.com:443"}, backendAddresses("registry", config))
+	config.Proxy.Fallback = &fallback
+	assert.Equal(t, []string{"127.0.0.1:65001"}, backendAddresses("registry", config))
+}
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-admin-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, "cache")
+	assert.Nil(t, os.Mkdir(cacheDir, 0755))
+
+	registry := httptest.NewServer(http.NotFoundHandler())
+	defer registry.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	closedAddress := closed.Addr().String()
+	closed.Close()
+
+	state := "RUNNING"
+	host := registry.Listener.Addr().String()
+	instances := map[string]bool{"/app": true}
+	sock := fakeNydusd(t, dir, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/daemon":
+			collection := map[string]interface{}{}
+			for mountpoint := range instances {
+				collection[mountpoint] = map[string]interface{}{
+					"backend_type": "Rafs",
+					"mountpoint":   mountpoint,
+					"config": json.RawMessage(fmt.Sprintf(`{"device":{
+						"backend":{"type":"registry","config":{"scheme":"http","host":%q}},
+						"cache":{"type":"blobcache","config":{"work_dir":%q}}}}`, host, cacheDir)),
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"state":              state,
+				"backend_collection": collection,
+			})
+		case "/api/v1/daemon/backend":
+			if !instances[r.URL.Query().Get("mountpoint")] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}))
+
+	server, err := New(Opt{APISock: sock, Token: "secret"})
+	assert.Nil(t, err)
+	probe := func(path string) (int, Health) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		var health Health
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &health))
+		return recorder.Code, health
+	}
+
+	code, health := probe(ReadyPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, health.Healthy)
+	assert.Equal(t, "RUNNING", health.State)
+	assert.Equal(t, []Check{{Name: "daemon"}, {Name: "instance:/app"}, {Name: "backend:/app"}, {Name: "cache:" + cacheDir}}, health.Checks)
+
+	// The backend is unreachable, only readiness fails.
+	host = closedAddress
+	code, health = probe(ReadyPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, health.Healthy)
+	assert.Equal(t, "backend:/app", health.Checks[2].Name)
+	assert.NotEmpty(t, health.Checks[2].Error)
+	code, _ = probe(HealthPath)
+	assert.Equal(t, http.StatusOK, code)
+	host = registry.Listener.Addr().String()
+
+	// The cache disk is full.
+	server.MinCacheFree = 1 << 62
+	code, health = probe(ReadyPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, health.Checks[3].Error, "free space")
+	server.MinCacheFree = 0
+
+	// The instance in mount table isn't served.
+	instances["/lost"] = false
+	code, health = probe(ReadyPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "instance:/lost", health.Checks[4].Name)
+	assert.NotEmpty(t, health.Checks[4].Error)
+	delete(instances, "/lost")
+
+	state = "INIT"
+	code, health = probe(ReadyPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, Check{Name: "state", Error: "daemon state is INIT"}, health.Checks[1])
+	code, _ = probe(HealthPath)
+	assert.Equal(t, http.StatusOK, code)
+
+	// The directory isn't a mountpoint.
+	server.Mountpoint = dir
+	code, health = probe(HealthPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, health.Checks[1].Error, "isn't mounted")
+
+	// Nydusd isn't running.
+	server, err = New(Opt{APISock: filepath.Join(dir, "none.sock")})
+	assert.Nil(t, err)
+	code, health = probe(HealthPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "daemon", health.Checks[0].Name)
+	assert.NotEmpty(t, health.Checks[0].Error)
+}
+
+func TestCheckBackendLocalfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-admin-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, checkBackend(context.Background(), "localfs", json.RawMessage(fmt.Sprintf(`{"dir":%q}`, dir))))
+	assert.NotNil(t, checkBackend(context.Background(), "localfs", json.RawMessage(fmt.Sprintf(`{"dir":%q}`, filepath.Join(dir, "none")))))
+}
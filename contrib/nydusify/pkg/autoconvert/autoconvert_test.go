@@ -0,0 +1,199 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package autoconvert
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/webhook"
+)
+
+func TestParseEvent(t *testing.T) {
+	for _, c := range []struct {
+		event  string
+		images []string
+	}{
+		{`{
+			"type": "PUSH_ARTIFACT",
+			"event_data": {
+				"resources": [
+					{"digest": "sha256:abc", "tag": "v1", "resource_url": "harbor.example.com/library/app:v1"},
+					{"digest": "sha256:def", "tag": "", "resource_url": "harbor.example.com/library/app@sha256:def"}
+				],
+				"repository": {"name": "app", "namespace": "library", "repo_full_name": "library/app"}
+			}
+		}`, []string{"harbor.example.com/library/app:v1"}},
+		{`{"type": "DELETE_ARTIFACT", "event_data": {"resources": [{"tag": "v1", "resource_url": "harbor.example.com/library/app:v1"}]}}`, []string{}},
+		{`{
+			"callback_url": "https://registry.hub.docker.com/u/user/app/hook/abc/",
+			"push_data": {"tag": "latest", "pusher": "user"},
+			"repository": {"repo_name": "user/app", "namespace": "user", "name": "app"}
+		}`, []string{"docker.io/user/app:latest"}},
+		{`{
+			"repository": "org/app",
+			"namespace": "org",
+			"name": "app",
+			"docker_url": "quay.io/org/app",
+			"updated_tags": ["v1", "latest"]
+		}`, []string{"quay.io/org/app:v1", "quay.io/org/app:latest"}},
+	} {
+		images, err := ParseEvent([]byte(c.event))
+		assert.Nil(t, err)
+		assert.Equal(t, c.images, images)
+	}
+
+	_, err := ParseEvent([]byte(`{"events": []}`))
+	assert.NotNil(t, err)
+	_, err = ParseEvent([]byte(`{"push_data": {"tag": "v1"}, "repository": "app"}`))
+	assert.NotNil(t, err)
+}
+
+func TestConfigTarget(t *testing.T) {
+	config := &Config{
+		Rules: []Rule{
+			{Rule: webhook.Rule{Source: "docker.io/user/", Target: "myregistry.com/mirror/", TagSuffix: "-nydus"}, Tags: []string{"v*"}},
+			{Rule: webhook.Rule{Source: "myregistry.com/", TagSuffix: "-nydus"}},
+		},
+	}
+
+	for _, c := range []struct {
+		image  string
+		target string
+	}{
+		{"docker.io/user/app:v1.0", "myregistry.com/mirror/app:v1.0-nydus"},
+		{"docker.io/user/app:latest", ""},
+		{"myregistry.com/app/web:v1", "myregistry.com/app/web:v1-nydus"},
+		// The converted image is pushed to the same repository.
+		{"myregistry.com/app/web:v1-nydus", ""},
+		{"quay.io/app/web:v1", ""},
+	} {
+		target, ok := config.Target(c.image)
+		assert.Equal(t, c.target != "", ok, c.image)
+		assert.Equal(t, c.target, target, c.image)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-autoconvert-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	q, err := OpenQueue(path)
+	assert.Nil(t, err)
+	job1, added, err := q.Enqueue("example.com/app:v1", "example.com/app:v1-nydus", nil)
+	assert.Nil(t, err)
+	assert.True(t, added)
+	// The repeated notification is merged into the pending job.
+	job, added, err := q.Enqueue("example.com/app:v1", "example.com/app:v1-nydus", nil)
+	assert.Nil(t, err)
+	assert.False(t, added)
+	assert.Equal(t, job1.ID, job.ID)
+	job2, _, err := q.Enqueue("example.com/app:v2", "example.com/app:v2-nydus", nil)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	job, err = q.Next(now)
+	assert.Nil(t, err)
+	assert.Equal(t, job1.ID, job.ID)
+	assert.Equal(t, 1, job.Attempts)
+
+	// The same target isn't converted concurrently.
+	job3, added, err := q.Enqueue("example.com/app:v1", "example.com/app:v1-nydus", nil)
+	assert.Nil(t, err)
+	assert.True(t, added)
+	job, err = q.Next(now)
+	assert.Nil(t, err)
+	assert.Equal(t, job2.ID, job.ID)
+	job, err = q.Next(now)
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+
+	// The failed job is retried after backoff.
+	job, err = q.Finish(job2.ID, fmt.Errorf("push failed"), 2, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, JobPending, job.State)
+	assert.Equal(t, "push failed", job.Error)
+	job, err = q.Next(now)
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+	job, err = q.Next(now.Add(2 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, job2.ID, job.ID)
+	job, err = q.Finish(job2.ID, fmt.Errorf("push failed"), 2, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, JobFailed, job.State)
+
+	// The running job is recovered after restart.
+	assert.Nil(t, q.Close())
+	q, err = OpenQueue(path)
+	assert.Nil(t, err)
+	defer q.Close()
+	job, err = q.Next(now)
+	assert.Nil(t, err)
+	assert.Equal(t, job1.ID, job.ID)
+	assert.Equal(t, 2, job.Attempts)
+	job, err = q.Finish(job1.ID, nil, 2, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, JobSucceeded, job.State)
+	job, err = q.Next(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, job3.ID, job.ID)
+
+	jobs, err := q.List()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 3)
+}
+
+func TestService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-autoconvert-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := OpenQueue(filepath.Join(dir, "queue.db"))
+	assert.Nil(t, err)
+	defer q.Close()
+
+	attempts := 0
+	done := make(chan struct{})
+	s := New(Opt{
+		Config: &Config{Rules: []Rule{{Rule: webhook.Rule{Source: "quay.io/", TagSuffix: "-nydus"}}}},
+		Queue:  q,
+		Convert: func(ctx context.Context, job Job) error {
+			attempts++
+			if attempts == 1 {
+				return fmt.Errorf("network error")
+			}
+			close(done)
+			return nil
+		},
+		Workers:     1,
+		MaxAttempts: 3,
+		// Retry immediately.
+		RetryInterval: 0,
+	})
+
+	jobs, err := s.Notify([]byte(`{"docker_url": "quay.io/org/app", "updated_tags": ["v1", "v1-nydus"]}`))
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "quay.io/org/app:v1-nydus", jobs[0].Target)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Run(ctx)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job isn't retried")
+	}
+	cancel()
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package autoconvert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/webhook"
+)
+
+// Rule selects the pushed images to convert, and maps them to the target
+// images in the same way as the rules of admission webhook.
+type Rule struct {
+	webhook.Rule
+	// Tags are the glob patterns (e.g. `v*`) of image tag to convert, all
+	// tags are matched if it's empty.
+	Tags []string `json:"tags"`
+}
+
+// Config is the configuration of auto-conversion service, the first rule
+// matched by the pushed image is applied.
+type Config struct {
+	Rules []Rule `json:"rules"`
+	// ConvertArgs are the extra arguments of `nydusify convert` for all
+	// conversions, e.g. `["--target-insecure", "--compressor", "lz4_block"]`.
+	ConvertArgs []string `json:"convert_args"`
+	// Harbor reads the conversion policies of projects from Harbor, which
+	// override the rules for the notifications of Harbor.
+	Harbor *HarborConfig `json:"harbor"`
+}
+
+// ParseConfigFile loads the configuration from JSON file.
+func ParseConfigFile(configPath string) (*Config, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read config file")
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrap(err, "parse config file")
+	}
+	for idx, rule := range config.Rules {
+		if rule.Target == "" && rule.TagSuffix == "" {
+			return nil, fmt.Errorf("rule %d should specify target or tag_suffix", idx)
+		}
+		for _, pattern := range rule.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d has invalid tag pattern %s", idx, pattern)
+			}
+		}
+	}
+	if config.Harbor != nil && config.Harbor.URL == "" {
+		return nil, fmt.Errorf("harbor should specify url")
+	}
+	return &config, nil
+}
+
+func (rule *Rule) matchTag(tag string) bool {
+	if len(rule.Tags) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Tags {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Target returns the reference of converted image for the pushed image by
+// the first matched rule. The pushed image may be the converted image of
+// another push, it's skipped to avoid converting again and again.
+func (config *Config) Target(image string) (string, bool) {
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return "", false
+	}
+	tagged, ok := named.(docker.Tagged)
+	if !ok {
+		return "", false
+	}
+	name, tag := named.Name(), tagged.Tag()
+
+	for _, rule := range config.Rules {
+		if !strings.HasPrefix(name, rule.Source) || !rule.matchTag(tag) {
+			continue
+		}
+		if rule.Target == "" && strings.HasSuffix(tag, rule.TagSuffix) {
+			return "", false
+		}
+		target := rule.Map(name, tag)
+		if _, err := docker.ParseDockerRef(target); err != nil {
+			return "", false
+		}
+		return target, target != named.String()
+	}
+
+	return "", false
+}
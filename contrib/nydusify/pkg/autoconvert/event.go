@@ -0,0 +1,111 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package autoconvert
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/reference/docker"
+)
+
+// The subset of registry webhook payloads used by the service, a payload
+// is recognized by its distinct fields.
+type event struct {
+	// Harbor: `PUSH_ARTIFACT` (v2) or `pushImage` (v1).
+	Type      string `json:"type"`
+	EventData *struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+	} `json:"event_data"`
+
+	// Docker Hub.
+	PushData *struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	// An object in Docker Hub payload, but a string in Quay payload.
+	Repository json.RawMessage `json:"repository"`
+
+	// Quay.
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+type dockerHubRepository struct {
+	RepoName string `json:"repo_name"`
+}
+
+// pushedImage is a pushed image in webhook payload.
+type pushedImage struct {
+	ref string
+	// The manifest digest, only known for Harbor.
+	digest string
+	harbor bool
+}
+
+// ParseEvent returns the normalized references of pushed images in the
+// webhook payload of Harbor, Docker Hub or Quay. The events other than push
+// are ignored.
+func ParseEvent(data []byte) ([]string, error) {
+	pushed, err := parseEvent(data)
+	if err != nil {
+		return nil, err
+	}
+	images := []string{}
+	for _, image := range pushed {
+		images = append(images, image.ref)
+	}
+	return images, nil
+}
+
+func parseEvent(data []byte) ([]pushedImage, error) {
+	var e event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid event: %s", err)
+	}
+
+	images := []pushedImage{}
+	switch {
+	case e.EventData != nil:
+		if e.Type != "PUSH_ARTIFACT" && e.Type != "pushImage" {
+			return images, nil
+		}
+		for _, resource := range e.EventData.Resources {
+			// The artifact pushed by digest has no tag to convert.
+			if resource.Tag == "" {
+				continue
+			}
+			images = append(images, pushedImage{
+				ref:    resource.ResourceURL,
+				digest: resource.Digest,
+				harbor: true,
+			})
+		}
+	case e.PushData != nil:
+		var repo dockerHubRepository
+		if err := json.Unmarshal(e.Repository, &repo); err != nil || repo.RepoName == "" {
+			return nil, fmt.Errorf("invalid Docker Hub event: no repository")
+		}
+		images = append(images, pushedImage{ref: "docker.io/" + repo.RepoName + ":" + e.PushData.Tag})
+	case e.DockerURL != "":
+		for _, tag := range e.UpdatedTags {
+			images = append(images, pushedImage{ref: e.DockerURL + ":" + tag})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported event")
+	}
+
+	for idx, image := range images {
+		named, err := docker.ParseDockerRef(image.ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image %s in event: %s", image.ref, err)
+		}
+		images[idx].ref = named.String()
+	}
+	return images, nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package autoconvert
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tlsconfig"
+)
+
+const (
+	// The annotations by which Harbor (v2.7 or later) registers the pushed
+	// Nydus manifest as the `build.nydus` accessory of source artifact in
+	// the same repository.
+	harborAnnotationDriverName   = "io.goharbor.artifact.v1alpha1.acceleration.driver.name"
+	harborAnnotationSourceDigest = "io.goharbor.artifact.v1alpha1.acceleration.source.digest"
+
+	defaultHarborLabelPrefix = "nydus."
+	defaultHarborTagSuffix   = "-nydus"
+	harborLabelPageSize      = 100
+)
+
+// HarborConfig is the Harbor API to read the conversion policies of
+// projects from the project labels, the label name is the policy key with
+// LabelPrefix and the label description is the value:
+//
+//   - `nydus.convert`: enables the conversion of the project.
+//   - `nydus.repositories`: comma-separated glob patterns of repository names
+//     in project to convert, all repositories if unset.
+//   - `nydus.tags`: comma-separated glob patterns of tags to convert, all tags
+//     if unset.
+//   - `nydus.target-project`: pushes the converted images to the repository
+//     of same name in the project, the same repository if unset.
+//   - `nydus.tag-suffix`: appended to the tag of converted image, defaults to
+//     `-nydus` if target-project is unset.
+type HarborConfig struct {
+	URL string `json:"url"`
+	// Username and Password of the account (e.g. a robot account) which can
+	// read the labels of projects.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Insecure skips the certificate verification of Harbor API.
+	Insecure bool `json:"insecure"`
+	// LabelPrefix defaults to `nydus.`.
+	LabelPrefix string `json:"label_prefix"`
+}
+
+// ProjectPolicy is the conversion policy of Harbor project.
+type ProjectPolicy struct {
+	Repositories  []string
+	Tags          []string
+	TargetProject string
+	TagSuffix     string
+}
+
+// Harbor is the client of Harbor API.
+type Harbor struct {
+	config HarborConfig
+	client *http.Client
+}
+
+type harborProject struct {
+	ProjectID int64 `json:"project_id"`
+}
+
+type harborLabel struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func NewHarbor(config HarborConfig) (*Harbor, error) {
+	apiURL, err := url.Parse(config.URL)
+	if err != nil || (apiURL.Scheme != "http" && apiURL.Scheme != "https") || apiURL.Host == "" {
+		return nil, fmt.Errorf("invalid Harbor URL %s", config.URL)
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.LabelPrefix == "" {
+		config.LabelPrefix = defaultHarborLabelPrefix
+	}
+
+	transport := proxy.Transport(nil)
+	if config.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &Harbor{
+		config: config,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: tlsconfig.Transport(transport),
+		},
+	}, nil
+}
+
+func (h *Harbor) get(ctx context.Context, apiPath string, query url.Values, v interface{}) error {
+	apiURL := h.config.URL + "/api/v2.0" + apiPath
+	if len(query) > 0 {
+		apiURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	// The project name may be numeric.
+	req.Header.Set("X-Is-Resource-Name", "true")
+	if h.config.Username != "" {
+		req.SetBasicAuth(h.config.Username, h.config.Password)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request Harbor API")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "read Harbor API response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s from Harbor: %s %s", apiPath, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return errors.Wrapf(json.Unmarshal(body, v), "unmarshal %s", apiPath)
+}
+
+// labels returns the project-scoped labels of project.
+func (h *Harbor) labels(ctx context.Context, project string) ([]harborLabel, error) {
+	var p harborProject
+	if err := h.get(ctx, "/projects/"+url.PathEscape(project), nil, &p); err != nil {
+		return nil, err
+	}
+
+	labels := []harborLabel{}
+	for page := 1; ; page++ {
+		var pageLabels []harborLabel
+		if err := h.get(ctx, "/labels", url.Values{
+			"scope":      {"p"},
+			"project_id": {fmt.Sprintf("%d", p.ProjectID)},
+			"page":       {fmt.Sprintf("%d", page)},
+			"page_size":  {fmt.Sprintf("%d", harborLabelPageSize)},
+		}, &pageLabels); err != nil {
+			return nil, err
+		}
+		labels = append(labels, pageLabels...)
+		if len(pageLabels) < harborLabelPageSize {
+			return labels, nil
+		}
+	}
+}
+
+func splitPatterns(value string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// parseProjectPolicy returns the policy in labels, or nil if the convert
+// label isn't attached.
+func parseProjectPolicy(prefix string, labels []harborLabel) (*ProjectPolicy, error) {
+	values := map[string]string{}
+	for _, label := range labels {
+		if strings.HasPrefix(label.Name, prefix) {
+			values[strings.TrimPrefix(label.Name, prefix)] = strings.TrimSpace(label.Description)
+		}
+	}
+	if _, ok := values["convert"]; !ok {
+		return nil, nil
+	}
+
+	policy := &ProjectPolicy{
+		Repositories:  splitPatterns(values["repositories"]),
+		Tags:          splitPatterns(values["tags"]),
+		TargetProject: values["target-project"],
+	}
+	for _, pattern := range append(policy.Repositories, policy.Tags...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s in label", pattern)
+		}
+	}
+	if suffix, ok := values["tag-suffix"]; ok {
+		policy.TagSuffix = suffix
+	} else if policy.TargetProject == "" {
+		policy.TagSuffix = defaultHarborTagSuffix
+	}
+	return policy, nil
+}
+
+// splitHarborImage splits the normalized image reference into Harbor
+// project and repository name in project.
+func splitHarborImage(image string) (docker.Named, string, string, error) {
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return nil, "", "", err
+	}
+	parts := strings.SplitN(docker.Path(named), "/", 2)
+	if len(parts) != 2 {
+		return nil, "", "", fmt.Errorf("image %s isn't in Harbor project", image)
+	}
+	return named, parts[0], parts[1], nil
+}
+
+// Policy returns the conversion policy of the Harbor project of pushed
+// image, it's nil if the project doesn't enable conversion.
+func (h *Harbor) Policy(image string) (*ProjectPolicy, error) {
+	_, project, _, err := splitHarborImage(image)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := h.labels(context.Background(), project)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get labels of Harbor project %s", project)
+	}
+	policy, err := parseProjectPolicy(h.config.LabelPrefix, labels)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse policy of Harbor project %s", project)
+	}
+	return policy, nil
+}
+
+func matchPatterns(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Target returns the source pinned by digest, the target and the target
+// annotations of the pushed image, it's false if the image isn't converted
+// by policy. The converted image pushed to the same repository is
+// registered as the accessory of source artifact.
+func (policy *ProjectPolicy) Target(image, digest string) (string, string, map[string]string, bool) {
+	named, project, repo, err := splitHarborImage(image)
+	if err != nil {
+		return "", "", nil, false
+	}
+	tagged, ok := named.(docker.Tagged)
+	if !ok {
+		return "", "", nil, false
+	}
+	tag := tagged.Tag()
+	if !matchPatterns(policy.Repositories, repo) || !matchPatterns(policy.Tags, tag) {
+		return "", "", nil, false
+	}
+
+	targetProject := project
+	if policy.TargetProject != "" {
+		targetProject = policy.TargetProject
+	}
+	sameRepo := targetProject == project
+	// The converted image is pushed to the same repository.
+	if sameRepo && (policy.TagSuffix == "" || strings.HasSuffix(tag, policy.TagSuffix)) {
+		return "", "", nil, false
+	}
+	target := docker.Domain(named) + "/" + targetProject + "/" + repo + ":" + tag + policy.TagSuffix
+	if _, err := docker.ParseDockerRef(target); err != nil {
+		return "", "", nil, false
+	}
+
+	source := named.String()
+	var annotations map[string]string
+	if _, err := godigest.Parse(digest); err == nil {
+		// Pin the pushed manifest, the tag may be pushed again before the
+		// conversion.
+		source = named.Name() + "@" + digest
+		if sameRepo {
+			annotations = map[string]string{
+				harborAnnotationDriverName:   "nydus",
+				harborAnnotationSourceDigest: digest,
+			}
+		}
+	}
+	return source, target, annotations, true
+}
@@ -0,0 +1,139 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package autoconvert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/webhook"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestProjectPolicyTarget(t *testing.T) {
+	policy, err := parseProjectPolicy("nydus.", []harborLabel{{Name: "prod"}})
+	assert.Nil(t, err)
+	assert.Nil(t, policy)
+	_, err = parseProjectPolicy("nydus.", []harborLabel{{Name: "nydus.convert"}, {Name: "nydus.tags", Description: "v[1"}})
+	assert.NotNil(t, err)
+
+	policy, err = parseProjectPolicy("nydus.", []harborLabel{
+		{Name: "nydus.convert"},
+		{Name: "nydus.repositories", Description: "app, team/*"},
+		{Name: "nydus.tags", Description: "v*"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "-nydus", policy.TagSuffix)
+
+	source, target, annotations, ok := policy.Target("harbor.corp/library/app:v1", testDigest)
+	assert.True(t, ok)
+	assert.Equal(t, "harbor.corp/library/app@"+testDigest, source)
+	assert.Equal(t, "harbor.corp/library/app:v1-nydus", target)
+	assert.Equal(t, map[string]string{
+		harborAnnotationDriverName:   "nydus",
+		harborAnnotationSourceDigest: testDigest,
+	}, annotations)
+
+	for _, image := range []string{
+		"harbor.corp/library/app:latest",
+		"harbor.corp/library/web:v1",
+		// The converted image is pushed to the same repository.
+		"harbor.corp/library/app:v1-nydus",
+	} {
+		_, _, _, ok := policy.Target(image, testDigest)
+		assert.False(t, ok, image)
+	}
+
+	policy, err = parseProjectPolicy("nydus.", []harborLabel{
+		{Name: "nydus.convert"},
+		{Name: "nydus.target-project", Description: "nydus"},
+	})
+	assert.Nil(t, err)
+	source, target, annotations, ok = policy.Target("harbor.corp/library/team/web:v1", "")
+	assert.True(t, ok)
+	assert.Equal(t, "harbor.corp/library/team/web:v1", source)
+	assert.Equal(t, "harbor.corp/nydus/team/web:v1", target)
+	assert.Nil(t, annotations)
+}
+
+func TestHarborService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ := r.BasicAuth()
+		if username != "robot$nydusify" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var v interface{}
+		switch {
+		case r.URL.Path == "/api/v2.0/projects/library":
+			v = harborProject{ProjectID: 1}
+		case r.URL.Path == "/api/v2.0/projects/public":
+			v = harborProject{ProjectID: 2}
+		case r.URL.Path == "/api/v2.0/labels" && r.URL.Query().Get("project_id") == "1":
+			v = []harborLabel{{Name: "nydus.convert"}, {Name: "nydus.tag-suffix", Description: "-accel"}}
+		case r.URL.Path == "/api/v2.0/labels":
+			v = []harborLabel{}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "nydusify-autoconvert-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	q, err := OpenQueue(filepath.Join(dir, "queue.db"))
+	assert.Nil(t, err)
+	defer q.Close()
+
+	harbor, err := NewHarbor(HarborConfig{URL: server.URL + "/", Username: "robot$nydusify", Password: "secret"})
+	assert.Nil(t, err)
+	s := New(Opt{
+		Config: &Config{Rules: []Rule{{Rule: webhook.Rule{Source: "harbor.corp/public/", Target: "harbor.corp/mirror/"}}}},
+		Harbor: harbor,
+		Queue:  q,
+	})
+
+	jobs, err := s.Notify([]byte(`{
+		"type": "PUSH_ARTIFACT",
+		"event_data": {
+			"resources": [{"digest": "` + testDigest + `", "tag": "v1", "resource_url": "harbor.corp/library/app:v1"}]
+		}
+	}`))
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "harbor.corp/library/app@"+testDigest, jobs[0].Source)
+	assert.Equal(t, "harbor.corp/library/app:v1-accel", jobs[0].Target)
+	assert.Equal(t, testDigest, jobs[0].Annotations[harborAnnotationSourceDigest])
+
+	// The project without convert label falls back to the rules.
+	jobs, err = s.Notify([]byte(`{
+		"type": "PUSH_ARTIFACT",
+		"event_data": {
+			"resources": [{"digest": "` + testDigest + `", "tag": "v1", "resource_url": "harbor.corp/public/app:v1"}]
+		}
+	}`))
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "harbor.corp/public/app:v1", jobs[0].Source)
+	assert.Equal(t, "harbor.corp/mirror/app:v1", jobs[0].Target)
+	assert.Nil(t, jobs[0].Annotations)
+
+	_, err = s.Notify([]byte(`{
+		"type": "PUSH_ARTIFACT",
+		"event_data": {"resources": [{"tag": "v1", "resource_url": "harbor.corp/unknown/app:v1"}]}
+	}`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,235 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package autoconvert
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Job ID (big endian) -> JSON of `Job`.
+var bucketJobs = []byte("jobs")
+
+type JobState string
+
+const (
+	JobPending   JobState = "pending"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// Job is the conversion of a pushed image.
+type Job struct {
+	ID     uint64 `json:"id"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Annotations are added to the target manifest, e.g. to register it
+	// as an accessory of source image in Harbor.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	State       JobState          `json:"state"`
+	Attempts    int               `json:"attempts"`
+	// Error of the last attempt.
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// The pending job isn't run before NextAt for retry backoff.
+	NextAt time.Time `json:"next_at"`
+}
+
+// Queue is the persistent job queue backed by bbolt, the jobs are run in
+// the order of creation.
+type Queue struct {
+	db *bolt.DB
+}
+
+func jobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func putJob(bucket *bolt.Bucket, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(jobKey(job.ID), data)
+}
+
+func forEachJob(bucket *bolt.Bucket, fn func(job *Job) error) error {
+	return bucket.ForEach(func(k, v []byte) error {
+		var job Job
+		if err := json.Unmarshal(v, &job); err != nil {
+			return errors.Wrapf(err, "unmarshal job %d", binary.BigEndian.Uint64(k))
+		}
+		return fn(&job)
+	})
+}
+
+// OpenQueue opens or creates the queue file, the jobs interrupted by last
+// exit of service are pending again.
+func OpenQueue(path string) (*Queue, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 30 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open job queue %s", path)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketJobs)
+		if err != nil {
+			return err
+		}
+		return forEachJob(bucket, func(job *Job) error {
+			if job.State != JobRunning {
+				return nil
+			}
+			job.State = JobPending
+			return putJob(bucket, job)
+		})
+	}); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "recover jobs")
+	}
+	return &Queue{db: db}, nil
+}
+
+// Close closes the queue.
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
+
+// Enqueue adds a pending job to convert source to target with the target
+// manifest annotations. It returns false if the same conversion is pending
+// already, so the repeated notifications are merged.
+func (q *Queue) Enqueue(source, target string, annotations map[string]string) (*Job, bool, error) {
+	var job *Job
+	added := false
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketJobs)
+		if err := forEachJob(bucket, func(j *Job) error {
+			if j.State == JobPending && j.Source == source && j.Target == target {
+				job = j
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if job != nil {
+			return nil
+		}
+
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		job = &Job{
+			ID:          id,
+			Source:      source,
+			Target:      target,
+			Annotations: annotations,
+			State:       JobPending,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+			NextAt:      now,
+		}
+		added = true
+		return putJob(bucket, job)
+	})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "enqueue job")
+	}
+	return job, added, nil
+}
+
+// Next marks the earliest pending job due at now as running and returns
+// it, or nil if there is no such job. A job isn't run concurrently with
+// another job pushing the same target.
+func (q *Queue) Next(now time.Time) (*Job, error) {
+	var next *Job
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketJobs)
+		running := map[string]bool{}
+		pending := []*Job{}
+		if err := forEachJob(bucket, func(job *Job) error {
+			switch job.State {
+			case JobRunning:
+				running[job.Target] = true
+			case JobPending:
+				pending = append(pending, job)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, job := range pending {
+			if running[job.Target] || job.NextAt.After(now) {
+				continue
+			}
+			job.State = JobRunning
+			job.Attempts++
+			job.UpdatedAt = now
+			next = job
+			return putJob(bucket, job)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get next job")
+	}
+	return next, nil
+}
+
+// Finish records the result of running job. The failed job is pending
+// again after the backoff, which starts from interval and doubles for each
+// attempt, until it has been attempted maxAttempts times.
+func (q *Queue) Finish(id uint64, result error, maxAttempts int, interval time.Duration) (*Job, error) {
+	var job *Job
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketJobs)
+		data := bucket.Get(jobKey(id))
+		if data == nil {
+			return errors.Errorf("job %d not found", id)
+		}
+		job = &Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return errors.Wrapf(err, "unmarshal job %d", id)
+		}
+
+		job.UpdatedAt = time.Now()
+		if result == nil {
+			job.State = JobSucceeded
+			job.Error = ""
+		} else {
+			job.Error = result.Error()
+			job.State = JobFailed
+			if job.Attempts < maxAttempts {
+				job.State = JobPending
+				job.NextAt = job.UpdatedAt.Add(interval << uint(job.Attempts-1))
+			}
+		}
+		return putJob(bucket, job)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "finish job")
+	}
+	return job, nil
+}
+
+// List returns all jobs in the order of creation.
+func (q *Queue) List() ([]Job, error) {
+	jobs := []Job{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return forEachJob(tx.Bucket(bucketJobs), func(job *Job) error {
+			jobs = append(jobs, *job)
+			return nil
+		})
+	})
+	return jobs, err
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package autoconvert implements a long-running service which receives the
+// push notifications of registry webhook, and converts the newly pushed
+// images matching the configured rules to Nydus images by a persistent job
+// queue, so that the Nydus images follow the source images without a CI
+// pipeline.
+package autoconvert
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The interval to check the jobs due for retry.
+const pollInterval = 5 * time.Second
+
+// ConvertFunc converts the source image of job and pushes it to target.
+type ConvertFunc func(ctx context.Context, job Job) error
+
+// ExecConvert returns a ConvertFunc which runs `nydusify convert` by the
+// binary in a separate process for each job, with the work directory and
+// output log in workDir. The work directory is kept for failed job, so
+// the retry resumes from the checkpoint of last attempt.
+func ExecConvert(binary, workDir string, args []string) ConvertFunc {
+	return func(ctx context.Context, job Job) error {
+		jobDir := filepath.Join(workDir, fmt.Sprintf("job-%d", job.ID))
+		logPath := jobDir + ".log"
+		logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "create job log")
+		}
+		defer logFile.Close()
+
+		cmdArgs := []string{
+			"convert",
+			"--source", job.Source,
+			"--target", job.Target,
+			"--work-dir", jobDir,
+		}
+		keys := []string{}
+		for key := range job.Annotations {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			cmdArgs = append(cmdArgs, "--annotation", key+"="+job.Annotations[key])
+		}
+		cmd := exec.CommandContext(ctx, binary, append(cmdArgs, args...)...)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "run convert, see %s", logPath)
+		}
+		return os.RemoveAll(jobDir)
+	}
+}
+
+type Opt struct {
+	Config *Config
+	// Harbor applies the project policies to Harbor notifications if it's
+	// set.
+	Harbor  *Harbor
+	Queue   *Queue
+	Convert ConvertFunc
+	// Secret authorizes the notifications by `Authorization` header or
+	// `secret` query parameter, no authorization if it's empty.
+	Secret string
+	// Workers is the number of concurrent conversions.
+	Workers int
+	// MaxAttempts is the maximum attempts of a job, the failed attempts
+	// are retried after backoff from RetryInterval.
+	MaxAttempts   int
+	RetryInterval time.Duration
+}
+
+// Service serves the registry webhook notifications, and runs the queued
+// conversions.
+type Service struct {
+	Opt
+	// Wakes up an idle worker once a job is queued.
+	wake chan struct{}
+}
+
+func New(opt Opt) *Service {
+	return &Service{
+		Opt:  opt,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (s *Service) authorized(r *http.Request) bool {
+	if s.Secret == "" {
+		return true
+	}
+	for _, secret := range []string{r.Header.Get("Authorization"), r.URL.Query().Get("secret")} {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(s.Secret)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify queues the conversions of the pushed images in webhook payload,
+// the images not matched by rules are ignored.
+func (s *Service) Notify(data []byte) ([]Job, error) {
+	images, err := parseEvent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []Job{}
+	for _, image := range images {
+		source, target, annotations, ok, err := s.target(image)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			logrus.Debugf("Ignore pushed image %s", image.ref)
+			continue
+		}
+		job, added, err := s.Queue.Enqueue(source, target, annotations)
+		if err != nil {
+			return nil, err
+		}
+		if added {
+			logrus.Infof("Queued job %d to convert %s to %s", job.ID, source, target)
+		}
+		jobs = append(jobs, *job)
+	}
+	if len(jobs) > 0 {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return jobs, nil
+}
+
+// target returns the source, target and target annotations of conversion
+// for the pushed image. The policy of Harbor project is applied to Harbor
+// notification if the project enables conversion, otherwise the rules.
+func (s *Service) target(image pushedImage) (string, string, map[string]string, bool, error) {
+	if image.harbor && s.Harbor != nil {
+		policy, err := s.Harbor.Policy(image.ref)
+		if err != nil {
+			return "", "", nil, false, err
+		}
+		if policy != nil {
+			source, target, annotations, ok := policy.Target(image.ref, image.digest)
+			return source, target, annotations, ok, nil
+		}
+	}
+	target, ok := s.Config.Target(image.ref)
+	return image.ref, target, nil, ok, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ServeHTTP receives the webhook notifications, it responds the queued
+// jobs.
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jobs, err := s.Notify(data)
+	if err != nil {
+		logrus.Warnf("Handle webhook notification: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobs)
+}
+
+// ServeJobs lists all jobs in queue.
+func (s *Service) ServeJobs(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	jobs, err := s.Queue.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *Service) runJob(ctx context.Context, job *Job) {
+	logrus.Infof("Running job %d (attempt %d) to convert %s to %s", job.ID, job.Attempts, job.Source, job.Target)
+	err := s.Convert(ctx, *job)
+	if ctx.Err() != nil {
+		// The job is interrupted by shutdown, it keeps running state in
+		// queue and is pending again on next start.
+		return
+	}
+
+	finished, ferr := s.Queue.Finish(job.ID, err, s.MaxAttempts, s.RetryInterval)
+	if ferr != nil {
+		logrus.Errorf("Record result of job %d: %s", job.ID, ferr)
+		return
+	}
+	switch finished.State {
+	case JobSucceeded:
+		logrus.Infof("Job %d succeeded", job.ID)
+	case JobPending:
+		logrus.Warnf("Job %d failed, retry at %s: %s", job.ID, finished.NextAt.Format(time.RFC3339), err)
+	default:
+		logrus.Errorf("Job %d failed after %d attempts: %s", job.ID, finished.Attempts, err)
+	}
+}
+
+func (s *Service) worker(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		job, err := s.Queue.Next(time.Now())
+		if err != nil {
+			logrus.Errorf("Get next job: %s", err)
+		}
+		if job != nil {
+			s.runJob(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run runs the queued jobs by workers until ctx is done.
+func (s *Service) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.worker(ctx)
+		}()
+	}
+	wg.Wait()
+}
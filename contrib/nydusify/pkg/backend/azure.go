@@ -0,0 +1,434 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+)
+
+const (
+	azureAPIVersion = "2020-10-02"
+	// Azure instance metadata service, used to get access token of managed identity.
+	azureMetadataEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureStorageResource  = "https://storage.azure.com/"
+	// Block size for Put Block, the maximum block count of one blob is 50000.
+	azureBlockSize = 64 * 1024 * 1024
+
+	azureDefaultTimeout = 5 * time.Minute
+)
+
+type AzureConfig struct {
+	// Default to `https://$account_name.blob.core.windows.net`.
+	Endpoint      string `json:"endpoint"`
+	AccountName   string `json:"account_name"`
+	ContainerName string `json:"container_name"`
+	ObjectPrefix  string `json:"object_prefix"`
+	// Shared access signature, with or without the leading `?`.
+	SASToken string `json:"sas_token"`
+	// Use the managed identity of Azure VM or AKS pod identity if no SAS token
+	// is specified, `client_id` selects a user-assigned identity.
+	ClientID string `json:"client_id"`
+	// Timeout in seconds for each request.
+	Timeout int `json:"timeout"`
+	// Proxy overrides the default proxy for requests to container.
+	proxy.Config
+	// TransportConfig tunes the connections to container.
+	TransportConfig
+}
+
+type azureToken struct {
+	value      string
+	expiration time.Time
+}
+
+type Azure struct {
+	endpoint      string
+	containerName string
+	objectPrefix  string
+	sasQuery      url.Values
+	clientID      string
+	client        *http.Client
+
+	mu    sync.Mutex
+	token *azureToken
+}
+
+func newAzureBackend(rawConfig []byte) (*Azure, error) {
+	var config AzureConfig
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return nil, errors.Wrap(err, "Parse Azure storage backend configuration")
+	}
+
+	if config.ContainerName == "" {
+		return nil, fmt.Errorf("no container is specified")
+	}
+	if config.Endpoint == "" {
+		if config.AccountName == "" {
+			return nil, fmt.Errorf("no endpoint or account is specified")
+		}
+		config.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", config.AccountName)
+	}
+
+	var sasQuery url.Values
+	if config.SASToken != "" {
+		query, err := url.ParseQuery(strings.TrimPrefix(config.SASToken, "?"))
+		if err != nil {
+			return nil, errors.Wrap(err, "Parse SAS token")
+		}
+		sasQuery = query
+	}
+
+	timeout := azureDefaultTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+
+	proxyConfig, err := proxy.BackendConfig(config.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse Azure storage backend proxy")
+	}
+	client := newHTTPClient(proxyConfig, config.TransportConfig, timeout)
+
+	return &Azure{
+		endpoint:      strings.TrimSuffix(config.Endpoint, "/"),
+		containerName: config.ContainerName,
+		objectPrefix:  config.ObjectPrefix,
+		sasQuery:      sasQuery,
+		clientID:      config.ClientID,
+		client:        client,
+	}, nil
+}
+
+// getToken gets access token of managed identity from instance
+// metadata service, refresh it 5 minutes before expiration.
+func (b *Azure) getToken(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.token != nil && time.Until(b.token.expiration) > 5*time.Minute {
+		return b.token.value, nil
+	}
+
+	query := url.Values{
+		"api-version": []string{"2018-02-01"},
+		"resource":    []string{azureStorageResource},
+	}
+	if b.clientID != "" {
+		query.Set("client_id", b.clientID)
+	}
+	endpoint := azureMetadataEndpoint
+	if env := os.Getenv("AZURE_METADATA_ENDPOINT"); env != "" {
+		endpoint = env
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "get managed identity token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get managed identity token: unexpected status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "decode managed identity token")
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", errors.Wrap(err, "parse managed identity token expiration")
+	}
+	b.token = &azureToken{
+		value:      token.AccessToken,
+		expiration: time.Unix(expiresOn, 0),
+	}
+
+	return b.token.value, nil
+}
+
+func (b *Azure) blobURL(key string, query url.Values) string {
+	merged := url.Values{}
+	for k, v := range b.sasQuery {
+		merged[k] = v
+	}
+	for k, v := range query {
+		merged[k] = v
+	}
+	// The empty key is for container operations.
+	u := fmt.Sprintf("%s/%s", b.endpoint, b.containerName)
+	if key != "" {
+		u += "/" + key
+	}
+	if len(merged) > 0 {
+		u += "?" + merged.Encode()
+	}
+	return u
+}
+
+// do sends the request, `body` is called to get the request body. Failed
+// requests are retried by the Retrier of caller.
+func (b *Azure) do(
+	ctx context.Context, method, key string, query url.Values, header http.Header, body func() (io.ReadCloser, int64, error),
+) (*http.Response, error) {
+	var reader io.ReadCloser
+	var size int64
+	if body != nil {
+		var err error
+		if reader, size, err = body(); err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.blobURL(key, query), reader)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+
+	if b.sasQuery == nil {
+		token, err := b.getToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		err := fmt.Errorf("%s %s: unexpected status %d: %s", method, key, resp.StatusCode, string(msg))
+		// Only network error and server side error are retryable.
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			err = Permanent(err)
+		}
+		return resp, err
+	}
+
+	return resp, nil
+}
+
+func fileSection(path string, offset, size int64) func() (io.ReadCloser, int64, error) {
+	return func() (io.ReadCloser, int64, error) {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(file, offset, size), file}, size, nil
+	}
+}
+
+type azureBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+func (b *Azure) putBlockList(ctx context.Context, key, blobPath string, size int64) error {
+	var blockIDs []string
+	g, gctx := errgroup.WithContext(ctx)
+	// Limit the concurrency of block uploading.
+	sem := make(chan struct{}, splitPartsCount)
+
+	for offset, idx := int64(0), 0; offset < size; offset, idx = offset+azureBlockSize, idx+1 {
+		length := int64(azureBlockSize)
+		if offset+length > size {
+			length = size - offset
+		}
+		// All block IDs of a blob must have the same length.
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", idx)))
+		blockIDs = append(blockIDs, blockID)
+		query := url.Values{
+			"comp":    []string{"block"},
+			"blockid": []string{blockID},
+		}
+		body := fileSection(blobPath, offset, length)
+
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			resp, err := b.do(gctx, http.MethodPut, key, query, nil, body)
+			if err != nil {
+				return errors.Wrapf(err, "put block %s", blockID)
+			}
+			resp.Body.Close()
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return errors.Wrap(err, "Uploading blocks failed")
+	}
+
+	blockList, err := xml.Marshal(azureBlockList{Latest: blockIDs})
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, http.MethodPut, key, url.Values{"comp": []string{"blocklist"}}, nil,
+		func() (io.ReadCloser, int64, error) {
+			return ioutil.NopCloser(bytes.NewReader(blockList)), int64(len(blockList)), nil
+		})
+	if err != nil {
+		return errors.Wrap(err, "put block list")
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Upload blob as image layer to Azure Blob Storage. Depending on blob's size,
+// upload it by a single Put Blob request or by Put Block/Put Block List.
+func (b *Azure) Upload(ctx context.Context, blobID, blobPath string, size int64, forcePush bool) (*ocispec.Descriptor, error) {
+	blobObjectKey := b.objectPrefix + blobID
+
+	desc := blobDesc(size, blobID)
+
+	if !forcePush {
+		if exist, err := b.Check(blobID); err != nil {
+			return nil, err
+		} else if exist {
+			logger.Infof("Skip upload because blob exists: %s", blobID)
+			return &desc, nil
+		}
+	}
+
+	stat, err := os.Stat(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	blobSize := stat.Size()
+
+	start := time.Now()
+	if blobSize >= multipartsUploadThreshold {
+		logger.Debugf("Upload %s using block list method", blobObjectKey)
+		if err := b.putBlockList(ctx, blobObjectKey, blobPath, blobSize); err != nil {
+			return nil, err
+		}
+	} else {
+		header := http.Header{}
+		header.Set("x-ms-blob-type", "BlockBlob")
+		resp, err := b.do(ctx, http.MethodPut, blobObjectKey, nil, header, fileSection(blobPath, 0, blobSize))
+		if err != nil {
+			return nil, errors.Wrap(err, "put blob")
+		}
+		resp.Body.Close()
+	}
+	logger.Debugf("Uploading blob %s costs %s", blobObjectKey, time.Since(start))
+
+	return &desc, nil
+}
+
+func (b *Azure) Check(blobID string) (bool, error) {
+	resp, err := b.do(context.Background(), http.MethodHead, b.objectPrefix+blobID, nil, nil, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (b *Azure) Type() Type {
+	return AzureBackend
+}
+
+type azureEnumerationResults struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (b *Azure) List(ctx context.Context) ([]BlobObject, error) {
+	blobs := []BlobObject{}
+	query := url.Values{
+		"restype":   []string{"container"},
+		"comp":      []string{"list"},
+		"prefix":    []string{b.objectPrefix},
+		"delimiter": []string{"/"},
+	}
+	for {
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "list blobs")
+		}
+		var result azureEnumerationResults
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "decode list blobs response")
+		}
+		for _, object := range result.Blobs {
+			id, ok := blobIDFromKey(b.objectPrefix, object.Name)
+			if !ok {
+				continue
+			}
+			lastModified, err := http.ParseTime(object.Properties.LastModified)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse last modified time of blob %s", object.Name)
+			}
+			blobs = append(blobs, BlobObject{ID: id, Size: object.Properties.ContentLength, LastModified: lastModified})
+		}
+		if result.NextMarker == "" {
+			return blobs, nil
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
+
+func (b *Azure) Delete(ctx context.Context, blobID string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.objectPrefix+blobID, nil, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "delete blob")
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -8,16 +8,25 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+var logger = logging.Module(logging.ModuleBackend)
+
 // Backend transers artifacts generated during image conversion to a backend storage such as:
 //		1. registry: complying to OCI distribution specification, push blob file
 //		   to registry and use the registry as a storage.
 //		2. oss: A object storage backend, which uses its SDK to transer blob file.
+//		3. s3: An AWS S3 (or S3 compatible) object storage backend.
+//		4. azure: Azure Blob Storage, authenticated by SAS token or managed identity.
+//		5. gcs: Google Cloud Storage, authenticated by Application Default Credentials.
+//		6. localfs: A local or NFS directory, blobs are sharded by digest prefix.
+//		7. external: A helper binary speaking a stdio JSON protocol, for proprietary storage.
+//		8. ipfs: Add blobs to an IPFS node by CIDs, and push them to registry as fallback.
 type Backend interface {
 	// TODO: Hopefully, we can pass `Layer` struct in, thus to be able to cook both
 	// file handle and file path.
@@ -33,8 +42,30 @@ type Type = int
 const (
 	OssBackend Type = iota
 	RegistryBackend
+	S3Backend
+	AzureBackend
+	GCSBackend
+	LocalFSBackend
+	ExternalBackend
+	IPFSBackend
 )
 
+var typeNames = []string{"oss", "registry", "s3", "azure", "gcs", "localfs", "external", "ipfs"}
+
+// TypeName returns the name of backend type accepted by NewBackend.
+func TypeName(t Type) string {
+	if t < 0 || t >= len(typeNames) {
+		return "unknown"
+	}
+	return typeNames[t]
+}
+
+// InRegistry returns whether the blobs of backend type are pushed to registry,
+// so they should be layers of the image.
+func InRegistry(t Type) bool {
+	return t == RegistryBackend || t == IPFSBackend
+}
+
 func blobDesc(size int64, blobID string) ocispec.Descriptor {
 	blobDigest := digest.NewDigestFromEncoded(digest.SHA256, blobID)
 	desc := ocispec.Descriptor{
@@ -65,6 +96,18 @@ func NewBackend(bt string, config []byte, remote *remote.Remote) (Backend, error
 		return newOSSBackend(config)
 	case "registry":
 		return newRegistryBackend(config, remote)
+	case "s3":
+		return newS3Backend(config)
+	case "azure":
+		return newAzureBackend(config)
+	case "gcs":
+		return newGCSBackend(config)
+	case "localfs":
+		return newLocalFSBackend(config)
+	case "external":
+		return newExternalBackend(config)
+	case "ipfs":
+		return newIPFSBackend(config, remote)
 	default:
 		return nil, fmt.Errorf("unsupported backend type %s", bt)
 	}
@@ -0,0 +1,78 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tlsconfig"
+)
+
+// TransportConfig tunes the connections to storage backend in backend
+// config, the zero value keeps the defaults of Go HTTP client, which reuses
+// connections and attempts HTTP/2.
+type TransportConfig struct {
+	// DisableKeepAlives closes the connection after each request.
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+	// MaxIdleConns limits the idle connections kept for reuse (per host
+	// as well), defaults to 100 in total and 2 per host.
+	MaxIdleConns int `json:"max_idle_conns"`
+	// MaxConnsPerHost limits the connections to a host including the
+	// active ones, 0 means no limit.
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+	// DisableHTTP2 uses HTTP/1.1 only.
+	DisableHTTP2 bool `json:"disable_http2"`
+	// TLSSessionCacheSize enables TLS session resumption with an LRU cache
+	// of sessions if it's positive.
+	TLSSessionCacheSize int `json:"tls_session_cache_size"`
+}
+
+func (config TransportConfig) apply(transport *http.Transport) {
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+		transport.MaxIdleConnsPerHost = config.MaxIdleConns
+	}
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+	if !config.DisableHTTP2 && config.TLSSessionCacheSize <= 0 {
+		return
+	}
+
+	// The cloned default transport may have negotiated `h2` by ALPN already.
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	if config.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+		protos := []string{}
+		for _, proto := range tlsConfig.NextProtos {
+			if proto != "h2" {
+				protos = append(protos, proto)
+			}
+		}
+		tlsConfig.NextProtos = protos
+	}
+	if config.TLSSessionCacheSize > 0 {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(config.TLSSessionCacheSize)
+	}
+	transport.TLSClientConfig = tlsConfig
+}
+
+// newHTTPClient creates the client of requests to storage backend, with the
+// proxy override in backend config (the default proxy if nil), the transport
+// config of backend and the TLS config of hosts, timeout 0 means no timeout.
+func newHTTPClient(proxyConfig *proxy.Config, transportConfig TransportConfig, timeout time.Duration) *http.Client {
+	transport := proxy.Transport(proxyConfig)
+	transportConfig.apply(transport)
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: tlsconfig.Transport(transport),
+	}
+}
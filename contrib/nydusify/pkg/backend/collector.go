@@ -0,0 +1,44 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// BlobObject is a blob stored in storage backend.
+type BlobObject struct {
+	ID           string
+	Size         int64
+	LastModified time.Time
+}
+
+// Collector is implemented by the backends that can list and delete the
+// stored blobs, which is used to collect the blobs not referenced by any
+// image.
+type Collector interface {
+	// List returns the blobs in backend, the objects not named by blob id
+	// are ignored.
+	List(ctx context.Context) ([]BlobObject, error)
+	Delete(ctx context.Context, blobID string) error
+}
+
+// blobIDFromKey returns the blob id of object key under prefix, only the
+// objects named by sha256 hex digest are regarded as blobs, so that other
+// objects sharing the prefix are never collected.
+func blobIDFromKey(prefix, key string) (string, bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	id := strings.TrimPrefix(key, prefix)
+	if digest.NewDigestFromEncoded(digest.SHA256, id).Validate() != nil {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,192 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// The version of protocol between nydusify and external backend helper,
+// bump it for any incompatible change of request or response.
+const ExternalProtocolVersion = 1
+
+const (
+	ExternalMethodUpload = "upload"
+	ExternalMethodCheck  = "check"
+)
+
+const defaultExternalTimeout = 3600
+
+type ExternalConfig struct {
+	// Path of helper binary, it's looked up in PATH if no slash in it.
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// Additional `KEY=VALUE` environment variables for helper.
+	Env []string `json:"env"`
+	// Timeout of a helper invocation in seconds.
+	Timeout int `json:"timeout"`
+	// Opaque configuration forwarded to helper as is.
+	Config json.RawMessage `json:"config"`
+}
+
+// ExternalRequest is written to stdin of helper as a JSON object.
+type ExternalRequest struct {
+	Version   int             `json:"version"`
+	Method    string          `json:"method"`
+	BlobID    string          `json:"blob_id"`
+	BlobPath  string          `json:"blob_path,omitempty"`
+	BlobSize  int64           `json:"blob_size,omitempty"`
+	ForcePush bool            `json:"force_push,omitempty"`
+	Config    json.RawMessage `json:"config,omitempty"`
+}
+
+// ExternalResponse is read from stdout of helper as a JSON object, a
+// non-empty `error` or a non-zero exit code means the request failed.
+type ExternalResponse struct {
+	Version int    `json:"version"`
+	Error   string `json:"error,omitempty"`
+	// Result of `check` method.
+	Exist bool `json:"exist,omitempty"`
+	// Optional URLs of the uploaded blob, recorded in blob descriptor.
+	URLs []string `json:"urls,omitempty"`
+}
+
+// External delegates blob storage to a helper binary, a new helper
+// process is started for each request, which receives an `ExternalRequest`
+// in stdin and replies an `ExternalResponse` in stdout. So users can add
+// proprietary object storage without modifying nydusify.
+type External struct {
+	command string
+	args    []string
+	env     []string
+	timeout time.Duration
+	config  json.RawMessage
+}
+
+func newExternalBackend(rawConfig []byte) (*External, error) {
+	var config ExternalConfig
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return nil, errors.Wrap(err, "Parse external storage backend configuration")
+	}
+
+	if config.Command == "" {
+		return nil, fmt.Errorf("no command is specified")
+	}
+	command, err := exec.LookPath(config.Command)
+	if err != nil {
+		return nil, errors.Wrapf(err, "find helper %s", config.Command)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultExternalTimeout
+	}
+
+	return &External{
+		command: command,
+		args:    config.Args,
+		env:     config.Env,
+		timeout: time.Duration(timeout) * time.Second,
+		config:  config.Config,
+	}, nil
+}
+
+func (b *External) call(ctx context.Context, req ExternalRequest) (*ExternalResponse, error) {
+	req.Version = ExternalProtocolVersion
+	req.Config = b.config
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal helper request")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, b.command, b.args...)
+	cmd.Env = append(os.Environ(), b.env...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	logger.Debugf("Call external backend helper %s: %s %s", b.command, req.Method, req.BlobID)
+	runErr := cmd.Run()
+	if stderr.Len() > 0 {
+		logger.Debugf("External backend helper stderr: %s", strings.TrimSpace(stderr.String()))
+	}
+	if runErr != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("helper %s timeout after %s", req.Method, b.timeout)
+		}
+		return nil, errors.Wrapf(runErr, "run helper %s: %s", req.Method, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp ExternalResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, errors.Wrapf(err, "invalid helper response %q", stdout.String())
+	}
+	if resp.Version != ExternalProtocolVersion {
+		return nil, fmt.Errorf("unsupported helper protocol version %d, expected %d", resp.Version, ExternalProtocolVersion)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("helper %s: %s", req.Method, resp.Error)
+	}
+
+	return &resp, nil
+}
+
+func (b *External) Upload(ctx context.Context, blobID, blobPath string, size int64, forcePush bool) (*ocispec.Descriptor, error) {
+	desc := blobDesc(size, blobID)
+
+	if !forcePush {
+		exist, err := b.Check(blobID)
+		if err != nil {
+			return nil, err
+		}
+		if exist {
+			logger.Infof("Skip upload because blob exists: %s", blobID)
+			return &desc, nil
+		}
+	}
+
+	resp, err := b.call(ctx, ExternalRequest{
+		Method:    ExternalMethodUpload,
+		BlobID:    blobID,
+		BlobPath:  blobPath,
+		BlobSize:  size,
+		ForcePush: forcePush,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "upload blob by external backend")
+	}
+	desc.URLs = resp.URLs
+
+	return &desc, nil
+}
+
+func (b *External) Check(blobID string) (bool, error) {
+	resp, err := b.call(context.Background(), ExternalRequest{
+		Method: ExternalMethodCheck,
+		BlobID: blobID,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "check blob by external backend")
+	}
+	return resp.Exist, nil
+}
+
+func (b *External) Type() Type {
+	return ExternalBackend
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestExternalHelperProcess isn't a real test, it's invoked by the
+// external backend as helper, stores blobs in `$dir` from helper config.
+func TestExternalHelperProcess(t *testing.T) {
+	if os.Getenv("NYDUSIFY_EXTERNAL_HELPER") != "1" {
+		return
+	}
+
+	reply := func(resp ExternalResponse) {
+		resp.Version = ExternalProtocolVersion
+		json.NewEncoder(os.Stdout).Encode(resp)
+		os.Exit(0)
+	}
+
+	var req ExternalRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		reply(ExternalResponse{Error: err.Error()})
+	}
+	var config struct {
+		Dir string `json:"dir"`
+	}
+	if err := json.Unmarshal(req.Config, &config); err != nil {
+		reply(ExternalResponse{Error: err.Error()})
+	}
+	target := filepath.Join(config.Dir, req.BlobID)
+
+	switch req.Method {
+	case ExternalMethodCheck:
+		_, err := os.Stat(target)
+		reply(ExternalResponse{Exist: err == nil})
+	case ExternalMethodUpload:
+		if err := copyFile(req.BlobPath, target); err != nil {
+			reply(ExternalResponse{Error: err.Error()})
+		}
+		reply(ExternalResponse{URLs: []string{"file://" + target}})
+	default:
+		fmt.Fprintf(os.Stderr, "unknown method %s", req.Method)
+		os.Exit(1)
+	}
+}
+
+func TestExternalBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-external-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	blobID := "7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"
+	blobPath := filepath.Join(dir, "blob")
+	assert.Nil(t, ioutil.WriteFile(blobPath, []byte("blob data"), 0644))
+	storeDir := filepath.Join(dir, "store")
+	assert.Nil(t, os.Mkdir(storeDir, 0755))
+
+	config, err := json.Marshal(ExternalConfig{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=TestExternalHelperProcess"},
+		Env:     []string{"NYDUSIFY_EXTERNAL_HELPER=1"},
+		Config:  json.RawMessage(`{"dir": "` + storeDir + `"}`),
+	})
+	assert.Nil(t, err)
+	b, err := newExternalBackend(config)
+	assert.Nil(t, err)
+
+	exist, err := b.Check(blobID)
+	assert.Nil(t, err)
+	assert.False(t, exist)
+
+	desc, err := b.Upload(context.Background(), blobID, blobPath, 9, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"file://" + filepath.Join(storeDir, blobID)}, desc.URLs)
+	data, err := ioutil.ReadFile(filepath.Join(storeDir, blobID))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("blob data"), data)
+
+	exist, err = b.Check(blobID)
+	assert.Nil(t, err)
+	assert.True(t, exist)
+
+	// Helper reports error in response.
+	_, err = b.Upload(context.Background(), "deadbeef", filepath.Join(dir, "nonexist"), 9, true)
+	assert.NotNil(t, err)
+
+	_, err = newExternalBackend([]byte(`{"command": "nydusify-nonexist-helper"}`))
+	assert.NotNil(t, err)
+}
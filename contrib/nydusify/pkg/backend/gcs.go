@@ -0,0 +1,524 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+)
+
+const (
+	gcsEndpoint      = "https://storage.googleapis.com"
+	gcsScope         = "https://www.googleapis.com/auth/devstorage.read_write"
+	gcsTokenEndpoint = "https://oauth2.googleapis.com/token"
+	// GCE/GKE metadata server, GKE workload identity exposes the token of
+	// bound Google service account here.
+	gcsMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// Chunk size of resumable upload must be a multiple of 256 KiB.
+	gcsUploadChunkSize = 32 * 1024 * 1024
+	gcsUploadRetry     = 5
+)
+
+type GCSConfig struct {
+	// Default to `https://storage.googleapis.com`.
+	Endpoint     string `json:"endpoint"`
+	BucketName   string `json:"bucket_name"`
+	ObjectPrefix string `json:"object_prefix"`
+	// Path of service account key or authorized user credentials file,
+	// fallback to Application Default Credentials if empty.
+	CredentialsFile string `json:"credentials_file"`
+	// Proxy overrides the default proxy for requests to bucket.
+	proxy.Config
+	// TransportConfig tunes the connections to bucket.
+	TransportConfig
+}
+
+type gcsCredentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcsTokenSource provides OAuth2 access token with Application Default
+// Credentials semantics: credentials file, gcloud user credentials, then
+// metadata server (GCE or GKE workload identity).
+type gcsTokenSource struct {
+	mu         sync.Mutex
+	creds      *gcsCredentialsFile
+	client     *http.Client
+	token      string
+	expiration time.Time
+}
+
+type GCS struct {
+	endpoint     string
+	bucketName   string
+	objectPrefix string
+	tokenSource  *gcsTokenSource
+	client       *http.Client
+}
+
+func findGCSCredentialsFile(path string) (*gcsCredentialsFile, error) {
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		// Well-known location created by `gcloud auth application-default login`
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(path); err != nil {
+			return nil, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read GCS credentials file")
+	}
+	var creds gcsCredentialsFile
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, errors.Wrap(err, "parse GCS credentials file")
+	}
+	if creds.Type != "service_account" && creds.Type != "authorized_user" {
+		return nil, fmt.Errorf("unsupported GCS credentials type %s", creds.Type)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = gcsTokenEndpoint
+	}
+
+	return &creds, nil
+}
+
+func newGCSBackend(rawConfig []byte) (*GCS, error) {
+	var config GCSConfig
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return nil, errors.Wrap(err, "Parse GCS storage backend configuration")
+	}
+
+	if config.BucketName == "" {
+		return nil, fmt.Errorf("no bucket is specified")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = gcsEndpoint
+	}
+
+	creds, err := findGCSCredentialsFile(config.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	proxyConfig, err := proxy.BackendConfig(config.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse GCS storage backend proxy")
+	}
+	client := newHTTPClient(proxyConfig, config.TransportConfig, 0)
+
+	return &GCS{
+		endpoint:     strings.TrimSuffix(config.Endpoint, "/"),
+		bucketName:   config.BucketName,
+		objectPrefix: config.ObjectPrefix,
+		tokenSource: &gcsTokenSource{
+			creds:  creds,
+			client: &http.Client{Timeout: 30 * time.Second},
+		},
+		client: client,
+	}, nil
+}
+
+func (ts *gcsTokenSource) signJWT(now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(ts.creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("invalid private key in GCS credentials")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", errors.Wrap(err, "parse private key in GCS credentials")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private key in GCS credentials is not RSA key")
+	}
+
+	encode := func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(data), nil
+	}
+	header, err := encode(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encode(map[string]interface{}{
+		"iss":   ts.creds.ClientEmail,
+		"scope": gcsScope,
+		"aud":   ts.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := header + "." + claims
+	hashed := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", errors.Wrap(err, "sign JWT")
+	}
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (ts *gcsTokenSource) fetch(ctx context.Context) (*http.Request, error) {
+	if ts.creds == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataEndpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return req, nil
+	}
+
+	form := url.Values{}
+	if ts.creds.Type == "service_account" {
+		assertion, err := ts.signJWT(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	} else {
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", ts.creds.ClientID)
+		form.Set("client_secret", ts.creds.ClientSecret)
+		form.Set("refresh_token", ts.creds.RefreshToken)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.creds.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// Token returns a valid access token, refresh it 5 minutes before expiration.
+func (ts *gcsTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Until(ts.expiration) > 5*time.Minute {
+		return ts.token, nil
+	}
+
+	req, err := ts.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "get GCS access token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get GCS access token: unexpected status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "decode GCS access token")
+	}
+	ts.token = token.AccessToken
+	ts.expiration = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return ts.token, nil
+}
+
+func (b *GCS) do(ctx context.Context, method, u string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	token, err := b.tokenSource.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return b.client.Do(req)
+}
+
+// createUploadSession starts a resumable upload, returns the session URI.
+func (b *GCS) createUploadSession(ctx context.Context, key string) (string, error) {
+	query := url.Values{
+		"uploadType": []string{"resumable"},
+		"name":       []string{key},
+	}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", b.endpoint, url.PathEscape(b.bucketName), query.Encode())
+	header := http.Header{}
+	header.Set("X-Upload-Content-Type", "application/octet-stream")
+
+	resp, err := b.do(ctx, http.MethodPost, u, nil, header)
+	if err != nil {
+		return "", errors.Wrap(err, "create upload session")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("create upload session: unexpected status %d", resp.StatusCode)
+	}
+
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", errors.New("create upload session: no session URI returned")
+	}
+	return session, nil
+}
+
+// uploadedOffset queries the persisted size of an interrupted resumable
+// upload, returns -1 if the upload has been completed.
+func (b *GCS) uploadedOffset(ctx context.Context, session string, size int64) (int64, error) {
+	header := http.Header{}
+	header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	resp, err := b.do(ctx, http.MethodPut, session, nil, header)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return -1, nil
+	case http.StatusPermanentRedirect:
+		// The `Range` header looks like `bytes=0-42`, no header means nothing persisted.
+		uploadedRange := resp.Header.Get("Range")
+		if uploadedRange == "" {
+			return 0, nil
+		}
+		end, err := strconv.ParseInt(uploadedRange[strings.LastIndex(uploadedRange, "-")+1:], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid range %s", uploadedRange)
+		}
+		return end + 1, nil
+	default:
+		return 0, fmt.Errorf("query upload status: unexpected status %d", resp.StatusCode)
+	}
+}
+
+func (b *GCS) resumableUpload(ctx context.Context, key, blobPath string, size int64) error {
+	session, err := b.createUploadSession(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset := int64(0)
+	failures := 0
+	for offset < size || size == 0 {
+		length := int64(gcsUploadChunkSize)
+		if offset+length > size {
+			length = size - offset
+		}
+		header := http.Header{}
+		if length > 0 {
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		} else {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		}
+
+		resp, err := b.do(ctx, http.MethodPut, session, io.NewSectionReader(file, offset, length), header)
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+				return nil
+			case resp.StatusCode == http.StatusPermanentRedirect:
+				offset += length
+				failures = 0
+				continue
+			default:
+				err = fmt.Errorf("upload chunk: unexpected status %d", resp.StatusCode)
+			}
+		}
+
+		// Resume from the persisted offset of the session on error.
+		failures++
+		if failures > gcsUploadRetry {
+			return errors.Wrap(err, "resumable upload")
+		}
+		logger.Warnf("Resume GCS upload %s due to error: %s", key, err)
+		time.Sleep(time.Duration(failures) * time.Second)
+		persisted, queryErr := b.uploadedOffset(ctx, session, size)
+		if queryErr != nil {
+			logger.Warnf("Query GCS upload status: %s", queryErr)
+			continue
+		}
+		if persisted < 0 {
+			return nil
+		}
+		offset = persisted
+	}
+
+	return nil
+}
+
+// Upload blob as image layer to GCS backend using resumable upload, the
+// interrupted upload is resumed from the offset persisted by GCS.
+func (b *GCS) Upload(ctx context.Context, blobID, blobPath string, size int64, forcePush bool) (*ocispec.Descriptor, error) {
+	blobObjectKey := b.objectPrefix + blobID
+
+	desc := blobDesc(size, blobID)
+
+	if !forcePush {
+		if exist, err := b.Check(blobID); err != nil {
+			return nil, err
+		} else if exist {
+			logger.Infof("Skip upload because blob exists: %s", blobID)
+			return &desc, nil
+		}
+	}
+
+	stat, err := os.Stat(blobPath)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	if err := b.resumableUpload(ctx, blobObjectKey, blobPath, stat.Size()); err != nil {
+		return nil, err
+	}
+	logger.Debugf("Uploading blob %s costs %s", blobObjectKey, time.Since(start))
+
+	return &desc, nil
+}
+
+func (b *GCS) Check(blobID string) (bool, error) {
+	u := fmt.Sprintf(
+		"%s/storage/v1/b/%s/o/%s", b.endpoint, url.PathEscape(b.bucketName), url.PathEscape(b.objectPrefix+blobID),
+	)
+	resp, err := b.do(context.Background(), http.MethodGet, u, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("get object metadata: unexpected status %d", resp.StatusCode)
+	}
+}
+
+func (b *GCS) Type() Type {
+	return GCSBackend
+}
+
+type gcsObjectList struct {
+	Items []struct {
+		Name    string    `json:"name"`
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (b *GCS) List(ctx context.Context) ([]BlobObject, error) {
+	blobs := []BlobObject{}
+	query := url.Values{
+		"prefix":    []string{b.objectPrefix},
+		"delimiter": []string{"/"},
+	}
+	for {
+		u := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", b.endpoint, url.PathEscape(b.bucketName), query.Encode())
+		resp, err := b.do(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "list objects")
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("list objects: unexpected status %d", resp.StatusCode)
+		}
+		var result gcsObjectList
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "decode list objects response")
+		}
+		for _, object := range result.Items {
+			id, ok := blobIDFromKey(b.objectPrefix, object.Name)
+			if !ok {
+				continue
+			}
+			size, err := strconv.ParseInt(object.Size, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse size of object %s", object.Name)
+			}
+			blobs = append(blobs, BlobObject{ID: id, Size: size, LastModified: object.Updated})
+		}
+		if result.NextPageToken == "" {
+			return blobs, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+func (b *GCS) Delete(ctx context.Context, blobID string) error {
+	u := fmt.Sprintf(
+		"%s/storage/v1/b/%s/o/%s", b.endpoint, url.PathEscape(b.bucketName), url.PathEscape(b.objectPrefix+blobID),
+	)
+	resp, err := b.do(ctx, http.MethodDelete, u, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "delete object")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("delete object: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
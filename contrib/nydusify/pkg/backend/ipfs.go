@@ -0,0 +1,144 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const ipfsDefaultAPI = "http://127.0.0.1:5001"
+
+type IPFSConfig struct {
+	// HTTP RPC API of the IPFS node to add the blobs, default to
+	// `http://127.0.0.1:5001`.
+	API string `json:"api"`
+}
+
+// IPFS adds blobs to an IPFS node by its RPC API and annotates the blob
+// descriptors with the CIDs. The blobs are pushed to the registry as well,
+// nydusd reads them from the registry if the CIDs can't be resolved.
+type IPFS struct {
+	api      string
+	client   *http.Client
+	registry Backend
+}
+
+func newIPFSBackend(rawConfig []byte, remote *remote.Remote) (*IPFS, error) {
+	var config IPFSConfig
+	if len(rawConfig) > 0 {
+		if err := json.Unmarshal(rawConfig, &config); err != nil {
+			return nil, errors.Wrap(err, "Parse IPFS storage backend configuration")
+		}
+	}
+
+	api := strings.TrimSuffix(config.API, "/")
+	if api == "" {
+		api = ipfsDefaultAPI
+	}
+
+	return &IPFS{
+		api:      api,
+		client:   &http.Client{},
+		registry: &Registry{remote: remote},
+	}, nil
+}
+
+type ipfsAddResponse struct {
+	Name string
+	Hash string
+}
+
+// Add the blob file to IPFS and pin it, return its CID. Blobs are added as
+// CIDv1 with raw leaves, so the gateway serves the ranges of blob directly.
+func (b *IPFS) add(ctx context.Context, blobPath string) (string, error) {
+	blobFile, err := os.Open(blobPath)
+	if err != nil {
+		return "", errors.Wrap(err, "Open blob file")
+	}
+	defer blobFile.Close()
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filepath.Base(blobPath))
+		if err == nil {
+			_, err = io.Copy(part, blobFile)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	url := b.api + "/api/v0/add?cid-version=1&raw-leaves=true&pin=true&quieter=true"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		pr.Close()
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		pr.Close()
+		return "", errors.Wrap(err, "Add blob to IPFS")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("add blob to IPFS: unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var added ipfsAddResponse
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		return "", errors.Wrap(err, "Parse response of adding blob to IPFS")
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("add blob to IPFS: no CID in response")
+	}
+
+	return added.Hash, nil
+}
+
+func (b *IPFS) Upload(
+	ctx context.Context, blobID, blobPath string, size int64, forcePush bool,
+) (*ocispec.Descriptor, error) {
+	desc, err := b.registry.Upload(ctx, blobID, blobPath, size, forcePush)
+	if err != nil {
+		return nil, err
+	}
+
+	cid, err := b.add(ctx, blobPath)
+	if err != nil {
+		return nil, err
+	}
+	desc.Annotations[utils.LayerAnnotationNydusBlobCID] = cid
+
+	return desc, nil
+}
+
+func (b *IPFS) Check(blobID string) (bool, error) {
+	return b.registry.Check(blobID)
+}
+
+func (b *IPFS) Type() Type {
+	return IPFSBackend
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFSAdd(t *testing.T) {
+	var added []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v0/add" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("cid-version") != "1" || query.Get("raw-leaves") != "true" || query.Get("pin") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		added, _ = ioutil.ReadAll(file)
+		w.Write([]byte(`{"Name":"blob","Hash":"bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku","Size":"4"}`))
+	}))
+	defer server.Close()
+
+	b, err := newIPFSBackend(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ipfsDefaultAPI, b.api)
+	assert.Equal(t, IPFSBackend, b.Type())
+	assert.Equal(t, "ipfs", TypeName(b.Type()))
+	assert.True(t, InRegistry(b.Type()))
+
+	b, err = newIPFSBackend([]byte(`{"api": "`+server.URL+`/"}`), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL, b.api)
+
+	dir, err := ioutil.TempDir("", "nydusify-ipfs-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	blobPath := filepath.Join(dir, "blob")
+	assert.Nil(t, ioutil.WriteFile(blobPath, []byte("blob"), 0644))
+
+	cid, err := b.add(context.Background(), blobPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", cid)
+	assert.Equal(t, "blob", string(added))
+
+	b.api = server.URL + "/invalid"
+	_, err = b.add(context.Background(), blobPath)
+	assert.NotNil(t, err)
+
+	_, err = b.add(context.Background(), filepath.Join(dir, "nonexistent"))
+	assert.NotNil(t, err)
+}
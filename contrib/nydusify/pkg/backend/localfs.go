@@ -0,0 +1,195 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Every shard level takes 2 hex chars of blob id as directory name,
+	// 256 sub directories at most for each level.
+	localFSShardWidth = 2
+	localFSMaxShards  = 4
+)
+
+type LocalFSConfig struct {
+	Dir string `json:"dir"`
+	// Shard blobs into `$dir/ab/cd/abcd...` like directories by blob id
+	// prefix. The default 0 means flat layout `$dir/abcd...`, which is the
+	// only layout read by the `localfs` backend of nydusd.
+	ShardDepth int `json:"shard_depth"`
+	// Never write the directory, for example an NFS share mounted
+	// read-only, upload succeeds only if the blob already exists.
+	ReadOnly bool `json:"readonly"`
+}
+
+// LocalFS stores blobs under a local or network filesystem directory.
+type LocalFS struct {
+	dir        string
+	shardDepth int
+	readOnly   bool
+}
+
+func newLocalFSBackend(rawConfig []byte) (*LocalFS, error) {
+	var config LocalFSConfig
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return nil, errors.Wrap(err, "Parse localfs storage backend configuration")
+	}
+
+	if config.Dir == "" {
+		return nil, fmt.Errorf("no dir is specified")
+	}
+
+	shardDepth := config.ShardDepth
+	if shardDepth < 0 || shardDepth > localFSMaxShards {
+		return nil, fmt.Errorf("shard_depth should be in range [0, %d]", localFSMaxShards)
+	}
+
+	if !config.ReadOnly {
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			return nil, errors.Wrap(err, "Create localfs backend directory")
+		}
+	}
+
+	return &LocalFS{
+		dir:        config.Dir,
+		shardDepth: shardDepth,
+		readOnly:   config.ReadOnly,
+	}, nil
+}
+
+// BlobPath returns the sharded path of blob in backend directory.
+func (b *LocalFS) BlobPath(blobID string) string {
+	elems := []string{b.dir}
+	for level := 0; level < b.shardDepth; level++ {
+		start := level * localFSShardWidth
+		if start+localFSShardWidth > len(blobID) {
+			break
+		}
+		elems = append(elems, blobID[start:start+localFSShardWidth])
+	}
+	elems = append(elems, blobID)
+	return filepath.Join(elems...)
+}
+
+// copyFile copies blob to a temp file in the same directory first, then
+// renames it to the target, the blob is never visible partially.
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Create shard directory")
+	}
+	tmpFile, err := ioutil.TempFile(dir, "."+filepath.Base(dst)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := io.Copy(tmpFile, srcFile); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "Copy blob")
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "Sync blob")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), dst)
+}
+
+func (b *LocalFS) Upload(ctx context.Context, blobID, blobPath string, size int64, forcePush bool) (*ocispec.Descriptor, error) {
+	desc := blobDesc(size, blobID)
+
+	exist, err := b.Check(blobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.readOnly {
+		if !exist {
+			return nil, fmt.Errorf("blob %s does not exist in read-only localfs backend", blobID)
+		}
+		return &desc, nil
+	}
+
+	if exist && !forcePush {
+		logger.Infof("Skip upload because blob exists: %s", blobID)
+		return &desc, nil
+	}
+
+	start := time.Now()
+	target := b.BlobPath(blobID)
+	if err := copyFile(blobPath, target); err != nil {
+		return nil, errors.Wrapf(err, "Store blob to %s", target)
+	}
+	logger.Debugf("Storing blob %s costs %s", target, time.Since(start))
+
+	return &desc, nil
+}
+
+func (b *LocalFS) Check(blobID string) (bool, error) {
+	if _, err := os.Stat(b.BlobPath(blobID)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *LocalFS) Type() Type {
+	return LocalFSBackend
+}
+
+func (b *LocalFS) List(ctx context.Context) ([]BlobObject, error) {
+	blobs := []BlobObject{}
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		// Only the blobs in the layout of configured shard depth.
+		if id, ok := blobIDFromKey("", info.Name()); ok && b.BlobPath(id) == path {
+			blobs = append(blobs, BlobObject{ID: id, Size: info.Size(), LastModified: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "walk localfs backend directory")
+	}
+	return blobs, nil
+}
+
+func (b *LocalFS) Delete(ctx context.Context, blobID string) error {
+	if b.readOnly {
+		return fmt.Errorf("can't delete blob %s in read-only localfs backend", blobID)
+	}
+	return os.Remove(b.BlobPath(blobID))
+}
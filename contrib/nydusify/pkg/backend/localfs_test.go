@@ -0,0 +1,62 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalFSBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-localfs-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	blobID := "7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"
+	blobPath := filepath.Join(dir, blobID)
+	assert.Nil(t, ioutil.WriteFile(blobPath, []byte("blob data"), 0644))
+	storeDir := filepath.Join(dir, "store")
+
+	// Read-only backend never creates the directory.
+	readOnly, err := newLocalFSBackend([]byte(`{"dir": "` + storeDir + `", "shard_depth": 2, "readonly": true}`))
+	assert.Nil(t, err)
+	_, err = readOnly.Upload(context.Background(), blobID, blobPath, 9, false)
+	assert.NotNil(t, err)
+	_, err = os.Stat(storeDir)
+	assert.True(t, os.IsNotExist(err))
+
+	b, err := newLocalFSBackend([]byte(`{"dir": "` + storeDir + `", "shard_depth": 2}`))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(storeDir, "7c", "c4", blobID), b.BlobPath(blobID))
+
+	_, err = b.Upload(context.Background(), blobID, blobPath, 9, false)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(storeDir, "7c", "c4", blobID))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("blob data"), data)
+
+	exist, err := readOnly.Check(blobID)
+	assert.Nil(t, err)
+	assert.True(t, exist)
+	_, err = readOnly.Upload(context.Background(), blobID, blobPath, 9, false)
+	assert.Nil(t, err)
+
+	flat, err := newLocalFSBackend([]byte(`{"dir": "` + storeDir + `", "shard_depth": 0}`))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(storeDir, blobID), flat.BlobPath(blobID))
+
+	// The layout read by nydusd is the default.
+	flat, err = newLocalFSBackend([]byte(`{"dir": "` + storeDir + `"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(storeDir, blobID), flat.BlobPath(blobID))
+
+	_, err = newLocalFSBackend([]byte(`{"dir": "` + storeDir + `", "shard_depth": 5}`))
+	assert.NotNil(t, err)
+}
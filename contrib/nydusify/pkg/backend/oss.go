@@ -18,8 +18,10 @@ import (
 	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tlsconfig"
 )
 
 const (
@@ -53,7 +55,22 @@ func newOSSBackend(rawConfig []byte) (*OSSBackend, error) {
 		return nil, fmt.Errorf("no endpoint or bucket is specified")
 	}
 
-	client, err := oss.New(endpoint, accessKeyID, accessKeySecret)
+	// The SDK doesn't read proxy from environment variables, so the client is
+	// replaced if any proxy or host TLS config is configured.
+	var options []oss.ClientOption
+	proxyConfig, err := proxy.BackendConfig(proxy.Config{
+		HTTPProxy:  configMap["http_proxy"],
+		HTTPSProxy: configMap["https_proxy"],
+		NoProxy:    configMap["no_proxy"],
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse OSS storage backend proxy")
+	}
+	if proxyConfig != nil || !proxy.Default().IsZero() || tlsconfig.Default() != nil {
+		options = append(options, oss.HTTPClient(newHTTPClient(proxyConfig, TransportConfig{}, 0)))
+	}
+
+	client, err := oss.New(endpoint, accessKeyID, accessKeySecret, options...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Create client")
 	}
@@ -108,7 +125,7 @@ func (b *OSSBackend) Upload(ctx context.Context, blobID, blobPath string, size i
 		if exist, err := b.bucket.IsObjectExist(blobObjectKey); err != nil {
 			return nil, err
 		} else if exist {
-			logrus.Infof("Skip upload because blob exists: %s", blobID)
+			logger.Infof("Skip upload because blob exists: %s", blobID)
 			return &desc, nil
 		}
 	}
@@ -138,7 +155,7 @@ func (b *OSSBackend) Upload(ctx context.Context, blobID, blobPath string, size i
 	defer close(crc64ErrChan)
 
 	if needMultiparts {
-		logrus.Debugf("Upload %s using multiparts method", blobObjectKey)
+		logger.Debugf("Upload %s using multiparts method", blobObjectKey)
 		chunks, err := oss.SplitFileByPartNum(blobPath, splitPartsCount)
 		if err != nil {
 			return nil, err
@@ -217,17 +234,17 @@ func (b *OSSBackend) Upload(ctx context.Context, blobID, blobPath string, size i
 			}
 
 		} else {
-			logrus.Warnf("Too many values, skip crc64 integrity check.")
+			logger.Warnf("Too many values, skip crc64 integrity check.")
 		}
 	} else {
-		logrus.Warnf("No CRC64 in header, skip crc64 integrity check.")
+		logger.Warnf("No CRC64 in header, skip crc64 integrity check.")
 	}
 
 	// With OSS backend, no blob has to be pushed to registry, but have to push to build cache.
 
 	end := time.Now()
 	elapsed := end.Sub(start)
-	logrus.Debugf("Uploading blob %s costs %s", blobObjectKey, elapsed)
+	logger.Debugf("Uploading blob %s costs %s", blobObjectKey, elapsed)
 
 	return &desc, nil
 }
@@ -240,3 +257,31 @@ func (b *OSSBackend) Check(blobID string) (bool, error) {
 func (b *OSSBackend) Type() Type {
 	return OssBackend
 }
+
+func (b *OSSBackend) List(ctx context.Context) ([]BlobObject, error) {
+	blobs := []BlobObject{}
+	token := ""
+	for {
+		options := []oss.Option{oss.Prefix(b.objectPrefix), oss.Delimiter("/")}
+		if token != "" {
+			options = append(options, oss.ContinuationToken(token))
+		}
+		result, err := b.bucket.ListObjectsV2(options...)
+		if err != nil {
+			return nil, errors.Wrap(err, "list objects")
+		}
+		for _, object := range result.Objects {
+			if id, ok := blobIDFromKey(b.objectPrefix, object.Key); ok {
+				blobs = append(blobs, BlobObject{ID: id, Size: object.Size, LastModified: object.LastModified})
+			}
+		}
+		if !result.IsTruncated {
+			return blobs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (b *OSSBackend) Delete(ctx context.Context, blobID string) error {
+	return b.bucket.DeleteObject(b.objectPrefix + blobID)
+}
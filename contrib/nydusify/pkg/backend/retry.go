@@ -0,0 +1,336 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryInterval    = 2 * time.Second
+	defaultRetryMaxInterval = 30 * time.Second
+	defaultRetryBudget      = 0.2
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+	// The retries always allowed by retry budget.
+	minRetryBudget = 10
+)
+
+// RetryConfig configures the retry of storage backend requests, the zero
+// value of each field means using the default value.
+type RetryConfig struct {
+	// Maximum attempts of a request including the first one, defaults to 3.
+	Attempts int
+	// Backoff before the first retry, doubled for each retry up to
+	// MaxInterval, defaults to 2s and 30s. The actual backoff is randomized
+	// between the half and the full of it.
+	Interval    time.Duration
+	MaxInterval time.Duration
+	// Budget limits the retries to a ratio of requests (plus 10 retries),
+	// so that an unhealthy backend isn't flooded by retries, defaults to 0.2.
+	Budget float64
+	// The circuit breaker of backend host opens after continuous failures
+	// (defaults to 5), requests fail fast until it cools down (defaults to
+	// 30s), then a trial request is allowed to close it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+func (config RetryConfig) withDefaults() RetryConfig {
+	if config.Attempts <= 0 {
+		config.Attempts = defaultRetryAttempts
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultRetryInterval
+	}
+	if config.MaxInterval <= 0 {
+		config.MaxInterval = defaultRetryMaxInterval
+	}
+	if config.MaxInterval < config.Interval {
+		config.MaxInterval = config.Interval
+	}
+	if config.Budget <= 0 {
+		config.Budget = defaultRetryBudget
+	}
+	if config.BreakerThreshold <= 0 {
+		config.BreakerThreshold = defaultBreakerThreshold
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = defaultBreakerCooldown
+	}
+	return config
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Cause() error {
+	return e.err
+}
+
+// Permanent marks the error as not retryable, e.g. client side errors.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if the error or its cause is marked by Permanent.
+func IsPermanent(err error) bool {
+	for err != nil {
+		if _, ok := err.(*permanentError); ok {
+			return true
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
+}
+
+// ErrCircuitOpen is returned without sending request when the circuit
+// breaker of backend host is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Circuit breaker states, exported as the value of metrics.
+const (
+	BreakerClosed = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+type breaker struct {
+	host     string
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	// A trial request is in flight in half-open state.
+	trial bool
+}
+
+// The breakers are shared by all backends of the same host.
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*breaker{}
+)
+
+func breakerOf(host string) *breaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	if b, ok := breakers[host]; ok {
+		return b
+	}
+	b := &breaker{host: host}
+	breakers[host] = b
+	return b
+}
+
+func (b *breaker) setState(state int) {
+	if b.state != state {
+		b.state = state
+		metrics.BackendBreakerState(b.host, state)
+	}
+}
+
+func (b *breaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.trial = true
+		return true
+	case BreakerHalfOpen:
+		// Allow only one trial request.
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// cancel releases the trial of cancelled request.
+func (b *breaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *breaker) report(err error, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != BreakerClosed {
+			logger.Infof("Circuit breaker of backend host %s is closed", b.host)
+		}
+		b.failures = 0
+		b.trial = false
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= threshold {
+		if b.state != BreakerOpen {
+			logger.Warnf("Circuit breaker of backend host %s is open: %s", b.host, err)
+		}
+		b.trial = false
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// Retrier retries the failed requests of a storage backend with
+// exponential backoff, except the permanent errors.
+type Retrier struct {
+	config      RetryConfig
+	backendType string
+	breaker     *breaker
+
+	mu       sync.Mutex
+	requests int
+	retries  int
+}
+
+// NewRetrier creates a retrier for the backend, the circuit breaker is
+// shared with other backends of the same host.
+func NewRetrier(backend Backend, config RetryConfig) *Retrier {
+	return &Retrier{
+		config:      config.withDefaults(),
+		backendType: TypeName(backend.Type()),
+		breaker:     breakerOf(hostOf(backend)),
+	}
+}
+
+// NewRemoteRetrier creates a retrier for the requests to registry of remote,
+// e.g. pushing the bootstrap layers.
+func NewRemoteRetrier(remote *remote.Remote, config RetryConfig) *Retrier {
+	return NewRetrier(&Registry{remote: remote}, config)
+}
+
+func (r *Retrier) takeBudget() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if float64(r.retries) >= minRetryBudget+r.config.Budget*float64(r.requests) {
+		return false
+	}
+	r.retries++
+	return true
+}
+
+func (r *Retrier) backoff(retry int) time.Duration {
+	interval := r.config.Interval
+	for i := 1; i < retry && interval < r.config.MaxInterval; i++ {
+		interval *= 2
+	}
+	if interval > r.config.MaxInterval {
+		interval = r.config.MaxInterval
+	}
+	return interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+}
+
+// Do calls op until it succeeds, returns a permanent error, or the attempts
+// or retry budget are used up.
+func (r *Retrier) Do(ctx context.Context, op func() error) error {
+	r.mu.Lock()
+	r.requests++
+	r.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < r.config.Attempts; attempt++ {
+		if attempt > 0 {
+			if !r.takeBudget() {
+				return errors.Wrap(err, "retry budget of backend is exhausted")
+			}
+			backoff := r.backoff(attempt)
+			logger.Warnf("Retry %s backend request in %s due to error: %s", r.backendType, backoff, err)
+			metrics.BackendRetryCount(r.backendType)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if !r.breaker.allow(r.config.BreakerCooldown) {
+			return errors.Wrapf(ErrCircuitOpen, "backend host %s", r.breaker.host)
+		}
+		err = op()
+		if ctx.Err() != nil {
+			// Cancellation isn't a failure of backend.
+			r.breaker.cancel()
+			return err
+		}
+		if err == nil || IsPermanent(err) {
+			r.breaker.report(nil, r.config.BreakerThreshold)
+			return err
+		}
+		r.breaker.report(err, r.config.BreakerThreshold)
+	}
+
+	return err
+}
+
+// hostOf returns the host that backend requests are sent to.
+func hostOf(backend Backend) string {
+	endpointHost := func(endpoint string) string {
+		if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+			return u.Host
+		}
+		return endpoint
+	}
+
+	switch b := backend.(type) {
+	case *OSSBackend:
+		return endpointHost(b.bucket.Client.Config.Endpoint)
+	case *S3:
+		return b.endpoint
+	case *Azure:
+		return endpointHost(b.endpoint)
+	case *GCS:
+		return endpointHost(b.endpoint)
+	case *Registry:
+		if b.remote != nil {
+			if named, err := reference.ParseNormalizedNamed(b.remote.Ref); err == nil {
+				return reference.Domain(named)
+			}
+		}
+	case *LocalFS:
+		return "localfs:" + b.dir
+	case *External:
+		return "external:" + b.command
+	}
+	return fmt.Sprintf("%s:unknown", TypeName(backend.Type()))
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrier(t *testing.T) {
+	config := RetryConfig{
+		Attempts:         3,
+		Interval:         time.Millisecond,
+		MaxInterval:      2 * time.Millisecond,
+		BreakerThreshold: 4,
+		BreakerCooldown:  time.Hour,
+	}
+	r := NewRetrier(&LocalFS{dir: t.Name()}, config)
+	ctx := context.Background()
+
+	calls := 0
+	failing := func(n int, err error) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= n {
+				return err
+			}
+			return nil
+		}
+	}
+
+	assert.Nil(t, r.Do(ctx, failing(2, fmt.Errorf("network error"))))
+	assert.Equal(t, 3, calls)
+
+	err := r.Do(ctx, failing(1, errors.Wrap(Permanent(fmt.Errorf("status 403")), "upload")))
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, 1, calls)
+
+	// The breaker opens after continuous failures of all requests.
+	err = r.Do(ctx, failing(3, fmt.Errorf("network error")))
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, BreakerClosed, r.breaker.state)
+	err = r.Do(ctx, failing(3, fmt.Errorf("network error")))
+	assert.Equal(t, ErrCircuitOpen, errors.Cause(err))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, BreakerOpen, r.breaker.state)
+
+	// The breaker is shared by backends of the same host.
+	other := NewRetrier(&LocalFS{dir: t.Name()}, config)
+	err = other.Do(ctx, failing(0, nil))
+	assert.Equal(t, ErrCircuitOpen, errors.Cause(err))
+	assert.Equal(t, 0, calls)
+
+	// A trial request is allowed after cooldown.
+	r.config.BreakerCooldown = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(t, r.Do(ctx, failing(0, nil)))
+	assert.Equal(t, BreakerClosed, r.breaker.state)
+}
+
+func TestRetryBudget(t *testing.T) {
+	r := NewRetrier(&LocalFS{dir: t.Name()}, RetryConfig{
+		Attempts:         100,
+		Interval:         time.Microsecond,
+		MaxInterval:      4 * time.Microsecond,
+		BreakerThreshold: 1000,
+	})
+	calls := 0
+	err := r.Do(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("network error")
+	})
+	assert.NotNil(t, err)
+	// 10 retries are always allowed, plus 20% of requests.
+	assert.Equal(t, 1+11, calls)
+
+	backoff := r.backoff(20)
+	assert.True(t, backoff >= r.config.MaxInterval/2 && backoff <= r.config.MaxInterval)
+}
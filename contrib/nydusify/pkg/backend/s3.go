@@ -0,0 +1,607 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+)
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+
+	// Instance metadata service (IMDSv2) used to get IAM role credentials
+	// when running on EC2 instance.
+	s3MetadataEndpoint = "http://169.254.169.254"
+	// ECS task role credentials endpoint, see `AWS_CONTAINER_CREDENTIALS_RELATIVE_URI`.
+	s3ContainerMetadataEndpoint = "http://169.254.170.2"
+)
+
+type S3Config struct {
+	Endpoint        string `json:"endpoint"`
+	Scheme          string `json:"scheme"`
+	Region          string `json:"region"`
+	BucketName      string `json:"bucket_name"`
+	ObjectPrefix    string `json:"object_prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret"`
+	SessionToken    string `json:"session_token"`
+	// Use `scheme://endpoint/bucket/key` instead of `scheme://bucket.endpoint/key`,
+	// it's required by most of S3 compatible storage such as MinIO and Ceph RGW.
+	ForcePathStyle bool `json:"force_path_style"`
+	// Proxy overrides the default proxy for requests to bucket.
+	proxy.Config
+	// TransportConfig tunes the connections to bucket.
+	TransportConfig
+}
+
+type s3Credentials struct {
+	AccessKeyID     string
+	AccessKeySecret string
+	SessionToken    string
+	// Zero value means the credentials never expire.
+	Expiration time.Time
+}
+
+// s3CredentialsProvider gets credentials in the order: static config,
+// environment variables, ECS task role, EC2 instance IAM role.
+type s3CredentialsProvider struct {
+	mu     sync.Mutex
+	static *s3Credentials
+	cached *s3Credentials
+	client *http.Client
+}
+
+type S3 struct {
+	objectPrefix   string
+	bucketName     string
+	endpoint       string
+	scheme         string
+	region         string
+	forcePathStyle bool
+	credentials    *s3CredentialsProvider
+	client         *http.Client
+}
+
+func newS3Backend(rawConfig []byte) (*S3, error) {
+	var config S3Config
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return nil, errors.Wrap(err, "Parse S3 storage backend configuration")
+	}
+
+	if config.BucketName == "" {
+		return nil, fmt.Errorf("no bucket is specified")
+	}
+	if config.Region == "" {
+		config.Region = os.Getenv("AWS_REGION")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("s3.%s.amazonaws.com", config.Region)
+	}
+	if config.Scheme == "" {
+		config.Scheme = "https"
+	}
+
+	proxyConfig, err := proxy.BackendConfig(config.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse S3 storage backend proxy")
+	}
+	client := newHTTPClient(proxyConfig, config.TransportConfig, 0)
+
+	var static *s3Credentials
+	if config.AccessKeyID != "" && config.AccessKeySecret != "" {
+		static = &s3Credentials{
+			AccessKeyID:     config.AccessKeyID,
+			AccessKeySecret: config.AccessKeySecret,
+			SessionToken:    config.SessionToken,
+		}
+	}
+
+	return &S3{
+		objectPrefix:   config.ObjectPrefix,
+		bucketName:     config.BucketName,
+		endpoint:       config.Endpoint,
+		scheme:         config.Scheme,
+		region:         config.Region,
+		forcePathStyle: config.ForcePathStyle,
+		credentials: &s3CredentialsProvider{
+			static: static,
+			client: &http.Client{Timeout: 10 * time.Second},
+		},
+		client: client,
+	}, nil
+}
+
+func (p *s3CredentialsProvider) fetchContainerCredentials(ctx context.Context, relativeURI string) (*s3Credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s3ContainerMetadataEndpoint+relativeURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.fetchRoleCredentials(req)
+}
+
+func (p *s3CredentialsProvider) fetchInstanceCredentials(ctx context.Context) (*s3Credentials, error) {
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, s3MetadataEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := p.client.Do(tokenReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "get instance metadata token")
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "read instance metadata token")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get instance metadata token: unexpected status %d", resp.StatusCode)
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s3MetadataEndpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return req, nil
+	}
+
+	roleReq, err := get("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	resp, err = p.client.Do(roleReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "get instance IAM role")
+	}
+	role, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "read instance IAM role")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get instance IAM role: unexpected status %d", resp.StatusCode)
+	}
+
+	credReq, err := get("/latest/meta-data/iam/security-credentials/" + strings.TrimSpace(string(role)))
+	if err != nil {
+		return nil, err
+	}
+	return p.fetchRoleCredentials(credReq)
+}
+
+func (p *s3CredentialsProvider) fetchRoleCredentials(req *http.Request) (*s3Credentials, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get role credentials")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get role credentials: unexpected status %d", resp.StatusCode)
+	}
+
+	var creds struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string `json:"SecretAccessKey"`
+		Token           string `json:"Token"`
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, errors.Wrap(err, "decode role credentials")
+	}
+
+	return &s3Credentials{
+		AccessKeyID:     creds.AccessKeyID,
+		AccessKeySecret: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expiration:      creds.Expiration,
+	}, nil
+}
+
+// Get returns valid credentials, the credentials of IAM role will be
+// refreshed 5 minutes before expiration.
+func (p *s3CredentialsProvider) Get(ctx context.Context) (*s3Credentials, error) {
+	if p.static != nil {
+		return p.static, nil
+	}
+
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &s3Credentials{
+			AccessKeyID:     id,
+			AccessKeySecret: secret,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cached != nil && time.Until(p.cached.Expiration) > 5*time.Minute {
+		return p.cached, nil
+	}
+
+	var creds *s3Credentials
+	var err error
+	if relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relativeURI != "" {
+		creds, err = p.fetchContainerCredentials(ctx, relativeURI)
+	} else {
+		creds, err = p.fetchInstanceCredentials(ctx)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "no available S3 credentials")
+	}
+	p.cached = creds
+
+	return creds, nil
+}
+
+func s3HmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		segments[idx] = strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3SignRequest signs the request in place using AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func s3SignRequest(req *http.Request, creds *s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	date := now.UTC().Format(s3DateFormat)
+
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	canonicalQuery := make([]string, 0, len(queryKeys))
+	for _, key := range queryKeys {
+		for _, value := range query[key] {
+			canonicalQuery = append(canonicalQuery, s3EscapePath(key)+"="+s3EscapePath(value))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, "s3", "aws4_request"}, "/")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	signingKey := s3HmacSHA256([]byte("AWS4"+creds.AccessKeySecret), date)
+	signingKey = s3HmacSHA256(signingKey, region)
+	signingKey = s3HmacSHA256(signingKey, "s3")
+	signingKey = s3HmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func (b *S3) objectURL(key string, query url.Values) *url.URL {
+	u := &url.URL{
+		Scheme: b.scheme,
+		Host:   b.bucketName + "." + b.endpoint,
+		Path:   "/" + key,
+	}
+	if b.forcePathStyle {
+		u.Host = b.endpoint
+		u.Path = "/" + b.bucketName + "/" + key
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return u
+}
+
+func (b *S3) do(
+	ctx context.Context, method, key string, query url.Values, body io.Reader, size int64,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, b.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	creds, err := b.credentials.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s3SignRequest(req, creds, b.region, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		err := fmt.Errorf("%s %s: unexpected status %d: %s", method, key, resp.StatusCode, string(msg))
+		// Only network error and server side error are retryable.
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			err = Permanent(err)
+		}
+		return resp, err
+	}
+
+	return resp, nil
+}
+
+func (b *S3) putObject(ctx context.Context, key, blobPath string, size int64) error {
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	resp, err := b.do(ctx, http.MethodPut, key, nil, file, size)
+	if err != nil {
+		return errors.Wrap(err, "put object")
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func (b *S3) multipartUpload(ctx context.Context, key, blobPath string, size int64) error {
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": []string{""}}, nil, 0)
+	if err != nil {
+		return errors.Wrap(err, "initiate multipart upload")
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return errors.Wrap(err, "decode multipart upload response")
+	}
+	uploadID := initiated.UploadID
+
+	partSize := size / splitPartsCount
+	parts := make([]s3CompletedPart, splitPartsCount)
+
+	g, gctx := errgroup.WithContext(ctx)
+	for idx := 0; idx < splitPartsCount; idx++ {
+		number := idx + 1
+		offset := int64(idx) * partSize
+		length := partSize
+		if number == splitPartsCount {
+			length = size - offset
+		}
+		g.Go(func() error {
+			file, err := os.Open(blobPath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			query := url.Values{
+				"partNumber": []string{strconv.Itoa(number)},
+				"uploadId":   []string{uploadID},
+			}
+			resp, err := b.do(gctx, http.MethodPut, key, query, io.NewSectionReader(file, offset, length), length)
+			if err != nil {
+				return errors.Wrapf(err, "upload part %d", number)
+			}
+			resp.Body.Close()
+			parts[number-1] = s3CompletedPart{
+				PartNumber: number,
+				ETag:       resp.Header.Get("ETag"),
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		if resp, err := b.do(ctx, http.MethodDelete, key, url.Values{"uploadId": []string{uploadID}}, nil, 0); err == nil {
+			resp.Body.Close()
+		}
+		return errors.Wrap(err, "Uploading parts failed")
+	}
+
+	completeBody, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err = b.do(
+		ctx, http.MethodPost, key, url.Values{"uploadId": []string{uploadID}},
+		bytes.NewReader(completeBody), int64(len(completeBody)),
+	)
+	if err != nil {
+		return errors.Wrap(err, "complete multipart upload")
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Upload blob as image layer to S3 backend. Depending on blob's size,
+// upload it by multiparts method or the normal method.
+func (b *S3) Upload(ctx context.Context, blobID, blobPath string, size int64, forcePush bool) (*ocispec.Descriptor, error) {
+	blobObjectKey := b.objectPrefix + blobID
+
+	desc := blobDesc(size, blobID)
+
+	if !forcePush {
+		if exist, err := b.Check(blobID); err != nil {
+			return nil, err
+		} else if exist {
+			logger.Infof("Skip upload because blob exists: %s", blobID)
+			return &desc, nil
+		}
+	}
+
+	stat, err := os.Stat(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	blobSize := stat.Size()
+
+	start := time.Now()
+	if blobSize >= multipartsUploadThreshold {
+		logger.Debugf("Upload %s using multiparts method", blobObjectKey)
+		err = b.multipartUpload(ctx, blobObjectKey, blobPath, blobSize)
+	} else {
+		err = b.putObject(ctx, blobObjectKey, blobPath, blobSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf("Uploading blob %s costs %s", blobObjectKey, time.Since(start))
+
+	return &desc, nil
+}
+
+func (b *S3) Check(blobID string) (bool, error) {
+	resp, err := b.do(context.Background(), http.MethodHead, b.objectPrefix+blobID, nil, nil, 0)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (b *S3) Type() Type {
+	return S3Backend
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3) List(ctx context.Context) ([]BlobObject, error) {
+	blobs := []BlobObject{}
+	query := url.Values{
+		"list-type": []string{"2"},
+		"prefix":    []string{b.objectPrefix},
+		"delimiter": []string{"/"},
+	}
+	for {
+		resp, err := b.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "list objects")
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "decode list objects response")
+		}
+		for _, object := range result.Contents {
+			if id, ok := blobIDFromKey(b.objectPrefix, object.Key); ok {
+				blobs = append(blobs, BlobObject{ID: id, Size: object.Size, LastModified: object.LastModified})
+			}
+		}
+		if !result.IsTruncated {
+			return blobs, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (b *S3) Delete(ctx context.Context, blobID string) error {
+	resp, err := b.do(ctx, http.MethodDelete, b.objectPrefix+blobID, nil, nil, 0)
+	if err != nil {
+		return errors.Wrap(err, "delete object")
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package batch converts the images listed in a batch file with global
+// concurrency control, a failed image doesn't stop the conversions of the
+// other images.
+package batch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Image is the mapping of source image to target image in batch file.
+type Image struct {
+	Source string `yaml:"source"`
+	// Target is the source image with the tag suffix of defaults if it's
+	// empty.
+	Target string `yaml:"target"`
+	// Args are the extra arguments of `nydusify convert` for the image,
+	// appended after the ones of defaults.
+	Args []string `yaml:"args"`
+}
+
+// Defaults are shared by all images in batch file.
+type Defaults struct {
+	TargetSuffix string   `yaml:"target_suffix"`
+	Args         []string `yaml:"args"`
+}
+
+// File is the batch file in YAML or JSON.
+type File struct {
+	Defaults Defaults `yaml:"defaults"`
+	// Concurrency is the number of images converted concurrently.
+	Concurrency int     `yaml:"concurrency"`
+	Images      []Image `yaml:"images"`
+}
+
+// Task is the conversion of an image with defaults applied.
+type Task struct {
+	Source string
+	Target string
+	Args   []string
+}
+
+// ParseFile loads the batch file, JSON is accepted as it's a subset of
+// YAML.
+func ParseFile(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read batch file")
+	}
+	var file File
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrap(err, "parse batch file")
+	}
+	return &file, nil
+}
+
+// Tasks applies the defaults to images, the target images should be
+// different from each other.
+func (file *File) Tasks() ([]Task, error) {
+	if len(file.Images) == 0 {
+		return nil, fmt.Errorf("no image in batch file")
+	}
+
+	tasks := []Task{}
+	targets := map[string]int{}
+	for idx, image := range file.Images {
+		if image.Source == "" {
+			return nil, fmt.Errorf("image %d should specify source", idx)
+		}
+		target := image.Target
+		if target == "" {
+			if file.Defaults.TargetSuffix == "" {
+				return nil, fmt.Errorf("image %d should specify target, or target_suffix should be specified in defaults", idx)
+			}
+			target = image.Source + file.Defaults.TargetSuffix
+		}
+		if _, err := docker.ParseDockerRef(target); err != nil {
+			return nil, errors.Wrapf(err, "invalid target of image %d", idx)
+		}
+		if prev, ok := targets[target]; ok {
+			return nil, fmt.Errorf("image %d and %d have the same target %s", prev, idx, target)
+		}
+		targets[target] = idx
+
+		args := append([]string{}, file.Defaults.Args...)
+		tasks = append(tasks, Task{
+			Source: image.Source,
+			Target: target,
+			Args:   append(args, image.Args...),
+		})
+	}
+
+	return tasks, nil
+}
+
+// ConvertFunc converts the idx-th task.
+type ConvertFunc func(ctx context.Context, idx int, task Task) error
+
+// ExecConvert returns a ConvertFunc which runs `nydusify convert` by the
+// binary in a separate process for each task, with the work directory and
+// output log in workDir. The work directory of failed task is kept, so a
+// re-run of the batch resumes from the checkpoint.
+func ExecConvert(binary, workDir string) ConvertFunc {
+	return func(ctx context.Context, idx int, task Task) error {
+		taskDir := filepath.Join(workDir, fmt.Sprintf("image-%d", idx))
+		logPath := LogPath(workDir, idx)
+		logFile, err := os.Create(logPath)
+		if err != nil {
+			return errors.Wrap(err, "create log")
+		}
+		defer logFile.Close()
+
+		cmd := exec.CommandContext(ctx, binary, append([]string{
+			"convert",
+			"--source", task.Source,
+			"--target", task.Target,
+			"--work-dir", taskDir,
+		}, task.Args...)...)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "run convert, see %s", logPath)
+		}
+		return os.RemoveAll(taskDir)
+	}
+}
+
+// LogPath returns the output log of the idx-th task by ExecConvert.
+func LogPath(workDir string, idx int) string {
+	return filepath.Join(workDir, fmt.Sprintf("image-%d.log", idx))
+}
+
+// Result is the status of a task.
+type Result struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Succeeded bool   `json:"succeeded"`
+	Error     string `json:"error,omitempty"`
+	// Duration of conversion in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// Report summarizes the results of batch.
+type Report struct {
+	Total     int      `json:"total"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	Results   []Result `json:"results"`
+}
+
+// Run converts the tasks with concurrency, the tasks not started are
+// failed once ctx is done.
+func Run(ctx context.Context, tasks []Task, concurrency int, convert ConvertFunc) *Report {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	report := &Report{
+		Total:   len(tasks),
+		Results: make([]Result, len(tasks)),
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for idx := range tasks {
+		idx, task := idx, tasks[idx]
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			start := time.Now()
+			err := ctx.Err()
+			if err == nil {
+				err = convert(ctx, idx, task)
+			}
+			result := Result{
+				Source:    task.Source,
+				Target:    task.Target,
+				Succeeded: err == nil,
+				Duration:  time.Since(start).Seconds(),
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			report.Results[idx] = result
+			if err != nil {
+				report.Results[idx].Error = err.Error()
+				report.Failed++
+				logrus.Errorf("[%d/%d] Failed to convert %s to %s: %s",
+					report.Succeeded+report.Failed, report.Total, task.Source, task.Target, err)
+				return
+			}
+			report.Succeeded++
+			logrus.Infof("[%d/%d] Converted %s to %s in %.1fs",
+				report.Succeeded+report.Failed, report.Total, task.Source, task.Target, result.Duration)
+		}()
+	}
+	wg.Wait()
+
+	return report
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package batch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-batch-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "batch.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`
+defaults:
+  target_suffix: -nydus
+  args: ["--compressor", "lz4_block"]
+concurrency: 4
+images:
+  - source: example.com/app:v1
+  - source: example.com/web:v1
+    target: example.com/nydus/web:v1
+    args: ["--platform", "linux/arm64"]
+`), 0644))
+	file, err := ParseFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, file.Concurrency)
+	tasks, err := file.Tasks()
+	assert.Nil(t, err)
+	assert.Equal(t, []Task{
+		{Source: "example.com/app:v1", Target: "example.com/app:v1-nydus", Args: []string{"--compressor", "lz4_block"}},
+		{Source: "example.com/web:v1", Target: "example.com/nydus/web:v1", Args: []string{"--compressor", "lz4_block", "--platform", "linux/arm64"}},
+	}, tasks)
+
+	// JSON is also accepted.
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"images": [{"source": "example.com/app:v1"}]}`), 0644))
+	file, err = ParseFile(path)
+	assert.Nil(t, err)
+	_, err = file.Tasks()
+	assert.NotNil(t, err)
+
+	file.Images = append(file.Images, file.Images[0])
+	file.Defaults.TargetSuffix = "-nydus"
+	_, err = file.Tasks()
+	assert.NotNil(t, err)
+}
+
+func TestRun(t *testing.T) {
+	tasks := []Task{}
+	for i := 0; i < 10; i++ {
+		tasks = append(tasks, Task{Source: fmt.Sprintf("example.com/app:v%d", i), Target: fmt.Sprintf("example.com/app:v%d-nydus", i)})
+	}
+
+	var running, maxRunning int32
+	report := Run(context.Background(), tasks, 3, func(ctx context.Context, idx int, task Task) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		if idx%4 == 0 {
+			return fmt.Errorf("push failed")
+		}
+		return nil
+	})
+	assert.LessOrEqual(t, int(maxRunning), 3)
+	assert.Equal(t, 10, report.Total)
+	assert.Equal(t, 3, report.Failed)
+	assert.Equal(t, 7, report.Succeeded)
+	assert.Equal(t, "example.com/app:v4", report.Results[4].Source)
+	assert.Equal(t, "push failed", report.Results[4].Error)
+	assert.True(t, report.Results[5].Succeeded)
+}
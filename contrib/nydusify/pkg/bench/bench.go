@@ -0,0 +1,283 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package bench cold-starts Nydus image by Nydusd with an empty blob cache,
+// reads the files of an access trace (or all files) from the mountpoint,
+// and reports the startup latency and the data fetched from storage
+// backend, so that the images built with different chunk sizes or
+// compressors can be compared.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mount"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/prefetch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+type Opt struct {
+	Target         string
+	TargetInsecure bool
+	ExpectedArch   string
+	NydusdPath     string
+	// BackendType defaults to registry, the backend config is generated
+	// from target reference if unset.
+	BackendType    string
+	BackendConfig  string
+	PrefetchPolicy prefetch.Policy
+	// Trace is the files to read in order after the image is mounted, the
+	// absolute paths in image rootfs, e.g. the list generated by `nydusify
+	// prefetch`. All regular files are read in walk order if empty.
+	Trace []string
+}
+
+// Result is the report of a cold start, the durations are in seconds from
+// the start of benchmark.
+type Result struct {
+	Image string `json:"image"`
+	// TimeToReady is the time to pull bootstrap and get Nydusd running.
+	TimeToReady float64 `json:"time_to_ready"`
+	// TimeToFirstByte is the time to read the first byte of files.
+	TimeToFirstByte float64 `json:"time_to_first_byte"`
+	// TimeToFinish is the time to read all files of trace.
+	TimeToFinish float64 `json:"time_to_finish"`
+	FilesRead    int     `json:"files_read"`
+	// FilesMissing are the files of trace not found in image.
+	FilesMissing int   `json:"files_missing"`
+	BytesRead    int64 `json:"bytes_read"`
+	// ImageSize is the total size of Nydus blobs in image.
+	ImageSize int64 `json:"image_size"`
+	// BytesFetched is the amount of data read from storage backend,
+	// including prefetch.
+	BytesFetched uint64  `json:"bytes_fetched"`
+	FetchRatio   float64 `json:"fetch_ratio"`
+	CacheReads   uint64  `json:"cache_reads"`
+	CacheHits    uint64  `json:"cache_hits"`
+	CacheHitRate float64 `json:"cache_hit_rate"`
+}
+
+// backendMetrics is the subset of `/api/v1/metrics/backend` of Nydusd.
+type backendMetrics struct {
+	ReadAmountTotal uint64 `json:"read_amount_total"`
+}
+
+// blobcacheMetrics is the subset of `/api/v1/metrics/blobcache` of Nydusd.
+type blobcacheMetrics struct {
+	PartialHits uint64 `json:"partial_hits"`
+	WholeHits   uint64 `json:"whole_hits"`
+	Total       uint64 `json:"total"`
+}
+
+func ratio(numerator, denominator float64) float64 {
+	if denominator == 0 {
+		return 0
+	}
+	return numerator / denominator
+}
+
+func (result *Result) setMetrics(backend backendMetrics, blobcache blobcacheMetrics) {
+	result.BytesFetched = backend.ReadAmountTotal
+	result.FetchRatio = ratio(float64(backend.ReadAmountTotal), float64(result.ImageSize))
+	result.CacheReads = blobcache.Total
+	result.CacheHits = blobcache.PartialHits + blobcache.WholeHits
+	result.CacheHitRate = ratio(float64(result.CacheHits), float64(result.CacheReads))
+}
+
+// readStats is the result of reading files from mountpoint.
+type readStats struct {
+	files        int
+	missing      int
+	bytes        int64
+	firstByteAt  time.Time
+	finishedAt   time.Time
+	firstByteSet bool
+}
+
+func (stats *readStats) readFile(path string, buf []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			if !stats.firstByteSet {
+				stats.firstByteAt = time.Now()
+				stats.firstByteSet = true
+			}
+			stats.bytes += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	stats.files++
+
+	return nil
+}
+
+// replay reads the files of trace under root in order, or all regular files
+// if the trace is empty. The missing files and non-regular files of trace
+// are skipped.
+func replay(ctx context.Context, root string, trace []string) (*readStats, error) {
+	stats := &readStats{}
+	buf := make([]byte, 1<<20)
+
+	if len(trace) == 0 {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if err := stats.readFile(path, buf); err != nil {
+				return errors.Wrapf(err, "read %s", path)
+			}
+			return nil
+		})
+		stats.finishedAt = time.Now()
+		return stats, err
+	}
+
+	for _, name := range trace {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(root, filepath.Clean("/"+name))
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			logrus.Debugf("Skip %s in trace: not a regular file in image", name)
+			stats.missing++
+			continue
+		}
+		if err := stats.readFile(path, buf); err != nil {
+			return nil, errors.Wrapf(err, "read %s", name)
+		}
+	}
+	stats.finishedAt = time.Now()
+
+	return stats, nil
+}
+
+// fetchMetrics gets the metrics of Nydusd from API socket, the only RAFS
+// instance is used without `id` parameter.
+func fetchMetrics(ctx context.Context, apiSock, name string, metrics interface{}) error {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				dialer := &net.Dialer{Timeout: 5 * time.Second}
+				return dialer.DialContext(ctx, "unix", apiSock)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unix/api/v1/metrics/"+name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request Nydusd API")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "read Nydusd API response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s metrics from Nydusd: %s %s", name, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return errors.Wrapf(json.Unmarshal(body, metrics), "unmarshal %s metrics", name)
+}
+
+// Run mounts the image in a temporary directory removed after benchmark,
+// so that all data is fetched from storage backend.
+func Run(ctx context.Context, opt Opt) (*Result, error) {
+	dir, err := ioutil.TempDir("", "nydusify-bench-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create work directory")
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	mounter, err := mount.Mount(ctx, mount.Opt{
+		WorkDir:        filepath.Join(dir, "work"),
+		Target:         opt.Target,
+		TargetInsecure: opt.TargetInsecure,
+		ExpectedArch:   opt.ExpectedArch,
+		NydusdPath:     opt.NydusdPath,
+		BackendType:    opt.BackendType,
+		BackendConfig:  opt.BackendConfig,
+		PrefetchPolicy: opt.PrefetchPolicy,
+		Mountpoint:     filepath.Join(dir, "mnt"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := mounter.Umount(); err != nil {
+			logrus.Warnf("Umount benchmarked image: %s", err)
+		}
+	}()
+
+	result := &Result{
+		Image:       opt.Target,
+		TimeToReady: time.Since(start).Seconds(),
+	}
+	for _, layer := range mounter.Image().Manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+			result.ImageSize += layer.Size
+		}
+	}
+
+	stats, err := replay(ctx, mounter.Mountpoint, opt.Trace)
+	if err != nil {
+		return nil, errors.Wrap(err, "replay access trace")
+	}
+	result.FilesRead = stats.files
+	result.FilesMissing = stats.missing
+	result.BytesRead = stats.bytes
+	if stats.firstByteSet {
+		result.TimeToFirstByte = stats.firstByteAt.Sub(start).Seconds()
+	}
+	result.TimeToFinish = stats.finishedAt.Sub(start).Seconds()
+
+	var backend backendMetrics
+	if err := fetchMetrics(ctx, mounter.APISock(), "backend", &backend); err != nil {
+		return nil, err
+	}
+	var blobcache blobcacheMetrics
+	if err := fetchMetrics(ctx, mounter.APISock(), "blobcache", &blobcache); err != nil {
+		return nil, err
+	}
+	result.setMetrics(backend, blobcache)
+
+	return result, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package bench
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplay(t *testing.T) {
+	root, err := ioutil.TempDir("", "nydusify-bench-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	for name, content := range map[string]string{
+		"bin/app":      "0123456789",
+		"etc/app.conf": "conf",
+		"empty":        "",
+	} {
+		path := filepath.Join(root, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	assert.Nil(t, os.Symlink("app", filepath.Join(root, "bin/link")))
+
+	stats, err := replay(context.Background(), root, []string{"/bin/app", "/bin/link", "/missing", "/etc", "/etc/app.conf"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.files)
+	assert.Equal(t, 3, stats.missing)
+	assert.Equal(t, int64(14), stats.bytes)
+	assert.True(t, stats.firstByteSet)
+	assert.False(t, stats.finishedAt.Before(stats.firstByteAt))
+
+	// All regular files are read without trace.
+	stats, err = replay(context.Background(), root, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, stats.files)
+	assert.Equal(t, 0, stats.missing)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = replay(ctx, root, []string{"/bin/app"})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSetMetrics(t *testing.T) {
+	result := &Result{ImageSize: 1000}
+	result.setMetrics(backendMetrics{ReadAmountTotal: 250}, blobcacheMetrics{PartialHits: 1, WholeHits: 2, Total: 4})
+	assert.Equal(t, uint64(250), result.BytesFetched)
+	assert.Equal(t, 0.25, result.FetchRatio)
+	assert.Equal(t, uint64(3), result.CacheHits)
+	assert.Equal(t, 0.75, result.CacheHitRate)
+
+	// No division by zero for empty image.
+	result = &Result{}
+	result.setMetrics(backendMetrics{ReadAmountTotal: 1}, blobcacheMetrics{})
+	assert.Equal(t, 0.0, result.FetchRatio)
+	assert.Equal(t, 0.0, result.CacheHitRate)
+}
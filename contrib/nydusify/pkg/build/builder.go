@@ -5,14 +5,18 @@
 package build
 
 import (
+	"context"
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
-	"github.com/sirupsen/logrus"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/logging"
 )
 
+var logger = logging.Module(logging.ModuleBuild)
+
 type BuilderOption struct {
 	ParentBootstrapPath string
 	ChunkDict           string
@@ -26,6 +30,16 @@ type BuilderOption struct {
 	// A regular file or fifo into which commands nydus-image to dump contents.
 	BlobPath     string
 	AlignedChunk bool
+	// Algorithm to compress chunk data, use the default of nydus-image if empty.
+	Compressor string
+	// Level of zstd compressor, 0 is the default level.
+	CompressLevel int
+	// Store the already compressed files without compression.
+	CompressAuto bool
+	// ID of the key to encrypt chunk data, and the key provider
+	// configuration file to get the key, no encryption if empty.
+	EncryptKeyID string
+	KeyProvider  string
 }
 
 type Builder struct {
@@ -42,8 +56,9 @@ func NewBuilder(binaryPath string) *Builder {
 	}
 }
 
-// Run exec nydus-image CLI to build layer
-func (builder *Builder) Run(option BuilderOption) error {
+// Run exec nydus-image CLI to build layer, nydus-image is killed if ctx is
+// canceled.
+func (builder *Builder) Run(ctx context.Context, option BuilderOption) error {
 	var args []string
 	if option.ParentBootstrapPath == "" {
 		args = []string{
@@ -62,6 +77,19 @@ func (builder *Builder) Run(option BuilderOption) error {
 	if option.ChunkDict != "" {
 		args = append(args, "--chunk-dict", option.ChunkDict)
 	}
+	if option.Compressor != "" {
+		args = append(args, "--compressor", option.Compressor)
+	}
+	if option.CompressLevel != 0 {
+		args = append(args, "--compress-level", strconv.Itoa(option.CompressLevel))
+	}
+	if option.CompressAuto {
+		args = append(args, "--compress-auto")
+	}
+	if option.EncryptKeyID != "" {
+		// Chunk encryption is only supported by RAFS v5.
+		args = append(args, "--fs-version", "5", "--encrypt-key-id", option.EncryptKeyID, "--key-provider", option.KeyProvider)
+	}
 
 	args = append(
 		args,
@@ -82,9 +110,9 @@ func (builder *Builder) Run(option BuilderOption) error {
 		args = append(args, "--prefetch-policy", "fs")
 	}
 
-	logrus.Debugf("\tCommand: %s %s", builder.binaryPath, strings.Join(args[:], " "))
+	logger.Debugf("\tCommand: %s %s", builder.binaryPath, strings.Join(args[:], " "))
 
-	cmd := exec.Command(builder.binaryPath, args...)
+	cmd := exec.CommandContext(ctx, builder.binaryPath, args...)
 	cmd.Stdout = builder.stdout
 	cmd.Stderr = builder.stderr
 
@@ -97,7 +125,7 @@ func (builder *Builder) Run(option BuilderOption) error {
 	stdin.Close()
 
 	if err := cmd.Run(); err != nil {
-		logrus.WithError(err).Errorf("fail to run %v %+v", builder.binaryPath, args)
+		logger.WithError(err).Errorf("fail to run %v %+v", builder.binaryPath, args)
 		return err
 	}
 
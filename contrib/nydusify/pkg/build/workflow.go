@@ -5,6 +5,7 @@
 package build
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,7 +14,6 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 type WorkflowOption struct {
@@ -21,6 +21,11 @@ type WorkflowOption struct {
 	TargetDir      string
 	NydusImagePath string
 	PrefetchDir    string
+	Compressor     string
+	CompressLevel  int
+	CompressAuto   bool
+	EncryptKeyID   string
+	KeyProvider    string
 }
 
 type Workflow struct {
@@ -102,7 +107,7 @@ func NewWorkflow(option WorkflowOption) (*Workflow, error) {
 
 // Build nydus bootstrap and blob, returned blobPath's basename is sha256 hex string
 func (workflow *Workflow) Build(
-	layerDir, whiteoutSpec, parentBootstrapPath, bootstrapPath string, alignedChunk bool,
+	ctx context.Context, layerDir, whiteoutSpec, parentBootstrapPath, bootstrapPath string, alignedChunk bool,
 ) (string, error) {
 	workflow.bootstrapPath = bootstrapPath
 
@@ -112,7 +117,7 @@ func (workflow *Workflow) Build(
 
 	blobPath := filepath.Join(workflow.blobsDir, uuid.NewString())
 
-	if err := workflow.builder.Run(BuilderOption{
+	if err := workflow.builder.Run(ctx, BuilderOption{
 		ParentBootstrapPath: workflow.parentBootstrapPath,
 		BootstrapPath:       workflow.bootstrapPath,
 		RootfsPath:          layerDir,
@@ -122,6 +127,11 @@ func (workflow *Workflow) Build(
 		BlobPath:            blobPath,
 		AlignedChunk:        alignedChunk,
 		ChunkDict:           workflow.ChunkDict,
+		Compressor:          workflow.Compressor,
+		CompressLevel:       workflow.CompressLevel,
+		CompressAuto:        workflow.CompressAuto,
+		EncryptKeyID:        workflow.EncryptKeyID,
+		KeyProvider:         workflow.KeyProvider,
 	}); err != nil {
 		return "", errors.Wrapf(err, "build layer %s", layerDir)
 	}
@@ -133,7 +143,7 @@ func (workflow *Workflow) Build(
 		return "", errors.Wrap(err, "get latest blob")
 	}
 
-	logrus.Debugf("original: %s. digested: %s", blobPath, digestedBlobPath)
+	logger.Debugf("original: %s. digested: %s", blobPath, digestedBlobPath)
 
 	// Ignore the empty blob file generated by this build.
 	blobInfo, err := os.Stat(blobPath)
@@ -159,7 +169,7 @@ func (workflow *Workflow) Build(
 		if err != nil && err != os.ErrExist {
 			return "", err
 		} else if err == os.ErrExist {
-			logrus.Warnf("Same blob %s are generated", digestedBlobPath)
+			logger.Warnf("Same blob %s are generated", digestedBlobPath)
 			return "", nil
 		}
 	}
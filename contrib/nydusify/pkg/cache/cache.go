@@ -14,9 +14,9 @@ import (
 	"strconv"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/logging"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
-	"github.com/sirupsen/logrus"
 
 	"github.com/containerd/containerd/images"
 	digest "github.com/opencontainers/go-digest"
@@ -25,6 +25,8 @@ import (
 	"github.com/pkg/errors"
 )
 
+var logger = logging.Module(logging.ModuleCache)
+
 // Opt configures Nydus cache
 type Opt struct {
 	// Maximum records(bootstrap layer + blob layer) in cache image.
@@ -96,7 +98,7 @@ func (cache *Cache) recordToLayer(record *Record) (*ocispec.Descriptor, *ocispec
 	if record.NydusBlobDesc != nil {
 		// Record blob layer to cache image if the blob be pushed
 		// to registry instead of storage backend.
-		if cache.opt.Backend.Type() == backend.RegistryBackend {
+		if backend.InRegistry(cache.opt.Backend.Type()) {
 			blobCacheDesc = &ocispec.Descriptor{
 				MediaType: utils.MediaTypeNydusBlob,
 				Digest:    record.NydusBlobDesc.Digest,
@@ -106,6 +108,9 @@ func (cache *Cache) recordToLayer(record *Record) (*ocispec.Descriptor, *ocispec
 					utils.LayerAnnotationNydusSourceChainID: record.SourceChainID.String(),
 				},
 			}
+			if cid := record.NydusBlobDesc.Annotations[utils.LayerAnnotationNydusBlobCID]; cid != "" {
+				blobCacheDesc.Annotations[utils.LayerAnnotationNydusBlobCID] = cid
+			}
 		} else {
 			bootstrapCacheDesc.Annotations[utils.LayerAnnotationNydusBlobDigest] = record.NydusBlobDesc.Digest.String()
 			bootstrapCacheDesc.Annotations[utils.LayerAnnotationNydusBlobSize] = strconv.FormatInt(record.NydusBlobDesc.Size, 10)
@@ -199,6 +204,9 @@ func (cache *Cache) layerToRecord(layer *ocispec.Descriptor) *Record {
 				utils.LayerAnnotationNydusBlob: "true",
 			},
 		}
+		if cid := layer.Annotations[utils.LayerAnnotationNydusBlobCID]; cid != "" {
+			nydusBlobDesc.Annotations[utils.LayerAnnotationNydusBlobCID] = cid
+		}
 		return &Record{
 			SourceChainID: sourceChainID,
 			NydusBlobDesc: nydusBlobDesc,
@@ -242,7 +250,7 @@ func (cache *Cache) importRecordsFromLayers(layers []ocispec.Descriptor) {
 			pulledRecords[record.SourceChainID] = newRecord
 			pushedRecords = append(pushedRecords, newRecord)
 		} else {
-			logrus.Warnf("Strange! Build cache layer can't produce a valid record. %s", layer.Digest)
+			logger.Warnf("Strange! Build cache layer can't produce a valid record. %s", layer.Digest)
 		}
 	}
 
@@ -272,7 +280,7 @@ func (cache *Cache) Export(ctx context.Context) error {
 		if diffID.Validate() == nil {
 			diffIDs = append(diffIDs, diffID)
 		} else {
-			logrus.Warn("Drop the entire diff id list due to an invalid diff id")
+			logger.Warn("Drop the entire diff id list due to an invalid diff id")
 			diffIDs = []digest.Digest{}
 			// It is possible that some existing cache images don't have diff ids,
 			// but we can't break the cache export, so just break the loop.
@@ -388,7 +396,7 @@ func (cache *Cache) Check(ctx context.Context, layerChainID digest.Digest) (*Rec
 
 	// Check blob layer on cache
 	if record.NydusBlobDesc != nil {
-		if cache.opt.Backend.Type() == backend.RegistryBackend {
+		if backend.InRegistry(cache.opt.Backend.Type()) {
 			blobReader, err := cache.remote.Pull(ctx, *record.NydusBlobDesc, true)
 			if err != nil {
 				return nil, nil, nil, errors.Wrap(err, "Check blob layer")
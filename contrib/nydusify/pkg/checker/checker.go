@@ -12,10 +12,14 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/rule"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/tool"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/prefetch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signature"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
 
 // Opt defines Checker options.
@@ -32,6 +36,11 @@ type Opt struct {
 	BackendType    string
 	BackendConfig  string
 	ExpectedArch   string
+	// PrefetchPolicy is used to mount Nydus image by Nydusd, which is
+	// overridden by the policy in bootstrap layer annotation.
+	PrefetchPolicy prefetch.Policy
+	// Verify cosign signature of target image before mounting it if specified.
+	SignatureVerifier *signature.Verifier
 }
 
 // Checker validates Nydus image manifest, bootstrap and mounts filesystem
@@ -78,6 +87,12 @@ func New(opt Opt) (*Checker, error) {
 // Check checks Nydus image, and outputs image information to work
 // directory, the check workflow is composed of various rules.
 func (checker *Checker) Check(ctx context.Context) error {
+	if checker.SignatureVerifier != nil {
+		if err := checker.SignatureVerifier.Verify(ctx, checker.targetParser.Remote); err != nil {
+			return errors.Wrap(err, "verify signature of Nydus image")
+		}
+	}
+
 	targetParsed, err := checker.targetParser.Parse(ctx)
 	if err != nil {
 		return errors.Wrap(err, "parse Nydus image")
@@ -105,6 +120,22 @@ func (checker *Checker) Check(ctx context.Context) error {
 		return errors.Wrap(err, "output image information")
 	}
 
+	prefetchPolicy, err := checker.prefetchPolicy(targetParsed)
+	if err != nil {
+		return err
+	}
+
+	var storageBackend backend.Backend
+	if checker.BackendType != "" {
+		// The backend config of Nydusd may have the fields unknown to
+		// nydusify, only the blobs in manifest are checked then.
+		storageBackend, err = backend.NewBackend(checker.BackendType, []byte(checker.BackendConfig), checker.targetParser.Remote)
+		if err != nil {
+			logrus.Warnf("Skip checking blobs in storage backend: %s", err)
+			storageBackend = nil
+		}
+	}
+
 	rules := []rule.Rule{
 		&rule.ManifestRule{
 			SourceParsed:  sourceParsed,
@@ -113,6 +144,11 @@ func (checker *Checker) Check(ctx context.Context) error {
 			BackendType:   checker.BackendType,
 			ExpectedArch:  checker.ExpectedArch,
 		},
+		&rule.ReferenceRule{
+			Parsed:  targetParsed,
+			Remote:  checker.targetParser.Remote,
+			Backend: storageBackend,
+		},
 		&rule.BootstrapRule{
 			Parsed:          targetParsed,
 			NydusImagePath:  checker.NydusImagePath,
@@ -124,14 +160,15 @@ func (checker *Checker) Check(ctx context.Context) error {
 			Source:          checker.Source,
 			SourceMountPath: filepath.Join(checker.WorkDir, "fs/source_mounted"),
 			NydusdConfig: tool.NydusdConfig{
-				NydusdPath:    checker.NydusdPath,
-				BackendType:   checker.BackendType,
-				BackendConfig: checker.BackendConfig,
-				BootstrapPath: filepath.Join(checker.WorkDir, "nydus_bootstrap"),
-				ConfigPath:    filepath.Join(checker.WorkDir, "fs/nydusd_config.json"),
-				BlobCacheDir:  filepath.Join(checker.WorkDir, "fs/nydus_blobs"),
-				MountPath:     filepath.Join(checker.WorkDir, "fs/nydus_mounted"),
-				APISockPath:   filepath.Join(checker.WorkDir, "fs/nydus_api.sock"),
+				NydusdPath:     checker.NydusdPath,
+				BackendType:    checker.BackendType,
+				BackendConfig:  checker.BackendConfig,
+				BootstrapPath:  filepath.Join(checker.WorkDir, "nydus_bootstrap"),
+				ConfigPath:     filepath.Join(checker.WorkDir, "fs/nydusd_config.json"),
+				BlobCacheDir:   filepath.Join(checker.WorkDir, "fs/nydus_blobs"),
+				MountPath:      filepath.Join(checker.WorkDir, "fs/nydus_mounted"),
+				APISockPath:    filepath.Join(checker.WorkDir, "fs/nydus_api.sock"),
+				PrefetchPolicy: prefetchPolicy,
 			},
 		},
 	}
@@ -146,3 +183,21 @@ func (checker *Checker) Check(ctx context.Context) error {
 
 	return nil
 }
+
+// prefetchPolicy resolves the prefetch policy to mount Nydus image, the
+// annotation of bootstrap layer takes precedence over checker option.
+func (checker *Checker) prefetchPolicy(parsed *parser.Parsed) (prefetch.Policy, error) {
+	var annotations map[string]string
+	if parsed.NydusImage != nil {
+		for _, layer := range parsed.NydusImage.Manifest.Layers {
+			if layer.Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+				annotations = layer.Annotations
+			}
+		}
+	}
+	policy, err := prefetch.ResolvePolicy(checker.PrefetchPolicy, annotations, prefetch.PolicyBackground)
+	if err != nil {
+		return "", errors.Wrap(err, "resolve prefetch policy")
+	}
+	return policy, nil
+}
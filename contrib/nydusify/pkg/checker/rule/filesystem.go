@@ -67,7 +67,7 @@ func hashFile(path string) ([]byte, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "read file during hashing file")
 		}
-		if _, err := hasher.Write(buf); err != nil {
+		if _, err := hasher.Write(buf[:n]); err != nil {
 			return nil, errors.Wrap(err, "calculate hash of file")
 		}
 	}
@@ -214,6 +214,8 @@ func (rule *FilesystemRule) verify() error {
 		return errors.Wrap(err, "walk rootfs of source image")
 	}
 
+	logrus.Infof("Comparing %d files in source image with %d files in Nydus image", len(sourceNodes), len(nydusNodes))
+
 	for path, sourceNode := range sourceNodes {
 		nydusNode, exist := nydusNodes[path]
 		if !exist {
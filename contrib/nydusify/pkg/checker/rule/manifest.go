@@ -70,6 +70,12 @@ func (rule *ManifestRule) Validate() error {
 			if layer.Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
 				return errors.New("invalid bootstrap layer in nydus image manifest")
 			}
+			// The version isn't annotated by the images converted before.
+			switch version := layer.Annotations[utils.LayerAnnotationNydusFsVersion]; version {
+			case "", "5", "6":
+			default:
+				return errors.Errorf("unsupported RAFS version %s of bootstrap layer in nydus image manifest", version)
+			}
 		} else {
 			if layer.MediaType != utils.MediaTypeNydusBlob ||
 				layer.Annotations[utils.LayerAnnotationNydusBlob] != "true" {
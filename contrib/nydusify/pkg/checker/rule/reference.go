@@ -0,0 +1,106 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// ReferenceRule ensures the config and layers in Nydus manifest, and the
+// blobs recorded in bootstrap layer annotation are available, so that the
+// image doesn't fail on the first read of a missing blob at runtime.
+type ReferenceRule struct {
+	Parsed *parser.Parsed
+	Remote *remote.Remote
+	// Backend checks the blobs not in manifest, skipped if nil.
+	Backend backend.Backend
+}
+
+func (rule *ReferenceRule) Name() string {
+	return "Reference"
+}
+
+// fetch reads the first byte of blob, the registry may not send a request
+// until the read.
+func (rule *ReferenceRule) fetch(ctx context.Context, desc ocispec.Descriptor) error {
+	reader, err := rule.Remote.Pull(ctx, desc, true)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if _, err := io.CopyN(ioutil.Discard, reader, 1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (rule *ReferenceRule) Validate() error {
+	logrus.Infof("Checking Nydus image references")
+
+	if rule.Parsed.NydusImage == nil {
+		return errors.New("invalid nydus image manifest")
+	}
+	ctx := context.Background()
+	manifest := rule.Parsed.NydusImage.Manifest
+
+	descs := append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)
+	inManifest := map[string]bool{}
+	var blobIDs []string
+	for _, desc := range descs {
+		if err := rule.fetch(ctx, desc); err != nil {
+			return errors.Wrapf(err, "fetch %s referenced by manifest", desc.Digest)
+		}
+		inManifest[desc.Digest.Hex()] = true
+		if annotation, ok := desc.Annotations[utils.LayerAnnotationNydusBlobIDs]; ok {
+			if err := json.Unmarshal([]byte(annotation), &blobIDs); err != nil {
+				return errors.Wrapf(err, "invalid annotation %s", utils.LayerAnnotationNydusBlobIDs)
+			}
+		}
+	}
+
+	for _, blobID := range blobIDs {
+		if inManifest[blobID] {
+			continue
+		}
+		if rule.Backend == nil {
+			logrus.Debugf("Skip checking blob %s without storage backend", blobID)
+			continue
+		}
+		if backend.InRegistry(rule.Backend.Type()) {
+			desc := ocispec.Descriptor{
+				MediaType: utils.MediaTypeNydusBlob,
+				Digest:    digest.NewDigestFromHex(string(digest.SHA256), blobID),
+			}
+			if err := rule.fetch(ctx, desc); err != nil {
+				return errors.Wrapf(err, "fetch blob %s from registry", blobID)
+			}
+			continue
+		}
+		exist, err := rule.Backend.Check(blobID)
+		if err != nil {
+			return errors.Wrapf(err, "check blob %s in storage backend", blobID)
+		}
+		if !exist {
+			return errors.Errorf("blob %s isn't found in storage backend", blobID)
+		}
+	}
+
+	logrus.Infof("Verified %d references in manifest and %d blobs", len(descs), len(blobIDs))
+
+	return nil
+}
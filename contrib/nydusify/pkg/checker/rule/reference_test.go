@@ -0,0 +1,88 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package rule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestReferenceRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-reference-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r, err := remote.NewLayout("oci:" + filepath.Join(dir, "layout") + ":v1")
+	assert.Nil(t, err)
+	push := func(data string) ocispec.Descriptor {
+		desc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString(data),
+			Size:      int64(len(data)),
+		}
+		assert.Nil(t, r.Push(ctx, desc, true, bytes.NewReader([]byte(data))))
+		return desc
+	}
+
+	storeDir := filepath.Join(dir, "store")
+	b, err := backend.NewBackend("localfs", []byte(fmt.Sprintf(`{"dir":%q}`, storeDir)), nil)
+	assert.Nil(t, err)
+	blobPath := filepath.Join(dir, "blob")
+	assert.Nil(t, ioutil.WriteFile(blobPath, []byte("blob"), 0644))
+	_, err = b.Upload(ctx, digest.FromString("a").Hex(), blobPath, 4, false)
+	assert.Nil(t, err)
+
+	blobIDs, err := json.Marshal([]string{digest.FromString("a").Hex()})
+	assert.Nil(t, err)
+	bootstrap := push("bootstrap")
+	bootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusBlobIDs:   string(blobIDs),
+	}
+	parsed := &parser.Parsed{
+		NydusImage: &parser.Image{
+			Manifest: ocispec.Manifest{
+				Config: push("config"),
+				Layers: []ocispec.Descriptor{bootstrap},
+			},
+		},
+	}
+
+	rule := &ReferenceRule{Parsed: parsed, Remote: r, Backend: b}
+	assert.Nil(t, rule.Validate())
+
+	// Blobs aren't checked without backend.
+	blobIDs, err = json.Marshal([]string{digest.FromString("b").Hex()})
+	assert.Nil(t, err)
+	bootstrap.Annotations[utils.LayerAnnotationNydusBlobIDs] = string(blobIDs)
+	parsed.NydusImage.Manifest.Layers = []ocispec.Descriptor{bootstrap}
+	assert.NotNil(t, rule.Validate())
+	rule.Backend = nil
+	assert.Nil(t, rule.Validate())
+
+	// Layers in manifest must exist.
+	parsed.NydusImage.Manifest.Layers = append(parsed.NydusImage.Manifest.Layers, ocispec.Descriptor{
+		MediaType: utils.MediaTypeNydusBlob,
+		Digest:    digest.FromString("missing"),
+		Size:      7,
+	})
+	assert.NotNil(t, rule.Validate())
+}
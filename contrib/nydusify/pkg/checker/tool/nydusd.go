@@ -12,16 +12,23 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"text/template"
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/prefetch"
 )
 
 type NydusdConfig struct {
+	// PrefetchPolicy defaults to background prefetch, prefetch is always
+	// disabled without storage backend.
+	PrefetchPolicy prefetch.Policy
 	EnablePrefetch bool
+	PrefetchAll    bool
 	NydusdPath     string
 	BootstrapPath  string
 	ConfigPath     string
@@ -60,39 +67,51 @@ var configTpl = `
 	"fs_prefetch": {
 		"enable": {{.EnablePrefetch}},
 		"threads_count": 10,
-		"merging_size": 131072
+		"merging_size": 131072,
+		"prefetch_all": {{.PrefetchAll}}
 	},
 	"digest_validate": true,
 	"enable_xattr": true
 }
 `
 
-func makeConfig(conf NydusdConfig) error {
+func renderConfig(conf NydusdConfig) ([]byte, error) {
 	tpl := template.Must(template.New("").Parse(configTpl))
 
 	var ret bytes.Buffer
 	if conf.BackendType == "" {
 		conf.BackendType = "localfs"
 		conf.BackendConfig = `{"dir": "/fake"}`
-		conf.EnablePrefetch = false
-	} else {
-		conf.EnablePrefetch = true
+		conf.PrefetchPolicy = prefetch.PolicyOnDemand
+	} else if conf.PrefetchPolicy == "" {
+		conf.PrefetchPolicy = prefetch.PolicyBackground
 	}
+	conf.EnablePrefetch = conf.PrefetchPolicy.Enabled()
+	conf.PrefetchAll = conf.PrefetchPolicy.PrefetchAll()
 	if err := tpl.Execute(&ret, conf); err != nil {
-		return errors.New("prepare config template for Nydusd")
+		return nil, errors.New("prepare config template for Nydusd")
 	}
 
-	if err := ioutil.WriteFile(conf.ConfigPath, ret.Bytes(), 0644); err != nil {
+	return ret.Bytes(), nil
+}
+
+func makeConfig(conf NydusdConfig) error {
+	// Nydusd without bootstrap mounts RAFS instances by API later.
+	if conf.BootstrapPath == "" {
+		return nil
+	}
+	config, err := renderConfig(conf)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(conf.ConfigPath, config, 0644); err != nil {
 		return errors.New("write config file for Nydusd")
 	}
 
 	return nil
 }
 
-// Wait until Nydusd ready by checking daemon state RUNNING
-func checkReady(ctx context.Context, sock string) (<-chan bool, error) {
-	ready := make(chan bool)
-
+func newAPIClient(sock string) *http.Client {
 	transport := &http.Transport{
 		MaxIdleConns:          10,
 		IdleConnTimeout:       10 * time.Second,
@@ -106,10 +125,16 @@ func checkReady(ctx context.Context, sock string) (<-chan bool, error) {
 		},
 	}
 
-	client := &http.Client{
+	return &http.Client{
 		Timeout:   30 * time.Second,
 		Transport: transport,
 	}
+}
+
+// Wait until Nydusd ready by checking daemon state RUNNING
+func checkReady(ctx context.Context, sock string) (<-chan bool, error) {
+	ready := make(chan bool)
+	client := newAPIClient(sock)
 
 	go func() {
 		for {
@@ -158,17 +183,16 @@ func (nydusd *Nydusd) Mount() error {
 	nydusd.Umount()
 
 	args := []string{
-		"--config",
-		nydusd.ConfigPath,
 		"--mountpoint",
 		nydusd.MountPath,
-		"--bootstrap",
-		nydusd.BootstrapPath,
 		"--apisock",
 		nydusd.APISockPath,
 		"--log-level",
 		"error",
 	}
+	if nydusd.BootstrapPath != "" {
+		args = append(args, "--config", nydusd.ConfigPath, "--bootstrap", nydusd.BootstrapPath)
+	}
 
 	cmd := exec.Command(nydusd.NydusdPath, args...)
 	cmd.Stdout = os.Stdout
@@ -201,6 +225,44 @@ func (nydusd *Nydusd) Mount() error {
 	return nil
 }
 
+type mountRequest struct {
+	Source string `json:"source"`
+	FsType string `json:"fs_type"`
+	Config string `json:"config"`
+}
+
+// MountRafs mounts the bootstrap of conf at the subdirectory mountpoint
+// (e.g. `/app`) of the running Nydusd by API, the storage backend, blob
+// cache and prefetch of the RAFS instance are configured by conf.
+func (nydusd *Nydusd) MountRafs(mountpoint string, conf NydusdConfig) error {
+	config, err := renderConfig(conf)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(mountRequest{
+		Source: conf.BootstrapPath,
+		FsType: "rafs",
+		Config: string(config),
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal mount request")
+	}
+
+	client := newAPIClient(nydusd.APISockPath)
+	apiURL := "http://unix/api/v1/mount?mountpoint=" + url.QueryEscape(mountpoint)
+	resp, err := client.Post(apiURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "request Nydusd API")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("mount %s by Nydusd API: %s %s", mountpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
 func (nydusd *Nydusd) Umount() error {
 	if _, err := os.Stat(nydusd.MountPath); err == nil {
 		cmd := exec.Command("umount", nydusd.MountPath)
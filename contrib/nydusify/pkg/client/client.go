@@ -0,0 +1,318 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package client is the Go API to convert images to Nydus images and mount
+// Nydus images in process, for the tools embedding nydusify instead of
+// running its CLI and parsing the output. The API is kept compatible across
+// releases, new options are added as fields whose zero value keeps the
+// previous behavior.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/mount"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/prefetch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+// StageEvent is emitted when a stage of conversion is started and finished.
+type StageEvent = progress.StageEvent
+
+// ProgressEvent is emitted when a layer is processed or a blob is uploaded.
+type ProgressEvent = progress.ProgressEvent
+
+// EventHandler receives the *StageEvent and *ProgressEvent of conversion,
+// it's called serially and should return quickly.
+type EventHandler func(event interface{})
+
+type Opt struct {
+	// NydusImagePath and NydusdPath are the paths of nydus-image and
+	// nydusd binaries, they are searched in PATH if unset.
+	NydusImagePath string
+	NydusdPath     string
+	// WorkDir contains the temporary directories of conversions and
+	// mounts, the system temporary directory is used if unset.
+	WorkDir string
+}
+
+// Client converts and mounts images, it's safe for concurrent use.
+type Client struct {
+	opt Opt
+}
+
+func New(opt Opt) (*Client, error) {
+	if opt.WorkDir != "" {
+		if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+			return nil, errors.Wrap(err, "create work directory")
+		}
+	}
+	return &Client{opt: opt}, nil
+}
+
+func lookPath(path, name string) (string, error) {
+	if path == "" {
+		path = name
+	}
+	found, err := exec.LookPath(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "find %s binary", name)
+	}
+	return found, nil
+}
+
+func defaultPlatform(platform string) string {
+	if platform == "" {
+		return "linux/" + runtime.GOARCH
+	}
+	return platform
+}
+
+func newRemote(ref string, insecure bool, auth string) (*remote.Remote, error) {
+	if auth == "" {
+		return provider.DefaultRemote(ref, insecure)
+	}
+	return provider.DefaultRemoteWithAuth(ref, insecure, auth)
+}
+
+// canceled returns the error of ctx if it's canceled or timed out, which
+// may cause err, so that callers can check it by errors.Is.
+func canceled(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), err.Error())
+	}
+	return err
+}
+
+type ConvertOpt struct {
+	Source string
+	Target string
+	// SourceAuth and TargetAuth are base64 encoded `username:password`,
+	// the docker config is used if unset.
+	SourceAuth     string
+	TargetAuth     string
+	SourceInsecure bool
+	TargetInsecure bool
+	// Platform of source image to convert, defaults to linux with the
+	// architecture of current process.
+	Platform string
+
+	// BackendType defaults to registry, the blobs are pushed to target
+	// repository.
+	BackendType   string
+	BackendConfig string
+	// Compressor is the algorithm to compress chunk data in blob, uses the
+	// default of nydus-image if unset, see `nydus-image create --compressor`.
+	Compressor string
+	// PrefetchPatterns are the paths to prefetch separated by new line.
+	PrefetchPatterns string
+	// PrefetchPolicy is written to Nydus image, see `prefetch.Policy`.
+	PrefetchPolicy string
+	DockerV2Format bool
+	// Flatten merges all source layers into one Nydus layer.
+	Flatten bool
+	// WhiteoutStrategy and HardlinkStrategy are preserve (default) or
+	// resolve, see `provider.Strategy`.
+	WhiteoutStrategy string
+	HardlinkStrategy string
+	// MaxConcurrency limits the number of layers pulled or pushed
+	// concurrently, uses the default of converter if zero.
+	MaxConcurrency uint
+
+	// OnEvent receives the progress of conversion, the stages are logged
+	// by logrus if unset.
+	OnEvent EventHandler
+}
+
+type ConvertResult struct {
+	Target string
+	// Manifest is the descriptor of pushed Nydus manifest.
+	Manifest ocispec.Descriptor
+	Duration time.Duration
+}
+
+// Convert converts the source image and pushes Nydus image to target, the
+// conversion is aborted once ctx is canceled.
+func (client *Client) Convert(ctx context.Context, opt ConvertOpt) (*ConvertResult, error) {
+	if opt.Source == "" || opt.Target == "" {
+		return nil, fmt.Errorf("source and target are required")
+	}
+	if _, err := prefetch.ParsePolicy(opt.PrefetchPolicy); err != nil {
+		return nil, err
+	}
+	whiteoutStrategy, err := provider.ParseStrategy(opt.WhiteoutStrategy)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse whiteout strategy")
+	}
+	hardlinkStrategy, err := provider.ParseStrategy(opt.HardlinkStrategy)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse hardlink strategy")
+	}
+	if opt.BackendType == "" {
+		opt.BackendType = "registry"
+	}
+	nydusImagePath, err := lookPath(client.opt.NydusImagePath, "nydus-image")
+	if err != nil {
+		return nil, err
+	}
+
+	workDir, err := ioutil.TempDir(client.opt.WorkDir, "nydusify-convert-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create work directory")
+	}
+	defer os.RemoveAll(workDir)
+	sourceDir := filepath.Join(workDir, "source")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create source directory")
+	}
+
+	sourceRemote, err := newRemote(opt.Source, opt.SourceInsecure, opt.SourceAuth)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse source reference")
+	}
+	targetRemote, err := newRemote(opt.Target, opt.TargetInsecure, opt.TargetAuth)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse target reference")
+	}
+
+	logger, err := provider.DefaultLogger()
+	if err != nil {
+		return nil, err
+	}
+	var reporter *progress.Reporter
+	if opt.OnEvent != nil {
+		reporter = progress.NewHandlerReporter(progress.Handler(opt.OnEvent))
+		logger = reporter.Logger()
+	}
+
+	start := time.Now()
+	sourceProviders, err := provider.DefaultSource(ctx, sourceRemote, sourceDir, defaultPlatform(opt.Platform))
+	if err != nil {
+		return nil, canceled(ctx, errors.Wrap(err, "parse source image"))
+	}
+
+	cvt, err := converter.New(converter.Opt{
+		Logger:           logger,
+		SourceProviders:  sourceProviders,
+		TargetRemote:     targetRemote,
+		NydusImagePath:   nydusImagePath,
+		WorkDir:          workDir,
+		PrefetchDir:      opt.PrefetchPatterns,
+		PrefetchPolicy:   opt.PrefetchPolicy,
+		DockerV2Format:   opt.DockerV2Format,
+		BackendType:      opt.BackendType,
+		BackendConfig:    opt.BackendConfig,
+		Compressor:       opt.Compressor,
+		Flatten:          opt.Flatten,
+		WhiteoutStrategy: whiteoutStrategy,
+		HardlinkStrategy: hardlinkStrategy,
+		Source:           opt.Source,
+		MaxConcurrency:   opt.MaxConcurrency,
+		Progress:         reporter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cvt.Convert(ctx); err != nil {
+		return nil, canceled(ctx, err)
+	}
+
+	result := &ConvertResult{
+		Target:   targetRemote.Ref,
+		Duration: time.Since(start),
+	}
+	if desc := cvt.Manifest(); desc != nil {
+		result.Manifest = *desc
+	}
+	return result, nil
+}
+
+type MountOpt struct {
+	Target         string
+	TargetInsecure bool
+	// Platform of Nydus image to mount, defaults to linux with the
+	// architecture of current process.
+	Platform   string
+	Mountpoint string
+	// BackendType defaults to registry, the backend config is generated
+	// from target reference with the docker config if unset.
+	BackendType   string
+	BackendConfig string
+	// PrefetchPolicy overrides the policy written in Nydus image, see
+	// `prefetch.Policy`.
+	PrefetchPolicy string
+}
+
+// Mount is a Nydus image mounted by Nydusd.
+type Mount struct {
+	mounter *mount.Mounter
+	workDir string
+}
+
+// Mount mounts the Nydus image read-only at mountpoint, the blobs are
+// fetched on demand, Umount should be called to stop Nydusd.
+func (client *Client) Mount(ctx context.Context, opt MountOpt) (*Mount, error) {
+	if opt.Target == "" || opt.Mountpoint == "" {
+		return nil, fmt.Errorf("target and mountpoint are required")
+	}
+	_, arch, err := provider.ExtractOsArch(defaultPlatform(opt.Platform))
+	if err != nil {
+		return nil, err
+	}
+	policy, err := prefetch.ParsePolicy(opt.PrefetchPolicy)
+	if err != nil {
+		return nil, err
+	}
+	nydusdPath, err := lookPath(client.opt.NydusdPath, "nydusd")
+	if err != nil {
+		return nil, err
+	}
+
+	workDir, err := ioutil.TempDir(client.opt.WorkDir, "nydusify-mount-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create work directory")
+	}
+	mounter, err := mount.Mount(ctx, mount.Opt{
+		WorkDir:        workDir,
+		Target:         opt.Target,
+		TargetInsecure: opt.TargetInsecure,
+		ExpectedArch:   arch,
+		NydusdPath:     nydusdPath,
+		BackendType:    opt.BackendType,
+		BackendConfig:  opt.BackendConfig,
+		PrefetchPolicy: policy,
+		Mountpoint:     opt.Mountpoint,
+	})
+	if err != nil {
+		os.RemoveAll(workDir)
+		return nil, canceled(ctx, err)
+	}
+
+	return &Mount{mounter: mounter, workDir: workDir}, nil
+}
+
+func (m *Mount) Mountpoint() string {
+	return m.mounter.Mountpoint
+}
+
+// Umount stops Nydusd and removes the work directory of mount.
+func (m *Mount) Umount() error {
+	if err := m.mounter.Umount(); err != nil {
+		return err
+	}
+	return errors.Wrap(os.RemoveAll(m.workDir), "remove work directory")
+}
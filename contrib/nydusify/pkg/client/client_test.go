@@ -0,0 +1,64 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-client-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	workDir := filepath.Join(dir, "work")
+	client, err := New(Opt{
+		NydusImagePath: filepath.Join(dir, "nydus-image"),
+		WorkDir:        workDir,
+	})
+	assert.Nil(t, err)
+
+	opt := ConvertOpt{Source: "localhost:1/app:v1", Target: "localhost:1/app:v1-nydus"}
+	_, err = client.Convert(context.Background(), ConvertOpt{Source: opt.Source})
+	assert.NotNil(t, err)
+	_, err = client.Convert(context.Background(), opt)
+	assert.Contains(t, err.Error(), "find nydus-image binary")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "nydus-image"), []byte("#!/bin/sh\n"), 0755))
+	opt.PrefetchPolicy = "lazy"
+	_, err = client.Convert(context.Background(), opt)
+	assert.NotNil(t, err)
+
+	// The canceled conversion is reported by the error of context.
+	opt.PrefetchPolicy = ""
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.Convert(ctx, opt)
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	// The temporary directory of conversion is removed.
+	entries, err := ioutil.ReadDir(workDir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 0)
+}
+
+func TestMount(t *testing.T) {
+	client, err := New(Opt{NydusdPath: "/nonexistent/nydusd"})
+	assert.Nil(t, err)
+
+	_, err = client.Mount(context.Background(), MountOpt{Target: "localhost:1/app:v1-nydus"})
+	assert.NotNil(t, err)
+	_, err = client.Mount(context.Background(), MountOpt{Target: "localhost:1/app:v1-nydus", Mountpoint: "/mnt", Platform: "linux"})
+	assert.NotNil(t, err)
+	_, err = client.Mount(context.Background(), MountOpt{Target: "localhost:1/app:v1-nydus", Mountpoint: "/mnt"})
+	assert.Contains(t, err.Error(), "find nydusd binary")
+}
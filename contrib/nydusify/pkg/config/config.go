@@ -0,0 +1,298 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package config loads the declarative config file of nydusify commands,
+// which sets the flags of each command in one YAML (or JSON) file, with
+// environment variable substitution. The flags specified in command line
+// or environment variables override the config file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Kind is the value type of flag.
+type Kind int
+
+const (
+	String Kind = iota
+	Bool
+	Int
+	Uint
+	Float
+	Duration
+	StringSlice
+)
+
+// Flag is the schema of a flag in config file.
+type Flag struct {
+	Name string
+	Kind Kind
+	// TakesFile means the value is the path of an existing file.
+	TakesFile bool
+	// Choices are the possible values of string flag, any value is
+	// accepted if it's empty.
+	Choices []string
+}
+
+// Schema is the flags of commands, a subcommand is named after its parent
+// command, e.g. `dedup inspect`.
+type Schema map[string][]Flag
+
+// Value is the parsed value of flag, only the field of flag kind is set.
+type Value struct {
+	String   string
+	Bool     bool
+	Int      int64
+	Uint     uint64
+	Float    float64
+	Duration time.Duration
+	Strings  []string
+}
+
+// File is the config file, mapping commands to their flags.
+type File struct {
+	Path     string
+	Commands map[string]map[string]interface{}
+}
+
+// Expand substitutes `${VAR}` and `${VAR:-default}` in data by lookup,
+// `$$` is an escaped `$`. It fails on undefined variables without default.
+func Expand(data string, lookup func(string) (string, bool)) (string, error) {
+	var result strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] != '$' || i+1 >= len(data) {
+			result.WriteByte(data[i])
+			continue
+		}
+		switch data[i+1] {
+		case '$':
+			result.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(data[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unclosed variable at offset %d", i)
+			}
+			expr := data[i+2 : i+end]
+			name, def, hasDefault := expr, "", false
+			if idx := strings.Index(expr, ":-"); idx >= 0 {
+				name, def, hasDefault = expr[:idx], expr[idx+2:], true
+			}
+			value, ok := lookup(name)
+			if !ok || (value == "" && hasDefault) {
+				if !hasDefault {
+					return "", fmt.Errorf("environment variable %s isn't set", name)
+				}
+				value = def
+			}
+			result.WriteString(value)
+			i += end
+		default:
+			result.WriteByte('$')
+		}
+	}
+	return result.String(), nil
+}
+
+// Load reads the config file with the environment variables substituted.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read config file")
+	}
+	expanded, err := Expand(string(data), os.LookupEnv)
+	if err != nil {
+		return nil, errors.Wrapf(err, "substitute environment variables in %s", path)
+	}
+	file := &File{Path: path, Commands: map[string]map[string]interface{}{}}
+	if err := yaml.Unmarshal([]byte(expanded), &file.Commands); err != nil {
+		return nil, errors.Wrapf(err, "parse config file %s", path)
+	}
+	return file, nil
+}
+
+func scalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// Parse validates the value in config file against flag.
+func (flag *Flag) Parse(value interface{}) (*Value, error) {
+	result := &Value{}
+	s, isScalar := scalar(value)
+
+	switch flag.Kind {
+	case String:
+		if !isScalar {
+			// The JSON config of flag (e.g. `backend-config`) can be
+			// written as a mapping in config file.
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, fmt.Errorf("should be a string or JSON object: %s", err)
+			}
+			s = string(data)
+		}
+		if len(flag.Choices) > 0 {
+			valid := false
+			for _, choice := range flag.Choices {
+				valid = valid || s == choice
+			}
+			if !valid {
+				return nil, fmt.Errorf("should be one of %v, got %q", flag.Choices, s)
+			}
+		}
+		result.String = s
+	case Bool:
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("should be true or false")
+		}
+		result.Bool = v
+	case Int, Uint:
+		v, err := strconv.ParseInt(s, 10, 64)
+		if !isScalar || err != nil {
+			return nil, fmt.Errorf("should be an integer")
+		}
+		if flag.Kind == Uint {
+			if v < 0 {
+				return nil, fmt.Errorf("should not be negative")
+			}
+			result.Uint = uint64(v)
+		}
+		result.Int = v
+	case Float:
+		v, err := strconv.ParseFloat(s, 64)
+		if !isScalar || err != nil {
+			return nil, fmt.Errorf("should be a number")
+		}
+		result.Float = v
+	case Duration:
+		v, err := time.ParseDuration(s)
+		if !isScalar || err != nil {
+			return nil, fmt.Errorf("should be a duration like 30s or 5m")
+		}
+		result.Duration = v
+	case StringSlice:
+		if isScalar {
+			result.Strings = []string{s}
+			break
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("should be a string or a list of strings")
+		}
+		result.Strings = []string{}
+		for _, item := range list {
+			s, ok := scalar(item)
+			if !ok {
+				return nil, fmt.Errorf("should be a list of strings")
+			}
+			result.Strings = append(result.Strings, s)
+		}
+	}
+
+	return result, nil
+}
+
+// checkFiles checks the files of flag exist.
+func (flag *Flag) checkFiles(value *Value) error {
+	if !flag.TakesFile {
+		return nil
+	}
+	paths := value.Strings
+	if flag.Kind == String {
+		paths = []string{value.String}
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); path != "" && err != nil {
+			return fmt.Errorf("file %s isn't accessible: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// Values returns the values of command flags in config file.
+func (file *File) Values(schema Schema, command string) (map[string]*Value, error) {
+	values := map[string]*Value{}
+	section, ok := file.Commands[command]
+	if !ok {
+		return values, nil
+	}
+	flags := map[string]*Flag{}
+	for idx := range schema[command] {
+		flags[schema[command][idx].Name] = &schema[command][idx]
+	}
+	for name, value := range section {
+		flag, ok := flags[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown flag %s", command, name)
+		}
+		parsed, err := flag.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", command, name, err)
+		}
+		values[name] = parsed
+	}
+	return values, nil
+}
+
+// Validate checks the commands and flags in config file against schema, as
+// well as the files of flags exist, all errors are returned in order of
+// command and flag name.
+func (file *File) Validate(schema Schema) []error {
+	errs := []error{}
+	commands := []string{}
+	for command := range file.Commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	for _, command := range commands {
+		if _, ok := schema[command]; !ok {
+			errs = append(errs, fmt.Errorf("unknown command %s", command))
+			continue
+		}
+		names := []string{}
+		for name := range file.Commands[command] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			single := &File{Commands: map[string]map[string]interface{}{
+				command: {name: file.Commands[command][name]},
+			}}
+			values, err := single.Values(schema, command)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for idx := range schema[command] {
+				flag := &schema[command][idx]
+				if flag.Name != name {
+					continue
+				}
+				if err := flag.checkFiles(values[name]); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s: %s", command, name, err))
+				}
+			}
+		}
+	}
+	return errs
+}
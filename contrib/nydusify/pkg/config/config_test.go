@@ -0,0 +1,124 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpand(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		if name == "REGISTRY" {
+			return "example.com", true
+		}
+		if name == "EMPTY" {
+			return "", true
+		}
+		return "", false
+	}
+
+	result, err := Expand("${REGISTRY}/app:${TAG:-latest} ${EMPTY:-x} $$HOME $1", lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com/app:latest x $HOME $1", result)
+
+	_, err = Expand("${TAG}", lookup)
+	assert.NotNil(t, err)
+	_, err = Expand("${REGISTRY", lookup)
+	assert.NotNil(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-config-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "nydusify.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`
+convert:
+  target-suffix: -nydus
+  compressor: ${COMPRESSOR:-lz4_block}
+  backend-config:
+    endpoint: ${NYDUSIFY_TEST_ENDPOINT}
+  docker-v2-format: true
+  chunk-size: 1048576
+  retry-interval: 30s
+  platform: [linux/amd64, linux/arm64]
+dedup inspect:
+  log-level: verbose
+  backend-config-file: missing.json
+unknown: {}
+`), 0644))
+
+	_, err = Load(path)
+	assert.NotNil(t, err)
+	os.Setenv("NYDUSIFY_TEST_ENDPOINT", "oss.example.com")
+	defer os.Unsetenv("NYDUSIFY_TEST_ENDPOINT")
+	file, err := Load(path)
+	assert.Nil(t, err)
+
+	schema := Schema{
+		"convert": {
+			{Name: "target-suffix"},
+			{Name: "compressor", Choices: []string{"none", "lz4_block", "zstd"}},
+			{Name: "backend-config"},
+			{Name: "docker-v2-format", Kind: Bool},
+			{Name: "chunk-size", Kind: Uint},
+			{Name: "retry-interval", Kind: Duration},
+			{Name: "platform", Kind: StringSlice},
+		},
+		"dedup inspect": {
+			{Name: "log-level", Choices: []string{"debug", "info"}},
+		},
+	}
+
+	values, err := file.Values(schema, "convert")
+	assert.Nil(t, err)
+	assert.Equal(t, "lz4_block", values["compressor"].String)
+	assert.Equal(t, `{"endpoint":"oss.example.com"}`, values["backend-config"].String)
+	assert.True(t, values["docker-v2-format"].Bool)
+	assert.Equal(t, uint64(1048576), values["chunk-size"].Uint)
+	assert.Equal(t, 30*time.Second, values["retry-interval"].Duration)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, values["platform"].Strings)
+
+	errs := file.Validate(schema)
+	assert.Len(t, errs, 3)
+	assert.Contains(t, errs[0].Error(), "dedup inspect: unknown flag backend-config-file")
+	assert.Contains(t, errs[1].Error(), "dedup inspect: log-level: should be one of")
+	assert.Equal(t, "unknown command unknown", errs[2].Error())
+
+	schema["dedup inspect"] = append(schema["dedup inspect"], Flag{Name: "backend-config-file", TakesFile: true})
+	errs = file.Validate(schema)
+	assert.Len(t, errs, 3)
+	assert.Contains(t, errs[0].Error(), "file missing.json isn't accessible")
+}
+
+func TestParse(t *testing.T) {
+	flag := Flag{Name: "chunk-size", Kind: Uint}
+	_, err := flag.Parse(-1)
+	assert.NotNil(t, err)
+	_, err = flag.Parse("1M")
+	assert.NotNil(t, err)
+
+	flag = Flag{Name: "retry-interval", Kind: Duration}
+	_, err = flag.Parse(30)
+	assert.NotNil(t, err)
+
+	flag = Flag{Name: "platform", Kind: StringSlice}
+	value, err := flag.Parse("linux/amd64")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"linux/amd64"}, value.Strings)
+	_, err = flag.Parse([]interface{}{map[string]interface{}{}})
+	assert.NotNil(t, err)
+
+	flag = Flag{Name: "flatten", Kind: Bool}
+	_, err = flag.Parse("yes")
+	assert.NotNil(t, err)
+}
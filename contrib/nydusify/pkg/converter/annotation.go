@@ -0,0 +1,70 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AnnotationOpt edits the annotations of Nydus manifest and the labels of
+// image config, which are copied from source image.
+type AnnotationOpt struct {
+	// Annotations and Labels are added to target, they override the ones
+	// copied from source, as well as the Nydus annotations.
+	Annotations map[string]string
+	Labels      map[string]string
+	// StripAnnotations and StripLabels are the keys not copied from source,
+	// a key ending with `*` matches the keys of the prefix, e.g.
+	// `org.opencontainers.image.*`.
+	StripAnnotations []string
+	StripLabels      []string
+}
+
+// ParseKeyValues parses the `key=value` pairs, an empty value is allowed.
+func ParseKeyValues(pairs []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		result[parts[0]] = parts[1]
+	}
+	return result, nil
+}
+
+func matchKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeAnnotations copies source without the stripped keys, then overrides
+// it by each of overrides in order. It returns nil if the result is empty.
+func mergeAnnotations(source map[string]string, strip []string, overrides ...map[string]string) map[string]string {
+	result := map[string]string{}
+	for key, value := range source {
+		if !matchKey(strip, key) {
+			result[key] = value
+		}
+	}
+	for _, override := range overrides {
+		for key, value := range override {
+			result[key] = value
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
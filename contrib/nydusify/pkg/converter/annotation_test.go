@@ -0,0 +1,35 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeAnnotations(t *testing.T) {
+	pairs, err := ParseKeyValues([]string{"team=infra", "empty=", "url=https://a.com/?x=1"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"team": "infra", "empty": "", "url": "https://a.com/?x=1"}, pairs)
+	_, err = ParseKeyValues([]string{"team"})
+	assert.NotNil(t, err)
+	_, err = ParseKeyValues([]string{"=infra"})
+	assert.NotNil(t, err)
+
+	source := map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/app",
+		"org.opencontainers.image.revision": "abc",
+		"com.example.build":                 "42",
+		"com.example.secret":                "x",
+	}
+	merged := mergeAnnotations(source, []string{"org.opencontainers.image.*", "com.example.secret"},
+		map[string]string{"com.example.build": "nydus"}, map[string]string{"team": "infra"})
+	assert.Equal(t, map[string]string{"com.example.build": "nydus", "team": "infra"}, merged)
+
+	assert.Equal(t, source, mergeAnnotations(source, nil))
+	assert.Nil(t, mergeAnnotations(source, []string{"*"}))
+	assert.Nil(t, mergeAnnotations(nil, nil, nil))
+}
@@ -0,0 +1,33 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+// attachArtifact pushes the data as the only layer of an artifact, which
+// refers to the pushed Nydus manifest.
+func (cvt *Converter) attachArtifact(
+	ctx context.Context, artifactType, mediaType string, data []byte, annotations map[string]string,
+) (*remote.Referrer, error) {
+	layer := ocispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      digest.FromBytes(data),
+		Size:        int64(len(data)),
+		Annotations: annotations,
+	}
+	if err := cvt.TargetRemote.Push(ctx, layer, true, bytes.NewReader(data)); err != nil {
+		return nil, errors.Wrap(err, "Push artifact layer")
+	}
+	return cvt.TargetRemote.Attach(ctx, *cvt.manifestDesc, artifactType, []ocispec.Descriptor{layer}, annotations)
+}
@@ -119,7 +119,7 @@ func (cg *cacheGlue) Push(ctx context.Context, layer *buildLayer) error {
 	}
 
 	// Push blob layer to cache image
-	if layer.backend.Type() == backend.RegistryBackend && layer.blobPath != "" {
+	if backend.InRegistry(layer.backend.Type()) && layer.blobPath != "" {
 		// FIXME: With registry storage backend, is it an error when `blobPath == ""`
 		blobFile, err := os.Open(layer.blobPath)
 		if err != nil {
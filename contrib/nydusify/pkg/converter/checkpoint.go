@@ -0,0 +1,166 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+)
+
+const checkpointVersion = 1
+
+// checkpointLayer is a layer whose bootstrap and blob have been pushed.
+type checkpointLayer struct {
+	Record cache.Record `json:"record"`
+	// Name of the bootstrap file in checkpoint directory, it's needed
+	// to build the child layers.
+	Bootstrap string `json:"bootstrap"`
+}
+
+type checkpointFile struct {
+	Version int `json:"version"`
+	// Fingerprint of the options affecting the built layers, the
+	// checkpoint is dropped once it's changed.
+	Fingerprint string            `json:"fingerprint"`
+	Layers      []checkpointLayer `json:"layers"`
+}
+
+// checkpoint persists the progress of conversion to work directory, so
+// that a re-run of the same conversion skips the layers pushed already.
+type checkpoint struct {
+	mutex sync.Mutex
+	dir   string
+	file  checkpointFile
+}
+
+func checkpointFingerprint(options ...string) string {
+	data, _ := json.Marshal(options)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// loadCheckpoint loads the checkpoint in `$workDir/checkpoint`, or starts
+// a new one if it doesn't exist or the fingerprint mismatches.
+func loadCheckpoint(workDir string, fingerprint string) (*checkpoint, error) {
+	cp := &checkpoint{
+		dir: filepath.Join(workDir, "checkpoint"),
+		file: checkpointFile{
+			Version:     checkpointVersion,
+			Fingerprint: fingerprint,
+		},
+	}
+
+	data, err := ioutil.ReadFile(cp.path())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Read checkpoint")
+	}
+	if err == nil {
+		var file checkpointFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			logrus.Warnf("Drop invalid checkpoint: %s", err)
+		} else if file.Version != checkpointVersion || file.Fingerprint != fingerprint {
+			logrus.Infof("Drop checkpoint of a different conversion")
+		} else {
+			cp.file = file
+			return cp, nil
+		}
+	}
+
+	if err := os.RemoveAll(cp.dir); err != nil {
+		return nil, errors.Wrap(err, "Remove checkpoint directory")
+	}
+	if err := os.MkdirAll(cp.dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create checkpoint directory")
+	}
+
+	return cp, nil
+}
+
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+func (cp *checkpoint) path() string {
+	return filepath.Join(cp.dir, "checkpoint.json")
+}
+
+// Get returns the checkpointed record and the bootstrap path of layer.
+func (cp *checkpoint) Get(chainID digest.Digest) (*cache.Record, string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	for _, layer := range cp.file.Layers {
+		if layer.Record.SourceChainID != chainID {
+			continue
+		}
+		bootstrapPath := filepath.Join(cp.dir, layer.Bootstrap)
+		if _, err := os.Stat(bootstrapPath); err != nil {
+			return nil, ""
+		}
+		record := layer.Record
+		return &record, bootstrapPath
+	}
+
+	return nil, ""
+}
+
+// Add records the layer once its bootstrap and blob are pushed.
+func (cp *checkpoint) Add(record cache.Record, bootstrapPath string) error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	name := record.SourceChainID.Hex()
+	if err := copyFile(bootstrapPath, filepath.Join(cp.dir, name)); err != nil {
+		return errors.Wrap(err, "Copy bootstrap to checkpoint")
+	}
+	cp.file.Layers = append(cp.file.Layers, checkpointLayer{
+		Record:    record,
+		Bootstrap: name,
+	})
+
+	data, err := json.Marshal(cp.file)
+	if err != nil {
+		return errors.Wrap(err, "Marshal checkpoint")
+	}
+	tmpPath := cp.path() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "Write checkpoint")
+	}
+	if err := os.Rename(tmpPath, cp.path()); err != nil {
+		return errors.Wrap(err, "Write checkpoint")
+	}
+
+	return nil
+}
+
+// Clear removes the checkpoint once the conversion is finished.
+func (cp *checkpoint) Clear() error {
+	return os.RemoveAll(cp.dir)
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
+)
+
+func TestCheckpoint(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-checkpoint-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	bootstrapPath := filepath.Join(workDir, "bootstrap")
+	assert.Nil(t, ioutil.WriteFile(bootstrapPath, []byte("bootstrap"), 0644))
+
+	fingerprint := checkpointFingerprint("source", "target")
+	cp, err := loadCheckpoint(workDir, fingerprint)
+	assert.Nil(t, err)
+
+	chainID := digest.FromString("layer")
+	record, _ := cp.Get(chainID)
+	assert.Nil(t, record)
+
+	bootstrapDesc := ocispec.Descriptor{Digest: digest.FromString("bootstrap")}
+	assert.Nil(t, cp.Add(cache.Record{
+		SourceChainID:        chainID,
+		NydusBootstrapDesc:   &bootstrapDesc,
+		NydusBootstrapDiffID: digest.FromString("diff"),
+	}, bootstrapPath))
+
+	// Resume from the checkpoint of same conversion.
+	cp, err = loadCheckpoint(workDir, fingerprint)
+	assert.Nil(t, err)
+	record, resumedPath := cp.Get(chainID)
+	assert.NotNil(t, record)
+	assert.Equal(t, bootstrapDesc.Digest, record.NydusBootstrapDesc.Digest)
+	data, err := ioutil.ReadFile(resumedPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "bootstrap", string(data))
+
+	// Checkpoint of different conversion is dropped.
+	cp, err = loadCheckpoint(workDir, checkpointFingerprint("source", "another"))
+	assert.Nil(t, err)
+	record, _ = cp.Get(chainID)
+	assert.Nil(t, record)
+
+	assert.Nil(t, cp.Clear())
+	_, err = os.Stat(filepath.Join(workDir, "checkpoint"))
+	assert.True(t, os.IsNotExist(err))
+}
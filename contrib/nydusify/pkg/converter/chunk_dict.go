@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/tool"
@@ -64,7 +65,7 @@ func parseArgs(args string) (chunkDictType string, from string, info string, err
 	return
 }
 
-func getChunkDictFromRegistry(prepareDir, imageName string, insecure bool, platform string) (string, error) {
+func getChunkDictFromRegistry(prepareDir, imageName string, insecure bool, osName, arch string) (string, error) {
 	// get bootstrap from registry
 	timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute) // 5 minutes timout
 	defer cancel()
@@ -72,7 +73,7 @@ func getChunkDictFromRegistry(prepareDir, imageName string, insecure bool, platf
 	if err != nil {
 		return "", err
 	}
-	p, err := parser.New(r, platform)
+	p, err := parser.NewWithPlatform(r, ocispec.Platform{OS: osName, Architecture: arch})
 	if err != nil {
 		return "", err
 	}
@@ -100,11 +101,11 @@ func (cvt *Converter) prepareBootstrap(prepareDir, from, info string) (string, [
 	if from == "local" {
 		target = info
 	} else {
-		_, arch, err := provider.ExtractOsArch(cvt.chunkDict.Platform)
+		osName, arch, err := provider.ExtractConvertibleOsArch(cvt.chunkDict.Platform)
 		if err != nil {
 			return "", []string{}, err
 		}
-		target, err = getChunkDictFromRegistry(prepareDir, info, cvt.chunkDict.Insecure, arch)
+		target, err = getChunkDictFromRegistry(prepareDir, info, cvt.chunkDict.Insecure, osName, arch)
 		if err != nil {
 			return "", []string{}, err
 		}
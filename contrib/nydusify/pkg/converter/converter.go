@@ -6,20 +6,29 @@ package converter
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/exitcode"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/sbom"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signature"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tarsplit"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tracing"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
 
@@ -76,6 +85,10 @@ type Opt struct {
 	NydusImagePath string
 	WorkDir        string
 	PrefetchDir    string
+	// PrefetchPolicy is written to bootstrap layer annotation of Nydus
+	// image to override the prefetch policy selected by mount option,
+	// see `prefetch.Policy`.
+	PrefetchPolicy string
 
 	MultiPlatform  bool
 	DockerV2Format bool
@@ -84,11 +97,83 @@ type Opt struct {
 	BackendConfig       string
 	BackendForcePush    bool
 	BackendAlignedChunk bool
+	// BackendRetry configures the retry and circuit breaker of blob
+	// uploads to storage backend and layer pushes to target registry.
+	BackendRetry backend.RetryConfig
+
+	// Compressor is the algorithm to compress chunk data in blob, see
+	// `nydus-image create --compressor`.
+	Compressor string
+	// CompressLevel is the level of zstd compressor, 0 is the default level.
+	CompressLevel int
+	// CompressAuto stores the chunks of already compressed files (e.g.
+	// gzip, zip and jpeg) without compression.
+	CompressAuto bool
+	// EncryptKeyID is the ID of the key to encrypt chunk data in blob, and
+	// KeyProvider is the key provider configuration file to get the key, see
+	// `nydus-image create --encrypt-key-id`.
+	EncryptKeyID string
+	KeyProvider  string
+	// Flatten merges all source layers into one Nydus layer.
+	Flatten bool
+	// WhiteoutStrategy is how the whiteouts and opaque directories of source
+	// layers are materialized, StrategyResolve applies them at conversion
+	// time by merging source layers as Flatten does.
+	WhiteoutStrategy provider.Strategy
+	// HardlinkStrategy is how the hardlinks of source layers are
+	// materialized, StrategyResolve breaks them into regular files.
+	HardlinkStrategy provider.Strategy
+	// PathFilter drops the paths of source layers it doesn't select, no
+	// path is dropped if it's nil.
+	PathFilter *provider.PathFilter
 
 	NydusifyVersion string
 	Source          string
 
 	ChunkDict ChunkDictOpt
+	// DedupDB is the path of chunk deduplication database, the most
+	// similar image in database is used as chunk dict, and the converted
+	// image is recorded in database, conflicts with ChunkDict.
+	DedupDB string
+
+	// MaxConcurrency limits the number of layers pulled or pushed
+	// concurrently, PullWorkerCount and PushWorkerCount are used if zero.
+	// Layers are always built in order since a layer is built on top of
+	// the bootstrap of its parent.
+	MaxConcurrency uint
+
+	// ManifestOnly pushes Nydus manifest by digest without tagging it,
+	// the manifest can be got by Converter.Manifest to assemble a
+	// manifest index of multiple platforms, see ConvertIndex.
+	ManifestOnly bool
+
+	// Sign target image once the manifest is pushed.
+	Signers []signature.Signer
+
+	// SBOMFormat generates the SBOM from the package databases in source
+	// layers, it's attached to Nydus manifest as a referrer artifact.
+	// Empty means no SBOM.
+	SBOMFormat sbom.Format
+	// Provenance attaches an in-toto attestation of the conversion to
+	// Nydus manifest, including source image, versions and parameters.
+	Provenance bool
+	// TarSplit records the tar-split metadata of source layers and
+	// attaches it to Nydus manifest, so that the original layers can be
+	// reconstructed from Nydus image by `nydusify restore`.
+	TarSplit bool
+
+	// DryRun builds Nydus layers locally without pushing anything, the
+	// estimate of conversion can be got by Converter.DryRunReport. Cache
+	// image and checkpoint aren't used, so that all layers are built.
+	DryRun bool
+
+	// Progress reports the processed layers and uploaded blobs, nil
+	// means no report.
+	Progress *progress.Reporter
+
+	// Annotation edits the annotations and labels copied from source
+	// manifest and config.
+	Annotation AnnotationOpt
 }
 
 type Converter struct {
@@ -104,19 +189,43 @@ type Converter struct {
 	NydusImagePath string
 	WorkDir        string
 	PrefetchDir    string
+	PrefetchPolicy string
 
 	MultiPlatform  bool
 	DockerV2Format bool
 
 	BackendForcePush    bool
 	BackendAlignedChunk bool
+	Compressor          string
+	CompressLevel       int
+	CompressAuto        bool
+	EncryptKeyID        string
+	KeyProvider         string
+	Flatten             bool
+	WhiteoutStrategy    provider.Strategy
+	HardlinkStrategy    provider.Strategy
+	PathFilter          *provider.PathFilter
 
 	NydusifyVersion string
 	Source          string
+	DedupDB         string
 
 	storageBackend backend.Backend
-
-	chunkDict ChunkDictOpt
+	backendRetrier *backend.Retrier
+	remoteRetrier  *backend.Retrier
+
+	chunkDict      ChunkDictOpt
+	signers        []signature.Signer
+	maxConcurrency uint
+	manifestOnly   bool
+	manifestDesc   *ocispec.Descriptor
+	sbomFormat     sbom.Format
+	provenance     bool
+	tarSplit       bool
+	dryRun         bool
+	dryRunReport   *DryRunReport
+	progress       *progress.Reporter
+	annotation     AnnotationOpt
 }
 
 func imageRepository(ref string) (string, error) {
@@ -131,11 +240,17 @@ func imageRepository(ref string) (string, error) {
 func New(opt Opt) (*Converter, error) {
 	// TODO: Add parameters sanity check here
 	// Built layer has to go somewhere. Storage backend is the media holing layer blob.
-	backend, err := backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), opt.TargetRemote)
+	storageBackend, err := backend.NewBackend(opt.BackendType, []byte(opt.BackendConfig), opt.TargetRemote)
 	if err != nil {
 		return nil, err
 	}
 
+	// The cached layers are pushed to target image, they can be mounted from
+	// cache image in another repository of the same registry.
+	if opt.CacheRemote != nil && opt.TargetRemote.AddMountSource(opt.CacheRemote) {
+		logrus.Debugf("Mount blobs from cache image %s on push", opt.CacheRemote.Ref)
+	}
+
 	return &Converter{
 		Logger:              opt.Logger,
 		SourceProviders:     opt.SourceProviders,
@@ -146,16 +261,38 @@ func New(opt Opt) (*Converter, error) {
 		NydusImagePath:      opt.NydusImagePath,
 		WorkDir:             opt.WorkDir,
 		PrefetchDir:         opt.PrefetchDir,
+		PrefetchPolicy:      opt.PrefetchPolicy,
 		MultiPlatform:       opt.MultiPlatform,
 		DockerV2Format:      opt.DockerV2Format,
 		BackendForcePush:    opt.BackendForcePush,
 		BackendAlignedChunk: opt.BackendAlignedChunk,
+		Compressor:          opt.Compressor,
+		CompressLevel:       opt.CompressLevel,
+		CompressAuto:        opt.CompressAuto,
+		EncryptKeyID:        opt.EncryptKeyID,
+		KeyProvider:         opt.KeyProvider,
+		Flatten:             opt.Flatten,
+		WhiteoutStrategy:    opt.WhiteoutStrategy,
+		HardlinkStrategy:    opt.HardlinkStrategy,
+		PathFilter:          opt.PathFilter,
 		NydusifyVersion:     opt.NydusifyVersion,
 		Source:              opt.Source,
-
-		storageBackend: backend,
-
-		chunkDict: opt.ChunkDict,
+		DedupDB:             opt.DedupDB,
+
+		storageBackend: storageBackend,
+		backendRetrier: backend.NewRetrier(storageBackend, opt.BackendRetry),
+		remoteRetrier:  backend.NewRemoteRetrier(opt.TargetRemote, opt.BackendRetry),
+
+		chunkDict:      opt.ChunkDict,
+		signers:        opt.Signers,
+		maxConcurrency: opt.MaxConcurrency,
+		manifestOnly:   opt.ManifestOnly,
+		sbomFormat:     opt.SBOMFormat,
+		provenance:     opt.Provenance,
+		tarSplit:       opt.TarSplit,
+		dryRun:         opt.DryRun,
+		progress:       opt.Progress,
+		annotation:     opt.Annotation,
 	}, nil
 }
 
@@ -178,8 +315,12 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 	}()
 
 	// Try to pull Nydus cache image from remote registry
+	cacheRemote := cvt.CacheRemote
+	if cvt.dryRun {
+		cacheRemote = nil
+	}
 	cg, err := newCacheGlue(
-		ctx, cvt.CacheMaxRecords, cvt.CacheVersion, cvt.DockerV2Format, cvt.TargetRemote, cvt.CacheRemote, cvt.storageBackend,
+		ctx, cvt.CacheMaxRecords, cvt.CacheVersion, cvt.DockerV2Format, cvt.TargetRemote, cacheRemote, cvt.storageBackend,
 	)
 	if err != nil {
 		return errors.Wrap(err, "Pull cache image")
@@ -197,6 +338,53 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 
 	start := time.Now()
 
+	if cvt.SourceProviders == nil || len(cvt.SourceProviders) == 0 {
+		return errors.New("Invalid source provider")
+	}
+
+	// In fact, during parsing image manifest, only one interested tag is inserted.
+	if len(cvt.SourceProviders) != 1 {
+		return errors.New("Should have only one source image")
+	}
+
+	sourceProvider := cvt.SourceProviders[0]
+	sourceConfig, err := sourceProvider.Config(ctx)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Source, errors.Wrap(err, "Get source config"))
+	}
+	// The layers of Windows image are handled as they are, the foreign
+	// layers and backup stream metadata can't be merged or rewritten. The
+	// tar-split can't be restored either, the foreign layers aren't
+	// unpacked and the paths may be renamed for case-insensitivity.
+	if sourceConfig.OS == "windows" && (cvt.Flatten || cvt.WhiteoutStrategy == provider.StrategyResolve ||
+		!cvt.PathFilter.IsZero() || cvt.HardlinkStrategy == provider.StrategyResolve || cvt.tarSplit) {
+		return errors.New("flatten, path filter, resolve strategies and tar-split are not supported for Windows image")
+	}
+	if cvt.Flatten || cvt.WhiteoutStrategy == provider.StrategyResolve {
+		sourceProvider = provider.FlattenSource(sourceProvider, cvt.WorkDir)
+	}
+	if !cvt.PathFilter.IsZero() {
+		sourceProvider = provider.FilterPaths(sourceProvider, cvt.PathFilter)
+	}
+	if cvt.HardlinkStrategy == provider.StrategyResolve {
+		sourceProvider = provider.ResolveHardlinks(sourceProvider)
+	}
+	sourceLayers, err := sourceProvider.Layers(ctx)
+	if err != nil {
+		return exitcode.Wrap(exitcode.Source, errors.Wrap(err, "Get source layers"))
+	}
+	sourceSize := int64(0)
+	for _, sourceLayer := range sourceLayers {
+		sourceSize += sourceLayer.Size()
+	}
+	cvt.progress.AddLayers(len(sourceLayers), sourceSize)
+	if cvt.DedupDB != "" {
+		chunkDictOpt, blobs, err = cvt.prepareDedupDict(sourceLayers)
+		if err != nil {
+			return errors.Wrap(err, "Prepare chunk dict from dedup database")
+		}
+	}
+
 	// BuildWorkflow builds nydus blob/bootstrap layer by layer
 	bootstrapsDir := filepath.Join(cvt.WorkDir, "bootstraps")
 	if err := os.RemoveAll(bootstrapsDir); err != nil {
@@ -210,31 +398,53 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 		NydusImagePath: cvt.NydusImagePath,
 		PrefetchDir:    cvt.PrefetchDir,
 		TargetDir:      cvt.WorkDir,
+		Compressor:     cvt.Compressor,
+		CompressLevel:  cvt.CompressLevel,
+		CompressAuto:   cvt.CompressAuto,
+		EncryptKeyID:   cvt.EncryptKeyID,
+		KeyProvider:    cvt.KeyProvider,
 	})
 	if err != nil {
 		return errors.Wrap(err, "Create build flow")
 	}
-
-	if cvt.SourceProviders == nil || len(cvt.SourceProviders) == 0 {
-		return errors.New("Invalid source provider")
+	// Resume from the layers pushed by previous run of the same conversion
+	sourceDigest := ""
+	if sourceManifest, err := sourceProvider.Manifest(ctx); err == nil && sourceManifest != nil {
+		sourceDigest = sourceManifest.Digest.String()
 	}
-
-	// In fact, during parsing image manifest, only one interested tag is inserted.
-	if len(cvt.SourceProviders) != 1 {
-		return errors.New("Should have only one source image")
+	cp, err := loadCheckpoint(cvt.WorkDir, checkpointFingerprint(
+		cvt.Source, sourceDigest, cvt.TargetRemote.Ref, backend.TypeName(cvt.storageBackend.Type()),
+		cvt.NydusifyVersion, cvt.PrefetchDir, chunkDictOpt, fmt.Sprint(cvt.DockerV2Format), fmt.Sprint(cvt.BackendAlignedChunk),
+		cvt.Compressor, fmt.Sprint(cvt.CompressLevel), fmt.Sprint(cvt.CompressAuto), cvt.EncryptKeyID, cvt.KeyProvider, fmt.Sprint(cvt.Flatten), string(cvt.WhiteoutStrategy), string(cvt.HardlinkStrategy),
+		cvt.PathFilter.String(),
+	))
+	if err != nil {
+		return errors.Wrap(err, "Load checkpoint")
 	}
 
-	sourceProvider := cvt.SourceProviders[0]
-	sourceLayers, err := sourceProvider.Layers(ctx)
-	if err != nil {
-		return errors.Wrap(err, "Get source layers")
+	pullWorkerCount, pushWorkerCount := PullWorkerCount, PushWorkerCount
+	if cvt.maxConcurrency > 0 {
+		pullWorkerCount, pushWorkerCount = cvt.maxConcurrency, cvt.maxConcurrency
 	}
-	pullWorker := utils.NewQueueWorkerPool(PullWorkerCount, uint(len(sourceLayers)))
-	pushWorker := utils.NewWorkerPool(PushWorkerCount, uint(len(sourceLayers)))
+	var sbomCollector *sbom.Collector
+	if cvt.sbomFormat != "" {
+		sbomCollector = sbom.NewCollector(len(sourceLayers))
+	}
+	var tarSplitCollector *tarsplit.Collector
+	if cvt.tarSplit && !cvt.dryRun {
+		if err := cvt.checkTarSplit(sourceProvider); err != nil {
+			return err
+		}
+		tarSplitCollector = tarsplit.NewCollector(len(sourceLayers))
+	}
+
+	pullWorker := utils.NewQueueWorkerPool(pullWorkerCount, uint(len(sourceLayers)))
+	pushWorker := utils.NewWorkerPool(pushWorkerCount, uint(len(sourceLayers)))
 	buildLayers := []*buildLayer{}
 
 	// Pull and mount source layer in pull worker
 	var parentBuildLayer *buildLayer
+	resumable := !cvt.dryRun
 	for idx, sourceLayer := range sourceLayers {
 		buildLayer := &buildLayer{
 			index:          idx,
@@ -246,8 +456,26 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 			parent:         parentBuildLayer,
 			dockerV2Format: cvt.DockerV2Format,
 			backend:        cvt.storageBackend,
+			retrier:        cvt.backendRetrier,
+			remoteRetrier:  cvt.remoteRetrier,
 			forcePush:      cvt.BackendForcePush,
 			alignedChunk:   cvt.BackendAlignedChunk,
+			checkpoint:     cp,
+			sbom:           sbomCollector,
+			tarSplit:       tarSplitCollector,
+			progress:       cvt.progress,
+		}
+		// Only the leading layers can be resumed, since a layer is built
+		// on top of the bootstrap of its parent.
+		if resumable {
+			record, bootstrapPath := cp.Get(sourceLayer.ChainID())
+			if record != nil {
+				logrus.Infof("Resume layer %s from checkpoint", sourceLayer.Digest())
+				buildLayer.cacheRecord = record
+				buildLayer.bootstrapPath = bootstrapPath
+			} else {
+				resumable = false
+			}
 		}
 		parentBuildLayer = buildLayer
 		buildLayers = append(buildLayers, buildLayer)
@@ -268,12 +496,13 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 		select {
 		case _job := <-jobChan:
 			if _job.Err() != nil {
-				return errors.Wrap(_job.Err(), "Pull source layer")
+				return exitcode.Wrap(exitcode.Source, errors.Wrap(_job.Err(), "Pull source layer"))
 			}
 			job := _job.(*mountJob)
 
 			// Skip building if we found the cache record in cache image
 			if job.layer.Cached() {
+				cvt.progress.LayerProcessed(job.layer.source.Size(), false)
 				continue
 			}
 
@@ -289,25 +518,38 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 			}()
 
 			if err != nil {
-				return errors.Wrap(err, "Build source layer")
+				return exitcode.Wrap(exitcode.Build, errors.Wrap(err, "Build source layer"))
 			}
+			cvt.progress.LayerProcessed(job.layer.source.Size(), job.layer.blobPath != "" && !cvt.dryRun)
 
 			// Push Nydus layer (bootstrap & blob) to target registry
 			pushWorker.Put(func() error {
+				if cvt.dryRun {
+					return job.layer.estimate(ctx)
+				}
 				return job.layer.Push(ctx)
 			})
 		case err := <-pushWorker.Err():
 			// Should throw the error as soon as possible instead
 			// of waiting for all pull jobs to finish
 			if err != nil {
-				return errors.Wrap(err, "Push Nydus layer in worker")
+				return exitcode.Wrap(exitcode.Push, errors.Wrap(err, "Push Nydus layer in worker"))
 			}
 		}
 	}
 
 	// Wait all layer push job finish, then we can push image manifest on next
 	if err := <-pushWorker.Waiter(); err != nil {
-		return errors.Wrap(err, "Push Nydus layer in wait")
+		return exitcode.Wrap(exitcode.Push, errors.Wrap(err, "Push Nydus layer in wait"))
+	}
+
+	if cvt.dryRun {
+		cvt.dryRunReport, err = cvt.estimate(ctx, sourceProvider, buildLayers, blobs)
+		if err != nil {
+			return errors.Wrap(err, "Estimate conversion")
+		}
+		logrus.Infof("Dry run of converting to %s, nothing is pushed", cvt.TargetRemote.Ref)
+		return nil
 	}
 
 	// Collect all meta information of current build environment, it will be
@@ -339,6 +581,9 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 		multiPlatform:  cvt.MultiPlatform,
 		dockerV2Format: cvt.DockerV2Format,
 		buildInfo:      buildInfo,
+		manifestOnly:   cvt.manifestOnly,
+		prefetchPolicy: cvt.PrefetchPolicy,
+		annotation:     cvt.annotation,
 	}
 	pushDone := logger.Log(ctx, "[MANI] Push manifest", nil)
 	if err := mm.Push(ctx, buildLayers); err != nil {
@@ -350,9 +595,48 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 			logrus.Warnf("Push manifest: %s", err)
 			return pushDone(errInvalidCache)
 		}
-		return pushDone(errors.Wrap(err, "Push target manifest"))
+		return pushDone(exitcode.Wrap(exitcode.Push, errors.Wrap(err, "Push target manifest")))
 	}
 	pushDone(nil)
+	cvt.manifestDesc = mm.manifestDesc
+
+	if len(cvt.signers) > 0 && !cvt.manifestOnly {
+		signDone := logger.Log(ctx, "[MANI] Sign manifest", nil)
+		if err := cvt.sign(ctx); err != nil {
+			return signDone(exitcode.Wrap(exitcode.Push, errors.Wrap(err, "Sign target image")))
+		}
+		signDone(nil)
+	}
+
+	if sbomCollector != nil {
+		sbomDone := logger.Log(ctx, "[MANI] Attach SBOM", nil)
+		if err := cvt.attachSBOM(ctx, sbomCollector); err != nil {
+			return sbomDone(exitcode.Wrap(exitcode.Push, errors.Wrap(err, "Attach SBOM to target image")))
+		}
+		sbomDone(nil)
+	}
+
+	if tarSplitCollector != nil {
+		tarSplitDone := logger.Log(ctx, "[MANI] Attach tar-split", nil)
+		if err := cvt.attachTarSplit(ctx, sourceProvider, tarSplitCollector); err != nil {
+			return tarSplitDone(exitcode.Wrap(exitcode.Push, errors.Wrap(err, "Attach tar-split to target image")))
+		}
+		tarSplitDone(nil)
+	}
+
+	if cvt.provenance {
+		provenanceDone := logger.Log(ctx, "[MANI] Attach provenance", nil)
+		if err := cvt.attachProvenance(ctx, provenanceInfo{
+			startedOn:      start,
+			sourceDigest:   sourceDigest,
+			builderVersion: buildWorkflow.BuilderVersion,
+			chunkDict:      chunkDictOpt,
+			bootstrapPath:  buildLayers[len(buildLayers)-1].bootstrapPath,
+		}); err != nil {
+			return provenanceDone(exitcode.Wrap(exitcode.Push, errors.Wrap(err, "Attach provenance to target image")))
+		}
+		provenanceDone(nil)
+	}
 
 	if repo != "" {
 		metrics.ConversionDuration(repo, len(sourceLayers), start)
@@ -361,7 +645,7 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 	start = time.Now()
 	// Push Nydus cache image to remote registry
 	if err := cg.Export(ctx, buildLayers); err != nil {
-		return errors.Wrap(err, "export cache records")
+		return exitcode.Wrap(exitcode.Push, errors.Wrap(err, "export cache records"))
 	}
 
 	if repo != "" {
@@ -369,13 +653,50 @@ func (cvt *Converter) convert(ctx context.Context) (retErr error) {
 		metrics.ConversionSuccessCount(repo)
 	}
 
+	if cvt.DedupDB != "" {
+		if err := cvt.recordDedup(ctx, sourceLayers, buildLayers); err != nil {
+			return errors.Wrap(err, "Record image in dedup database")
+		}
+	}
+
+	if err := cp.Clear(); err != nil {
+		logrus.Warnf("Failed to clear checkpoint: %s", err)
+	}
+
 	logrus.Infof("Converted to %s", cvt.TargetRemote.Ref)
 
 	return nil
 }
 
+func (cvt *Converter) sign(ctx context.Context) error {
+	desc, err := cvt.TargetRemote.Resolve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "resolve target manifest")
+	}
+	for _, signer := range cvt.signers {
+		if err := signer.Sign(ctx, cvt.TargetRemote, desc.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Manifest returns the pushed Nydus manifest, which is used to assemble
+// a manifest index of multiple platforms with Opt.ManifestOnly.
+func (cvt *Converter) Manifest() *ocispec.Descriptor {
+	return cvt.manifestDesc
+}
+
 // Convert converts source image to target (Nydus) image
-func (cvt *Converter) Convert(ctx context.Context) error {
+func (cvt *Converter) Convert(ctx context.Context) (retErr error) {
+	ctx, span := tracing.Start(ctx, "convert image",
+		attribute.String("source", cvt.Source),
+		attribute.String("target", cvt.TargetRemote.Ref),
+	)
+	defer func() {
+		tracing.End(span, retErr)
+	}()
+
 	if err := cvt.convert(ctx); err != nil {
 		if errors.Is(err, errInvalidCache) {
 			// Retry to convert without cache if the cache is invalid. we can't ensure the
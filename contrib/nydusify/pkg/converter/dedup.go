@@ -0,0 +1,91 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+func sourceLayerDigests(layers []provider.SourceLayer) []string {
+	digests := []string{}
+	for _, layer := range layers {
+		digests = append(digests, layer.Digest().String())
+	}
+	return digests
+}
+
+// prepareDedupDict extracts the bootstrap of the most similar image in dedup
+// database as chunk dict, it returns empty chunk dict if database is empty.
+func (cvt *Converter) prepareDedupDict(sourceLayers []provider.SourceLayer) (string, []string, error) {
+	db, err := dedup.Open(cvt.DedupDB)
+	if err != nil {
+		return "", []string{}, err
+	}
+	defer db.Close()
+
+	image, data, err := db.Dict(sourceLayerDigests(sourceLayers))
+	if err != nil {
+		return "", []string{}, err
+	}
+	if image == nil {
+		logrus.Infof("No image in dedup database %s", cvt.DedupDB)
+		return "", []string{}, nil
+	}
+
+	prepareDir := filepath.Join(cvt.WorkDir, "chunk_dict")
+	if err := os.MkdirAll(prepareDir, 0755); err != nil {
+		return "", []string{}, err
+	}
+	// The checkpoint is invalid once the chunk dict is changed, which is
+	// detected by the path of chunk dict in fingerprint.
+	target := filepath.Join(prepareDir, "dedup-"+digest.Digest(image.Bootstrap).Encoded()+".boot")
+	if err := ioutil.WriteFile(target, data, 0644); err != nil {
+		return "", []string{}, errors.Wrap(err, "write chunk dict bootstrap")
+	}
+	logrus.Infof("Use image %s in dedup database as chunk dict", image.Reference)
+
+	return cvt.prepareBootstrap(prepareDir, "local", target)
+}
+
+// recordDedup adds the final bootstrap of converted image to dedup database.
+func (cvt *Converter) recordDedup(ctx context.Context, sourceLayers []provider.SourceLayer, buildLayers []*buildLayer) error {
+	if len(buildLayers) == 0 {
+		return nil
+	}
+
+	layer := buildLayers[len(buildLayers)-1]
+	if layer.bootstrapPath == "" {
+		bootstrapName := strconv.Itoa(layer.index+1) + "-" + layer.source.Digest().String()
+		layer.bootstrapPath = filepath.Join(layer.bootstrapsDir, bootstrapName+"-cached")
+		if err := layer.cacheGlue.PullBootstrap(ctx, layer.source.ChainID(), layer.bootstrapPath); err != nil {
+			return errors.Wrap(err, "pull bootstrap from cache")
+		}
+	}
+
+	db, err := dedup.Open(cvt.DedupDB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ref := cvt.TargetRemote.Ref
+	// The manifests of platforms are pushed by digest to the same reference.
+	if cvt.manifestOnly && cvt.manifestDesc != nil {
+		ref = ref + "@" + cvt.manifestDesc.Digest.String()
+	}
+
+	return db.Add(ref, sourceLayerDigests(sourceLayers), layer.bootstrapPath)
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/dustin/go-humanize"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// DryRunLayer is the Nydus layer built from a source layer in dry run.
+type DryRunLayer struct {
+	SourceDigest digest.Digest `json:"source_digest"`
+	SourceSize   int64         `json:"source_size"`
+	// BlobID is empty if all chunks of the layer exist in chunk dict or
+	// lower layers.
+	BlobID   string `json:"blob_id,omitempty"`
+	BlobSize int64  `json:"blob_size"`
+	// BlobExists means the blob exists in storage backend, it isn't
+	// uploaded again.
+	BlobExists bool `json:"blob_exists"`
+	// BootstrapSize is the compressed size of bootstrap layer.
+	BootstrapSize int64 `json:"bootstrap_size"`
+}
+
+// DryRunReport is the estimate of conversion, nothing is pushed to target
+// registry or storage backend in dry run.
+type DryRunReport struct {
+	Source     string        `json:"source"`
+	Target     string        `json:"target"`
+	Layers     []DryRunLayer `json:"layers"`
+	SourceSize int64         `json:"source_size"`
+	// ConvertedSize is the size of blobs and the bootstrap layer of Nydus
+	// image.
+	ConvertedSize int64 `json:"converted_size"`
+	// UploadSize is the size of blobs not existed in storage backend and
+	// all bootstrap layers, which are pushed on conversion.
+	UploadSize int64 `json:"upload_size"`
+
+	// The unique chunks of Nydus image and their compressed size.
+	Chunks    int   `json:"chunks"`
+	ChunkSize int64 `json:"chunk_size"`
+	// DictChunks are the chunks reused from the blobs of chunk dict.
+	DictChunks int `json:"dict_chunks"`
+	// TargetExists means a Nydus image exists in target repository, the
+	// chunks are compared with it to estimate the dedup ratio, which is the
+	// shared size in chunk size.
+	TargetExists bool    `json:"target_exists"`
+	SharedChunks int     `json:"shared_chunks"`
+	SharedSize   int64   `json:"shared_size"`
+	DedupRatio   float64 `json:"dedup_ratio"`
+}
+
+// estimate records the built Nydus layer in dry run instead of pushing it.
+func (layer *buildLayer) estimate(ctx context.Context) error {
+	_, bootstrapSize, err := utils.PackTargzInfo(
+		layer.bootstrapPath, utils.BootstrapFileNameInLayer, true,
+	)
+	if err != nil {
+		return errors.Wrap(err, "Calculate compressed boostrap size")
+	}
+
+	estimate := &DryRunLayer{
+		SourceDigest:  layer.source.Digest(),
+		SourceSize:    layer.source.Size(),
+		BootstrapSize: bootstrapSize,
+	}
+	if layer.blobPath != "" {
+		info, err := os.Stat(layer.blobPath)
+		if err != nil {
+			return errors.Wrap(err, "Get blob layer size")
+		}
+		defer os.Remove(layer.blobPath)
+
+		estimate.BlobID = filepath.Base(layer.blobPath)
+		estimate.BlobSize = info.Size()
+		exists, err := layer.backend.Check(estimate.BlobID)
+		if err != nil {
+			logrus.Debugf("Check blob %s in storage backend: %s", estimate.BlobID, err)
+		}
+		estimate.BlobExists = exists
+	}
+
+	logger.Log(ctx, "[BLOB] Estimate blob", provider.LoggerFields{
+		"Digest":   layer.source.Digest(),
+		"BlobSize": humanize.Bytes(uint64(estimate.BlobSize)),
+	})(nil)
+	layer.dryRun = estimate
+	return nil
+}
+
+func summarizeDryRun(report *DryRunReport, bootstrap, existing *dedup.Bootstrap, dictBlobs []string) {
+	for _, layer := range report.Layers {
+		report.SourceSize += layer.SourceSize
+		report.ConvertedSize += layer.BlobSize
+		if !layer.BlobExists {
+			report.UploadSize += layer.BlobSize
+		}
+		report.UploadSize += layer.BootstrapSize
+	}
+	if len(report.Layers) > 0 {
+		report.ConvertedSize += report.Layers[len(report.Layers)-1].BootstrapSize
+	}
+
+	dict := map[string]bool{}
+	for _, blob := range dictBlobs {
+		dict[blob] = true
+	}
+	existingChunks := map[string]bool{}
+	if existing != nil {
+		report.TargetExists = true
+		for _, chunk := range existing.Chunks {
+			existingChunks[chunk.Digest] = true
+		}
+	}
+	for _, chunk := range bootstrap.Chunks {
+		report.Chunks++
+		report.ChunkSize += int64(chunk.CompressedSize)
+		if dict[chunk.Blob] {
+			report.DictChunks++
+		}
+		if existingChunks[chunk.Digest] {
+			report.SharedChunks++
+			report.SharedSize += int64(chunk.CompressedSize)
+		}
+	}
+	if report.ChunkSize > 0 {
+		report.DedupRatio = float64(report.SharedSize) / float64(report.ChunkSize)
+	}
+}
+
+// estimate summarizes the layers built in dry run, the chunks are
+// compared with the Nydus image of source architecture in target
+// repository if it exists.
+func (cvt *Converter) estimate(ctx context.Context, sourceProvider provider.SourceProvider, buildLayers []*buildLayer, dictBlobs []string) (*DryRunReport, error) {
+	report := &DryRunReport{
+		Source: cvt.Source,
+		Target: cvt.TargetRemote.Ref,
+		Layers: []DryRunLayer{},
+	}
+	for _, layer := range buildLayers {
+		report.Layers = append(report.Layers, *layer.dryRun)
+	}
+
+	bootstrap, err := dedup.ParseBootstrapFile(buildLayers[len(buildLayers)-1].bootstrapPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parse built bootstrap")
+	}
+
+	arch := runtime.GOARCH
+	if config, err := sourceProvider.Config(ctx); err == nil && config != nil && config.Architecture != "" {
+		arch = config.Architecture
+	}
+	existing, err := dedup.PullImageBootstrap(ctx, cvt.TargetRemote, arch)
+	if err != nil {
+		logrus.Infof("No Nydus image to compare in target: %s", err)
+		existing = nil
+	}
+
+	summarizeDryRun(report, bootstrap, existing, dictBlobs)
+	return report, nil
+}
+
+// DryRunReport returns the estimate of conversion with Opt.DryRun.
+func (cvt *Converter) DryRunReport() *DryRunReport {
+	return cvt.dryRunReport
+}
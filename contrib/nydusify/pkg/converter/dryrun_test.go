@@ -0,0 +1,50 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+func TestSummarizeDryRun(t *testing.T) {
+	chunk := func(dgst, blob string) dedup.Chunk {
+		return dedup.Chunk{Digest: dgst, Blob: blob, CompressedSize: 100}
+	}
+	report := &DryRunReport{
+		Layers: []DryRunLayer{
+			{SourceSize: 1000, BlobID: "blob1", BlobSize: 200, BlobExists: true, BootstrapSize: 10},
+			{SourceSize: 500, BootstrapSize: 20},
+			{SourceSize: 800, BlobID: "blob3", BlobSize: 100, BootstrapSize: 30},
+		},
+	}
+	bootstrap := &dedup.Bootstrap{
+		Chunks: []dedup.Chunk{chunk("a", "blob1"), chunk("b", "blob1"), chunk("c", "dict"), chunk("d", "blob3")},
+	}
+	existing := &dedup.Bootstrap{
+		Chunks: []dedup.Chunk{chunk("a", "old"), chunk("c", "old")},
+	}
+
+	summarizeDryRun(report, bootstrap, existing, []string{"dict"})
+	assert.Equal(t, int64(2300), report.SourceSize)
+	// The blobs and the bootstrap of top layer.
+	assert.Equal(t, int64(330), report.ConvertedSize)
+	// The blob existed in backend isn't uploaded, all bootstraps are pushed.
+	assert.Equal(t, int64(160), report.UploadSize)
+	assert.Equal(t, 4, report.Chunks)
+	assert.Equal(t, int64(400), report.ChunkSize)
+	assert.Equal(t, 1, report.DictChunks)
+	assert.True(t, report.TargetExists)
+	assert.Equal(t, 2, report.SharedChunks)
+	assert.Equal(t, 0.5, report.DedupRatio)
+
+	report = &DryRunReport{}
+	summarizeDryRun(report, bootstrap, nil, nil)
+	assert.False(t, report.TargetExists)
+	assert.Equal(t, 0.0, report.DedupRatio)
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signature"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// IndexOpt configures the conversion of all platforms in a source image
+// index (manifest list).
+type IndexOpt struct {
+	SourceRemote *remote.Remote
+	TargetRemote *remote.Remote
+
+	// Also keep the OCI manifests of source index in target index,
+	// please ensure that they exist in target repository.
+	MultiPlatform  bool
+	DockerV2Format bool
+
+	// The number of platforms converted concurrently.
+	MaxConcurrency uint
+
+	// Sign target index once it's pushed.
+	Signers []signature.Signer
+
+	// PlatformOpt returns the conversion options of the platform of a source
+	// manifest, SourceProviders and WorkDir should be dedicated for the
+	// platform, see PlatformID. The Windows manifests of same os/arch are
+	// told apart by OS version.
+	PlatformOpt func(ctx context.Context, platform ocispec.Platform) (*Opt, error)
+}
+
+func pullIndex(ctx context.Context, r *remote.Remote) (*ocispec.Index, error) {
+	desc, err := r.Resolve(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Resolve source image")
+	}
+	if desc.MediaType != ocispec.MediaTypeImageIndex && desc.MediaType != images.MediaTypeDockerSchema2ManifestList {
+		return nil, fmt.Errorf("source image %s isn't a manifest index, media type %s", r.Ref, desc.MediaType)
+	}
+	reader, err := r.Pull(ctx, *desc, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Pull source manifest index")
+	}
+	defer reader.Close()
+	indexBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read source manifest index")
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal source manifest index")
+	}
+	return &index, nil
+}
+
+// convertiblePlatform returns the os/arch of source manifest if it can be
+// converted to Nydus image.
+func convertiblePlatform(desc ocispec.Descriptor) (string, bool) {
+	if desc.Platform == nil || utils.IsNydusPlatform(desc.Platform) {
+		return "", false
+	}
+	if desc.Platform.OS != "linux" && desc.Platform.OS != "windows" {
+		return "", false
+	}
+	if !utils.IsSupportedArch(desc.Platform.Architecture) {
+		return "", false
+	}
+	return desc.Platform.OS + "/" + desc.Platform.Architecture, true
+}
+
+// PlatformID identifies the platform of source manifest in the names of
+// work directory and cache tag, it's the architecture for Linux, and
+// `windows-$arch-$osVersion` for Windows.
+func PlatformID(platform ocispec.Platform) string {
+	if platform.OS != "windows" {
+		return platform.Architecture
+	}
+	id := platform.OS + "-" + platform.Architecture
+	if platform.OSVersion != "" {
+		id += "-" + platform.OSVersion
+	}
+	return id
+}
+
+// makeIndex makes target index in the order of source index, the platform
+// and annotations of source manifests are preserved in Nydus manifests.
+func makeIndex(source *ocispec.Index, converted map[digest.Digest]ocispec.Descriptor, multiPlatform bool) *ocispec.Index {
+	index := ocispec.Index{
+		Versioned:   source.Versioned,
+		Annotations: source.Annotations,
+		Manifests:   []ocispec.Descriptor{},
+	}
+
+	for _, desc := range source.Manifests {
+		if multiPlatform {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		nydusDesc, ok := converted[desc.Digest]
+		if !ok {
+			continue
+		}
+		platform := *desc.Platform
+		platform.OSFeatures = append(append([]string{}, platform.OSFeatures...), utils.ManifestOSFeatureNydus)
+		nydusDesc.Platform = &platform
+		nydusDesc.Annotations = desc.Annotations
+		index.Manifests = append(index.Manifests, nydusDesc)
+	}
+
+	return &index
+}
+
+// ConvertIndex converts the image of each supported platform in source
+// index to Nydus image concurrently, then pushes a manifest index of the
+// Nydus images to target.
+func ConvertIndex(ctx context.Context, opt IndexOpt) error {
+	sourceIndex, err := pullIndex(ctx, opt.SourceRemote)
+	if err != nil {
+		return err
+	}
+
+	concurrency := opt.MaxConcurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+
+	var (
+		mutex     sync.Mutex
+		wg        sync.WaitGroup
+		firstErr  error
+		converted = map[digest.Digest]ocispec.Descriptor{}
+		sem       = make(chan struct{}, concurrency)
+		platforms = map[string]bool{}
+	)
+	for _, desc := range sourceIndex.Manifests {
+		platform, ok := convertiblePlatform(desc)
+		if !ok {
+			logrus.Infof("Skip manifest %s of unsupported platform", desc.Digest)
+			continue
+		}
+		// Only the first manifest of a platform can be picked by source provider
+		platformID := PlatformID(*desc.Platform)
+		if platforms[platformID] {
+			logrus.Warnf("Skip manifest %s of duplicated platform %s", desc.Digest, platformID)
+			continue
+		}
+		platforms[platformID] = true
+		if desc.Platform.OSVersion != "" {
+			platform += " " + desc.Platform.OSVersion
+		}
+
+		wg.Add(1)
+		go func(desc ocispec.Descriptor, platform string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := func() error {
+				cvtOpt, err := opt.PlatformOpt(ctx, *desc.Platform)
+				if err != nil {
+					return err
+				}
+				cvtOpt.TargetRemote = opt.TargetRemote
+				cvtOpt.DockerV2Format = opt.DockerV2Format
+				cvtOpt.ManifestOnly = true
+				cvtOpt.Signers = nil
+				cvt, err := New(*cvtOpt)
+				if err != nil {
+					return err
+				}
+				if err := cvt.Convert(ctx); err != nil {
+					return err
+				}
+				mutex.Lock()
+				converted[desc.Digest] = *cvt.Manifest()
+				mutex.Unlock()
+				return nil
+			}()
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "Convert platform %s", platform)
+				}
+				mutex.Unlock()
+			}
+		}(desc, platform)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(converted) == 0 {
+		return fmt.Errorf("no manifest of supported platform found in source index")
+	}
+
+	indexMediaType := ocispec.MediaTypeImageIndex
+	if opt.DockerV2Format {
+		indexMediaType = images.MediaTypeDockerSchema2ManifestList
+	}
+	index := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Index
+	}{
+		MediaType: indexMediaType,
+		Index:     *makeIndex(sourceIndex, converted, opt.MultiPlatform),
+	}
+	indexDesc, indexBytes, err := utils.MarshalToDesc(index, indexMediaType)
+	if err != nil {
+		return errors.Wrap(err, "Marshal image manifest index")
+	}
+	if err := opt.TargetRemote.Push(ctx, *indexDesc, false, bytes.NewReader(indexBytes)); err != nil {
+		return errors.Wrap(err, "Push image manifest index")
+	}
+
+	for _, signer := range opt.Signers {
+		if err := signer.Sign(ctx, opt.TargetRemote, indexDesc.Digest); err != nil {
+			return errors.Wrap(err, "Sign target image")
+		}
+	}
+
+	logrus.Infof("Converted %d platforms to %s", len(converted), opt.TargetRemote.Ref)
+
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestMakeIndex(t *testing.T) {
+	amd64 := ocispec.Descriptor{
+		Digest:      digest.FromString("amd64"),
+		Platform:    &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		Annotations: map[string]string{"key": "amd64"},
+	}
+	arm64 := ocispec.Descriptor{
+		Digest:   digest.FromString("arm64"),
+		Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	}
+	windows := ocispec.Descriptor{
+		Digest:   digest.FromString("windows"),
+		Platform: &ocispec.Platform{OS: "windows", Architecture: "amd64"},
+	}
+	source := &ocispec.Index{
+		Manifests:   []ocispec.Descriptor{amd64, arm64, windows},
+		Annotations: map[string]string{"index": "source"},
+	}
+
+	platform, ok := convertiblePlatform(arm64)
+	assert.True(t, ok)
+	assert.Equal(t, "linux/arm64", platform)
+	platform, ok = convertiblePlatform(windows)
+	assert.True(t, ok)
+	assert.Equal(t, "windows/amd64", platform)
+	_, ok = convertiblePlatform(ocispec.Descriptor{Platform: &ocispec.Platform{OS: "darwin", Architecture: "arm64"}})
+	assert.False(t, ok)
+
+	// The Windows manifests of same os/arch are converted separately.
+	assert.Equal(t, "arm64", PlatformID(*arm64.Platform))
+	assert.Equal(t, "windows-amd64", PlatformID(*windows.Platform))
+	assert.Equal(t, "windows-amd64-10.0.17763.2114", PlatformID(ocispec.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.2114"}))
+
+	converted := map[digest.Digest]ocispec.Descriptor{
+		amd64.Digest: {Digest: digest.FromString("nydus-amd64")},
+		arm64.Digest: {Digest: digest.FromString("nydus-arm64")},
+	}
+
+	// The order, platform and annotations of source manifests are preserved.
+	index := makeIndex(source, converted, false)
+	assert.Equal(t, source.Annotations, index.Annotations)
+	assert.Len(t, index.Manifests, 2)
+	assert.Equal(t, digest.FromString("nydus-amd64"), index.Manifests[0].Digest)
+	assert.Equal(t, "amd64", index.Manifests[0].Annotations["key"])
+	assert.True(t, utils.IsNydusPlatform(index.Manifests[0].Platform))
+	assert.Equal(t, "v8", index.Manifests[1].Platform.Variant)
+	assert.True(t, utils.IsNydusPlatform(index.Manifests[1].Platform))
+	assert.False(t, utils.IsNydusPlatform(arm64.Platform))
+
+	index = makeIndex(source, converted, true)
+	assert.Len(t, index.Manifests, 5)
+	assert.Equal(t, amd64.Digest, index.Manifests[0].Digest)
+	assert.Equal(t, digest.FromString("nydus-amd64"), index.Manifests[1].Digest)
+	assert.Equal(t, windows.Digest, index.Manifests[4].Digest)
+}
@@ -19,12 +19,20 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/build"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/cache"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/progress"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/sbom"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tarsplit"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tracing"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 )
 
@@ -53,8 +61,19 @@ type buildLayer struct {
 	blobPath        string
 	bootstrapPath   string
 	backend         backend.Backend
+	retrier         *backend.Retrier
+	remoteRetrier   *backend.Retrier
 	forcePush       bool
 	alignedChunk    bool
+	checkpoint      *checkpoint
+	// Collect the package databases when source layer is mounted.
+	sbom *sbom.Collector
+	// Collect the tar-split metadata recorded when source layer is mounted.
+	tarSplit     *tarsplit.Collector
+	tarSplitPath string
+	// The estimate of built layer in dry run.
+	dryRun   *DryRunLayer
+	progress *progress.Reporter
 }
 
 // parseSourceMount parses mounts object returned by the Mount method in
@@ -111,19 +130,26 @@ func (layer *buildLayer) pushBlob(ctx context.Context, blobSize int64) error {
 	blobPath := layer.blobPath
 	blobID := filepath.Base(blobPath)
 
-	if err := utils.WithRetry(func() error {
+	ctx, span := tracing.Start(ctx, "upload blob",
+		attribute.String("blob_id", blobID),
+		attribute.Int64("blob_size", blobSize),
+		attribute.String("backend_type", backend.TypeName(layer.backend.Type())),
+	)
+	if err := layer.retrier.Do(ctx, func() error {
 		desc, err := layer.backend.Upload(ctx, blobID, blobPath, blobSize, layer.forcePush)
 		if err != nil {
+			metrics.BackendFailureCount(backend.TypeName(layer.backend.Type()))
+			span.AddEvent("upload failed", trace.WithAttributes(attribute.String("error", err.Error())))
 			return err
 		}
 		layer.blobDesc = desc
 
 		return nil
 	}); err != nil {
-		return err
+		return tracing.End(span, err)
 	}
 
-	return nil
+	return tracing.End(span, nil)
 }
 
 func (layer *buildLayer) pushBootstrap(ctx context.Context) (*ocispec.Descriptor, *digest.Digest, error) {
@@ -142,6 +168,11 @@ func (layer *buildLayer) pushBootstrap(ctx context.Context) (*ocispec.Descriptor
 		return nil, nil, errors.Wrap(err, "Calculate uncompressed boostrap digest")
 	}
 
+	fsVersion, err := dedup.ReadFsVersion(layer.bootstrapPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Read bootstrap version")
+	}
+
 	bootstrapMediaType := ocispec.MediaTypeImageLayerGzip
 	if layer.dockerV2Format {
 		bootstrapMediaType = images.MediaTypeDockerSchema2LayerGzip
@@ -156,10 +187,11 @@ func (layer *buildLayer) pushBootstrap(ctx context.Context) (*ocispec.Descriptor
 			// DiffID of layer defined in OCI spec
 			utils.LayerAnnotationUncompressed:   uncompressedDigest.String(),
 			utils.LayerAnnotationNydusBootstrap: "true",
+			utils.LayerAnnotationNydusFsVersion: fsVersion,
 		},
 	}
 
-	if err := utils.WithRetry(func() error {
+	if err := layer.remoteRetrier.Do(ctx, func() error {
 		compressedReader, err := utils.PackTargz(
 			layer.bootstrapPath, utils.BootstrapFileNameInLayer, true,
 		)
@@ -180,7 +212,13 @@ func (layer *buildLayer) pushBootstrap(ctx context.Context) (*ocispec.Descriptor
 	return &desc, &uncompressedDigest, nil
 }
 
-func (layer *buildLayer) Push(ctx context.Context) error {
+func (layer *buildLayer) Push(ctx context.Context) (retErr error) {
+	defer metrics.LayerStage(metrics.StagePush)()
+	ctx, span := tracing.Start(ctx, "push layer", attribute.String("source_digest", layer.source.Digest().String()))
+	defer func() {
+		tracing.End(span, retErr)
+	}()
+
 	// Push Nydus bootstrap layer to remote registry
 	bootstrapInfo, err := os.Stat(layer.bootstrapPath)
 	if err != nil {
@@ -209,7 +247,7 @@ func (layer *buildLayer) Push(ctx context.Context) error {
 
 		blobSize := humanize.Bytes(uint64(info.Size()))
 		var op string
-		if layer.backend.Type() == backend.OssBackend {
+		if !backend.InRegistry(layer.backend.Type()) {
 			op = "Upload"
 		} else {
 			op = "Push"
@@ -221,6 +259,7 @@ func (layer *buildLayer) Push(ctx context.Context) error {
 		if err := layer.pushBlob(ctx, info.Size()); err != nil {
 			return pushDone(errors.Wrapf(err, "Push Nydus blob layer"))
 		}
+		layer.progress.BlobUploaded(info.Size())
 
 		pushDone(nil)
 	}
@@ -231,17 +270,29 @@ func (layer *buildLayer) Push(ctx context.Context) error {
 		logrus.Warnf("Failed push layer to cache image: %s", err)
 	}
 
+	if layer.checkpoint != nil {
+		if err := layer.checkpoint.Add(layer.GetCacheRecord(), layer.bootstrapPath); err != nil {
+			logrus.Warnf("Failed to save checkpoint of layer %s: %s", layer.source.Digest(), err)
+		}
+	}
+
 	return nil
 }
 
 func (layer *buildLayer) Mount(ctx context.Context) (func() error, error) {
 	sourceLayerSize := humanize.Bytes(uint64(layer.source.Size()))
 
+	// The layer has been pushed by previous run, see checkpoint
+	if layer.cacheRecord != nil {
+		return nil, nil
+	}
+
 	// Give priority to checking & pulling Nydus layer from cache image
 	cacheRecord, err := layer.cacheGlue.Pull(ctx, layer.source.ChainID())
 	if err != nil {
 		logrus.Warnf("Failed to get cache record: %s", err)
 	}
+	metrics.BuildCacheCount(cacheRecord != nil)
 	if cacheRecord != nil {
 		layer.cacheRecord = cacheRecord
 		return nil, nil
@@ -250,12 +301,28 @@ func (layer *buildLayer) Mount(ctx context.Context) (func() error, error) {
 	bootstrapName := strconv.Itoa(layer.index+1) + "-" + layer.source.Digest().String()
 	layer.bootstrapPath = filepath.Join(layer.bootstrapsDir, bootstrapName)
 
+	if layer.tarSplit != nil {
+		source, ok := layer.source.(provider.TarSplitSourceLayer)
+		if !ok {
+			return nil, fmt.Errorf("tar-split isn't supported by source layer %s", layer.source.Digest())
+		}
+		layer.tarSplitPath = layer.bootstrapPath + ".tar-split.json"
+		source.RecordTarSplit(layer.tarSplitPath)
+	}
+
 	// Pull source layer for building on next if no cache hit
 	mountDone := logger.Log(ctx, "[SOUR] Mount layer", provider.LoggerFields{
 		"Digest": layer.source.Digest(),
 		"Size":   sourceLayerSize,
 	})
-	mounts, umount, err := layer.source.Mount(ctx)
+	pullDone := metrics.LayerStage(metrics.StagePull)
+	pullCtx, span := tracing.Start(ctx, "pull layer",
+		attribute.String("source_digest", layer.source.Digest().String()),
+		attribute.Int64("source_size", layer.source.Size()),
+	)
+	mounts, umount, err := layer.source.Mount(pullCtx)
+	tracing.End(span, err)
+	pullDone()
 	if err != nil {
 		return nil, mountDone(errors.Wrapf(err, "Mount source layer %s", layer.source.Digest()))
 	}
@@ -268,7 +335,13 @@ func (layer *buildLayer) Mount(ctx context.Context) (func() error, error) {
 	return umount, mountDone(nil)
 }
 
-func (layer *buildLayer) Build(ctx context.Context) error {
+func (layer *buildLayer) Build(ctx context.Context) (retErr error) {
+	defer metrics.LayerStage(metrics.StageBuild)()
+	_, span := tracing.Start(ctx, "build layer", attribute.String("source_digest", layer.source.Digest().String()))
+	defer func() {
+		tracing.End(span, retErr)
+	}()
+
 	sourceSize := humanize.Bytes(uint64(layer.source.Size()))
 
 	// Build Nydus blob and bootstrap file to temp directory
@@ -280,7 +353,8 @@ func (layer *buildLayer) Build(ctx context.Context) error {
 	parentLayer := layer.parent
 	if parentLayer != nil {
 		// Try to reuse the bootstrap of parent layer in cache record
-		if parentLayer.Cached() {
+		// The bootstrap of layer resumed from checkpoint is already in local
+		if parentLayer.Cached() && parentLayer.bootstrapPath == "" {
 			bootstrapName := strconv.Itoa(parentLayer.index+1) + "-" + parentLayer.source.Digest().String()
 			parentLayer.bootstrapPath = filepath.Join(parentLayer.bootstrapsDir, bootstrapName+"-cached")
 			if err := parentLayer.cacheGlue.PullBootstrap(ctx, parentLayer.source.ChainID(), parentLayer.bootstrapPath); err != nil {
@@ -291,8 +365,13 @@ func (layer *buildLayer) Build(ctx context.Context) error {
 		}
 		parentBootstrapPath = parentLayer.bootstrapPath
 	}
+	if prepared, ok := layer.source.(provider.PreparedSourceLayer); ok {
+		if err := prepared.Prepare(ctx, parentBootstrapPath); err != nil {
+			return buildDone(errors.Wrapf(err, "Prepare source layer %s", layer.source.Digest()))
+		}
+	}
 	blobPath, err := layer.buildWorkflow.Build(
-		layer.sourceMount.Source, layer.sourceMount.WhiteoutSpec, parentBootstrapPath, layer.bootstrapPath, layer.alignedChunk,
+		ctx, layer.sourceMount.Source, layer.sourceMount.WhiteoutSpec, parentBootstrapPath, layer.bootstrapPath, layer.alignedChunk,
 	)
 	if err != nil {
 		return buildDone(errors.Wrapf(err, "Build source layer %s", layer.source.Digest()))
@@ -301,6 +380,18 @@ func (layer *buildLayer) Build(ctx context.Context) error {
 	// The built blob will be removed after `upload` phrase.
 	layer.blobPath = blobPath
 
+	if layer.sbom != nil {
+		if err := layer.sbom.AddLayer(layer.index, layer.sourceMount.Source, layer.sourceMount.WhiteoutSpec); err != nil {
+			return buildDone(errors.Wrapf(err, "Collect SBOM of source layer %s", layer.source.Digest()))
+		}
+	}
+
+	if layer.tarSplit != nil {
+		if err := layer.tarSplit.AddLayer(layer.index, layer.tarSplitPath, layer.bootstrapPath); err != nil {
+			return buildDone(errors.Wrapf(err, "Collect tar-split of source layer %s", layer.source.Digest()))
+		}
+	}
+
 	return buildDone(nil)
 }
 
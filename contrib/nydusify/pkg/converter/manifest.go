@@ -34,6 +34,13 @@ type manifestManager struct {
 	multiPlatform  bool
 	dockerV2Format bool
 	buildInfo      *BuildInfo
+	// Only push Nydus manifest by digest without tagging.
+	manifestOnly bool
+	// The pushed Nydus manifest.
+	manifestDesc *ocispec.Descriptor
+	// Written to bootstrap layer annotation if specified.
+	prefetchPolicy string
+	annotation     AnnotationOpt
 }
 
 // Try to get manifests from exists target image
@@ -90,12 +97,14 @@ func (mm *manifestManager) makeManifestIndex(
 	for _, desc := range existDescs {
 		if desc.Platform != nil {
 			// Input nydus image manifest must have platform filled before making this manifest index.
-			if matched := utils.MatchNydusPlatform(&desc, nydusManifest.Platform.OS, nydusManifest.Platform.Architecture); matched {
+			// The Windows manifests of same os/arch are told apart by OS version.
+			sameOSVersion := desc.Platform.OSVersion == nydusManifest.Platform.OSVersion
+			if matched := utils.MatchNydusPlatform(&desc, nydusManifest.Platform.OS, nydusManifest.Platform.Architecture); matched && sameOSVersion {
 				continue
 			}
 
 			if (desc.Platform.OS == nydusManifest.Platform.OS) &&
-				(desc.Platform.Architecture == nydusManifest.Platform.Architecture) &&
+				(desc.Platform.Architecture == nydusManifest.Platform.Architecture) && sameOSVersion &&
 				!utils.IsNydusPlatform(desc.Platform) {
 				foundOCI = true
 			}
@@ -121,9 +130,16 @@ func (mm *manifestManager) makeManifestIndex(
 
 	// Append the OCI manifest provided by source to manifest list
 	if !foundOCI && ociManifest != nil {
-		ociManifest.Platform = &ocispec.Platform{
-			OS:           utils.SupportedOS,
-			Architecture: utils.SupportedArch,
+		// Keep the platform cloned from source, e.g. the OS version of
+		// Windows image.
+		if ociManifest.Platform == nil {
+			ociManifest.Platform = &ocispec.Platform{}
+		}
+		if ociManifest.Platform.OS == "" {
+			ociManifest.Platform.OS = utils.SupportedOS
+		}
+		if ociManifest.Platform.Architecture == "" {
+			ociManifest.Platform.Architecture = utils.SupportedArch
 		}
 		descs = append(descs, *ociManifest)
 	}
@@ -143,6 +159,27 @@ func (mm *manifestManager) makeManifestIndex(
 	return &index, nil
 }
 
+// foreignLayerMediaType returns the media type of foreign layer in the
+// format of Nydus manifest, the layer digest is the same in both formats.
+func foreignLayerMediaType(mediaType string, dockerV2Format bool) string {
+	toDocker := map[string]string{
+		ocispec.MediaTypeImageLayerNonDistributable:     images.MediaTypeDockerSchema2LayerForeign,
+		ocispec.MediaTypeImageLayerNonDistributableGzip: images.MediaTypeDockerSchema2LayerForeignGzip,
+	}
+	if dockerV2Format {
+		if converted, ok := toDocker[mediaType]; ok {
+			return converted
+		}
+		return mediaType
+	}
+	for oci, docker := range toDocker {
+		if docker == mediaType {
+			return oci
+		}
+	}
+	return mediaType
+}
+
 func (mm *manifestManager) CloneSourcePlatform(ctx context.Context, additionalOSFeatures string) (*ocispec.Platform, error) {
 	sourceConfig, err := mm.sourceProvider.Config(ctx)
 	if err != nil {
@@ -154,18 +191,60 @@ func (mm *manifestManager) CloneSourcePlatform(ctx context.Context, additionalOS
 		features = append(features, additionalOSFeatures)
 	}
 
+	// The OS version of Windows image is required by Windows runtime to
+	// select the manifest compatible to host.
+	osVersion := ""
+	if sourceConfig.OS == "windows" {
+		osVersion, err = mm.sourceOSVersion(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Source image configuration must exist according to OCI image spec.
 	return &ocispec.Platform{
 		OS:           sourceConfig.OS,
 		Architecture: sourceConfig.Architecture,
+		OSVersion:    osVersion,
 		OSFeatures:   features,
 	}, nil
 }
 
+// sourceOSVersion returns the OS version of source image, from the platform
+// in source manifest index or the `os.version` of source config.
+func (mm *manifestManager) sourceOSVersion(ctx context.Context) (string, error) {
+	manifestDesc, err := mm.sourceProvider.Manifest(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "can't take in source image manifest")
+	}
+	if manifestDesc != nil && manifestDesc.Platform != nil && manifestDesc.Platform.OSVersion != "" {
+		return manifestDesc.Platform.OSVersion, nil
+	}
+
+	rsp, ok := mm.sourceProvider.(provider.RawSourceProvider)
+	if !ok {
+		return "", nil
+	}
+	data, err := rsp.RawConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		OSVersion string `json:"os.version,omitempty"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", errors.Wrap(err, "Unmarshal source image config")
+	}
+	return config.OSVersion, nil
+}
+
 func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer) error {
 	layers := []ocispec.Descriptor{}
 	// add reference blobs to annotation
 	blobListInAnnotation := mm.referenceBlobs
+	// CIDs of the blobs added to IPFS, the reference blobs have no CIDs and
+	// are read from registry.
+	blobCIDs := map[string]string{}
 
 	for idx, _layer := range buildLayers {
 		record := _layer.GetCacheRecord()
@@ -173,10 +252,13 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 		if record.NydusBlobDesc != nil {
 			// Write blob digest list in JSON format to layer annotation of bootstrap.
 			blobListInAnnotation = append(blobListInAnnotation, record.NydusBlobDesc.Digest.Hex())
+			if cid := record.NydusBlobDesc.Annotations[utils.LayerAnnotationNydusBlobCID]; cid != "" {
+				blobCIDs[record.NydusBlobDesc.Digest.Hex()] = cid
+			}
 			// For registry backend, we need to write the blob layer to
 			// manifest to prevent them from being deleted by registry GC.
 			// todo: add reference blobs layer to manifest
-			if mm.backend.Type() == backend.RegistryBackend {
+			if backend.InRegistry(mm.backend.Type()) {
 				layers = append(layers, *record.NydusBlobDesc)
 			}
 		}
@@ -188,6 +270,16 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 				return errors.Wrap(err, "Marshal blob list")
 			}
 			record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusBlobIDs] = string(blobListBytes)
+			if len(blobCIDs) > 0 {
+				blobCIDsBytes, err := json.Marshal(blobCIDs)
+				if err != nil {
+					return errors.Wrap(err, "Marshal blob CIDs")
+				}
+				record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusIPFSCIDs] = string(blobCIDsBytes)
+			}
+			if mm.prefetchPolicy != "" {
+				record.NydusBootstrapDesc.Annotations[utils.LayerAnnotationNydusPrefetchPolicy] = mm.prefetchPolicy
+			}
 			layers = append(layers, *record.NydusBootstrapDesc)
 		}
 	}
@@ -198,12 +290,24 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 	}
 	ociConfig.RootFS.DiffIDs = []digest.Digest{}
 	ociConfig.History = []ocispec.History{}
+	ociConfig.Config.Labels = mergeAnnotations(ociConfig.Config.Labels, mm.annotation.StripLabels, mm.annotation.Labels)
+
+	// The annotations of source manifest are kept, overridden by Nydus
+	// build info and the specified ones.
+	sourceAnnotations, err := provider.ManifestAnnotations(ctx, mm.sourceProvider)
+	if err != nil {
+		return errors.Wrap(err, "Get source manifest annotations")
+	}
+	annotations := mergeAnnotations(sourceAnnotations, mm.annotation.StripAnnotations, mm.buildInfo.Dump(), mm.annotation.Annotations)
 
 	// Remove useless annotations from layer
 	validAnnotationKeys := map[string]bool{
-		utils.LayerAnnotationNydusBlob:      true,
-		utils.LayerAnnotationNydusBlobIDs:   true,
-		utils.LayerAnnotationNydusBootstrap: true,
+		utils.LayerAnnotationNydusBlob:           true,
+		utils.LayerAnnotationNydusBlobIDs:        true,
+		utils.LayerAnnotationNydusBootstrap:      true,
+		utils.LayerAnnotationNydusPrefetchPolicy: true,
+		utils.LayerAnnotationNydusFsVersion:      true,
+		utils.LayerAnnotationNydusIPFSCIDs:       true,
 	}
 	for idx, desc := range layers {
 		layerDiffID := digest.Digest(desc.Annotations[utils.LayerAnnotationUncompressed])
@@ -222,12 +326,40 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 		}
 	}
 
+	// The foreign layers of Windows image are referenced as they are
+	// under Nydus layers, they're pulled from their URLs by Windows runtime.
+	foreignLayers, foreignDiffIDs, err := provider.ForeignLayers(ctx, mm.sourceProvider)
+	if err != nil {
+		return errors.Wrap(err, "Get source foreign layers")
+	}
+	if len(foreignLayers) > 0 {
+		foreign := make([]ocispec.Descriptor, 0, len(foreignLayers)+len(layers))
+		for _, desc := range foreignLayers {
+			desc.MediaType = foreignLayerMediaType(desc.MediaType, mm.dockerV2Format)
+			foreign = append(foreign, desc)
+		}
+		layers = append(foreign, layers...)
+		ociConfig.RootFS.DiffIDs = append(append([]digest.Digest{}, foreignDiffIDs...), ociConfig.RootFS.DiffIDs...)
+	}
+
 	// Push Nydus image config
 	configMediaType := ocispec.MediaTypeImageConfig
 	if mm.dockerV2Format {
 		configMediaType = images.MediaTypeDockerSchema2Config
 	}
-	configDesc, configBytes, err := utils.MarshalToDesc(ociConfig, configMediaType)
+	// The `os.version` of Windows image config isn't in ocispec.Image.
+	var nydusConfig interface{} = ociConfig
+	if ociConfig.OS == "windows" {
+		osVersion, err := mm.sourceOSVersion(ctx)
+		if err != nil {
+			return err
+		}
+		nydusConfig = struct {
+			*ocispec.Image
+			OSVersion string `json:"os.version,omitempty"`
+		}{ociConfig, osVersion}
+	}
+	configDesc, configBytes, err := utils.MarshalToDesc(nydusConfig, configMediaType)
 	if err != nil {
 		return errors.Wrap(err, "Marshal source image config")
 	}
@@ -253,7 +385,7 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 			},
 			Config:      *configDesc,
 			Layers:      layers,
-			Annotations: mm.buildInfo.Dump(),
+			Annotations: annotations,
 		},
 	}
 
@@ -269,16 +401,26 @@ func (mm *manifestManager) Push(ctx context.Context, buildLayers []*buildLayer)
 
 	nydusManifestDesc.Platform = p
 
+	if mm.manifestOnly {
+		if err := mm.remote.Push(ctx, *nydusManifestDesc, true, bytes.NewReader(manifestBytes)); err != nil {
+			return errors.Wrap(err, "Push nydus image manifest")
+		}
+		mm.manifestDesc = nydusManifestDesc
+		return nil
+	}
+
 	if !mm.multiPlatform {
 		if err := mm.remote.Push(ctx, *nydusManifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
 			return errors.Wrap(err, "Push nydus image manifest")
 		}
+		mm.manifestDesc = nydusManifestDesc
 		return nil
 	}
 
 	if err := mm.remote.Push(ctx, *nydusManifestDesc, true, bytes.NewReader(manifestBytes)); err != nil {
 		return errors.Wrap(err, "Push nydus image manifest")
 	}
+	mm.manifestDesc = nydusManifestDesc
 
 	// Push manifest index, includes OCI manifest and Nydus manifest
 	ociManifestDesc, err := mm.sourceProvider.Manifest(ctx)
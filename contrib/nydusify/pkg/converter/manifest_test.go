@@ -9,6 +9,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/containerd/containerd/images"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -136,4 +137,33 @@ func TestManifest(t *testing.T) {
 		makeDesc("2", makePlatform("linux/ppc64le", false)),
 		makeDesc("nydus", makePlatform("linux/amd64", true)),
 	}, index.Manifests)
+
+	// The Windows manifests of other OS versions are kept
+	windowsPlatform := func(osVersion string, nydus bool) *ocispec.Platform {
+		platform := makePlatform("windows/amd64", nydus)
+		platform.OSVersion = osVersion
+		return platform
+	}
+	nydusDesc = makeDesc("nydus-ltsc2022", windowsPlatform("10.0.20348.1006", true))
+	ociDesc = makeDesc("ltsc2022", windowsPlatform("10.0.20348.1006", false))
+	existDescs = []ocispec.Descriptor{
+		makeDesc("ltsc2019", windowsPlatform("10.0.17763.3406", false)),
+		makeDesc("nydus-ltsc2019", windowsPlatform("10.0.17763.3406", true)),
+		makeDesc("nydus-ltsc2022-old", windowsPlatform("10.0.20348.1006", true)),
+	}
+	index, err = mm.makeManifestIndex(context.Background(), existDescs, &nydusDesc, &ociDesc)
+	assert.Nil(t, err)
+	assert.Equal(t, []ocispec.Descriptor{
+		makeDesc("ltsc2019", windowsPlatform("10.0.17763.3406", false)),
+		makeDesc("nydus-ltsc2019", windowsPlatform("10.0.17763.3406", true)),
+		makeDesc("ltsc2022", windowsPlatform("10.0.20348.1006", false)),
+		makeDesc("nydus-ltsc2022", windowsPlatform("10.0.20348.1006", true)),
+	}, index.Manifests)
+}
+
+func TestForeignLayerMediaType(t *testing.T) {
+	assert.Equal(t, ocispec.MediaTypeImageLayerNonDistributableGzip, foreignLayerMediaType(images.MediaTypeDockerSchema2LayerForeignGzip, false))
+	assert.Equal(t, images.MediaTypeDockerSchema2LayerForeignGzip, foreignLayerMediaType(images.MediaTypeDockerSchema2LayerForeignGzip, true))
+	assert.Equal(t, images.MediaTypeDockerSchema2LayerForeign, foreignLayerMediaType(ocispec.MediaTypeImageLayerNonDistributable, true))
+	assert.Equal(t, ocispec.MediaTypeImageLayerNonDistributable, foreignLayerMediaType(ocispec.MediaTypeImageLayerNonDistributable, false))
 }
@@ -0,0 +1,84 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/provenance"
+)
+
+type provenanceInfo struct {
+	startedOn      time.Time
+	sourceDigest   string
+	builderVersion string
+	chunkDict      string
+	// The bootstrap of top layer, it's empty if the layer is from cache.
+	bootstrapPath string
+}
+
+// attachProvenance records the conversion of target image as an in-toto
+// attestation, then attaches it to the pushed Nydus manifest.
+func (cvt *Converter) attachProvenance(ctx context.Context, info provenanceInfo) error {
+	params := provenance.Parameters{
+		Compressor:       cvt.Compressor,
+		AlignedChunk:     cvt.BackendAlignedChunk,
+		ChunkDict:        info.chunkDict,
+		Flatten:          cvt.Flatten,
+		WhiteoutStrategy: string(cvt.WhiteoutStrategy),
+		HardlinkStrategy: string(cvt.HardlinkStrategy),
+		PrefetchPatterns: cvt.PrefetchDir,
+		PrefetchPolicy:   cvt.PrefetchPolicy,
+		BackendType:      backend.TypeName(cvt.storageBackend.Type()),
+		DockerV2Format:   cvt.DockerV2Format,
+	}
+	if cvt.PathFilter != nil {
+		params.IncludePaths = cvt.PathFilter.Include
+		params.ExcludePaths = cvt.PathFilter.Exclude
+	}
+	if info.bootstrapPath != "" {
+		superBlock, err := dedup.ReadSuperBlock(info.bootstrapPath)
+		if err != nil {
+			logrus.Warnf("Failed to read bootstrap format parameters: %s", err)
+		} else {
+			params.Compressor = superBlock.Compressor
+			params.DigestAlgorithm = superBlock.DigestAlgorithm
+			params.ChunkSize = superBlock.ChunkSize
+		}
+	}
+
+	statement := provenance.New(provenance.Opt{
+		Target:          cvt.TargetRemote.Ref,
+		TargetDigest:    cvt.manifestDesc.Digest,
+		Source:          cvt.Source,
+		SourceDigest:    digest.Digest(info.sourceDigest),
+		NydusifyVersion: cvt.NydusifyVersion,
+		BuilderVersion:  info.builderVersion,
+		Parameters:      params,
+		StartedOn:       info.startedOn,
+		FinishedOn:      time.Now(),
+	})
+	data, err := statement.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "Marshal provenance")
+	}
+
+	referrer, err := cvt.attachArtifact(ctx, provenance.MediaTypeInToto, provenance.MediaTypeInToto, data, map[string]string{
+		provenance.AnnotationPredicateType: statement.PredicateType,
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Attached provenance %s to %s", referrer.Digest, cvt.TargetRemote.Ref)
+	return nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const (
+	// DockerArchivePrefix is the source prefix of `docker save` tarball.
+	DockerArchivePrefix = "docker-archive:"
+	// OCIArchivePrefix is the source prefix of OCI image layout tarball.
+	OCIArchivePrefix = "oci-archive:"
+
+	// Read archive from stdin if the path is `-`.
+	archiveStdin = "-"
+	// Follow symlinks in archive (layers shared by `docker save`) up
+	// to this depth.
+	maxArchiveLinks = 8
+)
+
+// IsArchiveSource returns true if the source is a docker-archive or
+// oci-archive tarball rather than an image reference.
+func IsArchiveSource(source string) bool {
+	return strings.HasPrefix(source, DockerArchivePrefix) || strings.HasPrefix(source, OCIArchivePrefix)
+}
+
+type archiveEntry struct {
+	offset   int64
+	size     int64
+	linkname string
+}
+
+// archive indexes the entries of an uncompressed tarball, so that the
+// blobs can be read by offset without unpacking the tarball.
+type archive struct {
+	file    *os.File
+	entries map[string]archiveEntry
+	// Blob digest to entry name in archive.
+	blobs map[digest.Digest]string
+}
+
+// spoolStdin writes the archive streamed from stdin to work directory,
+// the entries must be seekable to be read in any order.
+func spoolStdin(workDir string) (string, error) {
+	archivePath := filepath.Join(workDir, "archive.tar")
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return "", errors.Wrap(err, "Create archive file")
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, os.Stdin); err != nil {
+		return "", errors.Wrap(err, "Read archive from stdin")
+	}
+
+	return archivePath, nil
+}
+
+func openArchive(archivePath string) (*archive, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Open archive")
+	}
+
+	a := &archive{
+		file:    file,
+		entries: map[string]archiveEntry{},
+		blobs:   map[digest.Digest]string{},
+	}
+
+	// The data of a tar entry directly follows its header, so the offset
+	// is the position of reader after reading the header.
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "Read archive")
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			offset, err := file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				file.Close()
+				return nil, errors.Wrap(err, "Seek archive")
+			}
+			a.entries[name] = archiveEntry{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			a.entries[name] = archiveEntry{linkname: path.Join(path.Dir(name), hdr.Linkname)}
+		case tar.TypeLink:
+			a.entries[name] = archiveEntry{linkname: path.Clean(hdr.Linkname)}
+		}
+	}
+
+	return a, nil
+}
+
+func (a *archive) open(name string) (*io.SectionReader, error) {
+	name = path.Clean(name)
+	for i := 0; i < maxArchiveLinks; i++ {
+		entry, ok := a.entries[name]
+		if !ok {
+			return nil, fmt.Errorf("not found %s in archive", name)
+		}
+		if entry.linkname == "" {
+			return io.NewSectionReader(a.file, entry.offset, entry.size), nil
+		}
+		name = entry.linkname
+	}
+	return nil, fmt.Errorf("too many levels of links for %s in archive", name)
+}
+
+func (a *archive) readJSON(name string, v interface{}) error {
+	reader, err := a.open(name)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrapf(err, "Read %s in archive", name)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.Wrapf(err, "Unmarshal %s in archive", name)
+	}
+	return nil
+}
+
+// digestOf returns the digest of entry, it's calculated unless the entry
+// is named by digest in blobs directory of OCI image layout.
+func (a *archive) digestOf(name string) (digest.Digest, int64, error) {
+	reader, err := a.open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	parts := strings.Split(path.Clean(name), "/")
+	if len(parts) == 3 && parts[0] == "blobs" {
+		if dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2]); dgst.Validate() == nil {
+			return dgst, reader.Size(), nil
+		}
+	}
+	dgst, err := digest.FromReader(reader)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "Calculate digest of %s in archive", name)
+	}
+	return dgst, reader.Size(), nil
+}
+
+// Pull reads the blob in archive by digest, it has the same signature
+// as remote.Remote, so that layers are pulled in the same way.
+func (a *archive) Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error) {
+	name, ok := a.blobs[desc.Digest]
+	if !ok {
+		name = path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	}
+	reader, err := a.open(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+func checkArchiveConfig(config *ocispec.Image, arch string) error {
+	if config.OS == "" || config.Architecture == "" {
+		return errors.New("Source image configuration does not have os or architecture")
+	}
+	if config.Architecture != arch {
+		return errors.Errorf("Specified %s architecture was not found", arch)
+	}
+	return nil
+}
+
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// parseDockerArchive parses the image in `docker save` tarball, the
+// image manifest isn't in the tarball, so it's made from the config
+// and layers in `manifest.json`.
+func (a *archive) parseDockerArchive(arch string) (*parser.Image, error) {
+	var manifests []dockerArchiveManifest
+	if err := a.readJSON("manifest.json", &manifests); err != nil {
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, fmt.Errorf("not found image in docker archive")
+	}
+	if len(manifests) > 1 {
+		logrus.Warnf("Found %d images in docker archive, only the first one %v is converted", len(manifests), manifests[0].RepoTags)
+	}
+	archiveManifest := manifests[0]
+
+	var config ocispec.Image
+	if err := a.readJSON(archiveManifest.Config, &config); err != nil {
+		return nil, err
+	}
+	if err := checkArchiveConfig(&config, arch); err != nil {
+		return nil, err
+	}
+	configDigest, configSize, err := a.digestOf(archiveManifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	a.blobs[configDigest] = archiveManifest.Config
+
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		Config: ocispec.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2Config,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ocispec.Descriptor{},
+	}
+	for _, layer := range archiveManifest.Layers {
+		layerDigest, layerSize, err := a.digestOf(layer)
+		if err != nil {
+			return nil, err
+		}
+		a.blobs[layerDigest] = layer
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2Layer,
+			Digest:    layerDigest,
+			Size:      layerSize,
+		})
+	}
+
+	desc, _, err := utils.MarshalToDesc(manifest, images.MediaTypeDockerSchema2Manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal image manifest")
+	}
+
+	return &parser.Image{
+		Desc:     *desc,
+		Manifest: manifest,
+		Config:   config,
+	}, nil
+}
+
+// findOCIManifest finds the manifest of platform in OCI image layout,
+// the nested index (manifest list) is also searched.
+func (a *archive) findOCIManifest(index *ocispec.Index, osName, arch string, depth int) (*ocispec.Descriptor, error) {
+	for idx := range index.Manifests {
+		desc := index.Manifests[idx]
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			if depth >= maxArchiveLinks {
+				continue
+			}
+			var nested ocispec.Index
+			if err := a.readJSON(path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()), &nested); err != nil {
+				return nil, err
+			}
+			found, err := a.findOCIManifest(&nested, osName, arch, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if found != nil {
+				return found, nil
+			}
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			if desc.Platform == nil {
+				return &desc, nil
+			}
+			if desc.Platform.OS == osName && desc.Platform.Architecture == arch && !utils.IsNydusPlatform(desc.Platform) {
+				return &desc, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// parseOCIArchive parses the image of platform in OCI image layout tarball.
+func (a *archive) parseOCIArchive(osName, arch string) (*parser.Image, error) {
+	var index ocispec.Index
+	if err := a.readJSON("index.json", &index); err != nil {
+		return nil, err
+	}
+	desc, err := a.findOCIManifest(&index, osName, arch, 0)
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil {
+		return nil, fmt.Errorf("not found OCI %s/%s manifest in oci archive", osName, arch)
+	}
+
+	var manifest ocispec.Manifest
+	if err := a.readJSON(path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()), &manifest); err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := a.readJSON(path.Join("blobs", manifest.Config.Digest.Algorithm().String(), manifest.Config.Digest.Encoded()), &config); err != nil {
+		return nil, err
+	}
+	if err := checkArchiveConfig(&config, arch); err != nil {
+		return nil, err
+	}
+
+	return &parser.Image{
+		Desc:     *desc,
+		Manifest: manifest,
+		Config:   config,
+	}, nil
+}
+
+// ArchiveSource reads image layers from docker-archive or oci-archive
+// tarball, the source is formatted as `docker-archive:/path/to/image.tar`,
+// use `-` as path to read the tarball from stdin.
+func ArchiveSource(ctx context.Context, source, workDir, platform string, keys *DecryptionKeys) ([]SourceProvider, error) {
+	osName, arch, err := ExtractConvertibleOsArch(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	var archivePath string
+	var oci bool
+	if strings.HasPrefix(source, OCIArchivePrefix) {
+		archivePath, oci = strings.TrimPrefix(source, OCIArchivePrefix), true
+	} else if strings.HasPrefix(source, DockerArchivePrefix) {
+		archivePath = strings.TrimPrefix(source, DockerArchivePrefix)
+	} else {
+		return nil, fmt.Errorf("invalid archive source %s", source)
+	}
+
+	if archivePath == archiveStdin {
+		archivePath, err = spoolStdin(workDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a, err := openArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var image *parser.Image
+	if oci {
+		image, err = a.parseOCIArchive(osName, arch)
+	} else {
+		image, err = a.parseDockerArchive(arch)
+	}
+	if err != nil {
+		a.file.Close()
+		return nil, errors.Wrap(err, "Parse source archive")
+	}
+
+	sp := []SourceProvider{
+		&defaultSourceProvider{
+			workDir:        workDir,
+			image:          *image,
+			remote:         a,
+			decryptionKeys: keys,
+		},
+	}
+
+	return sp, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+type testArchiveFile struct {
+	name     string
+	data     []byte
+	linkname string
+}
+
+func writeTestArchive(t *testing.T, archivePath string, files []testArchiveFile) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		if file.linkname != "" {
+			assert.Nil(t, tw.WriteHeader(&tar.Header{Name: file.name, Linkname: file.linkname, Typeflag: tar.TypeSymlink}))
+			continue
+		}
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(file.data)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, ioutil.WriteFile(archivePath, buf.Bytes(), 0644))
+}
+
+func makeTestLayer(t *testing.T, name, content string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte(content))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Close())
+	return buf.Bytes()
+}
+
+func marshalTestJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	assert.Nil(t, err)
+	return data
+}
+
+func checkArchiveSource(t *testing.T, source, workDir string, layer []byte) {
+	sps, err := ArchiveSource(context.Background(), source, workDir, "linux/amd64", nil)
+	assert.Nil(t, err)
+	assert.Len(t, sps, 1)
+
+	config, err := sps[0].Config(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "amd64", config.Architecture)
+
+	layers, err := sps[0].Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, layers, 2)
+	assert.Equal(t, digest.FromBytes(layer), layers[0].Digest())
+	assert.Equal(t, layers[0].Digest(), layers[1].Digest())
+	assert.NotEqual(t, layers[0].ChainID(), layers[1].ChainID())
+
+	mounts, umount, err := layers[0].Mount(context.Background())
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(mounts[0].Source, "hello.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+	assert.Nil(t, umount())
+
+	_, err = ArchiveSource(context.Background(), source, workDir, "linux/arm64", nil)
+	assert.NotNil(t, err)
+}
+
+func TestDockerArchiveSource(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-archive-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	layer := makeTestLayer(t, "hello.txt", "hello")
+	config := ocispec.Image{OS: "linux", Architecture: "amd64"}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []digest.Digest{digest.FromBytes(layer), digest.FromBytes(layer)}
+
+	archivePath := filepath.Join(workDir, "image.tar")
+	writeTestArchive(t, archivePath, []testArchiveFile{
+		{name: "config.json", data: marshalTestJSON(t, config)},
+		{name: "layer1/layer.tar", data: layer},
+		// Layers of the same content are linked by `docker save`.
+		{name: "layer2/layer.tar", linkname: "../layer1/layer.tar"},
+		{name: "manifest.json", data: marshalTestJSON(t, []dockerArchiveManifest{{
+			Config:   "config.json",
+			RepoTags: []string{"hello:latest"},
+			Layers:   []string{"layer1/layer.tar", "layer2/layer.tar"},
+		}})},
+	})
+
+	assert.True(t, IsArchiveSource(DockerArchivePrefix+archivePath))
+	assert.False(t, IsArchiveSource("docker.io/library/hello:latest"))
+	checkArchiveSource(t, DockerArchivePrefix+archivePath, workDir, layer)
+}
+
+func TestOCIArchiveSource(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-archive-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	layer := makeTestLayer(t, "hello.txt", "hello")
+	layerDigest := digest.FromBytes(layer)
+	config := ocispec.Image{OS: "linux", Architecture: "amd64"}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []digest.Digest{layerDigest, layerDigest}
+	configBytes := marshalTestJSON(t, config)
+	manifest := ocispec.Manifest{
+		Config: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(configBytes), Size: int64(len(configBytes))},
+		Layers: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayer, Digest: layerDigest, Size: int64(len(layer))},
+			{MediaType: ocispec.MediaTypeImageLayer, Digest: layerDigest, Size: int64(len(layer))},
+		},
+	}
+	manifest.SchemaVersion = 2
+	manifestBytes := marshalTestJSON(t, manifest)
+	manifestDigest := digest.FromBytes(manifestBytes)
+	index := ocispec.Index{Manifests: []ocispec.Descriptor{
+		{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    digest.FromString("arm64"),
+			Platform:  &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+		},
+		{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      int64(len(manifestBytes)),
+			Platform:  &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		},
+	}}
+	index.SchemaVersion = 2
+
+	archivePath := filepath.Join(workDir, "image.tar")
+	writeTestArchive(t, archivePath, []testArchiveFile{
+		{name: "oci-layout", data: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{name: "index.json", data: marshalTestJSON(t, index)},
+		{name: "blobs/sha256/" + manifestDigest.Encoded(), data: manifestBytes},
+		{name: "blobs/sha256/" + digest.FromBytes(configBytes).Encoded(), data: configBytes},
+		{name: "blobs/sha256/" + layerDigest.Encoded(), data: layer},
+	})
+
+	checkArchiveSource(t, OCIArchivePrefix+archivePath, workDir, layer)
+}
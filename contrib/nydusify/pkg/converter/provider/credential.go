@@ -0,0 +1,168 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/credentials"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/pkg/errors"
+)
+
+// Credentials got from helper are cached for the duration, the short-lived
+// tokens like ECR (12 hours) and GCR (1 hour) are refreshed before expiry.
+const defaultCredentialTTL = 10 * time.Minute
+
+// Well known credential helpers of cloud registries, they are used if
+// no auth is configured for the host in docker config file and the
+// helper binary `docker-credential-<helper>` exists in PATH.
+var knownCredentialHelpers = []struct {
+	host   *regexp.Regexp
+	helper string
+}{
+	{regexp.MustCompile(`^[0-9]+\.dkr\.ecr(-fips)?\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`), "ecr-login"},
+	{regexp.MustCompile(`^([a-z]+\.)?gcr\.io$`), "gcloud"},
+	{regexp.MustCompile(`^[a-z0-9-]+-docker\.pkg\.dev$`), "gcloud"},
+	{regexp.MustCompile(`^[a-z0-9]+\.azurecr\.(io|cn|us)$`), "acr-env"},
+}
+
+type cachedCredential struct {
+	username string
+	secret   string
+	expireAt time.Time
+}
+
+// credentialCache resolves registry credentials from docker config file
+// or credential helpers, and caches them per host, so that the helper
+// isn't invoked for each request of conversion.
+type credentialCache struct {
+	// Use the helper for all hosts if specified, for example `ecr-login`.
+	helper string
+	ttl    time.Duration
+	mu     sync.Mutex
+	cached map[string]cachedCredential
+}
+
+func newCredentialCache(helper string) *credentialCache {
+	return &credentialCache{
+		helper: helper,
+		ttl:    defaultCredentialTTL,
+		cached: make(map[string]cachedCredential),
+	}
+}
+
+func detectCredentialHelper(host string) string {
+	for _, known := range knownCredentialHelpers {
+		if !known.host.MatchString(host) {
+			continue
+		}
+		if _, err := exec.LookPath("docker-credential-" + known.helper); err == nil {
+			return known.helper
+		}
+	}
+	return ""
+}
+
+func (cache *credentialCache) lookup(host string) (types.AuthConfig, error) {
+	// The host of docker hub image will be converted to `registry-1.docker.io` in:
+	// github.com/containerd/containerd/remotes/docker/registry.go
+	// But we need use the key `https://index.docker.io/v1/` to find auth from docker config.
+	key := host
+	if host == "registry-1.docker.io" {
+		key = "https://index.docker.io/v1/"
+	}
+
+	config := dockerconfig.LoadDefaultConfigFile(os.Stderr)
+	if cache.helper != "" {
+		authConfig, err := credentials.NewNativeStore(config, cache.helper).Get(key)
+		return authConfig, errors.Wrapf(err, "get credential from helper %s", cache.helper)
+	}
+
+	// Docker config file handles `credHelpers` and `credsStore` itself.
+	authConfig, err := config.GetAuthConfig(key)
+	if err != nil {
+		return authConfig, err
+	}
+	if authConfig.Username != "" || authConfig.Password != "" || authConfig.IdentityToken != "" {
+		return authConfig, nil
+	}
+
+	if helper := detectCredentialHelper(host); helper != "" {
+		registryLogger.Debugf("Use credential helper %s for %s", helper, host)
+		authConfig, err := credentials.NewNativeStore(config, helper).Get(key)
+		return authConfig, errors.Wrapf(err, "get credential from helper %s", helper)
+	}
+
+	return authConfig, nil
+}
+
+// Get implements withCredentialFunc.
+func (cache *credentialCache) Get(host string) (string, string, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cred, ok := cache.cached[host]; ok && time.Now().Before(cred.expireAt) {
+		return cred.username, cred.secret, nil
+	}
+
+	authConfig, err := cache.lookup(host)
+	if err != nil {
+		return "", "", err
+	}
+
+	cred := cachedCredential{
+		username: authConfig.Username,
+		secret:   authConfig.Password,
+		expireAt: time.Now().Add(cache.ttl),
+	}
+	// Containerd uses the secret as refresh token if username is empty.
+	if authConfig.IdentityToken != "" {
+		cred.username = ""
+		cred.secret = authConfig.IdentityToken
+	}
+	cache.cached[host] = cred
+
+	return cred.username, cred.secret, nil
+}
+
+// Invalidate drops all cached credentials, they will be resolved again
+// on next request.
+func (cache *credentialCache) Invalidate() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if len(cache.cached) > 0 {
+		registryLogger.Debugf("Invalidate cached registry credentials")
+	}
+	cache.cached = make(map[string]cachedCredential)
+}
+
+// credentialRefreshTransport invalidates the credential cache once an
+// authorized request is rejected, which usually means the token has
+// expired in a long conversion, the retry of request gets new one.
+type credentialRefreshTransport struct {
+	base  http.RoundTripper
+	cache *credentialCache
+}
+
+func (t *credentialRefreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) &&
+		req.Header.Get("Authorization") != "" {
+		registryLogger.Warnf("Registry rejected credential with status %d: %s", resp.StatusCode, req.URL.Host)
+		t.cache.Invalidate()
+	}
+	return resp, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeCredentialHelper = `#!/bin/sh
+read host
+echo "$host" >> "$(dirname "$0")/calls"
+echo '{"ServerURL": "'$host'", "Username": "AWS", "Secret": "token"}'
+`
+
+func TestCredentialCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-credential-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(fakeCredentialHelper), 0755))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer os.Unsetenv("DOCKER_CONFIG")
+
+	calls := func() []string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+		return strings.Fields(string(data))
+	}
+
+	cache := newCredentialCache("fake")
+	for i := 0; i < 3; i++ {
+		username, secret, err := cache.Get("123456789012.dkr.ecr.us-east-1.amazonaws.com")
+		assert.Nil(t, err)
+		assert.Equal(t, "AWS", username)
+		assert.Equal(t, "token", secret)
+	}
+	assert.Equal(t, []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com"}, calls())
+
+	// Expired credential is refreshed by helper.
+	cache.Invalidate()
+	_, _, err = cache.Get("123456789012.dkr.ecr.us-east-1.amazonaws.com")
+	assert.Nil(t, err)
+	assert.Len(t, calls(), 2)
+}
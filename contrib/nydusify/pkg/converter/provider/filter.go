@@ -0,0 +1,260 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// PathFilter selects the paths of source layers kept in Nydus image. The
+// patterns starting with `/` match the absolute path in image, the others
+// match the name of any path component, both in the syntax of `path.Match`,
+// e.g. `/usr/share/doc`, `/usr/share/locale/*` or `*.pyc`. A pattern
+// matching a directory matches everything in it.
+type PathFilter struct {
+	// Include keeps the matched paths only (and their parent directories),
+	// all paths are kept if it's empty.
+	Include []string
+	// Exclude drops the matched paths, which overrides Include.
+	Exclude []string
+}
+
+// NewPathFilter validates the patterns.
+func NewPathFilter(include, exclude []string) (*PathFilter, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if pattern == "" || pattern == "/" {
+			return nil, fmt.Errorf("invalid path pattern %q", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q", pattern)
+		}
+	}
+	return &PathFilter{Include: include, Exclude: exclude}, nil
+}
+
+// IsZero reports whether no pattern is specified.
+func (filter *PathFilter) IsZero() bool {
+	return filter == nil || (len(filter.Include) == 0 && len(filter.Exclude) == 0)
+}
+
+// String returns the canonical form of filter, e.g. for the fingerprint of
+// conversion.
+func (filter *PathFilter) String() string {
+	if filter.IsZero() {
+		return ""
+	}
+	include := append([]string{}, filter.Include...)
+	exclude := append([]string{}, filter.Exclude...)
+	sort.Strings(include)
+	sort.Strings(exclude)
+	return "include=" + strings.Join(include, ",") + ";exclude=" + strings.Join(exclude, ",")
+}
+
+// matchPattern reports whether the pattern matches the absolute path or any
+// of its parent directories.
+func matchPattern(pattern, filePath string) bool {
+	parts := strings.Split(strings.TrimPrefix(filePath, "/"), "/")
+	if strings.HasPrefix(pattern, "/") {
+		for idx := range parts {
+			if matched, _ := path.Match(pattern, "/"+strings.Join(parts[:idx+1], "/")); matched {
+				return true
+			}
+		}
+		return false
+	}
+	for _, part := range parts {
+		if matched, _ := path.Match(pattern, part); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, filePath string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, filePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Excluded reports whether the absolute path is dropped by Exclude.
+func (filter *PathFilter) Excluded(filePath string) bool {
+	return matchAny(filter.Exclude, filePath)
+}
+
+// Included reports whether the absolute path is kept by Include, the parent
+// directories of included paths aren't included by themselves.
+func (filter *PathFilter) Included(filePath string) bool {
+	return len(filter.Include) == 0 || matchAny(filter.Include, filePath)
+}
+
+type filterSourceProvider struct {
+	SourceProvider
+	filter *PathFilter
+}
+
+// filterSourceLayer removes the filtered paths from unpacked source layer.
+type filterSourceLayer struct {
+	SourceLayer
+	filter        *PathFilter
+	chainID       digest.Digest
+	parentChainID *digest.Digest
+}
+
+// FilterPaths makes the source provider drop the paths of source layers
+// not selected by filter, so that the Nydus image can be slimmed without
+// rebuilding the source image.
+func FilterPaths(sp SourceProvider, filter *PathFilter) SourceProvider {
+	return &filterSourceProvider{
+		SourceProvider: sp,
+		filter:         filter,
+	}
+}
+
+// The filtered layer shouldn't share the cache record with source layer
+// of same chain id, their blobs are different.
+func filteredChainID(filter *PathFilter, chainID digest.Digest) digest.Digest {
+	return digest.FromString("filter-paths:" + filter.String() + ":" + chainID.String())
+}
+
+func (sp *filterSourceProvider) ManifestAnnotations(ctx context.Context) (map[string]string, error) {
+	return ManifestAnnotations(ctx, sp.SourceProvider)
+}
+
+func (sp *filterSourceProvider) Layers(ctx context.Context) ([]SourceLayer, error) {
+	layers, err := sp.SourceProvider.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filteredLayers := []SourceLayer{}
+	for _, layer := range layers {
+		filteredLayer := &filterSourceLayer{
+			SourceLayer: layer,
+			filter:      sp.filter,
+			chainID:     filteredChainID(sp.filter, layer.ChainID()),
+		}
+		if parentChainID := layer.ParentChainID(); parentChainID != nil {
+			filteredParentChainID := filteredChainID(sp.filter, *parentChainID)
+			filteredLayer.parentChainID = &filteredParentChainID
+		}
+		filteredLayers = append(filteredLayers, filteredLayer)
+	}
+
+	return filteredLayers, nil
+}
+
+func (sl *filterSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	mounts, umount, err := sl.SourceLayer.Mount(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The files of layer mounted by containerd can't be modified.
+	if len(mounts) == 0 || mounts[0].Type != "oci-directory" {
+		umount()
+		return nil, nil, fmt.Errorf("filtering paths only supports unpacked OCI layer")
+	}
+
+	count, err := filterDir(mounts[0].Source, sl.filter)
+	if err != nil {
+		umount()
+		return nil, nil, errors.Wrapf(err, "Filter paths of source layer %s", sl.Digest())
+	}
+	if count > 0 {
+		logrus.Infof("Filtered out %d paths of source layer %s", count, sl.Digest())
+	}
+
+	return mounts, umount, nil
+}
+
+func (sl *filterSourceLayer) ChainID() digest.Digest {
+	return sl.chainID
+}
+
+func (sl *filterSourceLayer) ParentChainID() *digest.Digest {
+	return sl.parentChainID
+}
+
+// filterDir removes the paths filtered out from unpacked layer directory,
+// the whiteout of a path is filtered as the path itself. The directories
+// left empty by Include are removed unless they're included. It returns
+// the number of removed paths.
+func filterDir(root string, filter *PathFilter) (int, error) {
+	count := 0
+	var walk func(dir, imageDir string) (bool, error)
+	// walk filters the directory, it returns whether the directory is kept
+	// for the entries in it.
+	walk = func(dir, imageDir string) (bool, error) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return false, err
+		}
+		kept := false
+		for _, info := range infos {
+			name := info.Name()
+			filePath := filepath.Join(dir, name)
+			imagePath := path.Join(imageDir, name)
+			if name == whiteoutOpaque {
+				// It's kept with the directory.
+				continue
+			}
+			if strings.HasPrefix(name, whiteoutPrefix) {
+				imagePath = path.Join(imageDir, strings.TrimPrefix(name, whiteoutPrefix))
+			}
+
+			if filter.Excluded(imagePath) {
+				if err := os.RemoveAll(filePath); err != nil {
+					return false, err
+				}
+				count++
+				continue
+			}
+			included := filter.Included(imagePath)
+			if info.IsDir() && !included {
+				subKept, err := walk(filePath, imagePath)
+				if err != nil {
+					return false, err
+				}
+				if !subKept {
+					if err := os.RemoveAll(filePath); err != nil {
+						return false, err
+					}
+					count++
+					continue
+				}
+			} else if info.IsDir() && len(filter.Exclude) > 0 {
+				if _, err := walk(filePath, imagePath); err != nil {
+					return false, err
+				}
+			} else if !included {
+				if err := os.Remove(filePath); err != nil {
+					return false, err
+				}
+				count++
+				continue
+			}
+			kept = true
+		}
+		return kept, nil
+	}
+
+	_, err := walk(root, "/")
+	return count, err
+}
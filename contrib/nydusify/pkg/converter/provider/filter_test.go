@@ -0,0 +1,101 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func listTestLayerDir(t *testing.T, dir string) []string {
+	files := []string{}
+	assert.Nil(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		assert.Nil(t, err)
+		if path != dir {
+			files = append(files, strings.TrimPrefix(path, dir+"/"))
+		}
+		return nil
+	}))
+	sort.Strings(files)
+	return files
+}
+
+func TestPathFilter(t *testing.T) {
+	_, err := NewPathFilter([]string{"/"}, nil)
+	assert.NotNil(t, err)
+	_, err = NewPathFilter(nil, []string{"[a"})
+	assert.NotNil(t, err)
+
+	filter, err := NewPathFilter([]string{"/usr/share/locale/en*"}, []string{"/usr/share/doc", "*.pyc"})
+	assert.Nil(t, err)
+	assert.False(t, filter.IsZero())
+	assert.True(t, filter.Excluded("/usr/share/doc"))
+	assert.True(t, filter.Excluded("/usr/share/doc/bash/README"))
+	assert.False(t, filter.Excluded("/usr/share/docs"))
+	assert.True(t, filter.Excluded("/app/lib/__init__.pyc"))
+	assert.True(t, filter.Included("/usr/share/locale/en_US/LC_MESSAGES"))
+	assert.False(t, filter.Included("/usr/share/locale"))
+	assert.Equal(t, "include=/usr/share/locale/en*;exclude=*.pyc,/usr/share/doc", filter.String())
+
+	var empty *PathFilter
+	assert.True(t, empty.IsZero())
+	assert.Equal(t, "", empty.String())
+}
+
+func TestFilterPaths(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-filter-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	layerDir := filepath.Join(workDir, "layer")
+	makeTestLayerDir(t, layerDir, map[string]string{
+		"app/main.py":                      "main",
+		"app/main.pyc":                     "bytecode",
+		"app/tests/.wh.fixture":            "",
+		"app/data/.wh..wh..opq":            "",
+		"etc/hosts":                        "hosts",
+		"usr/share/doc/bash/README":        "readme",
+		"usr/share/locale/de/bash.mo":      "de",
+		"usr/share/locale/en/bash.mo":      "en",
+		"usr/lib/.wh.libgone.so":           "",
+		"usr/share/doc/.wh.removed":        "",
+		"usr/share/locale/fr/.wh..wh..opq": "",
+	})
+
+	filter, err := NewPathFilter([]string{"/app", "/usr/share/locale/en"}, []string{"/usr/share/doc", "*.pyc", "tests"})
+	assert.Nil(t, err)
+	sp := FilterPaths(&testSourceProvider{layers: []SourceLayer{
+		&testSourceLayer{dir: layerDir, chainID: digest.FromString("layer")},
+	}}, filter)
+	layers, err := sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, layers, 1)
+	assert.Equal(t, digest.FromString("layer"), layers[0].Digest())
+	assert.NotEqual(t, digest.FromString("layer"), layers[0].ChainID())
+	assert.Nil(t, layers[0].ParentChainID())
+
+	mounts, umount, err := layers[0].Mount(context.Background())
+	assert.Nil(t, err)
+	defer umount()
+	assert.Equal(t, []string{
+		"app",
+		"app/data",
+		"app/data/.wh..wh..opq",
+		"app/main.py",
+		"usr",
+		"usr/share",
+		"usr/share/locale",
+		"usr/share/locale/en",
+		"usr/share/locale/en/bash.mo",
+	}, listTestLayerDir(t, mounts[0].Source))
+}
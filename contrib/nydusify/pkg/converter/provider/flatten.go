@@ -0,0 +1,276 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+
+	// The number of source layers pulled and unpacked ahead of merging.
+	flattenPullWorkerCount = 5
+)
+
+type flattenSourceProvider struct {
+	SourceProvider
+	workDir string
+}
+
+// flattenSourceLayer merges all layers of source image into one
+// filesystem tree.
+type flattenSourceLayer struct {
+	layers   []SourceLayer
+	mountDir string
+	chainID  digest.Digest
+	size     int64
+}
+
+// FlattenSource makes the source provider return all source layers as a
+// single layer, the layers are unpacked into `$workDir/flatten` in order
+// with the OCI whiteouts and opaque directories applied.
+func FlattenSource(sp SourceProvider, workDir string) SourceProvider {
+	return &flattenSourceProvider{
+		SourceProvider: sp,
+		workDir:        workDir,
+	}
+}
+
+func (sp *flattenSourceProvider) ManifestAnnotations(ctx context.Context) (map[string]string, error) {
+	return ManifestAnnotations(ctx, sp.SourceProvider)
+}
+
+func (sp *flattenSourceProvider) Layers(ctx context.Context) ([]SourceLayer, error) {
+	layers, err := sp.SourceProvider.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		return layers, nil
+	}
+
+	var size int64
+	for _, layer := range layers {
+		size += layer.Size()
+	}
+
+	// The flattened layer shouldn't share the cache record with the
+	// topmost layer of same chain id, their blobs are different.
+	chainID := digest.FromString("flatten:" + layers[len(layers)-1].ChainID().String())
+
+	return []SourceLayer{
+		&flattenSourceLayer{
+			layers:   layers,
+			mountDir: filepath.Join(sp.workDir, "flatten"),
+			chainID:  chainID,
+			size:     size,
+		},
+	}, nil
+}
+
+func (sl *flattenSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	if err := os.RemoveAll(sl.mountDir); err != nil {
+		return nil, nil, errors.Wrap(err, "Remove flatten directory")
+	}
+	if err := os.MkdirAll(sl.mountDir, 0755); err != nil {
+		return nil, nil, errors.Wrap(err, "Create flatten directory")
+	}
+
+	if err := sl.mergeLayers(ctx); err != nil {
+		os.RemoveAll(sl.mountDir)
+		return nil, nil, err
+	}
+
+	umount := func() error {
+		return os.RemoveAll(sl.mountDir)
+	}
+
+	mounts := []mount.Mount{
+		{
+			Type:   "oci-directory",
+			Source: sl.mountDir,
+		},
+	}
+
+	return mounts, umount, nil
+}
+
+type mountedLayer struct {
+	mounts []mount.Mount
+	umount func() error
+	err    error
+}
+
+// mergeLayers mounts source layers concurrently, and merges them into
+// flatten directory from the bottom layer.
+func (sl *flattenSourceLayer) mergeLayers(ctx context.Context) error {
+	sem := make(chan struct{}, flattenPullWorkerCount)
+	results := make([]chan mountedLayer, len(sl.layers))
+	for idx := range sl.layers {
+		results[idx] = make(chan mountedLayer, 1)
+	}
+	// Acquire the workers in order of layers, so that the layer to be
+	// merged next is always mounted.
+	go func() {
+		for idx := range sl.layers {
+			sem <- struct{}{}
+			go func(idx int) {
+				mounts, umount, err := sl.layers[idx].Mount(ctx)
+				results[idx] <- mountedLayer{mounts: mounts, umount: umount, err: err}
+			}(idx)
+		}
+	}()
+
+	// Umount the layers not merged, and let the pending mounts go on.
+	cleanup := func(from int) {
+		for idx := from; idx < len(results); idx++ {
+			if result := <-results[idx]; result.err == nil {
+				result.umount()
+			}
+			<-sem
+		}
+	}
+
+	for idx, layer := range sl.layers {
+		result := <-results[idx]
+		err := result.err
+		if err == nil {
+			// The files in unpacked OCI layer are moved to the flatten
+			// directory, the layer mounted by containerd can't be modified.
+			if len(result.mounts) == 0 || result.mounts[0].Type != "oci-directory" {
+				err = fmt.Errorf("flatten only supports unpacked OCI layer")
+			} else {
+				err = mergeDir(sl.mountDir, result.mounts[0].Source)
+			}
+			result.umount()
+		}
+		<-sem
+		if err != nil {
+			go cleanup(idx + 1)
+			return errors.Wrapf(err, "Flatten source layer %s", layer.Digest())
+		}
+	}
+
+	return nil
+}
+
+// copyMetadata applies the owner, mode, xattrs and times of `src` to `dst`,
+// e.g. from upper directory to the merged directory. The owner is changed
+// first since chown clears the setuid and setgid bits of file.
+func copyMetadata(dst, src string, info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	names, err := xattr.LList(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := xattr.LGet(src, name)
+		if err != nil {
+			return err
+		}
+		if err := xattr.LSet(dst, name, value); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// mergeDir merges the upper directory `src` into the lower directory
+// `dst`, the entries in `src` are moved rather than copied.
+func mergeDir(dst, src string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	// Opaque directory hides all entries of lower layers.
+	for _, entry := range entries {
+		if entry.Name() != whiteoutOpaque {
+			continue
+		}
+		lowerEntries, err := ioutil.ReadDir(dst)
+		if err != nil {
+			return err
+		}
+		for _, lower := range lowerEntries {
+			if err := os.RemoveAll(filepath.Join(dst, lower.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		srcPath := filepath.Join(src, name)
+		dstPath := filepath.Join(dst, name)
+
+		if name == whiteoutOpaque {
+			continue
+		}
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			if err := os.RemoveAll(filepath.Join(dst, strings.TrimPrefix(name, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if entry.IsDir() {
+			if lower, err := os.Lstat(dstPath); err == nil && lower.IsDir() {
+				if err := mergeDir(dstPath, srcPath); err != nil {
+					return err
+				}
+				if err := copyMetadata(dstPath, srcPath, entry); err != nil {
+					return errors.Wrapf(err, "Copy metadata of %s", srcPath)
+				}
+				continue
+			}
+		}
+
+		if err := os.RemoveAll(dstPath); err != nil {
+			return err
+		}
+		if err := os.Rename(srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sl *flattenSourceLayer) Digest() digest.Digest {
+	return sl.chainID
+}
+
+func (sl *flattenSourceLayer) Size() int64 {
+	return sl.size
+}
+
+func (sl *flattenSourceLayer) ChainID() digest.Digest {
+	return sl.chainID
+}
+
+func (sl *flattenSourceLayer) ParentChainID() *digest.Digest {
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSourceLayer struct {
+	dir     string
+	chainID digest.Digest
+}
+
+func (sl *testSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	return []mount.Mount{{Type: "oci-directory", Source: sl.dir}}, func() error {
+		return os.RemoveAll(sl.dir)
+	}, nil
+}
+
+func (sl *testSourceLayer) Size() int64 {
+	return 1
+}
+
+func (sl *testSourceLayer) Digest() digest.Digest {
+	return sl.chainID
+}
+
+func (sl *testSourceLayer) ChainID() digest.Digest {
+	return sl.chainID
+}
+
+func (sl *testSourceLayer) ParentChainID() *digest.Digest {
+	return nil
+}
+
+type testSourceProvider struct {
+	layers []SourceLayer
+}
+
+func (sp *testSourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
+	return &ocispec.Descriptor{}, nil
+}
+
+func (sp *testSourceProvider) Config(ctx context.Context) (*ocispec.Image, error) {
+	return &ocispec.Image{}, nil
+}
+
+func (sp *testSourceProvider) Layers(ctx context.Context) ([]SourceLayer, error) {
+	return sp.layers, nil
+}
+
+func makeTestLayerDir(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		if content == "/" {
+			assert.Nil(t, os.MkdirAll(path, 0700))
+			continue
+		}
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestFlattenSource(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-flatten-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	lower := filepath.Join(workDir, "lower")
+	makeTestLayerDir(t, lower, map[string]string{
+		"etc/hosts":       "lower",
+		"etc/removed":     "lower",
+		"opaque/hidden":   "lower",
+		"replaced/file":   "lower",
+		"usr/bin/keep.sh": "lower",
+	})
+	upper := filepath.Join(workDir, "upper")
+	makeTestLayerDir(t, upper, map[string]string{
+		"etc/hosts":           "upper",
+		"etc/.wh.removed":     "",
+		"opaque/.wh..wh..opq": "",
+		"opaque/new":          "upper",
+		"replaced":            "upper",
+		"usr/bin":             "/",
+	})
+
+	sp := FlattenSource(&testSourceProvider{layers: []SourceLayer{
+		&testSourceLayer{dir: lower, chainID: digest.FromString("lower")},
+		&testSourceLayer{dir: upper, chainID: digest.FromString("upper")},
+	}}, workDir)
+	layers, err := sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, layers, 1)
+	assert.Equal(t, int64(2), layers[0].Size())
+	assert.NotEqual(t, digest.FromString("upper"), layers[0].ChainID())
+	assert.Nil(t, layers[0].ParentChainID())
+
+	mounts, umount, err := layers[0].Mount(context.Background())
+	assert.Nil(t, err)
+	merged := mounts[0].Source
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(merged, name))
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	assert.Equal(t, "upper", read("etc/hosts"))
+	assert.Equal(t, "upper", read("opaque/new"))
+	assert.Equal(t, "upper", read("replaced"))
+	assert.Equal(t, "lower", read("usr/bin/keep.sh"))
+	for _, name := range []string{"etc/removed", "etc/.wh.removed", "opaque/hidden", "opaque/.wh..wh..opq"} {
+		_, err := os.Lstat(filepath.Join(merged, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	// The metadata of upper directory is kept.
+	info, err := os.Stat(filepath.Join(merged, "usr/bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	assert.Nil(t, umount())
+	_, err = os.Stat(merged)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,197 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Strategy is how the whiteouts or hardlinks of source layers are
+// materialized in Nydus image.
+type Strategy string
+
+const (
+	// StrategyPreserve passes them to builder as they are in source
+	// layers, it's the default.
+	StrategyPreserve Strategy = "preserve"
+	// StrategyResolve applies them during conversion, so that Nydus
+	// metadata doesn't contain them.
+	StrategyResolve Strategy = "resolve"
+)
+
+// ParseStrategy validates the whiteout or hardlink strategy, empty means
+// StrategyPreserve.
+func ParseStrategy(strategy string) (Strategy, error) {
+	switch Strategy(strategy) {
+	case "", StrategyPreserve:
+		return StrategyPreserve, nil
+	case StrategyResolve:
+		return StrategyResolve, nil
+	}
+	return "", fmt.Errorf("unsupported strategy %s, should be preserve or resolve", strategy)
+}
+
+type hardlinkSourceProvider struct {
+	SourceProvider
+}
+
+// hardlinkSourceLayer breaks the hardlinks of unpacked source layer.
+type hardlinkSourceLayer struct {
+	SourceLayer
+	chainID       digest.Digest
+	parentChainID *digest.Digest
+}
+
+// ResolveHardlinks makes the source provider break the hardlinks in source
+// layers into independent regular files, so that no hardlink in Nydus image
+// spans layers, at the cost of duplicated file data.
+func ResolveHardlinks(sp SourceProvider) SourceProvider {
+	return &hardlinkSourceProvider{
+		SourceProvider: sp,
+	}
+}
+
+// The resolved layer shouldn't share the cache record with source layer
+// of same chain id, their blobs are different.
+func resolvedChainID(chainID digest.Digest) digest.Digest {
+	return digest.FromString("resolve-hardlinks:" + chainID.String())
+}
+
+func (sp *hardlinkSourceProvider) ManifestAnnotations(ctx context.Context) (map[string]string, error) {
+	return ManifestAnnotations(ctx, sp.SourceProvider)
+}
+
+func (sp *hardlinkSourceProvider) Layers(ctx context.Context) ([]SourceLayer, error) {
+	layers, err := sp.SourceProvider.Layers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resolvedLayers := []SourceLayer{}
+	for _, layer := range layers {
+		resolvedLayer := &hardlinkSourceLayer{
+			SourceLayer: layer,
+			chainID:     resolvedChainID(layer.ChainID()),
+		}
+		if parentChainID := layer.ParentChainID(); parentChainID != nil {
+			resolvedParentChainID := resolvedChainID(*parentChainID)
+			resolvedLayer.parentChainID = &resolvedParentChainID
+		}
+		resolvedLayers = append(resolvedLayers, resolvedLayer)
+	}
+
+	return resolvedLayers, nil
+}
+
+func (sl *hardlinkSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	mounts, umount, err := sl.SourceLayer.Mount(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The files of layer mounted by containerd can't be modified.
+	if len(mounts) == 0 || mounts[0].Type != "oci-directory" {
+		umount()
+		return nil, nil, fmt.Errorf("resolving hardlinks only supports unpacked OCI layer")
+	}
+
+	count, err := breakHardlinks(mounts[0].Source)
+	if err != nil {
+		umount()
+		return nil, nil, errors.Wrapf(err, "Resolve hardlinks of source layer %s", sl.Digest())
+	}
+	if count > 0 {
+		logrus.Infof("Resolved %d hardlinks of source layer %s", count, sl.Digest())
+	}
+
+	return mounts, umount, nil
+}
+
+func (sl *hardlinkSourceLayer) ChainID() digest.Digest {
+	return sl.chainID
+}
+
+func (sl *hardlinkSourceLayer) ParentChainID() *digest.Digest {
+	return sl.parentChainID
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// breakHardlinks replaces the hardlinks in directory with copies, the first
+// path of an inode keeps the inode. It returns the number of copied files.
+func breakHardlinks(root string) (int, error) {
+	seen := map[inodeKey]bool{}
+	count := 0
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Nlink <= 1 {
+			return nil
+		}
+
+		key := inodeKey{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+		if !seen[key] {
+			seen[key] = true
+			return nil
+		}
+
+		if err := copyFile(path, info); err != nil {
+			return errors.Wrapf(err, "Copy hardlink %s", path)
+		}
+		count++
+
+		return nil
+	})
+
+	return count, err
+}
+
+// copyFile replaces the file by a copy with the same content and metadata.
+func copyFile(path string, info os.FileInfo) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(path), ".nydusify-hardlink-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := copyMetadata(dst.Name(), path, info); err != nil {
+		return err
+	}
+
+	return os.Rename(dst.Name(), path)
+}
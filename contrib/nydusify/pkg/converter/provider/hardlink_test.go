@@ -0,0 +1,78 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStrategy(t *testing.T) {
+	strategy, err := ParseStrategy("")
+	assert.Nil(t, err)
+	assert.Equal(t, StrategyPreserve, strategy)
+	strategy, err = ParseStrategy("resolve")
+	assert.Nil(t, err)
+	assert.Equal(t, StrategyResolve, strategy)
+	_, err = ParseStrategy("squash")
+	assert.NotNil(t, err)
+}
+
+func TestResolveHardlinks(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-hardlink-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	layerDir := filepath.Join(workDir, "layer")
+	makeTestLayerDir(t, layerDir, map[string]string{
+		"bin/busybox": "busybox",
+		"etc/hosts":   "hosts",
+	})
+	assert.Nil(t, os.Chmod(filepath.Join(layerDir, "bin/busybox"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(layerDir, "usr/bin"), 0755))
+	for _, name := range []string{"bin/sh", "usr/bin/env"} {
+		assert.Nil(t, os.Link(filepath.Join(layerDir, "bin/busybox"), filepath.Join(layerDir, name)))
+	}
+
+	sp := ResolveHardlinks(&testSourceProvider{layers: []SourceLayer{
+		&testSourceLayer{dir: layerDir, chainID: digest.FromString("layer")},
+	}})
+	layers, err := sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, layers, 1)
+	assert.Equal(t, digest.FromString("layer"), layers[0].Digest())
+	assert.NotEqual(t, digest.FromString("layer"), layers[0].ChainID())
+	assert.Nil(t, layers[0].ParentChainID())
+
+	mounts, umount, err := layers[0].Mount(context.Background())
+	assert.Nil(t, err)
+	defer umount()
+
+	for _, name := range []string{"bin/busybox", "bin/sh", "usr/bin/env"} {
+		path := filepath.Join(mounts[0].Source, name)
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, "busybox", string(data))
+		info, err := os.Lstat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode())
+		assert.Equal(t, uint64(1), uint64(info.Sys().(*syscall.Stat_t).Nlink), name)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(mounts[0].Source, "bin"))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	// Nothing to resolve in the second run.
+	count, err := breakHardlinks(mounts[0].Source)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
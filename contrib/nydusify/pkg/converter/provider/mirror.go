@@ -0,0 +1,153 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/events"
+)
+
+const (
+	// A mirror be marked as unhealthy after continuous failures.
+	defaultMirrorFailureLimit = 3
+	// Unhealthy mirror will be probed by a real request after the interval.
+	defaultMirrorProbeInterval = 30 * time.Second
+)
+
+// Matches blob fetch path of OCI distribution API: /v2/<name>/blobs/<digest>
+var blobPathRegexp = regexp.MustCompile(`^/v2/.+/blobs/[a-z0-9]+:[a-zA-Z0-9=_-]+$`)
+
+type mirror struct {
+	url      *url.URL
+	failures int
+	// Zero value means the mirror is healthy.
+	unhealthySince time.Time
+}
+
+// MirrorTransport fetches blobs from an ordered list of mirrors, it marks
+// a mirror as unhealthy when it returns 5xx or network error repeatedly,
+// fails over to the next mirror, and finally the original registry.
+type MirrorTransport struct {
+	base          http.RoundTripper
+	mirrors       []*mirror
+	failureLimit  int
+	probeInterval time.Duration
+	mu            sync.Mutex
+}
+
+// NewMirrorTransport creates a mirror transport, mirror is an URL like
+// `https://mirror.example.com[/prefix]`.
+func NewMirrorTransport(base http.RoundTripper, mirrorURLs []string) (*MirrorTransport, error) {
+	mirrors := []*mirror{}
+	for _, mirrorURL := range mirrorURLs {
+		u, err := url.Parse(mirrorURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse mirror %s", mirrorURL)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid mirror %s, scheme should be http or https", mirrorURL)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		mirrors = append(mirrors, &mirror{url: u})
+	}
+
+	return &MirrorTransport{
+		base:          base,
+		mirrors:       mirrors,
+		failureLimit:  defaultMirrorFailureLimit,
+		probeInterval: defaultMirrorProbeInterval,
+	}, nil
+}
+
+// available returns true if the mirror is healthy, or it's time to
+// probe the unhealthy mirror again.
+func (t *MirrorTransport) available(m *mirror) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if m.unhealthySince.IsZero() {
+		return true
+	}
+	if time.Since(m.unhealthySince) >= t.probeInterval {
+		// Allow only one probe request in an interval.
+		m.unhealthySince = time.Now()
+		return true
+	}
+	return false
+}
+
+func (t *MirrorTransport) report(m *mirror, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		if !m.unhealthySince.IsZero() {
+			registryLogger.Infof("Mirror %s recovered", m.url.Host)
+		}
+		m.failures = 0
+		m.unhealthySince = time.Time{}
+		return
+	}
+
+	m.failures++
+	if m.failures >= t.failureLimit && m.unhealthySince.IsZero() {
+		registryLogger.Warnf("Mirror %s is marked as unhealthy: %s", m.url.Host, err)
+		m.unhealthySince = time.Now()
+		events.Emit(events.Event{
+			Type:  events.TypeBackendFailover,
+			Error: err.Error(),
+			Data:  map[string]string{"kind": "mirror", "host": m.url.Host},
+		})
+	}
+}
+
+func (t *MirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || !blobPathRegexp.MatchString(req.URL.Path) {
+		return t.base.RoundTrip(req)
+	}
+
+	for _, m := range t.mirrors {
+		if !t.available(m) {
+			continue
+		}
+
+		mirrored := req.Clone(req.Context())
+		mirrored.URL.Scheme = m.url.Scheme
+		mirrored.URL.Host = m.url.Host
+		mirrored.URL.Path = m.url.Path + req.URL.Path
+		mirrored.Host = m.url.Host
+
+		resp, err := t.base.RoundTrip(mirrored)
+		if err == nil && resp.StatusCode < 500 {
+			t.report(m, nil)
+			if resp.StatusCode < 300 {
+				return resp, nil
+			}
+			// The blob may not be synced to mirror yet, try next one.
+			resp.Body.Close()
+			continue
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		registryLogger.Debugf("Fetch %s from mirror %s: %s", req.URL.Path, m.url.Host, err)
+		t.report(m, err)
+	}
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testBlobPath = "/v2/library/busybox/blobs/sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"
+
+func TestMirrorTransport(t *testing.T) {
+	var brokenHits, healthyHits, originHits int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&brokenHits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthyHits, 1)
+		assert.Equal(t, "/prefix"+testBlobPath, r.URL.Path)
+		w.Write([]byte("mirror"))
+	}))
+	defer healthy.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&originHits, 1)
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	transport, err := NewMirrorTransport(http.DefaultTransport, []string{broken.URL, healthy.URL + "/prefix/"})
+	assert.Nil(t, err)
+	client := &http.Client{Transport: transport}
+
+	get := func(path string) string {
+		resp, err := client.Get(origin.URL + path)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return string(body)
+	}
+
+	// Fail over to the second mirror, the broken one is skipped
+	// after it reaches the failure limit.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "mirror", get(testBlobPath))
+	}
+	assert.Equal(t, int32(defaultMirrorFailureLimit), atomic.LoadInt32(&brokenHits))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&healthyHits))
+
+	// Non-blob requests always go to origin registry.
+	assert.Equal(t, "origin", get("/v2/library/busybox/manifests/latest"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&originHits))
+
+	// The unhealthy mirror is probed again after the interval.
+	transport.probeInterval = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(t, "mirror", get(testBlobPath))
+	assert.Equal(t, int32(defaultMirrorFailureLimit+1), atomic.LoadInt32(&brokenHits))
+
+	// Fall back to origin registry if all mirrors are unavailable.
+	healthy.Close()
+	transport.probeInterval = time.Hour
+	for i := 0; i < defaultMirrorFailureLimit; i++ {
+		assert.Equal(t, "origin", get(testBlobPath))
+	}
+	assert.Equal(t, int32(1+defaultMirrorFailureLimit), atomic.LoadInt32(&originHits))
+	assert.Equal(t, int32(defaultMirrorFailureLimit+1), atomic.LoadInt32(&brokenHits))
+}
@@ -0,0 +1,305 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Annotations and cipher of OCI encrypted layers defined by ocicrypt,
+// see https://github.com/containers/ocicrypt/blob/main/docs/spec.md
+const (
+	annotationEncKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	annotationEncPubOpts = "org.opencontainers.image.enc.pubopts"
+
+	mediaTypeEncryptedSuffix = "+encrypted"
+	cipherAES256CTR          = "AES_256_CTR_HMAC_SHA256"
+)
+
+// DecryptionKeys holds the private keys to decrypt OCI encrypted source
+// layers, which are encrypted by containerd imgcrypt or skopeo with JWE
+// recipients.
+type DecryptionKeys struct {
+	keys []*rsa.PrivateKey
+}
+
+// LoadDecryptionKeys loads PEM encoded RSA private keys (PKCS1 or PKCS8).
+func LoadDecryptionKeys(paths []string) (*DecryptionKeys, error) {
+	keys := []*rsa.PrivateKey{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "read decryption key")
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid PEM private key in %s", path)
+		}
+		var key interface{}
+		if block.Type == "RSA PRIVATE KEY" {
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		} else {
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse decryption key %s", path)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported decryption key type %T in %s, only RSA key is supported", key, path)
+		}
+		keys = append(keys, rsaKey)
+	}
+	return &DecryptionKeys{keys: keys}, nil
+}
+
+// IsEncryptedLayer returns true if the layer is an ocicrypt encrypted layer.
+func IsEncryptedLayer(desc ocispec.Descriptor) bool {
+	return strings.HasSuffix(desc.MediaType, mediaTypeEncryptedSuffix)
+}
+
+// jweJSON is the JWE JSON serialization (RFC 7516) of layer private options.
+type jweJSON struct {
+	Protected   string            `json:"protected"`
+	Unprotected map[string]string `json:"unprotected"`
+	Header      map[string]string `json:"header"`
+	Recipients  []struct {
+		Header       map[string]string `json:"header"`
+		EncryptedKey string            `json:"encrypted_key"`
+	} `json:"recipients"`
+	EncryptedKey string `json:"encrypted_key"`
+	AAD          string `json:"aad"`
+	IV           string `json:"iv"`
+	Ciphertext   string `json:"ciphertext"`
+	Tag          string `json:"tag"`
+}
+
+type layerPrivateOpts struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        digest.Digest     `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+type layerPublicOpts struct {
+	Cipher string `json:"cipher"`
+	HMAC   []byte `json:"hmac"`
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// unwrapKey decrypts the content encryption key of a JWE recipient.
+func unwrapKey(key *rsa.PrivateKey, alg string, encryptedKey []byte) ([]byte, error) {
+	var h hash.Hash
+	switch alg {
+	case "RSA-OAEP":
+		h = sha1.New()
+	case "RSA-OAEP-256":
+		h = sha256.New()
+	case "RSA1_5":
+		return rsa.DecryptPKCS1v15(rand.Reader, key, encryptedKey)
+	default:
+		return nil, fmt.Errorf("unsupported JWE key algorithm %s", alg)
+	}
+	return rsa.DecryptOAEP(h, rand.Reader, key, encryptedKey, nil)
+}
+
+func (dk *DecryptionKeys) decryptJWE(raw []byte) ([]byte, error) {
+	var jwe jweJSON
+	if err := json.Unmarshal(raw, &jwe); err != nil {
+		return nil, errors.Wrap(err, "parse JWE")
+	}
+
+	protectedBytes, err := decodeSegment(jwe.Protected)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode JWE protected header")
+	}
+	protected := map[string]string{}
+	if len(protectedBytes) > 0 {
+		if err := json.Unmarshal(protectedBytes, &protected); err != nil {
+			return nil, errors.Wrap(err, "parse JWE protected header")
+		}
+	}
+
+	// Flattened serialization has a single recipient in top level.
+	recipients := jwe.Recipients
+	if jwe.EncryptedKey != "" {
+		recipients = append(recipients, struct {
+			Header       map[string]string `json:"header"`
+			EncryptedKey string            `json:"encrypted_key"`
+		}{Header: jwe.Header, EncryptedKey: jwe.EncryptedKey})
+	}
+
+	header := func(recipient map[string]string, name string) string {
+		for _, h := range []map[string]string{recipient, jwe.Unprotected, protected} {
+			if value, ok := h[name]; ok {
+				return value
+			}
+		}
+		return ""
+	}
+
+	iv, err := decodeSegment(jwe.IV)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode JWE iv")
+	}
+	ciphertext, err := decodeSegment(jwe.Ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode JWE ciphertext")
+	}
+	tag, err := decodeSegment(jwe.Tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode JWE tag")
+	}
+	aad := jwe.Protected
+	if jwe.AAD != "" {
+		aad += "." + jwe.AAD
+	}
+
+	for _, recipient := range recipients {
+		if enc := header(recipient.Header, "enc"); enc != "A256GCM" {
+			return nil, fmt.Errorf("unsupported JWE content encryption %s", enc)
+		}
+		encryptedKey, err := decodeSegment(recipient.EncryptedKey)
+		if err != nil {
+			continue
+		}
+		for _, key := range dk.keys {
+			cek, err := unwrapKey(key, header(recipient.Header, "alg"), encryptedKey)
+			if err != nil || len(cek) != 32 {
+				continue
+			}
+			block, err := aes.NewCipher(cek)
+			if err != nil {
+				return nil, err
+			}
+			gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+			if err != nil {
+				return nil, err
+			}
+			plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(aad))
+			if err != nil {
+				continue
+			}
+			return plaintext, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no matched decryption key for JWE recipients")
+}
+
+// hmacVerifiedReader verifies the HMAC of ciphertext and the digest of
+// plaintext at EOF.
+type hmacVerifiedReader struct {
+	reader         io.Reader
+	closer         io.Closer
+	mac            hash.Hash
+	expectedMAC    []byte
+	digester       digest.Digester
+	expectedDigest digest.Digest
+}
+
+func (r *hmacVerifiedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		if !hmac.Equal(r.mac.Sum(nil), r.expectedMAC) {
+			return n, fmt.Errorf("HMAC of encrypted layer mismatched")
+		}
+		if r.expectedDigest != "" && r.digester.Digest() != r.expectedDigest {
+			return n, fmt.Errorf("digest of decrypted layer mismatched, expected %s", r.expectedDigest)
+		}
+	}
+	return n, err
+}
+
+func (r *hmacVerifiedReader) Close() error {
+	return r.closer.Close()
+}
+
+// DecryptLayer returns the decrypted stream of an ocicrypt encrypted layer,
+// the stream returns error at EOF if the layer has been tampered.
+func (dk *DecryptionKeys) DecryptLayer(desc ocispec.Descriptor, reader io.ReadCloser) (io.ReadCloser, error) {
+	if dk == nil || len(dk.keys) == 0 {
+		return nil, fmt.Errorf("no decryption key is specified for encrypted layer %s", desc.Digest)
+	}
+
+	pubOptsBytes, err := base64.StdEncoding.DecodeString(desc.Annotations[annotationEncPubOpts])
+	if err != nil {
+		return nil, errors.Wrap(err, "decode encryption public options")
+	}
+	pubOpts := layerPublicOpts{Cipher: cipherAES256CTR}
+	if len(pubOptsBytes) > 0 {
+		if err := json.Unmarshal(pubOptsBytes, &pubOpts); err != nil {
+			return nil, errors.Wrap(err, "parse encryption public options")
+		}
+	}
+	if pubOpts.Cipher != cipherAES256CTR {
+		return nil, fmt.Errorf("unsupported layer cipher %s", pubOpts.Cipher)
+	}
+
+	var privOptsBytes []byte
+	for _, encoded := range strings.Split(desc.Annotations[annotationEncKeysJWE], ",") {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		if privOptsBytes, err = dk.decryptJWE(raw); err == nil {
+			break
+		}
+	}
+	if privOptsBytes == nil {
+		return nil, fmt.Errorf("failed to decrypt key of layer %s, no matched decryption key", desc.Digest)
+	}
+
+	var privOpts layerPrivateOpts
+	if err := json.Unmarshal(privOptsBytes, &privOpts); err != nil {
+		return nil, errors.Wrap(err, "parse encryption private options")
+	}
+	nonce := privOpts.CipherOptions["nonce"]
+	if len(privOpts.SymmetricKey) != 32 || len(nonce) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid symmetric key or nonce of layer %s", desc.Digest)
+	}
+
+	block, err := aes.NewCipher(privOpts.SymmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(crypto.SHA256.New, privOpts.SymmetricKey)
+	digester := digest.Canonical.Digester()
+	stream := cipher.StreamReader{
+		S: cipher.NewCTR(block, nonce),
+		R: io.TeeReader(reader, mac),
+	}
+
+	return &hmacVerifiedReader{
+		reader:         io.TeeReader(stream, digester.Hash()),
+		closer:         reader,
+		mac:            mac,
+		expectedMAC:    pubOpts.HMAC,
+		digester:       digester,
+		expectedDigest: privOpts.Digest,
+	}, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// encryptLayer encrypts layer data like ocicrypt with a JWE recipient.
+func encryptLayer(t *testing.T, data []byte, key *rsa.PublicKey) ([]byte, ocispec.Descriptor) {
+	symKey := make([]byte, 32)
+	nonce := make([]byte, aes.BlockSize)
+	rand.Read(symKey)
+	rand.Read(nonce)
+
+	block, err := aes.NewCipher(symKey)
+	assert.Nil(t, err)
+	encrypted := make([]byte, len(data))
+	cipher.NewCTR(block, nonce).XORKeyStream(encrypted, data)
+	mac := hmac.New(sha256.New, symKey)
+	mac.Write(encrypted)
+
+	privOpts, err := json.Marshal(layerPrivateOpts{
+		SymmetricKey:  symKey,
+		Digest:        digest.FromBytes(data),
+		CipherOptions: map[string][]byte{"nonce": nonce},
+	})
+	assert.Nil(t, err)
+	pubOpts, err := json.Marshal(layerPublicOpts{Cipher: cipherAES256CTR, HMAC: mac.Sum(nil)})
+	assert.Nil(t, err)
+
+	// JWE general JSON serialization with RSA-OAEP and A256GCM.
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	rand.Read(cek)
+	rand.Read(iv)
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, cek, nil)
+	assert.Nil(t, err)
+	protected := base64.RawURLEncoding.EncodeToString([]byte(`{"enc":"A256GCM"}`))
+	block, err = aes.NewCipher(cek)
+	assert.Nil(t, err)
+	gcm, err := cipher.NewGCM(block)
+	assert.Nil(t, err)
+	sealed := gcm.Seal(nil, iv, privOpts, []byte(protected))
+	jwe, err := json.Marshal(map[string]interface{}{
+		"protected": protected,
+		"recipients": []map[string]interface{}{{
+			"header":        map[string]string{"alg": "RSA-OAEP"},
+			"encrypted_key": base64.RawURLEncoding.EncodeToString(encryptedKey),
+		}},
+		"iv":         base64.RawURLEncoding.EncodeToString(iv),
+		"ciphertext": base64.RawURLEncoding.EncodeToString(sealed[:len(sealed)-16]),
+		"tag":        base64.RawURLEncoding.EncodeToString(sealed[len(sealed)-16:]),
+	})
+	assert.Nil(t, err)
+
+	return encrypted, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip + mediaTypeEncryptedSuffix,
+		Digest:    digest.FromBytes(encrypted),
+		Size:      int64(len(encrypted)),
+		Annotations: map[string]string{
+			annotationEncKeysJWE: base64.StdEncoding.EncodeToString(jwe),
+			annotationEncPubOpts: base64.StdEncoding.EncodeToString(pubOpts),
+		},
+	}
+}
+
+func TestDecryptLayer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	data := bytes.Repeat([]byte("layer data "), 1000)
+	encrypted, desc := encryptLayer(t, data, &key.PublicKey)
+	assert.True(t, IsEncryptedLayer(desc))
+
+	keys := &DecryptionKeys{keys: []*rsa.PrivateKey{otherKey, key}}
+	reader, err := keys.DecryptLayer(desc, ioutil.NopCloser(bytes.NewReader(encrypted)))
+	assert.Nil(t, err)
+	decrypted, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, data, decrypted)
+
+	// Tampered layer is detected at EOF.
+	encrypted[10] ^= 0xff
+	reader, err = keys.DecryptLayer(desc, ioutil.NopCloser(bytes.NewReader(encrypted)))
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.NotNil(t, err)
+
+	_, err = (&DecryptionKeys{keys: []*rsa.PrivateKey{otherKey}}).DecryptLayer(desc, ioutil.NopCloser(bytes.NewReader(encrypted)))
+	assert.NotNil(t, err)
+}
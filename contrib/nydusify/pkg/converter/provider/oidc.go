@@ -0,0 +1,225 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	oidcGrantClientCredentials = "client_credentials"
+	oidcGrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	oidcTokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	// Refresh access token in advance to avoid expiry on the fly.
+	oidcExpiryDelta = 30 * time.Second
+)
+
+// OIDCConfig configures bearer token authentication for registries
+// fronted by an OIDC provider.
+type OIDCConfig struct {
+	TokenEndpoint    string   `json:"token_endpoint"`
+	ClientID         string   `json:"client_id"`
+	ClientSecret     string   `json:"client_secret"`
+	ClientSecretFile string   `json:"client_secret_file"`
+	Scopes           []string `json:"scopes"`
+	Audience         string   `json:"audience"`
+	// Exchange the JWT in file (for example a Kubernetes service account
+	// token) for an access token as per RFC 8693, rather than using the
+	// client credentials grant.
+	SubjectTokenFile string `json:"subject_token_file"`
+}
+
+// ParseOIDCConfig parses OIDC config from a JSON file.
+func ParseOIDCConfig(path string) (*OIDCConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read OIDC config file")
+	}
+	var config OIDCConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrap(err, "parse OIDC config file")
+	}
+	if config.TokenEndpoint == "" {
+		return nil, fmt.Errorf("token_endpoint is required in OIDC config")
+	}
+	if config.ClientID == "" && config.SubjectTokenFile == "" {
+		return nil, fmt.Errorf("client_id or subject_token_file is required in OIDC config")
+	}
+	return &config, nil
+}
+
+type oidcTokenSource struct {
+	config    *OIDCConfig
+	client    *http.Client
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func (source *oidcTokenSource) fetch() (string, time.Time, error) {
+	form := url.Values{}
+	if source.config.ClientID != "" {
+		form.Set("client_id", source.config.ClientID)
+	}
+	secret := source.config.ClientSecret
+	if source.config.ClientSecretFile != "" {
+		data, err := ioutil.ReadFile(source.config.ClientSecretFile)
+		if err != nil {
+			return "", time.Time{}, errors.Wrap(err, "read OIDC client secret file")
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if secret != "" {
+		form.Set("client_secret", secret)
+	}
+	if len(source.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(source.config.Scopes, " "))
+	}
+	if source.config.Audience != "" {
+		form.Set("audience", source.config.Audience)
+	}
+
+	if source.config.SubjectTokenFile != "" {
+		// Read the subject token every time, it is rotated by kubelet.
+		subjectToken, err := ioutil.ReadFile(source.config.SubjectTokenFile)
+		if err != nil {
+			return "", time.Time{}, errors.Wrap(err, "read OIDC subject token file")
+		}
+		form.Set("grant_type", oidcGrantTokenExchange)
+		form.Set("subject_token", strings.TrimSpace(string(subjectToken)))
+		form.Set("subject_token_type", oidcTokenTypeJWT)
+	} else {
+		form.Set("grant_type", oidcGrantClientCredentials)
+	}
+
+	resp, err := source.client.PostForm(source.config.TokenEndpoint, form)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "request OIDC token endpoint")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "read OIDC token response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("OIDC token endpoint returns status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "parse OIDC token response")
+	}
+	if tokenResp.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("no access_token in OIDC token response")
+	}
+
+	// Zero value means the token never expires.
+	var expiresAt time.Time
+	if tokenResp.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - oidcExpiryDelta)
+	}
+
+	return tokenResp.AccessToken, expiresAt, nil
+}
+
+// Token returns cached access token, or fetches a new one if it's expired
+// or the cached one is rejected by registry.
+func (source *oidcTokenSource) Token(rejected string) (string, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	valid := source.token != "" && (source.expiresAt.IsZero() || time.Now().Before(source.expiresAt))
+	if valid && (rejected == "" || rejected != source.token) {
+		return source.token, nil
+	}
+
+	token, expiresAt, err := source.fetch()
+	if err != nil {
+		return "", err
+	}
+	registryLogger.Debugf("Got OIDC access token from %s", source.config.TokenEndpoint)
+	source.token = token
+	source.expiresAt = expiresAt
+
+	return token, nil
+}
+
+// oidcTransport authorizes requests to registry host with the bearer
+// token from OIDC provider, and refreshes the token on 401 response.
+type oidcTransport struct {
+	base   http.RoundTripper
+	host   string
+	source *oidcTokenSource
+}
+
+func newOIDCTransport(base http.RoundTripper, host string, config *OIDCConfig) *oidcTransport {
+	return &oidcTransport{
+		base: base,
+		host: host,
+		source: &oidcTokenSource{
+			config: config,
+			client: newDefaultClient(),
+		},
+	}
+}
+
+func (t *oidcTransport) roundTrip(req *http.Request, token string) (*http.Response, error) {
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(authorized)
+}
+
+func (t *oidcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Never leak the token to other hosts like mirrors or blob storage
+	// redirected by registry.
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	token, err := t.source.Token("")
+	if err != nil {
+		return nil, errors.Wrap(err, "get OIDC token")
+	}
+	resp, err := t.roundTrip(req, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Retry with refreshed token if the request body can be replayed,
+	// otherwise the next retry of caller gets the refreshed one.
+	token, err = t.source.Token(token)
+	if err != nil {
+		resp.Body.Close()
+		return nil, errors.Wrap(err, "refresh OIDC token")
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	resp.Body.Close()
+	registryLogger.Debugf("Retry request with refreshed OIDC token: %s", req.URL.Path)
+
+	return t.roundTrip(req, token)
+}
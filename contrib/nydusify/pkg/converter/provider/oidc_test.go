@@ -0,0 +1,73 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCTransport(t *testing.T) {
+	var issued int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+		assert.Equal(t, "nydusify", r.Form.Get("client_id"))
+		assert.Equal(t, "secret", r.Form.Get("client_secret"))
+		assert.Equal(t, "pull push", r.Form.Get("scope"))
+		n := atomic.AddInt32(&issued, 1)
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": 3600}`, n)
+	}))
+	defer tokenServer.Close()
+
+	// Registry revokes the first token.
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer registry.Close()
+
+	registryURL, err := url.Parse(registry.URL)
+	assert.Nil(t, err)
+	transport := newOIDCTransport(http.DefaultTransport, registryURL.Host, &OIDCConfig{
+		TokenEndpoint: tokenServer.URL,
+		ClientID:      "nydusify",
+		ClientSecret:  "secret",
+		Scopes:        []string{"pull", "push"},
+	})
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(registry.URL + "/v2/")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&issued))
+
+	// Replayable body is sent again with refreshed token.
+	resp, err = client.Post(registry.URL+"/v2/repo/blobs/uploads/", "text/plain", strings.NewReader("data"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&issued))
+
+	// Token is never sent to other hosts.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+	resp, err = client.Get(other.URL)
+	assert.Nil(t, err)
+	resp.Body.Close()
+}
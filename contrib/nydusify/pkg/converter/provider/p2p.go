@@ -0,0 +1,147 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/events"
+)
+
+// P2PProxyTransport fetches blobs through the HTTP proxy of P2P system, e.g.
+// the dfdaemon of Dragonfly, so that a large cluster doesn't pull the same
+// blobs from registry on every node. Like the proxy of Nydusd storage backend,
+// the blob request falls back to registry if the proxy returns 5xx or network
+// error, and the proxy is skipped for a while once it's unhealthy.
+type P2PProxyTransport struct {
+	base          http.RoundTripper
+	proxy         http.RoundTripper
+	proxyURL      *url.URL
+	failureLimit  int
+	probeInterval time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// Zero value means the proxy is healthy.
+	unhealthySince time.Time
+}
+
+// NewP2PProxyTransport creates a P2P proxy transport, proxy is an URL like
+// `http://127.0.0.1:65001`. The blob requests are sent to the proxy as is,
+// including the Range header of partial blob reads, the registry redirects
+// of blob requests (e.g. to object storage) are proxied as well.
+func NewP2PProxyTransport(base http.RoundTripper, proxy string) (*P2PProxyTransport, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse P2P proxy %s", proxy)
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid P2P proxy %s, scheme should be http or https", proxy)
+	}
+
+	// Connect to proxy with the same settings of registry connections.
+	proxyTransport := newDefaultClient().Transport.(*http.Transport)
+	if transport, ok := base.(*http.Transport); ok {
+		proxyTransport = transport.Clone()
+	}
+	proxyTransport.Proxy = http.ProxyURL(proxyURL)
+
+	return &P2PProxyTransport{
+		base:          base,
+		proxy:         proxyTransport,
+		proxyURL:      proxyURL,
+		failureLimit:  defaultMirrorFailureLimit,
+		probeInterval: defaultMirrorProbeInterval,
+	}, nil
+}
+
+// isBlobRequest returns true for the blob fetch request, or the request
+// redirected from it.
+func isBlobRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for ; req != nil; req = redirectedFrom(req) {
+		if blobPathRegexp.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func redirectedFrom(req *http.Request) *http.Request {
+	if req.Response == nil {
+		return nil
+	}
+	return req.Response.Request
+}
+
+func (t *P2PProxyTransport) available() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.unhealthySince.IsZero() {
+		return true
+	}
+	if time.Since(t.unhealthySince) >= t.probeInterval {
+		t.unhealthySince = time.Now()
+		return true
+	}
+	return false
+}
+
+func (t *P2PProxyTransport) report(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err == nil {
+		if !t.unhealthySince.IsZero() {
+			registryLogger.Infof("P2P proxy %s recovered", t.proxyURL.Host)
+		}
+		t.failures = 0
+		t.unhealthySince = time.Time{}
+		return
+	}
+
+	t.failures++
+	if t.failures >= t.failureLimit && t.unhealthySince.IsZero() {
+		registryLogger.Warnf("P2P proxy %s is marked as unhealthy: %s", t.proxyURL.Host, err)
+		t.unhealthySince = time.Now()
+		events.Emit(events.Event{
+			Type:  events.TypeBackendFailover,
+			Error: err.Error(),
+			Data:  map[string]string{"kind": "p2p-proxy", "host": t.proxyURL.Host},
+		})
+	}
+}
+
+func (t *P2PProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isBlobRequest(req) || !t.available() {
+		return t.base.RoundTrip(req)
+	}
+
+	resp, err := t.proxy.RoundTrip(req.Clone(req.Context()))
+	if err == nil && resp.StatusCode < 500 {
+		t.report(nil)
+		return resp, nil
+	}
+	if err == nil {
+		resp.Body.Close()
+		err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if req.Context().Err() != nil {
+		return nil, req.Context().Err()
+	}
+	registryLogger.Debugf("Fetch %s from P2P proxy %s: %s", req.URL.Path, t.proxyURL.Host, err)
+	t.report(err)
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestP2PProxyTransport(t *testing.T) {
+	var proxyHits, originHits int32
+	var broken int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&originHits, 1)
+		if r.URL.Path == testBlobPath {
+			http.Redirect(w, r, "/storage/blob", http.StatusTemporaryRedirect)
+			return
+		}
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxyHits, 1)
+		if atomic.LoadInt32(&broken) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		// Requests are forwarded with the origin URL.
+		assert.Equal(t, origin.URL+r.URL.Path, r.URL.String())
+		assert.Equal(t, "bytes=10-", r.Header.Get("Range"))
+		if r.URL.Path == testBlobPath {
+			http.Redirect(w, r, origin.URL+"/storage/blob", http.StatusTemporaryRedirect)
+			return
+		}
+		w.Write([]byte("proxy"))
+	}))
+	defer proxy.Close()
+
+	_, err := NewP2PProxyTransport(http.DefaultTransport, "unix:///run/dfdaemon.sock")
+	assert.NotNil(t, err)
+	transport, err := NewP2PProxyTransport(http.DefaultTransport, proxy.URL)
+	assert.Nil(t, err)
+	client := &http.Client{Transport: transport}
+
+	get := func(path string) string {
+		req, err := http.NewRequest(http.MethodGet, origin.URL+path, nil)
+		assert.Nil(t, err)
+		req.Header.Set("Range", "bytes=10-")
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return string(body)
+	}
+
+	// The blob request and its redirect are both proxied.
+	assert.Equal(t, "proxy", get(testBlobPath))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&proxyHits))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&originHits))
+
+	// Non-blob requests always go to origin registry.
+	assert.Equal(t, "origin", get("/v2/library/busybox/manifests/latest"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&originHits))
+
+	// Fall back to origin registry, the proxy is skipped after it
+	// reaches the failure limit.
+	atomic.StoreInt32(&broken, 1)
+	atomic.StoreInt32(&proxyHits, 0)
+	atomic.StoreInt32(&originHits, 0)
+	for i := 0; i < defaultMirrorFailureLimit; i++ {
+		assert.Equal(t, "origin", get(testBlobPath))
+	}
+	assert.Equal(t, int32(defaultMirrorFailureLimit), atomic.LoadInt32(&proxyHits))
+	assert.Equal(t, int32(2*defaultMirrorFailureLimit), atomic.LoadInt32(&originHits))
+}
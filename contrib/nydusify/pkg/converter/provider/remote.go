@@ -7,36 +7,79 @@ package provider
 import (
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
-	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
-	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/distribution/reference"
 	"github.com/pkg/errors"
 
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/logging"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
 	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tlsconfig"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tracing"
 )
 
+var registryLogger = logging.Module(logging.ModuleRegistry)
+
+// TransportOptions tunes the HTTP transport of registry client, the zero
+// value closes the connection after each request and disables HTTP/2.
+type TransportOptions struct {
+	// KeepAlive reuses the connections across requests.
+	KeepAlive bool
+	// MaxIdleConns limits the idle connections kept for reuse (per host
+	// as well), defaults to 10.
+	MaxIdleConns int
+	// MaxConnsPerHost limits the connections to a host including the
+	// active ones, 0 means no limit.
+	MaxConnsPerHost int
+	// HTTP2 enables HTTP/2 for TLS connections.
+	HTTP2 bool
+	// TLSSessionCacheSize enables TLS session resumption with an LRU cache
+	// of sessions if it's positive.
+	TLSSessionCacheSize int
+}
+
+func newTransport(opts TransportOptions) *http.Transport {
+	maxIdleConns := 10
+	if opts.MaxIdleConns > 0 {
+		maxIdleConns = opts.MaxIdleConns
+	}
+	transport := &http.Transport{
+		Proxy: proxy.Func(nil),
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 5 * time.Second,
+		DisableKeepAlives:     !opts.KeepAlive,
+		TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
+	}
+	if opts.HTTP2 {
+		transport.TLSNextProto = nil
+		transport.ForceAttemptHTTP2 = true
+	}
+	if opts.TLSSessionCacheSize > 0 {
+		transport.TLSClientConfig = &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(opts.TLSSessionCacheSize),
+		}
+	}
+	return transport
+}
+
 func newDefaultClient() *http.Client {
 	return &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-			MaxIdleConns:          10,
-			IdleConnTimeout:       30 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 5 * time.Second,
-			DisableKeepAlives:     true,
-			TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
-		},
+		Transport: newTransport(TransportOptions{}),
 	}
 }
 
@@ -44,16 +87,79 @@ func newDefaultClient() *http.Client {
 // username, password and error.
 type withCredentialFunc = func(string) (string, string, error)
 
+// RemoteOptions configures the remote instance created by DefaultRemoteWithOptions.
+type RemoteOptions struct {
+	// Blobs are fetched from the ordered mirror list first with automatic failover.
+	Mirrors []string
+	// Get registry credentials by `docker-credential-<helper>` for all hosts,
+	// for example `ecr-login`, `gcloud`, `acr-env`.
+	CredentialHelper string
+	// Authorize requests with the bearer token from OIDC provider, the
+	// token is refreshed on 401 response.
+	OIDC *OIDCConfig
+	// Fetch blobs through the HTTP proxy of P2P system like Dragonfly,
+	// e.g. `http://127.0.0.1:65001`, with fallback to registry.
+	P2PProxy string
+	// Transport tunes the connections to registry.
+	Transport TransportOptions
+	// ChunkedUpload pushes large blobs in resumable chunks if it's set.
+	ChunkedUpload *remote.ChunkedUploadOpt
+}
+
 // withRemote creates an remote instance, it uses the implemention of containerd
 // docker remote to access image from remote registry.
-func withRemote(ref string, insecure bool, credFunc withCredentialFunc) (*remote.Remote, error) {
-	resolverFunc := func() remotes.Resolver {
-		registryHosts := docker.ConfigureDefaultRegistries(
+func withRemote(ref string, insecure bool, opts RemoteOptions, credFunc withCredentialFunc, credCache *credentialCache) (*remote.Remote, error) {
+	// The image in OCI image layout directory is accessed without registry
+	if remote.IsLayoutReference(ref) {
+		return remote.NewLayout(ref)
+	}
+
+	// The transport is shared by all resolvers, so that the idle connections,
+	// the health state of mirrors and the OIDC token are kept across requests.
+	// The TLS config of hosts applies to the registry, mirrors and P2P proxy.
+	base := tlsconfig.Transport(newTransport(opts.Transport))
+	transport := base
+	if opts.P2PProxy != "" {
+		p2pTransport, err := NewP2PProxyTransport(transport, opts.P2PProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport = p2pTransport
+	}
+	if opts.OIDC != nil {
+		parsed, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return nil, err
+		}
+		host, err := docker.DefaultHost(reference.Domain(parsed))
+		if err != nil {
+			return nil, err
+		}
+		transport = newOIDCTransport(transport, host, opts.OIDC)
+	}
+	if len(opts.Mirrors) > 0 {
+		mirrorTransport, err := NewMirrorTransport(transport, opts.Mirrors)
+		if err != nil {
+			return nil, err
+		}
+		transport = mirrorTransport
+	}
+
+	hostsFunc := func() docker.RegistryHosts {
+		client := &http.Client{Transport: transport}
+		authClient := &http.Client{Transport: base}
+		if credCache != nil {
+			client.Transport = &credentialRefreshTransport{base: client.Transport, cache: credCache}
+			authClient.Transport = &credentialRefreshTransport{base: authClient.Transport, cache: credCache}
+		}
+		client.Transport = tracing.NewTransport(client.Transport)
+		authClient.Transport = tracing.NewTransport(authClient.Transport)
+		return docker.ConfigureDefaultRegistries(
 			docker.WithAuthorizer(docker.NewAuthorizer(
-				newDefaultClient(),
+				authClient,
 				credFunc,
 			)),
-			docker.WithClient(newDefaultClient()),
+			docker.WithClient(client),
 			docker.WithPlainHTTP(func(host string) (bool, error) {
 				_insecure, err := docker.MatchLocalhost(host)
 				if err != nil {
@@ -65,41 +171,37 @@ func withRemote(ref string, insecure bool, credFunc withCredentialFunc) (*remote
 				return insecure, nil
 			}),
 		)
-
-		return docker.NewResolver(docker.ResolverOptions{
-			Hosts: registryHosts,
-		})
 	}
 
-	return remote.New(ref, resolverFunc)
+	r, err := remote.NewWithRegistryHosts(ref, hostsFunc)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ChunkedUpload != nil {
+		r.SetChunkedUpload(*opts.ChunkedUpload)
+	}
+	return r, nil
 }
 
 // DefaultRemote creates an remote instance, it attempts to read docker auth config
 // file `$DOCKER_CONFIG/config.json` to communicate with remote registry, `$DOCKER_CONFIG`
 // defaults to `~/.docker`.
 func DefaultRemote(ref string, insecure bool) (*remote.Remote, error) {
-	return withRemote(ref, insecure, func(host string) (string, string, error) {
-		// The host of docker hub image will be converted to `registry-1.docker.io` in:
-		// github.com/containerd/containerd/remotes/docker/registry.go
-		// But we need use the key `https://index.docker.io/v1/` to find auth from docker config.
-		if host == "registry-1.docker.io" {
-			host = "https://index.docker.io/v1/"
-		}
-
-		config := dockerconfig.LoadDefaultConfigFile(os.Stderr)
-		authConfig, err := config.GetAuthConfig(host)
-		if err != nil {
-			return "", "", err
-		}
+	return DefaultRemoteWithOptions(ref, insecure, RemoteOptions{})
+}
 
-		return authConfig.Username, authConfig.Password, nil
-	})
+// DefaultRemoteWithOptions creates an remote instance like DefaultRemote, the
+// credentials from docker config or credential helpers are cached and refreshed
+// when expired, so it works for short-lived tokens in a long conversion.
+func DefaultRemoteWithOptions(ref string, insecure bool, opts RemoteOptions) (*remote.Remote, error) {
+	credCache := newCredentialCache(opts.CredentialHelper)
+	return withRemote(ref, insecure, opts, credCache.Get, credCache)
 }
 
 // DefaultRemoteWithAuth creates an remote instance, it parses base64 encoded auth string
 // to communicate with remote registry.
 func DefaultRemoteWithAuth(ref string, insecure bool, auth string) (*remote.Remote, error) {
-	return withRemote(ref, insecure, func(host string) (string, string, error) {
+	return withRemote(ref, insecure, RemoteOptions{}, func(host string) (string, string, error) {
 		// Leave auth empty if no authorization be required
 		if strings.TrimSpace(auth) == "" {
 			return "", "", nil
@@ -113,5 +215,49 @@ func DefaultRemoteWithAuth(ref string, insecure bool, auth string) (*remote.Remo
 			return "", "", errors.New("Invalid base64 encoded auth string")
 		}
 		return ary[0], ary[1], nil
-	})
+	}, nil)
+}
+
+// RegistryBackendConfig generates the config of Nydusd registry backend to
+// read the blobs of image, the auth is resolved like DefaultRemote.
+func RegistryBackendConfig(ref string, insecure bool) (string, error) {
+	parsed, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse reference %s", ref)
+	}
+	host, err := docker.DefaultHost(reference.Domain(parsed))
+	if err != nil {
+		return "", err
+	}
+
+	scheme := "https"
+	isLocalhost, err := docker.MatchLocalhost(host)
+	if err != nil {
+		return "", err
+	}
+	if insecure || isLocalhost {
+		scheme = "http"
+	}
+
+	config := map[string]string{
+		"scheme": scheme,
+		"host":   host,
+		"repo":   reference.Path(parsed),
+	}
+	username, secret, err := newCredentialCache("").Get(host)
+	if err != nil {
+		return "", errors.Wrapf(err, "get credential of %s", host)
+	}
+	if username != "" {
+		config["auth"] = base64.StdEncoding.EncodeToString([]byte(username + ":" + secret))
+	} else if secret != "" {
+		// Nydusd takes bearer token, but the identity token is refresh token.
+		registryLogger.Warnf("Identity token of %s isn't supported by Nydusd, access anonymously", host)
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
@@ -0,0 +1,98 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportOptions(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(transport *http.Transport) string {
+		transport.TLSClientConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		client := &http.Client{Transport: transport}
+		resp, err := client.Get(server.URL)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return string(body)
+	}
+
+	transport := newTransport(TransportOptions{})
+	assert.Equal(t, 10, transport.MaxIdleConns)
+	assert.True(t, transport.DisableKeepAlives)
+	assert.Nil(t, transport.TLSClientConfig)
+
+	// Connections are reused with keep-alive enabled.
+	transport = newTransport(TransportOptions{KeepAlive: true, MaxIdleConns: 4, TLSSessionCacheSize: 8})
+	assert.Equal(t, 4, transport.MaxIdleConnsPerHost)
+	assert.NotNil(t, transport.TLSClientConfig.ClientSessionCache)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "HTTP/1.1", get(transport))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+
+	transport = newTransport(TransportOptions{KeepAlive: true, HTTP2: true, TLSSessionCacheSize: 8})
+	assert.Equal(t, "HTTP/2.0", get(transport))
+}
+
+func TestRegistryBackendConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-backend-config-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"auths": {"localhost:5000": {"auth": "dXNlcjpwYXNz"}}}`), 0644))
+	// The config directory is resolved only once by docker cli.
+	configDir := dockerconfig.Dir()
+	dockerconfig.SetDir(dir)
+	defer dockerconfig.SetDir(configDir)
+
+	parse := func(ref string, insecure bool) map[string]string {
+		data, err := RegistryBackendConfig(ref, insecure)
+		assert.Nil(t, err)
+		config := map[string]string{}
+		assert.Nil(t, json.Unmarshal([]byte(data), &config))
+		return config
+	}
+
+	assert.Equal(t, map[string]string{
+		"scheme": "http",
+		"host":   "localhost:5000",
+		"repo":   "app/web",
+		"auth":   "dXNlcjpwYXNz",
+	}, parse("localhost:5000/app/web:v1-nydus", false))
+	assert.Equal(t, map[string]string{
+		"scheme": "https",
+		"host":   "registry-1.docker.io",
+		"repo":   "library/nginx",
+	}, parse("nginx", false))
+	assert.Equal(t, "http", parse("example.com/nginx", true)["scheme"])
+
+	_, err = RegistryBackendConfig("INVALID", false)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+type rootfsSourceProvider struct {
+	config ocispec.Image
+	layer  *rootfsSourceLayer
+}
+
+// rootfsSourceLayer is the only layer of image built from rootfs.
+type rootfsSourceLayer struct {
+	dir    string
+	digest digest.Digest
+	size   int64
+}
+
+// RootfsSource creates source provider of the image built from a rootfs
+// directory, or a (compressed) tarball of rootfs (`-` to read from stdin),
+// the tarball is unpacked into `$workDir/rootfs` in advance. The image
+// config is read from `configPath` if specified, of which the OS and
+// architecture default to platform.
+func RootfsSource(ctx context.Context, rootfs, configPath, workDir, platform string) (SourceProvider, error) {
+	var config ocispec.Image
+	if configPath != "" {
+		data, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "read image config")
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, errors.Wrap(err, "unmarshal image config")
+		}
+	}
+	osName, arch, err := ExtractOsArch(platform)
+	if err != nil {
+		return nil, err
+	}
+	if config.OS == "" {
+		config.OS = osName
+	}
+	if config.Architecture == "" {
+		config.Architecture = arch
+	}
+	if config.OS != osName || config.Architecture != arch {
+		return nil, fmt.Errorf("platform %s/%s of image config doesn't match %s", config.OS, config.Architecture, platform)
+	}
+
+	layer, err := newRootfsSourceLayer(ctx, rootfs, filepath.Join(workDir, "rootfs"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &rootfsSourceProvider{
+		config: config,
+		layer:  layer,
+	}, nil
+}
+
+func newRootfsSourceLayer(ctx context.Context, rootfs, unpackDir string) (*rootfsSourceLayer, error) {
+	if rootfs != "-" {
+		info, err := os.Stat(rootfs)
+		if err != nil {
+			return nil, errors.Wrap(err, "stat rootfs")
+		}
+		if info.IsDir() {
+			dgst, size, err := digestDir(rootfs)
+			if err != nil {
+				return nil, errors.Wrapf(err, "digest rootfs %s", rootfs)
+			}
+			return &rootfsSourceLayer{dir: rootfs, digest: dgst, size: size}, nil
+		}
+	}
+
+	var reader io.Reader = os.Stdin
+	if rootfs != "-" {
+		file, err := os.Open(rootfs)
+		if err != nil {
+			return nil, errors.Wrap(err, "open rootfs tarball")
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	if err := os.RemoveAll(unpackDir); err != nil {
+		return nil, errors.Wrap(err, "remove rootfs directory")
+	}
+	if err := os.MkdirAll(unpackDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create rootfs directory")
+	}
+	// The tarball is identified by the digest of its content.
+	digester := digest.Canonical.Digester()
+	counter := &countWriter{}
+	tee := io.TeeReader(reader, io.MultiWriter(digester.Hash(), counter))
+	if err := utils.UnpackTargz(ctx, unpackDir, tee); err != nil {
+		return nil, errors.Wrap(err, "unpack rootfs tarball")
+	}
+	// Digest the padding after end of archive.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, errors.Wrap(err, "read rootfs tarball")
+	}
+
+	return &rootfsSourceLayer{
+		dir:    unpackDir,
+		digest: digester.Digest(),
+		size:   counter.n,
+	}, nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// digestDir digests the path and metadata of all files in directory, the
+// file content isn't read, so that the changed directory is identified
+// cheaply for build cache and checkpoint.
+func digestDir(dir string) (digest.Digest, int64, error) {
+	digester := digest.Canonical.Digester()
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		size += info.Size()
+		fmt.Fprintf(digester.Hash(), "%s\x00%o\x00%d\x00%d\x00%s\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano(), link)
+		return nil
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return digester.Digest(), size, nil
+}
+
+func (sp *rootfsSourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
+	// The image isn't converted from a manifest.
+	return nil, nil
+}
+
+func (sp *rootfsSourceProvider) Config(ctx context.Context) (*ocispec.Image, error) {
+	config := sp.config
+	return &config, nil
+}
+
+func (sp *rootfsSourceProvider) Layers(ctx context.Context) ([]SourceLayer, error) {
+	return []SourceLayer{sp.layer}, nil
+}
+
+func (sl *rootfsSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func() error, error) {
+	// The rootfs directory is never removed, the tarball is unpacked in
+	// work directory once and kept for retrying.
+	umount := func() error {
+		return nil
+	}
+
+	mounts := []mount.Mount{
+		{
+			Type:   "oci-directory",
+			Source: sl.dir,
+		},
+	}
+
+	return mounts, umount, nil
+}
+
+func (sl *rootfsSourceLayer) Digest() digest.Digest {
+	return sl.digest
+}
+
+func (sl *rootfsSourceLayer) Size() int64 {
+	return sl.size
+}
+
+func (sl *rootfsSourceLayer) ChainID() digest.Digest {
+	return sl.digest
+}
+
+func (sl *rootfsSourceLayer) ParentChainID() *digest.Digest {
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootfsSource(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-rootfs-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	// Build from directory.
+	rootfs := filepath.Join(workDir, "dir")
+	makeTestLayerDir(t, rootfs, map[string]string{"etc/hosts": "hello"})
+	configPath := filepath.Join(workDir, "config.json")
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte(`{"architecture":"amd64","config":{"Env":["A=B"]}}`), 0644))
+
+	sp, err := RootfsSource(context.Background(), rootfs, configPath, workDir, "linux/amd64")
+	assert.Nil(t, err)
+	manifest, err := sp.Manifest(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, manifest)
+	config, err := sp.Config(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "linux", config.OS)
+	assert.Equal(t, []string{"A=B"}, config.Config.Env)
+
+	layers, err := sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, layers, 1)
+	mounts, umount, err := layers[0].Mount(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, rootfs, mounts[0].Source)
+	assert.Nil(t, umount())
+	// The rootfs of user is kept.
+	_, err = os.Stat(filepath.Join(rootfs, "etc/hosts"))
+	assert.Nil(t, err)
+
+	// The digest changes with the directory.
+	dirDigest := layers[0].Digest()
+	makeTestLayerDir(t, rootfs, map[string]string{"etc/passwd": "root"})
+	sp, err = RootfsSource(context.Background(), rootfs, "", workDir, "linux/amd64")
+	assert.Nil(t, err)
+	layers, err = sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.NotEqual(t, dirDigest, layers[0].Digest())
+
+	_, err = RootfsSource(context.Background(), rootfs, configPath, workDir, "linux/arm64")
+	assert.NotNil(t, err)
+
+	// Build from tarball.
+	layer := makeTestLayer(t, "hello.txt", "hello")
+	tarball := filepath.Join(workDir, "rootfs.tar")
+	assert.Nil(t, ioutil.WriteFile(tarball, layer, 0644))
+	sp, err = RootfsSource(context.Background(), tarball, "", workDir, "linux/amd64")
+	assert.Nil(t, err)
+	layers, err = sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, digest.FromBytes(layer), layers[0].Digest())
+	assert.Equal(t, int64(len(layer)), layers[0].Size())
+	mounts, _, err = layers[0].Mount(context.Background())
+	assert.Nil(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(mounts[0].Source, "hello.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+}
@@ -15,6 +15,7 @@ package provider
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -46,18 +47,66 @@ type SourceProvider interface {
 	Layers(ctx context.Context) ([]SourceLayer, error)
 }
 
+// AnnotatedSourceProvider is the source provider knowing the annotations of
+// source manifest, which are copied to Nydus manifest.
+type AnnotatedSourceProvider interface {
+	SourceProvider
+	ManifestAnnotations(ctx context.Context) (map[string]string, error)
+}
+
+// ManifestAnnotations returns the annotations of source manifest, it's nil
+// if the source provider doesn't implement AnnotatedSourceProvider.
+func ManifestAnnotations(ctx context.Context, sp SourceProvider) (map[string]string, error) {
+	if annotated, ok := sp.(AnnotatedSourceProvider); ok {
+		return annotated.ManifestAnnotations(ctx)
+	}
+	return nil, nil
+}
+
+// ForeignSourceProvider is the source provider of Windows image, of which
+// the foreign (non-distributable) base layers aren't converted but kept as
+// is in Nydus manifest, they're pulled from their URLs by Windows runtime.
+type ForeignSourceProvider interface {
+	SourceProvider
+	// ForeignLayers returns the foreign layers with their diff IDs, they're
+	// below all the layers returned by Layers.
+	ForeignLayers(ctx context.Context) ([]ocispec.Descriptor, []digest.Digest, error)
+}
+
+// ForeignLayers returns the foreign layers of source image, they're nil
+// if the source provider doesn't implement ForeignSourceProvider.
+func ForeignLayers(ctx context.Context, sp SourceProvider) ([]ocispec.Descriptor, []digest.Digest, error) {
+	if foreign, ok := sp.(ForeignSourceProvider); ok {
+		return foreign.ForeignLayers(ctx)
+	}
+	return nil, nil, nil
+}
+
+// blobPuller pulls blob of source image, it's implemented by remote
+// registry and archive tarball.
+type blobPuller interface {
+	Pull(ctx context.Context, desc ocispec.Descriptor, byDigest bool) (io.ReadCloser, error)
+}
+
 type defaultSourceProvider struct {
-	workDir string
-	image   parser.Image
-	remote  *remote.Remote
+	workDir        string
+	image          parser.Image
+	remote         blobPuller
+	decryptionKeys *DecryptionKeys
 }
 
 type defaultSourceLayer struct {
-	remote        *remote.Remote
-	mountDir      string
+	remote         blobPuller
+	decryptionKeys *DecryptionKeys
+	mountDir       string
+	// tarSplitPath records the tar-split metadata of layer on mount if set.
+	tarSplitPath  string
 	desc          ocispec.Descriptor
 	chainID       digest.Digest
 	parentChainID *digest.Digest
+	// windows is set for the layer of Windows image, which is unpacked
+	// with its backup stream metadata, see unpackWindowsLayer.
+	windows bool
 }
 
 func (sp *defaultSourceProvider) Manifest(ctx context.Context) (*ocispec.Descriptor, error) {
@@ -68,26 +117,72 @@ func (sp *defaultSourceProvider) Config(ctx context.Context) (*ocispec.Image, er
 	return &sp.image.Config, nil
 }
 
+func (sp *defaultSourceProvider) ManifestAnnotations(ctx context.Context) (map[string]string, error) {
+	return sp.image.Manifest.Annotations, nil
+}
+
+// foreignLayerCount returns the number of foreign layers at the bottom of
+// Windows image, the foreign layers above distributable layers can't be
+// kept under Nydus bootstrap.
+func (sp *defaultSourceProvider) foreignLayerCount() (int, error) {
+	if sp.image.Config.OS != "windows" {
+		return 0, nil
+	}
+	layers := sp.image.Manifest.Layers
+	count := 0
+	for count < len(layers) && IsForeignLayer(layers[count]) {
+		count++
+	}
+	for _, desc := range layers[count:] {
+		if IsForeignLayer(desc) {
+			return 0, fmt.Errorf("foreign layer %s above distributable layers is not supported", desc.Digest)
+		}
+	}
+	return count, nil
+}
+
+func (sp *defaultSourceProvider) ForeignLayers(ctx context.Context) ([]ocispec.Descriptor, []digest.Digest, error) {
+	count, err := sp.foreignLayerCount()
+	if err != nil || count == 0 {
+		return nil, nil, err
+	}
+	diffIDs := sp.image.Config.RootFS.DiffIDs
+	if len(diffIDs) < count {
+		return nil, nil, fmt.Errorf("Mismatched foreign layers (%d) and diff ids (%d)", count, len(diffIDs))
+	}
+	return sp.image.Manifest.Layers[:count], diffIDs[:count], nil
+}
+
 func (sp *defaultSourceProvider) Layers(ctx context.Context) ([]SourceLayer, error) {
 	layers := sp.image.Manifest.Layers
 	diffIDs := sp.image.Config.RootFS.DiffIDs
 	if len(layers) != len(diffIDs) {
 		return nil, fmt.Errorf("Mismatched fs layers (%d) and diff ids (%d)", len(layers), len(diffIDs))
 	}
+	foreignCount, err := sp.foreignLayerCount()
+	if err != nil {
+		return nil, err
+	}
 
 	var parentChainID *digest.Digest
 	sourceLayers := []SourceLayer{}
 
 	for i, desc := range layers {
 		chainID := identity.ChainID(diffIDs[:i+1])
+		if i < foreignCount {
+			parentChainID = &chainID
+			continue
+		}
 		layer := &defaultSourceLayer{
-			remote: sp.remote,
+			remote:         sp.remote,
+			decryptionKeys: sp.decryptionKeys,
 			// Use layer ChainID as the mounted directory name, in case of
 			// the layers in the same Digest are removed by umount.
 			mountDir:      filepath.Join(sp.workDir, chainID.String()),
 			desc:          desc,
 			chainID:       chainID,
 			parentChainID: parentChainID,
+			windows:       sp.image.Config.OS == "windows",
 		}
 		sourceLayers = append(sourceLayers, layer)
 		parentChainID = &chainID
@@ -107,8 +202,26 @@ func (sl *defaultSourceLayer) Mount(ctx context.Context) ([]mount.Mount, func()
 		}
 		defer reader.Close()
 
+		// Decrypt OCI encrypted layer before decompression
+		if IsEncryptedLayer(sl.desc) {
+			reader, err = sl.decryptionKeys.DecryptLayer(sl.desc, reader)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Decrypt source layer %s", digestStr))
+			}
+		}
+
+		// Only the tar stream before TOC is needed to unpack zstd:chunked layer
+		var layerReader io.Reader = reader
+		if IsZstdChunkedLayer(sl.desc) && !IsEncryptedLayer(sl.desc) {
+			payloadSize, err := zstdChunkedPayloadSize(sl.desc)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("Parse zstd:chunked source layer %s", digestStr))
+			}
+			layerReader = io.LimitReader(reader, payloadSize)
+		}
+
 		// Decompress layer from source stream
-		if err := utils.UnpackTargz(ctx, sl.mountDir, reader); err != nil {
+		if err := sl.unpack(ctx, layerReader); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("Decompress source layer %s", digestStr))
 		}
 
@@ -149,6 +262,22 @@ func (sl *defaultSourceLayer) ParentChainID() *digest.Digest {
 
 // Input platform string should be formated like os/arch.
 func ExtractOsArch(platform string) (string, string, error) {
+	os, arch, err := ExtractConvertibleOsArch(platform)
+	if err != nil {
+		return "", "", err
+	}
+
+	if os != "linux" {
+		return "", "", fmt.Errorf("not support os %s", os)
+	}
+
+	return os, arch, nil
+}
+
+// ExtractConvertibleOsArch extracts os/arch like ExtractOsArch, the OS may
+// also be `windows` for the conversion of Windows image, of which the layers
+// are unpacked with their backup stream metadata, see unpackWindowsLayer.
+func ExtractConvertibleOsArch(platform string) (string, string, error) {
 
 	if len(strings.Split(platform, "/")) != 2 {
 		return "", "", fmt.Errorf("invalid platform format, %s", platform)
@@ -158,7 +287,7 @@ func ExtractOsArch(platform string) (string, string, error) {
 	os := p[0]
 	arch := p[1]
 
-	if os != "linux" {
+	if os != "linux" && os != "windows" {
 		return "", "", fmt.Errorf("not support os %s", os)
 	}
 
@@ -171,13 +300,30 @@ func ExtractOsArch(platform string) (string, string, error) {
 
 // DefaultSource pulls image layers from specify image reference
 func DefaultSource(ctx context.Context, remote *remote.Remote, workDir, platform string) ([]SourceProvider, error) {
+	return DefaultSourceWithDecryption(ctx, remote, workDir, platform, nil)
+}
 
-	_, arch, err := ExtractOsArch(platform)
+// DefaultSourceWithDecryption pulls image layers like DefaultSource, and
+// decrypts the OCI encrypted layers by the keys.
+func DefaultSourceWithDecryption(ctx context.Context, remote *remote.Remote, workDir, platform string, keys *DecryptionKeys) ([]SourceProvider, error) {
+
+	os, arch, err := ExtractConvertibleOsArch(platform)
 	if err != nil {
 		return nil, err
 	}
 
-	parser, err := parser.New(remote, arch)
+	return DefaultSourceOfPlatform(ctx, remote, workDir, ocispec.Platform{OS: os, Architecture: arch}, keys)
+}
+
+// DefaultSourceOfPlatform pulls image layers like DefaultSourceWithDecryption,
+// the manifest is selected by the OS version of platform too if it's set,
+// which tells apart the Windows manifests in manifest index.
+func DefaultSourceOfPlatform(ctx context.Context, remote *remote.Remote, workDir string, platform ocispec.Platform, keys *DecryptionKeys) ([]SourceProvider, error) {
+	if _, _, err := ExtractConvertibleOsArch(platform.OS + "/" + platform.Architecture); err != nil {
+		return nil, err
+	}
+
+	parser, err := parser.NewWithPlatform(remote, platform)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create parser")
 	}
@@ -190,14 +336,15 @@ func DefaultSource(ctx context.Context, remote *remote.Remote, workDir, platform
 		if parsed.NydusImage != nil {
 			return nil, fmt.Errorf("the source is an image that only included Nydus manifest")
 		}
-		return nil, fmt.Errorf("not found OCI %s manifest in source image", utils.SupportedOS+"/"+utils.SupportedArch)
+		return nil, fmt.Errorf("not found OCI %s/%s manifest in source image", platform.OS, platform.Architecture)
 	}
 
 	sp := []SourceProvider{
 		&defaultSourceProvider{
-			workDir: workDir,
-			image:   *parsed.OCIImage,
-			remote:  remote,
+			workDir:        workDir,
+			image:          *parsed.OCIImage,
+			remote:         remote,
+			decryptionKeys: keys,
 		},
 	}
 
@@ -0,0 +1,98 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tarsplit"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// TarSplitSourceLayer is the source layer able to record the tar-split
+// metadata of its uncompressed tarball on mount, for reconstructing the
+// original layer from Nydus image.
+type TarSplitSourceLayer interface {
+	SourceLayer
+	// RecordTarSplit writes the metadata to the file of path on the next
+	// Mount.
+	RecordTarSplit(path string)
+}
+
+// RawSourceProvider is the source provider knowing the raw manifest and
+// config of source image, which are kept as is for reconstruction.
+type RawSourceProvider interface {
+	SourceProvider
+	RawManifest(ctx context.Context) ([]byte, error)
+	RawConfig(ctx context.Context) ([]byte, error)
+}
+
+func (sl *defaultSourceLayer) RecordTarSplit(path string) {
+	sl.tarSplitPath = path
+}
+
+// unpack decompresses the layer to mount directory, the tar-split metadata
+// is recorded as the tarball is read if requested.
+func (sl *defaultSourceLayer) unpack(ctx context.Context, reader io.Reader) error {
+	unpackTargz := utils.UnpackTargz
+	if sl.windows {
+		unpackTargz = unpackWindowsLayer
+	}
+	if sl.tarSplitPath == "" {
+		return unpackTargz(ctx, sl.mountDir, reader)
+	}
+
+	file, err := os.Create(sl.tarSplitPath)
+	if err != nil {
+		return errors.Wrap(err, "Create tar-split metadata file")
+	}
+	defer file.Close()
+
+	ds, err := utils.DecompressStream(reader)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	stream, err := tarsplit.NewInputStream(ds, file)
+	if err != nil {
+		return errors.Wrap(err, "Record tar-split metadata")
+	}
+	defer stream.Close()
+	if err := unpackTargz(ctx, sl.mountDir, stream); err != nil {
+		return err
+	}
+	// The paddings after the end of archive aren't read by unpacker.
+	if _, err := io.Copy(ioutil.Discard, stream); err != nil {
+		return errors.Wrap(err, "Record tar-split metadata")
+	}
+
+	return nil
+}
+
+func (sp *defaultSourceProvider) pullRaw(ctx context.Context, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := sp.remote.Pull(ctx, desc, true)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+func (sp *defaultSourceProvider) RawManifest(ctx context.Context) ([]byte, error) {
+	data, err := sp.pullRaw(ctx, sp.image.Desc)
+	return data, errors.Wrap(err, "Pull source manifest")
+}
+
+func (sp *defaultSourceProvider) RawConfig(ctx context.Context) ([]byte, error) {
+	data, err := sp.pullRaw(ctx, sp.image.Manifest.Config)
+	return data, errors.Wrap(err, "Pull source config")
+}
@@ -0,0 +1,321 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// WindowsXattrPrefix is the xattr namespace of the backup stream metadata of
+// Windows layer in Nydus image, e.g. the security descriptor of file in PAX
+// record `MSWINDOWS.rawsd` is kept as xattr `user.MSWINDOWS.rawsd`.
+const WindowsXattrPrefix = "user."
+
+// The top-level directories of Windows layer tarball: filesystem, registry
+// hives and the utility VM image for Hyper-V isolation.
+var windowsLayerRoots = map[string]bool{
+	"Files":     true,
+	"Hives":     true,
+	"UtilityVM": true,
+}
+
+// The PAX records of file attributes, security descriptor, reparse point,
+// extended attributes and creation time written by Windows layer writer.
+var windowsPAXPrefixes = []string{"MSWINDOWS.", "LIBARCHIVE."}
+
+// PreparedSourceLayer is the source layer needing preparation on its mounted
+// directory before build, against the bootstrap of parent layer which is
+// empty for the lowest layer.
+type PreparedSourceLayer interface {
+	SourceLayer
+	Prepare(ctx context.Context, parentBootstrapPath string) error
+}
+
+// IsForeignLayer returns whether the layer is a foreign (non-distributable)
+// layer, such as the base layers of Windows image.
+func IsForeignLayer(desc ocispec.Descriptor) bool {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2LayerForeign,
+		images.MediaTypeDockerSchema2LayerForeignGzip,
+		ocispec.MediaTypeImageLayerNonDistributable,
+		ocispec.MediaTypeImageLayerNonDistributableGzip:
+		return true
+	}
+	return false
+}
+
+// foldCase returns the key comparing the paths case-insensitively as NTFS,
+// which compares the names in upper case.
+func foldCase(name string) string {
+	return strings.ToUpper(name)
+}
+
+// windowsLayerPath returns the cleaned relative path of entry in Windows
+// layer, the entry must be under one of the layer roots.
+func windowsLayerPath(name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	root := strings.SplitN(cleaned, "/", 2)[0]
+	if !windowsLayerRoots[root] {
+		return "", fmt.Errorf("invalid entry %s out of Files, Hives and UtilityVM in Windows layer", name)
+	}
+	return cleaned, nil
+}
+
+// unpackWindowsLayer unpacks .tar(.gz|.zst) stream of Windows layer to dst
+// path as the OCI layer, the backup stream metadata in PAX records is kept
+// as the xattrs of file, see WindowsXattrPrefix. The whiteouts are unpacked
+// as the regular files like UnpackTargz.
+func unpackWindowsLayer(ctx context.Context, dst string, r io.Reader) error {
+	ds, err := utils.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	// Guarantee that umask won't affect file/directory creation
+	mask := unix.Umask(0)
+	defer unix.Umask(mask)
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirTimes []dirTime
+	// The paths in layer differing only in case are the same file on
+	// Windows, they can't be converted unambiguously.
+	names := map[string]string{}
+
+	tr := tar.NewReader(ds)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "Read Windows layer")
+		}
+
+		name, err := windowsLayerPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if other, ok := names[foldCase(name)]; ok && other != name {
+			return fmt.Errorf("entry %s conflicts with %s case-insensitively in Windows layer", name, other)
+		}
+		names[foldCase(name)] = name
+
+		target := filepath.Join(dst, name)
+		if err := makeParentDirs(dst, name, true); err != nil {
+			return err
+		}
+		// The entry overrides the earlier one of same path, but the
+		// directory is kept for its children.
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		mode := os.FileMode(hdr.Mode & 0777)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+			dirTimes = append(dirTimes, dirTime{path: target, mtime: hdr.ModTime})
+		case tar.TypeReg, tar.TypeRegA:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return errors.Wrapf(err, "Write %s", name)
+			}
+		case tar.TypeSymlink:
+			// The target is kept as is, it may be an absolute Windows
+			// path which is resolved by Windows runtime.
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkName, err := windowsLayerPath(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := makeParentDirs(dst, linkName, false); err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(dst, linkName), target); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("unsupported type %c of entry %s in Windows layer", hdr.Typeflag, name)
+		}
+
+		for key, value := range hdr.PAXRecords {
+			if !isWindowsPAXRecord(key) {
+				continue
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				// Linux doesn't allow user xattrs on symlinks, the
+				// reparse point and attributes are
+				// derivable from the link target.
+				logrus.Warnf("Skip backup stream metadata %s of symlink %s in Windows layer", key, name)
+				continue
+			}
+			if err := xattr.LSet(target, WindowsXattrPrefix+key, []byte(value)); err != nil {
+				return errors.Wrapf(err, "Set backup stream metadata %s of %s", key, name)
+			}
+		}
+
+		if hdr.Typeflag != tar.TypeDir {
+			mtime := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+			if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return errors.Wrapf(err, "Set mtime of %s", name)
+			}
+		}
+	}
+
+	// The mtime of directories is changed by creating their children.
+	for idx := len(dirTimes) - 1; idx >= 0; idx-- {
+		if err := os.Chtimes(dirTimes[idx].path, dirTimes[idx].mtime, dirTimes[idx].mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeParentDirs checks the parent directories of entry in Windows layer
+// unpacked to dst aren't symlinks, which could lead the entry out of dst,
+// the missing directories are created if create is set.
+func makeParentDirs(dst, name string, create bool) error {
+	dir := dst
+	for _, component := range strings.Split(path.Dir(name), "/") {
+		if component == "." {
+			break
+		}
+		dir = filepath.Join(dir, component)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) && create {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("parent %s of entry %s is not a directory in Windows layer", component, name)
+		}
+	}
+	return nil
+}
+
+func isWindowsPAXRecord(key string) bool {
+	for _, prefix := range windowsPAXPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepare renames the files of Windows layer to their names in lower layers
+// if they differ only in case, Windows resolves the paths case-insensitively
+// while nydus-image merges the layers by exact names.
+func (sl *defaultSourceLayer) Prepare(ctx context.Context, parentBootstrapPath string) error {
+	if !sl.windows || parentBootstrapPath == "" {
+		return nil
+	}
+
+	bootstrap, err := dedup.ParseBootstrapFile(parentBootstrapPath)
+	if err != nil {
+		return errors.Wrap(err, "Parse parent bootstrap")
+	}
+	lowerNames := map[string]string{}
+	for _, file := range bootstrap.Files {
+		lowerNames[foldCase(file.Path)] = file.Path
+	}
+
+	return reconcileCase(sl.mountDir, lowerNames)
+}
+
+// reconcileCase renames the files under root to the names in lowerNames,
+// which are indexed by the case-folded absolute paths. The whiteouts are
+// renamed by the names they hide.
+func reconcileCase(root string, lowerNames map[string]string) error {
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := ioutil.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			prefix := ""
+			if name != whiteoutOpaque && strings.HasPrefix(name, whiteoutPrefix) {
+				prefix = whiteoutPrefix
+			}
+			lowerPath, ok := lowerNames[foldCase(path.Join("/", dir, strings.TrimPrefix(name, prefix)))]
+			if ok && prefix+path.Base(lowerPath) != name {
+				renamed := prefix + path.Base(lowerPath)
+				if _, err := os.Lstat(filepath.Join(root, dir, renamed)); err == nil {
+					return fmt.Errorf("entry %s conflicts with %s case-insensitively in Windows layer", path.Join(dir, name), path.Join(dir, renamed))
+				}
+				if err := os.Rename(filepath.Join(root, dir, name), filepath.Join(root, dir, renamed)); err != nil {
+					return err
+				}
+				logrus.Debugf("Renamed %s to %s of lower layer", path.Join(dir, name), path.Join(dir, renamed))
+				name = renamed
+			}
+			if entry.IsDir() && prefix == "" {
+				if err := walk(path.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk("")
+}
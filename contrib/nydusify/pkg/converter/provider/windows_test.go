@@ -0,0 +1,209 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/xattr"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+)
+
+func makeTestWindowsLayer(t *testing.T, headers []*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		assert.Nil(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(hdr.Name))
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestUnpackWindowsLayer(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-windows-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	mtime := time.Unix(1600000000, 0)
+	layer := makeTestWindowsLayer(t, []*tar.Header{
+		{Name: "Files", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "Files/Windows", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime, PAXRecords: map[string]string{
+			"MSWINDOWS.fileattr": "16",
+		}},
+		{Name: "Files/Windows/notepad.exe", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, PAXRecords: map[string]string{
+			"MSWINDOWS.fileattr":      "32",
+			"MSWINDOWS.rawsd":         "AQAEgBQAAAAkAAAAAAAAADAAAAA=",
+			"LIBARCHIVE.creationtime": "1600000000",
+		}},
+		{Name: "Files/Windows/write.exe", Typeflag: tar.TypeLink, Linkname: "Files/Windows/notepad.exe"},
+		{Name: "Files/Windows/.wh.old.dll", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "Files/ProgramData", Typeflag: tar.TypeSymlink, Linkname: `C:\ProgramData`, ModTime: mtime, PAXRecords: map[string]string{
+			"MSWINDOWS.fileattr": "1040",
+		}},
+		{Name: "Hives/Software_Delta", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	})
+
+	dir := filepath.Join(workDir, "layer")
+	assert.Nil(t, unpackWindowsLayer(context.Background(), dir, bytes.NewReader(layer)))
+	assert.Equal(t, []string{
+		"Files",
+		"Files/ProgramData",
+		"Files/Windows",
+		"Files/Windows/.wh.old.dll",
+		"Files/Windows/notepad.exe",
+		"Files/Windows/write.exe",
+		"Hives",
+		"Hives/Software_Delta",
+	}, listTestLayerDir(t, dir))
+
+	data, err := xattr.LGet(filepath.Join(dir, "Files/Windows/notepad.exe"), "user.MSWINDOWS.rawsd")
+	assert.Nil(t, err)
+	assert.Equal(t, "AQAEgBQAAAAkAAAAAAAAADAAAAA=", string(data))
+	data, err = xattr.LGet(filepath.Join(dir, "Files/Windows/notepad.exe"), "user.LIBARCHIVE.creationtime")
+	assert.Nil(t, err)
+	assert.Equal(t, "1600000000", string(data))
+	data, err = xattr.LGet(filepath.Join(dir, "Files/Windows"), "user.MSWINDOWS.fileattr")
+	assert.Nil(t, err)
+	assert.Equal(t, "16", string(data))
+
+	info, err := os.Stat(filepath.Join(dir, "Files/Windows/notepad.exe"))
+	assert.Nil(t, err)
+	assert.Equal(t, mtime.Unix(), info.ModTime().Unix())
+	link, err := os.Stat(filepath.Join(dir, "Files/Windows/write.exe"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(info, link))
+	target, err := os.Readlink(filepath.Join(dir, "Files/ProgramData"))
+	assert.Nil(t, err)
+	assert.Equal(t, `C:\ProgramData`, target)
+	info, err = os.Stat(filepath.Join(dir, "Files/Windows"))
+	assert.Nil(t, err)
+	assert.Equal(t, mtime.Unix(), info.ModTime().Unix())
+
+	for name, headers := range map[string][]*tar.Header{
+		"out of layer roots": {
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"escaping hardlink": {
+			{Name: "Files/passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"},
+		},
+		"case conflict": {
+			{Name: "Files/Windows/System32", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "Files/WINDOWS/system32", Typeflag: tar.TypeDir, Mode: 0755},
+		},
+		"through symlink": {
+			{Name: "Files/escape", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+			{Name: "Files/escape/file", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		dir := filepath.Join(workDir, "invalid")
+		err := unpackWindowsLayer(context.Background(), dir, bytes.NewReader(makeTestWindowsLayer(t, headers)))
+		assert.NotNil(t, err, name)
+		assert.Nil(t, os.RemoveAll(dir))
+	}
+}
+
+func TestReconcileCase(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "nydusify-windows-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(workDir)
+
+	lowerNames := map[string]string{}
+	for _, path := range []string{"/Files", "/Files/Windows", "/Files/Windows/System32", "/Files/Windows/System32/kernel32.dll", "/Files/Users"} {
+		lowerNames[foldCase(path)] = path
+	}
+
+	makeTestLayerDir(t, workDir, map[string]string{
+		"Files/WINDOWS/system32/KERNEL32.DLL": "new",
+		"Files/WINDOWS/system32/new.dll":      "new",
+		"Files/.wh.USERS":                     "",
+		"Files/WINDOWS/.wh..wh..opq":          "",
+	})
+	assert.Nil(t, reconcileCase(workDir, lowerNames))
+	assert.Equal(t, []string{
+		"Files",
+		"Files/.wh.Users",
+		"Files/Windows",
+		"Files/Windows/.wh..wh..opq",
+		"Files/Windows/System32",
+		"Files/Windows/System32/kernel32.dll",
+		"Files/Windows/System32/new.dll",
+	}, listTestLayerDir(t, workDir))
+
+	// The names in upper layer differing only in case can't be merged.
+	conflictDir := filepath.Join(workDir, "conflict")
+	makeTestLayerDir(t, conflictDir, map[string]string{
+		"Files/Users": "/",
+		"Files/USERS": "/",
+	})
+	assert.NotNil(t, reconcileCase(conflictDir, lowerNames))
+}
+
+func TestForeignLayers(t *testing.T) {
+	foreign := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerForeignGzip,
+		Digest:    digest.FromString("foreign"),
+		URLs:      []string{"https://mcr.microsoft.com/foreign"},
+	}
+	layer := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerGzip,
+		Digest:    digest.FromString("layer"),
+	}
+	diffIDs := []digest.Digest{digest.FromString("foreign-diff"), digest.FromString("layer-diff")}
+	sp := &defaultSourceProvider{
+		workDir: "/work",
+		image: parser.Image{
+			Manifest: ocispec.Manifest{Layers: []ocispec.Descriptor{foreign, layer}},
+			Config:   ocispec.Image{OS: "windows", RootFS: ocispec.RootFS{DiffIDs: diffIDs}},
+		},
+	}
+
+	layers, err := sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, layers, 1)
+	assert.Equal(t, layer.Digest, layers[0].Digest())
+	assert.Equal(t, identity.ChainID(diffIDs), layers[0].ChainID())
+	assert.Equal(t, diffIDs[0], *layers[0].ParentChainID())
+	assert.True(t, layers[0].(*defaultSourceLayer).windows)
+
+	foreignLayers, foreignDiffIDs, err := ForeignLayers(context.Background(), sp)
+	assert.Nil(t, err)
+	assert.Equal(t, []ocispec.Descriptor{foreign}, foreignLayers)
+	assert.Equal(t, diffIDs[:1], foreignDiffIDs)
+
+	// The foreign layer can't be kept above the converted layers.
+	sp.image.Manifest.Layers = []ocispec.Descriptor{layer, foreign}
+	_, err = sp.Layers(context.Background())
+	assert.NotNil(t, err)
+
+	// The foreign layers of Linux image are converted as usual.
+	sp.image.Manifest.Layers = []ocispec.Descriptor{foreign, layer}
+	sp.image.Config.OS = "linux"
+	layers, err = sp.Layers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, layers, 2)
+	foreignLayers, _, err = ForeignLayers(context.Background(), sp)
+	assert.Nil(t, err)
+	assert.Nil(t, foreignLayers)
+}
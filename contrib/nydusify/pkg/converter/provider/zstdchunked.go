@@ -0,0 +1,55 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Annotations of zstd:chunked layer produced by containers/storage.
+	annotationZstdChunkedManifestChecksum = "io.github.containers.zstd-chunked.manifest-checksum"
+	annotationZstdChunkedManifestPosition = "io.github.containers.zstd-chunked.manifest-position"
+
+	// The header size of zstd skippable frame which holds the TOC.
+	zstdSkippableFrameHeaderSize = 8
+)
+
+// IsZstdChunkedLayer returns true if the layer is produced in zstd:chunked
+// format, which has a TOC (manifest) appended to the zstd stream. The TOC
+// isn't parsed, the layer is unpacked as a plain zstd stream without it.
+func IsZstdChunkedLayer(desc ocispec.Descriptor) bool {
+	return desc.Annotations[annotationZstdChunkedManifestChecksum] != "" &&
+		desc.Annotations[annotationZstdChunkedManifestPosition] != ""
+}
+
+// zstdChunkedPayloadSize returns the size of compressed tar stream before
+// the TOC of zstd:chunked layer, the position annotation is formatted as
+// `offset:length:uncompressedLength:type`.
+func zstdChunkedPayloadSize(desc ocispec.Descriptor) (int64, error) {
+	position := desc.Annotations[annotationZstdChunkedManifestPosition]
+	parts := strings.Split(position, ":")
+	if len(parts) != 4 {
+		return 0, fmt.Errorf("invalid zstd:chunked manifest position %q", position)
+	}
+
+	offset, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid zstd:chunked manifest offset %q", parts[0])
+	}
+	length, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid zstd:chunked manifest length %q", parts[1])
+	}
+	if offset < zstdSkippableFrameHeaderSize || offset+length > desc.Size {
+		return 0, fmt.Errorf("zstd:chunked manifest position %q is out of layer size %d", position, desc.Size)
+	}
+
+	return offset - zstdSkippableFrameHeaderSize, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestZstdChunkedLayer(t *testing.T) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	content := []byte("hello zstd:chunked")
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(content)
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Close())
+
+	encoder, err := zstd.NewWriter(nil)
+	assert.Nil(t, err)
+	payload := encoder.EncodeAll(tarBuf.Bytes(), nil)
+
+	// Append the TOC in a zstd skippable frame like containers/storage.
+	toc := []byte(`{"version":1,"entries":[]}`)
+	var blob bytes.Buffer
+	blob.Write(payload)
+	frameHeader := make([]byte, zstdSkippableFrameHeaderSize)
+	binary.LittleEndian.PutUint32(frameHeader[0:4], 0x184D2A50)
+	binary.LittleEndian.PutUint32(frameHeader[4:8], uint32(len(toc)))
+	blob.Write(frameHeader)
+	blob.Write(toc)
+
+	desc := ocispec.Descriptor{
+		Size: int64(blob.Len()),
+		Annotations: map[string]string{
+			annotationZstdChunkedManifestChecksum: "sha256:checksum",
+			annotationZstdChunkedManifestPosition: fmt.Sprintf("%d:%d:%d:1", len(payload)+zstdSkippableFrameHeaderSize, len(toc), len(toc)),
+		},
+	}
+	assert.True(t, IsZstdChunkedLayer(desc))
+	assert.False(t, IsZstdChunkedLayer(ocispec.Descriptor{}))
+
+	payloadSize, err := zstdChunkedPayloadSize(desc)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(payload)), payloadSize)
+
+	dir, err := ioutil.TempDir("", "nydusify-zstdchunked-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, utils.UnpackTargz(context.Background(), dir, io.LimitReader(bytes.NewReader(blob.Bytes()), payloadSize)))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "hello.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+
+	desc.Annotations[annotationZstdChunkedManifestPosition] = "1:2"
+	_, err = zstdChunkedPayloadSize(desc)
+	assert.NotNil(t, err)
+	desc.Annotations[annotationZstdChunkedManifestPosition] = fmt.Sprintf("%d:%d:0:1", desc.Size, len(toc))
+	_, err = zstdChunkedPayloadSize(desc)
+	assert.NotNil(t, err)
+}
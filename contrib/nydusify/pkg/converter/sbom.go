@@ -0,0 +1,49 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/sbom"
+)
+
+// attachSBOM generates the SBOM of target image from the collected package
+// databases, then attaches it to the pushed Nydus manifest.
+func (cvt *Converter) attachSBOM(ctx context.Context, collector *sbom.Collector) error {
+	if missing := collector.Missing(); missing > 0 {
+		logrus.Warnf("SBOM may miss the packages in %d layers from cache or checkpoint", missing)
+	}
+
+	created := time.Now()
+	osRelease, packages := collector.Inventory()
+	data, err := sbom.Generate(cvt.sbomFormat, sbom.Document{
+		Image:       cvt.TargetRemote.Ref,
+		Digest:      cvt.manifestDesc.Digest,
+		Created:     created,
+		ToolVersion: cvt.NydusifyVersion,
+		OSRelease:   osRelease,
+		Packages:    packages,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Generate SBOM")
+	}
+
+	mediaType := cvt.sbomFormat.MediaType()
+	referrer, err := cvt.attachArtifact(ctx, mediaType, mediaType, data, map[string]string{
+		ocispec.AnnotationCreated: created.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Attached SBOM %s with %d packages to %s", referrer.Digest, len(packages), cvt.TargetRemote.Ref)
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package converter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tarsplit"
+)
+
+// checkTarSplit checks the original layers can be reconstructed, the layers
+// must be built as they are in source image.
+func (cvt *Converter) checkTarSplit(sp provider.SourceProvider) error {
+	if cvt.Flatten || cvt.WhiteoutStrategy == provider.StrategyResolve || cvt.HardlinkStrategy == provider.StrategyResolve {
+		return fmt.Errorf("tar-split can't be recorded for the flattened or resolved layers")
+	}
+	if !cvt.PathFilter.IsZero() {
+		return fmt.Errorf("tar-split can't be recorded for the filtered layers")
+	}
+	if _, ok := sp.(provider.RawSourceProvider); !ok {
+		return fmt.Errorf("tar-split isn't supported by source provider")
+	}
+	return nil
+}
+
+// attachTarSplit attaches the reconstruction data of source image to the
+// pushed Nydus manifest.
+func (cvt *Converter) attachTarSplit(ctx context.Context, sp provider.SourceProvider, collector *tarsplit.Collector) error {
+	if missing := collector.Missing(); missing > 0 {
+		logrus.Warnf("Skip attaching tar-split, it isn't recorded for %d layers from cache or checkpoint", missing)
+		return nil
+	}
+
+	rsp := sp.(provider.RawSourceProvider)
+	manifestDesc, err := sp.Manifest(ctx)
+	if err != nil {
+		return err
+	}
+	manifest, err := rsp.RawManifest(ctx)
+	if err != nil {
+		return err
+	}
+	config, err := rsp.RawConfig(ctx)
+	if err != nil {
+		return err
+	}
+	index, err := collector.Index(ocispec.Descriptor{
+		MediaType: manifestDesc.MediaType,
+		Digest:    manifestDesc.Digest,
+		Size:      manifestDesc.Size,
+	}, manifest, config)
+	if err != nil {
+		return err
+	}
+	data, err := tarsplit.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	referrer, err := cvt.attachArtifact(ctx, tarsplit.ArtifactType, tarsplit.MediaType, data, map[string]string{
+		ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Attached tar-split %s of %d layers to %s", referrer.Digest, len(index.Layers), cvt.TargetRemote.Ref)
+	return nil
+}
@@ -0,0 +1,247 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package copier copies converted image between registries without
+// converting it again, including the manifests, configs and all the blobs
+// referenced by bootstrap.
+package copier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+const defaultConcurrency = 5
+
+type Opt struct {
+	SourceRemote *remote.Remote
+	TargetRemote *remote.Remote
+	// Concurrency is the count of blobs copied in parallel.
+	Concurrency int
+}
+
+// Result is the statistics of copied blobs, the blobs skipped are those
+// already in target repository or mounted from source repository.
+type Result struct {
+	Manifests   int
+	Blobs       int
+	CopiedBlobs int
+	CopiedSize  int64
+}
+
+type manifest struct {
+	desc ocispec.Descriptor
+	data []byte
+}
+
+// image is the contents to copy, the manifests are in the order to push,
+// the manifest index is the last one.
+type image struct {
+	manifests []manifest
+	blobs     []ocispec.Descriptor
+}
+
+func pull(ctx context.Context, r *remote.Remote, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := r.Pull(ctx, desc, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pull %s", desc.Digest)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", desc.Digest)
+	}
+	return data, nil
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == images.MediaTypeDockerSchema2ManifestList
+}
+
+// collect walks the manifests of image, the blobs referenced by bootstrap
+// but not in manifest (e.g. the blobs of chunk dict) are resolved from
+// source repository, they are skipped if not found since they may be
+// stored in storage backend.
+func collect(ctx context.Context, source *remote.Remote) (*image, error) {
+	desc, err := source.Resolve(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve image %s", source.Ref)
+	}
+
+	img := &image{}
+	manifestDescs := []ocispec.Descriptor{*desc}
+	var index *manifest
+	if isIndex(desc.MediaType) {
+		data, err := pull(ctx, source, *desc)
+		if err != nil {
+			return nil, errors.Wrap(err, "get manifest index")
+		}
+		var parsed ocispec.Index
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return nil, errors.Wrap(err, "unmarshal manifest index")
+		}
+		manifestDescs = parsed.Manifests
+		index = &manifest{desc: *desc, data: data}
+	}
+
+	visited := map[digest.Digest]bool{}
+	addBlob := func(desc ocispec.Descriptor) {
+		if !visited[desc.Digest] {
+			visited[desc.Digest] = true
+			img.blobs = append(img.blobs, desc)
+		}
+	}
+	for _, desc := range manifestDescs {
+		data, err := pull(ctx, source, desc)
+		if err != nil {
+			return nil, errors.Wrap(err, "get manifest")
+		}
+		var parsed ocispec.Manifest
+		if err := json.Unmarshal(data, &parsed); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal manifest %s", desc.Digest)
+		}
+		img.manifests = append(img.manifests, manifest{desc: desc, data: data})
+
+		addBlob(parsed.Config)
+		blobIDs := []string{}
+		for _, layer := range parsed.Layers {
+			addBlob(layer)
+			if annotation, ok := layer.Annotations[utils.LayerAnnotationNydusBlobIDs]; ok {
+				if err := json.Unmarshal([]byte(annotation), &blobIDs); err != nil {
+					return nil, errors.Wrapf(err, "invalid annotation %s", utils.LayerAnnotationNydusBlobIDs)
+				}
+			}
+		}
+		for _, blobID := range blobIDs {
+			blobDigest := digest.NewDigestFromEncoded(digest.SHA256, blobID)
+			if visited[blobDigest] {
+				continue
+			}
+			blobRemote, err := source.WithDigest(blobDigest)
+			if err != nil {
+				return nil, err
+			}
+			blobDesc, err := blobRemote.Resolve(ctx)
+			if err != nil {
+				if errdefs.IsNotFound(errors.Cause(err)) {
+					logrus.Warnf("Skip blob %s not found in source repository, it may be stored in storage backend", blobID)
+					visited[blobDigest] = true
+					continue
+				}
+				return nil, errors.Wrapf(err, "resolve blob %s", blobID)
+			}
+			addBlob(ocispec.Descriptor{
+				MediaType: utils.MediaTypeNydusBlob,
+				Digest:    blobDigest,
+				Size:      blobDesc.Size,
+			})
+		}
+	}
+	if index != nil {
+		img.manifests = append(img.manifests, *index)
+	}
+
+	return img, nil
+}
+
+// lazyReader opens the source blob on first read, so the blob isn't pulled
+// if it exists in target or is mounted from source repository.
+type lazyReader struct {
+	ctx    context.Context
+	remote *remote.Remote
+	desc   ocispec.Descriptor
+	reader io.ReadCloser
+}
+
+func (r *lazyReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		reader, err := r.remote.Pull(r.ctx, r.desc, true)
+		if err != nil {
+			return 0, errors.Wrapf(err, "pull blob %s", r.desc.Digest)
+		}
+		r.reader = reader
+	}
+	return r.reader.Read(p)
+}
+
+func (r *lazyReader) Close() error {
+	if r.reader != nil {
+		return r.reader.Close()
+	}
+	return nil
+}
+
+// Copy copies the image from source to target, the blobs are copied in
+// parallel, then the manifests are pushed with the tag of target. The
+// registry mounts the blobs across repositories if they are in the same
+// registry.
+func Copy(ctx context.Context, opt Opt) (*Result, error) {
+	concurrency := opt.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	img, err := collect(ctx, opt.SourceRemote)
+	if err != nil {
+		return nil, err
+	}
+	opt.TargetRemote.AddMountSource(opt.SourceRemote)
+	logrus.Infof("Copying %d manifests and %d blobs from %s to %s",
+		len(img.manifests), len(img.blobs), opt.SourceRemote.Ref, opt.TargetRemote.Ref)
+
+	result := &Result{Manifests: len(img.manifests), Blobs: len(img.blobs)}
+	var mutex sync.Mutex
+	sem := make(chan struct{}, concurrency)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, desc := range img.blobs {
+		desc := desc
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			reader := &lazyReader{ctx: gctx, remote: opt.SourceRemote, desc: desc}
+			defer reader.Close()
+			if err := opt.TargetRemote.Push(gctx, desc, true, reader); err != nil {
+				return errors.Wrapf(err, "push blob %s", desc.Digest)
+			}
+			if reader.reader != nil {
+				mutex.Lock()
+				result.CopiedBlobs++
+				result.CopiedSize += desc.Size
+				mutex.Unlock()
+				logrus.Debugf("Copied blob %s (%d bytes)", desc.Digest, desc.Size)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	// The manifests in index are pushed by digest, the top level one is
+	// tagged.
+	for idx, manifest := range img.manifests {
+		byDigest := idx != len(img.manifests)-1
+		if err := opt.TargetRemote.Push(ctx, manifest.desc, byDigest, bytes.NewReader(manifest.data)); err != nil {
+			return nil, errors.Wrapf(err, "push manifest %s", manifest.desc.Digest)
+		}
+	}
+
+	return result, nil
+}
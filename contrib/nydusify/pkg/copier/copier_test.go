@@ -0,0 +1,90 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package copier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func push(t *testing.T, r *remote.Remote, mediaType string, data []byte, byDigest bool) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	assert.Nil(t, r.Push(context.Background(), desc, byDigest, bytes.NewReader(data)))
+	return desc
+}
+
+func TestCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-copier-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	source, err := remote.NewLayout("oci:" + filepath.Join(dir, "source") + ":v1")
+	assert.Nil(t, err)
+	target, err := remote.NewLayout("oci:" + filepath.Join(dir, "target") + ":v2")
+	assert.Nil(t, err)
+
+	// The blob of chunk dict is only referenced by bootstrap, the missing
+	// one is stored in storage backend.
+	dictBlob := push(t, source, utils.MediaTypeNydusBlob, []byte("dict blob"), true)
+	blob := push(t, source, utils.MediaTypeNydusBlob, []byte("blob"), true)
+	blobIDs, err := json.Marshal([]string{blob.Digest.Hex(), dictBlob.Digest.Hex(), digest.FromString("missing").Hex()})
+	assert.Nil(t, err)
+	bootstrap := push(t, source, ocispec.MediaTypeImageLayerGzip, []byte("bootstrap"), true)
+	bootstrap.Annotations = map[string]string{
+		utils.LayerAnnotationNydusBootstrap: "true",
+		utils.LayerAnnotationNydusBlobIDs:   string(blobIDs),
+	}
+	config := push(t, source, ocispec.MediaTypeImageConfig, []byte("{}"), true)
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{blob, bootstrap},
+	})
+	assert.Nil(t, err)
+	manifest := push(t, source, ocispec.MediaTypeImageManifest, manifestBytes, true)
+	manifest.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	indexBytes, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{manifest},
+	})
+	assert.Nil(t, err)
+	index := push(t, source, ocispec.MediaTypeImageIndex, indexBytes, false)
+
+	ctx := context.Background()
+	result, err := Copy(ctx, Opt{SourceRemote: source, TargetRemote: target})
+	assert.Nil(t, err)
+	assert.Equal(t, &Result{Manifests: 2, Blobs: 4, CopiedBlobs: 4, CopiedSize: 24}, result)
+
+	desc, err := target.Resolve(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, index.Digest, desc.Digest)
+	for _, desc := range []ocispec.Descriptor{manifest, config, blob, bootstrap, dictBlob} {
+		reader, err := target.Pull(ctx, desc, true)
+		assert.Nil(t, err)
+		reader.Close()
+	}
+
+	// The blobs in target are skipped.
+	result, err = Copy(ctx, Opt{SourceRemote: source, TargetRemote: target})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.CopiedBlobs)
+}
@@ -0,0 +1,568 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// The on-disk layout of RAFS v5 bootstrap, see `rafs/src/metadata/layout/v5.rs`.
+const (
+	rafsV5Magic          = 0x52414653
+	rafsV5Version        = 0x500
+	rafsV5SuperBlockSize = 8192
+	rafsV5InodeSize      = 128
+	rafsV5ChunkSize      = 80
+	rafsV5ExtBlobSize    = 64
+
+	rafsFlagCompressNone = 0x1
+	rafsFlagCompressLZ4  = 0x2
+	rafsFlagBlake3       = 0x4
+	rafsFlagCompressGzip = 0x40
+	rafsFlagCompressZstd = 0x80
+
+	rafsChunkFlagCompressed = 0x1
+
+	// RAFS v4 shares the magic of v5.
+	rafsV4Version = 0x400
+	// RAFS v6 is EROFS compatible, see `rafs/src/metadata/layout/v6.rs`.
+	erofsSuperOffset = 1024
+	erofsSuperMagic  = 0xE0F5E1E2
+
+	rafsInodeFlagXattr = 0x4
+)
+
+// Chunk is a data chunk referenced by the files in bootstrap.
+type Chunk struct {
+	// Digest is the hex digest of uncompressed chunk data prefixed with
+	// the digest algorithm, e.g. `sha256:<hex>`.
+	Digest string
+	// Blob is the ID of the blob that stores the chunk.
+	Blob string
+	// Index is the index of chunk in blob.
+	Index            uint32
+	CompressedOffset uint64
+	CompressedSize   uint32
+	UncompressedSize uint32
+	// FileOffset is the offset of chunk data in file.
+	FileOffset uint64
+	// Compressed is false if the chunk is stored as is.
+	Compressed bool
+}
+
+// File is an inode in the filesystem tree of bootstrap.
+type File struct {
+	// Path is the absolute path in filesystem, e.g. `/etc/os-release`.
+	Path string
+	// Ino is the inode number in source filesystem, the hardlinks have
+	// the same Ino.
+	Ino uint64
+	// Mode is the `st_mode` including file type.
+	Mode uint32
+	UID  uint32
+	GID  uint32
+	Size uint64
+	// Rdev is the device number of character and block device.
+	Rdev      uint32
+	Mtime     uint64
+	MtimeNsec uint32
+	// Symlink is the target of symlink.
+	Symlink string
+	Xattrs  map[string][]byte
+	Chunks  []Chunk
+}
+
+// ExtBlob is the blob information recorded in extended blob table.
+type ExtBlob struct {
+	ChunkCount     uint32
+	CompressedSize uint64
+}
+
+// Bootstrap is the blobs and chunks parsed from RAFS v5 bootstrap.
+type Bootstrap struct {
+	// Compressor is the compression algorithm of chunks, one of `none`,
+	// `lz4_block` and `gzip`.
+	Compressor string
+	Blobs      []string
+	// ExtBlobs is in the same order as Blobs, empty for the bootstrap
+	// built without extended blob table.
+	ExtBlobs []ExtBlob
+	Chunks   []Chunk
+	// PrefetchChunks are the chunks of files in prefetch table, including
+	// the files under prefetched directories.
+	PrefetchChunks []Chunk
+	// Files are in the order of walking the tree from root directory, the
+	// hardlinks are returned as separate files.
+	Files []File
+}
+
+// bootstrapInode is the inode information needed to walk the tree.
+type bootstrapInode struct {
+	name       string
+	ino        uint64
+	mode       uint32
+	uid        uint32
+	gid        uint32
+	size       uint64
+	rdev       uint32
+	mtime      uint64
+	mtimeNsec  uint32
+	symlink    string
+	xattrs     map[string][]byte
+	childIndex uint64
+	childCount uint64
+	chunks     []Chunk
+}
+
+func align8(size uint64) uint64 {
+	return (size + 7) &^ 7
+}
+
+type bootstrapReader struct {
+	data []byte
+}
+
+func (r *bootstrapReader) slice(offset, size uint64) ([]byte, error) {
+	if offset+size < offset || offset+size > uint64(len(r.data)) {
+		return nil, fmt.Errorf("range %d+%d exceeds bootstrap size %d", offset, size, len(r.data))
+	}
+	return r.data[offset : offset+size], nil
+}
+
+func (r *bootstrapReader) blobs(offset, size uint64) ([]string, error) {
+	// Each entry is `readahead_offset: u32 | readahead_size: u32 | blob_id | '\0'`,
+	// the last entry may be without the trailing '\0'.
+	data, err := r.slice(offset, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "read blob table")
+	}
+	blobs := []string{}
+	for len(data) > 8 {
+		data = data[8:]
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			end = len(data)
+		}
+		blobs = append(blobs, string(data[:end]))
+		if end == len(data) {
+			break
+		}
+		data = data[end+1:]
+	}
+	return blobs, nil
+}
+
+// ParseBootstrap parses the blobs and chunks of RAFS v5 bootstrap, the
+// chunks shared by multiple files are returned once.
+func ParseBootstrap(data []byte) (*Bootstrap, error) {
+	r := &bootstrapReader{data: data}
+	le := binary.LittleEndian
+
+	sb, err := r.slice(0, rafsV5SuperBlockSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "read super block")
+	}
+	superBlock, err := parseSuperBlock(sb)
+	if err != nil {
+		return nil, err
+	}
+	inodeTableOffset := le.Uint64(sb[32:40])
+	prefetchTableOffset := le.Uint64(sb[40:48])
+	blobTableOffset := le.Uint64(sb[48:56])
+	inodeTableEntries := uint64(le.Uint32(sb[56:60]))
+	prefetchTableEntries := uint64(le.Uint32(sb[60:64]))
+	blobTableSize := uint64(le.Uint32(sb[64:68]))
+	extBlobTableEntries := uint64(le.Uint32(sb[68:72]))
+	extBlobTableOffset := le.Uint64(sb[72:80])
+
+	algorithm := superBlock.DigestAlgorithm
+	blobs, err := r.blobs(blobTableOffset, blobTableSize)
+	if err != nil {
+		return nil, err
+	}
+
+	inodeTable, err := r.slice(inodeTableOffset, inodeTableEntries*4)
+	if err != nil {
+		return nil, errors.Wrap(err, "read inode table")
+	}
+
+	bootstrap := Bootstrap{Compressor: superBlock.Compressor, Blobs: blobs}
+	if extBlobTableEntries > 0 {
+		extBlobTable, err := r.slice(extBlobTableOffset, extBlobTableEntries*rafsV5ExtBlobSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "read extended blob table")
+		}
+		for ; len(extBlobTable) > 0; extBlobTable = extBlobTable[rafsV5ExtBlobSize:] {
+			bootstrap.ExtBlobs = append(bootstrap.ExtBlobs, ExtBlob{
+				ChunkCount:     le.Uint32(extBlobTable[0:4]),
+				CompressedSize: le.Uint64(extBlobTable[16:24]),
+			})
+		}
+		if len(bootstrap.ExtBlobs) < len(blobs) {
+			return nil, fmt.Errorf("extended blob table is shorter than blob table")
+		}
+	}
+
+	// Hardlinks share the same inode offset.
+	inodes := map[uint64]*bootstrapInode{}
+	inodesByIno := map[uint64]*bootstrapInode{}
+	visitedChunks := map[string]bool{}
+	for idx := uint64(0); idx < inodeTableEntries; idx++ {
+		offset := uint64(le.Uint32(inodeTable[idx*4:])) << 3
+		if offset == 0 {
+			continue
+		}
+		if info, ok := inodes[offset]; ok {
+			inodesByIno[idx+1] = info
+			continue
+		}
+
+		inode, err := r.slice(offset, rafsV5InodeSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read inode %d", idx+1)
+		}
+		mode := le.Uint32(inode[60:64])
+		nameSize := uint64(le.Uint16(inode[100:102]))
+		symlinkSize := uint64(le.Uint16(inode[102:104]))
+		// The inode is followed by name, symlink, xattrs and chunks.
+		names, err := r.slice(offset+rafsV5InodeSize, align8(nameSize)+symlinkSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read name of inode %d", idx+1)
+		}
+		info := &bootstrapInode{
+			name:       string(names[:nameSize]),
+			ino:        le.Uint64(inode[40:48]),
+			mode:       mode,
+			uid:        le.Uint32(inode[48:52]),
+			gid:        le.Uint32(inode[52:56]),
+			size:       le.Uint64(inode[64:72]),
+			rdev:       le.Uint32(inode[104:108]),
+			mtimeNsec:  le.Uint32(inode[108:112]),
+			mtime:      le.Uint64(inode[112:120]),
+			symlink:    string(names[align8(nameSize):]),
+			childIndex: uint64(le.Uint32(inode[92:96])),
+			childCount: uint64(le.Uint32(inode[96:100])),
+		}
+		inodes[offset] = info
+		inodesByIno[idx+1] = info
+
+		cur := offset + rafsV5InodeSize + align8(nameSize) + align8(symlinkSize)
+		if le.Uint64(inode[80:88])&rafsInodeFlagXattr != 0 {
+			header, err := r.slice(cur, 8)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read xattrs of inode %d", idx+1)
+			}
+			size := le.Uint64(header)
+			table, err := r.slice(cur+8, size)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read xattrs of inode %d", idx+1)
+			}
+			if info.xattrs, err = parseXattrs(table); err != nil {
+				return nil, errors.Wrapf(err, "parse xattrs of inode %d", idx+1)
+			}
+			cur += 8 + align8(size)
+		}
+		if mode&syscall.S_IFMT != syscall.S_IFREG {
+			continue
+		}
+		chunkCount := uint64(le.Uint32(inode[96:100]))
+
+		chunks, err := r.slice(cur, chunkCount*rafsV5ChunkSize)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read chunks of inode %d", idx+1)
+		}
+		for ; len(chunks) > 0; chunks = chunks[rafsV5ChunkSize:] {
+			dgst := algorithm + ":" + hex.EncodeToString(chunks[0:32])
+			blobIndex := le.Uint32(chunks[32:36])
+			if int(blobIndex) >= len(blobs) {
+				return nil, fmt.Errorf("invalid blob index %d of chunk %s", blobIndex, dgst)
+			}
+			chunk := Chunk{
+				Digest:           dgst,
+				Blob:             blobs[blobIndex],
+				Index:            le.Uint32(chunks[72:76]),
+				CompressedOffset: le.Uint64(chunks[48:56]),
+				CompressedSize:   le.Uint32(chunks[40:44]),
+				UncompressedSize: le.Uint32(chunks[44:48]),
+				FileOffset:       le.Uint64(chunks[64:72]),
+				Compressed:       le.Uint32(chunks[36:40])&rafsChunkFlagCompressed != 0,
+			}
+			info.chunks = append(info.chunks, chunk)
+			if visitedChunks[dgst] {
+				continue
+			}
+			visitedChunks[dgst] = true
+			bootstrap.Chunks = append(bootstrap.Chunks, chunk)
+		}
+	}
+
+	if prefetchTableEntries > 0 {
+		prefetchTable, err := r.slice(prefetchTableOffset, prefetchTableEntries*4)
+		if err != nil {
+			return nil, errors.Wrap(err, "read prefetch table")
+		}
+		bootstrap.PrefetchChunks = prefetchChunks(inodesByIno, prefetchTable)
+	}
+	bootstrap.Files = walkFiles(inodesByIno)
+
+	return &bootstrap, nil
+}
+
+// parseXattrs parses the xattr pairs, each pair is `<size: u32><name>\0<value>`.
+func parseXattrs(table []byte) (map[string][]byte, error) {
+	xattrs := map[string][]byte{}
+	for len(table) > 0 {
+		if len(table) < 4 {
+			return nil, fmt.Errorf("invalid xattr pair")
+		}
+		size := uint64(binary.LittleEndian.Uint32(table[0:4]))
+		if uint64(len(table)-4) < size {
+			return nil, fmt.Errorf("invalid xattr pair size %d", size)
+		}
+		pair := table[4 : 4+size]
+		table = table[4+size:]
+		sep := bytes.IndexByte(pair, 0)
+		if sep < 0 {
+			return nil, fmt.Errorf("invalid xattr pair without name")
+		}
+		xattrs[string(pair[:sep])] = append([]byte{}, pair[sep+1:]...)
+	}
+	return xattrs, nil
+}
+
+// walkFiles walks the tree from root inode 1, the children of directory
+// are the inodes in `[childIndex, childIndex+childCount)`.
+func walkFiles(inodes map[uint64]*bootstrapInode) []File {
+	files := []File{}
+	visitedDirs := map[*bootstrapInode]bool{}
+	var walk func(ino uint64, filePath string)
+	walk = func(ino uint64, filePath string) {
+		info, ok := inodes[ino]
+		if !ok {
+			return
+		}
+		files = append(files, File{
+			Path:      filePath,
+			Ino:       info.ino,
+			Mode:      info.mode,
+			UID:       info.uid,
+			GID:       info.gid,
+			Size:      info.size,
+			Rdev:      info.rdev,
+			Mtime:     info.mtime,
+			MtimeNsec: info.mtimeNsec,
+			Symlink:   info.symlink,
+			Xattrs:    info.xattrs,
+			Chunks:    info.chunks,
+		})
+		if info.mode&syscall.S_IFMT != syscall.S_IFDIR || visitedDirs[info] {
+			return
+		}
+		visitedDirs[info] = true
+		for child := info.childIndex; child < info.childIndex+info.childCount; child++ {
+			if childInfo, ok := inodes[child]; ok {
+				walk(child, path.Join(filePath, childInfo.name))
+			}
+		}
+	}
+	walk(1, "/")
+	return files
+}
+
+// prefetchChunks collects the chunks of inodes in prefetch table, the
+// children of directory are the inodes in `[childIndex, childIndex+childCount)`.
+func prefetchChunks(inodes map[uint64]*bootstrapInode, prefetchTable []byte) []Chunk {
+	chunks := []Chunk{}
+	visitedInodes := map[*bootstrapInode]bool{}
+	visitedChunks := map[string]bool{}
+	var walk func(ino uint64)
+	walk = func(ino uint64) {
+		info, ok := inodes[ino]
+		if !ok || visitedInodes[info] {
+			return
+		}
+		visitedInodes[info] = true
+		if info.mode&syscall.S_IFMT == syscall.S_IFDIR {
+			for child := info.childIndex; child < info.childIndex+info.childCount; child++ {
+				walk(child)
+			}
+			return
+		}
+		for _, chunk := range info.chunks {
+			key := fmt.Sprintf("%s/%d", chunk.Blob, chunk.Index)
+			if visitedChunks[key] {
+				continue
+			}
+			visitedChunks[key] = true
+			chunks = append(chunks, chunk)
+		}
+	}
+	for ; len(prefetchTable) >= 4; prefetchTable = prefetchTable[4:] {
+		// The table is padded by zero.
+		if ino := uint64(binary.LittleEndian.Uint32(prefetchTable)); ino != 0 {
+			walk(ino)
+		}
+	}
+	return chunks
+}
+
+// SuperBlock is the format parameters in the super block of bootstrap.
+type SuperBlock struct {
+	// Compressor is the compression algorithm of chunks.
+	Compressor string
+	// DigestAlgorithm is the digest algorithm of chunks, `sha256` or
+	// `blake3`.
+	DigestAlgorithm string
+	// ChunkSize is the maximum uncompressed size of chunks.
+	ChunkSize uint32
+}
+
+func parseSuperBlock(sb []byte) (*SuperBlock, error) {
+	le := binary.LittleEndian
+	if len(sb) < rafsV5SuperBlockSize || le.Uint32(sb[0:4]) != rafsV5Magic || le.Uint32(sb[4:8]) != rafsV5Version {
+		return nil, fmt.Errorf("unsupported bootstrap, only RAFS v5 is supported")
+	}
+	flags := le.Uint64(sb[16:24])
+
+	superBlock := &SuperBlock{
+		Compressor:      "none",
+		DigestAlgorithm: "sha256",
+		ChunkSize:       le.Uint32(sb[12:16]),
+	}
+	if flags&rafsFlagBlake3 != 0 {
+		superBlock.DigestAlgorithm = "blake3"
+	}
+	switch {
+	case flags&rafsFlagCompressLZ4 != 0:
+		superBlock.Compressor = "lz4_block"
+	case flags&rafsFlagCompressGzip != 0:
+		superBlock.Compressor = "gzip"
+	case flags&rafsFlagCompressZstd != 0:
+		superBlock.Compressor = "zstd"
+	}
+	return superBlock, nil
+}
+
+// FsVersion returns the RAFS version of bootstrap from its super block,
+// e.g. `5` for RAFS v5.
+func FsVersion(sb []byte) (string, error) {
+	le := binary.LittleEndian
+	if len(sb) >= 8 && le.Uint32(sb[0:4]) == rafsV5Magic {
+		switch le.Uint32(sb[4:8]) {
+		case rafsV4Version:
+			return "4", nil
+		case rafsV5Version:
+			return "5", nil
+		}
+	}
+	if len(sb) >= erofsSuperOffset+4 && le.Uint32(sb[erofsSuperOffset:]) == erofsSuperMagic {
+		return "6", nil
+	}
+	return "", fmt.Errorf("unknown bootstrap format")
+}
+
+// ReadFsVersion reads the RAFS version of bootstrap file.
+func ReadFsVersion(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "open bootstrap")
+	}
+	defer file.Close()
+
+	sb := make([]byte, erofsSuperOffset+4)
+	n, err := io.ReadFull(file, sb)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", errors.Wrap(err, "read super block")
+	}
+	return FsVersion(sb[:n])
+}
+
+// ReadSuperBlock reads the super block of RAFS v5 bootstrap file without
+// parsing the whole bootstrap.
+func ReadSuperBlock(path string) (*SuperBlock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open bootstrap")
+	}
+	defer file.Close()
+
+	sb := make([]byte, rafsV5SuperBlockSize)
+	if _, err := io.ReadFull(file, sb); err != nil {
+		return nil, errors.Wrap(err, "read super block")
+	}
+	return parseSuperBlock(sb)
+}
+
+// ParseBootstrapFile parses the RAFS v5 bootstrap file.
+func ParseBootstrapFile(path string) (*Bootstrap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read bootstrap")
+	}
+	return ParseBootstrap(data)
+}
+
+// PullBootstrap pulls the bootstrap layer of Nydus image and parses the
+// bootstrap, which is unpacked to a temporary file in workDir.
+func PullBootstrap(ctx context.Context, p *parser.Parser, image *parser.Image, workDir string) (*Bootstrap, error) {
+	// The images converted before the version is annotated are detected by
+	// parsing.
+	if version := parser.FsVersion(&image.Manifest); version != "" && version != "5" {
+		return nil, fmt.Errorf("unsupported RAFS v%s bootstrap, only RAFS v5 is supported", version)
+	}
+
+	bootstrapFile, err := ioutil.TempFile(workDir, ".nydus-bootstrap-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create bootstrap file")
+	}
+	bootstrapFile.Close()
+	defer os.Remove(bootstrapFile.Name())
+
+	reader, err := p.PullNydusBootstrap(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, bootstrapFile.Name()); err != nil {
+		return nil, errors.Wrap(err, "unpack Nydus bootstrap layer")
+	}
+	bootstrap, err := ParseBootstrapFile(bootstrapFile.Name())
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Nydus bootstrap")
+	}
+	return bootstrap, nil
+}
+
+// PullImageBootstrap parses the Nydus image of expected architecture, and
+// pulls its bootstrap.
+func PullImageBootstrap(ctx context.Context, remote *remote.Remote, expectedArch string) (*Bootstrap, error) {
+	p, err := parser.New(remote, expectedArch)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := p.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse Nydus image %s", remote.Ref)
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("not found Nydus image of %s", remote.Ref)
+	}
+	return PullBootstrap(ctx, p, parsed.NydusImage, "")
+}
@@ -0,0 +1,348 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dedup implements a persistent chunk deduplication database shared
+// by conversions of different images. The bootstraps of converted images are
+// recorded in the database, and one of them is provided to the builder as
+// chunk dict, so that the chunks existed in the blobs of other images (even
+// in different repositories) are referenced instead of being uploaded again.
+package dedup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Image reference -> JSON of `Image`.
+	bucketImages = []byte("images")
+	// Bootstrap digest -> bootstrap data.
+	bucketBootstraps = []byte("bootstraps")
+	// Chunk digest -> ID of blob that stores the chunk.
+	bucketChunks = []byte("chunks")
+)
+
+// Image is the record of converted Nydus image in database.
+type Image struct {
+	Reference string `json:"reference"`
+	// The digests of source layers, used to find the most similar image
+	// as chunk dict.
+	SourceLayers []string  `json:"source_layers"`
+	Bootstrap    string    `json:"bootstrap"`
+	Blobs        []string  `json:"blobs"`
+	Chunks       int       `json:"chunks"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Stat is the statistics of database.
+type Stat struct {
+	Images []Image `json:"images"`
+	// The number of unique chunks in all images.
+	Chunks int `json:"chunks"`
+	// The number of blobs that store the unique chunks.
+	Blobs int `json:"blobs"`
+	// The number of chunks referenced by images, the chunks shared by
+	// images are counted multiple times.
+	ReferencedChunks int `json:"referenced_chunks"`
+}
+
+// DB is the chunk deduplication database backed by bbolt.
+type DB struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database file, the file is locked until the
+// database is closed.
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 30 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open dedup database %s", path)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketImages, bucketBootstraps, bucketChunks} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "create buckets")
+	}
+	return &DB{db: db}, nil
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+func getImage(tx *bolt.Tx, ref string) (*Image, error) {
+	data := tx.Bucket(bucketImages).Get([]byte(ref))
+	if data == nil {
+		return nil, nil
+	}
+	var image Image
+	if err := json.Unmarshal(data, &image); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal image record %s", ref)
+	}
+	return &image, nil
+}
+
+func listImages(tx *bolt.Tx) ([]Image, error) {
+	images := []Image{}
+	err := tx.Bucket(bucketImages).ForEach(func(k, v []byte) error {
+		var image Image
+		if err := json.Unmarshal(v, &image); err != nil {
+			return errors.Wrapf(err, "unmarshal image record %s", k)
+		}
+		images = append(images, image)
+		return nil
+	})
+	return images, err
+}
+
+// removeBootstrap deletes the bootstrap if it isn't referenced by other images.
+func removeBootstrap(tx *bolt.Tx, dgst string, except string) error {
+	images, err := listImages(tx)
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		if image.Reference != except && image.Bootstrap == dgst {
+			return nil
+		}
+	}
+	return tx.Bucket(bucketBootstraps).Delete([]byte(dgst))
+}
+
+// Add records the bootstrap of converted image, and indexes its chunks. The
+// previous record of the same image reference is replaced.
+func (d *DB) Add(ref string, sourceLayers []string, bootstrapPath string) error {
+	data, err := ioutil.ReadFile(bootstrapPath)
+	if err != nil {
+		return errors.Wrap(err, "read bootstrap")
+	}
+	bootstrap, err := ParseBootstrap(data)
+	if err != nil {
+		return errors.Wrap(err, "parse bootstrap")
+	}
+
+	image := Image{
+		Reference:    ref,
+		SourceLayers: sourceLayers,
+		Bootstrap:    digest.FromBytes(data).String(),
+		Blobs:        bootstrap.Blobs,
+		Chunks:       len(bootstrap.Chunks),
+		UpdatedAt:    time.Now(),
+	}
+	record, err := json.Marshal(image)
+	if err != nil {
+		return errors.Wrap(err, "marshal image record")
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		previous, err := getImage(tx, ref)
+		if err != nil {
+			return err
+		}
+		if previous != nil && previous.Bootstrap != image.Bootstrap {
+			if err := removeBootstrap(tx, previous.Bootstrap, ref); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(bucketBootstraps).Put([]byte(image.Bootstrap), data); err != nil {
+			return err
+		}
+		if err := tx.Bucket(bucketImages).Put([]byte(ref), record); err != nil {
+			return err
+		}
+		// The chunk is kept in the blob that stores it first.
+		chunks := tx.Bucket(bucketChunks)
+		for _, chunk := range bootstrap.Chunks {
+			if chunks.Get([]byte(chunk.Digest)) == nil {
+				if err := chunks.Put([]byte(chunk.Digest), []byte(chunk.Blob)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes the record of image, its chunks are dropped from index
+// by Compact.
+func (d *DB) Remove(ref string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		image, err := getImage(tx, ref)
+		if err != nil {
+			return err
+		}
+		if image == nil {
+			return fmt.Errorf("image %s not found in dedup database", ref)
+		}
+		if err := removeBootstrap(tx, image.Bootstrap, ref); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketImages).Delete([]byte(ref))
+	})
+}
+
+// Dict selects the recorded image as chunk dict for converting the source
+// image with the layers, the image sharing the most source layers is
+// preferred, then the image with the most chunks. It returns nil if the
+// database is empty.
+func (d *DB) Dict(sourceLayers []string) (*Image, []byte, error) {
+	var (
+		image *Image
+		data  []byte
+	)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		images, err := listImages(tx)
+		if err != nil {
+			return err
+		}
+		layers := map[string]bool{}
+		for _, layer := range sourceLayers {
+			layers[layer] = true
+		}
+		score := func(image *Image) int {
+			shared := 0
+			for _, layer := range image.SourceLayers {
+				if layers[layer] {
+					shared++
+				}
+			}
+			return shared
+		}
+		for idx := range images {
+			candidate := &images[idx]
+			if image == nil || score(candidate) > score(image) ||
+				(score(candidate) == score(image) && candidate.Chunks > image.Chunks) {
+				image = candidate
+			}
+		}
+		if image == nil {
+			return nil
+		}
+		bootstrap := tx.Bucket(bucketBootstraps).Get([]byte(image.Bootstrap))
+		if bootstrap == nil {
+			return fmt.Errorf("bootstrap %s of image %s not found", image.Bootstrap, image.Reference)
+		}
+		// The data is only valid in transaction.
+		data = append([]byte{}, bootstrap...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "select chunk dict")
+	}
+	return image, data, nil
+}
+
+// Stat returns the images recorded in database and the statistics of
+// chunk index.
+func (d *DB) Stat() (*Stat, error) {
+	var stat Stat
+	err := d.db.View(func(tx *bolt.Tx) error {
+		images, err := listImages(tx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(images, func(i, j int) bool {
+			return images[i].Reference < images[j].Reference
+		})
+		stat.Images = images
+		for _, image := range images {
+			stat.ReferencedChunks += image.Chunks
+		}
+		blobs := map[string]bool{}
+		if err := tx.Bucket(bucketChunks).ForEach(func(k, v []byte) error {
+			stat.Chunks++
+			blobs[string(v)] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		stat.Blobs = len(blobs)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "stat dedup database")
+	}
+	return &stat, nil
+}
+
+// Compact rewrites the database to reclaim the space of removed records,
+// the chunk index is rebuilt from the bootstraps of recorded images.
+func Compact(path string) error {
+	src, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	err = src.db.View(func(srcTx *bolt.Tx) error {
+		images, err := listImages(srcTx)
+		if err != nil {
+			return err
+		}
+		// Rebuild in the order of conversion, so that the chunks are kept
+		// in the same blobs as before.
+		sort.Slice(images, func(i, j int) bool {
+			return images[i].UpdatedAt.Before(images[j].UpdatedAt)
+		})
+		return dst.db.Update(func(dstTx *bolt.Tx) error {
+			chunks := dstTx.Bucket(bucketChunks)
+			for _, image := range images {
+				data := srcTx.Bucket(bucketBootstraps).Get([]byte(image.Bootstrap))
+				if data == nil {
+					return fmt.Errorf("bootstrap %s of image %s not found", image.Bootstrap, image.Reference)
+				}
+				bootstrap, err := ParseBootstrap(data)
+				if err != nil {
+					return errors.Wrapf(err, "parse bootstrap of image %s", image.Reference)
+				}
+				for _, chunk := range bootstrap.Chunks {
+					if chunks.Get([]byte(chunk.Digest)) == nil {
+						if err := chunks.Put([]byte(chunk.Digest), []byte(chunk.Blob)); err != nil {
+							return err
+						}
+					}
+				}
+				if err := dstTx.Bucket(bucketBootstraps).Put([]byte(image.Bootstrap), data); err != nil {
+					return err
+				}
+				record := srcTx.Bucket(bucketImages).Get([]byte(image.Reference))
+				if err := dstTx.Bucket(bucketImages).Put([]byte(image.Reference), record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "compact dedup database")
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,277 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dedup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testFile struct {
+	mode   uint32
+	name   string
+	xattr  []byte
+	chunks []testChunk
+	// The children of directory are the inodes starting from childIndex.
+	childIndex uint32
+	childCount uint32
+}
+
+type testChunk struct {
+	data      byte
+	blobIndex uint32
+}
+
+func padding(buf *bytes.Buffer) {
+	for buf.Len()%8 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// makeTestBootstrap writes RAFS v5 bootstrap with the files, the inode
+// table points the last entry to the first file as hardlink, the inodes in
+// prefetch are written to prefetch table.
+func makeTestBootstrap(t *testing.T, blobs []string, files []testFile, prefetch ...uint32) []byte {
+	le := binary.LittleEndian
+	inodeTableOffset := uint64(rafsV5SuperBlockSize)
+	inodeTableSize := align8(uint64(len(files)+1) * 4)
+
+	var blobTable bytes.Buffer
+	for idx, blob := range blobs {
+		blobTable.Write(make([]byte, 8))
+		blobTable.WriteString(blob)
+		if idx != len(blobs)-1 {
+			blobTable.WriteByte(0)
+		}
+	}
+	blobTableOffset := inodeTableOffset + inodeTableSize
+	blobTableSize := uint64(blobTable.Len())
+	padding(&blobTable)
+
+	var inodes bytes.Buffer
+	offsets := []uint32{}
+	chunkCounts := make([]uint32, len(blobs))
+	for _, file := range files {
+		offsets = append(offsets, uint32((blobTableOffset+uint64(blobTable.Len())+uint64(inodes.Len()))>>3))
+		inode := make([]byte, rafsV5InodeSize)
+		le.PutUint32(inode[60:], file.mode)
+		if file.xattr != nil {
+			le.PutUint64(inode[80:], rafsInodeFlagXattr)
+		}
+		le.PutUint32(inode[92:], file.childIndex)
+		le.PutUint32(inode[96:], uint32(len(file.chunks))+file.childCount)
+		le.PutUint16(inode[100:], uint16(len(file.name)))
+		inodes.Write(inode)
+		inodes.WriteString(file.name)
+		padding(&inodes)
+		if file.xattr != nil {
+			header := make([]byte, 8)
+			le.PutUint64(header, uint64(len(file.xattr)))
+			inodes.Write(header)
+			inodes.Write(file.xattr)
+			padding(&inodes)
+		}
+		for _, chunk := range file.chunks {
+			info := make([]byte, rafsV5ChunkSize)
+			info[0] = chunk.data
+			le.PutUint32(info[32:], chunk.blobIndex)
+			le.PutUint32(info[40:], 100)
+			le.PutUint64(info[48:], uint64(chunkCounts[chunk.blobIndex])*100)
+			le.PutUint32(info[72:], chunkCounts[chunk.blobIndex])
+			chunkCounts[chunk.blobIndex]++
+			inodes.Write(info)
+		}
+	}
+	offsets = append(offsets, offsets[0])
+
+	extBlobTableOffset := blobTableOffset + uint64(blobTable.Len()) + uint64(inodes.Len())
+	var extBlobTable bytes.Buffer
+	for _, count := range chunkCounts {
+		entry := make([]byte, rafsV5ExtBlobSize)
+		le.PutUint32(entry[0:], count)
+		le.PutUint64(entry[16:], uint64(count)*100)
+		extBlobTable.Write(entry)
+	}
+	prefetchTableOffset := extBlobTableOffset + uint64(extBlobTable.Len())
+	prefetchTable := make([]byte, align8(uint64(len(prefetch))*4))
+	for idx, ino := range prefetch {
+		le.PutUint32(prefetchTable[idx*4:], ino)
+	}
+
+	sb := make([]byte, rafsV5SuperBlockSize)
+	le.PutUint32(sb[0:], rafsV5Magic)
+	le.PutUint32(sb[4:], rafsV5Version)
+	le.PutUint32(sb[12:], 0x100000)
+	le.PutUint64(sb[16:], rafsFlagCompressLZ4)
+	le.PutUint64(sb[32:], inodeTableOffset)
+	le.PutUint64(sb[40:], prefetchTableOffset)
+	le.PutUint64(sb[48:], blobTableOffset)
+	le.PutUint32(sb[56:], uint32(len(offsets)))
+	le.PutUint32(sb[60:], uint32(len(prefetchTable)/4))
+	le.PutUint32(sb[64:], uint32(blobTableSize))
+	le.PutUint32(sb[68:], uint32(len(blobs)))
+	le.PutUint64(sb[72:], extBlobTableOffset)
+
+	inodeTable := make([]byte, inodeTableSize)
+	for idx, offset := range offsets {
+		le.PutUint32(inodeTable[idx*4:], offset)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(sb)
+	buf.Write(inodeTable)
+	buf.Write(blobTable.Bytes())
+	buf.Write(inodes.Bytes())
+	buf.Write(extBlobTable.Bytes())
+	buf.Write(prefetchTable)
+	return buf.Bytes()
+}
+
+func TestParseBootstrap(t *testing.T) {
+	data := makeTestBootstrap(t, []string{"blob-a", "blob-b"}, []testFile{
+		{mode: syscall.S_IFREG | 0644, name: "a", xattr: []byte("\x0e\x00\x00\x00user.key\x00value"), chunks: []testChunk{{1, 0}, {2, 1}}},
+		{mode: syscall.S_IFDIR | 0755, name: "dir", childIndex: 3, childCount: 1},
+		{mode: syscall.S_IFREG | 0644, name: "b", chunks: []testChunk{{2, 1}, {3, 1}}},
+	}, 2)
+
+	bootstrap, err := ParseBootstrap(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"blob-a", "blob-b"}, bootstrap.Blobs)
+	assert.Len(t, bootstrap.Chunks, 3)
+	assert.Equal(t, "blob-a", bootstrap.Chunks[0].Blob)
+	assert.Equal(t, "blob-b", bootstrap.Chunks[2].Blob)
+	assert.Equal(t, uint32(100), bootstrap.Chunks[2].CompressedSize)
+	assert.Equal(t, "sha256:03", bootstrap.Chunks[2].Digest[:9])
+	assert.Equal(t, []ExtBlob{{ChunkCount: 1, CompressedSize: 100}, {ChunkCount: 3, CompressedSize: 300}}, bootstrap.ExtBlobs)
+	// The file under prefetched directory.
+	assert.Len(t, bootstrap.PrefetchChunks, 2)
+	assert.Equal(t, "blob-b", bootstrap.PrefetchChunks[1].Blob)
+	assert.Equal(t, uint32(2), bootstrap.PrefetchChunks[1].Index)
+	assert.Equal(t, uint64(200), bootstrap.PrefetchChunks[1].CompressedOffset)
+	assert.Equal(t, map[string][]byte{"user.key": []byte("value")}, bootstrap.Files[0].Xattrs)
+	assert.Equal(t, "lz4_block", bootstrap.Compressor)
+
+	dir, err := ioutil.TempDir("", "nydusify-dedup-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	bootstrapPath := filepath.Join(dir, "bootstrap")
+	assert.Nil(t, ioutil.WriteFile(bootstrapPath, data, 0644))
+	superBlock, err := ReadSuperBlock(bootstrapPath)
+	assert.Nil(t, err)
+	assert.Equal(t, &SuperBlock{Compressor: "lz4_block", DigestAlgorithm: "sha256", ChunkSize: 0x100000}, superBlock)
+	assert.Nil(t, ioutil.WriteFile(bootstrapPath, data[:100], 0644))
+	_, err = ReadSuperBlock(bootstrapPath)
+	assert.NotNil(t, err)
+
+	_, err = ParseBootstrap(data[:len(data)-1])
+	assert.NotNil(t, err)
+	_, err = ParseBootstrap(make([]byte, rafsV5SuperBlockSize))
+	assert.NotNil(t, err)
+}
+
+func TestFsVersion(t *testing.T) {
+	data := makeTestBootstrap(t, []string{"blob-a"}, []testFile{
+		{mode: syscall.S_IFDIR | 0755, name: "/"},
+	})
+	version, err := FsVersion(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "5", version)
+
+	v6 := make([]byte, 2048)
+	binary.LittleEndian.PutUint32(v6[erofsSuperOffset:], erofsSuperMagic)
+	version, err = FsVersion(v6)
+	assert.Nil(t, err)
+	assert.Equal(t, "6", version)
+
+	_, err = FsVersion(make([]byte, 2048))
+	assert.NotNil(t, err)
+	_, err = FsVersion(nil)
+	assert.NotNil(t, err)
+}
+
+func TestParseBootstrapFiles(t *testing.T) {
+	data := makeTestBootstrap(t, []string{"blob-a"}, []testFile{
+		{mode: syscall.S_IFDIR | 0755, name: "/", childIndex: 2, childCount: 2},
+		{mode: syscall.S_IFREG | 0644, name: "a", chunks: []testChunk{{1, 0}, {2, 0}}},
+		{mode: syscall.S_IFDIR | 0755, name: "etc", childIndex: 4, childCount: 1},
+		{mode: syscall.S_IFREG | 0644, name: "os-release", chunks: []testChunk{{3, 0}}},
+	})
+
+	bootstrap, err := ParseBootstrap(data)
+	assert.Nil(t, err)
+	paths := []string{}
+	for _, file := range bootstrap.Files {
+		paths = append(paths, file.Path)
+	}
+	assert.Equal(t, []string{"/", "/a", "/etc", "/etc/os-release"}, paths)
+	assert.Equal(t, uint32(syscall.S_IFDIR|0755), bootstrap.Files[2].Mode)
+	assert.Len(t, bootstrap.Files[1].Chunks, 2)
+	assert.Equal(t, uint32(2), bootstrap.Files[3].Chunks[0].Index)
+}
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-dedup-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	bootstrapA := filepath.Join(dir, "a.boot")
+	assert.Nil(t, ioutil.WriteFile(bootstrapA, makeTestBootstrap(t, []string{"blob-a"}, []testFile{
+		{mode: syscall.S_IFREG | 0644, name: "a", chunks: []testChunk{{1, 0}, {2, 0}}},
+	}), 0644))
+	bootstrapB := filepath.Join(dir, "b.boot")
+	assert.Nil(t, ioutil.WriteFile(bootstrapB, makeTestBootstrap(t, []string{"blob-a", "blob-b"}, []testFile{
+		{mode: syscall.S_IFREG | 0644, name: "b", chunks: []testChunk{{1, 0}, {3, 1}, {4, 1}}},
+	}), 0644))
+
+	dbPath := filepath.Join(dir, "dedup.db")
+	db, err := Open(dbPath)
+	assert.Nil(t, err)
+
+	image, _, err := db.Dict(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, image)
+
+	assert.Nil(t, db.Add("registry/a:latest", []string{"layer-1"}, bootstrapA))
+	assert.Nil(t, db.Add("registry/b:latest", []string{"layer-2"}, bootstrapB))
+
+	// Prefer the image sharing source layers.
+	image, data, err := db.Dict([]string{"layer-1", "layer-3"})
+	assert.Nil(t, err)
+	assert.Equal(t, "registry/a:latest", image.Reference)
+	expected, _ := ioutil.ReadFile(bootstrapA)
+	assert.Equal(t, expected, data)
+	// Otherwise the image with the most chunks.
+	image, _, err = db.Dict([]string{"layer-3"})
+	assert.Nil(t, err)
+	assert.Equal(t, "registry/b:latest", image.Reference)
+
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Len(t, stat.Images, 2)
+	assert.Equal(t, 4, stat.Chunks)
+	assert.Equal(t, 2, stat.Blobs)
+	assert.Equal(t, 5, stat.ReferencedChunks)
+
+	assert.Nil(t, db.Remove("registry/a:latest"))
+	assert.NotNil(t, db.Remove("registry/a:latest"))
+	assert.Nil(t, db.Close())
+
+	assert.Nil(t, Compact(dbPath))
+	db, err = Open(dbPath)
+	assert.Nil(t, err)
+	defer db.Close()
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Len(t, stat.Images, 1)
+	assert.Equal(t, 3, stat.Chunks)
+	assert.Equal(t, 2, stat.Blobs)
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package diff compares the filesystem trees and chunks of two Nydus images,
+// to quantify the chunks shared between image versions.
+package diff
+
+import (
+	"sort"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+// Change is a file added, removed or changed in the new image.
+type Change struct {
+	Path string `json:"path"`
+	// Kind is one of `added`, `removed` and `changed`.
+	Kind string `json:"kind"`
+	// Size is the file size in new image, or in old image if removed.
+	Size uint64 `json:"size"`
+}
+
+// Result is the file changes and chunk statistics of the new image
+// compared with the old image.
+type Result struct {
+	Changes []Change `json:"changes"`
+	// The unique chunks of new image, and those existed in old image.
+	Chunks       int   `json:"chunks"`
+	SharedChunks int   `json:"shared_chunks"`
+	Size         int64 `json:"size"`
+	SharedSize   int64 `json:"shared_size"`
+}
+
+func sameFile(a, b *dedup.File) bool {
+	if a.Mode != b.Mode || a.UID != b.UID || a.GID != b.GID ||
+		a.Size != b.Size || a.Symlink != b.Symlink || len(a.Chunks) != len(b.Chunks) {
+		return false
+	}
+	for idx := range a.Chunks {
+		if a.Chunks[idx].Digest != b.Chunks[idx].Digest {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff compares the files and chunks of two bootstraps, the chunks are
+// matched by digest, wherever they are stored. The sizes are the compressed
+// sizes of chunks.
+func Diff(oldBootstrap, newBootstrap *dedup.Bootstrap) *Result {
+	result := &Result{Changes: []Change{}}
+
+	oldFiles := map[string]*dedup.File{}
+	for idx := range oldBootstrap.Files {
+		oldFiles[oldBootstrap.Files[idx].Path] = &oldBootstrap.Files[idx]
+	}
+	for idx := range newBootstrap.Files {
+		file := &newBootstrap.Files[idx]
+		oldFile, ok := oldFiles[file.Path]
+		if !ok {
+			result.Changes = append(result.Changes, Change{Path: file.Path, Kind: "added", Size: file.Size})
+			continue
+		}
+		delete(oldFiles, file.Path)
+		if !sameFile(oldFile, file) {
+			result.Changes = append(result.Changes, Change{Path: file.Path, Kind: "changed", Size: file.Size})
+		}
+	}
+	for _, file := range oldFiles {
+		result.Changes = append(result.Changes, Change{Path: file.Path, Kind: "removed", Size: file.Size})
+	}
+	sort.Slice(result.Changes, func(i, j int) bool {
+		return result.Changes[i].Path < result.Changes[j].Path
+	})
+
+	oldChunks := map[string]bool{}
+	for _, chunk := range oldBootstrap.Chunks {
+		oldChunks[chunk.Digest] = true
+	}
+	for _, chunk := range newBootstrap.Chunks {
+		result.Chunks++
+		result.Size += int64(chunk.CompressedSize)
+		if oldChunks[chunk.Digest] {
+			result.SharedChunks++
+			result.SharedSize += int64(chunk.CompressedSize)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,48 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package diff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+func TestDiff(t *testing.T) {
+	chunk := func(dgst string) dedup.Chunk {
+		return dedup.Chunk{Digest: dgst, CompressedSize: 10}
+	}
+	oldBootstrap := &dedup.Bootstrap{
+		Chunks: []dedup.Chunk{chunk("a"), chunk("b"), chunk("c")},
+		Files: []dedup.File{
+			{Path: "/", Mode: 040755},
+			{Path: "/bin", Mode: 0100755, Size: 20, Chunks: []dedup.Chunk{chunk("a"), chunk("b")}},
+			{Path: "/lib", Mode: 0100644, Size: 10, Chunks: []dedup.Chunk{chunk("c")}},
+			{Path: "/tmp", Mode: 040755},
+		},
+	}
+	newBootstrap := &dedup.Bootstrap{
+		Chunks: []dedup.Chunk{chunk("a"), chunk("d"), chunk("c")},
+		Files: []dedup.File{
+			{Path: "/", Mode: 040755},
+			{Path: "/bin", Mode: 0100755, Size: 20, Chunks: []dedup.Chunk{chunk("a"), chunk("d")}},
+			{Path: "/lib", Mode: 0100644, Size: 10, Chunks: []dedup.Chunk{chunk("c")}},
+			{Path: "/etc", Mode: 040755},
+		},
+	}
+
+	result := Diff(oldBootstrap, newBootstrap)
+	assert.Equal(t, []Change{
+		{Path: "/bin", Kind: "changed", Size: 20},
+		{Path: "/etc", Kind: "added"},
+		{Path: "/tmp", Kind: "removed"},
+	}, result.Changes)
+	assert.Equal(t, 3, result.Chunks)
+	assert.Equal(t, 2, result.SharedChunks)
+	assert.Equal(t, int64(30), result.Size)
+	assert.Equal(t, int64(20), result.SharedSize)
+}
@@ -0,0 +1,313 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package estargz converts the layers of source image to eStargz format,
+// the converted image can be lazily pulled by stargz-snapshotter, and is
+// still a valid OCI image for the runtimes without lazy pulling support.
+package estargz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/images"
+	esgz "github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/signature"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tracing"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Opt configures the conversion from source image to eStargz image.
+type Opt struct {
+	WorkDir      string
+	SourceRemote *remote.Remote
+	TargetRemote *remote.Remote
+	// Platform (os/arch) of the image picked from source manifest index.
+	Platform       string
+	DecryptionKeys *provider.DecryptionKeys
+	DockerV2Format bool
+	// The number of layers converted concurrently.
+	MaxConcurrency uint
+	// Sign target image once it's pushed.
+	Signers []signature.Signer
+	// Retry configures the retry and circuit breaker of layer pulls and
+	// pushes.
+	Retry backend.RetryConfig
+}
+
+// layerDesc makes the descriptor of eStargz layer with the TOC digest
+// and uncompressed size annotations.
+func layerDesc(blobDigest digest.Digest, size int64, tocDigest digest.Digest, uncompressedSize int64, dockerV2Format bool) ocispec.Descriptor {
+	mediaType := ocispec.MediaTypeImageLayerGzip
+	if dockerV2Format {
+		mediaType = images.MediaTypeDockerSchema2LayerGzip
+	}
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    blobDigest,
+		Size:      size,
+		Annotations: map[string]string{
+			esgz.TOCJSONDigestAnnotation:         tocDigest.String(),
+			esgz.StoreUncompressedSizeAnnotation: strconv.FormatInt(uncompressedSize, 10),
+		},
+	}
+}
+
+type converter struct {
+	Opt
+	layersDir     string
+	sourceRetrier *backend.Retrier
+	targetRetrier *backend.Retrier
+}
+
+// pullLayer pulls source layer to a file in work directory, the layer is
+// decrypted if it's OCI encrypted.
+func (cvt *converter) pullLayer(ctx context.Context, desc ocispec.Descriptor) (string, error) {
+	layerPath := filepath.Join(cvt.layersDir, desc.Digest.Hex()+".source")
+
+	if err := cvt.sourceRetrier.Do(ctx, func() error {
+		reader, err := cvt.SourceRemote.Pull(ctx, desc, true)
+		if err != nil {
+			return errors.Wrap(err, "Pull source layer")
+		}
+		defer reader.Close()
+
+		if provider.IsEncryptedLayer(desc) {
+			reader, err = cvt.DecryptionKeys.DecryptLayer(desc, reader)
+			if err != nil {
+				return errors.Wrap(err, "Decrypt source layer")
+			}
+		}
+
+		file, err := os.Create(layerPath)
+		if err != nil {
+			return errors.Wrap(err, "Create source layer file")
+		}
+		defer file.Close()
+
+		if _, err := io.Copy(file, reader); err != nil {
+			return errors.Wrap(err, "Write source layer file")
+		}
+
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	return layerPath, nil
+}
+
+// convertLayer converts source layer to eStargz blob and pushes it to
+// target, returns the descriptor and diff id of the eStargz layer.
+func (cvt *converter) convertLayer(ctx context.Context, desc ocispec.Descriptor) (_ *ocispec.Descriptor, _ digest.Digest, retErr error) {
+	ctx, span := tracing.Start(ctx, "convert layer to estargz", attribute.String("source_digest", desc.Digest.String()))
+	defer func() {
+		tracing.End(span, retErr)
+	}()
+
+	sourcePath, err := cvt.pullLayer(ctx, desc)
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(sourcePath)
+
+	sourceFile, err := os.Open(sourcePath)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Open source layer file")
+	}
+	defer sourceFile.Close()
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Stat source layer file")
+	}
+
+	compression := newGzipCompression(gzip.BestCompression)
+	blob, err := esgz.Build(
+		io.NewSectionReader(sourceFile, 0, info.Size()),
+		esgz.WithContext(ctx),
+		esgz.WithCompression(compression),
+	)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Build estargz blob")
+	}
+	defer blob.Close()
+
+	blobPath := filepath.Join(cvt.layersDir, desc.Digest.Hex()+".estargz")
+	blobFile, err := os.Create(blobPath)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Create estargz blob file")
+	}
+	defer os.Remove(blobPath)
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(blobFile, digester.Hash()), blob)
+	blobFile.Close()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Write estargz blob file")
+	}
+
+	// The blob is decompressed to calculate diff id while it's read, which
+	// counts the uncompressed size as well.
+	newDesc := layerDesc(digester.Digest(), size, blob.TOCDigest(), compression.UncompressedSize(), cvt.DockerV2Format)
+
+	if err := cvt.targetRetrier.Do(ctx, func() error {
+		reader, err := os.Open(blobPath)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return cvt.TargetRemote.Push(ctx, newDesc, true, reader)
+	}); err != nil {
+		return nil, "", errors.Wrap(err, "Push estargz blob")
+	}
+
+	logrus.Infof("Converted layer %s to estargz layer %s", desc.Digest, newDesc.Digest)
+
+	return &newDesc, blob.DiffID(), nil
+}
+
+func (cvt *converter) pushManifest(ctx context.Context, image *parser.Image, layers []ocispec.Descriptor, diffIDs []digest.Digest) (*ocispec.Descriptor, error) {
+	config := image.Config
+	config.RootFS.DiffIDs = diffIDs
+
+	configMediaType := ocispec.MediaTypeImageConfig
+	if cvt.DockerV2Format {
+		configMediaType = images.MediaTypeDockerSchema2Config
+	}
+	configDesc, configBytes, err := utils.MarshalToDesc(config, configMediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal estargz image config")
+	}
+	if err := cvt.TargetRemote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push estargz image config")
+	}
+
+	manifestMediaType := ocispec.MediaTypeImageManifest
+	if cvt.DockerV2Format {
+		manifestMediaType = images.MediaTypeDockerSchema2Manifest
+	}
+	manifest := struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: manifestMediaType,
+		Manifest: ocispec.Manifest{
+			Versioned: specs.Versioned{
+				SchemaVersion: 2,
+			},
+			Config:      *configDesc,
+			Layers:      layers,
+			Annotations: image.Manifest.Annotations,
+		},
+	}
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(manifest, manifestMediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal estargz image manifest")
+	}
+	if err := cvt.TargetRemote.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "Push estargz image manifest")
+	}
+
+	return manifestDesc, nil
+}
+
+// Convert converts the layers of source image to eStargz concurrently,
+// then pushes the eStargz image to target.
+func Convert(ctx context.Context, opt Opt) (retErr error) {
+	ctx, span := tracing.Start(ctx, "convert image to estargz",
+		attribute.String("source", opt.SourceRemote.Ref),
+		attribute.String("target", opt.TargetRemote.Ref),
+	)
+	defer func() {
+		tracing.End(span, retErr)
+	}()
+
+	_, arch, err := provider.ExtractOsArch(opt.Platform)
+	if err != nil {
+		return err
+	}
+	p, err := parser.New(opt.SourceRemote, arch)
+	if err != nil {
+		return errors.Wrap(err, "Create parser")
+	}
+	parsed, err := p.Parse(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Parse source image")
+	}
+	if parsed.OCIImage == nil {
+		return fmt.Errorf("not found OCI %s manifest in source image", opt.Platform)
+	}
+	image := parsed.OCIImage
+
+	layersDir := filepath.Join(opt.WorkDir, "estargz")
+	if err := os.RemoveAll(layersDir); err != nil {
+		return errors.Wrap(err, "Remove estargz directory")
+	}
+	if err := os.MkdirAll(layersDir, 0755); err != nil {
+		return errors.Wrap(err, "Create estargz directory")
+	}
+	defer os.RemoveAll(layersDir)
+
+	cvt := &converter{
+		Opt:           opt,
+		layersDir:     layersDir,
+		sourceRetrier: backend.NewRemoteRetrier(opt.SourceRemote, opt.Retry),
+		targetRetrier: backend.NewRemoteRetrier(opt.TargetRemote, opt.Retry),
+	}
+
+	concurrency := opt.MaxConcurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	sourceLayers := image.Manifest.Layers
+	layers := make([]ocispec.Descriptor, len(sourceLayers))
+	diffIDs := make([]digest.Digest, len(sourceLayers))
+	pool := utils.NewWorkerPool(concurrency, uint(len(sourceLayers)))
+	for idx := range sourceLayers {
+		idx := idx
+		pool.Put(func() error {
+			desc, diffID, err := cvt.convertLayer(ctx, sourceLayers[idx])
+			if err != nil {
+				return errors.Wrapf(err, "Convert layer %s", sourceLayers[idx].Digest)
+			}
+			layers[idx] = *desc
+			diffIDs[idx] = diffID
+			return nil
+		})
+	}
+	if err := <-pool.Waiter(); err != nil {
+		return err
+	}
+
+	manifestDesc, err := cvt.pushManifest(ctx, image, layers, diffIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, signer := range opt.Signers {
+		if err := signer.Sign(ctx, opt.TargetRemote, manifestDesc.Digest); err != nil {
+			return errors.Wrap(err, "Sign target image")
+		}
+	}
+
+	logrus.Infof("Converted to estargz image %s", opt.TargetRemote.Ref)
+
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	esgz "github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayerDesc(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	content := []byte("hello estargz")
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(content)
+	assert.Nil(t, err)
+	assert.Nil(t, tw.Close())
+
+	compression := newGzipCompression(gzip.BestCompression)
+	blob, err := esgz.Build(
+		io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())),
+		esgz.WithCompression(compression),
+	)
+	assert.Nil(t, err)
+	defer blob.Close()
+	blobBytes, err := ioutil.ReadAll(blob)
+	assert.Nil(t, err)
+
+	// The size counted by build is the size of all gzip members decompressed.
+	size := compression.UncompressedSize()
+	gr, err := gzip.NewReader(bytes.NewReader(blobBytes))
+	assert.Nil(t, err)
+	uncompressed, err := ioutil.ReadAll(gr)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(uncompressed)), size)
+	assert.True(t, size > int64(len(content)))
+
+	desc := layerDesc(digest.FromBytes(blobBytes), int64(len(blobBytes)), blob.TOCDigest(), size, false)
+	assert.Equal(t, ocispec.MediaTypeImageLayerGzip, desc.MediaType)
+	assert.Equal(t, strconv.FormatInt(size, 10), desc.Annotations[esgz.StoreUncompressedSizeAnnotation])
+
+	// The TOC digest in annotation can be verified by the estargz reader.
+	reader, err := esgz.Open(io.NewSectionReader(bytes.NewReader(blobBytes), 0, int64(len(blobBytes))))
+	assert.Nil(t, err)
+	assert.Equal(t, desc.Annotations[esgz.TOCJSONDigestAnnotation], reader.TOCDigest().String())
+	_, ok := reader.Lookup("hello.txt")
+	assert.True(t, ok)
+}
+
+func TestGzipFooterBytes(t *testing.T) {
+	footer := gzipFooterBytes(0x1234)
+	assert.Len(t, footer, esgz.FooterSize)
+
+	tocOffset, _, err := esgz.OpenFooter(io.NewSectionReader(bytes.NewReader(footer), 0, int64(len(footer))))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0x1234), tocOffset)
+}
+
+func TestGzipCompressionRoundTrip(t *testing.T) {
+	contents := map[string][]byte{}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i, size := range []int{0, 13, 2 << 20} {
+		name := fmt.Sprintf("file-%d", i)
+		contents[name] = bytes.Repeat([]byte{byte('a' + i)}, size)
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(size), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(contents[name])
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tw.Close())
+
+	// The gzip compression of estargz package can't be compared with, its
+	// footer size check panics with the empty deflate block of recent Go.
+	compression := newGzipCompression(gzip.BestCompression)
+	blob, err := esgz.Build(
+		io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())),
+		esgz.WithCompression(compression),
+	)
+	assert.Nil(t, err)
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	assert.Nil(t, err)
+	sr := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+
+	// The footer written byte by byte is parsed by estargz, and points to
+	// the gzip member of TOC.
+	tocOffset, footerSize, err := esgz.OpenFooter(sr)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(esgz.FooterSize), footerSize)
+	footer := data[len(data)-esgz.FooterSize:]
+	assert.Equal(t, gzipFooterBytes(tocOffset), footer)
+	payloadSize, parsedTOCOffset, _, err := (&esgz.GzipDecompressor{}).ParseFooter(footer)
+	assert.Nil(t, err)
+	assert.Equal(t, tocOffset, payloadSize)
+	assert.Equal(t, tocOffset, parsedTOCOffset)
+	gr, err := gzip.NewReader(bytes.NewReader(data[tocOffset : int64(len(data))-footerSize]))
+	assert.Nil(t, err)
+	hdr, err := tar.NewReader(gr).Next()
+	assert.Nil(t, err)
+	assert.Equal(t, esgz.TOCTarName, hdr.Name)
+
+	// The payload before TOC unpacks to the source files.
+	reader, err := esgz.Unpack(sr, &esgz.GzipDecompressor{})
+	assert.Nil(t, err)
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	unpacked := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		if _, ok := contents[hdr.Name]; !ok {
+			// The landmark files of estargz.
+			continue
+		}
+		unpacked[hdr.Name], err = ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, contents, unpacked)
+
+	// The size counted by build is the size of all gzip members decompressed.
+	gr, err = gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	uncompressed, err := ioutil.ReadAll(gr)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(uncompressed)), compression.UncompressedSize())
+}
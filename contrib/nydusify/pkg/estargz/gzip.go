@@ -0,0 +1,128 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package estargz
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sync/atomic"
+
+	esgz "github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+)
+
+// gzipCompression is the gzip compression of estargz package, except
+// that the footer is written byte by byte. The footer must be exactly
+// esgz.FooterSize bytes, which estargz expects from compress/gzip with
+// NoCompression level, but the empty deflate block it writes differs
+// among Go versions.
+//
+// It also counts the uncompressed size of blob, when esgz.Build decompresses
+// the blob to calculate the diff id.
+type gzipCompression struct {
+	*esgz.GzipCompressor
+	*esgz.GzipDecompressor
+	level            int
+	uncompressedSize int64
+}
+
+func newGzipCompression(level int) *gzipCompression {
+	return &gzipCompression{
+		GzipCompressor:   esgz.NewGzipCompressorWithLevel(level),
+		GzipDecompressor: &esgz.GzipDecompressor{},
+		level:            level,
+	}
+}
+
+type countReadCloser struct {
+	io.ReadCloser
+	size *int64
+}
+
+func (r *countReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.size, int64(n))
+	return n, err
+}
+
+// Reader decompresses the blob, the uncompressed size is counted from zero.
+func (gc *gzipCompression) Reader(r io.Reader) (io.ReadCloser, error) {
+	reader, err := gc.GzipDecompressor.Reader(r)
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&gc.uncompressedSize, 0)
+	return &countReadCloser{ReadCloser: reader, size: &gc.uncompressedSize}, nil
+}
+
+// UncompressedSize returns the uncompressed size of blob built by
+// esgz.Build, it's available once the blob is read to the end.
+func (gc *gzipCompression) UncompressedSize() int64 {
+	return atomic.LoadInt64(&gc.uncompressedSize)
+}
+
+// gzipFooterBytes makes an empty gzip member, whose extra field records
+// the offset of TOC.
+func gzipFooterBytes(tocOff int64) []byte {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
+	extra := make([]byte, 4, 4+len(subfield))
+	extra[0], extra[1] = 'S', 'G'
+	binary.LittleEndian.PutUint16(extra[2:4], uint16(len(subfield)))
+	extra = append(extra, subfield...)
+
+	// ID1, ID2, CM (deflate), FLG (FEXTRA), MTIME, XFL, OS (unknown)
+	footer := []byte{0x1f, 0x8b, 0x08, 0x04, 0, 0, 0, 0, 0, 0xff}
+	footer = append(footer, 0, 0)
+	binary.LittleEndian.PutUint16(footer[len(footer)-2:], uint16(len(extra)))
+	footer = append(footer, extra...)
+	// The final stored deflate block without data.
+	footer = append(footer, 0x01, 0x00, 0x00, 0xff, 0xff)
+	// CRC32 and ISIZE of empty data.
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	return footer
+}
+
+func (gc *gzipCompression) WriteTOCAndFooter(w io.Writer, off int64, toc *esgz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	gz, err := gzip.NewWriterLevel(w, gc.level)
+	if err != nil {
+		return "", err
+	}
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     esgz.TOCTarName,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(gzipFooterBytes(off)); err != nil {
+		return "", err
+	}
+
+	return digest.FromBytes(tocJSON), nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package events emits the lifecycle events of nydusify commands to the
+// configured sinks, so that node agents and alerting systems can react to
+// them without polling. An event is delivered as a JSON object, by POST to
+// a webhook URL or as a line appended to a file.
+//
+// Events are queued and delivered in background, emitting never blocks the
+// command, and the events are dropped if the queue is full.
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/proxy"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tlsconfig"
+)
+
+const (
+	TypeMountCreated       = "mount.created"
+	TypeMountFailed        = "mount.failed"
+	TypePrefetchCompleted  = "prefetch.completed"
+	TypeCacheEvicted       = "cache.evicted"
+	TypeBackendFailover    = "backend.failover"
+	TypeConversionFinished = "conversion.finished"
+)
+
+const (
+	queueSize      = 1024
+	sendAttempts   = 3
+	sendBackoff    = time.Second
+	webhookTimeout = 10 * time.Second
+	closeTimeout   = 10 * time.Second
+)
+
+// Event is a lifecycle event, Data is the detail of event type.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Host is the hostname of node emitting the event.
+	Host string `json:"host"`
+	// Image is the image reference the event is about, if any.
+	Image string `json:"image,omitempty"`
+	// Error is set for the failure events, e.g. a failed conversion.
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Sink delivers the JSON encoded event.
+type Sink interface {
+	Send(ctx context.Context, data []byte) error
+	Close() error
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Send(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d of webhook %s", resp.StatusCode, s.url)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	return nil
+}
+
+type fileSink struct {
+	file *os.File
+}
+
+func (s *fileSink) Send(ctx context.Context, data []byte) error {
+	_, err := s.file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// ParseSink parses the sink of an `http://` or `https://` webhook URL, or
+// a file path (optionally prefixed by `file://`) to append JSON lines.
+func ParseSink(value string) (Sink, error) {
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		return &webhookSink{
+			url: value,
+			client: &http.Client{
+				Timeout:   webhookTimeout,
+				Transport: tlsconfig.Transport(proxy.Transport(nil)),
+			},
+		}, nil
+	}
+	path := strings.TrimPrefix(value, "file://")
+	if path == "" || strings.Contains(path, "://") {
+		return nil, fmt.Errorf("invalid event sink %q, should be a webhook URL or file path", value)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open event file")
+	}
+	return &fileSink{file: file}, nil
+}
+
+// Emitter queues the events and delivers them to sinks in order, a failed
+// delivery is retried a few times before the event is dropped for the sink.
+type Emitter struct {
+	host    string
+	sinks   []Sink
+	backoff time.Duration
+
+	mutex  sync.Mutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+}
+
+// NewEmitter starts delivering events to sinks.
+func NewEmitter(sinks []Sink) *Emitter {
+	host, _ := os.Hostname()
+	e := &Emitter{
+		host:    host,
+		sinks:   sinks,
+		backoff: sendBackoff,
+		queue:   make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *Emitter) run() {
+	defer close(e.done)
+	for data := range e.queue {
+		for _, sink := range e.sinks {
+			var err error
+			for attempt := 0; attempt < sendAttempts; attempt++ {
+				if attempt > 0 {
+					time.Sleep(e.backoff << uint(attempt-1))
+				}
+				if err = sink.Send(context.Background(), data); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				logrus.WithError(err).Warn("Failed to deliver event")
+			}
+		}
+	}
+}
+
+// Emit queues the event, the time and host are filled if unset.
+func (e *Emitter) Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Host == "" {
+		event.Host = e.host
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to marshal event %s", event.Type)
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- data:
+	default:
+		logrus.Warnf("Event queue is full, drop event %s", event.Type)
+	}
+}
+
+// Close stops accepting events and waits for the queued events to be
+// delivered until timeout, then closes the sinks.
+func (e *Emitter) Close(timeout time.Duration) {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return
+	}
+	e.closed = true
+	close(e.queue)
+	e.mutex.Unlock()
+
+	select {
+	case <-e.done:
+	case <-time.After(timeout):
+		logrus.Warnf("Timeout to deliver the rest %d events", len(e.queue))
+		return
+	}
+	for _, sink := range e.sinks {
+		sink.Close()
+	}
+}
+
+var (
+	defaultMutex   sync.Mutex
+	defaultEmitter *Emitter
+)
+
+// Setup emits the events of Emit to the sinks parsed from values, the
+// returned function delivers the queued events and should be called before
+// exit. Events are dropped if no sink is specified.
+func Setup(values []string) (func(), error) {
+	sinks := []Sink{}
+	for _, value := range values {
+		sink, err := ParseSink(value)
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return func() {}, nil
+	}
+
+	emitter := NewEmitter(sinks)
+	defaultMutex.Lock()
+	defaultEmitter = emitter
+	defaultMutex.Unlock()
+
+	return func() {
+		defaultMutex.Lock()
+		if defaultEmitter == emitter {
+			defaultEmitter = nil
+		}
+		defaultMutex.Unlock()
+		emitter.Close(closeTimeout)
+	}, nil
+}
+
+// Emit emits the event to the sinks set up by Setup.
+func Emit(event Event) {
+	defaultMutex.Lock()
+	emitter := defaultEmitter
+	defaultMutex.Unlock()
+	if emitter != nil {
+		emitter.Emit(event)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSink(t *testing.T) {
+	sink, err := ParseSink("https://agent.example.com/events")
+	assert.Nil(t, err)
+	assert.IsType(t, &webhookSink{}, sink)
+
+	_, err = ParseSink("grpc://agent.example.com")
+	assert.NotNil(t, err)
+	_, err = ParseSink("file://")
+	assert.NotNil(t, err)
+}
+
+func TestEmitter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-events-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The webhook fails on first request, then the event is delivered by
+	// retry.
+	var mutex sync.Mutex
+	received := []Event{}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event Event
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&event))
+		received = append(received, event)
+	}))
+	defer server.Close()
+
+	webhook, err := ParseSink(server.URL)
+	assert.Nil(t, err)
+	eventFile := filepath.Join(dir, "events.json")
+	file, err := ParseSink("file://" + eventFile)
+	assert.Nil(t, err)
+
+	emitter := NewEmitter([]Sink{webhook, file})
+	emitter.backoff = time.Millisecond
+	emitter.Emit(Event{Type: TypeMountCreated, Image: "example.com/app:nydus"})
+	emitter.Emit(Event{Type: TypeConversionFinished, Error: "failed"})
+	emitter.Close(5 * time.Second)
+	// The events after close are dropped.
+	emitter.Emit(Event{Type: TypeCacheEvicted})
+
+	assert.Equal(t, 3, requests)
+	assert.Len(t, received, 2)
+	assert.Equal(t, TypeMountCreated, received[0].Type)
+	assert.Equal(t, "example.com/app:nydus", received[0].Image)
+	assert.False(t, received[0].Time.IsZero())
+	assert.Equal(t, TypeConversionFinished, received[1].Type)
+	assert.Equal(t, "failed", received[1].Error)
+
+	data, err := ioutil.ReadFile(eventFile)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	var event Event
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(t, TypeConversionFinished, event.Type)
+}
+
+func TestSetup(t *testing.T) {
+	// Emitting without sinks is a no-op.
+	closeEvents, err := Setup(nil)
+	assert.Nil(t, err)
+	Emit(Event{Type: TypeMountFailed})
+	closeEvents()
+
+	_, err = Setup([]string{"ftp://example.com"})
+	assert.NotNil(t, err)
+}
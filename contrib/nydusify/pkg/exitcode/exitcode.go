@@ -0,0 +1,93 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package exitcode classifies the failures of conversion into stable exit
+// codes, so that CI systems can branch on the class of failure, e.g. retry
+// on push failures only.
+package exitcode
+
+import (
+	"errors"
+)
+
+const (
+	// OK means the command succeeded.
+	OK = 0
+	// Unknown is the failure not classified.
+	Unknown = 1
+	// Usage is the invalid arguments or configuration detected before
+	// conversion starts.
+	Usage = 2
+	// Source is the failure to fetch source image, e.g. not found, auth
+	// or network errors of source registry.
+	Source = 3
+	// Build is the failure of building Nydus layers by nydus-image.
+	Build = 4
+	// Push is the failure to push Nydus image, cache image or artifacts
+	// to target registry or storage backend.
+	Push = 5
+	// Verify is the failure of source image signature verification.
+	Verify = 6
+)
+
+var names = map[int]string{
+	OK:      "ok",
+	Unknown: "unknown",
+	Usage:   "usage",
+	Source:  "source",
+	Build:   "build",
+	Push:    "push",
+	Verify:  "verify",
+}
+
+type classifiedError struct {
+	code int
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Cause() error {
+	return e.err
+}
+
+// Wrap classifies err with code, the innermost class is kept if err is
+// classified already. It returns nil if err is nil.
+func Wrap(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+	return &classifiedError{code: code, err: err}
+}
+
+// Of returns the exit code of err, OK if err is nil, Unknown if err isn't
+// classified.
+func Of(err error) int {
+	if err == nil {
+		return OK
+	}
+	var classified *classifiedError
+	if errors.As(err, &classified) {
+		return classified.code
+	}
+	return Unknown
+}
+
+// Name returns the name of failure class of exit code.
+func Name(code int) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return names[Unknown]
+}
@@ -0,0 +1,27 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package exitcode
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	assert.Nil(t, Wrap(Push, nil))
+	assert.Equal(t, OK, Of(nil))
+	assert.Equal(t, Unknown, Of(fmt.Errorf("unknown")))
+
+	err := errors.Wrap(Wrap(Source, fmt.Errorf("unauthorized")), "Pull source layer")
+	assert.Equal(t, Source, Of(err))
+	assert.Equal(t, "Pull source layer: unauthorized", err.Error())
+	// The innermost class is kept.
+	assert.Equal(t, Source, Of(Wrap(Push, errors.Wrap(err, "Failed to convert"))))
+	assert.Equal(t, "source", Name(Of(err)))
+	assert.Equal(t, "unknown", Name(100))
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package export reconstitutes a standard tarball from Nydus image, for the
+// runtimes can't consume Nydus image. The layers of image are flattened
+// into one, as they are merged in the bootstrap.
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/viewer"
+)
+
+const (
+	// FormatRootfs is a plain tarball of the root filesystem.
+	FormatRootfs = "rootfs"
+	// FormatOCIArchive is an OCI image layout tarball with single layer,
+	// which can be loaded by `skopeo copy oci-archive:` or converted again
+	// by nydusify.
+	FormatOCIArchive = "oci-archive"
+)
+
+type Opt struct {
+	Target         string
+	TargetInsecure bool
+	ExpectedArch   string
+	Format         string
+}
+
+// Export writes the tarball of Nydus image in the format to writer, the
+// file data is fetched from the blobs in registry.
+func Export(ctx context.Context, opt Opt, w io.Writer) error {
+	if opt.Format != FormatRootfs && opt.Format != FormatOCIArchive {
+		return fmt.Errorf("unsupported export format %s", opt.Format)
+	}
+
+	targetRemote, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	if err != nil {
+		return err
+	}
+	p, err := parser.New(targetRemote, opt.ExpectedArch)
+	if err != nil {
+		return err
+	}
+	parsed, err := p.Parse(ctx)
+	if err != nil {
+		return errors.Wrap(err, "parse Nydus image")
+	}
+	if parsed.NydusImage == nil {
+		return fmt.Errorf("not found Nydus image of %s", opt.Target)
+	}
+	bootstrap, err := dedup.PullBootstrap(ctx, p, parsed.NydusImage, "")
+	if err != nil {
+		return err
+	}
+	v := viewer.New(targetRemote, bootstrap)
+
+	logrus.Infof("Exporting Nydus image %s as %s", opt.Target, opt.Format)
+	if opt.Format == FormatRootfs {
+		return v.WriteTar(ctx, w)
+	}
+
+	tag := ""
+	if named, err := docker.ParseDockerRef(opt.Target); err == nil {
+		if tagged, ok := named.(docker.Tagged); ok {
+			tag = tagged.Tag()
+		}
+	}
+	return writeOCIArchive(ctx, v, parsed.NydusImage.Config, tag, w)
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0444,
+		Size:     size,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+func writeTarBlob(tw *tar.Writer, desc ocispec.Descriptor, r io.Reader) error {
+	return writeTarFile(tw, path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Hex()), desc.Size, r)
+}
+
+type countingWriter struct {
+	size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// writeLayer writes the flattened filesystem as a gzip compressed layer to
+// file, returns the layer descriptor and diff ID.
+func writeLayer(ctx context.Context, v *viewer.Viewer, file *os.File) (*ocispec.Descriptor, digest.Digest, error) {
+	layerDigester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	gw := gzip.NewWriter(io.MultiWriter(file, layerDigester.Hash(), counter))
+	diffIDDigester := digest.Canonical.Digester()
+	if err := v.WriteTar(ctx, io.MultiWriter(gw, diffIDDigester.Hash())); err != nil {
+		return nil, "", err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, "", errors.Wrap(err, "compress layer")
+	}
+	return &ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    layerDigester.Digest(),
+		Size:      counter.size,
+	}, diffIDDigester.Digest(), nil
+}
+
+// writeOCIArchive writes the OCI image layout tarball, the image config of
+// Nydus image is kept except the rootfs and history.
+func writeOCIArchive(ctx context.Context, v *viewer.Viewer, config ocispec.Image, tag string, w io.Writer) error {
+	layerFile, err := ioutil.TempFile("", "nydusify-export-")
+	if err != nil {
+		return errors.Wrap(err, "create layer file")
+	}
+	defer os.Remove(layerFile.Name())
+	defer layerFile.Close()
+
+	layerDesc, diffID, err := writeLayer(ctx, v, layerFile)
+	if err != nil {
+		return errors.Wrap(err, "write layer")
+	}
+	if _, err := layerFile.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "seek layer file")
+	}
+
+	config.RootFS = ocispec.RootFS{
+		Type:    "layers",
+		DiffIDs: []digest.Digest{diffID},
+	}
+	config.History = []ocispec.History{{
+		Created:   config.Created,
+		CreatedBy: "nydusify export",
+		Comment:   "flattened from Nydus image",
+	}}
+	configDesc, configBytes, err := utils.MarshalToDesc(config, ocispec.MediaTypeImageConfig)
+	if err != nil {
+		return errors.Wrap(err, "marshal image config")
+	}
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    *configDesc,
+		Layers:    []ocispec.Descriptor{*layerDesc},
+	}, ocispec.MediaTypeImageManifest)
+	if err != nil {
+		return errors.Wrap(err, "marshal image manifest")
+	}
+	manifestDesc.Platform = &ocispec.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+	}
+	if tag != "" {
+		manifestDesc.Annotations = map[string]string{ocispec.AnnotationRefName: tag}
+	}
+	_, indexBytes, err := utils.MarshalToDesc(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{*manifestDesc},
+	}, ocispec.MediaTypeImageIndex)
+	if err != nil {
+		return errors.Wrap(err, "marshal image index")
+	}
+
+	tw := tar.NewWriter(w)
+	layout := []byte(`{"imageLayoutVersion":"` + ocispec.ImageLayoutVersion + `"}`)
+	if err := writeTarFile(tw, ocispec.ImageLayoutFile, int64(len(layout)), bytes.NewReader(layout)); err != nil {
+		return errors.Wrap(err, "write oci-layout")
+	}
+	if err := writeTarBlob(tw, *layerDesc, layerFile); err != nil {
+		return errors.Wrap(err, "write layer blob")
+	}
+	if err := writeTarBlob(tw, *configDesc, bytes.NewReader(configBytes)); err != nil {
+		return errors.Wrap(err, "write config blob")
+	}
+	if err := writeTarBlob(tw, *manifestDesc, bytes.NewReader(manifestBytes)); err != nil {
+		return errors.Wrap(err, "write manifest blob")
+	}
+	if err := writeTarFile(tw, "index.json", int64(len(indexBytes)), bytes.NewReader(indexBytes)); err != nil {
+		return errors.Wrap(err, "write index.json")
+	}
+	return tw.Close()
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/viewer"
+)
+
+func readTar(t *testing.T, r io.Reader) (map[string][]byte, map[string]*tar.Header) {
+	files := map[string][]byte{}
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		data, err := ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+		files[hdr.Name] = data
+		headers[hdr.Name] = hdr
+	}
+	return files, headers
+}
+
+func TestWriteOCIArchive(t *testing.T) {
+	// The file without chunks is all holes, no blob is fetched.
+	v := viewer.New(nil, &dedup.Bootstrap{
+		Files: []dedup.File{
+			{Path: "/", Mode: 040755},
+			{Path: "/bin", Mode: 040755, Xattrs: map[string][]byte{"user.key": []byte("value")}},
+			{Path: "/bin/sh", Ino: 10, Mode: 0100755, Size: 4, Mtime: 1600000000},
+			{Path: "/bin/bash", Ino: 10, Mode: 0100755, Size: 4},
+			{Path: "/sh", Mode: 0120777, Symlink: "bin/sh"},
+		},
+	})
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeOCIArchive(context.Background(), v, ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+	}, "v1", &buf))
+	files, _ := readTar(t, &buf)
+	assert.Equal(t, `{"imageLayoutVersion":"1.0.0"}`, string(files["oci-layout"]))
+
+	blob := func(dgst digest.Digest) []byte {
+		data, ok := files["blobs/sha256/"+dgst.Hex()]
+		assert.True(t, ok)
+		assert.Equal(t, dgst, digest.FromBytes(data))
+		return data
+	}
+
+	var index ocispec.Index
+	assert.Nil(t, json.Unmarshal(files["index.json"], &index))
+	assert.Len(t, index.Manifests, 1)
+	assert.Equal(t, "v1", index.Manifests[0].Annotations[ocispec.AnnotationRefName])
+	assert.Equal(t, "amd64", index.Manifests[0].Platform.Architecture)
+
+	var manifest ocispec.Manifest
+	assert.Nil(t, json.Unmarshal(blob(index.Manifests[0].Digest), &manifest))
+	var config ocispec.Image
+	assert.Nil(t, json.Unmarshal(blob(manifest.Config.Digest), &config))
+	assert.Len(t, manifest.Layers, 1)
+	layer := blob(manifest.Layers[0].Digest)
+	assert.Equal(t, int64(len(layer)), manifest.Layers[0].Size)
+
+	reader, err := gzip.NewReader(bytes.NewReader(layer))
+	assert.Nil(t, err)
+	layerTar, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, []digest.Digest{digest.FromBytes(layerTar)}, config.RootFS.DiffIDs)
+
+	layerFiles, headers := readTar(t, bytes.NewReader(layerTar))
+	assert.Len(t, layerFiles, 4)
+	assert.Equal(t, "value", headers["bin/"].PAXRecords["SCHILY.xattr.user.key"])
+	assert.Equal(t, []byte{0, 0, 0, 0}, layerFiles["bin/sh"])
+	assert.Equal(t, int64(1600000000), headers["bin/sh"].ModTime.Unix())
+	assert.Equal(t, byte(tar.TypeLink), headers["bin/bash"].Typeflag)
+	assert.Equal(t, "bin/sh", headers["bin/bash"].Linkname)
+	assert.Equal(t, "bin/sh", headers["sh"].Linkname)
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gc collects the blobs in storage backend which aren't referenced
+// by any of the given Nydus images.
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Result is the summary of garbage collection.
+type Result struct {
+	Referenced int
+	// Unreferenced are the blobs deleted, or to be deleted in dry-run mode.
+	Unreferenced []backend.BlobObject
+	// Recent are the unreferenced blobs kept in grace period.
+	Recent        []backend.BlobObject
+	ReclaimedSize int64
+}
+
+func pullJSON(ctx context.Context, r *remote.Remote, desc ocispec.Descriptor, v interface{}) error {
+	reader, err := r.Pull(ctx, desc, true)
+	if err != nil {
+		return errors.Wrapf(err, "pull %s", desc.Digest)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", desc.Digest)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ReferencedBlobs returns the blob ids referenced by the Nydus manifests of
+// images, all platforms of manifest index are included. The blobs are
+// recorded in the bootstrap layer annotation of Nydus manifest, including
+// the blobs referenced from chunk dict.
+func ReferencedBlobs(ctx context.Context, remotes []*remote.Remote) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	for _, r := range remotes {
+		desc, err := r.Resolve(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve image %s", r.Ref)
+		}
+
+		manifests := []ocispec.Descriptor{*desc}
+		if desc.MediaType == ocispec.MediaTypeImageIndex || desc.MediaType == images.MediaTypeDockerSchema2ManifestList {
+			var index ocispec.Index
+			if err := pullJSON(ctx, r, *desc, &index); err != nil {
+				return nil, errors.Wrapf(err, "get manifest index of %s", r.Ref)
+			}
+			manifests = index.Manifests
+		}
+
+		found := false
+		for _, desc := range manifests {
+			if desc.Platform != nil && !utils.IsNydusPlatform(desc.Platform) {
+				continue
+			}
+			var manifest ocispec.Manifest
+			if err := pullJSON(ctx, r, desc, &manifest); err != nil {
+				return nil, errors.Wrapf(err, "get manifest of %s", r.Ref)
+			}
+			for _, layer := range manifest.Layers {
+				if layer.Annotations[utils.LayerAnnotationNydusBootstrap] != "true" {
+					continue
+				}
+				blobs := []string{}
+				if err := json.Unmarshal([]byte(layer.Annotations[utils.LayerAnnotationNydusBlobIDs]), &blobs); err != nil {
+					return nil, errors.Wrapf(err, "invalid annotation %s in manifest %s of %s", utils.LayerAnnotationNydusBlobIDs, desc.Digest, r.Ref)
+				}
+				for _, blob := range blobs {
+					referenced[blob] = true
+				}
+				found = true
+			}
+		}
+		// Never collect blobs with a wrong image list.
+		if !found {
+			return nil, fmt.Errorf("not found Nydus manifest in image %s", r.Ref)
+		}
+		logrus.Infof("Collected referenced blobs of image %s", r.Ref)
+	}
+	return referenced, nil
+}
+
+// Collect deletes the blobs in backend which aren't referenced, the blobs
+// modified in grace period are kept since they may be uploaded by in-flight
+// conversions. Nothing is deleted in dry-run mode.
+func Collect(ctx context.Context, collector backend.Collector, referenced map[string]bool, gracePeriod time.Duration, dryRun bool) (*Result, error) {
+	blobs, err := collector.List(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list blobs in backend")
+	}
+
+	result := &Result{}
+	deadline := time.Now().Add(-gracePeriod)
+	for _, blob := range blobs {
+		if referenced[blob.ID] {
+			result.Referenced++
+			continue
+		}
+		if blob.LastModified.After(deadline) {
+			result.Recent = append(result.Recent, blob)
+			continue
+		}
+		result.Unreferenced = append(result.Unreferenced, blob)
+		result.ReclaimedSize += blob.Size
+		if dryRun {
+			logrus.Infof("Unreferenced blob %s (%d bytes)", blob.ID, blob.Size)
+			continue
+		}
+		if err := collector.Delete(ctx, blob.ID); err != nil {
+			return nil, errors.Wrapf(err, "delete blob %s", blob.ID)
+		}
+		logrus.Infof("Deleted unreferenced blob %s (%d bytes)", blob.ID, blob.Size)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/backend"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func blobID(name string) string {
+	return digest.FromString(name).Hex()
+}
+
+func TestGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-gc-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r, err := remote.NewLayout("oci:" + filepath.Join(dir, "layout") + ":v1")
+	assert.Nil(t, err)
+
+	blobIDs, err := json.Marshal([]string{blobID("a"), blobID("b")})
+	assert.Nil(t, err)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Layers: []ocispec.Descriptor{{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString("bootstrap"),
+			Annotations: map[string]string{
+				utils.LayerAnnotationNydusBootstrap: "true",
+				utils.LayerAnnotationNydusBlobIDs:   string(blobIDs),
+			},
+		}},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, r.Push(ctx, ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}, false, bytes.NewReader(manifest)))
+
+	referenced, err := ReferencedBlobs(ctx, []*remote.Remote{r})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{blobID("a"): true, blobID("b"): true}, referenced)
+
+	other, err := remote.NewLayout("oci:" + filepath.Join(dir, "layout") + ":v2")
+	assert.Nil(t, err)
+	_, err = ReferencedBlobs(ctx, []*remote.Remote{r, other})
+	assert.NotNil(t, err)
+
+	storeDir := filepath.Join(dir, "store")
+	b, err := backend.NewBackend("localfs", []byte(fmt.Sprintf(`{"dir":%q}`, storeDir)), nil)
+	assert.Nil(t, err)
+	collector := b.(backend.Collector)
+	blobPath := filepath.Join(dir, "blob")
+	assert.Nil(t, ioutil.WriteFile(blobPath, []byte("blob"), 0644))
+	for _, name := range []string{"a", "c", "d"} {
+		_, err := b.Upload(ctx, blobID(name), blobPath, 4, false)
+		assert.Nil(t, err)
+	}
+	// Blob c is out of grace period, and other files are never collected.
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(b.(*backend.LocalFS).BlobPath(blobID("c")), old, old))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(storeDir, "README"), []byte("keep"), 0644))
+
+	blobs, err := collector.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, blobs, 3)
+
+	result, err := Collect(ctx, collector, referenced, time.Hour, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.Referenced)
+	assert.Len(t, result.Unreferenced, 1)
+	assert.Equal(t, blobID("c"), result.Unreferenced[0].ID)
+	assert.Len(t, result.Recent, 1)
+	assert.Equal(t, int64(4), result.ReclaimedSize)
+	exist, err := b.Check(blobID("c"))
+	assert.Nil(t, err)
+	assert.True(t, exist)
+
+	_, err = Collect(ctx, collector, referenced, time.Hour, false)
+	assert.Nil(t, err)
+	exist, err = b.Check(blobID("c"))
+	assert.Nil(t, err)
+	assert.False(t, exist)
+	exist, err = b.Check(blobID("d"))
+	assert.Nil(t, err)
+	assert.True(t, exist)
+	_, err = os.Stat(filepath.Join(storeDir, "README"))
+	assert.Nil(t, err)
+}
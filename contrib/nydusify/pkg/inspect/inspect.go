@@ -0,0 +1,145 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package inspect collects the chunk statistics of Nydus image from its
+// bootstrap, such as the chunks and compression ratio of each blob, the
+// duplicated chunks and the largest files.
+package inspect
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+// BlobStat is the unique chunks stored in a blob.
+type BlobStat struct {
+	ID               string  `json:"id"`
+	Chunks           int     `json:"chunks"`
+	CompressedSize   int64   `json:"compressed_size"`
+	UncompressedSize int64   `json:"uncompressed_size"`
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+// FileStat is the chunks of a regular file.
+type FileStat struct {
+	Path           string `json:"path"`
+	Size           uint64 `json:"size"`
+	Chunks         int    `json:"chunks"`
+	CompressedSize int64  `json:"compressed_size"`
+}
+
+// Stat is the statistics of image.
+type Stat struct {
+	Files    int `json:"files"`
+	Dirs     int `json:"dirs"`
+	Symlinks int `json:"symlinks"`
+	// FileChunks is the chunks referenced by all files, UniqueChunks is the
+	// chunks with different digests.
+	FileChunks       int        `json:"file_chunks"`
+	UniqueChunks     int        `json:"unique_chunks"`
+	DuplicateRatio   float64    `json:"duplicate_ratio"`
+	CompressedSize   int64      `json:"compressed_size"`
+	UncompressedSize int64      `json:"uncompressed_size"`
+	CompressionRatio float64    `json:"compression_ratio"`
+	Blobs            []BlobStat `json:"blobs"`
+	LargestFiles     []FileStat `json:"largest_files"`
+	PrefetchChunks   int        `json:"prefetch_chunks"`
+}
+
+func ratio(a, b int64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// Inspect collects statistics from bootstrap, with the top largest files.
+func Inspect(bootstrap *dedup.Bootstrap, top int) *Stat {
+	stat := &Stat{
+		Blobs:          []BlobStat{},
+		LargestFiles:   []FileStat{},
+		UniqueChunks:   len(bootstrap.Chunks),
+		PrefetchChunks: len(bootstrap.PrefetchChunks),
+	}
+
+	blobs := map[string]*BlobStat{}
+	for _, id := range bootstrap.Blobs {
+		stat.Blobs = append(stat.Blobs, BlobStat{ID: id})
+	}
+	for idx := range stat.Blobs {
+		blobs[stat.Blobs[idx].ID] = &stat.Blobs[idx]
+	}
+	for _, chunk := range bootstrap.Chunks {
+		blob := blobs[chunk.Blob]
+		blob.Chunks++
+		blob.CompressedSize += int64(chunk.CompressedSize)
+		blob.UncompressedSize += int64(chunk.UncompressedSize)
+		stat.CompressedSize += int64(chunk.CompressedSize)
+		stat.UncompressedSize += int64(chunk.UncompressedSize)
+	}
+	for idx := range stat.Blobs {
+		stat.Blobs[idx].CompressionRatio = ratio(stat.Blobs[idx].CompressedSize, stat.Blobs[idx].UncompressedSize)
+	}
+	stat.CompressionRatio = ratio(stat.CompressedSize, stat.UncompressedSize)
+
+	files := []FileStat{}
+	for _, file := range bootstrap.Files {
+		switch file.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			stat.Dirs++
+			continue
+		case syscall.S_IFLNK:
+			stat.Symlinks++
+			continue
+		case syscall.S_IFREG:
+			stat.Files++
+		default:
+			continue
+		}
+		fileStat := FileStat{Path: file.Path, Size: file.Size, Chunks: len(file.Chunks)}
+		for _, chunk := range file.Chunks {
+			fileStat.CompressedSize += int64(chunk.CompressedSize)
+		}
+		stat.FileChunks += len(file.Chunks)
+		files = append(files, fileStat)
+	}
+	if stat.FileChunks > 0 {
+		stat.DuplicateRatio = 1 - float64(stat.UniqueChunks)/float64(stat.FileChunks)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	if len(files) > top {
+		files = files[:top]
+	}
+	stat.LargestFiles = append(stat.LargestFiles, files...)
+
+	return stat
+}
+
+// WriteTable writes the statistics as tables.
+func (stat *Stat) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "BLOB\tCHUNKS\tCOMPRESSED\tUNCOMPRESSED\tRATIO\n")
+	for _, blob := range stat.Blobs {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.2f\n", blob.ID, blob.Chunks, blob.CompressedSize, blob.UncompressedSize, blob.CompressionRatio)
+	}
+	fmt.Fprintf(tw, "\nFILE\tSIZE\tCHUNKS\tCOMPRESSED\t\n")
+	for _, file := range stat.LargestFiles {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", file.Path, file.Size, file.Chunks, file.CompressedSize)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nfiles: %d, dirs: %d, symlinks: %d, file chunks: %d, unique chunks: %d, duplicate ratio: %.2f, prefetch chunks: %d\ncompressed: %d bytes, uncompressed: %d bytes, compression ratio: %.2f\n",
+		stat.Files, stat.Dirs, stat.Symlinks, stat.FileChunks, stat.UniqueChunks, stat.DuplicateRatio, stat.PrefetchChunks,
+		stat.CompressedSize, stat.UncompressedSize, stat.CompressionRatio)
+	return err
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package inspect
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+func TestInspect(t *testing.T) {
+	chunk := func(dgst, blob string) dedup.Chunk {
+		return dedup.Chunk{Digest: dgst, Blob: blob, CompressedSize: 10, UncompressedSize: 40}
+	}
+	bootstrap := &dedup.Bootstrap{
+		Blobs:  []string{"blob-a", "blob-b"},
+		Chunks: []dedup.Chunk{chunk("a", "blob-a"), chunk("b", "blob-a"), chunk("c", "blob-b")},
+		Files: []dedup.File{
+			{Path: "/", Mode: 040755},
+			{Path: "/bin", Mode: 0100755, Size: 80, Chunks: []dedup.Chunk{chunk("a", "blob-a"), chunk("b", "blob-a")}},
+			{Path: "/lib", Mode: 0100644, Size: 120, Chunks: []dedup.Chunk{chunk("a", "blob-a"), chunk("b", "blob-a"), chunk("c", "blob-b")}},
+			{Path: "/sh", Mode: 0120777, Symlink: "/bin"},
+			{Path: "/empty", Mode: 0100644},
+		},
+	}
+
+	stat := Inspect(bootstrap, 2)
+	assert.Equal(t, 3, stat.Files)
+	assert.Equal(t, 1, stat.Dirs)
+	assert.Equal(t, 1, stat.Symlinks)
+	assert.Equal(t, 5, stat.FileChunks)
+	assert.Equal(t, 3, stat.UniqueChunks)
+	assert.InDelta(t, 0.4, stat.DuplicateRatio, 0.001)
+	assert.Equal(t, BlobStat{ID: "blob-a", Chunks: 2, CompressedSize: 20, UncompressedSize: 80, CompressionRatio: 0.25}, stat.Blobs[0])
+	assert.InDelta(t, 0.25, stat.CompressionRatio, 0.001)
+	assert.Equal(t, []FileStat{
+		{Path: "/lib", Size: 120, Chunks: 3, CompressedSize: 30},
+		{Path: "/bin", Size: 80, Chunks: 2, CompressedSize: 20},
+	}, stat.LargestFiles)
+
+	var buf bytes.Buffer
+	assert.Nil(t, stat.WriteTable(&buf))
+	assert.Contains(t, buf.String(), "duplicate ratio: 0.40")
+}
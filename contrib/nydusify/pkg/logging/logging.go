@@ -0,0 +1,136 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package logging provides loggers of subsystems, the level of each
+// subsystem can be configured independently of the global level.
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Subsystems having their own log level.
+const (
+	ModuleRegistry = "registry"
+	ModuleBackend  = "backend"
+	ModuleCache    = "cache"
+	ModuleBuild    = "build"
+)
+
+var modules = []string{ModuleRegistry, ModuleBackend, ModuleCache, ModuleBuild}
+
+var (
+	mutex   sync.Mutex
+	loggers = map[string]*logrus.Logger{}
+)
+
+func newModuleLogger() *logrus.Logger {
+	std := logrus.StandardLogger()
+	return &logrus.Logger{
+		Out:          std.Out,
+		Formatter:    std.Formatter,
+		Hooks:        std.Hooks,
+		ReportCaller: std.ReportCaller,
+		ExitFunc:     std.ExitFunc,
+		Level:        std.GetLevel(),
+	}
+}
+
+func moduleLogger(name string) *logrus.Logger {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger, ok := loggers[name]
+	if !ok {
+		logger = newModuleLogger()
+		loggers[name] = logger
+	}
+	return logger
+}
+
+// Module returns the logger of subsystem, entries are tagged by the
+// `module` field.
+func Module(name string) *logrus.Entry {
+	return moduleLogger(name).WithField("module", name)
+}
+
+// SetModuleLevel changes the log level of subsystem, it's safe to be
+// called at runtime.
+func SetModuleLevel(name string, level logrus.Level) {
+	moduleLogger(name).SetLevel(level)
+}
+
+// ParseModuleLevels parses the levels of subsystems in format
+// `registry=debug,backend=warn`.
+func ParseModuleLevels(spec string) (map[string]logrus.Level, error) {
+	levels := map[string]logrus.Level{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid module log level %s, should be <module>=<level>", item)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !isModule(name) {
+			return nil, fmt.Errorf("unknown log module %s, should be one of %s", name, strings.Join(modules, ", "))
+		}
+		level, err := logrus.ParseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+func isModule(name string) bool {
+	for _, module := range modules {
+		if module == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Setup configures the global logger and the loggers of subsystems,
+// format is `text` or `json`. Subsystems absent in moduleLevels follow
+// the global level.
+func Setup(level logrus.Level, format string, moduleLevels map[string]logrus.Level) error {
+	var formatter logrus.Formatter
+	switch format {
+	case "", "text":
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unsupported log format %s, should be text or json", format)
+	}
+	logrus.SetFormatter(formatter)
+	logrus.SetLevel(level)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, name := range modules {
+		logger, ok := loggers[name]
+		if !ok {
+			logger = newModuleLogger()
+			loggers[name] = logger
+		}
+		logger.SetFormatter(formatter)
+		moduleLevel, ok := moduleLevels[name]
+		if !ok {
+			moduleLevel = level
+		}
+		logger.SetLevel(moduleLevel)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseModuleLevels(t *testing.T) {
+	levels, err := ParseModuleLevels("registry=debug, backend=warn")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]logrus.Level{
+		ModuleRegistry: logrus.DebugLevel,
+		ModuleBackend:  logrus.WarnLevel,
+	}, levels)
+
+	levels, err = ParseModuleLevels("")
+	assert.Nil(t, err)
+	assert.Empty(t, levels)
+
+	_, err = ParseModuleLevels("fuse=debug")
+	assert.NotNil(t, err)
+	_, err = ParseModuleLevels("registry")
+	assert.NotNil(t, err)
+	_, err = ParseModuleLevels("registry=verbose")
+	assert.NotNil(t, err)
+}
+
+func TestModuleLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+
+	registry := Module(ModuleRegistry)
+	registry.Logger.SetOutput(&buf)
+	backend := Module(ModuleBackend)
+	backend.Logger.SetOutput(&buf)
+
+	assert.Nil(t, Setup(logrus.InfoLevel, "json", map[string]logrus.Level{
+		ModuleRegistry: logrus.DebugLevel,
+	}))
+	registry.Debug("registry debug")
+	backend.Debug("backend debug")
+
+	var entry map[string]string
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "registry debug", entry["msg"])
+	assert.Equal(t, ModuleRegistry, entry["module"])
+
+	// Switch level at runtime.
+	buf.Reset()
+	SetModuleLevel(ModuleRegistry, logrus.WarnLevel)
+	registry.Info("registry info")
+	assert.Empty(t, buf.String())
+
+	assert.NotNil(t, Setup(logrus.InfoLevel, "xml", nil))
+}
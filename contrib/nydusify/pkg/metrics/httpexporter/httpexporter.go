@@ -0,0 +1,60 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package httpexporter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+)
+
+// HTTPExporter serves metrics on `/metrics` of a listener for Prometheus
+// to scrape during conversion.
+type HTTPExporter struct {
+	server *http.Server
+}
+
+// New starts listening on addr, metrics.Register must be called before
+// the first scrape.
+func New(addr string) (*HTTPExporter, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen metrics on %s", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if metrics.Registry == nil {
+			http.Error(w, "metrics not registered", http.StatusServiceUnavailable)
+			return
+		}
+		promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Warnf("Serve metrics on %s: %s", addr, err)
+		}
+	}()
+	logrus.Infof("Serving metrics on http://%s/metrics", listener.Addr())
+
+	return &HTTPExporter{server: server}, nil
+}
+
+// Export stops the listener, in-flight scrapes are given a few seconds
+// to complete.
+func (exp *HTTPExporter) Export() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exp.server.Shutdown(ctx)
+}
@@ -21,6 +21,13 @@ const (
 	convertSuccessCountKey = "convert_success_count_key"
 	convertFailureCountKey = "convert_failure_count_key"
 	storeCacheDurationKey  = "store_cache_duration"
+	verifyFailureCountKey  = "verify_signature_failure_count"
+	layerDurationKey       = "layer_duration_seconds"
+	buildCacheCountKey     = "build_cache_count"
+	backendFailureCountKey = "backend_failure_count"
+	backendRetryCountKey   = "backend_retry_count"
+	backendBreakerStateKey = "backend_breaker_state"
+	inflightLayersKey      = "inflight_layers"
 	namespace              = "nydusify"
 	subsystem              = "convert"
 )
@@ -65,28 +72,108 @@ var (
 		},
 		[]string{"source_reference"},
 	)
+
+	verifyFailureCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      verifyFailureCountKey,
+			Help:      "The total image signature verification failure times. Broken down by references and reason.",
+		},
+		[]string{"reference", "reason"},
+	)
+
+	layerDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      layerDurationKey,
+			Help:      "The duration of pulling, building and pushing a layer. Broken down by stage.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+		},
+		[]string{"stage"},
+	)
+
+	buildCacheCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      buildCacheCountKey,
+			Help:      "The total times of looking up layers in build cache. Broken down by result (hit or miss).",
+		},
+		[]string{"result"},
+	)
+
+	backendFailureCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      backendFailureCountKey,
+			Help:      "The total failure times of storage backend requests, including retried ones. Broken down by backend type.",
+		},
+		[]string{"backend_type"},
+	)
+
+	backendRetryCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      backendRetryCountKey,
+			Help:      "The total retry times of storage backend requests. Broken down by backend type.",
+		},
+		[]string{"backend_type"},
+	)
+
+	backendBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      backendBreakerStateKey,
+			Help:      "The circuit breaker state of storage backend host (0 closed, 1 open, 2 half-open). Broken down by host.",
+		},
+		[]string{"host"},
+	)
+
+	inflightLayers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      inflightLayersKey,
+			Help:      "The number of layers in progress. Broken down by stage.",
+		},
+		[]string{"stage"},
+	)
+)
+
+// Stages of layer conversion.
+const (
+	StagePull  = "pull"
+	StageBuild = "build"
+	StagePush  = "push"
 )
 
 var register sync.Once
 var Registry *prometheus.Registry
-var exporter Exporter
+var exporters []Exporter
 
 func sinceInSeconds(start time.Time) float64 {
 	return time.Since(start).Seconds()
 }
 
 // Register registers metrics. This is always called only once.
-func Register(exp Exporter) {
+func Register(exps ...Exporter) {
 	register.Do(func() {
 		Registry = prometheus.NewRegistry()
-		Registry.MustRegister(convertDuration, convertSuccessCount, convertFailureCount, storeCacheDuration)
-		exporter = exp
+		Registry.MustRegister(
+			convertDuration, convertSuccessCount, convertFailureCount, storeCacheDuration, verifyFailureCount,
+			layerDuration, buildCacheCount, backendFailureCount, backendRetryCount, backendBreakerState, inflightLayers,
+		)
+		exporters = exps
 	})
 }
 
 func Export() {
-	// In case no exporter was ever registered.
-	if exporter != nil {
+	for _, exporter := range exporters {
 		exporter.Export()
 	}
 }
@@ -106,3 +193,38 @@ func ConversionFailureCount(ref string, reason string) {
 func StoreCacheDuration(ref string, start time.Time) {
 	storeCacheDuration.WithLabelValues(ref).Add(sinceInSeconds(start))
 }
+
+func VerifySignatureFailureCount(ref string, reason string) {
+	verifyFailureCount.WithLabelValues(ref, reason).Inc()
+}
+
+// LayerStage marks a layer entering the stage, the returned function
+// should be called once the stage is done.
+func LayerStage(stage string) func() {
+	start := time.Now()
+	inflightLayers.WithLabelValues(stage).Inc()
+	return func() {
+		inflightLayers.WithLabelValues(stage).Dec()
+		layerDuration.WithLabelValues(stage).Observe(sinceInSeconds(start))
+	}
+}
+
+func BuildCacheCount(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	buildCacheCount.WithLabelValues(result).Inc()
+}
+
+func BackendFailureCount(backendType string) {
+	backendFailureCount.WithLabelValues(backendType).Inc()
+}
+
+func BackendRetryCount(backendType string) {
+	backendRetryCount.WithLabelValues(backendType).Inc()
+}
+
+func BackendBreakerState(host string, state int) {
+	backendBreakerState.WithLabelValues(host).Set(float64(state))
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package migrate upgrades the Nydus images converted by older nydusify in
+// place, the RAFS version of bootstrap is detected and annotated on the
+// bootstrap layer, so that the image can be negotiated by version without
+// converting it again. The blobs and bootstrap aren't changed.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+type Opt struct {
+	Target         string
+	TargetInsecure bool
+	ExpectedArch   string
+	// DryRun detects the version without pushing anything.
+	DryRun bool
+}
+
+// Result is the report of migration.
+type Result struct {
+	FsVersion string `json:"fs_version"`
+	// Migrated is false if the image is already up to date.
+	Migrated bool          `json:"migrated"`
+	Digest   digest.Digest `json:"digest"`
+}
+
+// rewriteList updates the descriptors in the list field of raw manifest or
+// index by update, the other fields are kept as is. It returns nil if
+// nothing is updated.
+func rewriteList(data []byte, field string, update func(descs []ocispec.Descriptor) bool) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	var descs []ocispec.Descriptor
+	if err := json.Unmarshal(fields[field], &descs); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %s", field)
+	}
+	if !update(descs) {
+		return nil, nil
+	}
+	list, err := json.Marshal(descs)
+	if err != nil {
+		return nil, err
+	}
+	fields[field] = list
+	return json.Marshal(fields)
+}
+
+// annotateFsVersion sets the RAFS version on the bootstrap layer of raw
+// Nydus manifest.
+func annotateFsVersion(manifest []byte, version string) ([]byte, error) {
+	data, err := rewriteList(manifest, "layers", func(layers []ocispec.Descriptor) bool {
+		if len(layers) == 0 {
+			return false
+		}
+		bootstrap := &layers[len(layers)-1]
+		if bootstrap.Annotations == nil {
+			bootstrap.Annotations = map[string]string{}
+		}
+		bootstrap.Annotations[utils.LayerAnnotationNydusFsVersion] = version
+		return true
+	})
+	if err == nil && data == nil {
+		err = fmt.Errorf("no bootstrap layer")
+	}
+	return data, errors.Wrap(err, "annotate Nydus manifest")
+}
+
+// replaceManifest replaces the manifest of old digest in raw index.
+func replaceManifest(index []byte, old digest.Digest, desc ocispec.Descriptor) ([]byte, error) {
+	data, err := rewriteList(index, "manifests", func(manifests []ocispec.Descriptor) bool {
+		for idx := range manifests {
+			if manifests[idx].Digest == old {
+				manifests[idx].Digest = desc.Digest
+				manifests[idx].Size = desc.Size
+				return true
+			}
+		}
+		return false
+	})
+	if err == nil && data == nil {
+		err = fmt.Errorf("manifest %s isn't found", old)
+	}
+	return data, errors.Wrap(err, "update manifest index")
+}
+
+func pullRaw(ctx context.Context, r *remote.Remote, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := r.Pull(ctx, desc, true)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// detectFsVersion pulls the bootstrap of Nydus image and reads its version.
+func detectFsVersion(ctx context.Context, p *parser.Parser, image *parser.Image) (string, error) {
+	file, err := ioutil.TempFile("", "nydusify-migrate-")
+	if err != nil {
+		return "", errors.Wrap(err, "create bootstrap file")
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	reader, err := p.PullNydusBootstrap(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, file.Name()); err != nil {
+		return "", errors.Wrap(err, "unpack Nydus bootstrap layer")
+	}
+	return dedup.ReadFsVersion(file.Name())
+}
+
+// Migrate annotates the Nydus image of expected architecture with its RAFS
+// version, the manifest (and manifest index) is pushed to the same tag.
+func Migrate(ctx context.Context, opt Opt) (*Result, error) {
+	targetRemote, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parser.New(targetRemote, opt.ExpectedArch)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := p.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Nydus image")
+	}
+	image := parsed.NydusImage
+	if image == nil {
+		return nil, fmt.Errorf("not found Nydus image of %s", opt.Target)
+	}
+
+	if version := parser.FsVersion(&image.Manifest); version != "" {
+		logrus.Infof("Nydus image %s is up to date, RAFS v%s", opt.Target, version)
+		return &Result{FsVersion: version, Digest: image.Desc.Digest}, nil
+	}
+	version, err := detectFsVersion(ctx, p, image)
+	if err != nil {
+		return nil, errors.Wrap(err, "detect RAFS version")
+	}
+	result := &Result{FsVersion: version, Migrated: true, Digest: image.Desc.Digest}
+	if opt.DryRun {
+		logrus.Infof("Nydus image %s would be annotated with RAFS v%s", opt.Target, version)
+		return result, nil
+	}
+
+	manifest, err := pullRaw(ctx, targetRemote, image.Desc)
+	if err != nil {
+		return nil, errors.Wrap(err, "pull Nydus manifest")
+	}
+	manifest, err = annotateFsVersion(manifest, version)
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc := image.Desc
+	manifestDesc.Digest = digest.FromBytes(manifest)
+	manifestDesc.Size = int64(len(manifest))
+	result.Digest = manifestDesc.Digest
+
+	// The manifest is pushed by digest in manifest index.
+	if parsed.Index == nil {
+		if err := targetRemote.Push(ctx, manifestDesc, false, bytes.NewReader(manifest)); err != nil {
+			return nil, errors.Wrap(err, "push Nydus manifest")
+		}
+		logrus.Infof("Migrated Nydus image %s to %s with RAFS v%s", opt.Target, manifestDesc.Digest, version)
+		return result, nil
+	}
+	if err := targetRemote.Push(ctx, manifestDesc, true, bytes.NewReader(manifest)); err != nil {
+		return nil, errors.Wrap(err, "push Nydus manifest")
+	}
+
+	indexDesc, err := targetRemote.Resolve(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve manifest index")
+	}
+	index, err := pullRaw(ctx, targetRemote, *indexDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "pull manifest index")
+	}
+	index, err = replaceManifest(index, image.Desc.Digest, manifestDesc)
+	if err != nil {
+		return nil, err
+	}
+	newIndexDesc := ocispec.Descriptor{
+		MediaType: indexDesc.MediaType,
+		Digest:    digest.FromBytes(index),
+		Size:      int64(len(index)),
+	}
+	if err := targetRemote.Push(ctx, newIndexDesc, false, bytes.NewReader(index)); err != nil {
+		return nil, errors.Wrap(err, "push manifest index")
+	}
+	logrus.Infof("Migrated Nydus image %s to %s with RAFS v%s, manifest index %s", opt.Target, manifestDesc.Digest, version, newIndexDesc.Digest)
+
+	return result, nil
+}
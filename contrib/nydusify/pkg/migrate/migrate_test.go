@@ -0,0 +1,62 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package migrate
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestAnnotateFsVersion(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.nydus.blob.v1","size":1,"digest":"sha256:aa"},` +
+		`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","size":2,"digest":"sha256:bb",` +
+		`"annotations":{"containerd.io/snapshot/nydus-bootstrap":"true"}}],"annotations":{"key":"value"}}`)
+	data, err := annotateFsVersion(manifest, "5")
+	assert.Nil(t, err)
+
+	var parsed struct {
+		MediaType string `json:"mediaType"`
+		ocispec.Manifest
+	}
+	assert.Nil(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, ocispec.MediaTypeImageManifest, parsed.MediaType)
+	assert.Equal(t, "value", parsed.Annotations["key"])
+	assert.Len(t, parsed.Layers, 2)
+	assert.Nil(t, parsed.Layers[0].Annotations)
+	assert.Equal(t, "5", parsed.Layers[1].Annotations[utils.LayerAnnotationNydusFsVersion])
+	assert.Equal(t, "true", parsed.Layers[1].Annotations[utils.LayerAnnotationNydusBootstrap])
+
+	_, err = annotateFsVersion([]byte(`{"layers":[]}`), "5")
+	assert.NotNil(t, err)
+}
+
+func TestReplaceManifest(t *testing.T) {
+	old := digest.FromString("old")
+	index := []byte(`{"schemaVersion":2,"manifests":[` +
+		`{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":1,"digest":"sha256:aa","platform":{"architecture":"amd64","os":"linux"}},` +
+		`{"mediaType":"application/vnd.oci.image.manifest.v1+json","size":2,"digest":"` + old.String() + `",` +
+		`"platform":{"architecture":"amd64","os":"linux","os.features":["nydus.remoteimage.v1"]}}]}`)
+	desc := ocispec.Descriptor{Digest: digest.FromString("new"), Size: 3}
+	data, err := replaceManifest(index, old, desc)
+	assert.Nil(t, err)
+
+	var parsed ocispec.Index
+	assert.Nil(t, json.Unmarshal(data, &parsed))
+	assert.Len(t, parsed.Manifests, 2)
+	assert.Equal(t, digest.Digest("sha256:aa"), parsed.Manifests[0].Digest)
+	assert.Equal(t, desc.Digest, parsed.Manifests[1].Digest)
+	assert.Equal(t, int64(3), parsed.Manifests[1].Size)
+	assert.Equal(t, []string{utils.ManifestOSFeatureNydus}, parsed.Manifests[1].Platform.OSFeatures)
+
+	_, err = replaceManifest(index, digest.FromString("missing"), desc)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mount mounts Nydus image read-only at a local path by Nydusd,
+// without containerd and snapshotter, it's mostly used by developers to
+// look into the image.
+package mount
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/prefetch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+type Opt struct {
+	// WorkDir stores the bootstrap, Nydusd config and blob cache, a
+	// temporary directory is created and removed on umount if unset.
+	WorkDir        string
+	Target         string
+	TargetInsecure bool
+	ExpectedArch   string
+	NydusdPath     string
+	// BackendType defaults to registry, the backend config is generated
+	// from target reference if unset.
+	BackendType    string
+	BackendConfig  string
+	PrefetchPolicy prefetch.Policy
+	Mountpoint     string
+}
+
+// Mounter keeps the Nydusd instance of mounted image.
+type Mounter struct {
+	Opt
+	nydusd        *tool.Nydusd
+	image         *parser.Image
+	removeWorkDir bool
+}
+
+// Mount pulls the bootstrap of target image and mounts it by Nydusd, the
+// blobs are fetched on demand from storage backend.
+func Mount(ctx context.Context, opt Opt) (*Mounter, error) {
+	mounter := &Mounter{Opt: opt}
+	if mounter.BackendType == "" {
+		mounter.BackendType = "registry"
+	}
+	if mounter.BackendConfig == "" {
+		if mounter.BackendType != "registry" {
+			return nil, fmt.Errorf("backend config is required for backend type %s", mounter.BackendType)
+		}
+		config, err := provider.RegistryBackendConfig(mounter.Target, mounter.TargetInsecure)
+		if err != nil {
+			return nil, errors.Wrap(err, "generate registry backend config")
+		}
+		mounter.BackendConfig = config
+	}
+
+	if mounter.WorkDir == "" {
+		workDir, err := ioutil.TempDir("", "nydusify-mount-")
+		if err != nil {
+			return nil, errors.Wrap(err, "create work directory")
+		}
+		mounter.WorkDir = workDir
+		mounter.removeWorkDir = true
+	}
+
+	if err := mounter.mount(ctx); err != nil {
+		mounter.cleanup()
+		return nil, err
+	}
+	return mounter, nil
+}
+
+// pullImage pulls the bootstrap of Nydus image to bootstrapPath, and
+// resolves the prefetch policy with the one written in image.
+func pullImage(ctx context.Context, target string, insecure bool, arch string, policy prefetch.Policy, bootstrapPath string) (*parser.Image, prefetch.Policy, error) {
+	targetRemote, err := provider.DefaultRemote(target, insecure)
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := parser.New(targetRemote, arch)
+	if err != nil {
+		return nil, "", err
+	}
+	parsed, err := p.Parse(ctx)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "parse Nydus image")
+	}
+	if parsed.NydusImage == nil {
+		return nil, "", fmt.Errorf("not found Nydus image of %s", target)
+	}
+
+	var annotations map[string]string
+	for _, layer := range parsed.NydusImage.Manifest.Layers {
+		if layer.Annotations[utils.LayerAnnotationNydusBootstrap] == "true" {
+			annotations = layer.Annotations
+		}
+	}
+	policy, err = prefetch.ResolvePolicy(policy, annotations, prefetch.PolicyOnDemand)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "resolve prefetch policy")
+	}
+
+	reader, err := p.PullNydusBootstrap(ctx, parsed.NydusImage)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	if err := utils.UnpackFile(reader, utils.BootstrapFileNameInLayer, bootstrapPath); err != nil {
+		return nil, "", errors.Wrap(err, "unpack Nydus bootstrap layer")
+	}
+
+	return parsed.NydusImage, policy, nil
+}
+
+func (mounter *Mounter) mount(ctx context.Context) error {
+	blobCacheDir := filepath.Join(mounter.WorkDir, "cache")
+	if err := os.MkdirAll(blobCacheDir, 0755); err != nil {
+		return errors.Wrap(err, "create blob cache directory")
+	}
+	if err := os.MkdirAll(mounter.Mountpoint, 0755); err != nil {
+		return errors.Wrap(err, "create mountpoint")
+	}
+
+	bootstrapPath := filepath.Join(mounter.WorkDir, "nydus_bootstrap")
+	image, policy, err := pullImage(ctx, mounter.Target, mounter.TargetInsecure, mounter.ExpectedArch, mounter.PrefetchPolicy, bootstrapPath)
+	if err != nil {
+		return err
+	}
+
+	nydusd, err := tool.NewNydusd(tool.NydusdConfig{
+		NydusdPath:     mounter.NydusdPath,
+		BackendType:    mounter.BackendType,
+		BackendConfig:  mounter.BackendConfig,
+		BootstrapPath:  bootstrapPath,
+		ConfigPath:     filepath.Join(mounter.WorkDir, "nydusd_config.json"),
+		BlobCacheDir:   blobCacheDir,
+		MountPath:      mounter.Mountpoint,
+		APISockPath:    mounter.APISock(),
+		PrefetchPolicy: policy,
+	})
+	if err != nil {
+		return errors.Wrap(err, "create Nydusd daemon")
+	}
+	if err := nydusd.Mount(); err != nil {
+		return errors.Wrap(err, "mount Nydus image by Nydusd")
+	}
+	mounter.nydusd = nydusd
+	mounter.image = image
+
+	logrus.Infof("Mounted Nydus image %s to %s with prefetch policy %s", mounter.Target, mounter.Mountpoint, policy)
+	return nil
+}
+
+// APISock returns the API socket path of Nydusd, e.g. to get the metrics of
+// mounted image.
+func (mounter *Mounter) APISock() string {
+	return filepath.Join(mounter.WorkDir, "nydusd_api.sock")
+}
+
+// Image returns the mounted Nydus image.
+func (mounter *Mounter) Image() *parser.Image {
+	return mounter.image
+}
+
+func (mounter *Mounter) cleanup() {
+	if !mounter.removeWorkDir {
+		return
+	}
+	if err := os.RemoveAll(mounter.WorkDir); err != nil {
+		logrus.Warnf("Remove work directory %s: %s", mounter.WorkDir, err)
+	}
+}
+
+// Umount umounts the image to stop Nydusd, the temporary work directory
+// is removed then.
+func (mounter *Mounter) Umount() error {
+	if mounter.nydusd != nil {
+		if err := mounter.nydusd.Umount(); err != nil {
+			return errors.Wrap(err, "umount Nydus image")
+		}
+		mounter.nydusd = nil
+		logrus.Infof("Umounted Nydus image from %s", mounter.Mountpoint)
+	}
+	mounter.cleanup()
+	return nil
+}
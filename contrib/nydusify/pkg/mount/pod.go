@@ -0,0 +1,246 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mount
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/checker/tool"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/prefetch"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// PodImage is a Nydus image mounted at the subdirectory Name of the pod
+// mountpoint.
+type PodImage struct {
+	Name   string
+	Target string
+}
+
+type PodOpt struct {
+	// WorkDir stores the bootstraps and the blob cache shared by images, a
+	// temporary directory is created and removed on umount if unset.
+	WorkDir        string
+	Images         []PodImage
+	TargetInsecure bool
+	ExpectedArch   string
+	NydusdPath     string
+	PrefetchPolicy prefetch.Policy
+	Mountpoint     string
+}
+
+// PodMounter keeps the Nydusd instance serving all images of pod.
+type PodMounter struct {
+	PodOpt
+	// SharedBlobs is the number of blobs referenced by more than one image,
+	// which are fetched and cached once.
+	SharedBlobs   int
+	nydusd        *tool.Nydusd
+	removeWorkDir bool
+}
+
+type podContainer struct {
+	Name  string `yaml:"name"`
+	Image string `yaml:"image"`
+}
+
+type podSpec struct {
+	InitContainers []podContainer `yaml:"initContainers"`
+	Containers     []podContainer `yaml:"containers"`
+}
+
+// podManifest is the subset of Pod, or workload resource with pod template
+// such as Deployment, in YAML or JSON.
+type podManifest struct {
+	Spec struct {
+		podSpec  `yaml:",inline"`
+		Template struct {
+			Spec podSpec `yaml:"spec"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+func validPodImageName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// ParsePodImages returns the images of init containers and containers in
+// pod manifest, named by container names. The containers with the same
+// image share the image of the first one.
+func ParsePodImages(data []byte) ([]PodImage, error) {
+	images := []PodImage{}
+	names := map[string]string{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var manifest podManifest
+		if err := decoder.Decode(&manifest); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "parse pod manifest")
+		}
+		spec := manifest.Spec
+		containers := append(append(spec.InitContainers, spec.Containers...), spec.Template.Spec.InitContainers...)
+		containers = append(containers, spec.Template.Spec.Containers...)
+		for _, container := range containers {
+			if container.Image == "" {
+				continue
+			}
+			if name, ok := names[container.Image]; ok {
+				logrus.Infof("Container %s shares image %s with container %s", container.Name, container.Image, name)
+				continue
+			}
+			names[container.Image] = container.Name
+			images = append(images, PodImage{Name: container.Name, Target: container.Image})
+		}
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no container image in pod manifest")
+	}
+	return images, nil
+}
+
+// ParsePodImagesFile reads the images from pod manifest file.
+func ParsePodImagesFile(path string) ([]PodImage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read pod manifest")
+	}
+	return ParsePodImages(data)
+}
+
+// MountPod mounts the images of pod by a single Nydusd at the
+// subdirectories of mountpoint, the RAFS instances share the blob cache,
+// so the blobs referenced by several images (e.g. deduplicated by chunk
+// dict) are fetched once. The blobs are fetched on demand from the
+// registry storage backend of each image.
+func MountPod(ctx context.Context, opt PodOpt) (*PodMounter, error) {
+	if len(opt.Images) == 0 {
+		return nil, fmt.Errorf("no image to mount")
+	}
+	names := map[string]bool{}
+	for _, image := range opt.Images {
+		if !validPodImageName(image.Name) {
+			return nil, fmt.Errorf("invalid name %q of image %s", image.Name, image.Target)
+		}
+		if names[image.Name] {
+			return nil, fmt.Errorf("duplicated name %s of images", image.Name)
+		}
+		names[image.Name] = true
+	}
+
+	mounter := &PodMounter{PodOpt: opt}
+	if mounter.WorkDir == "" {
+		workDir, err := ioutil.TempDir("", "nydusify-mount-")
+		if err != nil {
+			return nil, errors.Wrap(err, "create work directory")
+		}
+		mounter.WorkDir = workDir
+		mounter.removeWorkDir = true
+	}
+
+	if err := mounter.mount(ctx); err != nil {
+		mounter.Umount()
+		return nil, err
+	}
+	return mounter, nil
+}
+
+func (mounter *PodMounter) mount(ctx context.Context) error {
+	blobCacheDir := filepath.Join(mounter.WorkDir, "cache")
+	if err := os.MkdirAll(blobCacheDir, 0755); err != nil {
+		return errors.Wrap(err, "create blob cache directory")
+	}
+	if err := os.MkdirAll(mounter.Mountpoint, 0755); err != nil {
+		return errors.Wrap(err, "create mountpoint")
+	}
+
+	nydusd, err := tool.NewNydusd(tool.NydusdConfig{
+		NydusdPath:  mounter.NydusdPath,
+		MountPath:   mounter.Mountpoint,
+		APISockPath: mounter.APISock(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "create Nydusd daemon")
+	}
+	if err := nydusd.Mount(); err != nil {
+		return errors.Wrap(err, "start Nydusd")
+	}
+	mounter.nydusd = nydusd
+
+	blobImages := map[string]int{}
+	for _, image := range mounter.Images {
+		imageDir := filepath.Join(mounter.WorkDir, image.Name)
+		if err := os.MkdirAll(imageDir, 0755); err != nil {
+			return errors.Wrap(err, "create image directory")
+		}
+		bootstrapPath := filepath.Join(imageDir, "nydus_bootstrap")
+		parsed, policy, err := pullImage(ctx, image.Target, mounter.TargetInsecure, mounter.ExpectedArch, mounter.PrefetchPolicy, bootstrapPath)
+		if err != nil {
+			return errors.Wrapf(err, "pull image %s", image.Target)
+		}
+		backendConfig, err := provider.RegistryBackendConfig(image.Target, mounter.TargetInsecure)
+		if err != nil {
+			return errors.Wrap(err, "generate registry backend config")
+		}
+
+		if err := nydusd.MountRafs("/"+image.Name, tool.NydusdConfig{
+			BackendType:    "registry",
+			BackendConfig:  backendConfig,
+			BootstrapPath:  bootstrapPath,
+			BlobCacheDir:   blobCacheDir,
+			PrefetchPolicy: policy,
+		}); err != nil {
+			return errors.Wrapf(err, "mount image %s", image.Target)
+		}
+		for _, layer := range parsed.Manifest.Layers {
+			if layer.Annotations[utils.LayerAnnotationNydusBlob] == "true" {
+				blobImages[layer.Digest.Hex()]++
+			}
+		}
+		logrus.Infof("Mounted Nydus image %s to %s with prefetch policy %s", image.Target, filepath.Join(mounter.Mountpoint, image.Name), policy)
+	}
+	for _, count := range blobImages {
+		if count > 1 {
+			mounter.SharedBlobs++
+		}
+	}
+
+	return nil
+}
+
+// APISock returns the API socket path of Nydusd.
+func (mounter *PodMounter) APISock() string {
+	return filepath.Join(mounter.WorkDir, "nydusd_api.sock")
+}
+
+// Umount umounts all images to stop Nydusd, the temporary work directory
+// is removed then.
+func (mounter *PodMounter) Umount() error {
+	if mounter.nydusd != nil {
+		if err := mounter.nydusd.Umount(); err != nil {
+			return errors.Wrap(err, "umount pod images")
+		}
+		mounter.nydusd = nil
+		logrus.Infof("Umounted pod images from %s", mounter.Mountpoint)
+	}
+	if mounter.removeWorkDir {
+		if err := os.RemoveAll(mounter.WorkDir); err != nil {
+			logrus.Warnf("Remove work directory %s: %s", mounter.WorkDir, err)
+		}
+	}
+	return nil
+}
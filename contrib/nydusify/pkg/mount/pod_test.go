@@ -0,0 +1,58 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePodImages(t *testing.T) {
+	images, err := ParsePodImages([]byte(`
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  initContainers:
+  - name: init
+    image: myregistry/init:v1-nydus
+  containers:
+  - name: app
+    image: myregistry/app:v1-nydus
+  - name: sidecar
+    image: myregistry/sidecar:v1-nydus
+  - name: sidecar2
+    image: myregistry/sidecar:v1-nydus
+---
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: myregistry/web:v1-nydus
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, []PodImage{
+		{Name: "init", Target: "myregistry/init:v1-nydus"},
+		{Name: "app", Target: "myregistry/app:v1-nydus"},
+		{Name: "sidecar", Target: "myregistry/sidecar:v1-nydus"},
+		{Name: "web", Target: "myregistry/web:v1-nydus"},
+	}, images)
+
+	images, err = ParsePodImages([]byte(`{"spec": {"containers": [{"name": "app", "image": "myregistry/app:v1-nydus"}]}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []PodImage{{Name: "app", Target: "myregistry/app:v1-nydus"}}, images)
+
+	_, err = ParsePodImages([]byte(`kind: ConfigMap`))
+	assert.NotNil(t, err)
+
+	assert.True(t, validPodImageName("app"))
+	assert.False(t, validPodImageName(".."))
+	assert.False(t, validPodImageName("a/b"))
+}
@@ -30,6 +30,11 @@ type Parser struct {
 	// knows how to choose the source image. In case of single manifest, `interestedArch`
 	// is the same with origin.
 	interestedArch string
+	// interestedOS is `linux` except for the parser of Windows image, and
+	// interestedOSVersion tells apart the Windows manifests of the same
+	// architecture if it's set.
+	interestedOS        string
+	interestedOSVersion string
 }
 
 // Image presents image contents.
@@ -56,9 +61,25 @@ func New(remote *remote.Remote, interestedArch string) (*Parser, error) {
 	return &Parser{
 		Remote:         remote,
 		interestedArch: interestedArch,
+		interestedOS:   utils.SupportedOS,
 	}, nil
 }
 
+// NewWithPlatform creates Nydus image parser instance selecting the manifest
+// of platform from manifest index, the OS may be `windows` and the OS version
+// is matched too if it's specified.
+func NewWithPlatform(remote *remote.Remote, platform ocispec.Platform) (*Parser, error) {
+	parser, err := New(remote, platform.Architecture)
+	if err != nil {
+		return nil, err
+	}
+	if platform.OS != "" {
+		parser.interestedOS = platform.OS
+	}
+	parser.interestedOSVersion = platform.OSVersion
+	return parser, nil
+}
+
 // Try to find the topmost layer in Nydus manifest, it should
 // be a Nydus bootstrap layer, see examples/manifest/manifest.json
 func findNydusBootstrapDesc(manifest *ocispec.Manifest) *ocispec.Descriptor {
@@ -74,6 +95,16 @@ func findNydusBootstrapDesc(manifest *ocispec.Manifest) *ocispec.Descriptor {
 	return nil
 }
 
+// FsVersion returns the RAFS version annotated on the bootstrap layer of
+// Nydus manifest, it's empty for the images converted before the version is
+// annotated, see `nydusify migrate`.
+func FsVersion(manifest *ocispec.Manifest) string {
+	if desc := findNydusBootstrapDesc(manifest); desc != nil {
+		return desc.Annotations[utils.LayerAnnotationNydusFsVersion]
+	}
+	return ""
+}
+
 func (parser *Parser) pull(ctx context.Context, desc *ocispec.Descriptor, res interface{}) error {
 	reader, err := parser.Remote.Pull(ctx, *desc, true)
 	if err != nil {
@@ -165,10 +196,10 @@ func (parser *Parser) PullNydusBootstrap(ctx context.Context, image *Image) (io.
 }
 
 func (parser *Parser) matchImagePlatform(desc *ocispec.Descriptor) bool {
-	if parser.interestedArch == desc.Platform.Architecture && desc.Platform.OS == "linux" {
-		return true
+	if parser.interestedArch != desc.Platform.Architecture || parser.interestedOS != desc.Platform.OS {
+		return false
 	}
-	return false
+	return parser.interestedOSVersion == "" || parser.interestedOSVersion == desc.Platform.OSVersion
 }
 
 // Parse parses Nydus image reference into Parsed object.
@@ -0,0 +1,65 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package prefetch
+
+import (
+	"fmt"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Policy decides how Nydusd prefetches the data of Nydus image after mounted.
+type Policy string
+
+const (
+	// PolicyBackground prefetches the files in prefetch table of bootstrap
+	// first, then downloads all the blobs of image in background.
+	PolicyBackground Policy = "background"
+	// PolicyEager only prefetches the files in prefetch table of bootstrap.
+	PolicyEager Policy = "eager"
+	// PolicyOnDemand never prefetches, the data is only fetched on reading.
+	PolicyOnDemand Policy = "on-demand"
+)
+
+// ParsePolicy parses prefetch policy, empty string means the policy is
+// unspecified.
+func ParsePolicy(policy string) (Policy, error) {
+	switch Policy(policy) {
+	case "", PolicyBackground, PolicyEager, PolicyOnDemand:
+		return Policy(policy), nil
+	}
+	return "", fmt.Errorf("invalid prefetch policy %s, should be one of: %s, %s, %s",
+		policy, PolicyBackground, PolicyEager, PolicyOnDemand)
+}
+
+// ResolvePolicy resolves the prefetch policy of image, the policy written in
+// bootstrap layer annotations by nydusify overrides the one selected by mount
+// option, `fallback` is used if neither is specified.
+func ResolvePolicy(option Policy, annotations map[string]string, fallback Policy) (Policy, error) {
+	if value, ok := annotations[utils.LayerAnnotationNydusPrefetchPolicy]; ok {
+		policy, err := ParsePolicy(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid annotation %s: %s", utils.LayerAnnotationNydusPrefetchPolicy, err)
+		}
+		if policy != "" {
+			return policy, nil
+		}
+	}
+	if option != "" {
+		return option, nil
+	}
+	return fallback, nil
+}
+
+// Enabled returns whether `fs_prefetch.enable` is set in Nydusd configuration.
+func (p Policy) Enabled() bool {
+	return p == PolicyBackground || p == PolicyEager
+}
+
+// PrefetchAll returns whether `fs_prefetch.prefetch_all` is set in Nydusd
+// configuration.
+func (p Policy) PrefetchAll() bool {
+	return p == PolicyBackground
+}
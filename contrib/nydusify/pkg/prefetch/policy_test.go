@@ -0,0 +1,47 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package prefetch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestResolvePolicy(t *testing.T) {
+	policy, err := ParsePolicy("eager")
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyEager, policy)
+	_, err = ParsePolicy("lazy")
+	assert.NotNil(t, err)
+
+	// Fallback without mount option and annotation.
+	policy, err = ResolvePolicy("", nil, PolicyBackground)
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyBackground, policy)
+	// Mount option overrides fallback.
+	policy, err = ResolvePolicy(PolicyOnDemand, map[string]string{}, PolicyBackground)
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyOnDemand, policy)
+	// Annotation overrides mount option.
+	policy, err = ResolvePolicy(PolicyOnDemand, map[string]string{
+		utils.LayerAnnotationNydusPrefetchPolicy: "eager",
+	}, PolicyBackground)
+	assert.Nil(t, err)
+	assert.Equal(t, PolicyEager, policy)
+	_, err = ResolvePolicy(PolicyOnDemand, map[string]string{
+		utils.LayerAnnotationNydusPrefetchPolicy: "lazy",
+	}, PolicyBackground)
+	assert.NotNil(t, err)
+
+	assert.True(t, PolicyBackground.Enabled())
+	assert.True(t, PolicyBackground.PrefetchAll())
+	assert.True(t, PolicyEager.Enabled())
+	assert.False(t, PolicyEager.PrefetchAll())
+	assert.False(t, PolicyOnDemand.Enabled())
+	assert.False(t, PolicyOnDemand.PrefetchAll())
+}
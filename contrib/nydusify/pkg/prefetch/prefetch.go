@@ -0,0 +1,171 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package prefetch generates the prefetch list of Nydus image from the file
+// access patterns recorded by Nydusd, the list is used by builder to put the
+// files into prefetch table of bootstrap.
+package prefetch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AccessPattern is the access record of a file exported by Nydusd API
+// `/api/v1/metrics/pattern`, which is only recorded with `access_pattern`
+// enabled in Nydusd configuration.
+type AccessPattern struct {
+	Ino                  uint64 `json:"ino"`
+	NrRead               uint64 `json:"nr_read"`
+	FirstAccessTimeSecs  uint64 `json:"first_access_time_secs"`
+	FirstAccessTimeNanos uint32 `json:"first_access_time_nanos"`
+}
+
+func (p AccessPattern) firstAccess() time.Time {
+	return time.Unix(int64(p.FirstAccessTimeSecs), int64(p.FirstAccessTimeNanos))
+}
+
+// FetchAccessPatterns gets the file access patterns from Nydusd API socket,
+// `id` is the mountpoint of RAFS instance, can be empty if Nydusd only
+// serves one instance.
+func FetchAccessPatterns(ctx context.Context, apiSock, id string) ([]AccessPattern, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				dialer := &net.Dialer{Timeout: 5 * time.Second}
+				return dialer.DialContext(ctx, "unix", apiSock)
+			},
+		},
+	}
+
+	endpoint := "http://unix/api/v1/metrics/pattern"
+	if id != "" {
+		endpoint += "?id=" + url.QueryEscape(id)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request Nydusd API")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read Nydusd API response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get access patterns from Nydusd: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var patterns []AccessPattern
+	if err := json.Unmarshal(body, &patterns); err != nil {
+		return nil, errors.Wrap(err, "unmarshal access patterns")
+	}
+	return patterns, nil
+}
+
+// ResolvePaths maps the inodes in access patterns to the paths of regular
+// files by walking the mountpoint of Nydus image, the paths are sorted by
+// first access time and are absolute paths in image rootfs.
+func ResolvePaths(mountpoint string, patterns []AccessPattern) ([]string, error) {
+	accessed := map[uint64]AccessPattern{}
+	for _, pattern := range patterns {
+		if pattern.NrRead > 0 {
+			accessed[pattern.Ino] = pattern
+		}
+	}
+
+	type file struct {
+		path    string
+		pattern AccessPattern
+	}
+	files := []file{}
+	// Hardlinks are prefetched once.
+	visited := map[uint64]bool{}
+	err := filepath.Walk(mountpoint, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		pattern, ok := accessed[stat.Ino]
+		if !ok || visited[stat.Ino] {
+			return nil
+		}
+		visited[stat.Ino] = true
+		rel, err := filepath.Rel(mountpoint, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{path: "/" + rel, pattern: pattern})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "walk mountpoint %s", mountpoint)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].pattern.firstAccess().Before(files[j].pattern.firstAccess())
+	})
+	paths := []string{}
+	for _, file := range files {
+		paths = append(paths, file.path)
+	}
+	return paths, nil
+}
+
+// WriteList writes the prefetch list, one path per line.
+func WriteList(w io.Writer, paths []string) error {
+	for _, path := range paths {
+		if _, err := fmt.Fprintln(w, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadList reads the prefetch list, the empty lines and the lines starting
+// with `#` are ignored, the paths should be absolute paths in image rootfs.
+func ReadList(r io.Reader) ([]string, error) {
+	paths := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			return nil, fmt.Errorf("invalid path %s in prefetch list, should be absolute path", line)
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read prefetch list")
+	}
+	return paths, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package prefetch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func inodeOf(t *testing.T, path string) uint64 {
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	return info.Sys().(*syscall.Stat_t).Ino
+}
+
+func TestResolvePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-prefetch-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "usr/bin"), 0755))
+	for _, name := range []string{"usr/bin/app", "etc-hosts", "unread"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	assert.Nil(t, os.Link(filepath.Join(dir, "usr/bin/app"), filepath.Join(dir, "usr/bin/app-link")))
+
+	paths, err := ResolvePaths(dir, []AccessPattern{
+		{Ino: inodeOf(t, filepath.Join(dir, "usr/bin/app")), NrRead: 2, FirstAccessTimeSecs: 20},
+		{Ino: inodeOf(t, filepath.Join(dir, "etc-hosts")), NrRead: 1, FirstAccessTimeSecs: 10},
+		{Ino: inodeOf(t, filepath.Join(dir, "unread")), NrRead: 0, FirstAccessTimeSecs: 5},
+		{Ino: inodeOf(t, filepath.Join(dir, "usr/bin")), NrRead: 1, FirstAccessTimeSecs: 1},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/etc-hosts", "/usr/bin/app"}, paths)
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteList(&buf, paths))
+	read, err := ReadList(strings.NewReader("# comment\n\n" + buf.String()))
+	assert.Nil(t, err)
+	assert.Equal(t, paths, read)
+
+	_, err = ReadList(strings.NewReader("relative/path\n"))
+	assert.NotNil(t, err)
+}
+
+func TestFetchAccessPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-prefetch-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "api.sock")
+	listener, err := net.Listen("unix", sock)
+	assert.Nil(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/metrics/pattern" || r.URL.Query().Get("id") != "/mnt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`[{"ino":3,"nr_read":8,"first_access_time_secs":1650000000,"first_access_time_nanos":100}]`))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	patterns, err := FetchAccessPatterns(context.Background(), sock, "/mnt")
+	assert.Nil(t, err)
+	assert.Equal(t, []AccessPattern{{Ino: 3, NrRead: 8, FirstAccessTimeSecs: 1650000000, FirstAccessTimeNanos: 100}}, patterns)
+
+	_, err = FetchAccessPatterns(context.Background(), sock, "")
+	assert.NotNil(t, err)
+}
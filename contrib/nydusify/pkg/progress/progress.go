@@ -0,0 +1,220 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package progress streams the structured progress events of conversion
+// as JSON lines, one event per line, for CI systems and other tools, or
+// passes them to the handler of the program embedding nydusify.
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+)
+
+const (
+	EventStage    = "stage"
+	EventProgress = "progress"
+	EventResult   = "result"
+
+	StatusStarted   = "started"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// StageEvent is emitted when a stage of conversion (e.g. `[SOUR] Mount
+// layer`) is started and finished.
+type StageEvent struct {
+	Type   string                 `json:"type"`
+	Time   time.Time              `json:"time"`
+	Stage  string                 `json:"stage"`
+	Status string                 `json:"status"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	// Duration in seconds of finished stage.
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// ProgressEvent is emitted when a layer is processed or uploaded.
+type ProgressEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// The source layers and their bytes, a layer is processed once it's
+	// built, or found in build cache or checkpoint.
+	Layers          int   `json:"layers"`
+	LayersProcessed int   `json:"layers_processed"`
+	Bytes           int64 `json:"bytes"`
+	BytesProcessed  int64 `json:"bytes_processed"`
+	// The Nydus blobs to upload, known once the layers are built.
+	Uploads          int   `json:"uploads"`
+	UploadsCompleted int   `json:"uploads_completed"`
+	BytesUploaded    int64 `json:"bytes_uploaded"`
+	// ETA in seconds estimated from the rate of processed bytes, it's
+	// omitted before any byte is processed.
+	ETA *float64 `json:"eta,omitempty"`
+}
+
+// ResultEvent is the final document of command.
+type ResultEvent struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Status   string    `json:"status"`
+	Source   string    `json:"source,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Duration float64   `json:"duration"`
+	// ExitCode and Class are the exit code of process and the name of its
+	// failure class, see package exitcode.
+	ExitCode int    `json:"exit_code"`
+	Class    string `json:"class"`
+	Error    string `json:"error,omitempty"`
+	// Detail is the output of command, e.g. the report of dry run.
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+// Handler receives the events, one of *StageEvent, *ProgressEvent and
+// *ResultEvent, it's called serially.
+type Handler func(event interface{})
+
+// Reporter passes the events to handler.
+type Reporter struct {
+	mutex   sync.Mutex
+	handler Handler
+	now     func() time.Time
+
+	start    time.Time
+	progress ProgressEvent
+}
+
+// NewReporter creates the reporter writing events to writer as JSON lines.
+func NewReporter(writer io.Writer) *Reporter {
+	return NewHandlerReporter(func(event interface{}) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		writer.Write(append(data, '\n'))
+	})
+}
+
+// NewHandlerReporter creates the reporter passing events to handler.
+func NewHandlerReporter(handler Handler) *Reporter {
+	return &Reporter{
+		handler: handler,
+		now:     time.Now,
+		start:   time.Now(),
+	}
+}
+
+func (r *Reporter) emit(event interface{}) {
+	r.handler(event)
+}
+
+// Emit writes the event, the time of event is filled by reporter.
+func (r *Reporter) Emit(event interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	switch e := event.(type) {
+	case *StageEvent:
+		e.Type, e.Time = EventStage, now
+	case *ProgressEvent:
+		e.Type, e.Time = EventProgress, now
+	case *ResultEvent:
+		e.Type, e.Time = EventResult, now
+	}
+	r.emit(event)
+}
+
+func (r *Reporter) emitProgress() {
+	event := r.progress
+	event.Type, event.Time = EventProgress, r.now()
+	if event.BytesProcessed > 0 {
+		elapsed := event.Time.Sub(r.start).Seconds()
+		eta := elapsed * float64(event.Bytes-event.BytesProcessed) / float64(event.BytesProcessed)
+		event.ETA = &eta
+	}
+	r.emit(&event)
+}
+
+func (r *Reporter) update(fn func(event *ProgressEvent)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fn(&r.progress)
+	r.emitProgress()
+}
+
+// AddLayers adds the source layers to process, it's called for each
+// platform of image.
+func (r *Reporter) AddLayers(layers int, bytes int64) {
+	if r == nil {
+		return
+	}
+	r.update(func(event *ProgressEvent) {
+		event.Layers += layers
+		event.Bytes += bytes
+	})
+}
+
+// LayerProcessed records a processed source layer, which produces a blob
+// to upload if upload is true.
+func (r *Reporter) LayerProcessed(bytes int64, upload bool) {
+	if r == nil {
+		return
+	}
+	r.update(func(event *ProgressEvent) {
+		event.LayersProcessed++
+		event.BytesProcessed += bytes
+		if upload {
+			event.Uploads++
+		}
+	})
+}
+
+// BlobUploaded records an uploaded blob.
+func (r *Reporter) BlobUploaded(bytes int64) {
+	if r == nil {
+		return
+	}
+	r.update(func(event *ProgressEvent) {
+		event.UploadsCompleted++
+		event.BytesUploaded += bytes
+	})
+}
+
+type logger struct {
+	reporter *Reporter
+}
+
+func (l *logger) Log(ctx context.Context, msg string, fields provider.LoggerFields) func(error) error {
+	l.reporter.Emit(&StageEvent{
+		Stage:  msg,
+		Status: StatusStarted,
+		Fields: fields,
+	})
+	start := time.Now()
+	return func(err error) error {
+		event := &StageEvent{
+			Stage:    msg,
+			Status:   StatusSucceeded,
+			Fields:   fields,
+			Duration: time.Since(start).Seconds(),
+		}
+		if err != nil {
+			event.Status = StatusFailed
+			event.Error = err.Error()
+		}
+		l.reporter.Emit(event)
+		return err
+	}
+}
+
+// Logger returns a ProgressLogger which emits the stages of conversion.
+func (r *Reporter) Logger() provider.ProgressLogger {
+	return &logger{reporter: r}
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package progress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func events(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	result := []map[string]interface{}{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		event := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		result = append(result, event)
+	}
+	return result
+}
+
+func TestReporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := NewReporter(buf)
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	r.start = start
+	r.now = func() time.Time { return now }
+
+	r.AddLayers(2, 300)
+	now = now.Add(10 * time.Second)
+	r.LayerProcessed(100, true)
+	r.BlobUploaded(50)
+	r.LayerProcessed(200, false)
+
+	done := r.Logger().Log(context.Background(), "[MANI] Push manifest", nil)
+	assert.NotNil(t, done(fmt.Errorf("unauthorized")))
+	r.Emit(&ResultEvent{Status: StatusFailed, ExitCode: 5, Class: "push"})
+
+	result := events(t, buf)
+	assert.Len(t, result, 7)
+	assert.Equal(t, EventProgress, result[0]["type"])
+	assert.Nil(t, result[0]["eta"])
+	// 100 of 300 bytes are processed in 10s.
+	assert.Equal(t, 20.0, result[1]["eta"])
+	assert.Equal(t, 1.0, result[1]["uploads"])
+	assert.Equal(t, 50.0, result[2]["bytes_uploaded"])
+	assert.Equal(t, 0.0, result[3]["eta"])
+	assert.Equal(t, 2.0, result[3]["layers_processed"])
+	assert.Equal(t, StatusStarted, result[4]["status"])
+	assert.Equal(t, StatusFailed, result[5]["status"])
+	assert.Equal(t, "unauthorized", result[5]["error"])
+	assert.Equal(t, EventResult, result[6]["type"])
+	assert.Equal(t, 5.0, result[6]["exit_code"])
+
+	// Nil reporter reports nothing.
+	var nilReporter *Reporter
+	nilReporter.AddLayers(1, 100)
+	nilReporter.LayerProcessed(100, true)
+	nilReporter.BlobUploaded(100)
+}
+
+func TestHandlerReporter(t *testing.T) {
+	result := []interface{}{}
+	r := NewHandlerReporter(func(event interface{}) {
+		result = append(result, event)
+	})
+	r.AddLayers(1, 100)
+	done := r.Logger().Log(context.Background(), "[SOUR] Mount layer", nil)
+	assert.Nil(t, done(nil))
+
+	assert.Len(t, result, 3)
+	assert.Equal(t, int64(100), result[0].(*ProgressEvent).Bytes)
+	assert.Equal(t, StatusStarted, result[1].(*StageEvent).Status)
+	assert.Equal(t, StatusSucceeded, result[2].(*StageEvent).Status)
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package provenance records how a Nydus image is converted as an in-toto
+// statement with SLSA provenance predicate, so that auditors can verify
+// what produced the image.
+package provenance
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// MediaTypeInToto is the media type (as well as artifact type) of
+	// in-toto statement.
+	MediaTypeInToto = "application/vnd.in-toto+json"
+	// AnnotationPredicateType is the annotation of attestation layer.
+	AnnotationPredicateType = "in-toto.io/predicate-type"
+
+	StatementType       = "https://in-toto.io/Statement/v0.1"
+	PredicateTypeSLSA   = "https://slsa.dev/provenance/v0.2"
+	BuildTypeConversion = "https://github.com/dragonflyoss/image-service/contrib/nydusify/convert@v1"
+	BuilderID           = "https://github.com/dragonflyoss/image-service/contrib/nydusify"
+)
+
+// Parameters are the options of conversion affecting the Nydus image.
+type Parameters struct {
+	// Compressor, DigestAlgorithm and ChunkSize are read from the bootstrap
+	// of image, Compressor is the requested one if bootstrap isn't built
+	// locally, e.g. all layers are from build cache.
+	Compressor       string `json:"compressor,omitempty"`
+	DigestAlgorithm  string `json:"digestAlgorithm,omitempty"`
+	ChunkSize        uint32 `json:"chunkSize,omitempty"`
+	AlignedChunk     bool   `json:"alignedChunk"`
+	ChunkDict        string `json:"chunkDict,omitempty"`
+	Flatten          bool   `json:"flatten"`
+	WhiteoutStrategy string `json:"whiteoutStrategy,omitempty"`
+	HardlinkStrategy string `json:"hardlinkStrategy,omitempty"`
+	// IncludePaths and ExcludePaths are the path patterns selecting the
+	// files of source layers.
+	IncludePaths     []string `json:"includePaths,omitempty"`
+	ExcludePaths     []string `json:"excludePaths,omitempty"`
+	PrefetchPatterns string   `json:"prefetchPatterns,omitempty"`
+	PrefetchPolicy   string   `json:"prefetchPolicy,omitempty"`
+	BackendType      string   `json:"backendType"`
+	DockerV2Format   bool     `json:"dockerV2Format"`
+}
+
+// Opt describes the conversion to record.
+type Opt struct {
+	Target          string
+	TargetDigest    digest.Digest
+	Source          string
+	SourceDigest    digest.Digest
+	NydusifyVersion string
+	BuilderVersion  string
+	Parameters      Parameters
+	StartedOn       time.Time
+	FinishedOn      time.Time
+}
+
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type Material struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type Predicate struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		Parameters  Parameters        `json:"parameters"`
+		Environment map[string]string `json:"environment,omitempty"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildStartedOn  string `json:"buildStartedOn"`
+		BuildFinishedOn string `json:"buildFinishedOn"`
+		Completeness    struct {
+			Parameters  bool `json:"parameters"`
+			Environment bool `json:"environment"`
+			Materials   bool `json:"materials"`
+		} `json:"completeness"`
+		Reproducible bool `json:"reproducible"`
+	} `json:"metadata"`
+	Materials []Material `json:"materials"`
+}
+
+// Statement is the in-toto statement of Nydus image.
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+func digestSet(dgst digest.Digest) map[string]string {
+	if dgst.Validate() != nil {
+		return nil
+	}
+	return map[string]string{dgst.Algorithm().String(): dgst.Encoded()}
+}
+
+// New creates the statement for the target image.
+func New(opt Opt) *Statement {
+	statement := &Statement{
+		Type: StatementType,
+		Subject: []Subject{{
+			Name:   opt.Target,
+			Digest: digestSet(opt.TargetDigest),
+		}},
+		PredicateType: PredicateTypeSLSA,
+	}
+
+	predicate := &statement.Predicate
+	predicate.Builder.ID = BuilderID
+	if opt.NydusifyVersion != "" {
+		predicate.Builder.ID += "@" + opt.NydusifyVersion
+	}
+	predicate.BuildType = BuildTypeConversion
+	predicate.Invocation.Parameters = opt.Parameters
+	predicate.Invocation.Environment = map[string]string{
+		"nydusifyVersion": opt.NydusifyVersion,
+		"builderVersion":  opt.BuilderVersion,
+	}
+	predicate.Metadata.BuildStartedOn = opt.StartedOn.UTC().Format(time.RFC3339)
+	predicate.Metadata.BuildFinishedOn = opt.FinishedOn.UTC().Format(time.RFC3339)
+	predicate.Metadata.Completeness.Parameters = true
+	// The source image is the only material, the builder version is empty
+	// if all layers are from build cache.
+	predicate.Metadata.Completeness.Environment = opt.BuilderVersion != ""
+	predicate.Metadata.Completeness.Materials = opt.SourceDigest != ""
+	predicate.Materials = []Material{}
+	if opt.Source != "" {
+		predicate.Materials = append(predicate.Materials, Material{
+			URI:    "pkg:docker/" + opt.Source,
+			Digest: digestSet(opt.SourceDigest),
+		})
+	}
+
+	return statement
+}
+
+// Marshal encodes the statement in JSON.
+func (statement *Statement) Marshal() ([]byte, error) {
+	return json.MarshalIndent(statement, "", "  ")
+}
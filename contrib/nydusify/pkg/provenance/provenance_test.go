@@ -0,0 +1,56 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provenance
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatement(t *testing.T) {
+	started := time.Date(2022, 6, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	opt := Opt{
+		Target:          "example.com/app:v1-nydus",
+		TargetDigest:    digest.FromString("target"),
+		Source:          "example.com/app:v1",
+		SourceDigest:    digest.FromString("source"),
+		NydusifyVersion: "v2.1.0",
+		BuilderVersion:  "v2.1.0-rc.1",
+		Parameters: Parameters{
+			Compressor:      "lz4_block",
+			DigestAlgorithm: "blake3",
+			ChunkSize:       0x100000,
+			BackendType:     "registry",
+		},
+		StartedOn:  started,
+		FinishedOn: started.Add(time.Minute),
+	}
+
+	data, err := New(opt).Marshal()
+	assert.Nil(t, err)
+	var statement Statement
+	assert.Nil(t, json.Unmarshal(data, &statement))
+	assert.Equal(t, StatementType, statement.Type)
+	assert.Equal(t, PredicateTypeSLSA, statement.PredicateType)
+	assert.Equal(t, []Subject{{Name: opt.Target, Digest: map[string]string{"sha256": opt.TargetDigest.Encoded()}}}, statement.Subject)
+	assert.Equal(t, BuilderID+"@v2.1.0", statement.Predicate.Builder.ID)
+	assert.Equal(t, opt.Parameters, statement.Predicate.Invocation.Parameters)
+	assert.Equal(t, "2022-06-01T00:00:00Z", statement.Predicate.Metadata.BuildStartedOn)
+	assert.Equal(t, "2022-06-01T00:01:00Z", statement.Predicate.Metadata.BuildFinishedOn)
+	assert.True(t, statement.Predicate.Metadata.Completeness.Materials)
+	assert.Equal(t, []Material{{URI: "pkg:docker/example.com/app:v1", Digest: map[string]string{"sha256": opt.SourceDigest.Encoded()}}}, statement.Predicate.Materials)
+
+	// The source built by buildkit has no digest.
+	opt.SourceDigest = ""
+	opt.BuilderVersion = ""
+	statement = *New(opt)
+	assert.False(t, statement.Predicate.Metadata.Completeness.Materials)
+	assert.False(t, statement.Predicate.Metadata.Completeness.Environment)
+	assert.Nil(t, statement.Predicate.Materials[0].Digest)
+}
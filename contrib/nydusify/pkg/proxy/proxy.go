@@ -0,0 +1,166 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package proxy resolves the proxy of outbound requests to registries and
+// storage backends, from explicit config or the standard HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables.
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Config is the proxy of HTTP and HTTPS requests, the requests to https
+// URLs are tunneled by CONNECT through HTTP proxy. The proxy URL is
+// `http://`, `https://` or `socks5://`, with optional `user:password@`.
+type Config struct {
+	HTTPProxy  string `json:"http_proxy,omitempty"`
+	HTTPSProxy string `json:"https_proxy,omitempty"`
+	// NoProxy is the comma-separated hosts bypassing proxy: host names,
+	// domain suffixes like `.example.com`, IPs or CIDRs, optionally with
+	// port, `*` disables proxy for all hosts.
+	NoProxy string `json:"no_proxy,omitempty"`
+}
+
+var (
+	mu            sync.RWMutex
+	defaultConfig = FromEnvironment()
+	defaultFunc   = defaultConfig.httpproxy().ProxyFunc()
+)
+
+func validateURL(name, value string) error {
+	if value == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %s: %s", name, value, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("invalid %s %s, should be http, https or socks5 URL", name, value)
+	}
+	if proxyURL.Host == "" {
+		return fmt.Errorf("invalid %s %s, no host is specified", name, value)
+	}
+	return nil
+}
+
+// Validate checks the proxy URLs.
+func (config Config) Validate() error {
+	if err := validateURL("http proxy", config.HTTPProxy); err != nil {
+		return err
+	}
+	return validateURL("https proxy", config.HTTPSProxy)
+}
+
+// IsZero reports whether no proxy is configured.
+func (config Config) IsZero() bool {
+	return config.HTTPProxy == "" && config.HTTPSProxy == ""
+}
+
+// Merge returns the config with the fields of `override` that are set.
+func (config Config) Merge(override Config) Config {
+	if override.HTTPProxy != "" {
+		config.HTTPProxy = override.HTTPProxy
+	}
+	if override.HTTPSProxy != "" {
+		config.HTTPSProxy = override.HTTPSProxy
+	}
+	if override.NoProxy != "" {
+		config.NoProxy = override.NoProxy
+	}
+	return config
+}
+
+func (config Config) httpproxy() *httpproxy.Config {
+	return &httpproxy.Config{
+		HTTPProxy:  config.HTTPProxy,
+		HTTPSProxy: config.HTTPSProxy,
+		NoProxy:    config.NoProxy,
+	}
+}
+
+// FromEnvironment reads the config from HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY (or the lowercase versions) environment variables.
+func FromEnvironment() Config {
+	env := httpproxy.FromEnvironment()
+	return Config{
+		HTTPProxy:  env.HTTPProxy,
+		HTTPSProxy: env.HTTPSProxy,
+		NoProxy:    env.NoProxy,
+	}
+}
+
+// SetDefault sets the default proxy used by registry clients and storage
+// backends without proxy override, and by http.DefaultTransport, it should
+// be called before any request.
+func SetDefault(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defaultConfig = config
+	defaultFunc = config.httpproxy().ProxyFunc()
+	mu.Unlock()
+
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport.Proxy = Func(nil)
+	}
+	return nil
+}
+
+// Default returns the default proxy, it's read from environment variables
+// unless SetDefault is called.
+func Default() Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultConfig
+}
+
+// Func returns the proxy function of http.Transport for config, the default
+// proxy is used if config is nil.
+func Func(config *Config) func(*http.Request) (*url.URL, error) {
+	if config != nil {
+		proxyFunc := config.httpproxy().ProxyFunc()
+		return func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		mu.RLock()
+		proxyFunc := defaultFunc
+		mu.RUnlock()
+		return proxyFunc(req.URL)
+	}
+}
+
+// Transport clones http.DefaultTransport with the proxy of config, the
+// default proxy is used if config is nil.
+func Transport(config *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = Func(config)
+	return transport
+}
+
+// BackendConfig returns the proxy override in storage backend config, the
+// `http_proxy`, `https_proxy` and `no_proxy` fields are merged with the
+// default proxy. It's nil if none of them is set.
+func BackendConfig(config Config) (*Config, error) {
+	if config == (Config{}) {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	merged := Default().Merge(config)
+	return &merged, nil
+}
@@ -0,0 +1,544 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package pullthrough implements a read-only registry facade, the clients
+// pull the ordinary image references through it, and the images are
+// converted to Nydus images on the first pull of tag, cached in another
+// repository and served from there thereafter, so that the push pipelines
+// aren't changed to adopt lazy pulling.
+package pullthrough
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+// The manifests larger than it are rejected, the same as containerd.
+const maxManifestSize = 4 << 20
+
+// The header of manifest response reports how the tag is served.
+const (
+	HeaderStatus = "Nydus-Pullthrough-Status"
+
+	StatusConverted = "converted"
+	StatusPending   = "pending"
+	StatusFailed    = "failed"
+)
+
+// The long job names are truncated and suffixed by the hash of target.
+const maxJobNameLen = 128
+
+var unsafeNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// ConvertFunc converts the source image and pushes it to target.
+type ConvertFunc func(ctx context.Context, source, target string) error
+
+// jobName returns the name of work directory and log of the conversion to
+// target, which is unique per target reference (repository and tag), since
+// the same source manifest may be converted to several repositories.
+func jobName(target string) string {
+	name := "convert-" + strings.Trim(unsafeNameRegexp.ReplaceAllString(target, "_"), "_")
+	if len(name) > maxJobNameLen {
+		name = name[:maxJobNameLen-17] + "-" + digest.FromString(target).Encoded()[:16]
+	}
+	return name
+}
+
+// ExecConvert returns a ConvertFunc which runs `nydusify convert` by the
+// binary in a separate process for each conversion, with the work directory
+// and output log in workDir named by target reference, so the retry of
+// failed conversion resumes from the checkpoint of last attempt.
+func ExecConvert(binary, workDir string, args []string) ConvertFunc {
+	return func(ctx context.Context, source, target string) error {
+		jobDir := filepath.Join(workDir, jobName(target))
+		logPath := jobDir + ".log"
+		logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrap(err, "create conversion log")
+		}
+		defer logFile.Close()
+
+		cmd := exec.CommandContext(ctx, binary, append([]string{
+			"convert",
+			"--source", source,
+			"--target", target,
+			"--work-dir", jobDir,
+		}, args...)...)
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "run convert, see %s", logPath)
+		}
+		return os.RemoveAll(jobDir)
+	}
+}
+
+type Opt struct {
+	// DefaultRegistry is the upstream registry of the repository names
+	// without registry host, e.g. `docker.io`.
+	DefaultRegistry string
+	// AllowedRegistries are the upstream registry hosts which can be pulled
+	// through the server, only DefaultRegistry is allowed if it's empty.
+	AllowedRegistries []string
+	SourceInsecure    bool
+	// Username and Password are required by basic auth of all requests if
+	// Password is set.
+	Username string
+	Password string
+	// CacheRepo is the repository prefix to push the converted images, the
+	// image of `host/repo` is cached in `$CacheRepo/host/repo`.
+	CacheRepo     string
+	CacheInsecure bool
+	Convert       ConvertFunc
+	// Workers is the number of concurrent conversions.
+	Workers int
+	// Wait is the maximum time of a manifest request waiting for the
+	// conversion, the source image is served if it's exceeded.
+	Wait time.Duration
+	// ConvertTimeout is the timeout of a conversion.
+	ConvertTimeout time.Duration
+	// RetryInterval is the backoff before converting the failed image
+	// again, the source image is served in the meantime.
+	RetryInterval time.Duration
+}
+
+type conversion struct {
+	done     chan struct{}
+	err      error
+	finished time.Time
+}
+
+// Server serves the registry API of pull requests.
+type Server struct {
+	Opt
+	ctx         context.Context
+	workers     chan struct{}
+	mutex       sync.Mutex
+	conversions map[string]*conversion
+	newRemote   func(ref string, insecure bool) (*remote.Remote, error)
+	allowed     map[string]bool
+}
+
+// normalizeRegistry returns the registry host as the domain of normalized
+// repository name, e.g. `docker.io` for `index.docker.io`.
+func normalizeRegistry(host string) (string, error) {
+	if !hasDomain(host + "/image") {
+		return "", fmt.Errorf("invalid registry host %s", host)
+	}
+	named, err := reference.ParseNormalizedNamed(host + "/image")
+	if err != nil {
+		return "", fmt.Errorf("invalid registry host %s", host)
+	}
+	return reference.Domain(named), nil
+}
+
+// New creates the server, the conversions are canceled once ctx is done.
+func New(ctx context.Context, opt Opt) (*Server, error) {
+	if opt.Workers < 1 {
+		opt.Workers = 1
+	}
+	registries := opt.AllowedRegistries
+	if len(registries) == 0 && opt.DefaultRegistry != "" {
+		registries = []string{opt.DefaultRegistry}
+	}
+	allowed := map[string]bool{}
+	for _, registry := range registries {
+		host, err := normalizeRegistry(registry)
+		if err != nil {
+			return nil, err
+		}
+		allowed[host] = true
+	}
+	if opt.Password != "" && opt.Username == "" {
+		return nil, fmt.Errorf("username is required by basic auth")
+	}
+	return &Server{
+		Opt:         opt,
+		ctx:         ctx,
+		workers:     make(chan struct{}, opt.Workers),
+		conversions: map[string]*conversion{},
+		newRemote:   provider.DefaultRemote,
+		allowed:     allowed,
+	}, nil
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Password == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(s.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) == 1
+}
+
+// parsePath parses the request path `/v2/<name>/manifests/<reference>` or
+// `/v2/<name>/blobs/<digest>`.
+func parsePath(urlPath string) (name, kind, ref string, ok bool) {
+	if !strings.HasPrefix(urlPath, "/v2/") {
+		return "", "", "", false
+	}
+	urlPath = strings.TrimPrefix(urlPath, "/v2/")
+	for _, kind := range []string{"manifests", "blobs"} {
+		sep := "/" + kind + "/"
+		if idx := strings.LastIndex(urlPath, sep); idx > 0 {
+			ref := urlPath[idx+len(sep):]
+			if ref == "" || strings.Contains(ref, "/") {
+				return "", "", "", false
+			}
+			return urlPath[:idx], kind, ref, true
+		}
+	}
+	return "", "", "", false
+}
+
+// hasDomain reports whether the first component of repository name is a
+// registry host, by the same rule as docker.
+func hasDomain(name string) bool {
+	idx := strings.Index(name, "/")
+	if idx < 0 {
+		return false
+	}
+	domain := name[:idx]
+	return strings.ContainsAny(domain, ".:") || domain == "localhost"
+}
+
+// sourceRepo returns the upstream repository of repository name.
+func sourceRepo(name, defaultRegistry string) (reference.Named, error) {
+	if !hasDomain(name) && defaultRegistry != "" {
+		name = defaultRegistry + "/" + name
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, err
+	}
+	if !reference.IsNameOnly(named) {
+		return nil, fmt.Errorf("invalid repository name %s", name)
+	}
+	return named, nil
+}
+
+// cacheRepo returns the repository of converted images for the upstream
+// repository, the port of registry host is joined by `-`.
+func cacheRepo(cacheRepo string, source reference.Named) string {
+	domain := strings.Replace(reference.Domain(source), ":", "-", 1)
+	return strings.TrimSuffix(cacheRepo, "/") + "/" + domain + "/" + reference.Path(source)
+}
+
+// cacheTag returns the tag of converted image for the source manifest, so
+// the moved tag is converted again.
+func cacheTag(source digest.Digest) string {
+	return source.Algorithm().String() + "-" + source.Encoded()
+}
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]registryError{
+		"errors": {{Code: code, Message: message}},
+	})
+}
+
+// writeRemoteError writes the error of upstream or cache registry.
+func writeRemoteError(w http.ResponseWriter, code string, err error) {
+	if errdefs.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, code, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadGateway, "UNAVAILABLE", err.Error())
+}
+
+// ServeHTTP serves the pull requests of registry API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nydusify pull-through"`)
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "only pull is supported")
+		return
+	}
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	name, kind, ref, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, "UNSUPPORTED", "unsupported request")
+		return
+	}
+	source, err := sourceRepo(name, s.DefaultRegistry)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "NAME_INVALID", err.Error())
+		return
+	}
+	// Otherwise the server could be used to pull from arbitrary hosts,
+	// including the internal ones reachable by the server only.
+	if registry := reference.Domain(source); !s.allowed[registry] {
+		writeError(w, http.StatusForbidden, "DENIED", fmt.Sprintf("upstream registry %s isn't allowed", registry))
+		return
+	}
+
+	if kind == "blobs" {
+		dgst, err := digest.Parse(ref)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "DIGEST_INVALID", err.Error())
+			return
+		}
+		s.serveDigest(w, r, source, dgst, false)
+		return
+	}
+	if dgst, err := digest.Parse(ref); err == nil {
+		s.serveDigest(w, r, source, dgst, true)
+		return
+	}
+	s.serveTag(w, r, source, ref)
+}
+
+// serveDigest serves the content of digest from the cache repository, or
+// the upstream repository if it isn't converted. The manifests of digest
+// are never converted since the clients verify the digest.
+func (s *Server) serveDigest(w http.ResponseWriter, r *http.Request, source reference.Named, dgst digest.Digest, manifest bool) {
+	code := "BLOB_UNKNOWN"
+	if manifest {
+		code = "MANIFEST_UNKNOWN"
+	}
+
+	var lastErr error
+	for _, repo := range []struct {
+		ref      string
+		insecure bool
+	}{
+		{cacheRepo(s.CacheRepo, source) + "@" + dgst.String(), s.CacheInsecure},
+		{source.Name() + "@" + dgst.String(), s.SourceInsecure},
+	} {
+		rm, err := s.newRemote(repo.ref, repo.insecure)
+		if err != nil {
+			writeError(w, http.StatusNotFound, "NAME_INVALID", err.Error())
+			return
+		}
+		desc, err := rm.Resolve(r.Context())
+		if err != nil {
+			lastErr = err
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			break
+		}
+		if manifest {
+			s.serveManifest(w, r, rm, *desc, "")
+		} else {
+			// The resolver may take the blob as manifest by its content
+			// type, which is fetched from the manifest endpoint then.
+			desc.MediaType = "application/octet-stream"
+			serveBlob(w, r, rm, *desc)
+		}
+		return
+	}
+	writeRemoteError(w, code, lastErr)
+}
+
+// serveTag serves the converted image of the tag, the conversion is
+// started if it isn't converted yet, and the source image is served if
+// it isn't done in time.
+func (s *Server) serveTag(w http.ResponseWriter, r *http.Request, source reference.Named, tag string) {
+	sourceRef, err := reference.WithTag(source, tag)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "TAG_INVALID", err.Error())
+		return
+	}
+	sourceRemote, err := s.newRemote(sourceRef.String(), s.SourceInsecure)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "NAME_INVALID", err.Error())
+		return
+	}
+	sourceDesc, err := sourceRemote.Resolve(r.Context())
+	if err != nil {
+		writeRemoteError(w, "MANIFEST_UNKNOWN", err)
+		return
+	}
+
+	target := cacheRepo(s.CacheRepo, source) + ":" + cacheTag(sourceDesc.Digest)
+	targetRemote, err := s.newRemote(target, s.CacheInsecure)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	targetDesc, err := targetRemote.Resolve(r.Context())
+	if err == nil {
+		s.serveManifest(w, r, targetRemote, *targetDesc, StatusConverted)
+		return
+	}
+	if !errdefs.IsNotFound(err) {
+		logrus.Warnf("Resolve cached image %s: %s", target, err)
+	}
+
+	// The source is pinned by digest in case the tag is moved during
+	// conversion.
+	status := StatusPending
+	conv := s.convert(source.Name()+"@"+sourceDesc.Digest.String(), target)
+	timer := time.NewTimer(s.Wait)
+	defer timer.Stop()
+	select {
+	case <-conv.done:
+		if conv.err == nil {
+			if targetDesc, err := targetRemote.Resolve(r.Context()); err == nil {
+				s.serveManifest(w, r, targetRemote, *targetDesc, StatusConverted)
+				return
+			}
+		}
+		status = StatusFailed
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	s.serveManifest(w, r, sourceRemote, *sourceDesc, status)
+}
+
+// convert starts the conversion of source to target if it isn't running,
+// the failed conversion isn't retried until RetryInterval passes.
+func (s *Server) convert(source, target string) *conversion {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if conv, ok := s.conversions[target]; ok {
+		select {
+		case <-conv.done:
+			if time.Since(conv.finished) < s.RetryInterval {
+				return conv
+			}
+		default:
+			return conv
+		}
+	}
+
+	conv := &conversion{done: make(chan struct{})}
+	s.conversions[target] = conv
+	go func() {
+		s.workers <- struct{}{}
+		defer func() { <-s.workers }()
+
+		ctx := s.ctx
+		if s.ConvertTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.ConvertTimeout)
+			defer cancel()
+		}
+		logrus.Infof("Converting %s to %s", source, target)
+		err := s.Convert(ctx, source, target)
+
+		s.mutex.Lock()
+		conv.err, conv.finished = err, time.Now()
+		if err == nil {
+			// The converted image is resolved from cache repository.
+			delete(s.conversions, target)
+		}
+		s.mutex.Unlock()
+		close(conv.done)
+		if err != nil {
+			// The failure isn't kept once it can be retried, in case the
+			// target is never pulled again.
+			time.AfterFunc(s.RetryInterval, func() {
+				s.mutex.Lock()
+				defer s.mutex.Unlock()
+				if s.conversions[target] == conv {
+					delete(s.conversions, target)
+				}
+			})
+		}
+
+		if err != nil {
+			logrus.Errorf("Convert %s to %s: %s", source, target, err)
+		} else {
+			logrus.Infof("Converted %s to %s", source, target)
+		}
+	}()
+	return conv
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, rm *remote.Remote, desc ocispec.Descriptor, status string) {
+	if desc.Size > maxManifestSize {
+		writeError(w, http.StatusBadGateway, "MANIFEST_INVALID", "manifest is too large")
+		return
+	}
+	var data []byte
+	if r.Method == http.MethodGet {
+		reader, err := rm.Pull(r.Context(), desc, true)
+		if err != nil {
+			writeRemoteError(w, "MANIFEST_UNKNOWN", err)
+			return
+		}
+		defer reader.Close()
+		if data, err = ioutil.ReadAll(io.LimitReader(reader, maxManifestSize)); err != nil {
+			writeRemoteError(w, "MANIFEST_UNKNOWN", err)
+			return
+		}
+		if digest.FromBytes(data) != desc.Digest {
+			writeError(w, http.StatusBadGateway, "MANIFEST_INVALID", fmt.Sprintf("digest of manifest doesn't match %s", desc.Digest))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	if status != "" {
+		w.Header().Set(HeaderStatus, status)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// serveBlob streams the blob with range requests supported, e.g. for
+// Nydusd fetching chunks on demand.
+func serveBlob(w http.ResponseWriter, r *http.Request, rm *remote.Remote, desc ocispec.Descriptor) {
+	reader, err := rm.Pull(r.Context(), desc, true)
+	if err != nil {
+		writeRemoteError(w, "BLOB_UNKNOWN", err)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	w.Header().Set("Etag", `"`+desc.Digest.String()+`"`)
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		io.Copy(w, reader)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package pullthrough
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePath(t *testing.T) {
+	name, kind, ref, ok := parsePath("/v2/docker.io/library/nginx/manifests/latest")
+	assert.True(t, ok)
+	assert.Equal(t, "docker.io/library/nginx", name)
+	assert.Equal(t, "manifests", kind)
+	assert.Equal(t, "latest", ref)
+
+	name, kind, ref, ok = parsePath("/v2/blobs/blobs/sha256:aa")
+	assert.True(t, ok)
+	assert.Equal(t, "blobs", name)
+	assert.Equal(t, "blobs", kind)
+	assert.Equal(t, "sha256:aa", ref)
+
+	for _, urlPath := range []string{"/v2/", "/v2/nginx/tags/list", "/v2/manifests/latest", "/v1/nginx/manifests/latest", "/v2/nginx/manifests/"} {
+		_, _, _, ok = parsePath(urlPath)
+		assert.False(t, ok, urlPath)
+	}
+}
+
+func TestRepo(t *testing.T) {
+	source, err := sourceRepo("nginx", "docker.io")
+	assert.Nil(t, err)
+	assert.Equal(t, "docker.io/library/nginx", source.Name())
+	assert.Equal(t, "myregistry/cache/docker.io/library/nginx", cacheRepo("myregistry/cache/", source))
+
+	source, err = sourceRepo("localhost:5000/app", "docker.io")
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:5000/app", source.Name())
+	assert.Equal(t, "myregistry/cache/localhost-5000/app", cacheRepo("myregistry/cache", source))
+
+	source, err = sourceRepo("team/app", "ghcr.io")
+	assert.Nil(t, err)
+	assert.Equal(t, "ghcr.io/team/app", source.Name())
+
+	_, err = sourceRepo("Invalid", "docker.io")
+	assert.NotNil(t, err)
+
+	dgst := digest.FromString("manifest")
+	assert.Equal(t, "sha256-"+dgst.Encoded(), cacheTag(dgst))
+}
+
+func TestJobName(t *testing.T) {
+	dgst := digest.FromString("manifest")
+	name1 := jobName("myregistry/cache/docker.io/library/nginx:" + cacheTag(dgst))
+	name2 := jobName("myregistry/cache/docker.io/team/nginx:" + cacheTag(dgst))
+	assert.Equal(t, "convert-myregistry_cache_docker.io_library_nginx_sha256-"+dgst.Encoded(), name1)
+	assert.NotEqual(t, name1, name2)
+
+	long := jobName("myregistry/cache/docker.io/" + strings.Repeat("a", 200) + ":" + cacheTag(dgst))
+	assert.Len(t, long, maxJobNameLen)
+	assert.NotEqual(t, long, jobName("myregistry/cache/docker.io/"+strings.Repeat("a", 201)+":"+cacheTag(dgst)))
+}
+
+func TestNew(t *testing.T) {
+	s, err := New(context.Background(), Opt{DefaultRegistry: "docker.io"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"docker.io": true}, s.allowed)
+
+	s, err = New(context.Background(), Opt{DefaultRegistry: "docker.io", AllowedRegistries: []string{"index.docker.io", "localhost:5000"}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"docker.io": true, "localhost:5000": true}, s.allowed)
+
+	_, err = New(context.Background(), Opt{AllowedRegistries: []string{"internal"}})
+	assert.NotNil(t, err)
+	_, err = New(context.Background(), Opt{Password: "secret"})
+	assert.NotNil(t, err)
+}
+
+func TestServeHTTP(t *testing.T) {
+	s, err := New(context.Background(), Opt{DefaultRegistry: "docker.io", CacheRepo: "myregistry/cache"})
+	assert.Nil(t, err)
+
+	for _, c := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/v2/", http.StatusOK},
+		{http.MethodPut, "/v2/nginx/manifests/latest", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/v2/nginx/tags/list", http.StatusNotFound},
+		{http.MethodGet, "/v2/Invalid/manifests/latest", http.StatusNotFound},
+		{http.MethodGet, "/v2/nginx/blobs/latest", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		assert.Equal(t, c.status, w.Code, c.path)
+		assert.Equal(t, "registry/2.0", w.Header().Get("Docker-Distribution-API-Version"))
+	}
+
+	// The upstream registries not allowed are rejected before any request
+	// to them.
+	for _, path := range []string{"/v2/internal.example.com/app/manifests/latest", "/v2/169.254.169.254:80/app/blobs/sha256:" + digest.FromString("blob").Encoded()} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusForbidden, w.Code, path)
+	}
+}
+
+func TestServeHTTPAuth(t *testing.T) {
+	s, err := New(context.Background(), Opt{DefaultRegistry: "docker.io", CacheRepo: "myregistry/cache", Username: "user", Password: "secret"})
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+
+	r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	r.SetBasicAuth("user", "wrong")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	r = httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	r.SetBasicAuth("user", "secret")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestConvertRetry(t *testing.T) {
+	s, err := New(context.Background(), Opt{
+		DefaultRegistry: "docker.io",
+		RetryInterval:   50 * time.Millisecond,
+		Convert: func(ctx context.Context, source, target string) error {
+			return fmt.Errorf("failed")
+		},
+	})
+	assert.Nil(t, err)
+
+	conv := s.convert("docker.io/library/nginx@sha256:aa", "cache/nginx:sha256-aa")
+	<-conv.done
+	assert.NotNil(t, conv.err)
+	// The failure is reused until it can be retried, then dropped.
+	assert.Equal(t, conv, s.convert("docker.io/library/nginx@sha256:aa", "cache/nginx:sha256-aa"))
+	assert.Eventually(t, func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.conversions) == 0
+	}, time.Second, 10*time.Millisecond)
+}
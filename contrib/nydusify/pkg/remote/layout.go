@@ -0,0 +1,305 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// LayoutPrefix is the reference prefix of OCI image layout directory,
+// formatted as `oci:/path/to/layout[:tag]`.
+const LayoutPrefix = "oci:"
+
+// All images in layout are named in this repository, the tag is the
+// `org.opencontainers.image.ref.name` annotation in `index.json`.
+const layoutRepository = "oci-layout.local/layout"
+
+// IsLayoutReference returns true if the reference points to an OCI image
+// layout directory rather than registry.
+func IsLayoutReference(ref string) bool {
+	return strings.HasPrefix(ref, LayoutPrefix)
+}
+
+// parseLayoutReference parses `oci:/path/to/layout[:tag]` into layout
+// directory and tag, tag defaults to `latest`.
+func parseLayoutReference(ref string) (string, string, error) {
+	dir := strings.TrimPrefix(ref, LayoutPrefix)
+	tag := "latest"
+	if idx := strings.LastIndex(dir, ":"); idx > strings.LastIndex(dir, "/") {
+		dir, tag = dir[:idx], dir[idx+1:]
+	}
+	if dir == "" || tag == "" {
+		return "", "", fmt.Errorf("invalid OCI layout reference %s", ref)
+	}
+	return dir, tag, nil
+}
+
+// layout reads and writes images in OCI image layout directory, it's
+// shared by the resolvers of a remote.
+type layout struct {
+	dir string
+	// Protect the read-modify-write of `index.json`.
+	mutex sync.Mutex
+}
+
+func (l *layout) blobPath(dgst digest.Digest) string {
+	return filepath.Join(l.dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func (l *layout) readIndex() (*ocispec.Index, error) {
+	index := ocispec.Index{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+	}
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &index, nil
+		}
+		return nil, errors.Wrap(err, "Read index.json")
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrap(err, "Unmarshal index.json")
+	}
+	return &index, nil
+}
+
+// tag points the tag to the manifest in `index.json`, the previous
+// manifest of the tag is untagged.
+func (l *layout) tag(tag string, desc ocispec.Descriptor) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	index, err := l.readIndex()
+	if err != nil {
+		return err
+	}
+	manifests := []ocispec.Descriptor{}
+	for _, manifest := range index.Manifests {
+		if manifest.Annotations[ocispec.AnnotationRefName] != tag {
+			manifests = append(manifests, manifest)
+		}
+	}
+	desc.Annotations = map[string]string{ocispec.AnnotationRefName: tag}
+	index.Manifests = append(manifests, desc)
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Marshal index.json")
+	}
+	if err := ioutil.WriteFile(filepath.Join(l.dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return errors.Wrap(err, "Write oci-layout")
+	}
+	tmpPath := filepath.Join(l.dir, "index.json.tmp")
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "Write index.json")
+	}
+	return os.Rename(tmpPath, filepath.Join(l.dir, "index.json"))
+}
+
+// refTag returns the tag of reference passed to resolver, it's empty if
+// the reference is for blobs.
+func refTag(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ""
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return ""
+}
+
+type layoutResolver struct {
+	layout *layout
+}
+
+func (r *layoutResolver) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	// The content referenced by digest is resolved from blobs directory.
+	if named, err := reference.ParseNormalizedNamed(ref); err == nil {
+		if digested, ok := named.(reference.Digested); ok {
+			info, err := os.Stat(r.layout.blobPath(digested.Digest()))
+			if err != nil {
+				if os.IsNotExist(err) {
+					return "", ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotFound, "blob %s in OCI layout %s", digested.Digest(), r.layout.dir)
+				}
+				return "", ocispec.Descriptor{}, err
+			}
+			return ref, ocispec.Descriptor{Digest: digested.Digest(), Size: info.Size()}, nil
+		}
+	}
+
+	tag := refTag(ref)
+	index, err := r.layout.readIndex()
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[ocispec.AnnotationRefName] == tag {
+			return ref, desc, nil
+		}
+	}
+	return "", ocispec.Descriptor{}, errors.Wrapf(errdefs.ErrNotFound, "tag %s in OCI layout %s", tag, r.layout.dir)
+}
+
+func (r *layoutResolver) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		file, err := os.Open(r.layout.blobPath(desc.Digest))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, errors.Wrapf(errdefs.ErrNotFound, "blob %s in OCI layout %s", desc.Digest, r.layout.dir)
+			}
+			return nil, err
+		}
+		return file, nil
+	}), nil
+}
+
+func (r *layoutResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	tag := refTag(ref)
+	return remotes.PusherFunc(func(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+		blobPath := r.layout.blobPath(desc.Digest)
+		if _, err := os.Stat(blobPath); err == nil {
+			// The existing manifest still needs to be tagged.
+			if tag == "" {
+				return nil, errors.Wrapf(errdefs.ErrAlreadyExists, "blob %s in OCI layout", desc.Digest)
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+			return nil, errors.Wrap(err, "Create blobs directory")
+		}
+		file, err := ioutil.TempFile(filepath.Dir(blobPath), ".tmp-"+desc.Digest.Encoded())
+		if err != nil {
+			return nil, errors.Wrap(err, "Create blob file")
+		}
+		return &layoutWriter{
+			layout:   r.layout,
+			desc:     desc,
+			tag:      tag,
+			file:     file,
+			digester: digest.Canonical.Digester(),
+			started:  time.Now(),
+		}, nil
+	}), nil
+}
+
+// layoutWriter writes blob to a temporary file, which is renamed to the
+// blob path once the digest is verified.
+type layoutWriter struct {
+	layout   *layout
+	desc     ocispec.Descriptor
+	tag      string
+	file     *os.File
+	digester digest.Digester
+	offset   int64
+	started  time.Time
+	closed   bool
+}
+
+func (w *layoutWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.digester.Hash().Write(p[:n])
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *layoutWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+func (w *layoutWriter) Digest() digest.Digest {
+	return w.digester.Digest()
+}
+
+func (w *layoutWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	defer w.Close()
+
+	if err := w.file.Sync(); err != nil {
+		return errors.Wrap(err, "Sync blob file")
+	}
+	if size > 0 && size != w.offset {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "unexpected blob size %d, expected %d", w.offset, size)
+	}
+	if expected != "" && expected != w.Digest() {
+		return errors.Wrapf(errdefs.ErrFailedPrecondition, "unexpected blob digest %s, expected %s", w.Digest(), expected)
+	}
+	if err := os.Rename(w.file.Name(), w.layout.blobPath(w.desc.Digest)); err != nil {
+		return errors.Wrap(err, "Rename blob file")
+	}
+
+	if w.tag != "" && isManifest(w.desc.MediaType) {
+		return w.layout.tag(w.tag, w.desc)
+	}
+	return nil
+}
+
+func (w *layoutWriter) Status() (content.Status, error) {
+	return content.Status{
+		Ref:       w.desc.Digest.String(),
+		Offset:    w.offset,
+		Total:     w.desc.Size,
+		Expected:  w.desc.Digest,
+		StartedAt: w.started,
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func (w *layoutWriter) Truncate(size int64) error {
+	return errors.Wrap(errdefs.ErrNotImplemented, "truncate blob in OCI layout")
+}
+
+func isManifest(mediaType string) bool {
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex,
+		images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList:
+		return true
+	}
+	return false
+}
+
+// NewLayout creates remote instance for the image in OCI image layout
+// directory, the directory is created once an image is pushed.
+func NewLayout(ref string) (*Remote, error) {
+	dir, tag, err := parseLayoutReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &layout{dir: dir}
+	remote, err := New(layoutRepository+":"+tag, func() remotes.Resolver {
+		return &layoutResolver{layout: l}
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid tag in OCI layout reference %s", ref)
+	}
+	remote.Ref = ref
+
+	return remote, nil
+}
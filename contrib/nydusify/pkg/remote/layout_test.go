@@ -0,0 +1,93 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLayoutReference(t *testing.T) {
+	dir, tag, err := parseLayoutReference("oci:/path/to/layout:v1")
+	assert.Nil(t, err)
+	assert.Equal(t, "/path/to/layout", dir)
+	assert.Equal(t, "v1", tag)
+
+	dir, tag, err = parseLayoutReference("oci:./host:5000/layout")
+	assert.Nil(t, err)
+	assert.Equal(t, "./host:5000/layout", dir)
+	assert.Equal(t, "latest", tag)
+
+	_, _, err = parseLayoutReference("oci:/path/to/layout:")
+	assert.NotNil(t, err)
+	assert.True(t, IsLayoutReference("oci:/path"))
+	assert.False(t, IsLayoutReference("oci-archive:/path"))
+}
+
+func TestLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-layout-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r, err := NewLayout("oci:" + dir + ":v1")
+	assert.Nil(t, err)
+
+	_, err = r.Resolve(ctx)
+	assert.True(t, errdefs.IsNotFound(err))
+
+	blob := []byte("blob")
+	blobDesc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	assert.Nil(t, r.Push(ctx, blobDesc, true, bytes.NewReader(blob)))
+	// Push existed blob again.
+	assert.Nil(t, r.Push(ctx, blobDesc, true, bytes.NewReader(blob)))
+	// Mismatched digest is rejected.
+	assert.NotNil(t, r.Push(ctx, ocispec.Descriptor{Digest: digest.FromString("other"), Size: int64(len(blob))}, true, bytes.NewReader(blob)))
+
+	manifest := []byte(`{"schemaVersion":2}`)
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	assert.Nil(t, r.Push(ctx, manifestDesc, false, bytes.NewReader(manifest)))
+
+	desc, err := r.Resolve(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, manifestDesc.Digest, desc.Digest)
+	reader, err := r.Pull(ctx, *desc, true)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, data)
+
+	// Tag the same manifest in another remote of the layout.
+	r2, err := r.WithTag("v2")
+	assert.Nil(t, err)
+	assert.Nil(t, r2.Push(ctx, manifestDesc, false, bytes.NewReader(manifest)))
+	assert.Nil(t, r.Push(ctx, manifestDesc, false, bytes.NewReader(manifest)))
+
+	indexBytes, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	assert.Nil(t, err)
+	var index ocispec.Index
+	assert.Nil(t, json.Unmarshal(indexBytes, &index))
+	assert.Len(t, index.Manifests, 2)
+	_, err = os.Stat(filepath.Join(dir, "oci-layout"))
+	assert.Nil(t, err)
+
+	_, err = r.Pull(ctx, ocispec.Descriptor{Digest: digest.FromString("not found")}, true)
+	assert.True(t, errdefs.IsNotFound(err))
+}
@@ -0,0 +1,283 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// MediaTypeEmptyJSON is the config (and the only layer if no file) of
+// artifact manifest, its content is `{}`.
+const MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+var emptyJSON = []byte("{}")
+
+// The referrers API isn't implemented by registry, fallback to tag schema.
+var errReferrersUnsupported = errors.New("referrers API unsupported")
+
+// Referrer is the descriptor of an artifact manifest referring to subject,
+// image-spec v1.0.2 doesn't have the `artifactType` field of OCI 1.1.
+type Referrer struct {
+	ocispec.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// referrersIndex is the response of referrers API, and the manifest index
+// stored in the tag of referrers tag schema.
+type referrersIndex struct {
+	specs.Versioned
+	MediaType string     `json:"mediaType"`
+	Manifests []Referrer `json:"manifests"`
+}
+
+// artifactManifest is the OCI 1.1 image manifest with artifact type and
+// subject.
+type artifactManifest struct {
+	specs.Versioned
+	MediaType    string               `json:"mediaType"`
+	ArtifactType string               `json:"artifactType"`
+	Config       ocispec.Descriptor   `json:"config"`
+	Layers       []ocispec.Descriptor `json:"layers"`
+	Subject      *ocispec.Descriptor  `json:"subject,omitempty"`
+	Annotations  map[string]string    `json:"annotations,omitempty"`
+}
+
+// ReferrersTag returns the tag of referrers index for the registry doesn't
+// implement referrers API, e.g. `sha256-<hex>`.
+func ReferrersTag(subject digest.Digest) string {
+	return fmt.Sprintf("%s-%s", subject.Algorithm(), subject.Encoded())
+}
+
+func emptyDescriptor() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: MediaTypeEmptyJSON,
+		Digest:    digest.FromBytes(emptyJSON),
+		Size:      int64(len(emptyJSON)),
+	}
+}
+
+// Referrers lists the artifacts referring to the subject manifest, filtered
+// by artifact type if it isn't empty. The referrers API is used if registry
+// implements it, otherwise the index in referrers tag is read.
+func (remote *Remote) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]Referrer, error) {
+	index, err := remote.fetchReferrers(ctx, subject, artifactType)
+	if errors.Is(err, errReferrersUnsupported) {
+		logrus.Debugf("Referrers API is unsupported by %s, read tag %s", remote.Ref, ReferrersTag(subject))
+		index, _, err = remote.fetchReferrersTag(ctx, subject)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "list referrers of %s", subject)
+	}
+
+	// Registry may ignore the filter.
+	referrers := []Referrer{}
+	for _, referrer := range index.Manifests {
+		if artifactType == "" || referrer.ArtifactType == artifactType {
+			referrers = append(referrers, referrer)
+		}
+	}
+	return referrers, nil
+}
+
+// Attach pushes an artifact manifest referring to the subject manifest, the
+// layers must be pushed before. The referrers index in referrers tag is
+// updated if registry doesn't implement referrers API.
+func (remote *Remote) Attach(
+	ctx context.Context, subject ocispec.Descriptor, artifactType string, layers []ocispec.Descriptor, annotations map[string]string,
+) (*Referrer, error) {
+	config := emptyDescriptor()
+	if err := remote.Push(ctx, config, true, bytes.NewReader(emptyJSON)); err != nil {
+		return nil, errors.Wrap(err, "push empty config")
+	}
+	if len(layers) == 0 {
+		layers = []ocispec.Descriptor{config}
+	}
+
+	manifest := artifactManifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       config,
+		Layers:       layers,
+		Subject: &ocispec.Descriptor{
+			MediaType: subject.MediaType,
+			Digest:    subject.Digest,
+			Size:      subject.Size,
+		},
+		Annotations: annotations,
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal artifact manifest")
+	}
+	referrer := Referrer{
+		Descriptor: ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Digest:      digest.FromBytes(data),
+			Size:        int64(len(data)),
+			Annotations: annotations,
+		},
+		ArtifactType: artifactType,
+	}
+	if err := remote.Push(ctx, referrer.Descriptor, true, bytes.NewReader(data)); err != nil {
+		return nil, errors.Wrap(err, "push artifact manifest")
+	}
+
+	// The registry implementing referrers API indexes the manifest by its
+	// subject on push.
+	_, err = remote.fetchReferrers(ctx, subject.Digest, "")
+	if err == nil {
+		return &referrer, nil
+	}
+	if !errors.Is(err, errReferrersUnsupported) {
+		return nil, errors.Wrapf(err, "list referrers of %s", subject.Digest)
+	}
+	if err := remote.addReferrerTag(ctx, subject.Digest, referrer); err != nil {
+		return nil, errors.Wrapf(err, "update referrers tag of %s", subject.Digest)
+	}
+	return &referrer, nil
+}
+
+// fetchReferrers requests the referrers API of registry, it returns
+// errReferrersUnsupported if the API isn't found.
+func (remote *Remote) fetchReferrers(ctx context.Context, subject digest.Digest, artifactType string) (*referrersIndex, error) {
+	if remote.hostsFunc == nil {
+		return nil, errReferrersUnsupported
+	}
+	hosts, err := remote.hostsFunc()(reference.Domain(remote.parsed))
+	if err != nil {
+		return nil, err
+	}
+	repo := reference.Path(remote.parsed)
+	ctx = docker.WithScope(ctx, fmt.Sprintf("repository:%s:pull", repo))
+
+	var lastErr error = errReferrersUnsupported
+	for _, host := range hosts {
+		if !host.Capabilities.Has(docker.HostCapabilityResolve) {
+			continue
+		}
+		url := fmt.Sprintf("%s://%s%s/%s/referrers/%s", host.Scheme, host.Host, host.Path, repo, subject)
+		if artifactType != "" {
+			url += "?artifactType=" + artifactType
+		}
+		index, err := requestReferrers(ctx, host, url)
+		if err == nil {
+			return index, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func requestReferrers(ctx context.Context, host docker.RegistryHost, url string) (*referrersIndex, error) {
+	resp, err := doRequest(ctx, host, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errReferrersUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s of %s", resp.Status, url)
+	}
+	// Some registries respond other content for unknown API.
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), ocispec.MediaTypeImageIndex) {
+		return nil, errReferrersUnsupported
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read referrers index")
+	}
+	var index referrersIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrap(err, "unmarshal referrers index")
+	}
+	return &index, nil
+}
+
+// fetchReferrersTag reads the referrers index in referrers tag, an empty
+// index is returned if the tag doesn't exist.
+func (remote *Remote) fetchReferrersTag(ctx context.Context, subject digest.Digest) (*referrersIndex, *Remote, error) {
+	tagRemote, err := remote.WithTag(ReferrersTag(subject))
+	if err != nil {
+		return nil, nil, err
+	}
+	index := &referrersIndex{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []Referrer{},
+	}
+
+	desc, err := tagRemote.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(errors.Cause(err)) {
+			return index, tagRemote, nil
+		}
+		return nil, nil, errors.Wrapf(err, "resolve tag %s", ReferrersTag(subject))
+	}
+	reader, err := tagRemote.Pull(ctx, *desc, true)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "pull tag %s", ReferrersTag(subject))
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "read tag %s", ReferrersTag(subject))
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, nil, errors.Wrapf(err, "unmarshal referrers index in tag %s", ReferrersTag(subject))
+	}
+	return index, tagRemote, nil
+}
+
+// addReferrerTag appends the referrer to the index in referrers tag, the
+// read-modify-write isn't atomic, as the tag schema doesn't offer that.
+func (remote *Remote) addReferrerTag(ctx context.Context, subject digest.Digest, referrer Referrer) error {
+	index, tagRemote, err := remote.fetchReferrersTag(ctx, subject)
+	if err != nil {
+		return err
+	}
+	for _, existed := range index.Manifests {
+		if existed.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, referrer)
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "marshal referrers index")
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	return tagRemote.Push(ctx, desc, false, bytes.NewReader(data))
+}
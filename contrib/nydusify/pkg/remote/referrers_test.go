@@ -0,0 +1,135 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func pushManifest(t *testing.T, r *Remote, data []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	assert.Nil(t, r.Push(context.Background(), desc, false, bytes.NewReader(data)))
+	return desc
+}
+
+func TestReferrersTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-referrers-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r, err := NewLayout("oci:" + dir + ":v1")
+	assert.Nil(t, err)
+	subject := pushManifest(t, r, []byte(`{"schemaVersion":2}`))
+	assert.Equal(t, "sha256-"+subject.Digest.Encoded(), ReferrersTag(subject.Digest))
+
+	referrers, err := r.Referrers(ctx, subject.Digest, "")
+	assert.Nil(t, err)
+	assert.Len(t, referrers, 0)
+
+	sbom, err := r.Attach(ctx, subject, "application/spdx+json", nil, map[string]string{"key": "value"})
+	assert.Nil(t, err)
+	_, err = r.Attach(ctx, subject, "application/vnd.in-toto+json", nil, nil)
+	assert.Nil(t, err)
+	// Attaching the same artifact again doesn't duplicate it.
+	_, err = r.Attach(ctx, subject, "application/spdx+json", nil, map[string]string{"key": "value"})
+	assert.Nil(t, err)
+
+	referrers, err = r.Referrers(ctx, subject.Digest, "")
+	assert.Nil(t, err)
+	assert.Len(t, referrers, 2)
+	referrers, err = r.Referrers(ctx, subject.Digest, "application/spdx+json")
+	assert.Nil(t, err)
+	assert.Equal(t, []Referrer{*sbom}, referrers)
+
+	// The artifact manifest refers to subject with empty config.
+	reader, err := r.Pull(ctx, sbom.Descriptor, true)
+	assert.Nil(t, err)
+	defer reader.Close()
+	var manifest artifactManifest
+	assert.Nil(t, json.NewDecoder(reader).Decode(&manifest))
+	assert.Equal(t, subject.Digest, manifest.Subject.Digest)
+	assert.Equal(t, MediaTypeEmptyJSON, manifest.Config.MediaType)
+	assert.Equal(t, []ocispec.Descriptor{emptyDescriptor()}, manifest.Layers)
+}
+
+func TestReferrersAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-referrers-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r, err := NewLayout("oci:" + dir + ":v1")
+	assert.Nil(t, err)
+	subject := pushManifest(t, r, []byte(`{"schemaVersion":2}`))
+
+	referrer := Referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("sbom"), Size: 4},
+		ArtifactType: "application/spdx+json",
+	}
+	supported := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !supported || req.URL.Path != "/v2/layout/referrers/"+subject.Digest.String() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(referrersIndex{
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: []Referrer{referrer, {Descriptor: referrer.Descriptor, ArtifactType: "other"}},
+		})
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	r.hostsFunc = func() docker.RegistryHosts {
+		return func(string) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       server.Client(),
+				Host:         serverURL.Host,
+				Scheme:       "http",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityResolve,
+			}}, nil
+		}
+	}
+
+	referrers, err := r.Referrers(ctx, subject.Digest, "application/spdx+json")
+	assert.Nil(t, err)
+	assert.Equal(t, []Referrer{referrer}, referrers)
+
+	// The referrers tag isn't used by the registry implementing the API.
+	_, err = r.Attach(ctx, subject, "application/spdx+json", nil, nil)
+	assert.Nil(t, err)
+	tagRemote, err := r.WithTag(ReferrersTag(subject.Digest))
+	assert.Nil(t, err)
+	_, err = tagRemote.Resolve(ctx)
+	assert.True(t, errdefs.IsNotFound(err))
+
+	supported = false
+	_, err = r.Attach(ctx, subject, "application/spdx+json", nil, nil)
+	assert.Nil(t, err)
+	referrers, err = r.Referrers(ctx, subject.Digest, "")
+	assert.Nil(t, err)
+	assert.Len(t, referrers, 1)
+}
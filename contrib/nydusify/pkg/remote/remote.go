@@ -7,13 +7,20 @@ package remote
 import (
 	"context"
 	"io"
+	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tracing"
 )
 
 // Remote provides the ability to access remote registry
@@ -27,7 +34,15 @@ type Remote struct {
 	// the resolver does not re-apply for a new token, so it's better to create a
 	// new resolver instance using resolverFunc for each request.
 	resolverFunc func() remotes.Resolver
-	pushed       sync.Map
+	// The hostsFunc is used for the requests not supported by resolver, e.g.
+	// referrers API, it's nil for the remote without registry.
+	hostsFunc func() docker.RegistryHosts
+	pushed    sync.Map
+	// mountSources are the repositories in the same registry to mount
+	// blobs from on push.
+	mountSources []string
+	// chunkedUpload pushes large blobs in resumable chunks if it's set.
+	chunkedUpload *ChunkedUploadOpt
 }
 
 // New creates remote instance from docker remote resolver
@@ -44,6 +59,21 @@ func New(ref string, resolverFunc func() remotes.Resolver) (*Remote, error) {
 	}, nil
 }
 
+// NewWithRegistryHosts creates remote instance from the registry hosts
+// configuration, a new configuration is created for each request.
+func NewWithRegistryHosts(ref string, hostsFunc func() docker.RegistryHosts) (*Remote, error) {
+	remote, err := New(ref, func() remotes.Resolver {
+		return docker.NewResolver(docker.ResolverOptions{
+			Hosts: hostsFunc(),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	remote.hostsFunc = hostsFunc
+	return remote, nil
+}
+
 // Push pushes blob to registry
 func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDigest bool, reader io.Reader) error {
 	// Concurrently push blob with same digest using containerd
@@ -55,6 +85,10 @@ func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDiges
 	lock.(*sync.Mutex).Lock()
 	defer lock.(*sync.Mutex).Unlock()
 
+	if remote.canPushChunked(desc, byDigest, reader) {
+		return remote.pushChunked(ctx, desc, reader.(io.ReadSeeker))
+	}
+
 	var ref string
 	if byDigest {
 		ref = remote.parsed.Name()
@@ -68,7 +102,7 @@ func (remote *Remote) Push(ctx context.Context, desc ocispec.Descriptor, byDiges
 		return err
 	}
 
-	writer, err := pusher.Push(ctx, desc)
+	writer, err := pusher.Push(ctx, remote.withMountSources(desc))
 	if err != nil {
 		if errdefs.IsAlreadyExists(err) {
 			return nil
@@ -107,11 +141,95 @@ func (remote *Remote) Pull(ctx context.Context, desc ocispec.Descriptor, byDiges
 func (remote *Remote) Resolve(ctx context.Context) (*ocispec.Descriptor, error) {
 	ref := reference.TagNameOnly(remote.parsed).String()
 
+	ctx, span := tracing.Start(ctx, "resolve manifest", attribute.String("reference", ref))
+
 	// Create a new resolver instance for the request
 	_, desc, err := remote.resolverFunc().Resolve(ctx, ref)
+	if err != nil {
+		return nil, tracing.End(span, err)
+	}
+	span.SetAttributes(attribute.String("digest", desc.Digest.String()))
+
+	return &desc, tracing.End(span, nil)
+}
+
+// WithTag creates a remote instance for another tag in the same repository,
+// it shares the resolver configuration of current remote.
+func (remote *Remote) WithTag(tag string) (*Remote, error) {
+	named, err := reference.WithTag(reference.TrimNamed(remote.parsed), tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Remote{
+		Ref:           named.String(),
+		parsed:        named,
+		resolverFunc:  remote.resolverFunc,
+		hostsFunc:     remote.hostsFunc,
+		mountSources:  remote.mountSources,
+		chunkedUpload: remote.chunkedUpload,
+	}, nil
+}
+
+// WithDigest creates a remote instance for the content of digest in the
+// same repository, the content is resolved as manifest or blob.
+func (remote *Remote) WithDigest(dgst digest.Digest) (*Remote, error) {
+	named, err := reference.WithDigest(reference.TrimNamed(remote.parsed), dgst)
 	if err != nil {
 		return nil, err
 	}
 
-	return &desc, nil
+	return &Remote{
+		Ref:          named.String(),
+		parsed:       named,
+		resolverFunc: remote.resolverFunc,
+		hostsFunc:    remote.hostsFunc,
+	}, nil
+}
+
+// The annotation prefix of repositories the blob can be mounted from, see
+// github.com/containerd/containerd/remotes/docker/handler.go
+const distributionSourceAnnotation = "containerd.io/distribution.source."
+
+// AddMountSource adds the repository of source as a candidate to mount
+// blobs from on push, instead of uploading the data again. It returns false
+// if source isn't in the same registry. It should be called before pushing.
+func (remote *Remote) AddMountSource(source *Remote) bool {
+	if reference.Domain(remote.parsed) != reference.Domain(source.parsed) {
+		return false
+	}
+	repo := reference.Path(source.parsed)
+	if repo == reference.Path(remote.parsed) {
+		return false
+	}
+	for _, added := range remote.mountSources {
+		if added == repo {
+			return true
+		}
+	}
+	remote.mountSources = append(remote.mountSources, repo)
+	return true
+}
+
+// withMountSources annotates the blob descriptor with the repositories to
+// mount from, containerd tries the one sharing the longest path prefix with
+// target repository, and uploads the blob as usual if the registry refuses
+// to mount it.
+func (remote *Remote) withMountSources(desc ocispec.Descriptor) ocispec.Descriptor {
+	if len(remote.mountSources) == 0 || isManifest(desc.MediaType) {
+		return desc
+	}
+	// Containerd looks up the annotation by host without port.
+	u, err := url.Parse("dummy://" + reference.Domain(remote.parsed))
+	if err != nil {
+		return desc
+	}
+
+	annotations := map[string]string{}
+	for key, value := range desc.Annotations {
+		annotations[key] = value
+	}
+	annotations[distributionSourceAnnotation+u.Hostname()] = strings.Join(remote.mountSources, ",")
+	desc.Annotations = annotations
+	return desc
 }
@@ -0,0 +1,51 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountSources(t *testing.T) {
+	newRemote := func(ref string) *Remote {
+		r, err := New(ref, nil)
+		assert.Nil(t, err)
+		return r
+	}
+	desc := ocispec.Descriptor{
+		MediaType:   ocispec.MediaTypeImageLayerGzip,
+		Digest:      digest.FromString("blob"),
+		Annotations: map[string]string{"key": "value"},
+	}
+
+	target := newRemote("localhost:5000/team/app:v2")
+	assert.Equal(t, desc, target.withMountSources(desc))
+
+	// Not mounted across registries or from the same repository.
+	assert.False(t, target.AddMountSource(newRemote("example.com/base/app:v1")))
+	assert.False(t, target.AddMountSource(newRemote("localhost:5000/team/app:v1")))
+	assert.True(t, target.AddMountSource(newRemote("localhost:5000/base/app:v1")))
+	assert.True(t, target.AddMountSource(newRemote("localhost:5000/team/web")))
+	assert.True(t, target.AddMountSource(newRemote("localhost:5000/base/app:v3")))
+
+	mounted := target.withMountSources(desc)
+	assert.Equal(t, map[string]string{
+		"key": "value",
+		"containerd.io/distribution.source.localhost": "base/app,team/web",
+	}, mounted.Annotations)
+	assert.Len(t, desc.Annotations, 1)
+
+	// The manifests can't be mounted.
+	manifest := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: desc.Digest}
+	assert.Equal(t, manifest, target.withMountSources(manifest))
+
+	r, err := target.WithDigest(desc.Digest)
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:5000/team/app@"+desc.Digest.String(), r.Ref)
+}
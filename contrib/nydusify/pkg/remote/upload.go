@@ -0,0 +1,395 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ChunkedUploadOpt configures the chunked upload of large blobs, the upload
+// session is persisted so that an interrupted push continues where it left
+// off, in the same process or the next run.
+type ChunkedUploadOpt struct {
+	// ChunkSize is the size of each PATCH request, the blobs not larger
+	// than it are pushed in one request. Some registries require at least
+	// 5MiB except the last chunk.
+	ChunkSize int64
+	// StateDir stores the sessions of unfinished uploads.
+	StateDir string
+}
+
+// uploadSession is the persisted state of a chunked upload.
+type uploadSession struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	// Location is the URL of upload session returned by registry.
+	Location string `json:"location"`
+	// Offset is the bytes accepted by registry.
+	Offset  int64     `json:"offset"`
+	Updated time.Time `json:"updated"`
+}
+
+// SetChunkedUpload enables the chunked upload for the blobs pushed by
+// digest from a seekable reader, it should be called before pushing.
+func (remote *Remote) SetChunkedUpload(opt ChunkedUploadOpt) {
+	remote.chunkedUpload = &opt
+}
+
+func (remote *Remote) canPushChunked(desc ocispec.Descriptor, byDigest bool, reader io.Reader) bool {
+	if remote.chunkedUpload == nil || remote.hostsFunc == nil || !byDigest {
+		return false
+	}
+	if _, ok := reader.(io.ReadSeeker); !ok {
+		return false
+	}
+	return remote.chunkedUpload.ChunkSize > 0 && desc.Size > remote.chunkedUpload.ChunkSize && !isManifest(desc.MediaType)
+}
+
+// doRequest sends the request created by newRequest to host, it's retried
+// once for the token requested by 401 challenge.
+func doRequest(ctx context.Context, host docker.RegistryHost, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	client := host.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range host.Header {
+			req.Header[key] = values
+		}
+		if host.Authorizer != nil {
+			if err := host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, errors.Wrap(err, "authorize request")
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "request %s %s", req.Method, req.URL)
+		}
+		if resp.StatusCode != http.StatusUnauthorized || host.Authorizer == nil || attempt > 0 {
+			return resp, nil
+		}
+		err = host.Authorizer.AddResponses(ctx, []*http.Response{resp})
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "authorize request")
+		}
+	}
+}
+
+func unexpectedStatus(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected status %s of %s %s: %s", resp.Status, resp.Request.Method, resp.Request.URL, strings.TrimSpace(string(body)))
+}
+
+// parseRange parses the `Range: 0-<end>` header of upload session, which
+// is the accepted bytes of blob.
+func parseRange(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid range %q", value)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range %q", value)
+	}
+	return end + 1, nil
+}
+
+// resolveLocation resolves the location header, which may be relative, of
+// response.
+func resolveLocation(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("no location of upload session in response of %s", resp.Request.URL)
+	}
+	u, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse location %s", location)
+	}
+	return u.String(), nil
+}
+
+type chunkedUpload struct {
+	host      docker.RegistryHost
+	opt       ChunkedUploadOpt
+	session   uploadSession
+	statePath string
+}
+
+func (upload *chunkedUpload) save() error {
+	upload.session.Updated = time.Now()
+	data, err := json.Marshal(upload.session)
+	if err != nil {
+		return errors.Wrap(err, "marshal upload session")
+	}
+	tmpPath := upload.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrap(err, "write upload session")
+	}
+	return errors.Wrap(os.Rename(tmpPath, upload.statePath), "write upload session")
+}
+
+// load reads the persisted session and asks registry for its progress, it
+// returns false if there is no session or the session has expired.
+func (upload *chunkedUpload) load(ctx context.Context) (bool, error) {
+	data, err := ioutil.ReadFile(upload.statePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "read upload session")
+	}
+	if err := json.Unmarshal(data, &upload.session); err != nil {
+		logrus.Warnf("Ignore invalid upload session %s: %s", upload.statePath, err)
+		return false, nil
+	}
+
+	resp, err := doRequest(ctx, upload.host, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, upload.session.Location, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		logrus.Infof("Upload session of blob %s has expired, upload from start", upload.session.Digest)
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return false, unexpectedStatus(resp)
+	}
+	if upload.session.Offset, err = parseRange(resp.Header.Get("Range")); err != nil {
+		return false, err
+	}
+	if resp.Header.Get("Location") != "" {
+		if upload.session.Location, err = resolveLocation(resp); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// start creates an upload session, the blob is mounted from mountFrom
+// repository if registry accepts, then it returns false.
+func (upload *chunkedUpload) start(ctx context.Context, mountFrom string) (bool, error) {
+	query := url.Values{}
+	if mountFrom != "" {
+		query.Set("mount", upload.session.Digest.String())
+		query.Set("from", mountFrom)
+	}
+	startURL := fmt.Sprintf("%s://%s%s/%s/blobs/uploads/?%s", upload.host.Scheme, upload.host.Host, upload.host.Path, upload.session.Repository, query.Encode())
+	resp, err := doRequest(ctx, upload.host, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, startURL, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return false, nil
+	case http.StatusAccepted:
+	default:
+		return false, unexpectedStatus(resp)
+	}
+	upload.session.Offset = 0
+	if upload.session.Location, err = resolveLocation(resp); err != nil {
+		return false, err
+	}
+	return true, upload.save()
+}
+
+func withQuery(location string, key, value string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse location %s", location)
+	}
+	query := u.Query()
+	query.Set(key, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// send uploads the rest of blob in chunks and completes the upload, the
+// session is saved after each chunk.
+func (upload *chunkedUpload) send(ctx context.Context, reader io.ReadSeeker, size int64) error {
+	for upload.session.Offset < size {
+		offset := upload.session.Offset
+		length := upload.opt.ChunkSize
+		if offset+length > size {
+			length = size - offset
+		}
+		resp, err := doRequest(ctx, upload.host, func() (*http.Request, error) {
+			if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+				return nil, errors.Wrap(err, "seek blob")
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPatch, upload.session.Location, ioutil.NopCloser(io.LimitReader(reader, length)))
+			if err != nil {
+				return nil, err
+			}
+			req.ContentLength = length
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+length-1))
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return unexpectedStatus(resp)
+		}
+		if upload.session.Location, err = resolveLocation(resp); err != nil {
+			return err
+		}
+		accepted, err := parseRange(resp.Header.Get("Range"))
+		if err != nil {
+			return err
+		}
+		if accepted <= offset {
+			accepted = offset + length
+		}
+		upload.session.Offset = accepted
+		if err := upload.save(); err != nil {
+			return err
+		}
+	}
+
+	completeURL, err := withQuery(upload.session.Location, "digest", upload.session.Digest.String())
+	if err != nil {
+		return err
+	}
+	resp, err := doRequest(ctx, upload.host, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, completeURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return unexpectedStatus(resp)
+	}
+	return nil
+}
+
+// blobExists checks whether the blob has been pushed to repository.
+func blobExists(ctx context.Context, host docker.RegistryHost, repo string, dgst digest.Digest) (bool, error) {
+	blobURL := fmt.Sprintf("%s://%s%s/%s/blobs/%s", host.Scheme, host.Host, host.Path, repo, dgst)
+	resp, err := doRequest(ctx, host, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, blobURL, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// pushChunked pushes the blob by chunked upload, an unfinished session of
+// the blob is resumed from the offset accepted by registry.
+func (remote *Remote) pushChunked(ctx context.Context, desc ocispec.Descriptor, reader io.ReadSeeker) error {
+	hosts, err := remote.hostsFunc()(reference.Domain(remote.parsed))
+	if err != nil {
+		return err
+	}
+	var host *docker.RegistryHost
+	for idx := range hosts {
+		if hosts[idx].Capabilities.Has(docker.HostCapabilityPush) {
+			host = &hosts[idx]
+			break
+		}
+	}
+	if host == nil {
+		return fmt.Errorf("no host to push %s", remote.Ref)
+	}
+	repo := reference.Path(remote.parsed)
+	scope := fmt.Sprintf("repository:%s:pull,push", repo)
+	for _, source := range remote.mountSources {
+		scope += fmt.Sprintf(" repository:%s:pull", source)
+	}
+	ctx = docker.WithScope(ctx, scope)
+
+	if exists, err := blobExists(ctx, *host, repo, desc.Digest); err != nil {
+		return errors.Wrapf(err, "check blob %s", desc.Digest)
+	} else if exists {
+		return nil
+	}
+
+	if err := os.MkdirAll(remote.chunkedUpload.StateDir, 0755); err != nil {
+		return errors.Wrap(err, "create upload state directory")
+	}
+	key := digest.FromString(host.Host + "/" + repo + "@" + desc.Digest.String())
+	upload := &chunkedUpload{
+		host: *host,
+		opt:  *remote.chunkedUpload,
+		session: uploadSession{
+			Repository: repo,
+			Digest:     desc.Digest,
+		},
+		statePath: filepath.Join(remote.chunkedUpload.StateDir, key.Encoded()+".json"),
+	}
+
+	resumed, err := upload.load(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "resume upload of blob %s", desc.Digest)
+	}
+	if resumed {
+		logrus.Infof("Resume upload of blob %s at %d of %d bytes", desc.Digest, upload.session.Offset, desc.Size)
+	} else {
+		mountFrom := ""
+		if len(remote.mountSources) > 0 {
+			mountFrom = remote.mountSources[0]
+		}
+		started, err := upload.start(ctx, mountFrom)
+		if err != nil {
+			return errors.Wrapf(err, "start upload of blob %s", desc.Digest)
+		}
+		if !started {
+			logrus.Debugf("Mounted blob %s from %s", desc.Digest, mountFrom)
+			return nil
+		}
+	}
+
+	// The session is kept for next attempt on failure.
+	if err := upload.send(ctx, reader, desc.Size); err != nil {
+		return errors.Wrapf(err, "upload blob %s", desc.Digest)
+	}
+	if err := os.Remove(upload.statePath); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Remove upload session %s: %s", upload.statePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRegistry implements the chunked upload of distribution API.
+type testRegistry struct {
+	mutex    sync.Mutex
+	blobs    map[digest.Digest][]byte
+	uploads  map[string][]byte
+	patches  int
+	failOn   int
+	sessions int
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch {
+	case req.Method == http.MethodHead:
+		dgst := digest.Digest(req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:])
+		if _, ok := r.blobs[dgst]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == http.MethodPost:
+		r.sessions++
+		id := fmt.Sprintf("session-%d", r.sessions)
+		r.uploads[id] = []byte{}
+		w.Header().Set("Location", "/v2/app/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		id := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		data, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			r.patches++
+			if r.patches == r.failOn {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			if req.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", len(data), len(data)+int(req.ContentLength)-1) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			chunk, _ := ioutil.ReadAll(req.Body)
+			data = append(data, chunk...)
+			r.uploads[id] = data
+		case http.MethodPut:
+			dgst := digest.Digest(req.URL.Query().Get("digest"))
+			if digest.FromBytes(data) != dgst {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.blobs[dgst] = data
+			delete(r.uploads, id)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Location", req.URL.Path)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+		if req.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+}
+
+func TestChunkedUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-upload-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	registry := &testRegistry{
+		blobs:   map[digest.Digest][]byte{},
+		uploads: map[string][]byte{},
+		failOn:  3,
+	}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+
+	hostsFunc := func() docker.RegistryHosts {
+		return func(string) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client:       server.Client(),
+				Host:         serverURL.Host,
+				Scheme:       "http",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush,
+			}}, nil
+		}
+	}
+	r, err := NewWithRegistryHosts(serverURL.Host+"/app:v1", hostsFunc)
+	assert.Nil(t, err)
+	r.SetChunkedUpload(ChunkedUploadOpt{ChunkSize: 10, StateDir: dir})
+
+	data := []byte(strings.Repeat("0123456789", 4) + "abc")
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	ctx := context.Background()
+
+	// The push is interrupted at the third chunk.
+	assert.NotNil(t, r.Push(ctx, desc, true, bytes.NewReader(data)))
+	states, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, states, 1)
+
+	// The next push continues the session from the 20th byte.
+	assert.Nil(t, r.Push(ctx, desc, true, bytes.NewReader(data)))
+	assert.Equal(t, data, registry.blobs[desc.Digest])
+	assert.Equal(t, 1, registry.sessions)
+	assert.Equal(t, 6, registry.patches)
+	states, err = ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, states, 0)
+
+	// The existing blob isn't uploaded again.
+	assert.Nil(t, r.Push(ctx, desc, true, bytes.NewReader(data)))
+	assert.Equal(t, 6, registry.patches)
+
+	// The expired session is restarted.
+	other := []byte(strings.Repeat("x", 25))
+	otherDesc := ocispec.Descriptor{MediaType: desc.MediaType, Digest: digest.FromBytes(other), Size: int64(len(other))}
+	registry.failOn = 8
+	assert.NotNil(t, r.Push(ctx, otherDesc, true, bytes.NewReader(other)))
+	registry.uploads = map[string][]byte{}
+	assert.Nil(t, r.Push(ctx, otherDesc, true, bytes.NewReader(other)))
+	assert.Equal(t, other, registry.blobs[otherDesc.Digest])
+	assert.Equal(t, 3, registry.sessions)
+
+	assert.Equal(t, int64(0), mustParseRange(t, ""))
+	assert.Equal(t, int64(10), mustParseRange(t, "0-9"))
+	_, err = parseRange("bytes")
+	assert.NotNil(t, err)
+}
+
+func mustParseRange(t *testing.T, value string) int64 {
+	offset, err := parseRange(value)
+	assert.Nil(t, err)
+	return offset
+}
@@ -0,0 +1,302 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package restore reconstructs the original image from Nydus image by the
+// tar-split attached on conversion, the layer tarballs are reassembled
+// from the raw tar headers and the file data in Nydus blobs, then pushed
+// with the raw manifest and config of source image.
+package restore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/tarsplit"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/viewer"
+)
+
+type Opt struct {
+	Target         string
+	TargetInsecure bool
+	ExpectedArch   string
+	// Source is the reference to push the original image.
+	Source         string
+	SourceInsecure bool
+}
+
+// Result is the report of reconstruction.
+type Result struct {
+	Digest digest.Digest `json:"digest"`
+	// Identical is true if the manifest digest is the same as source image.
+	Identical bool `json:"identical"`
+	Layers    int  `json:"layers"`
+	// RecompressedLayers are the layers whose compressed digests changed,
+	// their uncompressed tarballs are still identical.
+	RecompressedLayers int `json:"recompressed_layers"`
+}
+
+// compressionOf returns whether the layer of media type is compressed by
+// gzip, the layer can't be reproduced if it's neither uncompressed nor gzip
+// compressed.
+func compressionOf(mediaType string) (compressed bool, ok bool) {
+	switch mediaType {
+	case ocispec.MediaTypeImageLayer, images.MediaTypeDockerSchema2Layer:
+		return false, true
+	case ocispec.MediaTypeImageLayerGzip, images.MediaTypeDockerSchema2LayerGzip:
+		return true, true
+	}
+	return true, false
+}
+
+// gzipMediaType returns the media type of gzip compressed layer in manifest.
+func gzipMediaType(manifestMediaType string) string {
+	if manifestMediaType == images.MediaTypeDockerSchema2Manifest {
+		return images.MediaTypeDockerSchema2LayerGzip
+	}
+	return ocispec.MediaTypeImageLayerGzip
+}
+
+type countingWriter struct {
+	size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+// writeLayer reassembles the layer to file, the layer is compressed by gzip
+// of default level, the same as most image builders, if the original layer
+// is compressed. Returns the size, digest and diff ID of written layer.
+func writeLayer(
+	ctx context.Context, layer *tarsplit.Layer, fw tarsplit.FileWriter, compressed bool, file io.Writer,
+) (int64, digest.Digest, digest.Digest, error) {
+	layerDigester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	w := io.MultiWriter(file, layerDigester.Hash(), counter)
+
+	var gw *gzip.Writer
+	diffIDDigester := digest.Canonical.Digester()
+	tarWriter := io.MultiWriter(w, diffIDDigester.Hash())
+	if compressed {
+		gw = gzip.NewWriter(w)
+		tarWriter = io.MultiWriter(gw, diffIDDigester.Hash())
+	}
+	if err := layer.WriteTar(ctx, fw, tarWriter); err != nil {
+		return 0, "", "", err
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return 0, "", "", errors.Wrap(err, "compress layer")
+		}
+	}
+
+	return counter.size, layerDigester.Digest(), diffIDDigester.Digest(), nil
+}
+
+// pullIndex pulls the reconstruction data attached to Nydus manifest, the
+// latest one is used if there are several.
+func pullIndex(ctx context.Context, r *remote.Remote, subject digest.Digest) (*tarsplit.Index, error) {
+	referrers, err := r.Referrers(ctx, subject, tarsplit.ArtifactType)
+	if err != nil {
+		return nil, err
+	}
+	if len(referrers) == 0 {
+		return nil, fmt.Errorf("no tar-split is attached to %s, it should be converted with `--tar-split`", subject)
+	}
+	sort.SliceStable(referrers, func(i, j int) bool {
+		return referrers[i].Annotations[ocispec.AnnotationCreated] > referrers[j].Annotations[ocispec.AnnotationCreated]
+	})
+
+	data, err := pullBlob(ctx, r, referrers[0].Descriptor)
+	if err != nil {
+		return nil, errors.Wrap(err, "pull tar-split manifest")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Wrap(err, "unmarshal tar-split manifest")
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != tarsplit.MediaType {
+		return nil, fmt.Errorf("invalid tar-split manifest %s", referrers[0].Digest)
+	}
+	data, err = pullBlob(ctx, r, manifest.Layers[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "pull tar-split")
+	}
+	return tarsplit.Unmarshal(data)
+}
+
+func pullBlob(ctx context.Context, r *remote.Remote, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := r.Pull(ctx, desc, true)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if digest.FromBytes(data) != desc.Digest {
+		return nil, fmt.Errorf("digest of %s doesn't match", desc.Digest)
+	}
+	return data, nil
+}
+
+// rewriteLayers replaces the layers of raw manifest, the other fields are
+// kept as is.
+func rewriteLayers(manifest []byte, layers []ocispec.Descriptor) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(manifest, &fields); err != nil {
+		return nil, errors.Wrap(err, "unmarshal source manifest")
+	}
+	data, err := json.Marshal(layers)
+	if err != nil {
+		return nil, err
+	}
+	fields["layers"] = data
+	return json.Marshal(fields)
+}
+
+// Restore reconstructs the source image of Nydus image and pushes it, the
+// uncompressed layers are verified by the diff IDs in source config.
+func Restore(ctx context.Context, opt Opt) (*Result, error) {
+	targetRemote, err := provider.DefaultRemote(opt.Target, opt.TargetInsecure)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parser.New(targetRemote, opt.ExpectedArch)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := p.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Nydus image")
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("not found Nydus image of %s", opt.Target)
+	}
+	index, err := pullIndex(ctx, targetRemote, parsed.NydusImage.Desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(index.Manifest, &manifest); err != nil {
+		return nil, errors.Wrap(err, "unmarshal source manifest")
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(index.Config, &config); err != nil {
+		return nil, errors.Wrap(err, "unmarshal source config")
+	}
+	if len(manifest.Layers) != len(index.Layers) || len(config.RootFS.DiffIDs) != len(index.Layers) {
+		return nil, fmt.Errorf("mismatched layers of source manifest (%d), config (%d) and tar-split (%d)",
+			len(manifest.Layers), len(config.RootFS.DiffIDs), len(index.Layers))
+	}
+
+	sourceRemote, err := provider.DefaultRemote(opt.Source, opt.SourceInsecure)
+	if err != nil {
+		return nil, err
+	}
+	v := viewer.New(targetRemote, &dedup.Bootstrap{Compressor: index.Compressor})
+	reader := v.NewFileReader()
+	defer reader.Close()
+
+	result := &Result{Layers: len(index.Layers)}
+	layers := []ocispec.Descriptor{}
+	for idx, desc := range manifest.Layers {
+		mediaType := desc.MediaType
+		compressed, ok := compressionOf(mediaType)
+		if !ok {
+			logrus.Warnf("Layer %s of media type %s is recompressed by gzip", desc.Digest, mediaType)
+			mediaType = gzipMediaType(index.ManifestDesc.MediaType)
+		}
+		layer, err := restoreLayer(ctx, sourceRemote, &index.Layers[idx], reader, mediaType, compressed, config.RootFS.DiffIDs[idx])
+		if err != nil {
+			return nil, errors.Wrapf(err, "restore layer %s", desc.Digest)
+		}
+		if layer.Digest != desc.Digest || layer.Size != desc.Size {
+			if ok {
+				logrus.Warnf("Layer %s is recompressed to %s, the uncompressed tarball is identical", desc.Digest, layer.Digest)
+			}
+			layer.Annotations = desc.Annotations
+			desc = *layer
+			result.RecompressedLayers++
+		}
+		layers = append(layers, desc)
+		logrus.Infof("Restored layer %s", desc.Digest)
+	}
+
+	if err := sourceRemote.Push(ctx, manifest.Config, true, bytes.NewReader(index.Config)); err != nil {
+		return nil, errors.Wrap(err, "push source config")
+	}
+
+	manifestDesc := index.ManifestDesc
+	manifestBytes := index.Manifest
+	if result.RecompressedLayers > 0 {
+		manifestBytes, err = rewriteLayers(index.Manifest, layers)
+		if err != nil {
+			return nil, err
+		}
+		manifestDesc.Digest = digest.FromBytes(manifestBytes)
+		manifestDesc.Size = int64(len(manifestBytes))
+	}
+	if err := sourceRemote.Push(ctx, manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return nil, errors.Wrap(err, "push source manifest")
+	}
+	result.Digest = manifestDesc.Digest
+	result.Identical = manifestDesc.Digest == index.ManifestDesc.Digest
+
+	return result, nil
+}
+
+// restoreLayer reassembles the layer to a temporary file and pushes it.
+func restoreLayer(
+	ctx context.Context, r *remote.Remote, layer *tarsplit.Layer, fw tarsplit.FileWriter,
+	mediaType string, compressed bool, diffID digest.Digest,
+) (*ocispec.Descriptor, error) {
+	file, err := ioutil.TempFile("", "nydusify-restore-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create layer file")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, layerDigest, layerDiffID, err := writeLayer(ctx, layer, fw, compressed, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "reassemble layer")
+	}
+	if layerDiffID != diffID {
+		return nil, fmt.Errorf("diff ID %s of reassembled layer doesn't match %s", layerDiffID, diffID)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seek layer file")
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    layerDigest,
+		Size:      size,
+	}
+	if err := r.Push(ctx, desc, true, file); err != nil {
+		return nil, errors.Wrap(err, "push layer")
+	}
+	return &desc, nil
+}
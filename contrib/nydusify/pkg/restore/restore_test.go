@@ -0,0 +1,58 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package restore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionOf(t *testing.T) {
+	compressed, ok := compressionOf(ocispec.MediaTypeImageLayer)
+	assert.False(t, compressed)
+	assert.True(t, ok)
+	compressed, ok = compressionOf(images.MediaTypeDockerSchema2LayerGzip)
+	assert.True(t, compressed)
+	assert.True(t, ok)
+	_, ok = compressionOf("application/vnd.oci.image.layer.v1.tar+zstd")
+	assert.False(t, ok)
+
+	assert.Equal(t, images.MediaTypeDockerSchema2LayerGzip, gzipMediaType(images.MediaTypeDockerSchema2Manifest))
+	assert.Equal(t, ocispec.MediaTypeImageLayerGzip, gzipMediaType(ocispec.MediaTypeImageManifest))
+}
+
+func TestRewriteLayers(t *testing.T) {
+	manifest := []byte(`{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+   "config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": 2, "digest": "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},
+   "layers": [{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 1, "digest": "sha256:6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"}]
+}`)
+	layer := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerGzip,
+		Digest:    digest.FromString("recompressed"),
+		Size:      12,
+	}
+	data, err := rewriteLayers(manifest, []ocispec.Descriptor{layer})
+	assert.Nil(t, err)
+
+	var fields struct {
+		MediaType string               `json:"mediaType"`
+		Config    ocispec.Descriptor   `json:"config"`
+		Layers    []ocispec.Descriptor `json:"layers"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &fields))
+	assert.Equal(t, images.MediaTypeDockerSchema2Manifest, fields.MediaType)
+	assert.Equal(t, int64(2), fields.Config.Size)
+	assert.Equal(t, []ocispec.Descriptor{layer}, fields.Layers)
+
+	_, err = rewriteLayers([]byte("invalid"), nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sbom generates the software bill of materials of image during
+// conversion, the package databases are read from the source layers when
+// they are mounted for building, so the image isn't scanned again.
+package sbom
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/xattr"
+)
+
+const (
+	osReleasePath    = "etc/os-release"
+	osReleaseLibPath = "usr/lib/os-release"
+	dpkgStatusPath   = "var/lib/dpkg/status"
+	// Distroless images keep a status file for each package.
+	dpkgStatusDir = "var/lib/dpkg/status.d"
+	apkDBPath     = "lib/apk/db/installed"
+
+	// Skip the unreasonably large database.
+	maxFileSize = 64 << 20
+)
+
+var trackedFiles = []string{osReleasePath, osReleaseLibPath, dpkgStatusPath, apkDBPath}
+
+// layerFiles is the tracked files in a layer, the removed paths and
+// opaque directories hide the files of lower layers.
+type layerFiles struct {
+	files   map[string][]byte
+	removed []string
+	opaque  []string
+}
+
+// Collector collects the tracked files from source layers, the files of
+// upper layer override the lower ones.
+type Collector struct {
+	mutex  sync.Mutex
+	layers []*layerFiles
+}
+
+// NewCollector creates collector for the image with count of layers.
+func NewCollector(layers int) *Collector {
+	return &Collector{
+		layers: make([]*layerFiles, layers),
+	}
+}
+
+func isWhiteout(info os.FileInfo, whiteoutSpec string) bool {
+	if whiteoutSpec != "overlayfs" || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOpaque(layerDir, dir, whiteoutSpec string) bool {
+	if whiteoutSpec == "overlayfs" {
+		value, err := xattr.LGet(filepath.Join(layerDir, dir), "trusted.overlay.opaque")
+		return err == nil && string(value) == "y"
+	}
+	_, err := os.Lstat(filepath.Join(layerDir, dir, ".wh..wh..opq"))
+	return err == nil
+}
+
+// checkPath records the whiteouts of path and its parent directories, the
+// file info is nil if the path doesn't exist in layer.
+func (lf *layerFiles) checkPath(layerDir, relPath, whiteoutSpec string) (os.FileInfo, error) {
+	dirs := strings.Split(relPath, "/")
+	for idx := range dirs {
+		current := path.Join(dirs[:idx+1]...)
+		if whiteoutSpec == "oci" {
+			whiteout := path.Join(path.Dir(current), ".wh."+path.Base(current))
+			if _, err := os.Lstat(filepath.Join(layerDir, whiteout)); err == nil {
+				lf.removed = append(lf.removed, current)
+				return nil, nil
+			}
+		}
+		info, err := os.Lstat(filepath.Join(layerDir, current))
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if isWhiteout(info, whiteoutSpec) {
+			lf.removed = append(lf.removed, current)
+			return nil, nil
+		}
+		if idx == len(dirs)-1 {
+			return info, nil
+		}
+		if !info.IsDir() {
+			// The parent is replaced by non-directory.
+			lf.removed = append(lf.removed, current)
+			return nil, nil
+		}
+		if isOpaque(layerDir, current, whiteoutSpec) {
+			lf.opaque = append(lf.opaque, current)
+		}
+	}
+	return nil, nil
+}
+
+func (lf *layerFiles) addFile(layerDir, relPath string, info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		// e.g. the symlink of os-release, the file of lower layer is hidden.
+		lf.removed = append(lf.removed, relPath)
+		return nil
+	}
+	if info.Size() > maxFileSize {
+		return fmt.Errorf("file %s is too large (%d bytes)", relPath, info.Size())
+	}
+	data, err := ioutil.ReadFile(filepath.Join(layerDir, relPath))
+	if err != nil {
+		return errors.Wrapf(err, "read %s", relPath)
+	}
+	lf.files[relPath] = data
+	return nil
+}
+
+// AddLayer reads the tracked files from the mounted directory of source
+// layer, the whiteouts are recognized as per the whiteout spec (`oci` or
+// `overlayfs`) of layer.
+func (c *Collector) AddLayer(index int, layerDir, whiteoutSpec string) error {
+	if index < 0 || index >= len(c.layers) {
+		return fmt.Errorf("invalid layer index %d", index)
+	}
+
+	lf := &layerFiles{files: map[string][]byte{}}
+	for _, relPath := range trackedFiles {
+		info, err := lf.checkPath(layerDir, relPath, whiteoutSpec)
+		if err != nil {
+			return err
+		}
+		if info != nil {
+			if err := lf.addFile(layerDir, relPath, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	info, err := lf.checkPath(layerDir, dpkgStatusDir, whiteoutSpec)
+	if err != nil {
+		return err
+	}
+	if info != nil {
+		if !info.IsDir() {
+			lf.removed = append(lf.removed, dpkgStatusDir)
+		} else {
+			if isOpaque(layerDir, dpkgStatusDir, whiteoutSpec) {
+				lf.opaque = append(lf.opaque, dpkgStatusDir)
+			}
+			entries, err := ioutil.ReadDir(filepath.Join(layerDir, dpkgStatusDir))
+			if err != nil {
+				return errors.Wrapf(err, "read %s", dpkgStatusDir)
+			}
+			for _, entry := range entries {
+				relPath := path.Join(dpkgStatusDir, entry.Name())
+				if whiteoutSpec == "oci" && strings.HasPrefix(entry.Name(), ".wh.") {
+					if entry.Name() != ".wh..wh..opq" {
+						lf.removed = append(lf.removed, path.Join(dpkgStatusDir, strings.TrimPrefix(entry.Name(), ".wh.")))
+					}
+					continue
+				}
+				if isWhiteout(entry, whiteoutSpec) {
+					lf.removed = append(lf.removed, relPath)
+					continue
+				}
+				if strings.HasSuffix(entry.Name(), ".md5sums") {
+					continue
+				}
+				if err := lf.addFile(layerDir, relPath, entry); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	c.layers[index] = lf
+	c.mutex.Unlock()
+	return nil
+}
+
+// Missing returns the count of layers not added, e.g. the layers pulled
+// from build cache, the packages in them may be missed.
+func (c *Collector) Missing() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	missing := 0
+	for _, lf := range c.layers {
+		if lf == nil {
+			missing++
+		}
+	}
+	return missing
+}
+
+func removeTree(files map[string][]byte, dir string, keepSelf bool) {
+	for name := range files {
+		if (!keepSelf && name == dir) || strings.HasPrefix(name, dir+"/") {
+			delete(files, name)
+		}
+	}
+}
+
+// merge applies the layers in order to get the tracked files of image.
+func (c *Collector) merge() map[string][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	files := map[string][]byte{}
+	for _, lf := range c.layers {
+		if lf == nil {
+			continue
+		}
+		for _, dir := range lf.opaque {
+			removeTree(files, dir, true)
+		}
+		for _, removed := range lf.removed {
+			removeTree(files, removed, false)
+		}
+		for name, data := range lf.files {
+			files[name] = data
+		}
+	}
+	return files
+}
+
+// Inventory returns the OS release and installed packages of image, the
+// packages are sorted by type and name.
+func (c *Collector) Inventory() (*OSRelease, []Package) {
+	files := c.merge()
+
+	osRelease := &OSRelease{}
+	if data, ok := files[osReleasePath]; ok {
+		osRelease = parseOSRelease(data)
+	} else if data, ok := files[osReleaseLibPath]; ok {
+		osRelease = parseOSRelease(data)
+	}
+
+	packages := []Package{}
+	for name, data := range files {
+		switch {
+		case name == dpkgStatusPath || strings.HasPrefix(name, dpkgStatusDir+"/"):
+			packages = append(packages, parseDpkgStatus(data)...)
+		case name == apkDBPath:
+			packages = append(packages, parseApkDB(data)...)
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Type != packages[j].Type {
+			return packages[i].Type < packages[j].Type
+		}
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+	return osRelease, packages
+}
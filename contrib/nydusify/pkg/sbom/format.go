@@ -0,0 +1,240 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+type Format string
+
+const (
+	// FormatSPDX is SPDX 2.3 document in JSON.
+	FormatSPDX Format = "spdx"
+	// FormatCycloneDX is CycloneDX 1.4 BOM in JSON.
+	FormatCycloneDX Format = "cyclonedx"
+
+	MediaTypeSPDX      = "application/spdx+json"
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+)
+
+// ParseFormat validates the SBOM format.
+func ParseFormat(format string) (Format, error) {
+	switch Format(format) {
+	case FormatSPDX, FormatCycloneDX:
+		return Format(format), nil
+	}
+	return "", fmt.Errorf("unsupported SBOM format %s, should be spdx or cyclonedx", format)
+}
+
+// MediaType returns the media type (as well as artifact type) of format.
+func (f Format) MediaType() string {
+	if f == FormatCycloneDX {
+		return MediaTypeCycloneDX
+	}
+	return MediaTypeSPDX
+}
+
+// Document describes the image and its packages.
+type Document struct {
+	// Image is the reference of image.
+	Image string
+	// Digest is the digest of image manifest.
+	Digest      digest.Digest
+	Created     time.Time
+	ToolVersion string
+	OSRelease   *OSRelease
+	Packages    []Package
+}
+
+// Generate renders the document in format.
+func Generate(format Format, doc Document) ([]byte, error) {
+	if doc.OSRelease == nil {
+		doc.OSRelease = &OSRelease{}
+	}
+	switch format {
+	case FormatSPDX:
+		return json.MarshalIndent(spdxDocument(doc), "", "  ")
+	case FormatCycloneDX:
+		return json.MarshalIndent(cyclonedxBOM(doc), "", "  ")
+	}
+	return nil, fmt.Errorf("unsupported SBOM format %s", format)
+}
+
+// The namespace is unique for the image manifest.
+func documentNamespace(doc Document) string {
+	return fmt.Sprintf("https://nydus.dev/spdxdocs/%s@%s", doc.Image, doc.Digest)
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	LicenseComments  string            `json:"licenseComments,omitempty"`
+	CopyrightText    string            `json:"copyrightText"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+func spdxDocument(doc Document) interface{} {
+	imagePackage := spdxPackage{
+		Name:             doc.Image,
+		SPDXID:           "SPDXRef-Image",
+		VersionInfo:      doc.Digest.String(),
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+		PrimaryPurpose:   "CONTAINER",
+	}
+	if doc.Digest.Validate() == nil {
+		imagePackage.Checksums = []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: doc.Digest.Encoded()}}
+	}
+	packages := []spdxPackage{imagePackage}
+	relationships := []spdxRelationship{{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: imagePackage.SPDXID,
+	}}
+	for idx, pkg := range doc.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%d", pkg.Type, idx)
+		packages = append(packages, spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           id,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			// The license of apk isn't SPDX expression necessarily.
+			LicenseDeclared: "NOASSERTION",
+			LicenseComments: pkg.License,
+			CopyrightText:   "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.PURL(doc.OSRelease),
+			}},
+		})
+		relationships = append(relationships, spdxRelationship{
+			SPDXElementID:      imagePackage.SPDXID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              doc.Image,
+		"documentNamespace": documentNamespace(doc),
+		"creationInfo": map[string]interface{}{
+			"created":  doc.Created.UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: nydusify-" + doc.ToolVersion},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+type cyclonedxLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cyclonedxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cyclonedxComponent struct {
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Type       string              `json:"type"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Licenses   []cyclonedxLicense  `json:"licenses,omitempty"`
+	Properties []cyclonedxProperty `json:"properties,omitempty"`
+}
+
+func cyclonedxBOM(doc Document) interface{} {
+	components := []cyclonedxComponent{}
+	if doc.OSRelease.ID != "" {
+		components = append(components, cyclonedxComponent{
+			Type:    "operating-system",
+			Name:    doc.OSRelease.ID,
+			Version: doc.OSRelease.VersionID,
+		})
+	}
+	for _, pkg := range doc.Packages {
+		purl := pkg.PURL(doc.OSRelease)
+		component := cyclonedxComponent{
+			BOMRef:  purl,
+			Type:    "library",
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			PURL:    purl,
+			Properties: []cyclonedxProperty{{
+				Name:  "nydus:package:type",
+				Value: pkg.Type,
+			}},
+		}
+		if pkg.License != "" {
+			license := cyclonedxLicense{}
+			license.License.Name = pkg.License
+			component.Licenses = []cyclonedxLicense{license}
+		}
+		components = append(components, component)
+	}
+
+	return map[string]interface{}{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.4",
+		"serialNumber": "urn:uuid:" + uuid.NewSHA1(uuid.NameSpaceURL, []byte(documentNamespace(doc))).String(),
+		"version":      1,
+		"metadata": map[string]interface{}{
+			"timestamp": doc.Created.UTC().Format(time.RFC3339),
+			"tools": []map[string]string{{
+				"vendor":  "Nydus",
+				"name":    "nydusify",
+				"version": doc.ToolVersion,
+			}},
+			"component": cyclonedxComponent{
+				BOMRef:  doc.Digest.String(),
+				Type:    "container",
+				Name:    doc.Image,
+				Version: doc.Digest.String(),
+			},
+		},
+		"components": components,
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	PackageTypeDeb = "deb"
+	PackageTypeApk = "apk"
+)
+
+// OSRelease is the distribution of image in `/etc/os-release`.
+type OSRelease struct {
+	ID        string
+	VersionID string
+	Name      string
+}
+
+// Package is an installed package recorded in the package database.
+type Package struct {
+	Type    string
+	Name    string
+	Version string
+	Arch    string
+	// License is the declared license of apk package, it's not an SPDX
+	// license expression necessarily.
+	License string
+	// Source is the source package of deb, or the origin package of apk.
+	Source string
+}
+
+// PURL returns the package URL of package, see
+// https://github.com/package-url/purl-spec.
+func (pkg Package) PURL(osRelease *OSRelease) string {
+	namespace := osRelease.ID
+	if namespace == "" {
+		namespace = "unknown"
+	}
+	purl := fmt.Sprintf("pkg:%s/%s/%s", pkg.Type, url.PathEscape(namespace), url.PathEscape(pkg.Name))
+	if pkg.Version != "" {
+		purl += "@" + url.PathEscape(pkg.Version)
+	}
+
+	qualifiers := []string{}
+	if pkg.Arch != "" {
+		qualifiers = append(qualifiers, "arch="+url.QueryEscape(pkg.Arch))
+	}
+	if osRelease.ID != "" && osRelease.VersionID != "" {
+		qualifiers = append(qualifiers, "distro="+url.QueryEscape(osRelease.ID+"-"+osRelease.VersionID))
+	}
+	if pkg.Source != "" && pkg.Source != pkg.Name {
+		qualifiers = append(qualifiers, "upstream="+url.QueryEscape(pkg.Source))
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+func parseOSRelease(data []byte) *OSRelease {
+	osRelease := &OSRelease{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Trim(parts[1], `"'`)
+		switch parts[0] {
+		case "ID":
+			osRelease.ID = value
+		case "VERSION_ID":
+			osRelease.VersionID = value
+		case "PRETTY_NAME":
+			osRelease.Name = value
+		}
+	}
+	return osRelease
+}
+
+// parseStanzas parses the paragraphs of `key: value` fields separated by
+// blank line, the continuation lines starting with space are skipped.
+func parseStanzas(data []byte) []map[string]string {
+	stanzas := []map[string]string{}
+	current := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxFileSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				stanzas = append(stanzas, current)
+				current = map[string]string{}
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			current[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+	if len(current) > 0 {
+		stanzas = append(stanzas, current)
+	}
+	return stanzas
+}
+
+// parseDpkgStatus parses `/var/lib/dpkg/status` of Debian based image, the
+// packages not installed (e.g. removed but config files kept) are skipped.
+func parseDpkgStatus(data []byte) []Package {
+	packages := []Package{}
+	for _, stanza := range parseStanzas(data) {
+		if stanza["Package"] == "" {
+			continue
+		}
+		// The status files of distroless image have no status field.
+		if status, ok := stanza["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+		source := stanza["Source"]
+		// The source field may have version, e.g. `glibc (2.31-13)`.
+		if idx := strings.Index(source, " "); idx >= 0 {
+			source = source[:idx]
+		}
+		packages = append(packages, Package{
+			Type:    PackageTypeDeb,
+			Name:    stanza["Package"],
+			Version: stanza["Version"],
+			Arch:    stanza["Architecture"],
+			Source:  source,
+		})
+	}
+	return packages
+}
+
+// parseApkDB parses `/lib/apk/db/installed` of Alpine based image.
+func parseApkDB(data []byte) []Package {
+	packages := []Package{}
+	for _, stanza := range parseStanzas(data) {
+		if stanza["P"] == "" {
+			continue
+		}
+		packages = append(packages, Package{
+			Type:    PackageTypeApk,
+			Name:    stanza["P"],
+			Version: stanza["V"],
+			Arch:    stanza["A"],
+			License: stanza["L"],
+			Source:  stanza["o"],
+		})
+	}
+	return packages
+}
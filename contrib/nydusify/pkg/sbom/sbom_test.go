@@ -0,0 +1,171 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sbom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+const dpkgStatus = `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Source: glibc (2.31-13)
+Version: 2.31-13+deb11u3
+Description: GNU C Library
+ Contains the standard libraries.
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+
+Package: bash
+Status: install ok installed
+Architecture: amd64
+Version: 5.1-2+b3
+`
+
+const apkDB = `C:Q1abc=
+P:musl
+V:1.2.3-r0
+A:x86_64
+L:MIT
+o:musl
+
+P:busybox
+V:1.35.0-r17
+A:x86_64
+L:GPL-2.0-only
+o:busybox
+`
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestParsePackages(t *testing.T) {
+	packages := parseDpkgStatus([]byte(dpkgStatus))
+	assert.Equal(t, []Package{
+		{Type: PackageTypeDeb, Name: "libc6", Version: "2.31-13+deb11u3", Arch: "amd64", Source: "glibc"},
+		{Type: PackageTypeDeb, Name: "bash", Version: "5.1-2+b3", Arch: "amd64"},
+	}, packages)
+
+	packages = parseApkDB([]byte(apkDB))
+	assert.Len(t, packages, 2)
+	assert.Equal(t, Package{Type: PackageTypeApk, Name: "musl", Version: "1.2.3-r0", Arch: "x86_64", License: "MIT", Source: "musl"}, packages[0])
+
+	osRelease := parseOSRelease([]byte("PRETTY_NAME=\"Debian GNU/Linux 11 (bullseye)\"\nID=debian\nVERSION_ID=\"11\"\n"))
+	assert.Equal(t, &OSRelease{ID: "debian", VersionID: "11", Name: "Debian GNU/Linux 11 (bullseye)"}, osRelease)
+	assert.Equal(t, "pkg:deb/debian/libc6@2.31-13+deb11u3?arch=amd64&distro=debian-11&upstream=glibc",
+		Package{Type: PackageTypeDeb, Name: "libc6", Version: "2.31-13+deb11u3", Arch: "amd64", Source: "glibc"}.PURL(osRelease))
+	assert.Equal(t, "pkg:apk/unknown/musl", Package{Type: PackageTypeApk, Name: "musl"}.PURL(&OSRelease{}))
+}
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-sbom-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	lower := filepath.Join(dir, "lower")
+	writeFiles(t, lower, map[string]string{
+		"etc/os-release":            "ID=debian\nVERSION_ID=11\n",
+		"var/lib/dpkg/status":       dpkgStatus,
+		"var/lib/dpkg/status.d/tzd": "Package: tzdata\nVersion: 2021a\n",
+		"var/lib/dpkg/status.d/old": "Package: old\nVersion: 1\n",
+		"lib/apk/db/installed":      apkDB,
+	})
+	upper := filepath.Join(dir, "upper")
+	writeFiles(t, upper, map[string]string{
+		"var/lib/dpkg/status":           "Package: bash\nStatus: install ok installed\nVersion: 5.2\n",
+		"var/lib/dpkg/status.d/.wh.old": "",
+		"lib/.wh.apk":                   "",
+		"usr/bin/bash":                  "",
+	})
+
+	c := NewCollector(3)
+	assert.Nil(t, c.AddLayer(0, lower, "oci"))
+	assert.Nil(t, c.AddLayer(2, upper, "oci"))
+	assert.NotNil(t, c.AddLayer(3, upper, "oci"))
+	assert.Equal(t, 1, c.Missing())
+
+	osRelease, packages := c.Inventory()
+	assert.Equal(t, "debian", osRelease.ID)
+	assert.Equal(t, []Package{
+		{Type: PackageTypeDeb, Name: "bash", Version: "5.2"},
+		{Type: PackageTypeDeb, Name: "tzdata", Version: "2021a"},
+	}, packages)
+
+	// Opaque directory hides the files of lower layers.
+	opaque := filepath.Join(dir, "opaque")
+	writeFiles(t, opaque, map[string]string{
+		"var/lib/dpkg/.wh..wh..opq": "",
+	})
+	assert.Nil(t, c.AddLayer(1, opaque, "oci"))
+	_, packages = c.Inventory()
+	assert.Equal(t, []Package{{Type: PackageTypeDeb, Name: "bash", Version: "5.2"}}, packages)
+}
+
+func TestGenerate(t *testing.T) {
+	doc := Document{
+		Image:       "example.com/app:v1",
+		Digest:      digest.FromString("manifest"),
+		Created:     time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC),
+		ToolVersion: "v2.1.0",
+		OSRelease:   &OSRelease{ID: "alpine", VersionID: "3.16.0"},
+		Packages:    parseApkDB([]byte(apkDB)),
+	}
+
+	_, err := ParseFormat("syft")
+	assert.NotNil(t, err)
+
+	data, err := Generate(FormatSPDX, doc)
+	assert.Nil(t, err)
+	var spdx struct {
+		SPDXVersion  string `json:"spdxVersion"`
+		CreationInfo struct {
+			Created string `json:"created"`
+		} `json:"creationInfo"`
+		Packages      []spdxPackage      `json:"packages"`
+		Relationships []spdxRelationship `json:"relationships"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &spdx))
+	assert.Equal(t, "SPDX-2.3", spdx.SPDXVersion)
+	assert.Equal(t, "2022-06-01T00:00:00Z", spdx.CreationInfo.Created)
+	assert.Len(t, spdx.Packages, 3)
+	assert.Equal(t, "pkg:apk/alpine/busybox@1.35.0-r17?arch=x86_64&distro=alpine-3.16.0", spdx.Packages[2].ExternalRefs[0].ReferenceLocator)
+	assert.Len(t, spdx.Relationships, 3)
+
+	format, err := ParseFormat("cyclonedx")
+	assert.Nil(t, err)
+	assert.Equal(t, MediaTypeCycloneDX, format.MediaType())
+	data, err = Generate(format, doc)
+	assert.Nil(t, err)
+	var bom struct {
+		BOMFormat    string               `json:"bomFormat"`
+		SerialNumber string               `json:"serialNumber"`
+		Components   []cyclonedxComponent `json:"components"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &bom))
+	assert.Equal(t, "CycloneDX", bom.BOMFormat)
+	assert.Len(t, bom.Components, 3)
+	assert.Equal(t, "operating-system", bom.Components[0].Type)
+	assert.Equal(t, "MIT", bom.Components[1].Licenses[0].License.Name)
+
+	// The serial number is stable for the same image.
+	again, err := Generate(format, doc)
+	assert.Nil(t, err)
+	assert.Equal(t, data, again)
+}
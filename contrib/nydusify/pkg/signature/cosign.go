@@ -0,0 +1,479 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package signature verifies and creates cosign signatures of images, the
+// signatures are stored as `sha256-<hex>.sig` tag in image repository as
+// per cosign specification.
+package signature
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/metrics"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+const (
+	MediaTypeCosignPayload = "application/vnd.dev.cosign.simplesigning.v1+json"
+	CosignPayloadType      = "cosign container image signature"
+
+	AnnotationCosignSignature   = "dev.cosignproject.cosign/signature"
+	AnnotationCosignCertificate = "dev.sigstore.cosign/certificate"
+	AnnotationCosignChain       = "dev.sigstore.cosign/chain"
+	AnnotationCosignBundle      = "dev.sigstore.cosign/bundle"
+)
+
+// Reasons of verification failure, used as metrics label.
+const (
+	ReasonNoSignature      = "no_signature"
+	ReasonInvalidSignature = "invalid_signature"
+	ReasonUntrustedCert    = "untrusted_certificate"
+	ReasonInvalidBundle    = "invalid_bundle"
+	ReasonPayloadMismatch  = "payload_mismatch"
+)
+
+// OIDs of Fulcio certificate extensions for OIDC issuer, the legacy one
+// is raw string, the newer one is DER encoded UTF8String.
+var (
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// VerificationError indicates the image isn't signed or signed badly.
+type VerificationError struct {
+	Reason string
+	err    error
+}
+
+func (e *VerificationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.err
+}
+
+func verificationError(reason string, format string, args ...interface{}) error {
+	return &VerificationError{Reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// Payload is the simple signing payload signed by cosign.
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// VerifyOpt configures cosign signature verification, either `KeyPath`
+// is specified for keyed signing, or `FulcioRootsPath`, `RekorKeyPath`,
+// `CertIdentity` and `CertOIDCIssuer` for keyless signing.
+type VerifyOpt struct {
+	// PEM encoded public key generated by `cosign generate-key-pair`.
+	KeyPath string
+	// PEM encoded Fulcio root (and intermediate) certificates.
+	FulcioRootsPath string
+	// PEM encoded public key of Rekor transparency log.
+	RekorKeyPath string
+	// Expected email or URI in certificate SAN.
+	CertIdentity string
+	// Expected OIDC issuer in certificate, for example `https://accounts.google.com`.
+	CertOIDCIssuer string
+}
+
+// Verifier verifies cosign signatures of image manifest.
+type Verifier struct {
+	publicKey   crypto.PublicKey
+	fulcioRoots *x509.CertPool
+	rekorKey    crypto.PublicKey
+	identity    string
+	issuer      string
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM public key in %s", path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// NewVerifier creates cosign signature verifier.
+func NewVerifier(opt VerifyOpt) (*Verifier, error) {
+	if opt.KeyPath != "" {
+		publicKey, err := loadPublicKey(opt.KeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "load cosign public key")
+		}
+		return &Verifier{publicKey: publicKey}, nil
+	}
+
+	if opt.FulcioRootsPath == "" || opt.RekorKeyPath == "" {
+		return nil, fmt.Errorf("fulcio roots and rekor public key are required for keyless verification")
+	}
+	if opt.CertIdentity == "" || opt.CertOIDCIssuer == "" {
+		return nil, fmt.Errorf("certificate identity and OIDC issuer are required for keyless verification")
+	}
+	roots, err := ioutil.ReadFile(opt.FulcioRootsPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read fulcio roots")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(roots) {
+		return nil, fmt.Errorf("no certificate in fulcio roots %s", opt.FulcioRootsPath)
+	}
+	rekorKey, err := loadPublicKey(opt.RekorKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "load rekor public key")
+	}
+
+	return &Verifier{
+		fulcioRoots: pool,
+		rekorKey:    rekorKey,
+		identity:    opt.CertIdentity,
+		issuer:      opt.CertOIDCIssuer,
+	}, nil
+}
+
+func verifySignature(publicKey crypto.PublicKey, data, signature []byte) error {
+	hash := sha256.Sum256(data)
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+			return err
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, signature) {
+			return fmt.Errorf("invalid ED25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	return nil
+}
+
+// SignatureTag returns the cosign signature tag of manifest digest.
+func SignatureTag(manifestDigest digest.Digest) string {
+	return fmt.Sprintf("%s-%s.sig", manifestDigest.Algorithm(), manifestDigest.Encoded())
+}
+
+func fetchBlob(ctx context.Context, r *remote.Remote, desc ocispec.Descriptor) ([]byte, error) {
+	reader, err := r.Pull(ctx, desc, true)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if desc.Digest.Validate() == nil && digest.FromBytes(data) != desc.Digest {
+		return nil, fmt.Errorf("digest mismatch for %s", desc.Digest)
+	}
+	return data, nil
+}
+
+// Verify verifies that the image manifest (or index) pointed by remote
+// has at least one valid cosign signature, the failure is counted in
+// metrics by reason.
+func (v *Verifier) Verify(ctx context.Context, r *remote.Remote) error {
+	err := v.verify(ctx, r)
+	if err != nil {
+		reason := "unknown"
+		var verifyErr *VerificationError
+		if errors.As(err, &verifyErr) {
+			reason = verifyErr.Reason
+		}
+		metrics.VerifySignatureFailureCount(r.Ref, reason)
+	}
+	return err
+}
+
+func (v *Verifier) verify(ctx context.Context, r *remote.Remote) error {
+	desc, err := r.Resolve(ctx)
+	if err != nil {
+		return errors.Wrap(err, "resolve image")
+	}
+
+	sigRemote, err := r.WithTag(SignatureTag(desc.Digest))
+	if err != nil {
+		return err
+	}
+	sigDesc, err := sigRemote.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return verificationError(ReasonNoSignature, "no cosign signature found for %s@%s", r.Ref, desc.Digest)
+		}
+		return errors.Wrap(err, "resolve cosign signature")
+	}
+	manifestBytes, err := fetchBlob(ctx, sigRemote, *sigDesc)
+	if err != nil {
+		return errors.Wrap(err, "fetch cosign signature manifest")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return errors.Wrap(err, "parse cosign signature manifest")
+	}
+
+	var lastErr error = verificationError(ReasonNoSignature, "no cosign signature layer found for %s@%s", r.Ref, desc.Digest)
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != MediaTypeCosignPayload {
+			continue
+		}
+		payload, err := fetchBlob(ctx, sigRemote, layer)
+		if err != nil {
+			return errors.Wrap(err, "fetch cosign signature payload")
+		}
+		if err := v.verifyLayer(layer, payload, desc.Digest); err != nil {
+			logrus.Debugf("Skip invalid cosign signature %s: %s", layer.Digest, err)
+			lastErr = err
+			continue
+		}
+		logrus.Infof("Verified cosign signature of %s@%s", r.Ref, desc.Digest)
+		return nil
+	}
+
+	return lastErr
+}
+
+func (v *Verifier) verifyLayer(layer ocispec.Descriptor, payload []byte, manifestDigest digest.Digest) error {
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[AnnotationCosignSignature])
+	if err != nil || len(signature) == 0 {
+		return verificationError(ReasonInvalidSignature, "invalid signature annotation")
+	}
+
+	publicKey := v.publicKey
+	if publicKey == nil {
+		cert, err := v.verifyCertificate(layer, payload, signature)
+		if err != nil {
+			return err
+		}
+		publicKey = cert.PublicKey
+	}
+
+	if err := verifySignature(publicKey, payload, signature); err != nil {
+		return verificationError(ReasonInvalidSignature, "verify signature: %s", err)
+	}
+
+	var p Payload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return verificationError(ReasonPayloadMismatch, "parse signature payload: %s", err)
+	}
+	if p.Critical.Type != CosignPayloadType {
+		return verificationError(ReasonPayloadMismatch, "unexpected payload type %s", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != manifestDigest.String() {
+		return verificationError(
+			ReasonPayloadMismatch, "signature is for %s rather than %s",
+			p.Critical.Image.DockerManifestDigest, manifestDigest,
+		)
+	}
+
+	return nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return certs, nil
+}
+
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuerV2) {
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidFulcioIssuer) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// verifyCertificate verifies the Fulcio certificate of keyless signing,
+// the certificate is short-lived, so it's verified at the time when the
+// signature was recorded in Rekor transparency log.
+func (v *Verifier) verifyCertificate(layer ocispec.Descriptor, payload, signature []byte) (*x509.Certificate, error) {
+	certs, err := parseCertificates([]byte(layer.Annotations[AnnotationCosignCertificate]))
+	if err != nil {
+		return nil, verificationError(ReasonUntrustedCert, "parse certificate: %s", err)
+	}
+	cert := certs[0]
+
+	intermediates := x509.NewCertPool()
+	if chain := layer.Annotations[AnnotationCosignChain]; chain != "" {
+		chainCerts, err := parseCertificates([]byte(chain))
+		if err != nil {
+			return nil, verificationError(ReasonUntrustedCert, "parse certificate chain: %s", err)
+		}
+		for _, c := range chainCerts {
+			intermediates.AddCert(c)
+		}
+	}
+
+	integratedTime, err := v.verifyBundle(layer.Annotations[AnnotationCosignBundle], payload, signature, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.fulcioRoots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, verificationError(ReasonUntrustedCert, "verify certificate: %s", err)
+	}
+
+	identities := append([]string{}, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	matched := false
+	for _, identity := range identities {
+		if identity == v.identity {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil, verificationError(ReasonUntrustedCert, "certificate identity %v doesn't match %s", identities, v.identity)
+	}
+	if issuer := certificateIssuer(cert); issuer != v.issuer {
+		return nil, verificationError(ReasonUntrustedCert, "certificate OIDC issuer %s doesn't match %s", issuer, v.issuer)
+	}
+
+	return cert, nil
+}
+
+// Bundle is the offline Rekor inclusion proof attached by cosign.
+type Bundle struct {
+	SignedEntryTimestamp []byte        `json:"SignedEntryTimestamp"`
+	Payload              BundlePayload `json:"Payload"`
+}
+
+// BundlePayload fields are in alphabetical order, so that the JSON
+// marshaled is canonical as signed by Rekor.
+type BundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+type rekorHashedRekord struct {
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   string `json:"content"`
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+func (v *Verifier) verifyBundle(rawBundle string, payload, signature []byte, cert *x509.Certificate) (time.Time, error) {
+	if rawBundle == "" {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "no rekor bundle in keyless signature")
+	}
+	var bundle Bundle
+	if err := json.Unmarshal([]byte(rawBundle), &bundle); err != nil {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "parse rekor bundle: %s", err)
+	}
+
+	canonical, err := json.Marshal(bundle.Payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifySignature(v.rekorKey, canonical, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "verify rekor signed entry timestamp: %s", err)
+	}
+
+	// The log entry must be for this signature.
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "decode rekor entry: %s", err)
+	}
+	var entry rekorHashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "parse rekor entry: %s", err)
+	}
+	payloadHash := sha256.Sum256(payload)
+	if entry.Spec.Data.Hash.Value != hex.EncodeToString(payloadHash[:]) {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "rekor entry is for another payload")
+	}
+	if entry.Spec.Signature.Content != base64.StdEncoding.EncodeToString(signature) {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "rekor entry is for another signature")
+	}
+	entryCert, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "decode rekor entry certificate: %s", err)
+	}
+	certs, err := parseCertificates(entryCert)
+	if err != nil || !bytes.Equal(certs[0].Raw, cert.Raw) {
+		return time.Time{}, verificationError(ReasonInvalidBundle, "rekor entry is for another certificate")
+	}
+
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+const testManifestDigest = digest.Digest("sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa")
+
+func testPayload(t *testing.T, manifestDigest digest.Digest) []byte {
+	var payload Payload
+	payload.Critical.Type = CosignPayloadType
+	payload.Critical.Image.DockerManifestDigest = manifestDigest.String()
+	payload.Critical.Identity.DockerReference = "example.com/repo"
+	data, err := json.Marshal(payload)
+	assert.Nil(t, err)
+	return data
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	hash := sha256.Sum256(data)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	assert.Nil(t, err)
+	return signature
+}
+
+func TestVerifyKeyed(t *testing.T) {
+	assert.Equal(t, "sha256-7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa.sig", SignatureTag(testManifestDigest))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	verifier := &Verifier{publicKey: &key.PublicKey}
+
+	payload := testPayload(t, testManifestDigest)
+	layer := ocispec.Descriptor{
+		MediaType: MediaTypeCosignPayload,
+		Annotations: map[string]string{
+			AnnotationCosignSignature: base64.StdEncoding.EncodeToString(sign(t, key, payload)),
+		},
+	}
+	assert.Nil(t, verifier.verifyLayer(layer, payload, testManifestDigest))
+
+	// Signature of another image.
+	err = verifier.verifyLayer(layer, payload, digest.FromString("other"))
+	assert.Equal(t, ReasonPayloadMismatch, err.(*VerificationError).Reason)
+
+	// Signed by another key.
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	layer.Annotations[AnnotationCosignSignature] = base64.StdEncoding.EncodeToString(sign(t, otherKey, payload))
+	err = verifier.verifyLayer(layer, payload, testManifestDigest)
+	assert.Equal(t, ReasonInvalidSignature, err.(*VerificationError).Reason)
+}
+
+func TestVerifyKeyless(t *testing.T) {
+	signedAt := time.Now().Add(-time.Hour)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             signedAt.Add(-time.Hour),
+		NotAfter:              signedAt.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	assert.Nil(t, err)
+	root, err := x509.ParseCertificate(rootDER)
+	assert.Nil(t, err)
+
+	// Short-lived certificate which has been expired now.
+	signerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	issuerExt, err := asn1.MarshalWithParams("https://accounts.example.com", "utf8")
+	assert.Nil(t, err)
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       signedAt.Add(-time.Minute),
+		NotAfter:        signedAt.Add(10 * time.Minute),
+		EmailAddresses:  []string{"ci@example.com"},
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: oidFulcioIssuerV2, Value: issuerExt}},
+	}, root, &signerKey.PublicKey, rootKey)
+	assert.Nil(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	payload := testPayload(t, testManifestDigest)
+	signature := sign(t, signerKey, payload)
+
+	var entry rekorHashedRekord
+	payloadHash := sha256.Sum256(payload)
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(payloadHash[:])
+	entry.Spec.Signature.Content = base64.StdEncoding.EncodeToString(signature)
+	entry.Spec.Signature.PublicKey.Content = base64.StdEncoding.EncodeToString(certPEM)
+	body, err := json.Marshal(entry)
+	assert.Nil(t, err)
+
+	rekorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	bundle := Bundle{Payload: BundlePayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: signedAt.Unix(),
+		LogID:          "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d",
+		LogIndex:       1,
+	}}
+	canonical, err := json.Marshal(bundle.Payload)
+	assert.Nil(t, err)
+	bundle.SignedEntryTimestamp = sign(t, rekorKey, canonical)
+	bundleJSON, err := json.Marshal(bundle)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	verifier := &Verifier{
+		fulcioRoots: pool,
+		rekorKey:    &rekorKey.PublicKey,
+		identity:    "ci@example.com",
+		issuer:      "https://accounts.example.com",
+	}
+	layer := ocispec.Descriptor{
+		MediaType: MediaTypeCosignPayload,
+		Annotations: map[string]string{
+			AnnotationCosignSignature:   base64.StdEncoding.EncodeToString(signature),
+			AnnotationCosignCertificate: string(certPEM),
+			AnnotationCosignBundle:      string(bundleJSON),
+		},
+	}
+	assert.Nil(t, verifier.verifyLayer(layer, payload, testManifestDigest))
+
+	verifier.identity = "attacker@example.com"
+	err = verifier.verifyLayer(layer, payload, testManifestDigest)
+	assert.Equal(t, ReasonUntrustedCert, err.(*VerificationError).Reason)
+	verifier.identity = "ci@example.com"
+
+	// Tampered integrated time invalidates the signed entry timestamp.
+	bundle.Payload.IntegratedTime = time.Now().Unix()
+	bundleJSON, err = json.Marshal(bundle)
+	assert.Nil(t, err)
+	layer.Annotations[AnnotationCosignBundle] = string(bundleJSON)
+	err = verifier.verifyLayer(layer, payload, testManifestDigest)
+	assert.Equal(t, ReasonInvalidBundle, err.(*VerificationError).Reason)
+}
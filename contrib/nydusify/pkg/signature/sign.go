@@ -0,0 +1,305 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package signature
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// CosignPasswordEnv is the environment variable of the password to
+// decrypt cosign private key, the same as cosign CLI.
+const CosignPasswordEnv = "COSIGN_PASSWORD"
+
+// Signer signs the image manifest (or index) pointed by remote.
+type Signer interface {
+	Sign(ctx context.Context, r *remote.Remote, manifestDigest digest.Digest) error
+}
+
+// CosignSigner signs image with a cosign private key, the signature is
+// pushed to the `sha256-<hex>.sig` tag of the image repository.
+type CosignSigner struct {
+	key crypto.Signer
+}
+
+// encryptedCosignKey is the PEM body of `cosign generate-key-pair`.
+type encryptedCosignKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func decryptCosignKey(data []byte, password []byte) ([]byte, error) {
+	var key encryptedCosignKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errors.Wrap(err, "parse encrypted key")
+	}
+	if key.KDF.Name != "scrypt" || key.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported key encryption %s and %s", key.KDF.Name, key.Cipher.Name)
+	}
+	if len(key.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("invalid nonce size %d", len(key.Cipher.Nonce))
+	}
+
+	secret, err := scrypt.Key(password, key.KDF.Salt, key.KDF.Params.N, key.KDF.Params.R, key.KDF.Params.P, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive key")
+	}
+	var secretKey [32]byte
+	var nonce [24]byte
+	copy(secretKey[:], secret)
+	copy(nonce[:], key.Cipher.Nonce)
+
+	decrypted, ok := secretbox.Open(nil, key.Ciphertext, &nonce, &secretKey)
+	if !ok {
+		return nil, fmt.Errorf("decrypt key, the password may be incorrect")
+	}
+	return decrypted, nil
+}
+
+// NewCosignSigner loads the private key generated by `cosign generate-key-pair`,
+// the password is read from `$COSIGN_PASSWORD`. A PEM encoded PKCS8 or EC
+// private key is also accepted.
+func NewCosignSigner(keyPath string) (*CosignSigner, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "read cosign private key")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM private key in %s", keyPath)
+	}
+
+	der := block.Bytes
+	switch block.Type {
+	case "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED SIGSTORE PRIVATE KEY":
+		der, err = decryptCosignKey(block.Bytes, []byte(os.Getenv(CosignPasswordEnv)))
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypt cosign private key")
+		}
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse EC private key")
+		}
+		return &CosignSigner{key: key}, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return &CosignSigner{key: signer}, nil
+}
+
+func (signer *CosignSigner) sign(payload []byte) ([]byte, error) {
+	switch signer.key.(type) {
+	case ed25519.PrivateKey:
+		return signer.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+		hash := sha256.Sum256(payload)
+		return signer.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", signer.key)
+	}
+}
+
+// fetchSignatureManifest returns the existing signature manifest, or nil
+// if the image isn't signed yet.
+func fetchSignatureManifest(ctx context.Context, sigRemote *remote.Remote) (*ocispec.Manifest, error) {
+	sigDesc, err := sigRemote.Resolve(ctx)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "resolve cosign signature")
+	}
+	manifestBytes, err := fetchBlob(ctx, sigRemote, *sigDesc)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch cosign signature manifest")
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, errors.Wrap(err, "parse cosign signature manifest")
+	}
+	return &manifest, nil
+}
+
+// Sign signs the manifest digest, the signature is appended to existing
+// signatures of the image.
+func (signer *CosignSigner) Sign(ctx context.Context, r *remote.Remote, manifestDigest digest.Digest) error {
+	named, err := reference.ParseNormalizedNamed(r.Ref)
+	if err != nil {
+		return err
+	}
+
+	var payload Payload
+	payload.Critical.Identity.DockerReference = named.Name()
+	payload.Critical.Image.DockerManifestDigest = manifestDigest.String()
+	payload.Critical.Type = CosignPayloadType
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "marshal signature payload")
+	}
+	signature, err := signer.sign(payloadBytes)
+	if err != nil {
+		return errors.Wrap(err, "sign payload")
+	}
+
+	sigRemote, err := r.WithTag(SignatureTag(manifestDigest))
+	if err != nil {
+		return err
+	}
+	manifest, err := fetchSignatureManifest(ctx, sigRemote)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = &ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+		}
+	}
+
+	payloadDesc := ocispec.Descriptor{
+		MediaType: MediaTypeCosignPayload,
+		Digest:    digest.FromBytes(payloadBytes),
+		Size:      int64(len(payloadBytes)),
+		Annotations: map[string]string{
+			AnnotationCosignSignature: base64.StdEncoding.EncodeToString(signature),
+		},
+	}
+	if err := sigRemote.Push(ctx, payloadDesc, true, bytes.NewReader(payloadBytes)); err != nil {
+		return errors.Wrap(err, "push signature payload")
+	}
+	manifest.Layers = append(manifest.Layers, payloadDesc)
+
+	// The config lists payloads as layers like cosign does.
+	diffIDs := []digest.Digest{}
+	for _, layer := range manifest.Layers {
+		diffIDs = append(diffIDs, layer.Digest)
+	}
+	config := ocispec.Image{
+		RootFS: ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	}
+	configDesc, configBytes, err := utils.MarshalToDesc(config, ocispec.MediaTypeImageConfig)
+	if err != nil {
+		return errors.Wrap(err, "marshal signature config")
+	}
+	if err := sigRemote.Push(ctx, *configDesc, true, bytes.NewReader(configBytes)); err != nil {
+		return errors.Wrap(err, "push signature config")
+	}
+	manifest.Config = *configDesc
+
+	manifestDesc, manifestBytes, err := utils.MarshalToDesc(struct {
+		MediaType string `json:"mediaType,omitempty"`
+		ocispec.Manifest
+	}{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Manifest:  *manifest,
+	}, ocispec.MediaTypeImageManifest)
+	if err != nil {
+		return errors.Wrap(err, "marshal signature manifest")
+	}
+	if err := sigRemote.Push(ctx, *manifestDesc, false, bytes.NewReader(manifestBytes)); err != nil {
+		return errors.Wrap(err, "push signature manifest")
+	}
+
+	logrus.Infof("Signed %s@%s by cosign", named.Name(), manifestDigest)
+
+	return nil
+}
+
+// NotationSigner signs image by notation CLI with a signing key profile,
+// which is configured by `notation key add`.
+type NotationSigner struct {
+	notationPath string
+	key          string
+}
+
+// NewNotationSigner creates notation signer, the `notation` binary is
+// looked up in PATH if notationPath is empty.
+func NewNotationSigner(notationPath, key string) (*NotationSigner, error) {
+	if notationPath == "" {
+		notationPath = "notation"
+	}
+	path, err := exec.LookPath(notationPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "find notation binary")
+	}
+	return &NotationSigner{
+		notationPath: path,
+		key:          key,
+	}, nil
+}
+
+func (signer *NotationSigner) Sign(ctx context.Context, r *remote.Remote, manifestDigest digest.Digest) error {
+	named, err := reference.ParseNormalizedNamed(r.Ref)
+	if err != nil {
+		return err
+	}
+	ref := fmt.Sprintf("%s@%s", named.Name(), manifestDigest)
+
+	args := []string{"sign"}
+	if signer.key != "" {
+		args = append(args, "--key", signer.key)
+	}
+	args = append(args, ref)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, signer.notationPath, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "notation sign %s: %s", ref, strings.TrimSpace(stderr.String()))
+	}
+
+	logrus.Infof("Signed %s by notation", ref)
+
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package signature
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func encryptCosignKey(t *testing.T, der, password []byte) []byte {
+	var key encryptedCosignKey
+	key.KDF.Name = "scrypt"
+	key.KDF.Params.N = 1024
+	key.KDF.Params.R = 8
+	key.KDF.Params.P = 1
+	key.KDF.Salt = []byte("0123456789abcdef0123456789abcdef")
+	key.Cipher.Name = "nacl/secretbox"
+	key.Cipher.Nonce = []byte("0123456789abcdef01234567")
+
+	secret, err := scrypt.Key(password, key.KDF.Salt, key.KDF.Params.N, key.KDF.Params.R, key.KDF.Params.P, 32)
+	assert.Nil(t, err)
+	var secretKey [32]byte
+	var nonce [24]byte
+	copy(secretKey[:], secret)
+	copy(nonce[:], key.Cipher.Nonce)
+	key.Ciphertext = secretbox.Seal(nil, der, &nonce, &secretKey)
+
+	data, err := json.Marshal(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED COSIGN PRIVATE KEY", Bytes: data})
+}
+
+func TestCosignSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-sign-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	keyPath := filepath.Join(dir, "cosign.key")
+	assert.Nil(t, ioutil.WriteFile(keyPath, encryptCosignKey(t, der, []byte("password")), 0600))
+
+	os.Setenv(CosignPasswordEnv, "wrong")
+	_, err = NewCosignSigner(keyPath)
+	assert.NotNil(t, err)
+
+	os.Setenv(CosignPasswordEnv, "password")
+	defer os.Unsetenv(CosignPasswordEnv)
+	signer, err := NewCosignSigner(keyPath)
+	assert.Nil(t, err)
+
+	// Signature is verifiable by the public key.
+	payload := testPayload(t, testManifestDigest)
+	signature, err := signer.sign(payload)
+	assert.Nil(t, err)
+	verifier := &Verifier{publicKey: &key.PublicKey}
+	assert.Nil(t, verifier.verifyLayer(ocispec.Descriptor{
+		MediaType: MediaTypeCosignPayload,
+		Annotations: map[string]string{
+			AnnotationCosignSignature: base64.StdEncoding.EncodeToString(signature),
+		},
+	}, payload, testManifestDigest))
+}
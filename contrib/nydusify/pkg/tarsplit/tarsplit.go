@@ -0,0 +1,278 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tarsplit preserves the tar-split metadata of source layers during
+// conversion, i.e. the raw tar headers and paddings, the file payloads are
+// referenced by the chunks in Nydus blobs. So the original layer tarballs
+// can be reassembled byte by byte from Nydus image later, the chunks are
+// fetched lazily on reconstruction.
+package tarsplit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sync"
+	"syscall"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+const (
+	// ArtifactType is the type of artifact attached to Nydus manifest.
+	ArtifactType = "application/vnd.nydus.tar-split.v1+json"
+	// MediaType is the media type of the gzip compressed Index in artifact.
+	MediaType = "application/vnd.nydus.tar-split.v1+json+gzip"
+
+	// Version is the version of Index.
+	Version = 1
+)
+
+// File is the payload of regular file in layer tarball.
+type File struct {
+	// Name is the name in tar header.
+	Name   string        `json:"name"`
+	Size   uint64        `json:"size"`
+	Chunks []dedup.Chunk `json:"chunks"`
+}
+
+// Layer is the reconstruction data of a source layer.
+type Layer struct {
+	// TarSplit is the tar-split metadata of uncompressed layer tarball in
+	// JSON lines.
+	TarSplit []byte `json:"tar_split"`
+	Files    []File `json:"files"`
+}
+
+// Index is the reconstruction data of source image, the layers are in the
+// same order as the layers of source manifest.
+type Index struct {
+	Version int `json:"version"`
+	// ManifestDesc, Manifest and Config are the descriptor, raw manifest
+	// and raw config of source image.
+	ManifestDesc ocispec.Descriptor `json:"manifest_desc"`
+	Manifest     []byte             `json:"manifest"`
+	Config       []byte             `json:"config"`
+	// Compressor is the compression algorithm of chunks.
+	Compressor string  `json:"compressor"`
+	Layers     []Layer `json:"layers"`
+}
+
+// NewInputStream returns the reader of tarball r, the tar-split metadata is
+// written to w as the tarball is read. The reader must be read until EOF to
+// get the complete metadata, or closed to abort.
+func NewInputStream(r io.Reader, w io.Writer) (io.ReadCloser, error) {
+	reader, err := asm.NewInputTarStream(r, storage.NewJSONPacker(w), storage.NewDiscardFilePutter())
+	if err != nil {
+		return nil, err
+	}
+	return reader.(io.ReadCloser), nil
+}
+
+// NewLayer references the file payloads in tar-split metadata by the chunks
+// of files in bootstrap, which is built from the layer on top of the lower
+// layers, so the files of layer are all in it.
+func NewLayer(metadata []byte, bootstrap *dedup.Bootstrap) (*Layer, error) {
+	files := map[string]*dedup.File{}
+	for idx := range bootstrap.Files {
+		files[bootstrap.Files[idx].Path] = &bootstrap.Files[idx]
+	}
+
+	layer := &Layer{
+		TarSplit: metadata,
+		Files:    []File{},
+	}
+	unpacker := storage.NewJSONUnpacker(bytes.NewReader(metadata))
+	for {
+		entry, err := unpacker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "parse tar-split metadata")
+		}
+		if entry.Type != storage.FileType || entry.Size == 0 {
+			continue
+		}
+		name := entry.GetName()
+		file, ok := files[path.Join("/", name)]
+		if !ok || file.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			return nil, fmt.Errorf("regular file %s of layer isn't found in bootstrap", name)
+		}
+		if file.Size != uint64(entry.Size) {
+			return nil, fmt.Errorf("size %d of file %s in bootstrap doesn't match %d in layer", file.Size, name, entry.Size)
+		}
+		layer.Files = append(layer.Files, File{
+			Name:   name,
+			Size:   file.Size,
+			Chunks: file.Chunks,
+		})
+	}
+
+	return layer, nil
+}
+
+// FileWriter writes the data of regular file by its chunks, it's
+// implemented by viewer.FileReader.
+type FileWriter interface {
+	WriteFile(ctx context.Context, file *dedup.File, w io.Writer) error
+}
+
+// fileGetter gets the file payloads of layer by FileWriter.
+type fileGetter struct {
+	ctx    context.Context
+	files  map[string]*File
+	writer FileWriter
+}
+
+func (g *fileGetter) Get(name string) (io.ReadCloser, error) {
+	file, ok := g.files[name]
+	if !ok {
+		return nil, fmt.Errorf("file %s isn't found in reconstruction data", name)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(g.writer.WriteFile(g.ctx, &dedup.File{
+			Path:   file.Name,
+			Mode:   syscall.S_IFREG,
+			Size:   file.Size,
+			Chunks: file.Chunks,
+		}, writer))
+	}()
+	return reader, nil
+}
+
+// WriteTar reassembles the uncompressed layer tarball to w, the checksums
+// of file payloads are verified.
+func (layer *Layer) WriteTar(ctx context.Context, fw FileWriter, w io.Writer) error {
+	getter := &fileGetter{
+		ctx:    ctx,
+		files:  map[string]*File{},
+		writer: fw,
+	}
+	for idx := range layer.Files {
+		getter.files[layer.Files[idx].Name] = &layer.Files[idx]
+	}
+	unpacker := storage.NewJSONUnpacker(bytes.NewReader(layer.TarSplit))
+	return asm.WriteOutputTarStream(getter, unpacker, w)
+}
+
+// Marshal encodes the index in gzip compressed JSON.
+func Marshal(index *Index) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gw).Encode(index); err != nil {
+		return nil, errors.Wrap(err, "marshal tar-split index")
+	}
+	if err := gw.Close(); err != nil {
+		return nil, errors.Wrap(err, "compress tar-split index")
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the index encoded by Marshal.
+func Unmarshal(data []byte) (*Index, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress tar-split index")
+	}
+	defer gr.Close()
+	var index Index
+	if err := json.NewDecoder(gr).Decode(&index); err != nil {
+		return nil, errors.Wrap(err, "unmarshal tar-split index")
+	}
+	if index.Version != Version {
+		return nil, fmt.Errorf("unsupported tar-split index version %d", index.Version)
+	}
+	return &index, nil
+}
+
+// Collector collects the reconstruction data of source layers, the layers
+// are added as they are built.
+type Collector struct {
+	mutex      sync.Mutex
+	compressor string
+	layers     []*Layer
+}
+
+// NewCollector creates collector for the image with count of layers.
+func NewCollector(layers int) *Collector {
+	return &Collector{
+		layers: make([]*Layer, layers),
+	}
+}
+
+// AddLayer reads the tar-split metadata recorded on mounting source layer,
+// and the bootstrap built from it.
+func (c *Collector) AddLayer(index int, metadataPath, bootstrapPath string) error {
+	if index < 0 || index >= len(c.layers) {
+		return fmt.Errorf("invalid layer index %d", index)
+	}
+
+	metadata, err := ioutil.ReadFile(metadataPath)
+	if err != nil {
+		return errors.Wrap(err, "read tar-split metadata")
+	}
+	bootstrap, err := dedup.ParseBootstrapFile(bootstrapPath)
+	if err != nil {
+		return errors.Wrap(err, "parse bootstrap")
+	}
+	layer, err := NewLayer(metadata, bootstrap)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.layers[index] = layer
+	c.compressor = bootstrap.Compressor
+	c.mutex.Unlock()
+	return nil
+}
+
+// Missing returns the count of layers not added, e.g. the layers pulled
+// from build cache.
+func (c *Collector) Missing() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	missing := 0
+	for _, layer := range c.layers {
+		if layer == nil {
+			missing++
+		}
+	}
+	return missing
+}
+
+// Index returns the reconstruction data of source image with its raw
+// manifest and config, all layers should be added.
+func (c *Collector) Index(manifestDesc ocispec.Descriptor, manifest, config []byte) (*Index, error) {
+	if missing := c.Missing(); missing > 0 {
+		return nil, fmt.Errorf("tar-split metadata of %d layers is missing", missing)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	index := &Index{
+		Version:      Version,
+		ManifestDesc: manifestDesc,
+		Manifest:     manifest,
+		Config:       config,
+		Compressor:   c.compressor,
+	}
+	for _, layer := range c.layers {
+		index.Layers = append(index.Layers, *layer)
+	}
+	return index, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tarsplit
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"syscall"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+// memFileWriter writes the file data by path, ignoring chunks.
+type memFileWriter map[string][]byte
+
+func (files memFileWriter) WriteFile(ctx context.Context, file *dedup.File, w io.Writer) error {
+	data, ok := files[file.Path]
+	if !ok {
+		return fmt.Errorf("%s not found", file.Path)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func buildTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0755}))
+	data := []byte("127.0.0.1 localhost\n")
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./etc/hosts", Mode: 0644, Size: int64(len(data)), Uname: "root"}))
+	_, err := tw.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./etc/.wh.passwd", Mode: 0644}))
+	assert.Nil(t, tw.Close())
+	// Padding of tar record written by some builders.
+	buf.Write(make([]byte, 3072))
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	layerTar := buildTar(t)
+
+	var metadata bytes.Buffer
+	stream, err := NewInputStream(bytes.NewReader(layerTar), &metadata)
+	assert.Nil(t, err)
+	_, err = io.Copy(ioutil.Discard, stream)
+	assert.Nil(t, err)
+
+	_, err = NewLayer(metadata.Bytes(), &dedup.Bootstrap{})
+	assert.NotNil(t, err)
+	_, err = NewLayer(metadata.Bytes(), &dedup.Bootstrap{
+		Files: []dedup.File{{Path: "/etc/hosts", Mode: syscall.S_IFREG | 0644, Size: 1}},
+	})
+	assert.NotNil(t, err)
+
+	chunks := []dedup.Chunk{{Digest: "sha256:abc", UncompressedSize: 20}}
+	layer, err := NewLayer(metadata.Bytes(), &dedup.Bootstrap{
+		Files: []dedup.File{
+			{Path: "/", Mode: syscall.S_IFDIR | 0755},
+			{Path: "/etc", Mode: syscall.S_IFDIR | 0755},
+			{Path: "/etc/hosts", Mode: syscall.S_IFREG | 0644, Size: 20, Chunks: chunks},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []File{{Name: "./etc/hosts", Size: 20, Chunks: chunks}}, layer.Files)
+
+	data, err := Marshal(&Index{
+		Version:      Version,
+		ManifestDesc: ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest},
+		Compressor:   "lz4_block",
+		Layers:       []Layer{*layer},
+	})
+	assert.Nil(t, err)
+	index, err := Unmarshal(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "lz4_block", index.Compressor)
+	assert.Len(t, index.Layers, 1)
+
+	var buf bytes.Buffer
+	files := memFileWriter{"./etc/hosts": []byte("127.0.0.1 localhost\n")}
+	assert.Nil(t, index.Layers[0].WriteTar(ctx, files, &buf))
+	assert.Equal(t, layerTar, buf.Bytes())
+
+	// The payload of different content is rejected by checksum.
+	files["./etc/hosts"] = []byte("127.0.0.2 localhost\n")
+	assert.NotNil(t, index.Layers[0].WriteTar(ctx, files, ioutil.Discard))
+}
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(2)
+	assert.NotNil(t, c.AddLayer(2, "", ""))
+	assert.Equal(t, 2, c.Missing())
+	_, err := c.Index(ocispec.Descriptor{}, nil, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,202 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tlsconfig configures the TLS of connections to registries and
+// storage backends per host: the custom CA certificates, the client
+// certificate for mTLS, and skipping certificate verification for the
+// specified hosts only.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// HostConfig is the TLS config of a host.
+type HostConfig struct {
+	// CAFile is the PEM bundle of CA certificates trusted in addition to
+	// the system roots.
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and key
+	// presented to host for mTLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// InsecureSkipVerify doesn't verify the certificate of host.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// Config is the TLS config keyed by `host:port`, `host` or `*.domain` for
+// all subdomains, the most specific key matches.
+type Config map[string]HostConfig
+
+// Hosts is the loaded TLS config of hosts.
+type Hosts struct {
+	exact    map[string]*tls.Config
+	wildcard map[string]*tls.Config
+}
+
+var (
+	mu           sync.RWMutex
+	defaultHosts *Hosts
+)
+
+func (hc HostConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: hc.InsecureSkipVerify,
+	}
+
+	if hc.CAFile != "" {
+		data, err := ioutil.ReadFile(hc.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA file")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificate in CA file %s", hc.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if (hc.CertFile == "") != (hc.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file should be specified together")
+	}
+	if hc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(hc.CertFile, hc.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// New loads the certificates of config.
+func New(config Config) (*Hosts, error) {
+	hosts := &Hosts{
+		exact:    map[string]*tls.Config{},
+		wildcard: map[string]*tls.Config{},
+	}
+	for key, hc := range config {
+		tlsConfig, err := hc.tlsConfig()
+		if err != nil {
+			return nil, errors.Wrapf(err, "TLS config of %s", key)
+		}
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "*.") {
+			hosts.wildcard[strings.TrimPrefix(key, "*")] = tlsConfig
+		} else {
+			hosts.exact[key] = tlsConfig
+		}
+	}
+	return hosts, nil
+}
+
+// Load reads the config in JSON file, e.g.
+//
+//	{"registry.corp:5000": {"ca_file": "ca.pem", "cert_file": "client.pem", "key_file": "client-key.pem"}}
+func Load(path string) (*Hosts, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read TLS config file")
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrap(err, "parse TLS config file")
+	}
+	return New(config)
+}
+
+// Match returns the TLS config of `host[:port]`, it's nil if the host isn't
+// configured.
+func (hosts *Hosts) Match(hostport string) *tls.Config {
+	if hosts == nil {
+		return nil
+	}
+	hostport = strings.ToLower(hostport)
+	if config, ok := hosts.exact[hostport]; ok {
+		return config
+	}
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	if config, ok := hosts.exact[host]; ok {
+		return config
+	}
+
+	var matched *tls.Config
+	matchedLen := 0
+	for suffix, config := range hosts.wildcard {
+		if strings.HasSuffix(host, suffix) && len(suffix) > matchedLen {
+			matched, matchedLen = config, len(suffix)
+		}
+	}
+	return matched
+}
+
+// SetDefault sets the TLS config of hosts used by Transport, it should be
+// called before any request.
+func SetDefault(hosts *Hosts) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultHosts = hosts
+}
+
+// Default returns the TLS config set by SetDefault, it's nil if unset.
+func Default() *Hosts {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultHosts
+}
+
+type transport struct {
+	base   *http.Transport
+	mu     sync.Mutex
+	clones map[*tls.Config]*http.Transport
+}
+
+// Transport wraps the base transport, the requests to the hosts of default
+// TLS config are sent by the clones of base with the TLS config of host,
+// the others by base.
+func Transport(base *http.Transport) http.RoundTripper {
+	return &transport{
+		base:   base,
+		clones: map[*tls.Config]*http.Transport{},
+	}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	config := Default().Match(req.URL.Host)
+	if config == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	clone, ok := t.clones[config]
+	if !ok {
+		clone = t.base.Clone()
+		tlsConfig := config.Clone()
+		if t.base.TLSClientConfig != nil {
+			tlsConfig.ClientSessionCache = t.base.TLSClientConfig.ClientSessionCache
+		}
+		clone.TLSClientConfig = tlsConfig
+		t.clones[config] = clone
+	}
+	t.mu.Unlock()
+
+	return clone.RoundTrip(req)
+}
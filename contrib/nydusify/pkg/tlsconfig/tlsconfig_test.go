@@ -0,0 +1,124 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	assert.Nil(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600))
+}
+
+// makeClientCert generates a self-signed client certificate.
+func makeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nydusify"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return cert, certFile, keyFile
+}
+
+func TestMatch(t *testing.T) {
+	hosts, err := New(Config{
+		"registry.corp:5000": {InsecureSkipVerify: true},
+		"registry.corp":      {},
+		"*.corp":             {},
+		"*.oss.corp":         {},
+	})
+	assert.Nil(t, err)
+	assert.True(t, hosts.Match("Registry.corp:5000").InsecureSkipVerify)
+	assert.False(t, hosts.Match("registry.corp:443").InsecureSkipVerify)
+	assert.Equal(t, hosts.wildcard[".oss.corp"], hosts.Match("bucket.oss.corp"))
+	assert.Equal(t, hosts.wildcard[".corp"], hosts.Match("hub.corp:443"))
+	assert.Nil(t, hosts.Match("corp"))
+	assert.Nil(t, hosts.Match("example.com"))
+	assert.Nil(t, (*Hosts)(nil).Match("example.com"))
+
+	_, err = New(Config{"registry.corp": {CertFile: "client.pem"}})
+	assert.NotNil(t, err)
+	_, err = New(Config{"registry.corp": {CAFile: "not-found.pem"}})
+	assert.NotNil(t, err)
+}
+
+func TestTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-tlsconfig-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer SetDefault(nil)
+
+	clientCert, certFile, keyFile := makeClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+
+	client := &http.Client{Transport: Transport(http.DefaultTransport.(*http.Transport).Clone())}
+	get := func() error {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// The server certificate isn't trusted without config.
+	assert.NotNil(t, get())
+
+	host := server.Listener.Addr().String()
+	hosts, err := New(Config{host: {CAFile: caFile}})
+	assert.Nil(t, err)
+	SetDefault(hosts)
+	// The client certificate is required.
+	assert.NotNil(t, get())
+
+	hosts, err = New(Config{host: {CAFile: caFile, CertFile: certFile, KeyFile: keyFile}})
+	assert.Nil(t, err)
+	SetDefault(hosts)
+	assert.Nil(t, get())
+
+	hosts, err = New(Config{host: {InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}})
+	assert.Nil(t, err)
+	SetDefault(hosts)
+	assert.Nil(t, get())
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTransport(t *testing.T) {
+	_, err := Init(context.Background(), "test")
+	assert.Nil(t, err)
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	var traceParent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	ctx, span := Start(context.Background(), "test")
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	assert.Nil(t, err)
+	resp, err := (&http.Client{Transport: NewTransport(nil)}).Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	// The trace id of parent span is propagated to server.
+	assert.Contains(t, traceParent, span.SpanContext().TraceID().String())
+	assert.Empty(t, req.Header.Get("traceparent"))
+}
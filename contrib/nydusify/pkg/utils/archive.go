@@ -6,6 +6,8 @@ package utils
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
 	"io"
@@ -16,9 +18,12 @@ import (
 
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/archive/compression"
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 )
 
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
 // PackTargz makes .tar(.gz) stream of file named `name` and return reader
 func PackTargz(src string, name string, compress bool) (io.ReadCloser, error) {
 	fi, err := os.Stat(src)
@@ -130,9 +135,24 @@ func PackTargzInfo(src, name string, compress bool) (digest.Digest, int64, error
 	return hash, <-chanSize, <-chanErr
 }
 
-// UnpackTargz unpacks .tar(.gz) stream, and write to dst path
+// DecompressStream decompresses .tar(.gz|.zst) stream, the skippable
+// frames in zstd stream (such as the TOC of zstd:chunked) are ignored.
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(zstdMagic)); err == nil && bytes.Equal(magic, zstdMagic) {
+		decoder, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return compression.DecompressStream(br)
+}
+
+// UnpackTargz unpacks .tar(.gz|.zst) stream, and write to dst path
 func UnpackTargz(ctx context.Context, dst string, r io.Reader) error {
-	ds, err := compression.DecompressStream(r)
+	ds, err := DecompressStream(r)
 	if err != nil {
 		return err
 	}
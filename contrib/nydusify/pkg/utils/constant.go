@@ -11,12 +11,20 @@ const (
 
 	ManifestNydusCache = "containerd.io/snapshot/nydus-cache"
 
-	LayerAnnotationNydusBlob          = "containerd.io/snapshot/nydus-blob"
-	LayerAnnotationNydusBlobDigest    = "containerd.io/snapshot/nydus-blob-digest"
-	LayerAnnotationNydusBlobSize      = "containerd.io/snapshot/nydus-blob-size"
-	LayerAnnotationNydusBlobIDs       = "containerd.io/snapshot/nydus-blob-ids"
-	LayerAnnotationNydusBootstrap     = "containerd.io/snapshot/nydus-bootstrap"
-	LayerAnnotationNydusSourceChainID = "containerd.io/snapshot/nydus-source-chainid"
+	LayerAnnotationNydusBlob           = "containerd.io/snapshot/nydus-blob"
+	LayerAnnotationNydusBlobDigest     = "containerd.io/snapshot/nydus-blob-digest"
+	LayerAnnotationNydusBlobSize       = "containerd.io/snapshot/nydus-blob-size"
+	LayerAnnotationNydusBlobIDs        = "containerd.io/snapshot/nydus-blob-ids"
+	LayerAnnotationNydusBootstrap      = "containerd.io/snapshot/nydus-bootstrap"
+	LayerAnnotationNydusSourceChainID  = "containerd.io/snapshot/nydus-source-chainid"
+	LayerAnnotationNydusPrefetchPolicy = "containerd.io/snapshot/nydus-prefetch-policy"
+	// LayerAnnotationNydusFsVersion is the RAFS version of bootstrap, e.g. `5`.
+	LayerAnnotationNydusFsVersion = "containerd.io/snapshot/nydus-fs-version"
+	// LayerAnnotationNydusBlobCID is the CID of blob added to IPFS.
+	LayerAnnotationNydusBlobCID = "containerd.io/snapshot/nydus-blob-cid"
+	// LayerAnnotationNydusIPFSCIDs is the JSON object of blob CIDs from blob
+	// IDs, set on the bootstrap layer for the `ipfs` backend of nydusd.
+	LayerAnnotationNydusIPFSCIDs = "containerd.io/snapshot/nydus-ipfs-cids"
 
 	LayerAnnotationUncompressed = "containerd.io/uncompressed"
 )
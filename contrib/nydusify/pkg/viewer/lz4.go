@@ -0,0 +1,82 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package viewer
+
+import (
+	"fmt"
+)
+
+var errInvalidLZ4Block = fmt.Errorf("invalid lz4 block")
+
+// decompressLZ4Block decompresses the raw lz4 block (without frame header)
+// compressed by `LZ4_compress_default`, the size of decompressed data must
+// be known.
+func decompressLZ4Block(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	readLength := func(si int, length int) (int, int, error) {
+		for {
+			if si >= len(src) {
+				return 0, 0, errInvalidLZ4Block
+			}
+			b := src[si]
+			si++
+			length += int(b)
+			if b != 255 {
+				return si, length, nil
+			}
+		}
+	}
+
+	for si := 0; si < len(src); {
+		token := src[si]
+		si++
+
+		var err error
+		literals := int(token >> 4)
+		if literals == 15 {
+			if si, literals, err = readLength(si, literals); err != nil {
+				return nil, err
+			}
+		}
+		if si+literals > len(src) || len(dst)+literals > size {
+			return nil, errInvalidLZ4Block
+		}
+		dst = append(dst, src[si:si+literals]...)
+		si += literals
+		// The last sequence has only literals.
+		if si == len(src) {
+			break
+		}
+
+		if si+2 > len(src) {
+			return nil, errInvalidLZ4Block
+		}
+		offset := int(src[si]) | int(src[si+1])<<8
+		si += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errInvalidLZ4Block
+		}
+		match := int(token & 0xf)
+		if match == 15 {
+			if si, match, err = readLength(si, match); err != nil {
+				return nil, err
+			}
+		}
+		match += 4
+		if len(dst)+match > size {
+			return nil, errInvalidLZ4Block
+		}
+		// The match may overlap with the bytes being copied.
+		start := len(dst) - offset
+		for i := 0; i < match; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != size {
+		return nil, fmt.Errorf("decompressed size %d of lz4 block doesn't match %d", len(dst), size)
+	}
+	return dst, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package viewer
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+func tarHeader(file *dedup.File) *tar.Header {
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(file.Path, "/"),
+		Mode:    int64(file.Mode & 07777),
+		Uid:     int(file.UID),
+		Gid:     int(file.GID),
+		ModTime: time.Unix(int64(file.Mtime), int64(file.MtimeNsec)),
+		Format:  tar.FormatPAX,
+	}
+	switch file.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case syscall.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = file.Symlink
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		hdr.Typeflag = tar.TypeChar
+		if file.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = int64(unix.Major(uint64(file.Rdev)))
+		hdr.Devminor = int64(unix.Minor(uint64(file.Rdev)))
+	case syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(file.Size)
+	}
+	if len(file.Xattrs) > 0 {
+		hdr.PAXRecords = map[string]string{}
+		for key, value := range file.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+key] = string(value)
+		}
+	}
+	return hdr
+}
+
+// WriteTar writes the flattened filesystem of image as a tar stream, the
+// hardlinks are written as links to the first path of inode. The sockets
+// are skipped as tar can't hold them.
+func (v *Viewer) WriteTar(ctx context.Context, w io.Writer) error {
+	readers := blobReaders{}
+	defer readers.close()
+
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	for idx := range v.bootstrap.Files {
+		file := &v.bootstrap.Files[idx]
+		fileType := file.Mode & syscall.S_IFMT
+		if file.Path == "/" || fileType == syscall.S_IFSOCK {
+			continue
+		}
+
+		hdr := tarHeader(file)
+		if fileType != syscall.S_IFDIR && file.Ino != 0 {
+			if target, ok := links[file.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = target
+				hdr.Size = 0
+			} else {
+				links[file.Ino] = hdr.Name
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "write tar header of %s", file.Path)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if err := v.writeFile(ctx, file, readers, tw); err != nil {
+				return errors.Wrapf(err, "write data of %s", file.Path)
+			}
+		}
+	}
+
+	return tw.Close()
+}
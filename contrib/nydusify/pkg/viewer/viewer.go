@@ -0,0 +1,314 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package viewer lists directories and reads files of Nydus image without
+// mounting it, only the bootstrap and the chunks of read files are fetched
+// from the registry.
+package viewer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"lukechampine.com/blake3"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Same as the limit of Linux.
+const maxSymlinkFollows = 40
+
+// Viewer reads the files of Nydus image, the blobs are pulled from the same
+// repository, so only registry storage backend is supported.
+type Viewer struct {
+	remote    *remote.Remote
+	bootstrap *dedup.Bootstrap
+	files     map[string]*dedup.File
+}
+
+// New creates a viewer of the Nydus image with its bootstrap.
+func New(remote *remote.Remote, bootstrap *dedup.Bootstrap) *Viewer {
+	files := map[string]*dedup.File{}
+	for idx := range bootstrap.Files {
+		files[bootstrap.Files[idx].Path] = &bootstrap.Files[idx]
+	}
+	return &Viewer{
+		remote:    remote,
+		bootstrap: bootstrap,
+		files:     files,
+	}
+}
+
+// FileMode converts `st_mode` to Go file mode.
+func FileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		fileMode |= os.ModeDir
+	case syscall.S_IFLNK:
+		fileMode |= os.ModeSymlink
+	case syscall.S_IFCHR:
+		fileMode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		fileMode |= os.ModeDevice
+	case syscall.S_IFIFO:
+		fileMode |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		fileMode |= os.ModeSocket
+	}
+	if mode&syscall.S_ISUID != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+// Stat returns the file of path, the symlink isn't followed.
+func (v *Viewer) Stat(filePath string) (*dedup.File, error) {
+	file, ok := v.files[path.Join("/", filePath)]
+	if !ok {
+		return nil, fmt.Errorf("%s: no such file or directory", filePath)
+	}
+	return file, nil
+}
+
+// resolve follows the symlinks in path (including the parent directories)
+// within image.
+func (v *Viewer) resolve(filePath string) (*dedup.File, error) {
+	resolved := "/"
+	parts := strings.Split(path.Clean("/"+filePath), "/")[1:]
+	for follows := 0; len(parts) > 0; {
+		if parts[0] == "" {
+			parts = parts[1:]
+			continue
+		}
+		next := path.Join(resolved, parts[0])
+		parts = parts[1:]
+		file, err := v.Stat(next)
+		if err != nil {
+			return nil, err
+		}
+		if file.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			resolved = next
+			continue
+		}
+		if follows++; follows > maxSymlinkFollows {
+			return nil, fmt.Errorf("%s: too many levels of symbolic links", filePath)
+		}
+		target := file.Symlink
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		parts = append(strings.Split(path.Clean(target), "/")[1:], parts...)
+		resolved = "/"
+	}
+	return v.Stat(resolved)
+}
+
+// List returns the entries in directory sorted by name, or the file itself
+// if it isn't a directory.
+func (v *Viewer) List(dirPath string) ([]dedup.File, error) {
+	dir, err := v.resolve(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if dir.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return []dedup.File{*dir}, nil
+	}
+	files := []dedup.File{}
+	for _, file := range v.bootstrap.Files {
+		if file.Path != "/" && path.Dir(file.Path) == dir.Path {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+func (v *Viewer) decompress(chunk dedup.Chunk, data []byte) ([]byte, error) {
+	if !chunk.Compressed {
+		return data, nil
+	}
+	switch v.bootstrap.Compressor {
+	case "lz4_block":
+		return decompressLZ4Block(data, int(chunk.UncompressedSize))
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	case "zstd":
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(data, make([]byte, 0, chunk.UncompressedSize))
+	}
+	return nil, fmt.Errorf("unsupported compressor %s", v.bootstrap.Compressor)
+}
+
+func verifyChunk(chunk dedup.Chunk, data []byte) error {
+	var sum []byte
+	switch {
+	case strings.HasPrefix(chunk.Digest, "sha256:"):
+		hash := sha256.Sum256(data)
+		sum = hash[:]
+	case strings.HasPrefix(chunk.Digest, "blake3:"):
+		hash := blake3.Sum256(data)
+		sum = hash[:]
+	default:
+		return fmt.Errorf("unsupported digest %s", chunk.Digest)
+	}
+	if chunk.Digest[strings.Index(chunk.Digest, ":")+1:] != hex.EncodeToString(sum) {
+		return fmt.Errorf("digest of chunk data doesn't match %s", chunk.Digest)
+	}
+	return nil
+}
+
+// Cat writes the data of regular file to writer, the symlinks are followed.
+// The chunks are fetched by range requests and verified by chunk digest.
+func (v *Viewer) Cat(ctx context.Context, filePath string, w io.Writer) error {
+	file, err := v.resolve(filePath)
+	if err != nil {
+		return err
+	}
+	if file.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return fmt.Errorf("%s: not a regular file", filePath)
+	}
+
+	readers := blobReaders{}
+	defer readers.close()
+	return v.writeFile(ctx, file, readers, w)
+}
+
+// blobReaders are the readers of blobs opened for range requests.
+type blobReaders map[string]io.ReadCloser
+
+func (readers blobReaders) close() {
+	for _, reader := range readers {
+		reader.Close()
+	}
+}
+
+// FileReader reads the data of files by chunks, the readers of blobs are
+// reused among files until it's closed.
+type FileReader struct {
+	viewer  *Viewer
+	readers blobReaders
+}
+
+// NewFileReader creates a reader of files, the files may not be in the
+// bootstrap of viewer, e.g. the overwritten files of lower layers.
+func (v *Viewer) NewFileReader() *FileReader {
+	return &FileReader{
+		viewer:  v,
+		readers: blobReaders{},
+	}
+}
+
+// WriteFile writes the data of regular file to writer.
+func (r *FileReader) WriteFile(ctx context.Context, file *dedup.File, w io.Writer) error {
+	return r.viewer.writeFile(ctx, file, r.readers, w)
+}
+
+// Close closes the readers of blobs.
+func (r *FileReader) Close() {
+	r.readers.close()
+}
+
+func (v *Viewer) writeFile(ctx context.Context, file *dedup.File, readers blobReaders, w io.Writer) error {
+	var err error
+	chunks := append([]dedup.Chunk{}, file.Chunks...)
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].FileOffset < chunks[j].FileOffset
+	})
+
+	var written uint64
+	for _, chunk := range chunks {
+		// The holes are filled with zero.
+		if chunk.FileOffset > written {
+			if _, err := io.CopyN(w, zeroReader{}, int64(chunk.FileOffset-written)); err != nil {
+				return err
+			}
+			written = chunk.FileOffset
+		}
+
+		reader, ok := readers[chunk.Blob]
+		if !ok {
+			reader, err = v.remote.Pull(ctx, ocispec.Descriptor{
+				MediaType: utils.MediaTypeNydusBlob,
+				Digest:    digest.NewDigestFromEncoded(digest.SHA256, chunk.Blob),
+			}, true)
+			if err != nil {
+				return errors.Wrapf(err, "pull blob %s", chunk.Blob)
+			}
+			readers[chunk.Blob] = reader
+		}
+		seeker, ok := reader.(io.Seeker)
+		if !ok {
+			return fmt.Errorf("range request isn't supported by remote")
+		}
+
+		if _, err := seeker.Seek(int64(chunk.CompressedOffset), io.SeekStart); err != nil {
+			return errors.Wrapf(err, "seek blob %s to %d", chunk.Blob, chunk.CompressedOffset)
+		}
+		buf := make([]byte, chunk.CompressedSize)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return errors.Wrapf(err, "read chunk %s of blob %s", chunk.Digest, chunk.Blob)
+		}
+		data, err := v.decompress(chunk, buf)
+		if err != nil {
+			return errors.Wrapf(err, "decompress chunk %s", chunk.Digest)
+		}
+		if err := verifyChunk(chunk, data); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		written += uint64(len(data))
+	}
+
+	if file.Size > written {
+		if _, err := io.CopyN(w, zeroReader{}, int64(file.Size-written)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package viewer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+func TestDecompressLZ4Block(t *testing.T) {
+	// Literals `abc`, match of offset 3 and length 9, then literal `!`.
+	block := []byte{0x35, 'a', 'b', 'c', 3, 0, 0x10, '!'}
+	data, err := decompressLZ4Block(block, 13)
+	assert.Nil(t, err)
+	assert.Equal(t, "abcabcabcabc!", string(data))
+
+	_, err = decompressLZ4Block(block, 12)
+	assert.NotNil(t, err)
+	_, err = decompressLZ4Block(block[:5], 13)
+	assert.NotNil(t, err)
+}
+
+func TestDecompressZstd(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("nydus"), 100)
+	compressed := encoder.EncodeAll(data, nil)
+	encoder.Close()
+
+	v := &Viewer{bootstrap: &dedup.Bootstrap{Compressor: "zstd"}}
+	decompressed, err := v.decompress(dedup.Chunk{Compressed: true, UncompressedSize: uint32(len(data))}, compressed)
+	assert.Nil(t, err)
+	assert.Equal(t, data, decompressed)
+
+	_, err = v.decompress(dedup.Chunk{Compressed: true}, []byte("invalid"))
+	assert.NotNil(t, err)
+}
+
+func TestViewer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-viewer-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	r, err := remote.NewLayout("oci:" + filepath.Join(dir, "layout") + ":v1")
+	assert.Nil(t, err)
+
+	compressed := []byte{0x35, 'a', 'b', 'c', 3, 0, 0x10, '!'}
+	blob := append(append([]byte{}, compressed...), []byte("tail\n")...)
+	blobDigest := digest.FromBytes(blob)
+	assert.Nil(t, r.Push(ctx, ocispec.Descriptor{
+		MediaType: utils.MediaTypeNydusBlob,
+		Digest:    blobDigest,
+		Size:      int64(len(blob)),
+	}, true, bytes.NewReader(blob)))
+
+	blobID := blobDigest.Hex()
+	chunks := []dedup.Chunk{{
+		Digest:           digest.FromString("tail\n").String(),
+		Blob:             blobID,
+		CompressedOffset: uint64(len(compressed)),
+		CompressedSize:   5,
+		UncompressedSize: 5,
+		FileOffset:       16,
+	}, {
+		Digest:           digest.FromString("abcabcabcabc!").String(),
+		Blob:             blobID,
+		CompressedSize:   uint32(len(compressed)),
+		UncompressedSize: 13,
+		Compressed:       true,
+	}}
+	v := New(r, &dedup.Bootstrap{
+		Compressor: "lz4_block",
+		Blobs:      []string{blobID},
+		Files: []dedup.File{
+			{Path: "/", Mode: 040755},
+			{Path: "/etc", Mode: 040755},
+			{Path: "/etc/os-release", Mode: 0120777, Symlink: "../usr/lib/os-release"},
+			{Path: "/usr", Mode: 040755},
+			{Path: "/usr/lib", Mode: 040755},
+			{Path: "/usr/lib/os-release", Mode: 0100644, Size: 24, Chunks: chunks},
+			{Path: "/loop", Mode: 0120777, Symlink: "loop"},
+		},
+	})
+
+	files, err := v.List("/")
+	assert.Nil(t, err)
+	assert.Len(t, files, 3)
+	assert.Equal(t, "/etc", files[0].Path)
+	files, err = v.List("/etc/os-release")
+	assert.Nil(t, err)
+	assert.Equal(t, "/usr/lib/os-release", files[0].Path)
+	_, err = v.List("/missing")
+	assert.NotNil(t, err)
+	assert.Equal(t, os.ModeSymlink|0777, FileMode(0120777))
+
+	var buf bytes.Buffer
+	assert.Nil(t, v.Cat(ctx, "etc/os-release", &buf))
+	assert.Equal(t, "abcabcabcabc!\x00\x00\x00tail\n\x00\x00\x00", buf.String())
+
+	assert.NotNil(t, v.Cat(ctx, "/loop", &buf))
+	assert.NotNil(t, v.Cat(ctx, "/usr", &buf))
+
+	// Corrupted chunk data is rejected.
+	chunks[0].Digest = digest.FromString("other").String()
+	assert.NotNil(t, v.Cat(ctx, "/usr/lib/os-release", &buf))
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package warmup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// The layout of chunk map file is a 4096 bytes header followed by a bitmap,
+// of which the most significant bit of first byte is for chunk 0.
+const (
+	chunkMapSuffix         = ".chunk_map"
+	chunkMapHeaderSize     = 4096
+	chunkMapMagic          = 0x424D4150
+	chunkMapMagic2         = 0x434D4150
+	chunkMapMagicAllReady  = 0x4D4D4150
+	chunkMapVersion        = 1
+	chunkMapAllReadyOffset = 12
+)
+
+type chunkMap struct {
+	path  string
+	count uint32
+	data  []byte
+}
+
+func chunkMapSize(count uint32) int {
+	return chunkMapHeaderSize + int((count+7)/8)
+}
+
+// loadChunkMap loads the chunk map file if it's valid, otherwise creates an
+// empty one, like Nydusd does.
+func loadChunkMap(path string, count uint32) (*chunkMap, error) {
+	if count == 0 {
+		return nil, fmt.Errorf("chunk count should be greater than 0")
+	}
+	m := &chunkMap{path: path, count: count}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read chunk map")
+	}
+	le := binary.LittleEndian
+	if len(data) == chunkMapSize(count) &&
+		le.Uint32(data[0:4]) == chunkMapMagic &&
+		le.Uint32(data[4:8]) >= chunkMapVersion &&
+		le.Uint32(data[8:12]) == chunkMapMagic2 {
+		m.data = data
+		return m, nil
+	}
+
+	m.data = make([]byte, chunkMapSize(count))
+	le.PutUint32(m.data[0:4], chunkMapMagic)
+	le.PutUint32(m.data[4:8], chunkMapVersion)
+	le.PutUint32(m.data[8:12], chunkMapMagic2)
+	return m, nil
+}
+
+func chunkMask(index uint32) byte {
+	return 1 << (7 - index%8)
+}
+
+func (m *chunkMap) allReady() bool {
+	return binary.LittleEndian.Uint32(m.data[chunkMapAllReadyOffset:]) == chunkMapMagicAllReady
+}
+
+func (m *chunkMap) isReady(index uint32) bool {
+	if m.allReady() {
+		return true
+	}
+	if index >= m.count {
+		return false
+	}
+	return m.data[chunkMapHeaderSize+int(index/8)]&chunkMask(index) != 0
+}
+
+func (m *chunkMap) setReady(index uint32) {
+	if index < m.count {
+		m.data[chunkMapHeaderSize+int(index/8)] |= chunkMask(index)
+	}
+}
+
+func (m *chunkMap) setAllReady() {
+	for index := uint32(0); index < m.count; index++ {
+		m.setReady(index)
+	}
+}
+
+// save writes the chunk map file atomically, the header is marked as all
+// ready once all chunks are ready.
+func (m *chunkMap) save() error {
+	ready := true
+	for index := uint32(0); index < m.count; index++ {
+		if !m.isReady(index) {
+			ready = false
+			break
+		}
+	}
+	if ready {
+		binary.LittleEndian.PutUint32(m.data[chunkMapAllReadyOffset:], chunkMapMagicAllReady)
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(m.path), ".warmup-chunk-map-")
+	if err != nil {
+		return errors.Wrap(err, "create chunk map")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := file.Chmod(0644); err != nil {
+		return errors.Wrap(err, "chmod chunk map")
+	}
+	if _, err := file.Write(m.data); err != nil {
+		return errors.Wrap(err, "write chunk map")
+	}
+	if err := file.Sync(); err != nil {
+		return errors.Wrap(err, "sync chunk map")
+	}
+	if err := os.Rename(file.Name(), m.path); err != nil {
+		return errors.Wrap(err, "rename chunk map")
+	}
+	return nil
+}
@@ -0,0 +1,587 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package warmup
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+)
+
+// The delta file is a tar of the JSON index followed by the data of the
+// fetched ranges.
+const (
+	deltaVersion   = 1
+	deltaIndexName = "delta.json"
+	deltaDataName  = "data"
+)
+
+// DeltaBlob is a blob in the cache layout of Nydusd.
+type DeltaBlob struct {
+	ID             string `json:"id"`
+	ChunkCount     uint32 `json:"chunk_count"`
+	CompressedSize uint64 `json:"compressed_size"`
+}
+
+// DeltaRange is a range of the blob data of new image. The range is copied
+// from the cache of base image if BaseBlob is set, otherwise it's stored in
+// delta data at DataOffset.
+type DeltaRange struct {
+	Blob   string `json:"blob"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+	// Chunks are the indexes of chunks in the range.
+	Chunks []uint32 `json:"chunks"`
+
+	BaseBlob   string `json:"base_blob,omitempty"`
+	BaseOffset uint64 `json:"base_offset,omitempty"`
+	// BaseChunk is the index of the chunk in base blob.
+	BaseChunk  uint32 `json:"base_chunk,omitempty"`
+	DataOffset uint64 `json:"data_offset,omitempty"`
+}
+
+// DeltaIndex describes how the cache of new image is built from the cache
+// of base image and delta data.
+type DeltaIndex struct {
+	Version int    `json:"version"`
+	Base    string `json:"base"`
+	Target  string `json:"target"`
+	// Blobs are the blobs of new image not in base image.
+	Blobs []DeltaBlob `json:"blobs"`
+	// BaseBlobs are the blobs of base image referenced by ranges.
+	BaseBlobs []DeltaBlob  `json:"base_blobs"`
+	Ranges    []DeltaRange `json:"ranges"`
+}
+
+// DeltaOpt defines the options to create delta between Nydus images.
+type DeltaOpt struct {
+	// Base is the Nydus image cached on nodes, e.g. the previous version.
+	Base *remote.Remote
+	// Target is the Nydus image to update to, the fetched blob data is
+	// pulled from its repository.
+	Target       *remote.Remote
+	ExpectedArch string
+	// Output is the path of delta file.
+	Output string
+}
+
+// DeltaResult is the summary of created delta.
+type DeltaResult struct {
+	// Blobs and Chunks are the blobs of new image not in base image, and
+	// their chunks.
+	Blobs  int
+	Chunks int
+	// CopiedChunks are the chunks copied from the cache of base image.
+	CopiedChunks  int
+	FetchedChunks int
+	// Size is the size of delta data, and TargetSize is the compressed size
+	// of the new blobs.
+	Size       int64
+	TargetSize int64
+}
+
+// ApplyOpt defines the options to apply delta.
+type ApplyOpt struct {
+	Delta string
+	// CacheDir is the `work_dir` of Nydusd file cache, which has the cache
+	// of base image.
+	CacheDir string
+}
+
+// ApplyResult is the summary of applied delta.
+type ApplyResult struct {
+	Blobs int
+	// Chunks are the chunks written into the cache of new image, the chunks
+	// not found in the cache of base image are missing and fetched by
+	// Nydusd on demand.
+	Chunks        int
+	CopiedChunks  int
+	MissingChunks int
+	Size          int64
+}
+
+// deltaPlan is the index of delta with the chunk ranges to fetch from new
+// blobs.
+type deltaPlan struct {
+	index DeltaIndex
+	fetch map[string][]chunkRange
+}
+
+// chunkKey identifies the same compressed data of the chunks in base and
+// new image, the compressor is the same for all chunks of bootstrap.
+type chunkKey struct {
+	digest           string
+	compressed       bool
+	compressedSize   uint32
+	uncompressedSize uint32
+}
+
+func keyOf(chunk dedup.Chunk) chunkKey {
+	return chunkKey{
+		digest:           chunk.Digest,
+		compressed:       chunk.Compressed,
+		compressedSize:   chunk.CompressedSize,
+		uncompressedSize: chunk.UncompressedSize,
+	}
+}
+
+// planDelta finds the chunks of the blobs only in target: those with the
+// same compressed data in base are copied from the cache of base, the
+// others are fetched. The blobs shared by target and base (e.g. converted
+// with `--base-image`) are cached as they are.
+func planDelta(base, target *dedup.Bootstrap) (*deltaPlan, error) {
+	if len(base.ExtBlobs) != len(base.Blobs) || len(target.ExtBlobs) != len(target.Blobs) {
+		return nil, fmt.Errorf("bootstrap without extended blob table isn't supported")
+	}
+
+	baseBlobs := map[string]DeltaBlob{}
+	for idx, id := range base.Blobs {
+		baseBlobs[id] = DeltaBlob{
+			ID:             id,
+			ChunkCount:     base.ExtBlobs[idx].ChunkCount,
+			CompressedSize: base.ExtBlobs[idx].CompressedSize,
+		}
+	}
+	baseChunks := map[chunkKey]dedup.Chunk{}
+	if base.Compressor == target.Compressor {
+		for _, chunk := range base.Chunks {
+			if _, ok := baseChunks[keyOf(chunk)]; !ok {
+				baseChunks[keyOf(chunk)] = chunk
+			}
+		}
+	}
+
+	type blobChunk struct {
+		blob  string
+		index uint32
+	}
+	newChunks := map[string][]dedup.Chunk{}
+	seen := map[blobChunk]bool{}
+	for _, chunk := range target.Chunks {
+		key := blobChunk{blob: chunk.Blob, index: chunk.Index}
+		if _, ok := baseBlobs[chunk.Blob]; ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		newChunks[chunk.Blob] = append(newChunks[chunk.Blob], chunk)
+	}
+
+	plan := &deltaPlan{
+		index: DeltaIndex{
+			Version:   deltaVersion,
+			Blobs:     []DeltaBlob{},
+			BaseBlobs: []DeltaBlob{},
+			Ranges:    []DeltaRange{},
+		},
+		fetch: map[string][]chunkRange{},
+	}
+	usedBaseBlobs := map[string]bool{}
+	for idx, id := range target.Blobs {
+		if _, ok := baseBlobs[id]; ok {
+			continue
+		}
+		plan.index.Blobs = append(plan.index.Blobs, DeltaBlob{
+			ID:             id,
+			ChunkCount:     target.ExtBlobs[idx].ChunkCount,
+			CompressedSize: target.ExtBlobs[idx].CompressedSize,
+		})
+
+		fetch := []dedup.Chunk{}
+		for _, chunk := range newChunks[id] {
+			baseChunk, ok := baseChunks[keyOf(chunk)]
+			if !ok {
+				fetch = append(fetch, chunk)
+				continue
+			}
+			usedBaseBlobs[baseChunk.Blob] = true
+			plan.index.Ranges = append(plan.index.Ranges, DeltaRange{
+				Blob:       id,
+				Offset:     chunk.CompressedOffset,
+				Size:       uint64(chunk.CompressedSize),
+				Chunks:     []uint32{chunk.Index},
+				BaseBlob:   baseChunk.Blob,
+				BaseOffset: baseChunk.CompressedOffset,
+				BaseChunk:  baseChunk.Index,
+			})
+		}
+		if len(fetch) > 0 {
+			plan.fetch[id] = mergeChunks(fetch, nil)
+		}
+	}
+
+	for _, id := range base.Blobs {
+		if usedBaseBlobs[id] {
+			plan.index.BaseBlobs = append(plan.index.BaseBlobs, baseBlobs[id])
+		}
+	}
+
+	return plan, nil
+}
+
+// fetchRanges downloads the ranges of new blobs into data file, and adds
+// them to delta index in the order of data.
+func (plan *deltaPlan) fetchRanges(ctx context.Context, target *remote.Remote, data io.Writer) (int64, error) {
+	var dataOffset int64
+	for _, blob := range plan.index.Blobs {
+		ranges := plan.fetch[blob.ID]
+		if len(ranges) == 0 {
+			continue
+		}
+
+		cached := &cacheBlob{remote: target, id: blob.ID, ext: dedup.ExtBlob{
+			ChunkCount:     blob.ChunkCount,
+			CompressedSize: blob.CompressedSize,
+		}}
+		reader, err := target.Pull(ctx, cached.desc(), true)
+		if err != nil {
+			return 0, errors.Wrapf(err, "pull blob %s", blob.ID)
+		}
+		seeker, ok := reader.(io.Seeker)
+		if !ok {
+			reader.Close()
+			return 0, fmt.Errorf("range request isn't supported by remote")
+		}
+
+		for _, r := range ranges {
+			if _, err := seeker.Seek(int64(r.offset), io.SeekStart); err != nil {
+				reader.Close()
+				return 0, errors.Wrapf(err, "seek blob %s to %d", blob.ID, r.offset)
+			}
+			if _, err := io.CopyN(data, reader, int64(r.size)); err != nil {
+				reader.Close()
+				return 0, errors.Wrapf(err, "read blob %s range %d+%d", blob.ID, r.offset, r.size)
+			}
+			indexes := []uint32{}
+			for _, chunk := range r.chunks {
+				indexes = append(indexes, chunk.Index)
+			}
+			plan.index.Ranges = append(plan.index.Ranges, DeltaRange{
+				Blob:       blob.ID,
+				Offset:     r.offset,
+				Size:       r.size,
+				Chunks:     indexes,
+				DataOffset: uint64(dataOffset),
+			})
+			dataOffset += int64(r.size)
+		}
+		reader.Close()
+	}
+	return dataOffset, nil
+}
+
+// writeDelta writes the delta file atomically from index and the data file.
+func writeDelta(output string, index *DeltaIndex, dataPath string) error {
+	indexData, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "marshal delta index")
+	}
+	data, err := os.Open(dataPath)
+	if err != nil {
+		return errors.Wrap(err, "open delta data")
+	}
+	defer data.Close()
+	info, err := data.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat delta data")
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(output), ".nydusify-delta-")
+	if err != nil {
+		return errors.Wrap(err, "create delta file")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	tw := tar.NewWriter(file)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     deltaIndexName,
+		Mode:     0644,
+		Size:     int64(len(indexData)),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errors.Wrap(err, "write delta index header")
+	}
+	if _, err := tw.Write(indexData); err != nil {
+		return errors.Wrap(err, "write delta index")
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     deltaDataName,
+		Mode:     0644,
+		Size:     info.Size(),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return errors.Wrap(err, "write delta data header")
+	}
+	if _, err := io.Copy(tw, data); err != nil {
+		return errors.Wrap(err, "write delta data")
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "close delta file")
+	}
+	if err := file.Chmod(0644); err != nil {
+		return errors.Wrap(err, "chmod delta file")
+	}
+	if err := file.Sync(); err != nil {
+		return errors.Wrap(err, "sync delta file")
+	}
+	return errors.Wrap(os.Rename(file.Name(), output), "rename delta file")
+}
+
+// CreateDelta creates the delta file from which the cache of target image
+// is built on the nodes with the cache of base image, it only contains the
+// chunks of target not in base.
+func CreateDelta(ctx context.Context, opt DeltaOpt) (*DeltaResult, error) {
+	base, err := dedup.PullImageBootstrap(ctx, opt.Base, opt.ExpectedArch)
+	if err != nil {
+		return nil, errors.Wrap(err, "pull bootstrap of base image")
+	}
+	target, err := dedup.PullImageBootstrap(ctx, opt.Target, opt.ExpectedArch)
+	if err != nil {
+		return nil, errors.Wrap(err, "pull bootstrap of target image")
+	}
+
+	plan, err := planDelta(base, target)
+	if err != nil {
+		return nil, err
+	}
+	plan.index.Base = opt.Base.Ref
+	plan.index.Target = opt.Target.Ref
+
+	data, err := ioutil.TempFile(filepath.Dir(opt.Output), ".nydusify-delta-data-")
+	if err != nil {
+		return nil, errors.Wrap(err, "create delta data")
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+	size, err := plan.fetchRanges(ctx, opt.Target, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := data.Close(); err != nil {
+		return nil, errors.Wrap(err, "close delta data")
+	}
+	if err := writeDelta(opt.Output, &plan.index, data.Name()); err != nil {
+		return nil, err
+	}
+
+	result := &DeltaResult{
+		Blobs: len(plan.index.Blobs),
+		Size:  size,
+	}
+	for _, blob := range plan.index.Blobs {
+		result.TargetSize += int64(blob.CompressedSize)
+	}
+	for _, r := range plan.index.Ranges {
+		result.Chunks += len(r.Chunks)
+		if r.BaseBlob != "" {
+			result.CopiedChunks += len(r.Chunks)
+		} else {
+			result.FetchedChunks += len(r.Chunks)
+		}
+	}
+	return result, nil
+}
+
+// readDeltaIndex reads the index at the beginning of delta file, the data
+// follows it in tar reader.
+func readDeltaIndex(tr *tar.Reader) (*DeltaIndex, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "read delta file")
+	}
+	if hdr.Name != deltaIndexName {
+		return nil, fmt.Errorf("invalid delta file: %s isn't the first entry", deltaIndexName)
+	}
+	var index DeltaIndex
+	if err := json.NewDecoder(tr).Decode(&index); err != nil {
+		return nil, errors.Wrap(err, "decode delta index")
+	}
+	if index.Version != deltaVersion {
+		return nil, fmt.Errorf("unsupported delta version %d", index.Version)
+	}
+
+	hdr, err = tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "read delta data")
+	}
+	if hdr.Name != deltaDataName {
+		return nil, fmt.Errorf("invalid delta file: unexpected entry %s", hdr.Name)
+	}
+	return &index, nil
+}
+
+type deltaCacheBlob struct {
+	file     *os.File
+	chunkMap *chunkMap
+}
+
+func openDeltaBlobs(cacheDir string, blobs []DeltaBlob, flag int) (map[string]*deltaCacheBlob, error) {
+	opened := map[string]*deltaCacheBlob{}
+	for _, blob := range blobs {
+		path := filepath.Join(cacheDir, blob.ID)
+		chunkMap, err := loadChunkMap(path+chunkMapSuffix, blob.ChunkCount)
+		if err != nil {
+			return opened, errors.Wrapf(err, "load chunk map of blob %s", blob.ID)
+		}
+		file, err := os.OpenFile(path, flag, 0644)
+		if err != nil && !os.IsNotExist(err) {
+			return opened, errors.Wrapf(err, "open cache file of blob %s", blob.ID)
+		}
+		opened[blob.ID] = &deltaCacheBlob{file: file, chunkMap: chunkMap}
+	}
+	return opened, nil
+}
+
+func closeDeltaBlobs(blobs map[string]*deltaCacheBlob) {
+	for _, blob := range blobs {
+		if blob.file != nil {
+			blob.file.Close()
+		}
+	}
+}
+
+// ApplyDelta builds the cache of target image in cache directory from delta
+// file and the cache of base image. The ranges already in cache are skipped,
+// and the base chunks not in cache are left to be fetched by Nydusd. It
+// should be done before Nydusd uses the cache directory.
+func ApplyDelta(ctx context.Context, opt ApplyOpt) (*ApplyResult, error) {
+	file, err := os.Open(opt.Delta)
+	if err != nil {
+		return nil, errors.Wrap(err, "open delta file")
+	}
+	defer file.Close()
+	tr := tar.NewReader(file)
+	index, err := readDeltaIndex(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(opt.CacheDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create cache directory")
+	}
+	blobs, err := openDeltaBlobs(opt.CacheDir, index.Blobs, os.O_RDWR|os.O_CREATE)
+	defer closeDeltaBlobs(blobs)
+	if err != nil {
+		return nil, err
+	}
+	baseBlobs, err := openDeltaBlobs(opt.CacheDir, index.BaseBlobs, os.O_RDONLY)
+	defer closeDeltaBlobs(baseBlobs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The data ranges are read in the order of data.
+	dataRanges, copyRanges := []DeltaRange{}, []DeltaRange{}
+	for _, r := range index.Ranges {
+		if _, ok := blobs[r.Blob]; !ok {
+			return nil, fmt.Errorf("invalid delta file: blob %s of range isn't in index", r.Blob)
+		}
+		if r.BaseBlob == "" {
+			dataRanges = append(dataRanges, r)
+		} else {
+			copyRanges = append(copyRanges, r)
+		}
+	}
+	sort.Slice(dataRanges, func(i, j int) bool {
+		return dataRanges[i].DataOffset < dataRanges[j].DataOffset
+	})
+
+	result := &ApplyResult{}
+	write := func(r DeltaRange, buf []byte) error {
+		blob := blobs[r.Blob]
+		if _, err := blob.file.WriteAt(buf, int64(r.Offset)); err != nil {
+			return errors.Wrapf(err, "write cache of blob %s", r.Blob)
+		}
+		for _, chunk := range r.Chunks {
+			blob.chunkMap.setReady(chunk)
+		}
+		result.Chunks += len(r.Chunks)
+		result.Size += int64(len(buf))
+		return nil
+	}
+	ready := func(r DeltaRange) bool {
+		for _, chunk := range r.Chunks {
+			if !blobs[r.Blob].chunkMap.isReady(chunk) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var dataOffset uint64
+	for _, r := range dataRanges {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if r.DataOffset < dataOffset {
+			return nil, fmt.Errorf("invalid delta file: overlapped data at %d", r.DataOffset)
+		}
+		if _, err := io.CopyN(ioutil.Discard, tr, int64(r.DataOffset-dataOffset)); err != nil {
+			return nil, errors.Wrap(err, "read delta data")
+		}
+		buf := make([]byte, r.Size)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return nil, errors.Wrap(err, "read delta data")
+		}
+		dataOffset = r.DataOffset + r.Size
+		if ready(r) {
+			continue
+		}
+		if err := write(r, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range copyRanges {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if ready(r) {
+			continue
+		}
+		base, ok := baseBlobs[r.BaseBlob]
+		if !ok {
+			return nil, fmt.Errorf("invalid delta file: base blob %s of range isn't in index", r.BaseBlob)
+		}
+		if base.file == nil || !base.chunkMap.isReady(r.BaseChunk) {
+			result.MissingChunks += len(r.Chunks)
+			continue
+		}
+		buf := make([]byte, r.Size)
+		if _, err := base.file.ReadAt(buf, int64(r.BaseOffset)); err != nil {
+			return nil, errors.Wrapf(err, "read cache of base blob %s", r.BaseBlob)
+		}
+		if err := write(r, buf); err != nil {
+			return nil, err
+		}
+		result.CopiedChunks += len(r.Chunks)
+	}
+
+	for _, b := range index.Blobs {
+		blob := blobs[b.ID]
+		if err := blob.file.Sync(); err != nil {
+			return nil, errors.Wrapf(err, "sync cache of blob %s", b.ID)
+		}
+		if err := blob.chunkMap.save(); err != nil {
+			return nil, err
+		}
+		result.Blobs++
+	}
+	logrus.Debugf("Applied delta from %s to %s", index.Base, index.Target)
+
+	return result, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package warmup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+func TestDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-warmup-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cacheDir := filepath.Join(dir, "cache")
+	assert.Nil(t, os.MkdirAll(cacheDir, 0755))
+
+	chunk := func(digest, blob string, index uint32, offset uint64) dedup.Chunk {
+		return dedup.Chunk{
+			Digest:           digest,
+			Blob:             blob,
+			Index:            index,
+			CompressedOffset: offset,
+			CompressedSize:   4,
+			UncompressedSize: 8,
+			Compressed:       true,
+		}
+	}
+	base := &dedup.Bootstrap{
+		Compressor: "lz4_block",
+		Blobs:      []string{"shared", "v1"},
+		ExtBlobs:   []dedup.ExtBlob{{ChunkCount: 1, CompressedSize: 4}, {ChunkCount: 2, CompressedSize: 8}},
+		Chunks: []dedup.Chunk{
+			chunk("sha256:s", "shared", 0, 0),
+			chunk("sha256:a", "v1", 0, 0),
+			chunk("sha256:b", "v1", 1, 4),
+		},
+	}
+	target := &dedup.Bootstrap{
+		Compressor: "lz4_block",
+		Blobs:      []string{"shared", "v2"},
+		ExtBlobs:   []dedup.ExtBlob{{ChunkCount: 1, CompressedSize: 4}, {ChunkCount: 4, CompressedSize: 16}},
+		Chunks: []dedup.Chunk{
+			chunk("sha256:s", "shared", 0, 0),
+			chunk("sha256:c", "v2", 0, 0),
+			chunk("sha256:b", "v2", 1, 4),
+			chunk("sha256:d", "v2", 2, 8),
+			chunk("sha256:d", "v2", 2, 8),
+			chunk("sha256:e", "v2", 3, 12),
+		},
+	}
+	// The blob data of v1 and v2, the chunk `b` is the same.
+	v1Data := []byte("aaaabbbb")
+	v2Data := []byte("ccccbbbbddddeeee")
+
+	plan, err := planDelta(base, target)
+	assert.Nil(t, err)
+	assert.Equal(t, []DeltaBlob{{ID: "v2", ChunkCount: 4, CompressedSize: 16}}, plan.index.Blobs)
+	assert.Equal(t, []DeltaBlob{{ID: "v1", ChunkCount: 2, CompressedSize: 8}}, plan.index.BaseBlobs)
+	assert.Equal(t, []DeltaRange{{Blob: "v2", Offset: 4, Size: 4, Chunks: []uint32{1}, BaseBlob: "v1", BaseOffset: 4, BaseChunk: 1}}, plan.index.Ranges)
+	assert.Len(t, plan.fetch["v2"], 2)
+
+	// Fetch the ranges like fetchRanges.
+	var data bytes.Buffer
+	for _, r := range plan.fetch["v2"] {
+		indexes := []uint32{}
+		for _, c := range r.chunks {
+			indexes = append(indexes, c.Index)
+		}
+		plan.index.Ranges = append(plan.index.Ranges, DeltaRange{
+			Blob: "v2", Offset: r.offset, Size: r.size, Chunks: indexes, DataOffset: uint64(data.Len()),
+		})
+		data.Write(v2Data[r.offset : r.offset+r.size])
+	}
+	assert.Equal(t, "ccccddddeeee", data.String())
+
+	dataPath := filepath.Join(dir, "data")
+	assert.Nil(t, ioutil.WriteFile(dataPath, data.Bytes(), 0644))
+	deltaPath := filepath.Join(dir, "delta.tar")
+	assert.Nil(t, writeDelta(deltaPath, &plan.index, dataPath))
+
+	// The base chunk isn't cached, it's left to Nydusd.
+	result, err := ApplyDelta(context.Background(), ApplyOpt{Delta: deltaPath, CacheDir: cacheDir})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, result.Chunks)
+	assert.Equal(t, 1, result.MissingChunks)
+	m, err := loadChunkMap(filepath.Join(cacheDir, "v2"+chunkMapSuffix), 4)
+	assert.Nil(t, err)
+	assert.False(t, m.isReady(1))
+	assert.False(t, m.allReady())
+
+	// Warm up the base blob, then the delta completes the cache.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, "v1"), v1Data, 0644))
+	m, err = loadChunkMap(filepath.Join(cacheDir, "v1"+chunkMapSuffix), 2)
+	assert.Nil(t, err)
+	m.setAllReady()
+	assert.Nil(t, m.save())
+	result, err = ApplyDelta(context.Background(), ApplyOpt{Delta: deltaPath, CacheDir: cacheDir})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.Chunks)
+	assert.Equal(t, 1, result.CopiedChunks)
+	assert.Equal(t, 0, result.MissingChunks)
+
+	cached, err := ioutil.ReadFile(filepath.Join(cacheDir, "v2"))
+	assert.Nil(t, err)
+	assert.Equal(t, v2Data, cached)
+	m, err = loadChunkMap(filepath.Join(cacheDir, "v2"+chunkMapSuffix), 4)
+	assert.Nil(t, err)
+	assert.True(t, m.allReady())
+
+	// The chunks of different compressor can't be copied.
+	target.Compressor = "gzip"
+	plan, err = planDelta(base, target)
+	assert.Nil(t, err)
+	assert.Len(t, plan.index.Ranges, 0)
+	assert.Len(t, plan.index.BaseBlobs, 0)
+	assert.Len(t, plan.fetch["v2"], 1)
+}
@@ -0,0 +1,348 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package warmup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	TrimReasonThreshold = "threshold"
+	TrimReasonSignal    = "signal"
+)
+
+var blobIDRegexp = regexp.MustCompile(`^[0-9a-f]{64}`)
+
+// Threshold is the free space of filesystem in bytes or in percent of its
+// size, in the format of kubelet eviction thresholds, e.g. `10Gi` or `15%`.
+type Threshold struct {
+	Bytes   uint64
+	Percent float64
+}
+
+// ParseThreshold parses the threshold like `10Gi`, `10GiB` or `15%`.
+func ParseThreshold(value string) (*Threshold, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percent threshold %s", value)
+		}
+		return &Threshold{Percent: percent}, nil
+	}
+	bytes, err := humanize.ParseBytes(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid threshold %s", value)
+	}
+	return &Threshold{Bytes: bytes}, nil
+}
+
+// Of returns the free bytes of threshold in filesystem of total bytes.
+func (t Threshold) Of(total uint64) uint64 {
+	if t.Percent > 0 {
+		return uint64(float64(total) * t.Percent / 100)
+	}
+	return t.Bytes
+}
+
+func (t Threshold) String() string {
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+	return humanize.IBytes(t.Bytes)
+}
+
+// TrimOpt defines the options to trim cache directory.
+type TrimOpt struct {
+	// CacheDir is the `work_dir` of Nydusd file cache.
+	CacheDir string
+	// The cache is trimmed once the free space of filesystem is less than
+	// MinFree, until it's more than TargetFree.
+	MinFree    Threshold
+	TargetFree Threshold
+	// ProcRoot is the procfs to find the blobs opened by Nydusd, `/proc` by
+	// default.
+	ProcRoot string
+	// OnTrim receives the event of each trim, which is called serially.
+	OnTrim func(event *TrimEvent)
+}
+
+// EvictedBlob is the cache of blob removed by trim.
+type EvictedBlob struct {
+	ID       string    `json:"id"`
+	Size     uint64    `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// TrimEvent is emitted on each trim of cache directory.
+type TrimEvent struct {
+	Time       time.Time     `json:"time"`
+	Reason     string        `json:"reason"`
+	CacheDir   string        `json:"cache_dir"`
+	FreeBefore uint64        `json:"free_before"`
+	FreeAfter  uint64        `json:"free_after"`
+	Target     uint64        `json:"target"`
+	Evicted    []EvictedBlob `json:"evicted"`
+	// InUseBlobs are the blobs opened by Nydusd, they're never evicted.
+	InUseBlobs int `json:"in_use_blobs"`
+	// Unresolved is true if the target free space isn't reached after all
+	// unused blobs are evicted.
+	Unresolved bool `json:"unresolved"`
+}
+
+// cacheEntry is the files of a blob in cache directory, such as the data
+// file and its chunk map.
+type cacheEntry struct {
+	id       string
+	files    []string
+	size     uint64
+	lastUsed time.Time
+}
+
+type fsUsage struct {
+	total uint64
+	free  uint64
+}
+
+func statFs(dir string) (*fsUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return nil, errors.Wrapf(err, "statfs %s", dir)
+	}
+	return &fsUsage{
+		total: stat.Blocks * uint64(stat.Bsize),
+		free:  stat.Bavail * uint64(stat.Bsize),
+	}, nil
+}
+
+// listCacheEntries groups the files in cache directory by blob ID, the size
+// is the allocated size since the cache files are sparse, and the last use
+// is the latest access or modification of the files.
+func listCacheEntries(cacheDir string) ([]cacheEntry, error) {
+	infos, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read cache directory")
+	}
+	entries := map[string]*cacheEntry{}
+	for _, info := range infos {
+		id := blobIDRegexp.FindString(info.Name())
+		if id == "" || !info.Mode().IsRegular() {
+			continue
+		}
+		entry, ok := entries[id]
+		if !ok {
+			entry = &cacheEntry{id: id}
+			entries[id] = entry
+		}
+		entry.files = append(entry.files, filepath.Join(cacheDir, info.Name()))
+		lastUsed := info.ModTime()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.size += uint64(stat.Blocks) * 512
+			if atime := time.Unix(stat.Atim.Unix()); atime.After(lastUsed) {
+				lastUsed = atime
+			}
+		} else {
+			entry.size += uint64(info.Size())
+		}
+		if lastUsed.After(entry.lastUsed) {
+			entry.lastUsed = lastUsed
+		}
+	}
+
+	result := []cacheEntry{}
+	for _, entry := range entries {
+		result = append(result, *entry)
+	}
+	return result, nil
+}
+
+// inUseBlobs finds the blobs in cache directory opened or mapped by any
+// process, i.e. the blobs of mounted images. The processes not permitted
+// to inspect are skipped.
+func inUseBlobs(procRoot, cacheDir string) (map[string]bool, error) {
+	cacheDir, err := filepath.Abs(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(cacheDir); err == nil {
+		cacheDir = resolved
+	}
+	procs, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, errors.Wrap(err, "read procfs")
+	}
+
+	blobs := map[string]bool{}
+	add := func(path string) {
+		if filepath.Dir(path) != cacheDir {
+			return
+		}
+		if id := blobIDRegexp.FindString(filepath.Base(path)); id != "" {
+			blobs[id] = true
+		}
+	}
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, proc.Name(), "fd")
+		if fds, err := ioutil.ReadDir(fdDir); err == nil {
+			for _, fd := range fds {
+				if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil {
+					add(target)
+				}
+			}
+		}
+		// The chunk map is mapped by Nydusd.
+		if maps, err := ioutil.ReadFile(filepath.Join(procRoot, proc.Name(), "maps")); err == nil {
+			for _, line := range strings.Split(string(maps), "\n") {
+				if idx := strings.Index(line, "/"); idx >= 0 {
+					add(strings.TrimSuffix(line[idx:], " (deleted)"))
+				}
+			}
+		}
+	}
+	return blobs, nil
+}
+
+// planTrim selects the unused entries to evict, the least recently used
+// first, until need bytes are freed. It returns false if all unused
+// entries aren't enough.
+func planTrim(entries []cacheEntry, inUse map[string]bool, need uint64) ([]cacheEntry, bool) {
+	unused := []cacheEntry{}
+	for _, entry := range entries {
+		if !inUse[entry.id] {
+			unused = append(unused, entry)
+		}
+	}
+	sort.SliceStable(unused, func(i, j int) bool {
+		return unused[i].lastUsed.Before(unused[j].lastUsed)
+	})
+
+	var freed uint64
+	for idx, entry := range unused {
+		if freed >= need {
+			return unused[:idx], true
+		}
+		freed += entry.size
+	}
+	return unused, freed >= need
+}
+
+// Trim evicts the cache of blobs unused by Nydusd if the free space is less
+// than MinFree, it returns nil if the cache isn't trimmed. The blobs of
+// mounted images are kept, since Nydusd treats the cached chunks as ready,
+// and the space of opened files isn't freed by removing them anyway.
+func Trim(ctx context.Context, opt TrimOpt, reason string) (*TrimEvent, error) {
+	usage, err := statFs(opt.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if reason == TrimReasonThreshold && usage.free >= opt.MinFree.Of(usage.total) {
+		return nil, nil
+	}
+
+	event := &TrimEvent{
+		Time:       time.Now(),
+		Reason:     reason,
+		CacheDir:   opt.CacheDir,
+		FreeBefore: usage.free,
+		Target:     opt.TargetFree.Of(usage.total),
+		Evicted:    []EvictedBlob{},
+	}
+	procRoot := opt.ProcRoot
+	if procRoot == "" {
+		procRoot = "/proc"
+	}
+	entries, err := listCacheEntries(opt.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	inUse, err := inUseBlobs(procRoot, opt.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if inUse[entry.id] {
+			event.InUseBlobs++
+		}
+	}
+
+	var need uint64
+	if event.Target > usage.free {
+		need = event.Target - usage.free
+	}
+	evict, ok := planTrim(entries, inUse, need)
+	event.Unresolved = !ok
+	for _, entry := range evict {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for _, file := range entry.files {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "remove cache file %s", file)
+			}
+		}
+		event.Evicted = append(event.Evicted, EvictedBlob{
+			ID:       entry.id,
+			Size:     entry.size,
+			LastUsed: entry.lastUsed,
+		})
+		logrus.Infof("Evicted cache of blob %s (%s)", entry.id, humanize.IBytes(entry.size))
+	}
+
+	if usage, err = statFs(opt.CacheDir); err != nil {
+		return nil, err
+	}
+	event.FreeAfter = usage.free
+	if opt.OnTrim != nil {
+		opt.OnTrim(event)
+	}
+	return event, nil
+}
+
+// WatchTrim checks the free space every interval and trims the cache under
+// MinFree, the cache is also trimmed on each value of trigger (e.g. sent by
+// the signal of disk pressure), until the context is done.
+func WatchTrim(ctx context.Context, opt TrimOpt, interval time.Duration, trigger <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		reason := TrimReasonThreshold
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-trigger:
+			reason = TrimReasonSignal
+		}
+		event, err := Trim(ctx, opt, reason)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logrus.WithError(err).Warnf("Failed to trim cache directory %s", opt.CacheDir)
+			continue
+		}
+		if event != nil && event.Unresolved {
+			logrus.Warnf("Free space %s of cache directory %s is still under target %s, the rest %d blobs are used by mounted images",
+				humanize.IBytes(event.FreeAfter), opt.CacheDir, humanize.IBytes(event.Target), event.InUseBlobs)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package warmup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThreshold(t *testing.T) {
+	threshold, err := ParseThreshold("15%")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(150), threshold.Of(1000))
+	assert.Equal(t, "15%", threshold.String())
+
+	threshold, err = ParseThreshold("10Gi")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10<<30), threshold.Of(1000))
+
+	_, err = ParseThreshold("101%")
+	assert.NotNil(t, err)
+	_, err = ParseThreshold("ten")
+	assert.NotNil(t, err)
+}
+
+func TestPlanTrim(t *testing.T) {
+	now := time.Now()
+	entries := []cacheEntry{
+		{id: "a", size: 100, lastUsed: now},
+		{id: "b", size: 100, lastUsed: now.Add(-time.Hour)},
+		{id: "c", size: 100, lastUsed: now.Add(-2 * time.Hour)},
+		{id: "d", size: 100, lastUsed: now.Add(-3 * time.Hour)},
+	}
+	inUse := map[string]bool{"d": true}
+
+	evict, ok := planTrim(entries, inUse, 150)
+	assert.True(t, ok)
+	assert.Len(t, evict, 2)
+	assert.Equal(t, "c", evict[0].id)
+	assert.Equal(t, "b", evict[1].id)
+
+	evict, ok = planTrim(entries, inUse, 0)
+	assert.True(t, ok)
+	assert.Len(t, evict, 0)
+
+	// The blob in use isn't evicted even if it's not enough.
+	evict, ok = planTrim(entries, inUse, 400)
+	assert.False(t, ok)
+	assert.Len(t, evict, 3)
+}
+
+func TestCacheEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-trim-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	assert.Nil(t, os.MkdirAll(cacheDir, 0755))
+	blobA, blobB := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	for _, name := range []string{blobA, blobA + chunkMapSuffix, blobB, ".warmup-" + blobB + "-1", "config.json"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(cacheDir, name), []byte("data"), 0644))
+	}
+
+	entries, err := listCacheEntries(cacheDir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		if entry.id == blobA {
+			assert.Len(t, entry.files, 2)
+		} else {
+			assert.Equal(t, blobB, entry.id)
+			assert.Len(t, entry.files, 1)
+		}
+	}
+
+	// A process opens the blob A, and maps the chunk map of blob B.
+	procRoot := filepath.Join(dir, "proc")
+	assert.Nil(t, os.MkdirAll(filepath.Join(procRoot, "100", "fd"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(procRoot, "self"), 0755))
+	assert.Nil(t, os.Symlink(filepath.Join(cacheDir, blobA), filepath.Join(procRoot, "100", "fd", "3")))
+	assert.Nil(t, os.Symlink("/dev/null", filepath.Join(procRoot, "100", "fd", "4")))
+	maps := "7f0000000000-7f0000001000 rw-s 00000000 08:01 1234 " + filepath.Join(cacheDir, blobB+chunkMapSuffix) + "\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(procRoot, "100", "maps"), []byte(maps), 0644))
+
+	inUse, err := inUseBlobs(procRoot, cacheDir)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{blobA: true, blobB: true}, inUse)
+}
@@ -0,0 +1,286 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package warmup downloads the blob data of Nydus image into the cache
+// directory of Nydusd ahead of time without mounting the image, so that the
+// image is served from local cache once mounted.
+//
+// The data is cached in the layout of Nydusd file cache with
+// `"cache_compressed": true`, that is the compressed chunk data is stored
+// in `$cache_dir/$blob_id` at its offset in blob, and the ready chunks are
+// marked in `$cache_dir/$blob_id.chunk_map`, see
+// `storage/src/cache/state/persist_map.rs`.
+package warmup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/remote"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/utils"
+)
+
+// Opt defines warm-up options.
+type Opt struct {
+	// Remote is the Nydus image to warm up, the blobs are pulled from the
+	// same repository, so only registry storage backend is supported.
+	Remote       *remote.Remote
+	ExpectedArch string
+	// CacheDir is the `work_dir` of Nydusd file cache.
+	CacheDir string
+	// PrefetchOnly only downloads the chunks of files in prefetch table of
+	// bootstrap, rather than all blobs of image.
+	PrefetchOnly bool
+}
+
+// Result is the summary of downloaded data.
+type Result struct {
+	Blobs  int
+	Chunks int
+	Size   int64
+}
+
+// Warmup downloads the blobs (or the prefetched chunks) of Nydus image into
+// cache directory, the chunks already in cache are skipped. It should be done
+// before Nydusd uses the cache directory.
+func Warmup(ctx context.Context, opt Opt) (*Result, error) {
+	p, err := parser.New(opt.Remote, opt.ExpectedArch)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := p.Parse(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Nydus image")
+	}
+	if parsed.NydusImage == nil {
+		return nil, fmt.Errorf("not found Nydus image of %s", opt.Remote.Ref)
+	}
+
+	if err := os.MkdirAll(opt.CacheDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create cache directory")
+	}
+	bootstrap, err := dedup.PullBootstrap(ctx, p, parsed.NydusImage, opt.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(bootstrap.ExtBlobs) == 0 {
+		// Nydusd doesn't persist the chunk state for such bootstrap.
+		return nil, fmt.Errorf("bootstrap without extended blob table can't be warmed up")
+	}
+
+	chunks := map[string][]dedup.Chunk{}
+	if opt.PrefetchOnly {
+		for _, chunk := range bootstrap.PrefetchChunks {
+			chunks[chunk.Blob] = append(chunks[chunk.Blob], chunk)
+		}
+	}
+
+	result := &Result{}
+	for idx, blobID := range bootstrap.Blobs {
+		blob := &cacheBlob{
+			remote:   opt.Remote,
+			cacheDir: opt.CacheDir,
+			id:       blobID,
+			ext:      bootstrap.ExtBlobs[idx],
+		}
+		var n int
+		var size int64
+		if opt.PrefetchOnly {
+			if len(chunks[blobID]) == 0 {
+				continue
+			}
+			n, size, err = blob.fetchChunks(ctx, chunks[blobID])
+		} else {
+			n, size, err = blob.fetchAll(ctx)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "warm up blob %s", blobID)
+		}
+		if n > 0 {
+			result.Blobs++
+		}
+		result.Chunks += n
+		result.Size += size
+		logrus.Infof("Warmed up %d chunks (%d bytes) of blob %s", n, size, blobID)
+	}
+
+	return result, nil
+}
+
+type cacheBlob struct {
+	remote   *remote.Remote
+	cacheDir string
+	id       string
+	ext      dedup.ExtBlob
+}
+
+func (blob *cacheBlob) path() string {
+	return filepath.Join(blob.cacheDir, blob.id)
+}
+
+func (blob *cacheBlob) desc() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: utils.MediaTypeNydusBlob,
+		Digest:    digest.NewDigestFromEncoded(digest.SHA256, blob.id),
+		Size:      int64(blob.ext.CompressedSize),
+	}
+}
+
+// fetchAll downloads the whole blob, which is verified by blob digest.
+func (blob *cacheBlob) fetchAll(ctx context.Context) (int, int64, error) {
+	chunkMap, err := loadChunkMap(blob.path()+chunkMapSuffix, blob.ext.ChunkCount)
+	if err != nil {
+		return 0, 0, err
+	}
+	if chunkMap.allReady() {
+		return 0, 0, nil
+	}
+
+	desc := blob.desc()
+	reader, err := blob.remote.Pull(ctx, desc, true)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "pull blob")
+	}
+	defer reader.Close()
+
+	file, err := ioutil.TempFile(blob.cacheDir, ".warmup-"+blob.id+"-")
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "create cache file")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := file.Chmod(0644); err != nil {
+		return 0, 0, errors.Wrap(err, "chmod cache file")
+	}
+
+	verifier := desc.Digest.Verifier()
+	size, err := io.Copy(io.MultiWriter(file, verifier), reader)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "download blob")
+	}
+	if !verifier.Verified() {
+		return 0, 0, fmt.Errorf("digest of downloaded blob doesn't match %s", desc.Digest)
+	}
+	if err := file.Sync(); err != nil {
+		return 0, 0, errors.Wrap(err, "sync cache file")
+	}
+	if err := os.Rename(file.Name(), blob.path()); err != nil {
+		return 0, 0, errors.Wrap(err, "rename cache file")
+	}
+
+	chunkMap.setAllReady()
+	if err := chunkMap.save(); err != nil {
+		return 0, 0, err
+	}
+	return int(blob.ext.ChunkCount), size, nil
+}
+
+type chunkRange struct {
+	offset uint64
+	size   uint64
+	chunks []dedup.Chunk
+}
+
+// mergeChunks merges the chunks adjacent in blob into ranges to reduce
+// requests, the ready chunks are skipped if chunkMap isn't nil.
+func mergeChunks(chunks []dedup.Chunk, chunkMap *chunkMap) []chunkRange {
+	sorted := append([]dedup.Chunk{}, chunks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].CompressedOffset < sorted[j].CompressedOffset
+	})
+	ranges := []chunkRange{}
+	for _, chunk := range sorted {
+		if chunkMap != nil && chunkMap.isReady(chunk.Index) {
+			continue
+		}
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			if last.offset+last.size == chunk.CompressedOffset {
+				last.size += uint64(chunk.CompressedSize)
+				last.chunks = append(last.chunks, chunk)
+				continue
+			}
+			// Chunks with the same offset are the same data.
+			if last.offset+last.size > chunk.CompressedOffset {
+				last.chunks = append(last.chunks, chunk)
+				continue
+			}
+		}
+		ranges = append(ranges, chunkRange{
+			offset: chunk.CompressedOffset,
+			size:   uint64(chunk.CompressedSize),
+			chunks: []dedup.Chunk{chunk},
+		})
+	}
+	return ranges
+}
+
+// fetchChunks downloads the chunks by range requests, the chunk data is
+// verified by Nydusd with `digest_validate` enabled.
+func (blob *cacheBlob) fetchChunks(ctx context.Context, chunks []dedup.Chunk) (int, int64, error) {
+	chunkMap, err := loadChunkMap(blob.path()+chunkMapSuffix, blob.ext.ChunkCount)
+	if err != nil {
+		return 0, 0, err
+	}
+	ranges := mergeChunks(chunks, chunkMap)
+	if len(ranges) == 0 {
+		return 0, 0, nil
+	}
+
+	reader, err := blob.remote.Pull(ctx, blob.desc(), true)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "pull blob")
+	}
+	defer reader.Close()
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		return 0, 0, fmt.Errorf("range request isn't supported by remote")
+	}
+
+	file, err := os.OpenFile(blob.path(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "open cache file")
+	}
+	defer file.Close()
+
+	n := 0
+	var size int64
+	for _, r := range ranges {
+		if _, err := seeker.Seek(int64(r.offset), io.SeekStart); err != nil {
+			return 0, 0, errors.Wrapf(err, "seek blob to %d", r.offset)
+		}
+		buf := make([]byte, r.size)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return 0, 0, errors.Wrapf(err, "read blob range %d+%d", r.offset, r.size)
+		}
+		if _, err := file.WriteAt(buf, int64(r.offset)); err != nil {
+			return 0, 0, errors.Wrap(err, "write cache file")
+		}
+		for _, chunk := range r.chunks {
+			chunkMap.setReady(chunk.Index)
+		}
+		n += len(r.chunks)
+		size += int64(r.size)
+	}
+	if err := file.Sync(); err != nil {
+		return 0, 0, errors.Wrap(err, "sync cache file")
+	}
+
+	if err := chunkMap.save(); err != nil {
+		return 0, 0, err
+	}
+	return n, size, nil
+}
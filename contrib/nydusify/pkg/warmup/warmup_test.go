@@ -0,0 +1,79 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package warmup
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/dedup"
+)
+
+func TestChunkMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-warmup-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blob"+chunkMapSuffix)
+	m, err := loadChunkMap(path, 10)
+	assert.Nil(t, err)
+	m.setReady(0)
+	m.setReady(9)
+	assert.Nil(t, m.save())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Len(t, data, chunkMapHeaderSize+2)
+	assert.Equal(t, uint32(chunkMapMagic), binary.LittleEndian.Uint32(data[0:]))
+	assert.Equal(t, uint32(chunkMapMagic2), binary.LittleEndian.Uint32(data[8:]))
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(data[12:]))
+	assert.Equal(t, []byte{0x80, 0x40}, data[chunkMapHeaderSize:])
+
+	// The chunk map of different chunk count is invalid.
+	m, err = loadChunkMap(path, 20)
+	assert.Nil(t, err)
+	assert.False(t, m.isReady(0))
+
+	m, err = loadChunkMap(path, 10)
+	assert.Nil(t, err)
+	assert.True(t, m.isReady(9))
+	assert.False(t, m.isReady(1))
+	m.setAllReady()
+	assert.Nil(t, m.save())
+	m, err = loadChunkMap(path, 10)
+	assert.Nil(t, err)
+	assert.True(t, m.allReady())
+
+	_, err = loadChunkMap(path, 0)
+	assert.NotNil(t, err)
+}
+
+func TestMergeChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nydusify-warmup-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := loadChunkMap(filepath.Join(dir, "blob"+chunkMapSuffix), 5)
+	assert.Nil(t, err)
+	m.setReady(3)
+
+	ranges := mergeChunks([]dedup.Chunk{
+		{Index: 4, CompressedOffset: 400, CompressedSize: 100},
+		{Index: 1, CompressedOffset: 100, CompressedSize: 100},
+		{Index: 0, CompressedOffset: 0, CompressedSize: 100},
+		{Index: 3, CompressedOffset: 300, CompressedSize: 100},
+	}, m)
+	assert.Len(t, ranges, 2)
+	assert.Equal(t, uint64(0), ranges[0].offset)
+	assert.Equal(t, uint64(200), ranges[0].size)
+	assert.Len(t, ranges[0].chunks, 2)
+	assert.Equal(t, uint64(400), ranges[1].offset)
+	assert.Equal(t, uint64(100), ranges[1].size)
+}
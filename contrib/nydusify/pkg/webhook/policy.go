@@ -0,0 +1,109 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/pkg/errors"
+)
+
+// Rule maps the images matched by Source prefix to the converted images.
+type Rule struct {
+	// Source is the prefix of normalized image reference, e.g.
+	// `docker.io/library/`, an empty Source matches all images.
+	Source string `json:"source"`
+	// Target replaces the Source prefix of image reference, the image is
+	// kept in the same repository if it's empty.
+	Target string `json:"target"`
+	// TagSuffix is appended to the image tag, e.g. `-nydus`.
+	TagSuffix string `json:"tag_suffix"`
+}
+
+// Map returns the converted image reference of the image name (without
+// tag) and tag, the name should be matched by Source prefix.
+func (rule Rule) Map(name, tag string) string {
+	target := name
+	if rule.Target != "" {
+		target = rule.Target + strings.TrimPrefix(name, rule.Source)
+	}
+	return target + ":" + tag + rule.TagSuffix
+}
+
+// Policy defines how pod image references are rewritten, the first matched
+// rule is applied.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+	// Lookup only rewrites the image reference if the converted image
+	// exists in registry, otherwise the original reference is kept.
+	Lookup bool `json:"lookup"`
+	// Insecure allows http/insecure registry communication on lookup.
+	Insecure bool `json:"insecure"`
+	// Namespaces limits the rewriting to pods in these namespaces, all
+	// namespaces are included if it's empty.
+	Namespaces []string `json:"namespaces"`
+}
+
+// ParsePolicyFile loads the policy from JSON file.
+func ParsePolicyFile(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read policy file")
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, errors.Wrap(err, "parse policy file")
+	}
+	for idx, rule := range policy.Rules {
+		if rule.Target == "" && rule.TagSuffix == "" {
+			return nil, fmt.Errorf("rule %d should specify target or tag_suffix", idx)
+		}
+	}
+	return &policy, nil
+}
+
+func (policy *Policy) matchNamespace(namespace string) bool {
+	if len(policy.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range policy.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Target returns the converted image reference of image by the first
+// matched rule. The image referenced by digest can't be rewritten since
+// the converted image has a different digest.
+func (policy *Policy) Target(image string) (string, bool) {
+	named, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return "", false
+	}
+	tagged, ok := named.(docker.Tagged)
+	if !ok {
+		return "", false
+	}
+	name := named.Name()
+
+	for _, rule := range policy.Rules {
+		if !strings.HasPrefix(name, rule.Source) {
+			continue
+		}
+		target := rule.Map(name, tagged.Tag())
+		if _, err := docker.ParseDockerRef(target); err != nil {
+			return "", false
+		}
+		return target, target != named.String()
+	}
+
+	return "", false
+}
@@ -0,0 +1,268 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package webhook implements a Kubernetes mutating admission webhook, which
+// rewrites the image references of pods to the converted Nydus images, so
+// that the workload manifests don't need to be changed by hand.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/converter/provider"
+	"github.com/dragonflyoss/image-service/contrib/nydusify/pkg/parser"
+)
+
+// The subset of admission.k8s.io/v1 AdmissionReview used by the webhook.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string           `json:"uid"`
+	Kind      groupVersionKind `json:"kind"`
+	Namespace string           `json:"namespace"`
+	Object    json.RawMessage  `json:"object"`
+}
+
+type groupVersionKind struct {
+	Group   string `json:"group"`
+	Version string `json:"version"`
+	Kind    string `json:"kind"`
+}
+
+type admissionResponse struct {
+	UID       string  `json:"uid"`
+	Allowed   bool    `json:"allowed"`
+	PatchType *string `json:"patchType,omitempty"`
+	Patch     []byte  `json:"patch,omitempty"`
+}
+
+type container struct {
+	Image string `json:"image"`
+}
+
+type pod struct {
+	Spec struct {
+		InitContainers      []container `json:"initContainers"`
+		Containers          []container `json:"containers"`
+		EphemeralContainers []container `json:"ephemeralContainers"`
+	} `json:"spec"`
+}
+
+type patchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+// LookupFunc checks whether the converted image exists.
+type LookupFunc func(ctx context.Context, ref string) (bool, error)
+
+// RegistryLookup returns a LookupFunc which checks whether the image in
+// registry contains a Nydus manifest of arch.
+func RegistryLookup(arch string, insecure bool) LookupFunc {
+	return func(ctx context.Context, ref string) (bool, error) {
+		r, err := provider.DefaultRemote(ref, insecure)
+		if err != nil {
+			return false, err
+		}
+		p, err := parser.New(r, arch)
+		if err != nil {
+			return false, err
+		}
+		parsed, err := p.Parse(ctx)
+		if err != nil {
+			return false, err
+		}
+		return parsed.NydusImage != nil, nil
+	}
+}
+
+// maxCacheEntries caps the lookup results cached by Mutator, the expired
+// results are pruned and then the earliest expiring ones are evicted once
+// it's reached.
+const maxCacheEntries = 4096
+
+type lookupResult struct {
+	found     bool
+	expiresAt time.Time
+}
+
+// Mutator serves the admission reviews of pods.
+type Mutator struct {
+	policy *Policy
+	lookup LookupFunc
+	ttl    time.Duration
+
+	mutex      sync.Mutex
+	cache      map[string]lookupResult
+	maxEntries int
+}
+
+// New creates a Mutator, the lookup results are cached for ttl, lookup is
+// only used if it's enabled by policy.
+func New(policy *Policy, lookup LookupFunc, ttl time.Duration) *Mutator {
+	return &Mutator{
+		policy:     policy,
+		lookup:     lookup,
+		ttl:        ttl,
+		cache:      map[string]lookupResult{},
+		maxEntries: maxCacheEntries,
+	}
+}
+
+// store caches the lookup result of ref, the caller must hold the mutex.
+func (m *Mutator) store(ref string, result lookupResult) {
+	if _, ok := m.cache[ref]; !ok && len(m.cache) >= m.maxEntries {
+		now := time.Now()
+		for key, cached := range m.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(m.cache, key)
+			}
+		}
+		for len(m.cache) >= m.maxEntries {
+			var earliest string
+			for key, cached := range m.cache {
+				if earliest == "" || cached.expiresAt.Before(m.cache[earliest].expiresAt) {
+					earliest = key
+				}
+			}
+			delete(m.cache, earliest)
+		}
+	}
+	m.cache[ref] = result
+}
+
+func (m *Mutator) exists(ctx context.Context, ref string) bool {
+	m.mutex.Lock()
+	result, ok := m.cache[ref]
+	m.mutex.Unlock()
+	if ok && time.Now().Before(result.expiresAt) {
+		return result.found
+	}
+
+	found, err := m.lookup(ctx, ref)
+	if err != nil {
+		// Keep the original image if the converted image is unavailable.
+		logrus.Warnf("Lookup converted image %s: %s", ref, err)
+		found = false
+	}
+	m.mutex.Lock()
+	m.store(ref, lookupResult{found: found, expiresAt: time.Now().Add(m.ttl)})
+	m.mutex.Unlock()
+	return found
+}
+
+func (m *Mutator) rewrite(ctx context.Context, image string) (string, bool) {
+	target, ok := m.policy.Target(image)
+	if !ok {
+		return "", false
+	}
+	if m.policy.Lookup && !m.exists(ctx, target) {
+		return "", false
+	}
+	return target, true
+}
+
+func (m *Mutator) mutate(ctx context.Context, req *admissionRequest) ([]patchOperation, error) {
+	patches := []patchOperation{}
+	if req.Kind.Kind != "Pod" || !m.policy.matchNamespace(req.Namespace) {
+		return patches, nil
+	}
+
+	var p pod
+	if err := json.Unmarshal(req.Object, &p); err != nil {
+		return nil, fmt.Errorf("invalid pod object: %s", err)
+	}
+	for _, field := range []struct {
+		name       string
+		containers []container
+	}{
+		{"initContainers", p.Spec.InitContainers},
+		{"containers", p.Spec.Containers},
+		{"ephemeralContainers", p.Spec.EphemeralContainers},
+	} {
+		for idx, c := range field.containers {
+			target, ok := m.rewrite(ctx, c.Image)
+			if !ok {
+				continue
+			}
+			patches = append(patches, patchOperation{
+				Op:    "replace",
+				Path:  fmt.Sprintf("/spec/%s/%d/image", field.name, idx),
+				Value: target,
+			})
+			logrus.Infof("Rewrite image %s to %s in pod of namespace %s", c.Image, target, req.Namespace)
+		}
+	}
+	return patches, nil
+}
+
+// Review responds to the admission review, the pod is always allowed, and
+// patched if any image reference is rewritten.
+func (m *Mutator) Review(ctx context.Context, data []byte) ([]byte, error) {
+	var review admissionReview
+	if err := json.Unmarshal(data, &review); err != nil {
+		return nil, fmt.Errorf("invalid admission review: %s", err)
+	}
+	if review.Request == nil {
+		return nil, fmt.Errorf("invalid admission review: no request")
+	}
+
+	patches, err := m.mutate(ctx, review.Request)
+	if err != nil {
+		return nil, err
+	}
+	response := &admissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	if len(patches) > 0 {
+		patch, err := json.Marshal(patches)
+		if err != nil {
+			return nil, err
+		}
+		patchType := "JSONPatch"
+		response.PatchType = &patchType
+		response.Patch = patch
+	}
+
+	return json.Marshal(admissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       review.Kind,
+		Response:   response,
+	})
+}
+
+func (m *Mutator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := m.Review(r.Context(), data)
+	if err != nil {
+		logrus.Warnf("Review admission request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyTarget(t *testing.T) {
+	policy := &Policy{
+		Rules: []Rule{
+			{Source: "docker.io/library/", Target: "myregistry.com/mirror/", TagSuffix: "-nydus"},
+			{Source: "myregistry.com/", TagSuffix: "-nydus"},
+		},
+	}
+
+	for _, c := range []struct {
+		image  string
+		target string
+	}{
+		{"ubuntu", "myregistry.com/mirror/ubuntu:latest-nydus"},
+		{"docker.io/library/nginx:1.21", "myregistry.com/mirror/nginx:1.21-nydus"},
+		{"myregistry.com/app/web:v1", "myregistry.com/app/web:v1-nydus"},
+		{"quay.io/app/web:v1", ""},
+		{"myregistry.com/app/web@sha256:" + fmt.Sprintf("%064d", 0), ""},
+		{"Invalid", ""},
+	} {
+		target, ok := policy.Target(c.image)
+		assert.Equal(t, c.target != "", ok, c.image)
+		assert.Equal(t, c.target, target, c.image)
+	}
+}
+
+func review(t *testing.T, m *Mutator, namespace string, spec string) []patchOperation {
+	req := fmt.Sprintf(`{
+		"apiVersion": "admission.k8s.io/v1",
+		"kind": "AdmissionReview",
+		"request": {
+			"uid": "uid-1",
+			"kind": {"group": "", "version": "v1", "kind": "Pod"},
+			"namespace": %q,
+			"object": {"spec": %s}
+		}
+	}`, namespace, spec)
+	data, err := m.Review(context.Background(), []byte(req))
+	assert.Nil(t, err)
+
+	var resp admissionReview
+	assert.Nil(t, json.Unmarshal(data, &resp))
+	assert.Equal(t, "AdmissionReview", resp.Kind)
+	assert.Equal(t, "uid-1", resp.Response.UID)
+	assert.True(t, resp.Response.Allowed)
+	if resp.Response.Patch == nil {
+		assert.Nil(t, resp.Response.PatchType)
+		return nil
+	}
+	assert.Equal(t, "JSONPatch", *resp.Response.PatchType)
+	patches := []patchOperation{}
+	assert.Nil(t, json.Unmarshal(resp.Response.Patch, &patches))
+	return patches
+}
+
+func TestMutator(t *testing.T) {
+	policy := &Policy{
+		Rules:      []Rule{{TagSuffix: "-nydus"}},
+		Lookup:     true,
+		Namespaces: []string{"default"},
+	}
+	lookups := 0
+	m := New(policy, func(ctx context.Context, ref string) (bool, error) {
+		lookups++
+		if ref == "docker.io/library/busybox:latest-nydus" {
+			return false, fmt.Errorf("not found")
+		}
+		return ref != "docker.io/library/redis:6-nydus", nil
+	}, time.Minute)
+
+	patches := review(t, m, "default", `{
+		"initContainers": [{"image": "busybox"}],
+		"containers": [{"image": "redis:6"}, {"image": "nginx:1.21"}]
+	}`)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/1/image", Value: "docker.io/library/nginx:1.21-nydus"},
+	}, patches)
+	assert.Equal(t, 3, lookups)
+
+	// Lookup results are cached.
+	patches = review(t, m, "default", `{"containers": [{"image": "nginx:1.21"}], "ephemeralContainers": [{"image": "busybox"}]}`)
+	assert.Equal(t, []patchOperation{
+		{Op: "replace", Path: "/spec/containers/0/image", Value: "docker.io/library/nginx:1.21-nydus"},
+	}, patches)
+	assert.Equal(t, 3, lookups)
+
+	assert.Nil(t, review(t, m, "kube-system", `{"containers": [{"image": "nginx:1.21"}]}`))
+
+	_, err := m.Review(context.Background(), []byte(`{"kind": "AdmissionReview"}`))
+	assert.NotNil(t, err)
+}
+
+func TestMutatorCache(t *testing.T) {
+	lookups := 0
+	m := New(&Policy{}, func(ctx context.Context, ref string) (bool, error) {
+		lookups++
+		return true, nil
+	}, time.Minute)
+	m.maxEntries = 2
+
+	// The expired result is pruned when the cache is full.
+	m.cache["expired"] = lookupResult{found: true, expiresAt: time.Now().Add(-time.Second)}
+	assert.True(t, m.exists(context.Background(), "a"))
+	assert.True(t, m.exists(context.Background(), "b"))
+	assert.Len(t, m.cache, 2)
+	assert.NotContains(t, m.cache, "expired")
+
+	// The earliest expiring result is evicted if none is expired.
+	assert.True(t, m.exists(context.Background(), "c"))
+	assert.Len(t, m.cache, 2)
+	assert.NotContains(t, m.cache, "a")
+	assert.Contains(t, m.cache, "c")
+
+	// Updating a cached result doesn't evict others.
+	m.cache["b"] = lookupResult{found: true, expiresAt: time.Now().Add(-time.Second)}
+	assert.True(t, m.exists(context.Background(), "b"))
+	assert.Len(t, m.cache, 2)
+	assert.Equal(t, 4, lookups)
+}
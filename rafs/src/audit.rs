@@ -0,0 +1,203 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Audit log of the file reads of a Rafs instance.
+//!
+//! Each record is a line of JSON with the time, the mount, the image, the requesting process and
+//! the path and byte range read, appended to a file or sent to syslog. The volume is bounded by
+//! sampling one of every `sample_interval` reads and by `max_records_per_sec`.
+
+use std::ffi::CString;
+use std::fs::{File, OpenOptions};
+use std::io::{Result, Write};
+use std::path::Path;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Mutex, Once};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use serde::Deserialize;
+use serde_json::json;
+
+/// Records are sent to syslog if the path of audit log is `syslog`.
+pub const AUDIT_LOG_SYSLOG: &str = "syslog";
+
+static OPEN_SYSLOG: Once = Once::new();
+
+/// Configuration information for the audit log of file reads.
+#[derive(Clone, Default, Deserialize)]
+pub struct AuditLogConfig {
+    /// File to append the records to, or `syslog`.
+    pub path: String,
+    /// Name of the image recorded with the reads, e.g. its reference.
+    #[serde(default)]
+    pub image: String,
+    /// Record one of every `sample_interval` reads, zero or one records all reads.
+    #[serde(default)]
+    pub sample_interval: u64,
+    /// Max number of records per second, zero means unlimited.
+    #[serde(default)]
+    pub max_records_per_sec: u64,
+}
+
+enum AuditSink {
+    File(File),
+    Syslog,
+}
+
+/// Audit log of the file reads of a Rafs instance.
+pub(crate) struct AuditLog {
+    mount: String,
+    image: String,
+    sink: Mutex<AuditSink>,
+    sample_interval: u64,
+    max_records_per_sec: u64,
+    reads: AtomicU64,
+    // Second of the current rate limit window, and the number of records in it.
+    window: Mutex<(u64, u64)>,
+}
+
+impl AuditLog {
+    pub(crate) fn new(mount: &str, config: &AuditLogConfig) -> Result<Self> {
+        let sink = if config.path == AUDIT_LOG_SYSLOG {
+            OPEN_SYSLOG.call_once(|| unsafe {
+                libc::openlog(
+                    b"nydusd\0".as_ptr() as *const libc::c_char,
+                    libc::LOG_PID,
+                    libc::LOG_USER,
+                )
+            });
+            AuditSink::Syslog
+        } else {
+            let file = OpenOptions::new()
+                .create(true)
+                .append(true)
+                .open(Path::new(&config.path))?;
+            AuditSink::File(file)
+        };
+
+        Ok(AuditLog {
+            mount: mount.to_string(),
+            image: config.image.clone(),
+            sink: Mutex::new(sink),
+            sample_interval: config.sample_interval,
+            max_records_per_sec: config.max_records_per_sec,
+            reads: AtomicU64::new(0),
+            window: Mutex::new((0, 0)),
+        })
+    }
+
+    /// Check whether the current read should be recorded.
+    pub(crate) fn sample(&self) -> bool {
+        let now = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or(0);
+        self.sample_at(now)
+    }
+
+    fn sample_at(&self, now: u64) -> bool {
+        let n = self.reads.fetch_add(1, Ordering::Relaxed);
+        if self.sample_interval > 1 && n % self.sample_interval != 0 {
+            return false;
+        }
+        if self.max_records_per_sec == 0 {
+            return true;
+        }
+
+        let mut window = self.window.lock().unwrap();
+        if window.0 != now {
+            *window = (now, 0);
+        }
+        if window.1 >= self.max_records_per_sec {
+            return false;
+        }
+        window.1 += 1;
+
+        true
+    }
+
+    /// Record that process `pid` of user `uid` read `size` bytes at `offset` of file `path`.
+    pub(crate) fn record(&self, uid: u32, pid: u32, path: &Path, offset: u64, size: usize) {
+        let time = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_millis() as u64)
+            .unwrap_or(0);
+        let line = json!({
+            "time": time,
+            "mount": self.mount,
+            "image": self.image,
+            "uid": uid,
+            "pid": pid,
+            "path": path.to_string_lossy(),
+            "offset": offset,
+            "size": size,
+        })
+        .to_string();
+
+        match &mut *self.sink.lock().unwrap() {
+            AuditSink::File(f) => {
+                // One write per record, so that records of instances sharing the file don't mix.
+                if let Err(e) = f.write_all(format!("{}\n", line).as_bytes()) {
+                    warn!("failed to write audit log of {}, {}", self.mount, e);
+                }
+            }
+            AuditSink::Syslog => {
+                if let Ok(msg) = CString::new(line) {
+                    unsafe {
+                        libc::syslog(
+                            libc::LOG_INFO,
+                            b"%s\0".as_ptr() as *const libc::c_char,
+                            msg.as_ptr(),
+                        )
+                    };
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use vmm_sys_util::tempfile::TempFile;
+
+    fn audit_log(path: &Path, sample_interval: u64, max_records_per_sec: u64) -> AuditLog {
+        let config = AuditLogConfig {
+            path: path.to_str().unwrap().to_string(),
+            image: "nginx:latest".to_string(),
+            sample_interval,
+            max_records_per_sec,
+        };
+        AuditLog::new("/mnt", &config).unwrap()
+    }
+
+    #[test]
+    fn test_audit_log() {
+        let tmp = TempFile::new().unwrap();
+        let log = audit_log(tmp.as_path(), 0, 0);
+        assert!(log.sample());
+        log.record(0, 100, Path::new("/etc/passwd"), 4096, 512);
+
+        let content = std::fs::read_to_string(tmp.as_path()).unwrap();
+        let record: serde_json::Value = serde_json::from_str(content.trim_end()).unwrap();
+        assert_eq!(record["mount"], "/mnt");
+        assert_eq!(record["image"], "nginx:latest");
+        assert_eq!(record["pid"], 100);
+        assert_eq!(record["path"], "/etc/passwd");
+        assert_eq!(record["offset"], 4096);
+        assert_eq!(record["size"], 512);
+    }
+
+    #[test]
+    fn test_audit_log_sample() {
+        let tmp = TempFile::new().unwrap();
+        let log = audit_log(tmp.as_path(), 3, 0);
+        let sampled: Vec<bool> = (0..6).map(|_| log.sample()).collect();
+        assert_eq!(sampled, vec![true, false, false, true, false, false]);
+
+        let log = audit_log(tmp.as_path(), 0, 2);
+        assert_eq!((0..10).filter(|_| log.sample_at(1)).count(), 2);
+        assert!(log.sample_at(2));
+    }
+}
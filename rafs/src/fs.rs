@@ -15,7 +15,9 @@
 //! [RafsConfig](struct.RafsConfig.html) to configure an [Rafs] instance.
 
 use std::any::Any;
+use std::cell::Cell;
 use std::cmp;
+use std::collections::hash_map::{self, HashMap};
 use std::convert::TryFrom;
 use std::ffi::{CStr, OsStr, OsString};
 use std::fmt;
@@ -24,23 +26,28 @@ use std::io::Result;
 use std::os::unix::ffi::OsStrExt;
 use std::path::PathBuf;
 use std::str::FromStr;
-use std::sync::Arc;
+use std::sync::mpsc::{channel, RecvTimeoutError, Sender};
+use std::sync::{Arc, Mutex};
+use std::thread::JoinHandle;
 use std::time::{Duration, SystemTime};
 
+use nix::sys::stat::fstat;
 use nix::unistd::{getegid, geteuid};
 use serde::Deserialize;
 
 use fuse_backend_rs::abi::linux_abi::Attr;
 use fuse_backend_rs::api::filesystem::*;
 use fuse_backend_rs::api::BackendFileSystem;
+use nydus_utils::budget::{self, MemoryClass, MemoryPermit};
 use nydus_utils::metrics::{self, FopRecorder, StatsFop::*};
 use storage::cache::BlobPrefetchConfig;
 use storage::device::{BlobDevice, BlobPrefetchRequest};
 use storage::factory::FactoryConfig;
 
+use crate::audit::{AuditLog, AuditLogConfig};
 use crate::metadata::layout::RAFS_ROOT_INODE;
 use crate::metadata::{
-    Inode, PostWalkAction, RafsInode, RafsSuper, RafsSuperMeta, DOT, DOTDOT,
+    Inode, PostWalkAction, RafsInode, RafsMode, RafsSuper, RafsSuperMeta, DOT, DOTDOT,
     RAFS_DEFAULT_CHUNK_SIZE,
 };
 use crate::{RafsError, RafsIoReader, RafsResult};
@@ -69,6 +76,18 @@ fn default_amplify_io() -> u32 {
     128 * 1024
 }
 
+fn default_max_amplify_io() -> u32 {
+    1024 * 1024
+}
+
+fn default_scrub_bandwidth_rate() -> u64 {
+    10 * 1024 * 1024
+}
+
+fn default_throttle_idle_ms() -> u64 {
+    1000
+}
+
 /// Configuration information for filesystem data prefetch.
 #[derive(Clone, Default, Deserialize)]
 pub struct FsPrefetchControl {
@@ -98,6 +117,19 @@ pub struct FsPrefetchControl {
     /// Whether to prefetch all filesystem data.
     #[serde(default = "default_prefetch_all")]
     pub prefetch_all: bool,
+
+    /// Latency threshold of on-demand reads from backend to throttle prefetching.
+    ///
+    /// In unit of milliseconds. Prefetching slows down when the average latency of on-demand
+    /// backend reads rises above the threshold, so that it doesn't compete with user IO.
+    /// throttle_latency_ms == 0 -- prefetch throttling disabled
+    #[serde(default)]
+    pub throttle_latency_ms: u64,
+
+    /// Prefetching ramps back up to full speed when there's no on-demand backend read in the
+    /// idle time in unit of milliseconds.
+    #[serde(default = "default_throttle_idle_ms")]
+    pub throttle_idle_ms: u64,
 }
 
 impl TryFrom<&RafsConfig> for BlobPrefetchConfig {
@@ -119,6 +151,8 @@ impl TryFrom<&RafsConfig> for BlobPrefetchConfig {
             threads_count: c.fs_prefetch.threads_count,
             merging_size: c.fs_prefetch.merging_size,
             bandwidth_rate: c.fs_prefetch.bandwidth_rate,
+            throttle_latency_ms: c.fs_prefetch.throttle_latency_ms,
+            throttle_idle_ms: c.fs_prefetch.throttle_idle_ms,
         })
     }
 }
@@ -163,6 +197,21 @@ pub struct RafsConfig {
     // ZERO value means, amplifying user io is not enabled.
     #[serde(default = "default_amplify_io")]
     pub amplify_io: u32,
+    /// Grow the amplified io window for sequential reads of a file and shrink it for random reads.
+    #[serde(default)]
+    pub adaptive_amplify_io: bool,
+    /// Max size of the amplified io window when `adaptive_amplify_io` is enabled.
+    #[serde(default = "default_max_amplify_io")]
+    pub max_amplify_io: u32,
+    /// Interval in seconds to verify the cached data in background, zero means never.
+    #[serde(default)]
+    pub scrub_interval_secs: u64,
+    /// Bytes per second to read the cached data for verification, zero means unlimited.
+    #[serde(default = "default_scrub_bandwidth_rate")]
+    pub scrub_bandwidth_rate: u64,
+    /// Record the file reads into an audit log.
+    #[serde(default)]
+    pub audit_log: Option<AuditLogConfig>,
 }
 
 impl RafsConfig {
@@ -198,6 +247,83 @@ impl fmt::Display for RafsConfig {
     }
 }
 
+// Max number of files whose access pattern is tracked, the history is reset when reached.
+const READ_AHEAD_MAX_FILES: usize = 4096;
+// The amplified io window is disabled once shrunk below the page size.
+const READ_AHEAD_MIN_WINDOW: u32 = 4096;
+
+struct ReadAheadState {
+    // Range of the last read of the file.
+    start: u64,
+    end: u64,
+    window: u32,
+}
+
+/// Adapt the amplified io window of each file to its access pattern.
+///
+/// The window of a file starts from `amplify_io`, doubles on each sequential read up to
+/// `max_amplify_io`, and halves on each random read, so scanning large files fetches more data
+/// ahead while random access, e.g. of databases, doesn't download unused data.
+struct ReadAheadTracker {
+    base: u32,
+    max: u32,
+    files: Mutex<HashMap<u64, ReadAheadState>>,
+}
+
+impl ReadAheadTracker {
+    fn new(base: u32, max: u32) -> Self {
+        ReadAheadTracker {
+            base,
+            max: cmp::max(base, max),
+            files: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Get the amplified io window for reading `size` bytes at `offset` of file `ino`.
+    fn window(&self, ino: u64, offset: u64, size: u32) -> u32 {
+        let mut files = self.files.lock().unwrap();
+        if files.len() >= READ_AHEAD_MAX_FILES && !files.contains_key(&ino) {
+            files.clear();
+        }
+
+        let end = offset + size as u64;
+        match files.entry(ino) {
+            hash_map::Entry::Vacant(v) => {
+                v.insert(ReadAheadState {
+                    start: offset,
+                    end,
+                    window: self.base,
+                });
+                self.base
+            }
+            hash_map::Entry::Occupied(mut o) => {
+                let state = o.get_mut();
+                // Reads of a sequential scan may be reordered by multiple fuse threads.
+                if offset <= state.end && end >= state.start {
+                    state.window = if state.window == 0 {
+                        self.base
+                    } else {
+                        cmp::min(state.window.saturating_mul(2), self.max)
+                    };
+                    state.end = cmp::max(end, state.end);
+                } else {
+                    state.window /= 2;
+                    if state.window < READ_AHEAD_MIN_WINDOW {
+                        state.window = 0;
+                    }
+                    state.end = end;
+                }
+                state.start = offset;
+                state.window
+            }
+        }
+    }
+
+    fn forget(&self, ino: u64) {
+        self.files.lock().unwrap().remove(&ino);
+    }
+}
+
 /// Struct to glue fuse, storage backend and filesystem metadata together.
 ///
 /// The [Rafs](struct.Rafs.html) structure implements the `fuse_backend_rs::FileSystem` trait,
@@ -214,8 +340,16 @@ pub struct Rafs {
     digest_validate: bool,
     fs_prefetch: bool,
     prefetch_all: bool,
+    merging_size: usize,
     xattr_enabled: bool,
     amplify_io: u32,
+    read_ahead: Option<ReadAheadTracker>,
+    audit: Option<AuditLog>,
+    scrub_interval_secs: u64,
+    scrub_bandwidth_rate: u64,
+    scrubber: Mutex<Option<(Sender<()>, JoinHandle<()>)>>,
+    #[allow(dead_code)]
+    metadata_permit: Option<MemoryPermit<'static>>,
 
     // static inode attributes
     i_uid: u32,
@@ -228,11 +362,33 @@ impl Rafs {
     pub fn new(conf: RafsConfig, id: &str, r: &mut RafsIoReader) -> RafsResult<Self> {
         let storage_conf = Self::prepare_storage_conf(&conf)?;
         let mut sb = RafsSuper::new(&conf).map_err(RafsError::FillSuperblock)?;
+        // The cached mode keeps all metadata in memory, roughly in proportion to the bootstrap.
+        let metadata_permit = if sb.mode == RafsMode::Cached {
+            let size = fstat(r.as_raw_fd())
+                .map_err(|e| RafsError::FillSuperblock(eother!(e)))?
+                .st_size as u64;
+            let permit = budget::reserve_memory(MemoryClass::Metadata, size).map_err(|e| {
+                error!(
+                    "no memory budget to load {} bytes of metadata in cached mode, {}",
+                    size, e
+                );
+                RafsError::FillSuperblock(e)
+            })?;
+            Some(permit)
+        } else {
+            None
+        };
         sb.load(r).map_err(RafsError::FillSuperblock)?;
 
         let blob_infos = sb.superblock.get_blob_infos();
         let device =
             BlobDevice::new(&storage_conf, &blob_infos).map_err(RafsError::CreateDevice)?;
+        let audit = match conf.audit_log.as_ref() {
+            Some(c) => Some(AuditLog::new(id, c).map_err(|e| {
+                RafsError::Configure(format!("failed to open audit log {}, {}", c.path, e))
+            })?),
+            None => None,
+        };
 
         let rafs = Rafs {
             id: id.to_string(),
@@ -244,8 +400,19 @@ impl Rafs {
             digest_validate: conf.digest_validate,
             fs_prefetch: conf.fs_prefetch.enable,
             amplify_io: conf.amplify_io,
+            read_ahead: if conf.adaptive_amplify_io && conf.amplify_io > 0 {
+                Some(ReadAheadTracker::new(conf.amplify_io, conf.max_amplify_io))
+            } else {
+                None
+            },
+            audit,
             prefetch_all: conf.fs_prefetch.prefetch_all,
+            merging_size: conf.fs_prefetch.merging_size,
             xattr_enabled: conf.enable_xattr,
+            scrub_interval_secs: conf.scrub_interval_secs,
+            scrub_bandwidth_rate: conf.scrub_bandwidth_rate,
+            scrubber: Mutex::new(None),
+            metadata_permit,
 
             i_uid: geteuid().into(),
             i_gid: getegid().into(),
@@ -305,6 +472,9 @@ impl Rafs {
             // Device should be ready before any prefetch.
             self.prefetch(r, prefetch_files)
         }
+        if self.scrub_interval_secs > 0 {
+            self.start_scrubber();
+        }
         self.initialized = true;
 
         Ok(())
@@ -315,6 +485,11 @@ impl Rafs {
         info! {"Destroy rafs"}
 
         if self.initialized {
+            // The scrubber holds the superblock, stop it by disconnecting the channel.
+            if let Some((sender, handle)) = self.scrubber.lock().unwrap().take() {
+                drop(sender);
+                let _ = handle.join();
+            }
             Arc::get_mut(&mut self.sb)
                 .expect("Superblock is no longer used")
                 .destroy();
@@ -335,6 +510,16 @@ impl Rafs {
         &self.sb.meta
     }
 
+    /// Get ids of the data blobs of the filesystem.
+    pub fn blob_ids(&self) -> Vec<String> {
+        self.sb
+            .superblock
+            .get_blob_infos()
+            .iter()
+            .map(|b| b.blob_id().to_string())
+            .collect()
+    }
+
     fn prepare_storage_conf(conf: &RafsConfig) -> RafsResult<Arc<FactoryConfig>> {
         let mut storage_conf = conf.device.clone();
         storage_conf.cache.cache_validate = conf.digest_validate;
@@ -470,6 +655,98 @@ impl Rafs {
         });
     }
 
+    // Verify the cached data of all files every `scrub_interval_secs` in background, corrupted
+    // chunks are evicted from the cache and fetched again from the backend on next access.
+    fn start_scrubber(&self) {
+        let sb = self.sb.clone();
+        let device = self.device.clone();
+        let id = self.id.clone();
+        let interval = Duration::from_secs(self.scrub_interval_secs);
+        let rate = self.scrub_bandwidth_rate;
+        let (sender, receiver) = channel::<()>();
+
+        let handle = std::thread::Builder::new()
+            .name("rafs-scrubber".to_string())
+            .spawn(move || {
+                // Nothing is sent on the channel, it's disconnected to stop the scrubber.
+                while let Err(RecvTimeoutError::Timeout) = receiver.recv_timeout(interval) {
+                    let corrupted = Cell::new(0usize);
+                    let stopped = Cell::new(false);
+                    let result = sb.walk_chunks(&|desc| {
+                        if stopped.get() || desc.bi_vec.is_empty() {
+                            return;
+                        }
+                        match device.scrub(desc) {
+                            Ok(n) => corrupted.set(corrupted.get() + n),
+                            Err(e) => warn!("{}: failed to scrub cached data: {}", id, e),
+                        }
+                        // Pace the reads to leave the disk bandwidth for user IO.
+                        let delay = if rate > 0 {
+                            Duration::from_secs_f64(desc.bi_size as f64 / rate as f64)
+                        } else {
+                            Duration::from_secs(0)
+                        };
+                        if let Err(RecvTimeoutError::Disconnected) = receiver.recv_timeout(delay) {
+                            stopped.set(true);
+                        }
+                    });
+                    if stopped.get() {
+                        break;
+                    }
+                    match result {
+                        Ok(_) => info!(
+                            "{}: scrubbed cached data, {} corrupted chunks evicted",
+                            id,
+                            corrupted.get()
+                        ),
+                        Err(e) => warn!("{}: failed to walk chunks to scrub: {}", id, e),
+                    }
+                }
+            });
+
+        match handle {
+            Ok(handle) => *self.scrubber.lock().unwrap() = Some((sender, handle)),
+            Err(e) => warn!("{}: failed to start scrubber: {}", self.id, e),
+        }
+    }
+
+    /// Prefetch the data of `files` into the cache in background, on demand of the management API.
+    ///
+    /// The paths are resolved before returning, and the data is fetched synchronously by a new
+    /// thread since the background prefetch workers have been stopped after mounting.
+    pub fn trigger_prefetch(&self, files: &[PathBuf]) -> Result<()> {
+        let mut inodes = Vec::with_capacity(files.len());
+        for f in files {
+            let ino = self
+                .sb
+                .ino_from_path(f.as_path())
+                .map_err(|e| enoent!(format!("failed to prefetch {}, {}", f.display(), e)))?;
+            inodes.push(ino);
+        }
+
+        let sb = self.sb.clone();
+        let device = self.device.clone();
+        let id = self.id.clone();
+        let merging_size = self.merging_size;
+        std::thread::Builder::new()
+            .name("rafs-prefetch".to_string())
+            .spawn(move || {
+                let result = sb.walk_files_chunks(&inodes, &|desc| {
+                    if desc.bi_vec.is_empty() {
+                        return;
+                    }
+                    if let Err(e) = device.fetch(desc, merging_size) {
+                        warn!("{}: failed to prefetch data: {}", id, e);
+                    }
+                });
+                match result {
+                    Ok(_) => info!("{}: prefetched {} files on demand", id, inodes.len()),
+                    Err(e) => warn!("{}: failed to walk chunks to prefetch: {}", id, e),
+                }
+            })
+            .map(|_| ())
+    }
+
     /// for blobfs
     pub fn fetch_range_synchronous(&self, prefetches: &[BlobPrefetchRequest]) -> Result<()> {
         self.device.fetch_range_synchronous(prefetches)
@@ -647,7 +924,7 @@ impl FileSystem for Rafs {
     #[allow(clippy::too_many_arguments)]
     fn read(
         &self,
-        _ctx: &Context,
+        ctx: &Context,
         ino: u64,
         _handle: u64,
         w: &mut dyn ZeroCopyWriter,
@@ -674,23 +951,22 @@ impl FileSystem for Rafs {
         let mut descs = inode.alloc_bio_vecs(offset, real_size as usize, true)?;
         debug_assert!(!descs.is_empty() && !descs[0].bi_vec.is_empty());
 
+        let amplify_io = match self.read_ahead.as_ref() {
+            Some(tracker) => tracker.window(ino, offset, size),
+            None => self.amplify_io,
+        };
         // Try to amplify user io for Rafs v5, to improve performance.
-        if self.sb.meta.is_v5() && size < self.amplify_io {
+        if self.sb.meta.is_v5() && size < amplify_io {
             let all_chunks_ready = self.device.is_all_chunk_ready(&descs);
             if !all_chunks_ready {
                 let chunk_size = self.metadata().chunk_size as u64;
                 let next_chunk_base = (offset + (size as u64) + chunk_size) & !chunk_size;
                 let window_base = std::cmp::min(next_chunk_base, inode_size);
                 let actual_size = window_base - (offset & !chunk_size);
-                if actual_size < self.amplify_io as u64 {
-                    let window_size = self.amplify_io as u64 - actual_size;
-                    self.sb.amplify_io(
-                        self.amplify_io,
-                        &mut descs,
-                        &inode,
-                        window_base,
-                        window_size,
-                    )?;
+                if actual_size < amplify_io as u64 {
+                    let window_size = amplify_io as u64 - actual_size;
+                    self.sb
+                        .amplify_io(amplify_io, &mut descs, &inode, window_base, window_size)?;
                 }
             }
         }
@@ -711,6 +987,16 @@ impl FileSystem for Rafs {
         }
         self.ios.latency_end(&start, Read);
 
+        if let Some(audit) = self.audit.as_ref() {
+            if result > 0 && audit.sample() {
+                if let Ok(path) = self.sb.path_from_ino(ino) {
+                    // The amplified data isn't read by the user.
+                    let size = cmp::min(result, real_size as usize);
+                    audit.record(ctx.uid, ctx.pid as u32, &path, offset, size);
+                }
+            }
+        }
+
         Ok(result)
     }
 
@@ -728,13 +1014,16 @@ impl FileSystem for Rafs {
     fn release(
         &self,
         _ctx: &Context,
-        _inode: u64,
+        inode: u64,
         _flags: u32,
         _handle: u64,
         _flush: bool,
         _flock_release: bool,
         _lock_owner: Option<u64>,
     ) -> Result<()> {
+        if let Some(tracker) = self.read_ahead.as_ref() {
+            tracker.forget(inode);
+        }
         Ok(())
     }
 
@@ -1043,6 +1332,35 @@ pub(crate) mod tests {
         }
     }
 
+    #[test]
+    fn test_read_ahead_tracker() {
+        let tracker = ReadAheadTracker::new(0x20000, 0x80000);
+
+        // Sequential reads grow the window up to the max.
+        assert_eq!(tracker.window(1, 0, 0x1000), 0x20000);
+        assert_eq!(tracker.window(1, 0x1000, 0x1000), 0x40000);
+        assert_eq!(tracker.window(1, 0x2000, 0x1000), 0x80000);
+        assert_eq!(tracker.window(1, 0x3000, 0x1000), 0x80000);
+        // A reordered read of the scan is still sequential.
+        assert_eq!(tracker.window(1, 0x2000, 0x1000), 0x80000);
+
+        // Random reads shrink the window until it's disabled.
+        assert_eq!(tracker.window(1, 0x100000, 0x1000), 0x40000);
+        assert_eq!(tracker.window(1, 0x10000, 0x1000), 0x20000);
+        for _ in 0..5 {
+            tracker.window(1, 0x10000, 0x1000);
+            tracker.window(1, 0x200000, 0x1000);
+        }
+        assert_eq!(tracker.window(1, 0x10000, 0x1000), 0);
+        // And a sequential read enables it again.
+        assert_eq!(tracker.window(1, 0x11000, 0x1000), 0x20000);
+
+        // Other files are not affected.
+        assert_eq!(tracker.window(2, 0x100000, 0x1000), 0x20000);
+        tracker.forget(1);
+        assert_eq!(tracker.window(1, 0x200000, 0x1000), 0x20000);
+    }
+
     #[test]
     fn test_fsprefetchcontrol_from_rafs_config() {
         let mut config = RafsConfig {
@@ -1052,6 +1370,8 @@ pub(crate) mod tests {
                 merging_size: 0,
                 bandwidth_rate: 0,
                 prefetch_all: false,
+                throttle_latency_ms: 0,
+                throttle_idle_ms: 0,
             },
             ..Default::default()
         };
@@ -44,6 +44,7 @@ use std::io::{BufWriter, Error, Read, Result, Seek, SeekFrom, Write};
 use std::os::unix::io::AsRawFd;
 use std::path::Path;
 
+pub mod audit;
 pub mod fs;
 pub mod metadata;
 #[cfg(test)]
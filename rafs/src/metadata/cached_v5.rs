@@ -367,7 +367,8 @@ impl RafsInode for CachedInodeV5 {
         }
         if self.is_reg() {
             let chunks = (self.i_size + chunk_size - 1) / chunk_size;
-            if !self.has_hole() && chunks != self.i_data.len() as u64 {
+            if !self.has_hole() && !self.has_variable_chunks() && chunks != self.i_data.len() as u64
+            {
                 return Err(einval!("invalid chunk count"));
             }
         } else if self.is_dir() {
@@ -643,6 +644,10 @@ impl RafsV5InodeOps for CachedInodeV5 {
         self.i_flags.contains(RafsV5InodeFlags::HAS_HOLE)
     }
 
+    fn has_variable_chunks(&self) -> bool {
+        self.i_flags.contains(RafsV5InodeFlags::VARIABLE_CHUNKS)
+    }
+
     fn cast_ondisk(&self) -> Result<RafsV5Inode> {
         let i_symlink_size = if self.is_symlink() {
             self.get_symlink()?.byte_size() as u16
@@ -785,7 +790,8 @@ mod cached_tests {
 
     use crate::metadata::cached_v5::{CachedInodeV5, CachedSuperBlockV5};
     use crate::metadata::layout::v5::{
-        rafsv5_align, RafsV5BlobTable, RafsV5ChunkInfo, RafsV5Inode, RafsV5InodeWrapper,
+        rafsv5_align, RafsV5BlobTable, RafsV5ChunkInfo, RafsV5Inode, RafsV5InodeFlags,
+        RafsV5InodeWrapper,
     };
     use crate::metadata::layout::{RafsXAttrs, RAFS_ROOT_INODE};
     use crate::metadata::{RafsInode, RafsStore, RafsSuperMeta};
@@ -989,6 +995,89 @@ mod cached_tests {
         std::fs::remove_file("/tmp/buf_3").unwrap();
     }
 
+    #[test]
+    fn test_alloc_bio_desc_variable_chunks() {
+        let mut f = OpenOptions::new()
+            .truncate(true)
+            .create(true)
+            .write(true)
+            .read(true)
+            .open("/tmp/buf_4")
+            .unwrap();
+        let mut writer = BufWriter::new(f.try_clone().unwrap());
+        let mut reader = Box::new(f.try_clone().unwrap()) as RafsIoReader;
+        let file_name = OsString::from("c_inode_4");
+        let chunk_sizes = [0x3000u32, 0x1800, 0x2800];
+        let mut ondisk_inode = RafsV5Inode::new();
+        ondisk_inode.i_name_size = rafsv5_align(file_name.len()) as u16;
+        ondisk_inode.i_ino = 4;
+        ondisk_inode.i_parent = 0;
+        ondisk_inode.i_nlink = 1;
+        ondisk_inode.i_child_count = chunk_sizes.len() as u32;
+        ondisk_inode.i_mode = libc::S_IFREG;
+        ondisk_inode.i_size = chunk_sizes.iter().sum::<u32>() as u64;
+        ondisk_inode.i_flags = RafsV5InodeFlags::VARIABLE_CHUNKS;
+
+        let inode = RafsV5InodeWrapper {
+            name: file_name.as_os_str(),
+            symlink: None,
+            inode: &ondisk_inode,
+        };
+        inode.store(&mut writer).unwrap();
+
+        let mut offset = 0u64;
+        for size in chunk_sizes.iter() {
+            let mut chunk = RafsV5ChunkInfo::new();
+            chunk.uncompress_size = *size;
+            chunk.uncompress_offset = offset;
+            chunk.compress_size = *size / 2;
+            chunk.compress_offset = offset / 2;
+            chunk.file_offset = offset;
+            chunk.store(&mut writer).unwrap();
+            offset += *size as u64;
+        }
+        f.seek(Start(0)).unwrap();
+        let mut meta = Arc::new(RafsSuperMeta::default());
+        Arc::get_mut(&mut meta).unwrap().chunk_size = 0x4000;
+        let mut blob_table = Arc::new(RafsV5BlobTable::new());
+        Arc::get_mut(&mut blob_table).unwrap().add(
+            String::from("123333"),
+            0,
+            0,
+            0,
+            0,
+            0,
+            0,
+            BlobFeatures::V5_NO_EXT_BLOB_TABLE,
+            meta.flags,
+        );
+        let mut cached_inode = CachedInodeV5::new(blob_table, meta.clone());
+        cached_inode.load(&meta, &mut reader).unwrap();
+        cached_inode.validate(100, 0x4000).unwrap();
+
+        let descs = cached_inode.alloc_bio_vecs(0x3800, 0x100, true).unwrap();
+        assert_eq!(descs[0].bi_size, 0x100);
+        assert_eq!(descs[0].bi_vec.len(), 1);
+        assert_eq!(descs[0].bi_vec[0].offset, 0x800);
+
+        let descs = cached_inode.alloc_bio_vecs(0x2f00, 0x2000, true).unwrap();
+        assert_eq!(descs[0].bi_size, 0x2000);
+        assert_eq!(descs[0].bi_vec.len(), 3);
+        assert_eq!(descs[0].bi_vec[0].offset, 0x2f00);
+        assert_eq!(descs[0].bi_vec[0].size, 0x100);
+        assert_eq!(descs[0].bi_vec[1].size, 0x1800);
+        assert_eq!(descs[0].bi_vec[2].offset, 0);
+        assert_eq!(descs[0].bi_vec[2].size, 0x700);
+
+        assert!(cached_inode
+            .alloc_bio_vecs(0x7000, 0x100, true)
+            .unwrap()
+            .is_empty());
+
+        drop(f);
+        std::fs::remove_file("/tmp/buf_4").unwrap();
+    }
+
     #[test]
     fn test_rafsv5_superblock() {
         let md = RafsSuperMeta::default();
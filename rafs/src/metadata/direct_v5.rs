@@ -536,7 +536,10 @@ impl RafsInode for OndiskInodeWrapper {
 
         if inode.is_reg() {
             let chunks = (inode.i_size + chunk_size - 1) / chunk_size;
-            if !inode.has_hole() && chunks != inode.i_child_count as u64 {
+            if !inode.has_hole()
+                && !inode.has_variable_chunks()
+                && chunks != inode.i_child_count as u64
+            {
                 return Err(einval!(format!(
                     "invalid chunk count, ino {}, expected {}, actual {}",
                     inode.i_ino, chunks, inode.i_child_count,
@@ -869,6 +872,7 @@ impl RafsV5InodeOps for OndiskInodeWrapper {
     }
 
     impl_inode_wrapper!(has_hole, bool);
+    impl_inode_wrapper!(has_variable_chunks, bool);
 }
 
 pub struct DirectChunkInfoV5 {
@@ -57,7 +57,7 @@ use crate::{impl_bootstrap_converter, impl_pub_getter_setter, RafsIoReader, Rafs
 // compressed blob file. To avoid circular dependency, the following Rafs v5 metadata structures
 // have been moved into the storage manager.
 use storage::device::v5::BlobV5ChunkInfo;
-use storage::device::{BlobChunkFlags, BlobInfo};
+use storage::device::{validate_key_id, BlobChunkFlags, BlobInfo, CIPHER_KEY_ID_MAX_LEN};
 use vm_memory::VolatileMemory;
 
 pub(crate) const RAFSV5_ALIGNMENT: usize = 8;
@@ -66,7 +66,9 @@ pub(crate) const RAFSV5_EXT_BLOB_ENTRY_SIZE: usize = 64;
 
 const RAFSV5_SUPER_MAGIC: u32 = 0x5241_4653;
 const RAFSV5_SUPERBLOCK_RESERVED_SIZE: usize = RAFSV5_SUPERBLOCK_SIZE - 80;
-const RAFSV5_EXT_BLOB_RESERVED_SIZE: usize = RAFSV5_EXT_BLOB_ENTRY_SIZE - 24;
+const RAFSV5_EXT_BLOB_KEY_ID_SIZE: usize = CIPHER_KEY_ID_MAX_LEN;
+const RAFSV5_EXT_BLOB_RESERVED_SIZE: usize =
+    RAFSV5_EXT_BLOB_ENTRY_SIZE - 24 - RAFSV5_EXT_BLOB_KEY_ID_SIZE;
 
 /// Trait to get information about a Rafs v5 inode.
 pub(crate) trait RafsV5InodeOps {
@@ -79,6 +81,9 @@ pub(crate) trait RafsV5InodeOps {
     /// Check whether the inode has hole chunk.
     fn has_hole(&self) -> bool;
 
+    /// Check whether the chunks of the inode are cut by content with variable sizes.
+    fn has_variable_chunks(&self) -> bool;
+
     /// Convert to the on disk data format.
     fn cast_ondisk(&self) -> Result<RafsV5Inode>;
 }
@@ -113,6 +118,7 @@ impl From<RafsSuperFlags> for compress::Algorithm {
             x if x.contains(RafsSuperFlags::COMPRESS_NONE) => compress::Algorithm::None,
             x if x.contains(RafsSuperFlags::COMPRESS_LZ4_BLOCK) => compress::Algorithm::Lz4Block,
             x if x.contains(RafsSuperFlags::COMPRESS_GZIP) => compress::Algorithm::GZip,
+            x if x.contains(RafsSuperFlags::COMPRESS_ZSTD) => compress::Algorithm::Zstd,
             _ => compress::Algorithm::Lz4Block,
         }
     }
@@ -124,6 +130,7 @@ impl From<compress::Algorithm> for RafsSuperFlags {
             compress::Algorithm::None => RafsSuperFlags::COMPRESS_NONE,
             compress::Algorithm::Lz4Block => RafsSuperFlags::COMPRESS_LZ4_BLOCK,
             compress::Algorithm::GZip => RafsSuperFlags::COMPRESS_GZIP,
+            compress::Algorithm::Zstd => RafsSuperFlags::COMPRESS_ZSTD,
         }
     }
 }
@@ -266,6 +273,7 @@ impl RafsV5SuperBlock {
         self.s_flags &= !RafsSuperFlags::COMPRESS_NONE.bits();
         self.s_flags &= !RafsSuperFlags::COMPRESS_LZ4_BLOCK.bits();
         self.s_flags &= !RafsSuperFlags::COMPRESS_GZIP.bits();
+        self.s_flags &= !RafsSuperFlags::COMPRESS_ZSTD.bits();
         self.s_flags |= c.bits();
     }
 
@@ -288,6 +296,11 @@ impl RafsV5SuperBlock {
         self.s_flags |= RafsSuperFlags::HAS_XATTR.bits();
     }
 
+    /// Mark the filesystem as having chunks with variable sizes.
+    pub fn set_variable_chunk_size(&mut self) {
+        self.s_flags |= RafsSuperFlags::VARIABLE_CHUNK_SIZE.bits();
+    }
+
     impl_pub_getter_setter!(magic, set_magic, s_magic, u32);
     impl_pub_getter_setter!(version, set_version, s_fs_version, u32);
     impl_pub_getter_setter!(sb_size, set_sb_size, s_sb_size, u32);
@@ -683,6 +696,10 @@ impl RafsV5BlobTable {
                 } else {
                     (0, 0, 0, BlobFeatures::V5_NO_EXT_BLOB_TABLE)
                 };
+            let cipher_key_id = match self.extended.entries.get(index) {
+                Some(entry) => entry.cipher_key_id()?,
+                None => String::new(),
+            };
 
             let mut blob_info = BlobInfo::new(
                 index as u32,
@@ -697,6 +714,7 @@ impl RafsV5BlobTable {
             blob_info.set_compressor(flags.into());
             blob_info.set_digester(flags.into());
             blob_info.set_readahead(readahead_offset as u64, readahead_size as u64);
+            blob_info.set_cipher_key_id(&cipher_key_id);
 
             self.entries.push(Arc::new(blob_info));
         }
@@ -704,6 +722,22 @@ impl RafsV5BlobTable {
         Ok(())
     }
 
+    /// Set the ID of the key to decrypt chunks of blob `blob_index`.
+    pub fn set_cipher_key_id(&mut self, blob_index: u32, key_id: &str) -> Result<()> {
+        validate_key_id(key_id)?;
+        let index = blob_index as usize;
+        if index >= self.entries.len() || index >= self.extended.entries.len() {
+            return Err(enoent!("blob not found"));
+        }
+
+        Arc::make_mut(&mut self.entries[index]).set_cipher_key_id(key_id);
+        let entry = Arc::make_mut(&mut self.extended.entries[index]);
+        entry.cipher_key_id = [0u8; RAFSV5_EXT_BLOB_KEY_ID_SIZE];
+        entry.cipher_key_id[..key_id.len()].copy_from_slice(key_id.as_bytes());
+
+        Ok(())
+    }
+
     /// Get the base blob information array.
     pub fn get_all(&self) -> Vec<Arc<BlobInfo>> {
         self.entries.clone()
@@ -755,6 +789,8 @@ pub struct RafsV5ExtBlobEntry {
     pub reserved1: [u8; 4],     //   --  8 Bytes
     pub uncompressed_size: u64, // -- 16 Bytes
     pub compressed_size: u64,   // -- 24 Bytes
+    /// ID of the key to decrypt chunks, padded with '\0', all zero if not encrypted.
+    pub cipher_key_id: [u8; RAFSV5_EXT_BLOB_KEY_ID_SIZE], // -- 56 Bytes
     pub reserved2: [u8; RAFSV5_EXT_BLOB_RESERVED_SIZE],
 }
 
@@ -766,6 +802,7 @@ impl Debug for RafsV5ExtBlobEntry {
             .field("chunk_count", &self.chunk_count)
             .field("blob_cache_size", &self.uncompressed_size)
             .field("compressed_blob_size", &self.compressed_size)
+            .field("cipher_key_id", &self.cipher_key_id().unwrap_or_default())
             .finish()
     }
 }
@@ -777,6 +814,7 @@ impl Default for RafsV5ExtBlobEntry {
             reserved1: [0; 4],
             uncompressed_size: 0,
             compressed_size: 0,
+            cipher_key_id: [0; RAFSV5_EXT_BLOB_KEY_ID_SIZE],
             reserved2: [0; RAFSV5_EXT_BLOB_RESERVED_SIZE],
         }
     }
@@ -791,6 +829,18 @@ impl RafsV5ExtBlobEntry {
             ..Default::default()
         }
     }
+
+    /// Get the ID of the key to decrypt chunks, empty if the blob isn't encrypted.
+    pub fn cipher_key_id(&self) -> Result<String> {
+        let len = self
+            .cipher_key_id
+            .iter()
+            .position(|c| *c == 0)
+            .unwrap_or(RAFSV5_EXT_BLOB_KEY_ID_SIZE);
+        std::str::from_utf8(&self.cipher_key_id[..len])
+            .map(|v| v.to_owned())
+            .map_err(|e| einval!(e))
+    }
 }
 
 /// Rafs v5 on disk extended blob information table.
@@ -870,6 +920,7 @@ impl RafsStore for RafsV5ExtBlobTable {
                 w.write_all(&entry.reserved1)?;
                 w.write_all(&u64::to_le_bytes(entry.uncompressed_size))?;
                 w.write_all(&u64::to_le_bytes(entry.compressed_size))?;
+                w.write_all(&entry.cipher_key_id)?;
                 w.write_all(&entry.reserved2)?;
                 size += RAFSV5_EXT_BLOB_ENTRY_SIZE;
                 Ok(())
@@ -895,6 +946,8 @@ bitflags! {
         const XATTR = 0x0000_0004;
         /// Inode chunks has holes.
         const HAS_HOLE = 0x0000_0008;
+        /// Inode chunks are cut by content with variable sizes.
+        const VARIABLE_CHUNKS = 0x0000_0010;
    }
 }
 
@@ -1019,6 +1072,12 @@ impl RafsV5Inode {
         self.i_flags.contains(RafsV5InodeFlags::HAS_HOLE)
     }
 
+    /// Check whether the inode chunks are cut by content with variable sizes.
+    #[inline]
+    pub fn has_variable_chunks(&self) -> bool {
+        self.i_flags.contains(RafsV5InodeFlags::VARIABLE_CHUNKS)
+    }
+
     /// Load an inode from a reader.
     pub fn load(&mut self, r: &mut RafsIoReader) -> Result<()> {
         r.read_exact(self.as_mut())
@@ -1220,13 +1279,24 @@ pub(crate) fn rafsv5_alloc_bio_vecs<I: RafsInode + RafsV5InodeChunkOps + RafsV5I
     let end = offset
         .checked_add(size as u64)
         .ok_or_else(|| einval!("invalid read size"))?;
-    let (index_start, index_end) = calculate_bio_chunk_index(
-        offset,
-        end,
-        inode.get_chunk_size() as u64,
-        inode.get_child_count(),
-        inode.has_hole(),
-    );
+    if size == 0 {
+        return Ok(vec![]);
+    }
+    // Chunks of files with holes or cut by content aren't located by the chunk size.
+    let variable = inode.has_hole() || inode.has_variable_chunks();
+    let (index_start, index_end) = if variable {
+        (
+            search_bio_chunk_index(inode, offset)?,
+            inode.get_chunk_count(),
+        )
+    } else {
+        calculate_bio_chunk_index(
+            offset,
+            end,
+            inode.get_chunk_size() as u64,
+            inode.get_child_count(),
+        )
+    };
     trace!(
         "alloc bio desc offset {} size {} i_size {} index_start {} index_end {} i_child_count {}",
         offset,
@@ -1236,21 +1306,19 @@ pub(crate) fn rafsv5_alloc_bio_vecs<I: RafsInode + RafsV5InodeChunkOps + RafsV5I
         index_end,
         inode.get_child_count()
     );
-    if size == 0 || index_start >= inode.get_chunk_count() {
+    if index_start >= inode.get_chunk_count() {
         return Ok(vec![]);
     }
 
     let mut descs = Vec::with_capacity(4);
     let mut desc = BlobIoVec::new();
-    let chunk = inode.get_chunk_info_v5(index_start)?;
-    let blob = inode.get_blob_by_index(chunk.blob_index())?;
-    if !add_chunk_to_bio_desc(&mut desc, offset, end, chunk, blob, user_io) {
-        return Err(einval!("failed to create blob io vector"));
-    }
-    for idx in index_start + 1..index_end {
+    for idx in index_start..index_end {
         let chunk = inode.get_chunk_info_v5(idx)?;
+        if variable && chunk.file_offset() >= end {
+            break;
+        }
         let blob = inode.get_blob_by_index(chunk.blob_index())?;
-        if blob.blob_index() != desc.bi_vec[0].blob.blob_index() {
+        if !desc.bi_vec.is_empty() && blob.blob_index() != desc.bi_vec[0].blob.blob_index() {
             descs.push(desc);
             desc = BlobIoVec::new();
         }
@@ -1258,11 +1326,32 @@ pub(crate) fn rafsv5_alloc_bio_vecs<I: RafsInode + RafsV5InodeChunkOps + RafsV5I
             return Err(einval!("failed to create blob io vector"));
         }
     }
-    descs.push(desc);
+    if !desc.bi_vec.is_empty() {
+        descs.push(desc);
+    }
 
     Ok(descs)
 }
 
+/// Search the index of the first chunk ending after `offset`, the chunks are sorted by file offset.
+fn search_bio_chunk_index<I: RafsV5InodeChunkOps + RafsV5InodeOps + RafsInode>(
+    inode: &I,
+    offset: u64,
+) -> Result<u32> {
+    let (mut start, mut end) = (0, inode.get_chunk_count());
+    while start < end {
+        let mid = start + (end - start) / 2;
+        let chunk = inode.get_chunk_info_v5(mid)?;
+        if chunk.file_offset() + chunk.uncompress_size() as u64 <= offset {
+            start = mid + 1;
+        } else {
+            end = mid;
+        }
+    }
+
+    Ok(start)
+}
+
 /// Add a new bio covering the IO range into the provided bio desc.
 ///
 /// Returns true if caller should continue checking more chunks.
@@ -1322,26 +1411,11 @@ fn add_chunk_to_bio_desc(
 /// - end: IO end to the file start, exclusive.
 /// - chunk_size: chunk size.
 /// - chunk_cnt: maximum number of chunks
-/// - has_hole: whether a file has holes in it.
-fn calculate_bio_chunk_index(
-    offset: u64,
-    end: u64,
-    chunk_size: u64,
-    chunk_cnt: u32,
-    has_hole: bool,
-) -> (u32, u32) {
+fn calculate_bio_chunk_index(offset: u64, end: u64, chunk_size: u64, chunk_cnt: u32) -> (u32, u32) {
     debug_assert!(offset < end);
 
-    let index_start = if !has_hole {
-        (offset / chunk_size) as u32
-    } else {
-        0
-    };
-    let index_end = if !has_hole {
-        cmp::min(((end - 1) / chunk_size) as u32 + 1, chunk_cnt)
-    } else {
-        chunk_cnt
-    };
+    let index_start = (offset / chunk_size) as u32;
+    let index_end = cmp::min(((end - 1) / chunk_size) as u32 + 1, chunk_cnt);
 
     (index_start, index_end)
 }
@@ -1528,6 +1602,8 @@ pub mod tests {
         for i in 0..5 {
             table.add(i * 3, 100, 100);
         }
+        let entry = Arc::make_mut(&mut table.entries[1]);
+        entry.cipher_key_id[..6].copy_from_slice(b"key-v1");
 
         // Store extended blob table
         let file = OpenOptions::new()
@@ -1553,6 +1629,8 @@ pub mod tests {
         assert!(table.get(0).is_some());
         assert!(table.get(4).is_some());
         assert!(table.get(5).is_none());
+        assert_eq!(table.get(0).unwrap().cipher_key_id().unwrap(), "");
+        assert_eq!(table.get(1).unwrap().cipher_key_id().unwrap(), "key-v1");
 
         // Check expected blob table
         for i in 0..5 {
@@ -1715,7 +1793,6 @@ pub mod tests {
                 *io_start + *io_size,
                 blksize,
                 chunk_cnt as u32,
-                false,
             );
 
             assert_eq!(start, *expected_start);
@@ -1755,6 +1832,10 @@ pub mod tests {
             RafsSuperFlags::from(compress::Algorithm::GZip),
             RafsSuperFlags::COMPRESS_GZIP
         );
+        assert_eq!(
+            RafsSuperFlags::from(compress::Algorithm::Zstd),
+            RafsSuperFlags::COMPRESS_ZSTD
+        );
         assert_eq!(
             RafsSuperFlags::from(compress::Algorithm::Lz4Block),
             RafsSuperFlags::COMPRESS_LZ4_BLOCK
@@ -1767,6 +1848,10 @@ pub mod tests {
             compress::Algorithm::from(RafsSuperFlags::COMPRESS_GZIP),
             compress::Algorithm::GZip
         );
+        assert_eq!(
+            compress::Algorithm::from(RafsSuperFlags::COMPRESS_ZSTD),
+            compress::Algorithm::Zstd
+        );
         assert_eq!(
             compress::Algorithm::from(RafsSuperFlags::COMPRESS_LZ4_BLOCK),
             compress::Algorithm::Lz4Block
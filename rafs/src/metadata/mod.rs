@@ -238,6 +238,10 @@ bitflags! {
         const HAS_XATTR = 0x0000_0020;
         // V5: Data chunks are compressed with gzip
         const COMPRESS_GZIP = 0x0000_0040;
+        // V5: Data chunks are compressed with zstd
+        const COMPRESS_ZSTD = 0x0000_0080;
+        /// V5: Data chunks of some files are cut by content, with variable sizes.
+        const VARIABLE_CHUNK_SIZE = 0x0000_0100;
     }
 }
 
@@ -622,6 +626,48 @@ impl RafsSuper {
         }
     }
 
+    /// Walk the data chunks of all files, the chunks are batched into blob io vectors by blob.
+    pub fn walk_chunks(&self, walker: &dyn Fn(&mut BlobIoVec)) -> Result<()> {
+        let mut hardlinks: HashSet<u64> = HashSet::new();
+        let mut head_desc = BlobIoVec {
+            bi_size: 0,
+            bi_flags: 0,
+            bi_vec: Vec::new(),
+        };
+
+        self.prefetch_data(
+            self.superblock.root_ino(),
+            &mut head_desc,
+            &mut hardlinks,
+            walker,
+        )?;
+        walker(&mut head_desc);
+
+        Ok(())
+    }
+
+    /// Walk the data chunks of the files and directories `inodes`, the chunks are batched into
+    /// blob io vectors by blob.
+    pub fn walk_files_chunks(
+        &self,
+        inodes: &[Inode],
+        walker: &dyn Fn(&mut BlobIoVec),
+    ) -> Result<()> {
+        let mut hardlinks: HashSet<u64> = HashSet::new();
+        let mut head_desc = BlobIoVec {
+            bi_size: 0,
+            bi_flags: 0,
+            bi_vec: Vec::new(),
+        };
+
+        for ino in inodes {
+            self.prefetch_data(*ino, &mut head_desc, &mut hardlinks, walker)?;
+        }
+        walker(&mut head_desc);
+
+        Ok(())
+    }
+
     #[inline]
     fn prefetch_inode<F>(
         inode: &Arc<dyn RafsInode>,
@@ -270,6 +270,10 @@ impl RafsV5InodeOps for MockInode {
         false
     }
 
+    fn has_variable_chunks(&self) -> bool {
+        false
+    }
+
     fn cast_ondisk(&self) -> Result<RafsV5Inode> {
         unimplemented!()
     }
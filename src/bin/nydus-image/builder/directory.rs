@@ -131,7 +131,8 @@ impl Builder for DirectoryBuilder {
         let mut blob_ctx = BlobContext::new(ctx.blob_id.clone(), ctx.blob_storage.clone())?;
         blob_ctx.set_chunk_dict(blob_mgr.get_chunk_dict());
         blob_ctx.set_chunk_size(ctx.chunk_size);
-        blob_ctx.set_meta_info_enabled(true);
+        // Blob metadata can't describe encrypted chunks, whose size is changed by encryption.
+        blob_ctx.set_meta_info_enabled(ctx.cipher.is_none());
         blob_mgr.extend_blob_table_from_chunk_dict()?;
 
         let blob_index = blob_mgr.alloc_index()?;
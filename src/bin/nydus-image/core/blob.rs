@@ -32,6 +32,9 @@ impl Blob {
     ) -> Result<bool> {
         match ctx.source_type {
             SourceType::Directory | SourceType::Diff => {
+                if let Some(cipher) = ctx.cipher.as_ref() {
+                    blob_ctx.cipher_key_id = cipher.key_id().to_owned();
+                }
                 let (inodes, prefetch_entries) = blob_ctx
                     .blob_layout
                     .layout_blob_simple(&ctx.prefetch, nodes)?;
@@ -425,6 +425,7 @@ impl Bootstrap {
             + extended_blob_table_size) as u32;
 
         let mut has_xattr = false;
+        let mut has_variable_chunks = false;
         for node in &mut bootstrap_ctx.nodes {
             inode_table.set(node.index, inode_offset)?;
             // Add inode size
@@ -439,11 +440,15 @@ impl Bootstrap {
             // Add chunks size
             if node.is_reg() {
                 inode_offset += node.inode.child_count() * size_of::<RafsV5ChunkInfo>() as u32;
+                has_variable_chunks |= node.inode.has_variable_chunks();
             }
         }
         if has_xattr {
             super_block.set_has_xattr();
         }
+        if has_variable_chunks {
+            super_block.set_variable_chunk_size();
+        }
 
         let mut bootstrap_writer = bootstrap_ctx.create_writer()?;
 
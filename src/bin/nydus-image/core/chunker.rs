@@ -0,0 +1,180 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Content defined chunking of file data, in the way of FastCDC.
+//!
+//! Cut points are found by a gear hash rolling over the data, so that inserting or removing a few
+//! bytes only changes the chunks around the edit, and the other chunks of a new version of the
+//! file are deduplicated. The chunk size is normally distributed around the average size by
+//! using a harder mask before the average size and an easier one after it.
+
+use anyhow::{bail, Result};
+use rafs::metadata::RAFS_MAX_CHUNK_SIZE;
+
+// Pseudo random values of the gear hash, generated by splitmix64 so the cut points are stable.
+const GEAR: [u64; 256] = gear_table();
+
+const fn gear_table() -> [u64; 256] {
+    let mut table = [0u64; 256];
+    let mut seed: u64 = 0x6e79_6475_735f_6364;
+    let mut i = 0;
+    while i < 256 {
+        seed = seed.wrapping_add(0x9e37_79b9_7f4a_7c15);
+        let mut z = seed;
+        z = (z ^ (z >> 30)).wrapping_mul(0xbf58_476d_1ce4_e5b9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94d0_49bb_1331_11eb);
+        table[i] = z ^ (z >> 31);
+        i += 1;
+    }
+    table
+}
+
+// Mask of the highest `bits` bits, the high bits of the gear hash depend on the last 64 bytes.
+fn high_bits_mask(bits: u32) -> u64 {
+    !0u64 << (64 - bits)
+}
+
+/// Content defined chunker with minimal, average and maximal chunk sizes.
+#[derive(Clone, Copy, Debug)]
+pub struct Chunker {
+    min_size: u32,
+    avg_size: u32,
+    max_size: u32,
+    mask_small: u64,
+    mask_large: u64,
+}
+
+impl Chunker {
+    /// Create a chunker, the average size must be a power of two.
+    pub fn new(min_size: u32, avg_size: u32, max_size: u32) -> Result<Self> {
+        if min_size < 0x1000
+            || !avg_size.is_power_of_two()
+            || min_size >= avg_size
+            || avg_size >= max_size
+            || max_size as u64 > RAFS_MAX_CHUNK_SIZE
+        {
+            bail!(
+                "invalid chunk sizes of content defined chunking, min {:#x} avg {:#x} max {:#x}",
+                min_size,
+                avg_size,
+                max_size
+            );
+        }
+        let bits = avg_size.trailing_zeros();
+
+        Ok(Chunker {
+            min_size,
+            avg_size,
+            max_size,
+            mask_small: high_bits_mask(bits + 2),
+            mask_large: high_bits_mask(bits - 2),
+        })
+    }
+
+    /// Get the maximal chunk size.
+    pub fn max_size(&self) -> u32 {
+        self.max_size
+    }
+
+    /// Get the size of the first chunk of `data`.
+    ///
+    /// `data` holds the rest of the file, or at least `max_size` bytes of it.
+    pub fn cut(&self, data: &[u8]) -> usize {
+        let min_size = self.min_size as usize;
+        if data.len() <= min_size {
+            return data.len();
+        }
+        let end = std::cmp::min(data.len(), self.max_size as usize);
+        let normal = std::cmp::min(end, self.avg_size as usize);
+
+        let mut hash = 0u64;
+        let mut i = min_size;
+        while i < normal {
+            hash = (hash << 1).wrapping_add(GEAR[data[i] as usize]);
+            if hash & self.mask_small == 0 {
+                return i + 1;
+            }
+            i += 1;
+        }
+        while i < end {
+            hash = (hash << 1).wrapping_add(GEAR[data[i] as usize]);
+            if hash & self.mask_large == 0 {
+                return i + 1;
+            }
+            i += 1;
+        }
+
+        end
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn random_data(size: usize) -> Vec<u8> {
+        let mut seed = 1u64;
+        (0..size)
+            .map(|_| {
+                seed = seed
+                    .wrapping_mul(6364136223846793005)
+                    .wrapping_add(1442695040888963407);
+                (seed >> 56) as u8
+            })
+            .collect()
+    }
+
+    fn split(chunker: &Chunker, data: &[u8]) -> Vec<usize> {
+        let mut sizes = Vec::new();
+        let mut offset = 0;
+        while offset < data.len() {
+            let size = chunker.cut(&data[offset..]);
+            sizes.push(size);
+            offset += size;
+        }
+        sizes
+    }
+
+    #[test]
+    fn test_chunker_new() {
+        assert!(Chunker::new(0x1000, 0x4000, 0x10000).is_ok());
+        assert!(Chunker::new(0x100, 0x4000, 0x10000).is_err());
+        assert!(Chunker::new(0x1000, 0x5000, 0x10000).is_err());
+        assert!(Chunker::new(0x4000, 0x4000, 0x10000).is_err());
+        assert!(Chunker::new(0x1000, 0x4000, 0x4000).is_err());
+        assert!(Chunker::new(0x1000, 0x4000, 0x200000).is_err());
+    }
+
+    #[test]
+    fn test_chunker_cut() {
+        let chunker = Chunker::new(0x1000, 0x4000, 0x10000).unwrap();
+        let data = random_data(0x100000);
+        let sizes = split(&chunker, &data);
+        assert_eq!(sizes.iter().sum::<usize>(), data.len());
+        for size in &sizes[..sizes.len() - 1] {
+            assert!(*size > 0x1000 && *size <= 0x10000);
+        }
+        assert_eq!(chunker.cut(&data[..0x800]), 0x800);
+        assert_eq!(chunker.cut(&[0u8; 0x20000]), 0x10000);
+    }
+
+    #[test]
+    fn test_chunker_shift() {
+        let chunker = Chunker::new(0x1000, 0x4000, 0x10000).unwrap();
+        let data = random_data(0x100000);
+        let mut shifted = vec![0xa5u8; 7];
+        shifted.extend_from_slice(&data);
+
+        // Only the chunks around the inserted bytes are changed.
+        let sizes = split(&chunker, &data);
+        let shifted_sizes = split(&chunker, &shifted);
+        let common = sizes
+            .iter()
+            .rev()
+            .zip(shifted_sizes.iter().rev())
+            .take_while(|(a, b)| a == b)
+            .count();
+        assert!(common >= sizes.len() - 2);
+    }
+}
@@ -28,11 +28,13 @@ use rafs::metadata::RafsSuperFlags;
 use rafs::metadata::{Inode, RAFS_DEFAULT_CHUNK_SIZE, RAFS_MAX_CHUNK_SIZE};
 use rafs::{RafsIoReader, RafsIoWrite};
 use storage::compress;
+use storage::crypt::BlobCipher;
 use storage::device::BlobFeatures;
 use storage::device::BlobInfo;
 use storage::meta::{BlobChunkInfoOndisk, BlobMetaHeaderOndisk};
 
 use super::chunk_dict::{ChunkDict, HashChunkDict};
+use super::chunker::Chunker;
 use super::layout::BlobLayout;
 use super::node::{ChunkWrapper, Node, WhiteoutSpec};
 use super::prefetch::{Prefetch, PrefetchPolicy};
@@ -248,6 +250,8 @@ pub struct BlobContext {
     pub chunk_count: u32,
     /// Chunk slice size.
     pub chunk_size: u32,
+    /// ID of the key to encrypt chunks, empty if the blob isn't encrypted.
+    pub cipher_key_id: String,
     /// Scratch data buffer for reading from/writing to disk files.
     pub chunk_data_buf: Vec<u8>,
     /// ChunkDict which would be loaded when builder start
@@ -292,6 +296,7 @@ impl BlobContext {
 
             chunk_count: 0,
             chunk_size: RAFS_DEFAULT_CHUNK_SIZE as u32,
+            cipher_key_id: String::new(),
             chunk_data_buf: vec![0u8; size],
             chunk_dict: Arc::new(()),
 
@@ -377,6 +382,7 @@ impl From<&BlobInfo> for BlobContext {
         ctx.chunk_count = blob.chunk_count();
         ctx.decompressed_blob_size = blob.uncompressed_size();
         ctx.compressed_blob_size = blob.compressed_size();
+        ctx.cipher_key_id = blob.cipher_key_id().to_owned();
 
         ctx
     }
@@ -517,7 +523,7 @@ impl BlobManager {
                     }
                     RafsVersion::V6 => todo!(),
                 }
-                blob_table.add(
+                let blob_index = blob_table.add(
                     blob_id,
                     0,
                     blob_readahead_size,
@@ -528,6 +534,9 @@ impl BlobManager {
                     blob_features,
                     flags,
                 );
+                if !ctx.cipher_key_id.is_empty() {
+                    blob_table.set_cipher_key_id(blob_index, &ctx.cipher_key_id)?;
+                }
             }
             if idx == up_idx {
                 break;
@@ -683,6 +692,12 @@ pub struct BuildContext {
     pub aligned_chunk: bool,
     /// Blob chunk compress flag.
     pub compressor: compress::Algorithm,
+    /// Compression level, only used by zstd and 0 means the default level.
+    pub compress_level: i32,
+    /// Skip compressing the files whose content is already compressed.
+    pub compress_auto: bool,
+    /// Cipher to encrypt chunks of the blob, only for Rafs v5.
+    pub cipher: Option<Arc<BlobCipher>>,
     /// Inode and chunk digest algorithm flag.
     pub digester: digest::Algorithm,
     /// Save host uid gid in each inode.
@@ -691,6 +706,8 @@ pub struct BuildContext {
     pub whiteout_spec: WhiteoutSpec,
     /// Chunk slice size.
     pub chunk_size: u32,
+    /// Cut chunks of files by content instead of by `chunk_size`, only for Rafs v5.
+    pub chunker: Option<Chunker>,
     /// Version number of output metadata and data blob.
     pub fs_version: RafsVersion,
 
@@ -728,11 +745,15 @@ impl BuildContext {
             blob_id,
             aligned_chunk,
             compressor,
+            compress_level: 0,
+            compress_auto: false,
+            cipher: None,
             digester,
             explicit_uidgid,
             whiteout_spec,
 
             chunk_size: RAFS_DEFAULT_CHUNK_SIZE as u32,
+            chunker: None,
             fs_version: RafsVersion::default(),
 
             source_type,
@@ -751,6 +772,22 @@ impl BuildContext {
     pub fn set_chunk_size(&mut self, chunk_size: u32) {
         self.chunk_size = chunk_size;
     }
+
+    pub fn set_compress_level(&mut self, compress_level: i32) {
+        self.compress_level = compress_level;
+    }
+
+    pub fn set_compress_auto(&mut self, compress_auto: bool) {
+        self.compress_auto = compress_auto;
+    }
+
+    pub fn set_cipher(&mut self, cipher: Option<Arc<BlobCipher>>) {
+        self.cipher = cipher;
+    }
+
+    pub fn set_chunker(&mut self, chunker: Option<Chunker>) {
+        self.chunker = chunker;
+    }
 }
 
 #[derive(Serialize, Default, Debug, Clone)]
@@ -5,6 +5,7 @@
 pub(crate) mod blob;
 pub(crate) mod bootstrap;
 pub(crate) mod chunk_dict;
+pub(crate) mod chunker;
 pub(crate) mod context;
 pub(crate) mod layout;
 pub(crate) mod node;
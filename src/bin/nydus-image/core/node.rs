@@ -5,6 +5,8 @@
 
 //! An in-memory RAFS inode for image building and inspection.
 
+use std::borrow::Cow;
+use std::cmp;
 use std::ffi::{OsStr, OsString};
 use std::fmt::{self, Display, Formatter};
 use std::fs::{self, File};
@@ -298,24 +300,47 @@ impl Node {
             .with_context(|| format!("failed to open node file {:?}", self.path))?;
         let mut inode_hasher = RafsDigest::hasher(ctx.digester);
         let mut blob_size = 0u64;
-
-        // `child_count` of regular file is reused as `chunk_count`.
-        for i in 0..self.inode.child_count() {
-            let chunk_size = blob_ctx.chunk_size;
-            let file_offset = i as u64 * chunk_size as u64;
-            let chunk_size = if i == self.inode.child_count() - 1 {
-                (self.inode.size() as u64)
-                    .checked_sub((chunk_size * i) as u64)
-                    .ok_or_else(|| {
-                        anyhow!("the rest chunk size of inode is bigger than chunk_size")
-                    })? as u32
-            } else {
-                chunk_size
+        let mut compressor = ctx.compressor;
+
+        let size = self.inode.size();
+        // Data of the file not cut into chunks yet, to find the cut points by content.
+        let mut window = Vec::new();
+        let mut next_offset = 0u64;
+        while next_offset < size {
+            let chunk_size = match ctx.chunker.as_ref() {
+                Some(chunker) => {
+                    let filled = window.len();
+                    window.resize(
+                        cmp::min(chunker.max_size() as u64, size - next_offset) as usize,
+                        0,
+                    );
+                    file.read_exact(&mut window[filled..])
+                        .with_context(|| format!("failed to read node file {:?}", self.path))?;
+                    let chunk_size = chunker.cut(&window);
+                    blob_ctx.chunk_data_buf[..chunk_size].copy_from_slice(&window[..chunk_size]);
+                    window.drain(..chunk_size);
+                    chunk_size as u32
+                }
+                None => {
+                    let chunk_size =
+                        cmp::min(blob_ctx.chunk_size as u64, size - next_offset) as u32;
+                    file.read_exact(&mut blob_ctx.chunk_data_buf[..chunk_size as usize])
+                        .with_context(|| format!("failed to read node file {:?}", self.path))?;
+                    chunk_size
+                }
             };
-
-            let mut chunk_data = &mut blob_ctx.chunk_data_buf[0..chunk_size as usize];
-            file.read_exact(&mut chunk_data)
-                .with_context(|| format!("failed to read node file {:?}", self.path))?;
+            let file_offset = next_offset;
+            next_offset += chunk_size as u64;
+
+            let chunk_data = &blob_ctx.chunk_data_buf[0..chunk_size as usize];
+            if file_offset == 0
+                && ctx.compress_auto
+                && compressor != compress::Algorithm::None
+                && is_compressed_content(&self.path, chunk_data)
+            {
+                trace!("\t\tskip compressing node file {:?}", self.path);
+                compressor = compress::Algorithm::None;
+            }
 
             // TODO: check for hole chunks. One possible way is to always save
             // a global hole chunk and check for digest duplication
@@ -360,8 +385,19 @@ impl Node {
             }
 
             // Compress chunk data
-            let (compressed, is_compressed) = compress::compress(&chunk_data, ctx.compressor)
-                .with_context(|| format!("failed to compress node file {:?}", self.path))?;
+            let (compressed, is_compressed) =
+                compress::compress_with_level(&chunk_data, compressor, ctx.compress_level)
+                    .with_context(|| format!("failed to compress node file {:?}", self.path))?;
+            // Encrypt chunk data with the chunk digest as additional authenticated data, so
+            // chunks can't be swapped in the blob.
+            let compressed = match ctx.cipher.as_ref() {
+                Some(cipher) => Cow::Owned(
+                    cipher
+                        .encrypt(&compressed, chunk_id.as_ref())
+                        .with_context(|| format!("failed to encrypt node file {:?}", self.path))?,
+                ),
+                None => compressed,
+            };
             let compressed_size = compressed.len();
 
             // Move cursor to offset of next chunk
@@ -409,6 +445,13 @@ impl Node {
             blob_size += compressed_size as u64;
         }
 
+        // `child_count` of regular file is reused as `chunk_count`, which isn't known from the
+        // file size for chunks cut by content.
+        if ctx.chunker.is_some() {
+            self.inode.set_child_count(self.chunks.len() as u32);
+            self.inode.set_has_variable_chunks(true);
+        }
+
         // Finish inode digest calculation
         self.inode.set_digest(inode_hasher.digest_finalize());
 
@@ -1240,6 +1283,32 @@ impl InodeWrapper {
         }
     }
 
+    pub fn set_has_variable_chunks(&mut self, enable: bool) {
+        match self {
+            InodeWrapper::V5(i) => {
+                if enable {
+                    i.i_flags |= RafsV5InodeFlags::VARIABLE_CHUNKS;
+                } else {
+                    i.i_flags &= !RafsV5InodeFlags::VARIABLE_CHUNKS;
+                }
+            }
+            InodeWrapper::V6(i) => {
+                if enable {
+                    i.i_flags |= RafsV5InodeFlags::VARIABLE_CHUNKS;
+                } else {
+                    i.i_flags &= !RafsV5InodeFlags::VARIABLE_CHUNKS;
+                }
+            }
+        }
+    }
+
+    pub fn has_variable_chunks(&self) -> bool {
+        match self {
+            InodeWrapper::V5(i) => i.has_variable_chunks(),
+            InodeWrapper::V6(i) => i.has_variable_chunks(),
+        }
+    }
+
     pub fn ino(&self) -> Inode {
         match self {
             InodeWrapper::V5(i) => i.i_ino,
@@ -1661,6 +1730,38 @@ impl Display for ChunkWrapper {
 }
 
 /// Construct a `RafsV5Inode` object from a `Arc<dyn RafsInode>` object.
+/// File extensions of the formats already compressed, compressing them again saves little.
+const COMPRESSED_FILE_EXTENSIONS: &[&str] = &[
+    "7z", "br", "bz2", "gz", "jar", "jpeg", "jpg", "lz4", "mp3", "mp4", "png", "tgz", "war",
+    "webm", "webp", "whl", "xz", "zip", "zst",
+];
+
+/// Magic numbers of the formats already compressed, to detect the files without extension.
+const COMPRESSED_FILE_MAGICS: &[&[u8]] = &[
+    &[0x1f, 0x8b],                         // gzip
+    &[0x28, 0xb5, 0x2f, 0xfd],             // zstd
+    &[0xfd, b'7', b'z', b'X', b'Z', 0x00], // xz
+    &[b'B', b'Z', b'h'],                   // bzip2
+    &[b'P', b'K', 0x03, 0x04],             // zip, jar
+    &[0x89, b'P', b'N', b'G'],             // png
+    &[0xff, 0xd8, 0xff],                   // jpeg
+    &[b'7', b'z', 0xbc, 0xaf, 0x27, 0x1c], // 7z
+];
+
+/// Check whether the file content is already compressed, by the file extension or the magic
+/// number in the first chunk `data`.
+fn is_compressed_content(path: &Path, data: &[u8]) -> bool {
+    if let Some(ext) = path.extension().and_then(|ext| ext.to_str()) {
+        let ext = ext.to_ascii_lowercase();
+        if COMPRESSED_FILE_EXTENSIONS.contains(&ext.as_str()) {
+            return true;
+        }
+    }
+    COMPRESSED_FILE_MAGICS
+        .iter()
+        .any(|magic| data.starts_with(magic))
+}
+
 fn to_rafsv5_inode(inode: &dyn RafsInode) -> RafsV5Inode {
     let attr = inode.get_attr();
 
@@ -1712,6 +1813,26 @@ mod tests {
     use std::fs::File;
     use vmm_sys_util::{tempdir::TempDir, tempfile::TempFile};
 
+    #[test]
+    fn test_is_compressed_content() {
+        assert!(is_compressed_content(
+            Path::new("/usr/share/doc/a.gz"),
+            b"data"
+        ));
+        assert!(is_compressed_content(Path::new("/srv/IMAGE.JPG"), b"data"));
+        assert!(is_compressed_content(
+            Path::new("/usr/lib/a"),
+            &[0x28, 0xb5, 0x2f, 0xfd, 0x00]
+        ));
+        assert!(is_compressed_content(
+            Path::new("/app.war.1"),
+            b"PK\x03\x04"
+        ));
+        assert!(!is_compressed_content(Path::new("/usr/bin/sh"), b"\x7fELF"));
+        assert!(!is_compressed_content(Path::new("/etc/gz"), b""));
+        assert!(!is_compressed_content(Path::new("/a.txt"), &[0x1f]));
+    }
+
     #[test]
     fn test_set_v6_offset() {
         let pa = TempDir::new().unwrap();
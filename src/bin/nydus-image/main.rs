@@ -17,6 +17,7 @@ extern crate lazy_static;
 
 use std::fs::{self, metadata, DirEntry, OpenOptions};
 use std::path::{Path, PathBuf};
+use std::sync::Arc;
 
 use anyhow::{bail, Context, Result};
 use clap::{App, Arg, SubCommand};
@@ -26,10 +27,13 @@ use serde::Serialize;
 use nydus_app::{setup_logging, BuildTimeInfo};
 use nydus_utils::digest;
 use rafs::RafsIoReader;
+use storage::crypt::{new_key_provider, BlobCipher};
+use storage::factory::KeyProviderConfig;
 use storage::{compress, RAFS_DEFAULT_CHUNK_SIZE};
 
 use crate::builder::{Builder, DiffBuilder, DirectoryBuilder, StargzBuilder};
 use crate::core::chunk_dict::import_chunk_dict;
+use crate::core::chunker::Chunker;
 use crate::core::context::{
     ArtifactStorage, BlobManager, BootstrapManager, BuildContext, BuildOutput, BuildOutputBlob,
     RafsVersion, SourceType,
@@ -214,6 +218,39 @@ fn main() -> Result<()> {
                         .required(false)
                         .takes_value(true),
                 )
+                .arg(
+                    Arg::with_name("chunking")
+                        .long("chunking")
+                        .help("way to cut data chunks of files, by fixed chunk size or by content (content defined chunking), only for Rafs v5:")
+                        .takes_value(true)
+                        .required(false)
+                        .default_value("fixed")
+                        .possible_values(&["fixed", "cdc"]),
+                )
+                .arg(
+                    Arg::with_name("cdc-min-size")
+                        .long("cdc-min-size")
+                        .help("minimal chunk size of content defined chunking, at least 0x1000:")
+                        .takes_value(true)
+                        .required(false)
+                        .default_value("0x10000"),
+                )
+                .arg(
+                    Arg::with_name("cdc-avg-size")
+                        .long("cdc-avg-size")
+                        .help("average chunk size of content defined chunking, must be power of two:")
+                        .takes_value(true)
+                        .required(false)
+                        .default_value("0x40000"),
+                )
+                .arg(
+                    Arg::with_name("cdc-max-size")
+                        .long("cdc-max-size")
+                        .help("maximal chunk size of content defined chunking, at most 0x100000:")
+                        .takes_value(true)
+                        .required(false)
+                        .default_value("0x100000"),
+                )
                 .arg(
                     Arg::with_name("compressor")
                         .long("compressor")
@@ -222,7 +259,36 @@ fn main() -> Result<()> {
                         .takes_value(true)
                         .required(false)
                         .default_value("lz4_block")
-                        .possible_values(&["none", "lz4_block", "gzip"]),
+                        .possible_values(&["none", "lz4_block", "gzip", "zstd"]),
+                )
+                .arg(
+                    Arg::with_name("compress-level")
+                        .long("compress-level")
+                        .help("level of zstd compressor, between 1-22 or 0 for the default level 3:")
+                        .takes_value(true)
+                        .required(false)
+                        .default_value("0"),
+                )
+                .arg(
+                    Arg::with_name("compress-auto")
+                        .long("compress-auto")
+                        .help("store the chunks of already compressed files (e.g. gzip, zstd, zip, jpeg, png) without compression")
+                        .takes_value(false)
+                        .required(false),
+                )
+                .arg(
+                    Arg::with_name("encrypt-key-id")
+                        .long("encrypt-key-id")
+                        .help("ID of the key to encrypt chunks of the data blob with AES-256-GCM, only for Rafs v5")
+                        .takes_value(true)
+                        .requires("key-provider"),
+                )
+                .arg(
+                    Arg::with_name("key-provider")
+                        .long("key-provider")
+                        .help("path to the key provider configuration file to get the key of `--encrypt-key-id`")
+                        .takes_value(true)
+                        .requires("encrypt-key-id"),
                 )
                 .arg(
                     Arg::with_name("digester")
@@ -449,7 +515,8 @@ struct Command {}
 impl Command {
     fn create(matches: &clap::ArgMatches, build_info: &BuildTimeInfo) -> Result<()> {
         let blob_id = Self::get_blob_id(&matches)?;
-        let chunk_size = Self::get_chunk_size(&matches)?;
+        let mut chunk_size = Self::get_chunk_size(&matches)?;
+        let compress_level = Self::get_compress_level(&matches)?;
         let parent_bootstrap = Self::get_parent_bootstrap(&matches)?;
         let source_path = PathBuf::from(matches.value_of("SOURCE").unwrap());
         let extra_paths: Vec<PathBuf> = matches
@@ -494,6 +561,12 @@ impl Command {
             }
         }
 
+        let chunker = Self::get_chunker(&matches, source_type, version)?;
+        if let Some(chunker) = chunker.as_ref() {
+            // Chunks cut by content are no bigger than the chunk size of the image.
+            chunk_size = chunker.max_size().next_power_of_two();
+        }
+
         let prefetch_policy = matches
             .value_of("prefetch-policy")
             .unwrap_or_default()
@@ -514,6 +587,10 @@ impl Command {
         );
         build_ctx.set_fs_version(version);
         build_ctx.set_chunk_size(chunk_size);
+        build_ctx.set_compress_level(compress_level);
+        build_ctx.set_compress_auto(matches.is_present("compress-auto"));
+        build_ctx.set_cipher(Self::get_cipher(&matches, source_type, version)?);
+        build_ctx.set_chunker(chunker);
 
         let mut blob_mgr = BlobManager::new();
         if let Some(chunk_dict_arg) = matches.value_of("chunk-dict") {
@@ -780,6 +857,78 @@ impl Command {
         }
     }
 
+    fn get_chunker(
+        matches: &clap::ArgMatches,
+        source_type: SourceType,
+        version: RafsVersion,
+    ) -> Result<Option<Chunker>> {
+        if matches.value_of("chunking") != Some("cdc") {
+            return Ok(None);
+        }
+        if source_type == SourceType::StargzIndex {
+            bail!("stargz_index source doesn't support content defined chunking");
+        }
+        if version.is_v6() {
+            bail!("content defined chunking is only supported by fs-version 5");
+        }
+
+        let get_size = |name: &str| -> Result<u32> {
+            // Safe to unwrap because the sizes have default values.
+            let v = matches.value_of(name).unwrap();
+            let param = v.trim_start_matches("0x").trim_start_matches("0X");
+            u32::from_str_radix(param, 16).context(format!("invalid {} {}", name, v))
+        };
+        let chunker = Chunker::new(
+            get_size("cdc-min-size")?,
+            get_size("cdc-avg-size")?,
+            get_size("cdc-max-size")?,
+        )?;
+
+        Ok(Some(chunker))
+    }
+
+    fn get_compress_level(matches: &clap::ArgMatches) -> Result<i32> {
+        match matches.value_of("compress-level") {
+            None => Ok(0),
+            Some(v) => {
+                let level: i32 = v.parse().context(format!("invalid compress level {}", v))?;
+                if !(0..=22).contains(&level) {
+                    bail!("invalid compress level: {}", level);
+                }
+                Ok(level)
+            }
+        }
+    }
+
+    fn get_cipher(
+        matches: &clap::ArgMatches,
+        source_type: SourceType,
+        version: RafsVersion,
+    ) -> Result<Option<Arc<BlobCipher>>> {
+        let key_id = match matches.value_of("encrypt-key-id") {
+            None => return Ok(None),
+            Some(v) => v,
+        };
+        if source_type == SourceType::StargzIndex {
+            bail!("stargz_index source doesn't support encryption");
+        }
+        if version.is_v6() {
+            bail!("encryption is only supported by fs-version 5");
+        }
+
+        // Safe to unwrap because `key-provider` is required by `encrypt-key-id`.
+        let path = matches.value_of("key-provider").unwrap();
+        let config = KeyProviderConfig::from_file(path)
+            .with_context(|| format!("failed to load key provider configuration {}", path))?;
+        let provider = new_key_provider(&config)?;
+        let key = provider
+            .get_key(key_id)
+            .with_context(|| format!("failed to get key {}", key_id))?;
+        let cipher = BlobCipher::new(key_id, &key)?;
+
+        Ok(Some(Arc::new(cipher)))
+    }
+
     fn get_fs_version(matches: &clap::ArgMatches) -> Result<RafsVersion> {
         match matches.value_of("fs-version") {
             None => Ok(RafsVersion::V6),
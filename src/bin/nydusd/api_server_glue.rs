@@ -13,12 +13,13 @@ use nix::sys::signal::{kill, SIGTERM};
 use nix::unistd::Pid;
 use vmm_sys_util::{epoll::EventSet, eventfd::EventFd};
 
-use nydus::{FsBackendType, NydusError};
+use nydus::{FsBackendOverlay, FsBackendType, NydusError};
 use nydus_api::http_endpoint::{
-    ApiError, ApiMountCmd, ApiRequest, ApiResponse, ApiResponsePayload, ApiResult, DaemonConf,
-    DaemonErrorKind, MetricsErrorKind,
+    ApiError, ApiMountCmd, ApiPrefetchCmd, ApiRequest, ApiResponse, ApiResponsePayload, ApiResult,
+    CacheTrimCmd, CredentialCmd, DaemonConf, DaemonErrorKind, MetricsErrorKind,
 };
 use nydus_utils::metrics;
+use storage::factory::BLOB_FACTORY;
 
 use crate::daemon::{DaemonError, FsBackendMountCmd, FsBackendUmountCmd, NydusDaemon};
 #[cfg(fusedev)]
@@ -76,6 +77,8 @@ impl ApiServer {
             ApiRequest::Mount(mountpoint, info) => self.do_mount(mountpoint, info),
             ApiRequest::Remount(mountpoint, info) => self.do_remount(mountpoint, info),
             ApiRequest::Umount(mountpoint) => self.do_umount(mountpoint),
+            ApiRequest::Prefetch(mountpoint, cmd) => self.do_prefetch(mountpoint, cmd),
+            ApiRequest::ExportMountsInfo(mountpoint) => self.mounts_info(mountpoint),
 
             ApiRequest::Events => Self::events(),
             ApiRequest::ExportGlobalMetrics(id) => Self::export_global_metrics(id),
@@ -86,6 +89,11 @@ impl ApiServer {
             ApiRequest::ExportBackendMetrics(id) => Self::export_backend_metrics(id),
             ApiRequest::ExportBlobcacheMetrics(id) => Self::export_blobcache_metrics(id),
             ApiRequest::ExportInflightMetrics => self.export_inflight_metrics(),
+            ApiRequest::ExportTenantsMetrics(tenant) => self.export_tenants_metrics(tenant),
+            ApiRequest::ExportMemoryMetrics => Self::export_memory_metrics(),
+            ApiRequest::ExportCacheUsage => Self::export_cache_usage(),
+            ApiRequest::TrimCache(cmd) => Self::trim_cache(cmd),
+            ApiRequest::UpdateCredential(cmd) => Self::update_credential(cmd),
 
             ApiRequest::SendFuseFd => self.send_fuse_fd(),
             ApiRequest::Takeover => self.do_takeover(),
@@ -118,17 +126,45 @@ impl ApiServer {
         Ok(ApiResponsePayload::FsBackendInfo(info))
     }
 
+    fn mounts_info(&self, mountpoint: Option<String>) -> ApiResponse {
+        let d = self.daemon.as_ref();
+        let info = d
+            .export_mounts_info(mountpoint.as_deref())
+            .map_err(|e| ApiError::MountFailure(e.into()))?;
+        Ok(ApiResponsePayload::MountsInfo(info))
+    }
+
+    fn export_tenants_metrics(&self, tenant: Option<String>) -> ApiResponse {
+        let d = self.daemon.as_ref();
+        let metrics = d
+            .export_tenants_metrics(tenant.as_deref())
+            .map_err(|e| ApiError::Metrics(MetricsErrorKind::Daemon(e.into())))?;
+        Ok(ApiResponsePayload::TenantsMetrics(metrics))
+    }
+
+    /// Apply the daemon configuration to all mounted instances, the missing items are unchanged.
     fn configure_daemon(&self, conf: DaemonConf) -> ApiResponse {
-        conf.log_level
-            .parse::<log::LevelFilter>()
-            .map_err(|e| {
+        if let Some(log_level) = conf.log_level {
+            let v = log_level.parse::<log::LevelFilter>().map_err(|e| {
                 error!("Invalid log level passed, {}", e);
                 ApiError::ResponsePayloadType
-            })
-            .map(|v| {
-                log::set_max_level(v);
-                ApiResponsePayload::Empty
-            })
+            })?;
+            log::set_max_level(v);
+        }
+        if let Some(rate) = conf.bandwidth_rate {
+            info!("set bandwidth rate of storage backends to {}", rate);
+            storage::backend::ratelimit::set_global_bandwidth_rate(rate);
+        }
+        if let Some(max) = conf.fetch_concurrency {
+            info!("set concurrent requests of storage backends to {}", max);
+            storage::backend::priority::set_max_concurrent_fetches(max);
+        }
+        if let Some(budget) = conf.memory_budget {
+            info!("set memory budget of daemon to {}", budget);
+            nydus_utils::budget::set_memory_budget(budget);
+        }
+
+        Ok(ApiResponsePayload::Empty)
     }
 
     fn events() -> ApiResponse {
@@ -167,6 +203,50 @@ impl ApiServer {
             .map_err(|e| ApiError::Metrics(MetricsErrorKind::Stats(e)))
     }
 
+    fn export_memory_metrics() -> ApiResponse {
+        serde_json::to_string(&nydus_utils::budget::memory_usage())
+            .map(ApiResponsePayload::MemoryMetrics)
+            .map_err(|e| ApiError::DaemonAbnormal(DaemonErrorKind::Serde(e)))
+    }
+
+    fn export_cache_usage() -> ApiResponse {
+        let usage = BLOB_FACTORY
+            .cache_usage()
+            .map_err(|e| ApiError::DaemonAbnormal(DaemonErrorKind::Other(e.to_string())))?;
+        serde_json::to_string(&usage)
+            .map(ApiResponsePayload::CacheUsage)
+            .map_err(|e| ApiError::DaemonAbnormal(DaemonErrorKind::Serde(e)))
+    }
+
+    /// Evict the unused blobs from cache directories, and return the disk usage after that.
+    fn trim_cache(cmd: CacheTrimCmd) -> ApiResponse {
+        let freed = BLOB_FACTORY
+            .trim_cache(cmd.target)
+            .map_err(|e| ApiError::DaemonAbnormal(DaemonErrorKind::Other(e.to_string())))?;
+        info!("trim cache by http request, {} bytes freed", freed);
+        Self::export_cache_usage()
+    }
+
+    fn update_credential(cmd: CredentialCmd) -> ApiResponse {
+        let updated = storage::backend::registry::update_credential(
+            &cmd.host,
+            cmd.repo.as_deref(),
+            cmd.auth,
+            cmd.registry_token,
+        )
+        .map_err(|e| ApiError::DaemonAbnormal(DaemonErrorKind::UnexpectedEvent(e.to_string())))?;
+        if updated == 0 {
+            return Err(ApiError::DaemonAbnormal(DaemonErrorKind::UnexpectedEvent(
+                format!("no registry backend of host {}", cmd.host),
+            )));
+        }
+        info!(
+            "update credential of {} registry backends by http request",
+            updated
+        );
+        Ok(ApiResponsePayload::Empty)
+    }
+
     /// Detect if there is fop being hang.
     /// `ApiResponsePayload::Empty` will be converted to http status code 204, which means
     /// there is no requests being processed right now.
@@ -237,6 +317,12 @@ impl ApiServer {
                 config: cmd.config,
                 source: cmd.source,
                 prefetch_files: cmd.prefetch_files,
+                tenant: cmd.tenant,
+                overlay: cmd.overlay.map(|o| FsBackendOverlay {
+                    upper_dir: o.upper_dir,
+                    work_dir: o.work_dir,
+                    target: o.target,
+                }),
             })
             .map(|_| ApiResponsePayload::Empty)
             .map_err(|e| ApiError::MountFailure(e.into()))
@@ -252,6 +338,9 @@ impl ApiServer {
                 config: cmd.config,
                 source: cmd.source,
                 prefetch_files: cmd.prefetch_files,
+                tenant: cmd.tenant,
+                // The overlay of the mounted instance is kept.
+                overlay: None,
             })
             .map(|_| ApiResponsePayload::Empty)
             .map_err(|e| ApiError::MountFailure(e.into()))
@@ -264,6 +353,13 @@ impl ApiServer {
             .map_err(|e| ApiError::MountFailure(e.into()))
     }
 
+    fn do_prefetch(&self, mountpoint: String, cmd: ApiPrefetchCmd) -> ApiResponse {
+        self.daemon
+            .prefetch(&mountpoint, cmd.files)
+            .map(|_| ApiResponsePayload::Empty)
+            .map_err(|e| ApiError::MountFailure(e.into()))
+    }
+
     fn send_fuse_fd(&self) -> ApiResponse {
         let d = self.daemon.as_ref();
 
@@ -6,9 +6,10 @@
 
 use std::any::Any;
 use std::cmp::PartialEq;
-use std::collections::HashMap;
+use std::collections::{HashMap, HashSet};
 use std::convert::From;
 use std::fmt::{Display, Formatter};
+use std::fs;
 use std::io::Result;
 use std::ops::Deref;
 use std::path::{Path, PathBuf};
@@ -20,6 +21,7 @@ use std::sync::{
     Arc, MutexGuard,
 };
 use std::thread;
+use std::time::{Duration, Instant};
 use std::{error, fmt, io};
 
 use event_manager::{EventOps, EventSubscriber, Events};
@@ -27,17 +29,22 @@ use fuse_backend_rs::api::{vfs::VfsError, BackendFileSystem, Vfs};
 use fuse_backend_rs::passthrough::{Config, PassthroughFs};
 use fuse_backend_rs::transport::Error as FuseTransportError;
 use fuse_backend_rs::Error as FuseError;
+use nix::errno::Errno;
+use nix::mount::{mount, umount, MsFlags};
 use rust_fsm::*;
 use serde::{self, Deserialize, Serialize};
 use serde_json::Error as SerdeError;
 use vmm_sys_util::{epoll::EventSet, eventfd::EventFd};
 
-use nydus::{FsBackendDesc, FsBackendType};
+use nydus::{FsBackendDesc, FsBackendOverlay, FsBackendType};
 use nydus_app::BuildTimeInfo;
+use nydus_utils::budget;
+use nydus_utils::metrics::{self, BackendReadStats};
 use rafs::{
     fs::{Rafs, RafsConfig},
     trim_backend_config, RafsError, RafsIoRead,
 };
+use storage::factory::BLOB_FACTORY;
 
 use crate::upgrade::{self, UpgradeManager, UpgradeMgrError};
 use crate::EVENT_MANAGER_RUN;
@@ -129,6 +136,8 @@ pub enum DaemonError {
     SessionShutdown(FuseTransportError),
     Downcast(String),
     FsTypeMismatch(String),
+    /// Failed to mount or umount the writable overlay of an instance.
+    Overlay(String),
 }
 
 impl fmt::Display for DaemonError {
@@ -137,6 +146,7 @@ impl fmt::Display for DaemonError {
             Self::InvalidArguments(s) => write!(f, "Invalid argument: {}", s),
             Self::InvalidConfig(s) => write!(f, "Invalid config: {}", s),
             Self::DaemonFailure(s) => write!(f, "Daemon error: {}", s),
+            Self::Overlay(s) => write!(f, "Overlay error: {}", s),
             _ => write!(f, "{:?}", self),
         }
     }
@@ -174,13 +184,32 @@ pub struct DaemonInfo {
     pub backend_collection: FsBackendCollection,
 }
 
-#[derive(Clone)]
+/// Mounted filesystem instance with its stats, exported by the mount API.
+#[derive(Serialize)]
+pub struct MountInfo {
+    #[serde(flatten)]
+    pub desc: FsBackendDesc,
+    /// Ids of the data blobs of Rafs.
+    pub blobs: Vec<String>,
+    /// Reads from the storage backends of all blobs.
+    pub backend: BackendReadStats,
+    /// Disk usage in bytes of all blobs in the local cache.
+    pub cache_size: u64,
+}
+
+#[derive(Clone, Deserialize, Serialize)]
 pub struct FsBackendMountCmd {
     pub fs_type: FsBackendType,
     pub source: String,
     pub config: String,
     pub mountpoint: String,
     pub prefetch_files: Option<Vec<String>>,
+    /// Tenant owning the instance, whose cache directory isn't shared with other tenants.
+    #[serde(default)]
+    pub tenant: Option<String>,
+    /// Writable overlay mounted over the instance.
+    #[serde(default)]
+    pub overlay: Option<FsBackendOverlay>,
 }
 
 #[derive(Clone, Deserialize, Serialize, Debug)]
@@ -216,8 +245,11 @@ impl FsBackendCollection {
         let desc = FsBackendDesc {
             backend_type: cmd.fs_type.clone(),
             mountpoint: cmd.mountpoint.clone(),
+            source: cmd.source.clone(),
+            tenant: cmd.tenant.clone(),
             mounted_time: chrono::Local::now(),
             config: fs_config,
+            overlay: cmd.overlay.clone(),
         };
 
         self.0.insert(id.to_string(), desc);
@@ -225,9 +257,82 @@ impl FsBackendCollection {
         Ok(())
     }
 
+    // Update the config of the instance, which is mounted at the same time.
+    fn update(&mut self, id: &str, cmd: &FsBackendMountCmd) -> DaemonResult<()> {
+        let mounted_time = self.0.get(id).map(|d| d.mounted_time);
+        self.add(id, cmd)?;
+        if let (Some(time), Some(desc)) = (mounted_time, self.0.get_mut(id)) {
+            desc.mounted_time = time;
+        }
+
+        Ok(())
+    }
+
     fn del(&mut self, id: &str) {
         self.0.remove(id);
     }
+
+    /// Check the instance to mount doesn't share its cache directory with the instances of
+    /// other tenants, otherwise the cached data and the cache quota would be shared between
+    /// tenants with different credentials.
+    fn check_tenant(&self, cmd: &FsBackendMountCmd) -> DaemonResult<()> {
+        if cmd.fs_type != FsBackendType::Rafs {
+            return Ok(());
+        }
+        let config: serde_json::Value =
+            serde_json::from_str(&cmd.config).map_err(DaemonError::Serde)?;
+        let work_dir = match cache_work_dir(&config) {
+            Some(dir) => dir,
+            None => return Ok(()),
+        };
+
+        for desc in self.0.values() {
+            if desc.tenant == cmd.tenant {
+                continue;
+            }
+            if let Some(dir) = desc.config.as_ref().and_then(cache_work_dir) {
+                if Path::new(dir) == Path::new(work_dir) {
+                    return Err(DaemonError::InvalidConfig(format!(
+                        "cache directory {} is used by {} of another tenant",
+                        work_dir, desc.mountpoint
+                    )));
+                }
+            }
+        }
+
+        Ok(())
+    }
+}
+
+fn cache_work_dir(config: &serde_json::Value) -> Option<&str> {
+    config["device"]["cache"]["config"]["work_dir"].as_str()
+}
+
+/// Get the disk usage in bytes of the cached blobs, keyed by blob id.
+fn blob_cache_sizes() -> DaemonResult<HashMap<String, u64>> {
+    let mut sizes = HashMap::new();
+    for usage in BLOB_FACTORY
+        .cache_usage()
+        .map_err(|e| DaemonError::Common(e.to_string()))?
+    {
+        for blob in usage.blobs {
+            sizes.insert(blob.blob_id, blob.size);
+        }
+    }
+
+    Ok(sizes)
+}
+
+/// Stats of all instances of a tenant, exported by the metrics API.
+#[derive(Serialize)]
+pub struct TenantMetrics {
+    pub tenant: String,
+    /// Mountpoints of the instances.
+    pub mounts: Vec<String>,
+    /// Reads from the storage backends of all blobs.
+    pub backend: BackendReadStats,
+    /// Disk usage in bytes of all blobs in the local cache.
+    pub cache_size: u64,
 }
 
 pub trait NydusDaemon: DaemonStateMachineSubscriber {
@@ -253,6 +358,36 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
         self.on_event(DaemonStateMachineInput::Successful)?;
         Ok(())
     }
+    /// Prepare to stop the daemon without failing the requests of the mounted filesystems.
+    ///
+    /// The fuse session is handed over to the supervisor if there's one listening, so that a
+    /// successor takes over the pending requests. Otherwise the in-flight fuse requests are
+    /// drained, at most for `timeout`, before the session is umounted by `stop()`. In both cases
+    /// the downloaded chunks still being written are persisted into the blobcache.
+    fn shutdown(&self, timeout: Duration) {
+        let deadline = Instant::now() + timeout;
+
+        if self.get_state() == DaemonState::RUNNING {
+            let handed_over = self.supervisor().is_some()
+                && self
+                    .save()
+                    .and_then(|_| self.trigger_exit())
+                    .map_err(|e| warn!("failed to hand over fuse session to supervisor, {}", e))
+                    .is_ok();
+            if handed_over {
+                info!("fuse session handed over to supervisor");
+            } else {
+                wait_until(deadline, "in-flight fuse requests", || {
+                    !matches!(self.export_inflight_ops(), Ok(Some(_)))
+                });
+            }
+        }
+
+        wait_until(deadline, "pending cache writes", || {
+            let usage = budget::memory_usage();
+            usage.backend_buffers == 0 && usage.persist_buffers == 0
+        });
+    }
     fn id(&self) -> Option<String>;
     fn supervisor(&self) -> Option<String>;
     fn save(&self) -> DaemonResult<()>;
@@ -261,6 +396,10 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
     fn upgrade_mgr(&self) -> Option<MutexGuard<UpgradeManager>>;
     fn backend_collection(&self) -> MutexGuard<FsBackendCollection>;
     fn version(&self) -> BuildTimeInfo;
+    /// Host path exposing the instances by fuse, under which an overlay can be composed.
+    fn fuse_mountpoint(&self) -> Option<&str> {
+        None
+    }
     fn export_info(&self) -> DaemonResult<String> {
         let response = DaemonInfo {
             version: self.version(),
@@ -284,6 +423,138 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
         Ok(resp)
     }
 
+    /// Prefetch the data of `files` of the rafs instance at `mountpoint` in background.
+    fn prefetch(&self, mountpoint: &str, files: Vec<String>) -> DaemonResult<()> {
+        let files = input_prefetch_files_verify(&Some(files))?.unwrap_or_default();
+        let fs = self
+            .backend_from_mountpoint(mountpoint)?
+            .ok_or(DaemonError::NotFound)?;
+        let any_fs = fs.deref().as_any();
+        let rafs = any_fs
+            .downcast_ref::<Rafs>()
+            .ok_or_else(|| DaemonError::FsTypeMismatch("to rafs".to_string()))?;
+        rafs.trigger_prefetch(&files)
+            .map_err(|e| DaemonError::Rafs(RafsError::Prefetch(e.to_string())))
+    }
+
+    /// Export the mounted instances sorted by mountpoint, or the one at `mountpoint`.
+    fn export_mounts_info(&self, mountpoint: Option<&str>) -> DaemonResult<String> {
+        let mut descs: Vec<FsBackendDesc> = match mountpoint {
+            Some(mp) => vec![self
+                .backend_collection()
+                .0
+                .get(mp)
+                .cloned()
+                .ok_or(DaemonError::NotFound)?],
+            None => self.backend_collection().0.values().cloned().collect(),
+        };
+        descs.sort_by(|a, b| a.mountpoint.cmp(&b.mountpoint));
+
+        let cache_sizes = blob_cache_sizes()?;
+        let mut mounts = Vec::with_capacity(descs.len());
+        for desc in descs {
+            let mut blobs = Vec::new();
+            let mut backend = BackendReadStats::default();
+            let mut cache_size = 0;
+            for (id, stats, size) in self.blobs_stats(&desc.mountpoint, &cache_sizes)? {
+                blobs.push(id);
+                backend.add(&stats);
+                cache_size += size;
+            }
+            mounts.push(MountInfo {
+                desc,
+                blobs,
+                backend,
+                cache_size,
+            });
+        }
+
+        match mountpoint {
+            Some(_) => serde_json::to_string(&mounts[0]),
+            None => serde_json::to_string(&mounts),
+        }
+        .map_err(DaemonError::Serde)
+    }
+
+    /// Export the stats of tenants sorted by name, or the one of `tenant`. The instances
+    /// without tenant aren't counted.
+    fn export_tenants_metrics(&self, tenant: Option<&str>) -> DaemonResult<String> {
+        let mut descs: Vec<FsBackendDesc> = self
+            .backend_collection()
+            .0
+            .values()
+            .filter(|d| d.tenant.is_some() && (tenant.is_none() || d.tenant.as_deref() == tenant))
+            .cloned()
+            .collect();
+        if tenant.is_some() && descs.is_empty() {
+            return Err(DaemonError::NotFound);
+        }
+        descs.sort_by(|a, b| a.mountpoint.cmp(&b.mountpoint));
+
+        let cache_sizes = blob_cache_sizes()?;
+        let mut tenants: Vec<TenantMetrics> = Vec::new();
+        // The blobs shared by instances of a tenant are counted once.
+        let mut counted: HashSet<(String, String)> = HashSet::new();
+        for desc in descs {
+            // Safe to unwrap because the instances without tenant are filtered out.
+            let name = desc.tenant.clone().unwrap();
+            let idx = match tenants.iter().position(|t| t.tenant == name) {
+                Some(idx) => idx,
+                None => {
+                    tenants.push(TenantMetrics {
+                        tenant: name.clone(),
+                        mounts: Vec::new(),
+                        backend: BackendReadStats::default(),
+                        cache_size: 0,
+                    });
+                    tenants.len() - 1
+                }
+            };
+            let blobs = self.blobs_stats(&desc.mountpoint, &cache_sizes)?;
+            let metrics = &mut tenants[idx];
+            metrics.mounts.push(desc.mountpoint);
+            for (id, stats, size) in blobs {
+                if counted.insert((name.clone(), id)) {
+                    metrics.backend.add(&stats);
+                    metrics.cache_size += size;
+                }
+            }
+        }
+        tenants.sort_by(|a, b| a.tenant.cmp(&b.tenant));
+
+        match tenant {
+            Some(_) => serde_json::to_string(&tenants[0]),
+            None => serde_json::to_string(&tenants),
+        }
+        .map_err(DaemonError::Serde)
+    }
+
+    /// Get the id, backend reads and cache size of each data blob of the Rafs at `mountpoint`.
+    fn blobs_stats(
+        &self,
+        mountpoint: &str,
+        cache_sizes: &HashMap<String, u64>,
+    ) -> DaemonResult<Vec<(String, BackendReadStats, u64)>> {
+        let blobs = match self.backend_from_mountpoint(mountpoint)? {
+            Some(fs) => fs
+                .deref()
+                .as_any()
+                .downcast_ref::<Rafs>()
+                .map(|rafs| rafs.blob_ids())
+                .unwrap_or_default(),
+            None => Vec::new(),
+        };
+
+        Ok(blobs
+            .into_iter()
+            .map(|id| {
+                let stats = metrics::get_backend_read_stats(&id).unwrap_or_default();
+                let size = cache_sizes.get(&id).cloned().unwrap_or(0);
+                (id, stats, size)
+            })
+            .collect())
+    }
+
     fn backend_from_mountpoint(&self, mp: &str) -> DaemonResult<Option<Arc<BackFileSystem>>> {
         let r = self.get_vfs().get_rootfs(mp)?;
         Ok(r)
@@ -296,9 +567,27 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
         if self.backend_from_mountpoint(&cmd.mountpoint)?.is_some() {
             return Err(DaemonError::AlreadyExists);
         }
+        self.backend_collection().check_tenant(&cmd)?;
+        let lower_dir = match cmd.overlay {
+            Some(_) => Some(
+                self.fuse_mountpoint()
+                    .map(|mp| Path::new(mp).join(cmd.mountpoint.trim_start_matches('/')))
+                    .ok_or(DaemonError::Unsupported)?,
+            ),
+            None => None,
+        };
         let backend = fs_backend_factory(&cmd)?;
         let index = self.get_vfs().mount(backend, &cmd.mountpoint)?;
         info!("{} mounted at {}", &cmd.fs_type, &cmd.mountpoint);
+        if let (Some(lower_dir), Some(overlay)) = (lower_dir, cmd.overlay.as_ref()) {
+            if let Err(e) = mount_overlay(&lower_dir, overlay) {
+                // Don't leave the instance mounted without the requested overlay.
+                if let Err(err) = self.get_vfs().umount(&cmd.mountpoint) {
+                    warn!("failed to umount {}, {:?}", &cmd.mountpoint, err);
+                }
+                return Err(e);
+            }
+        }
         self.backend_collection().add(&cmd.mountpoint, &cmd)?;
 
         // Add mounts opaque to UpgradeManager
@@ -309,10 +598,37 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
         Ok(())
     }
 
-    fn remount(&self, cmd: FsBackendMountCmd) -> DaemonResult<()> {
+    // Mount the filesystem at `vfs_index` used by the previous daemon, on live upgrade or
+    // failover.
+    fn restore_mount(&self, cmd: &FsBackendMountCmd, vfs_index: u8) -> DaemonResult<()> {
+        let backend = fs_backend_factory(cmd)?;
+        self.get_vfs()
+            .restore_mount(backend, vfs_index, &cmd.mountpoint)
+            .map_err(|e| {
+                DaemonError::DaemonFailure(format!(
+                    "restore mount {} at index {}: {:?}",
+                    cmd.mountpoint, vfs_index, e
+                ))
+            })?;
+        info!("{} restored at {}", &cmd.fs_type, &cmd.mountpoint);
+        self.backend_collection().add(&cmd.mountpoint, cmd)?;
+
+        Ok(())
+    }
+
+    fn remount(&self, mut cmd: FsBackendMountCmd) -> DaemonResult<()> {
         let rootfs = self
             .backend_from_mountpoint(&cmd.mountpoint)?
             .ok_or(DaemonError::NotFound)?;
+        // The instance is still owned by the tenant mounting it, and keeps its overlay.
+        let (tenant, overlay) = self
+            .backend_collection()
+            .0
+            .get(&cmd.mountpoint)
+            .map(|d| (d.tenant.clone(), d.overlay.clone()))
+            .unwrap_or_default();
+        cmd.tenant = tenant;
+        cmd.overlay = overlay;
         let rafs_config = RafsConfig::from_str(&&cmd.config)?;
         let mut bootstrap = <dyn RafsIoRead>::from_file(&&cmd.source)?;
         let any_fs = rootfs.deref().as_any();
@@ -325,6 +641,7 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
                 RafsError::Unsupported => DaemonError::Unsupported,
                 e => DaemonError::Rafs(e),
             })?;
+        self.backend_collection().update(&cmd.mountpoint, &cmd)?;
 
         // Update mounts opaque from UpgradeManager
         if let Some(mut mgr_guard) = self.upgrade_mgr() {
@@ -338,6 +655,15 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
         let _ = self
             .backend_from_mountpoint(&cmd.mountpoint)?
             .ok_or(DaemonError::NotFound)?;
+        // The overlay keeps the instance busy, so it's umounted first.
+        let overlay = self
+            .backend_collection()
+            .0
+            .get(&cmd.mountpoint)
+            .and_then(|d| d.overlay.clone());
+        if let Some(overlay) = overlay.as_ref() {
+            umount_overlay(overlay)?;
+        }
         self.get_vfs().umount(&cmd.mountpoint)?;
 
         self.backend_collection().del(&cmd.mountpoint);
@@ -351,6 +677,18 @@ pub trait NydusDaemon: DaemonStateMachineSubscriber {
     }
 }
 
+// Poll `done` until it returns true or `deadline` is reached.
+fn wait_until<F: Fn() -> bool>(deadline: Instant, what: &str, done: F) {
+    while !done() {
+        if Instant::now() >= deadline {
+            warn!("timed out waiting for {} on shutdown", what);
+            return;
+        }
+        thread::sleep(Duration::from_millis(10));
+    }
+    info!("drained {} on shutdown", what);
+}
+
 /// Validate prefetch file list command line parameter.
 ///
 /// A string including multiple directories and regular files should be separated by white-spaces, e.g.
@@ -374,6 +712,86 @@ fn input_prefetch_files_verify(input: &Option<Vec<String>>) -> DaemonResult<Opti
     Ok(prefetch_files)
 }
 
+/// Get the mount options of overlayfs composing `overlay` over `lower_dir`.
+fn overlay_options(lower_dir: &Path, overlay: &FsBackendOverlay) -> DaemonResult<String> {
+    let lower_dir = lower_dir.to_string_lossy();
+    for dir in [
+        &*lower_dir,
+        overlay.upper_dir.as_str(),
+        overlay.work_dir.as_str(),
+        overlay.target.as_str(),
+    ]
+    .iter()
+    {
+        if !dir.starts_with('/') {
+            return Err(DaemonError::InvalidArguments(format!(
+                "overlay directory {} isn't absolute",
+                dir
+            )));
+        }
+        // Overlayfs doesn't support escaping the separators of its options.
+        if dir.contains(|c: char| c == ',' || c == ':') {
+            return Err(DaemonError::InvalidArguments(format!(
+                "overlay directory {} contains ',' or ':'",
+                dir
+            )));
+        }
+    }
+
+    Ok(format!(
+        "lowerdir={},upperdir={},workdir={}",
+        lower_dir, overlay.upper_dir, overlay.work_dir
+    ))
+}
+
+/// Mount the writable `overlay` over `lower_dir`, creating its directories if missing.
+fn mount_overlay(lower_dir: &Path, overlay: &FsBackendOverlay) -> DaemonResult<()> {
+    let options = overlay_options(lower_dir, overlay)?;
+    for dir in [&overlay.upper_dir, &overlay.work_dir, &overlay.target].iter() {
+        fs::create_dir_all(dir)
+            .map_err(|e| DaemonError::Overlay(format!("create directory {}: {}", dir, e)))?;
+    }
+    mount(
+        Some("overlay"),
+        overlay.target.as_str(),
+        Some("overlay"),
+        MsFlags::empty(),
+        Some(options.as_str()),
+    )
+    .map_err(|e| DaemonError::Overlay(format!("mount at {}: {}", overlay.target, e)))?;
+    info!(
+        "overlay of {} mounted at {}",
+        lower_dir.display(),
+        overlay.target
+    );
+
+    Ok(())
+}
+
+/// Umount the writable `overlay`, and remove its upper and work directories.
+fn umount_overlay(overlay: &FsBackendOverlay) -> DaemonResult<()> {
+    match umount(overlay.target.as_str()) {
+        // The overlay may have been umounted by the user.
+        Ok(_) | Err(Errno::EINVAL) | Err(Errno::ENOENT) => {}
+        Err(e) => {
+            return Err(DaemonError::Overlay(format!(
+                "umount {}: {}",
+                overlay.target, e
+            )))
+        }
+    }
+    for dir in [&overlay.upper_dir, &overlay.work_dir].iter() {
+        if let Err(e) = fs::remove_dir_all(dir) {
+            if e.kind() != io::ErrorKind::NotFound {
+                warn!("failed to remove overlay directory {}, {}", dir, e);
+            }
+        }
+    }
+    info!("overlay at {} umounted", overlay.target);
+
+    Ok(())
+}
+
 fn fs_backend_factory(cmd: &FsBackendMountCmd) -> DaemonResult<BackFileSystem> {
     let prefetch_files = input_prefetch_files_verify(&cmd.prefetch_files)?;
 
@@ -460,6 +878,93 @@ impl EventSubscriber for NydusDaemonSubscriber {
     }
 }
 
+/// Reload the config file of the Rafs instance mounted by the command line on SIGHUP.
+///
+/// The instance is remounted with the same bootstrap, so the new backend credentials, bandwidth
+/// rate and cache quota apply without dropping the FUSE session.
+pub struct ConfigReloadSubscriber {
+    event_fd: EventFd,
+    daemon: Arc<dyn NydusDaemon>,
+    config_file: Option<String>,
+    mount_cmd: Option<FsBackendMountCmd>,
+}
+
+impl ConfigReloadSubscriber {
+    pub fn new(
+        daemon: Arc<dyn NydusDaemon>,
+        config_file: Option<String>,
+        mount_cmd: Option<FsBackendMountCmd>,
+    ) -> Result<Self> {
+        let event_fd = EventFd::new(0).map_err(|e| {
+            error!("Creating event fd failed. {}", e);
+            e
+        })?;
+
+        Ok(Self {
+            event_fd,
+            daemon,
+            config_file,
+            mount_cmd,
+        })
+    }
+
+    pub fn get_event_fd(&self) -> Result<EventFd> {
+        self.event_fd.try_clone()
+    }
+
+    fn reload(&self) {
+        let (config_file, cmd) = match (self.config_file.as_ref(), self.mount_cmd.as_ref()) {
+            (Some(f), Some(cmd)) if cmd.fs_type == FsBackendType::Rafs => (f, cmd),
+            _ => {
+                info!("no rafs instance mounted by command line to reload");
+                return;
+            }
+        };
+        let config = match std::fs::read_to_string(config_file) {
+            Ok(c) => c,
+            Err(e) => {
+                error!("failed to read config file {}: {}", config_file, e);
+                return;
+            }
+        };
+
+        let mut cmd = cmd.clone();
+        cmd.config = config;
+        match self.daemon.remount(cmd) {
+            Ok(_) => info!("config {} reloaded", config_file),
+            Err(e) => error!("failed to reload config {}: {}", config_file, e),
+        }
+    }
+}
+
+impl EventSubscriber for ConfigReloadSubscriber {
+    fn process(&self, events: Events, event_ops: &mut EventOps) {
+        self.event_fd
+            .read()
+            .map(|_| ())
+            .map_err(|e| last_error!(e))
+            .unwrap_or_else(|_| {});
+
+        match events.event_set() {
+            EventSet::IN => self.reload(),
+            EventSet::ERROR => {
+                error!("Got error on the monitored event.");
+            }
+            EventSet::HANG_UP => {
+                event_ops
+                    .remove(events)
+                    .unwrap_or_else(|e| error!("Encountered error during cleanup, {}", e));
+            }
+            _ => {}
+        }
+    }
+
+    fn init(&self, ops: &mut EventOps) {
+        ops.add(Events::new(&self.event_fd, EventSet::IN))
+            .expect("Cannot register event")
+    }
+}
+
 // State machine for Nydus daemon workflow.
 //
 // Valid states:
@@ -643,6 +1148,8 @@ mod tests {
                     mountpoint: "testmonutount".to_string(),
                     source: "testsource".to_string(),
                     prefetch_files: Some(vec!["testfile".to_string()]),
+                    tenant: None,
+                    overlay: None,
                 },
             )
             .is_err()
@@ -655,6 +1162,83 @@ mod tests {
         assert_eq!(col.0.len(), 0);
     }
 
+    #[test]
+    fn it_should_isolate_tenant_cache() {
+        let cmd = |mountpoint: &str, work_dir: &str, tenant: Option<&str>| FsBackendMountCmd {
+            fs_type: FsBackendType::Rafs,
+            config: format!(
+                r#"{{"device": {{"cache": {{"type": "blobcache", "config": {{"work_dir": "{}"}}}}}}}}"#,
+                work_dir
+            ),
+            mountpoint: mountpoint.to_string(),
+            source: "testsource".to_string(),
+            prefetch_files: None,
+            tenant: tenant.map(|t| t.to_string()),
+            overlay: None,
+        };
+        let mut col: FsBackendCollection = Default::default();
+        col.add("/a", &cmd("/a", "/cache/a", Some("team-a")))
+            .unwrap();
+
+        assert!(col
+            .check_tenant(&cmd("/b", "/cache/a/", Some("team-a")))
+            .is_ok());
+        assert!(col
+            .check_tenant(&cmd("/b", "/cache/b", Some("team-b")))
+            .is_ok());
+        assert!(col
+            .check_tenant(&cmd("/b", "/cache/a/", Some("team-b")))
+            .is_err());
+        assert!(col.check_tenant(&cmd("/b", "/cache/a", None)).is_err());
+    }
+
+    #[test]
+    fn it_should_compose_overlay() {
+        let overlay = FsBackendOverlay {
+            upper_dir: "/ctr/upper".to_string(),
+            work_dir: "/ctr/work".to_string(),
+            target: "/ctr/rootfs".to_string(),
+        };
+        assert_eq!(
+            overlay_options(Path::new("/mnt/sub"), &overlay).unwrap(),
+            "lowerdir=/mnt/sub,upperdir=/ctr/upper,workdir=/ctr/work"
+        );
+        assert!(overlay_options(Path::new("/mnt/a:b"), &overlay).is_err());
+        let mut relative = overlay.clone();
+        relative.upper_dir = "upper".to_string();
+        assert!(overlay_options(Path::new("/mnt/sub"), &relative).is_err());
+        let mut comma = overlay.clone();
+        comma.target = "/ctr/a,b".to_string();
+        assert!(overlay_options(Path::new("/mnt/sub"), &comma).is_err());
+
+        let mut col: FsBackendCollection = Default::default();
+        col.add(
+            "/sub",
+            &FsBackendMountCmd {
+                fs_type: FsBackendType::PassthroughFs,
+                config: "".to_string(),
+                mountpoint: "/sub".to_string(),
+                source: "/src".to_string(),
+                prefetch_files: None,
+                tenant: None,
+                overlay: Some(overlay.clone()),
+            },
+        )
+        .unwrap();
+        assert_eq!(col.0["/sub"].overlay, Some(overlay));
+    }
+
+    #[test]
+    fn it_should_wait_until_done_or_deadline() {
+        let start = Instant::now();
+        wait_until(start + Duration::from_secs(10), "nothing", || true);
+        assert!(start.elapsed() < Duration::from_secs(1));
+
+        let start = Instant::now();
+        wait_until(start + Duration::from_millis(50), "forever", || false);
+        assert!(start.elapsed() >= Duration::from_millis(50));
+    }
+
     #[test]
     fn it_should_verify_prefetch_files() {
         match input_prefetch_files_verify(&Some(vec!["/etc/passwd".to_string()])) {
@@ -704,6 +1288,8 @@ mod tests {
             mountpoint: "testmountpoint".to_string(),
             source: bootstrap.to_string(),
             prefetch_files: Some(vec!["/testfile".to_string()]),
+            tenant: None,
+            overlay: None,
         })
         .unwrap()
         .as_any()
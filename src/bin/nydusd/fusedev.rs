@@ -143,6 +143,7 @@ pub struct FusedevDaemon {
     pub conn: AtomicU64,
     pub failover_policy: FailoverPolicy,
     pub session: Mutex<FuseSession>,
+    mountpoint: String,
 
     bti: BuildTimeInfo,
     id: Option<String>,
@@ -305,6 +306,10 @@ impl NydusDaemon for FusedevDaemon {
         self.bti.clone()
     }
 
+    fn fuse_mountpoint(&self) -> Option<&str> {
+        Some(&self.mountpoint)
+    }
+
     fn export_inflight_ops(&self) -> DaemonResult<Option<String>> {
         let ops = self.inflight_ops.lock().unwrap();
 
@@ -415,6 +420,7 @@ pub fn create_nydus_daemon(
         conn: AtomicU64::new(0),
         failover_policy: fp,
         session: Mutex::new(session),
+        mountpoint: mountpoint.to_string(),
 
         bti,
         id,
@@ -26,6 +26,7 @@ use std::sync::{
     Arc, Mutex,
 };
 use std::thread;
+use std::time::Duration;
 use std::{io, process};
 
 use clap::{App, Arg};
@@ -40,7 +41,7 @@ use nydus_api::http::start_http_thread;
 use nydus_app::{dump_program_info, setup_logging, BuildTimeInfo};
 
 use self::api_server_glue::{ApiServer, ApiSeverSubscriber};
-use self::daemon::{DaemonError, FsBackendMountCmd, NydusDaemonSubscriber};
+use self::daemon::{ConfigReloadSubscriber, DaemonError, FsBackendMountCmd, NydusDaemonSubscriber};
 
 #[cfg(feature = "virtiofs")]
 mod virtiofs;
@@ -58,6 +59,7 @@ mod upgrade;
 lazy_static! {
     static ref EVENT_MANAGER_RUN: AtomicBool = AtomicBool::new(true);
     static ref EXIT_EVTFD: Mutex::<Option<EventFd>> = Mutex::<Option<EventFd>>::default();
+    static ref RELOAD_EVTFD: Mutex::<Option<EventFd>> = Mutex::<Option<EventFd>>::default();
 }
 
 fn get_default_rlimit_nofile() -> Result<rlim> {
@@ -111,6 +113,14 @@ extern "C" fn sig_exit(_sig: std::os::raw::c_int) {
     }
 }
 
+extern "C" fn sig_reload(_sig: std::os::raw::c_int) {
+    if let Some(evtfd) = RELOAD_EVTFD.lock().expect("Not poisoned lock!").as_ref() {
+        evtfd
+            .write(1)
+            .unwrap_or_else(|e| error!("Write event fd failed when reloading config, {}", e))
+    }
+}
+
 fn main() -> Result<()> {
     let (bti_string, bti) = BuildTimeInfo::dump(crate_version!());
 
@@ -190,6 +200,42 @@ fn main() -> Result<()> {
                 .required(false)
                 .global(true),
         )
+        .arg(
+            Arg::with_name("bandwidth-rate")
+                .long("bandwidth-rate")
+                .default_value("0")
+                .help("Limit the download bandwidth of all storage backends in bytes per second (0 means unlimited)")
+                .takes_value(true)
+                .required(false)
+                .global(true),
+        )
+        .arg(
+            Arg::with_name("fetch-concurrency")
+                .long("fetch-concurrency")
+                .default_value("0")
+                .help("Limit the concurrent requests to all storage backends, served by QoS class of mounts when saturated (0 means unlimited)")
+                .takes_value(true)
+                .required(false)
+                .global(true),
+        )
+        .arg(
+            Arg::with_name("memory-budget")
+                .long("memory-budget")
+                .default_value("0")
+                .help("Limit the memory used by metadata in cached mode and buffers of backend requests in bytes (0 means unlimited)")
+                .takes_value(true)
+                .required(false)
+                .global(true),
+        )
+        .arg(
+            Arg::with_name("shutdown-timeout")
+                .long("shutdown-timeout")
+                .default_value("10")
+                .help("Seconds to wait for in-flight requests and cache writes on SIGTERM before exiting")
+                .takes_value(true)
+                .required(false)
+                .global(true),
+        )
         .arg(
             Arg::with_name("supervisor")
                 .long("supervisor")
@@ -317,6 +363,33 @@ fn main() -> Result<()> {
         .value_of("rlimit-nofile")
         .map(|n| n.parse().unwrap_or(rlimit_nofile_default))
         .unwrap_or(rlimit_nofile_default);
+    // Safe to unwrap because it has default value.
+    let bandwidth_rate: u64 = cmd_arguments_parsed
+        .value_of("bandwidth-rate")
+        .unwrap()
+        .parse()
+        .map_err(|e| einval!(format!("invalid bandwidth rate: {}", e)))?;
+    storage::backend::ratelimit::set_global_bandwidth_rate(bandwidth_rate);
+    // Safe to unwrap because it has default value.
+    let fetch_concurrency: usize = cmd_arguments_parsed
+        .value_of("fetch-concurrency")
+        .unwrap()
+        .parse()
+        .map_err(|e| einval!(format!("invalid fetch concurrency: {}", e)))?;
+    storage::backend::priority::set_max_concurrent_fetches(fetch_concurrency);
+    // Safe to unwrap because it has default value.
+    let memory_budget: u64 = cmd_arguments_parsed
+        .value_of("memory-budget")
+        .unwrap()
+        .parse()
+        .map_err(|e| einval!(format!("invalid memory budget: {}", e)))?;
+    nydus_utils::budget::set_memory_budget(memory_budget);
+    // Safe to unwrap because it has default value.
+    let shutdown_timeout: u64 = cmd_arguments_parsed
+        .value_of("shutdown-timeout")
+        .unwrap()
+        .parse()
+        .map_err(|e| einval!(format!("invalid shutdown timeout: {}", e)))?;
 
     let mut opts = VfsOptions::default();
     let mount_cmd = if let Some(shared_dir) = shared_dir {
@@ -334,6 +407,8 @@ fn main() -> Result<()> {
             config: "".to_string(),
             mountpoint: virtual_mnt.to_string(),
             prefetch_files: None,
+            tenant: None,
+            overlay: None,
         };
 
         // passthroughfs requires !no_open
@@ -356,6 +431,8 @@ fn main() -> Result<()> {
             config: std::fs::read_to_string(config)?,
             mountpoint: virtual_mnt.to_string(),
             prefetch_files,
+            tenant: None,
+            overlay: None,
         };
 
         // rafs can be readonly and skip open
@@ -366,6 +443,9 @@ fn main() -> Result<()> {
         None
     };
 
+    // The config file of the Rafs instance is reloaded on SIGHUP.
+    let reload_cmd = mount_cmd.clone();
+
     // Enable all options required by passthroughfs
     if cmd_arguments_parsed.is_present("hybrid-mode") {
         opts.no_open = false;
@@ -462,9 +542,20 @@ fn main() -> Result<()> {
         info!("api server running at {}", apisock);
     }
 
+    let reload_subscriber = Arc::new(ConfigReloadSubscriber::new(
+        daemon.clone(),
+        cmd_arguments_parsed
+            .value_of("config")
+            .map(|s| s.to_string()),
+        reload_cmd,
+    )?);
+    *RELOAD_EVTFD.lock().unwrap().deref_mut() = Some(reload_subscriber.get_event_fd()?);
+    event_manager.add_subscriber(reload_subscriber);
+
     *EXIT_EVTFD.lock().unwrap().deref_mut() = Some(exit_evtfd);
     nydus_app::signal::register_signal_handler(signal::SIGINT, sig_exit);
     nydus_app::signal::register_signal_handler(signal::SIGTERM, sig_exit);
+    nydus_app::signal::register_signal_handler(signal::SIGHUP, sig_reload);
 
     while EVENT_MANAGER_RUN.load(Ordering::Relaxed) {
         // If event manager dies, so does nydusd
@@ -481,6 +572,8 @@ fn main() -> Result<()> {
         }
     }
 
+    // New mounts are refused since the API server is stopped.
+    daemon.shutdown(Duration::from_secs(shutdown_timeout));
     daemon.stop().unwrap_or_else(|e| error!("{}", e));
     daemon.wait().unwrap_or_else(|e| error!("{}", e));
     info!("nydusd quits");
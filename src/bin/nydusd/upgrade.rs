@@ -1,17 +1,153 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Live upgrade and failover of the fusedev daemon.
+//!
+//! The supervisor, e.g. a snapshotter managing nydusd, listens on the unix socket specified by
+//! `--supervisor`. On a `sendfd` request, the daemon connects to the supervisor and sends the
+//! state of its mounts, along with the `/dev/fuse` fd attached by `SCM_RIGHTS`, then closes the
+//! connection. The supervisor keeps them, and sends them back in the same way to the new daemon
+//! started with `--upgrade`, which connects to the supervisor on a `takeover` request, mounts
+//! the filesystems again at the same VFS indexes and serves the FUSE session without remounting
+//! it in the kernel.
+
+use std::collections::HashMap;
 use std::convert::TryFrom;
 #[cfg(feature = "fusedev")]
+use std::fs::File;
+#[cfg(feature = "fusedev")]
+use std::io::{Read, Write};
+#[cfg(feature = "fusedev")]
+use std::os::unix::io::{AsRawFd, FromRawFd, RawFd};
+#[cfg(feature = "fusedev")]
+use std::os::unix::net::UnixStream;
 use std::path::PathBuf;
 
-use crate::daemon::{DaemonResult, FsBackendMountCmd, FsBackendUmountCmd};
+#[cfg(feature = "fusedev")]
+use nix::sys::socket::{recvmsg, sendmsg, ControlMessage, ControlMessageOwned, MsgFlags};
+#[cfg(feature = "fusedev")]
+use nix::sys::uio::IoVec;
+use serde::{Deserialize, Serialize};
+
+use crate::daemon::{DaemonError, DaemonResult, FsBackendMountCmd, FsBackendUmountCmd};
 
 #[derive(Debug)]
-pub enum UpgradeMgrError {}
-pub struct UpgradeManager {}
+pub enum UpgradeMgrError {
+    /// Failed to exchange the state with the supervisor.
+    Supervisor(std::io::Error),
+    /// The state received from the supervisor is invalid.
+    InvalidState(serde_json::Error),
+    /// No fuse fd is received from the supervisor.
+    MissingFuseFd,
+}
+
+impl From<UpgradeMgrError> for DaemonError {
+    fn from(e: UpgradeMgrError) -> Self {
+        DaemonError::UpgradeManager(e)
+    }
+}
+
+/// A filesystem instance mounted by the daemon, to be mounted again by the new daemon.
+#[derive(Clone, Deserialize, Serialize)]
+pub struct MountState {
+    pub cmd: FsBackendMountCmd,
+    pub vfs_index: u8,
+}
+
+pub struct UpgradeManager {
+    #[allow(dead_code)]
+    supervisor: PathBuf,
+    mounts: HashMap<String, MountState>,
+}
 
 #[cfg(feature = "fusedev")]
 impl UpgradeManager {
-    pub fn new(_: PathBuf) -> Self {
-        UpgradeManager {}
+    pub fn new(supervisor: PathBuf) -> Self {
+        UpgradeManager {
+            supervisor,
+            mounts: HashMap::new(),
+        }
+    }
+
+    /// Send the mount states and the fuse fd to the supervisor.
+    fn save(&self, fuse_fd: RawFd) -> DaemonResult<()> {
+        let mut mounts: Vec<&MountState> = self.mounts.values().collect();
+        mounts.sort_by_key(|m| m.vfs_index);
+        let state = serde_json::to_vec(&mounts).map_err(DaemonError::Serde)?;
+
+        let mut stream =
+            UnixStream::connect(&self.supervisor).map_err(UpgradeMgrError::Supervisor)?;
+        let iov = [IoVec::from_slice(&state)];
+        let fds = [fuse_fd];
+        let sent = sendmsg(
+            stream.as_raw_fd(),
+            &iov,
+            &[ControlMessage::ScmRights(&fds)],
+            MsgFlags::empty(),
+            None,
+        )
+        .map_err(|e| UpgradeMgrError::Supervisor(eother!(e)))?;
+        // The fd is attached to the first part, the supervisor reads the rest until EOF.
+        stream
+            .write_all(&state[sent..])
+            .map_err(UpgradeMgrError::Supervisor)?;
+
+        info!(
+            "sent fuse fd and state of {} mounts to supervisor",
+            mounts.len()
+        );
+
+        Ok(())
+    }
+
+    /// Receive the mount states and the fuse fd saved by the previous daemon from the supervisor.
+    fn restore(&self) -> DaemonResult<(Vec<MountState>, File)> {
+        let mut stream =
+            UnixStream::connect(&self.supervisor).map_err(UpgradeMgrError::Supervisor)?;
+        let mut state = vec![0u8; 0x1000];
+        let mut cmsg_buffer = nix::cmsg_space!([RawFd; 1]);
+
+        let (size, fuse_fd) = {
+            let iov = [IoVec::from_mut_slice(&mut state)];
+            let msg = recvmsg(
+                stream.as_raw_fd(),
+                &iov,
+                Some(&mut cmsg_buffer),
+                MsgFlags::MSG_CMSG_CLOEXEC,
+            )
+            .map_err(|e| UpgradeMgrError::Supervisor(eother!(e)))?;
+            let mut fuse_fd = None;
+            for cmsg in msg.cmsgs() {
+                if let ControlMessageOwned::ScmRights(fds) = cmsg {
+                    for fd in fds {
+                        match fuse_fd {
+                            None => fuse_fd = Some(fd),
+                            // Unexpected fds are closed.
+                            Some(_) => drop(unsafe { File::from_raw_fd(fd) }),
+                        }
+                    }
+                }
+            }
+            (msg.bytes, fuse_fd)
+        };
+        let file = fuse_fd
+            .map(|fd| unsafe { File::from_raw_fd(fd) })
+            .ok_or(UpgradeMgrError::MissingFuseFd)?;
+
+        state.truncate(size);
+        stream
+            .read_to_end(&mut state)
+            .map_err(UpgradeMgrError::Supervisor)?;
+        let mounts: Vec<MountState> =
+            serde_json::from_slice(&state).map_err(UpgradeMgrError::InvalidState)?;
+
+        info!(
+            "received fuse fd and state of {} mounts from supervisor",
+            mounts.len()
+        );
+
+        Ok((mounts, file))
     }
 }
 
@@ -34,33 +170,99 @@ impl TryFrom<&str> for FailoverPolicy {
 }
 
 pub fn add_mounts_state(
-    _mgr: &mut UpgradeManager,
-    _cmd: FsBackendMountCmd,
-    _vfs_index: u8,
+    mgr: &mut UpgradeManager,
+    cmd: FsBackendMountCmd,
+    vfs_index: u8,
 ) -> DaemonResult<()> {
+    mgr.mounts
+        .insert(cmd.mountpoint.clone(), MountState { cmd, vfs_index });
     Ok(())
 }
 
-pub fn update_mounts_state(_mgr: &mut UpgradeManager, _cmd: FsBackendMountCmd) -> DaemonResult<()> {
+pub fn update_mounts_state(mgr: &mut UpgradeManager, cmd: FsBackendMountCmd) -> DaemonResult<()> {
+    let state = mgr
+        .mounts
+        .get_mut(&cmd.mountpoint)
+        .ok_or(DaemonError::NotFound)?;
+    state.cmd = cmd;
     Ok(())
 }
 
-pub fn remove_mounts_state(
-    _mgr: &mut UpgradeManager,
-    _cmd: FsBackendUmountCmd,
-) -> DaemonResult<()> {
+pub fn remove_mounts_state(mgr: &mut UpgradeManager, cmd: FsBackendUmountCmd) -> DaemonResult<()> {
+    mgr.mounts.remove(&cmd.mountpoint);
     Ok(())
 }
 
 #[cfg(feature = "fusedev")]
 pub mod fusedev_upgrade {
-    use crate::daemon::DaemonResult;
+    use std::os::unix::io::AsRawFd;
+
+    use super::add_mounts_state;
+    use crate::daemon::{DaemonError, DaemonResult, NydusDaemon};
     use crate::fusedev::FusedevDaemon;
-    pub fn save(_daemon: &FusedevDaemon) -> DaemonResult<()> {
-        Ok(())
+
+    pub fn save(daemon: &FusedevDaemon) -> DaemonResult<()> {
+        let mgr = daemon.upgrade_mgr().ok_or(DaemonError::Unsupported)?;
+        let session = daemon.session.lock().unwrap();
+        let file = session.get_fuse_file().ok_or(DaemonError::NotReady)?;
+
+        mgr.save(file.as_raw_fd())
     }
 
-    pub fn restore(_daemon: &FusedevDaemon) -> DaemonResult<()> {
+    pub fn restore(daemon: &FusedevDaemon) -> DaemonResult<()> {
+        let mut mgr = daemon.upgrade_mgr().ok_or(DaemonError::Unsupported)?;
+        let (mounts, file) = mgr.restore()?;
+
+        daemon.session.lock().unwrap().set_fuse_file(file);
+        // The kernel keeps the inode numbers encoding the VFS indexes, so the filesystems must
+        // be mounted at the same indexes.
+        for m in mounts {
+            daemon.restore_mount(&m.cmd, m.vfs_index)?;
+            add_mounts_state(&mut mgr, m.cmd, m.vfs_index)?;
+        }
+
         Ok(())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use nydus::FsBackendType;
+
+    fn mount_cmd(mountpoint: &str, source: &str) -> FsBackendMountCmd {
+        FsBackendMountCmd {
+            fs_type: FsBackendType::Rafs,
+            source: source.to_string(),
+            config: "{}".to_string(),
+            mountpoint: mountpoint.to_string(),
+            prefetch_files: None,
+            tenant: None,
+            overlay: None,
+        }
+    }
+
+    #[test]
+    fn test_mounts_state() {
+        let mut mgr = UpgradeManager {
+            supervisor: PathBuf::from("/tmp/supervisor.sock"),
+            mounts: HashMap::new(),
+        };
+
+        add_mounts_state(&mut mgr, mount_cmd("/a", "bootstrap-a"), 1).unwrap();
+        add_mounts_state(&mut mgr, mount_cmd("/b", "bootstrap-b"), 2).unwrap();
+        update_mounts_state(&mut mgr, mount_cmd("/a", "bootstrap-c")).unwrap();
+        assert!(update_mounts_state(&mut mgr, mount_cmd("/c", "bootstrap-c")).is_err());
+        assert_eq!(mgr.mounts["/a"].cmd.source, "bootstrap-c");
+        assert_eq!(mgr.mounts["/a"].vfs_index, 1);
+
+        remove_mounts_state(
+            &mut mgr,
+            FsBackendUmountCmd {
+                mountpoint: "/b".to_string(),
+            },
+        )
+        .unwrap();
+        assert_eq!(mgr.mounts.len(), 1);
+    }
+}
@@ -53,12 +53,33 @@ impl Display for FsBackendType {
     }
 }
 
+/// Writable overlayfs composed over a filesystem instance, whose lower directory is the
+/// instance in the fuse mountpoint.
+#[derive(Clone, Debug, Serialize, PartialEq, Deserialize)]
+pub struct FsBackendOverlay {
+    /// Upper directory keeping the changes, removed when the instance is umounted.
+    pub upper_dir: String,
+    /// Work directory of overlayfs, removed when the instance is umounted.
+    pub work_dir: String,
+    /// Where the overlay is mounted.
+    pub target: String,
+}
+
 #[serde_as]
 #[derive(Serialize, Clone, Deserialize)]
 pub struct FsBackendDesc {
     pub backend_type: FsBackendType,
     pub mountpoint: String,
+    /// Bootstrap of Rafs, or the shared directory of passthroughfs.
+    #[serde(default)]
+    pub source: String,
+    /// Tenant owning the instance on a daemon shared by multiple tenants.
+    #[serde(default)]
+    pub tenant: Option<String>,
     #[serde_as(as = "DisplayFromStr")]
     pub mounted_time: DateTime<Local>,
     pub config: Option<serde_json::Value>,
+    /// Writable overlay mounted over the instance.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub overlay: Option<FsBackendOverlay>,
 }
@@ -0,0 +1,404 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Storage backend driver to access blobs on Azure Blob Storage.
+use std::env;
+use std::io::{Error, Result};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use nydus_utils::metrics::BackendMetrics;
+use reqwest::blocking::Client;
+use reqwest::header::{HeaderMap, CONTENT_LENGTH};
+use reqwest::Method;
+
+use crate::backend::connection::{Connection, ConnectionError};
+use crate::backend::{BackendError, BackendResult, BlobBackend, BlobReader, CommonConfig};
+
+const HEADER_AUTHORIZATION: &str = "Authorization";
+const HEADER_MS_VERSION: &str = "x-ms-version";
+const HEADER_MS_DATE: &str = "x-ms-date";
+const API_VERSION: &str = "2020-10-02";
+
+/// Azure instance metadata service, used to get access token of managed identity.
+const METADATA_ENDPOINT: &str = "http://169.254.169.254/metadata/identity/oauth2/token";
+const STORAGE_RESOURCE: &str = "https://storage.azure.com/";
+const METADATA_TIMEOUT: u64 = 10;
+/// Refresh the access token 5 minutes before expiration.
+const TOKEN_REFRESH_SECS: u64 = 300;
+
+/// Error codes related to Azure storage backend.
+#[derive(Debug)]
+pub enum AzureError {
+    Auth(Error),
+    Request(ConnectionError),
+    ConstructHeader(String),
+    Transport(reqwest::Error),
+    Response(String),
+}
+
+impl From<AzureError> for BackendError {
+    fn from(error: AzureError) -> Self {
+        BackendError::Azure(error)
+    }
+}
+
+#[derive(Clone, Deserialize, Serialize)]
+struct AzureConfig {
+    /// Default to `https://<account_name>.blob.core.windows.net`.
+    #[serde(default)]
+    endpoint: String,
+    #[serde(default)]
+    account_name: String,
+    container_name: String,
+    /// Prefix object_prefix to blob name, for example the simulation of subdirectory:
+    /// - object_key: sha256:xxx
+    /// - object_prefix: nydus/
+    /// - object_key with object_prefix: nydus/sha256:xxx
+    #[serde(default)]
+    object_prefix: String,
+    /// Shared access signature, with or without the leading `?`.
+    #[serde(default)]
+    sas_token: String,
+    /// Use the managed identity of Azure VM or AKS pod identity if no SAS token is specified,
+    /// `client_id` selects a user-assigned identity.
+    #[serde(default)]
+    client_id: String,
+}
+
+#[derive(Deserialize)]
+struct ManagedIdentityToken {
+    access_token: String,
+    /// Seconds since epoch.
+    expires_on: String,
+}
+
+#[derive(Debug)]
+struct AzureState {
+    endpoint: String,
+    container_name: String,
+    object_prefix: String,
+    sas_token: String,
+    client_id: String,
+    /// The cached access token of managed identity and its expiration in seconds since epoch.
+    token: Mutex<Option<(String, u64)>>,
+    retry_limit: u8,
+}
+
+fn now_secs() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+impl AzureState {
+    fn url(&self, object_key: &str) -> String {
+        let url = format!(
+            "{}/{}/{}{}",
+            self.endpoint, self.container_name, self.object_prefix, object_key
+        );
+        if self.sas_token.is_empty() {
+            url
+        } else {
+            format!("{}?{}", url, self.sas_token)
+        }
+    }
+
+    fn get_token(&self) -> Result<String> {
+        let mut cached = self.token.lock().unwrap();
+        if let Some((token, expiration)) = cached.as_ref() {
+            if *expiration > now_secs() + TOKEN_REFRESH_SECS {
+                return Ok(token.clone());
+            }
+        }
+
+        let endpoint =
+            env::var("AZURE_METADATA_ENDPOINT").unwrap_or_else(|_| METADATA_ENDPOINT.to_string());
+        let mut query = vec![
+            ("api-version", "2018-02-01"),
+            ("resource", STORAGE_RESOURCE),
+        ];
+        if !self.client_id.is_empty() {
+            query.push(("client_id", self.client_id.as_str()));
+        }
+        let client = Client::builder()
+            .timeout(Duration::from_secs(METADATA_TIMEOUT))
+            .build()
+            .map_err(|e| einval!(e))?;
+        let resp = client
+            .get(endpoint.as_str())
+            .query(&query)
+            .header("Metadata", "true")
+            .send()
+            .map_err(|e| eother!(format!("get managed identity token: {}", e)))?;
+        if !resp.status().is_success() {
+            return Err(eother!(format!(
+                "get managed identity token: unexpected status {}",
+                resp.status()
+            )));
+        }
+        let token: ManagedIdentityToken = resp.json().map_err(|e| eother!(e))?;
+        let expiration = token
+            .expires_on
+            .parse::<u64>()
+            .map_err(|e| einval!(format!("invalid managed identity token expiration: {}", e)))?;
+        *cached = Some((token.access_token.clone(), expiration));
+
+        Ok(token.access_token)
+    }
+
+    /// Set the version and date headers, and the bearer token of managed identity if no SAS
+    /// token is specified.
+    fn sign(&self, headers: &mut HeaderMap) -> Result<()> {
+        let date = httpdate::fmt_http_date(SystemTime::now());
+        headers.insert(
+            HEADER_MS_VERSION,
+            API_VERSION.parse().map_err(|e| einval!(e))?,
+        );
+        headers.insert(
+            HEADER_MS_DATE,
+            date.as_str().parse().map_err(|e| einval!(e))?,
+        );
+        if self.sas_token.is_empty() {
+            let authorization = format!("Bearer {}", self.get_token()?);
+            headers.insert(
+                HEADER_AUTHORIZATION,
+                authorization.as_str().parse().map_err(|e| einval!(e))?,
+            );
+        }
+
+        Ok(())
+    }
+}
+
+struct AzureReader {
+    blob_id: String,
+    connection: Arc<Connection>,
+    state: Arc<AzureState>,
+    metrics: Arc<BackendMetrics>,
+}
+
+impl BlobReader for AzureReader {
+    fn blob_size(&self) -> BackendResult<u64> {
+        let url = self.state.url(&self.blob_id);
+        let mut headers = HeaderMap::new();
+        self.state.sign(&mut headers).map_err(AzureError::Auth)?;
+
+        let resp = self
+            .connection
+            .call::<&[u8]>(Method::HEAD, url.as_str(), None, None, headers, true)
+            .map_err(AzureError::Request)?;
+        let content_length = resp
+            .headers()
+            .get(CONTENT_LENGTH)
+            .ok_or_else(|| AzureError::Response("invalid content length".to_string()))?;
+
+        Ok(content_length
+            .to_str()
+            .map_err(|err| AzureError::Response(format!("invalid content length: {:?}", err)))?
+            .parse::<u64>()
+            .map_err(|err| AzureError::Response(format!("invalid content length: {:?}", err)))?)
+    }
+
+    fn try_read(&self, mut buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        let url = self.state.url(&self.blob_id);
+        let mut headers = HeaderMap::new();
+        let end_at = offset + buf.len() as u64 - 1;
+        let range = format!("bytes={}-{}", offset, end_at);
+
+        headers.insert(
+            "Range",
+            range
+                .as_str()
+                .parse()
+                .map_err(|e| AzureError::ConstructHeader(format!("{}", e)))?,
+        );
+        self.state.sign(&mut headers).map_err(AzureError::Auth)?;
+
+        // Safe because the the call() is a synchronous operation.
+        let mut resp = self
+            .connection
+            .call::<&[u8]>(Method::GET, url.as_str(), None, None, headers, true)
+            .map_err(AzureError::Request)?;
+
+        Ok(resp
+            .copy_to(&mut buf)
+            .map_err(AzureError::Transport)
+            .map(|size| size as usize)?)
+    }
+
+    fn prefetch_blob_data_range(&self, _ra_offset: u32, _ra_size: u32) -> BackendResult<()> {
+        Err(BackendError::Unsupported(
+            "Azure backend does not support prefetch as per on-disk blob entries".to_string(),
+        ))
+    }
+
+    fn stop_data_prefetch(&self) -> BackendResult<()> {
+        Err(BackendError::Unsupported(
+            "Azure backend does not support prefetch as per on-disk blob entries".to_string(),
+        ))
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        &self.metrics
+    }
+
+    fn retry_limit(&self) -> u8 {
+        self.state.retry_limit
+    }
+}
+
+/// Storage backend to access data stored in Azure Blob Storage.
+#[derive(Debug)]
+pub struct Azure {
+    connection: Arc<Connection>,
+    state: Arc<AzureState>,
+    metrics: Option<Arc<BackendMetrics>>,
+    id: Option<String>,
+}
+
+impl Azure {
+    /// Create a new Azure storage backend.
+    pub fn new(config: serde_json::value::Value, id: Option<&str>) -> Result<Azure> {
+        let common_config: CommonConfig =
+            serde_json::from_value(config.clone()).map_err(|e| einval!(e))?;
+        let retry_limit = common_config.retry_limit;
+        let connection = Connection::new(&common_config)?;
+        let azure_config: AzureConfig = serde_json::from_value(config).map_err(|e| einval!(e))?;
+        if azure_config.container_name.is_empty() {
+            return Err(einval!("no container is specified for Azure backend"));
+        }
+        let endpoint = if !azure_config.endpoint.is_empty() {
+            azure_config.endpoint.trim_end_matches('/').to_string()
+        } else if !azure_config.account_name.is_empty() {
+            format!(
+                "https://{}.blob.core.windows.net",
+                azure_config.account_name
+            )
+        } else {
+            return Err(einval!(
+                "no endpoint or account is specified for Azure backend"
+            ));
+        };
+        let state = Arc::new(AzureState {
+            endpoint,
+            container_name: azure_config.container_name,
+            object_prefix: azure_config.object_prefix,
+            sas_token: azure_config.sas_token.trim_start_matches('?').to_string(),
+            client_id: azure_config.client_id,
+            token: Mutex::new(None),
+            retry_limit,
+        });
+        let metrics = id.map(|i| BackendMetrics::new(i, "azure"));
+
+        Ok(Azure {
+            state,
+            connection,
+            metrics,
+            id: id.map(|i| i.to_string()),
+        })
+    }
+}
+
+impl BlobBackend for Azure {
+    fn shutdown(&self) {
+        self.connection.shutdown();
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        // `metrics()` is only used for nydusd, which will always provide valid `blob_id`, thus
+        // `self.metrics` has valid value.
+        self.metrics.as_ref().unwrap()
+    }
+
+    fn get_reader(&self, blob_id: &str) -> BackendResult<Arc<dyn BlobReader>> {
+        if let Some(metrics) = self.metrics.as_ref() {
+            Ok(Arc::new(AzureReader {
+                blob_id: blob_id.to_string(),
+                state: self.state.clone(),
+                connection: self.connection.clone(),
+                metrics: metrics.clone(),
+            }))
+        } else {
+            Err(BackendError::Unsupported(
+                "no metrics object available for AzureReader".to_string(),
+            ))
+        }
+    }
+}
+
+impl Drop for Azure {
+    fn drop(&mut self) {
+        if let Some(metrics) = self.metrics.as_ref() {
+            metrics.release().unwrap_or_else(|e| error!("{:?}", e));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::Value;
+
+    #[test]
+    fn test_azure_state() {
+        let state = AzureState {
+            endpoint: "https://account.blob.core.windows.net".to_string(),
+            container_name: "images".to_string(),
+            object_prefix: "nydus/".to_string(),
+            sas_token: "sv=2020-10-02&sig=xxx".to_string(),
+            client_id: "".to_string(),
+            token: Mutex::new(None),
+            retry_limit: 5,
+        };
+        assert_eq!(
+            state.url("obj_key"),
+            "https://account.blob.core.windows.net/images/nydus/obj_key?sv=2020-10-02&sig=xxx"
+        );
+
+        // No bearer token with SAS token.
+        let mut headers = HeaderMap::new();
+        state.sign(&mut headers).unwrap();
+        assert_eq!(headers.get(HEADER_MS_VERSION).unwrap(), API_VERSION);
+        assert!(headers.get(HEADER_MS_DATE).is_some());
+        assert!(headers.get(HEADER_AUTHORIZATION).is_none());
+
+        // The cached token of managed identity before expiration.
+        let state = AzureState {
+            sas_token: "".to_string(),
+            token: Mutex::new(Some(("token".to_string(), now_secs() + 3600))),
+            ..state
+        };
+        assert_eq!(
+            state.url("obj_key"),
+            "https://account.blob.core.windows.net/images/nydus/obj_key"
+        );
+        let mut headers = HeaderMap::new();
+        state.sign(&mut headers).unwrap();
+        assert_eq!(headers.get(HEADER_AUTHORIZATION).unwrap(), "Bearer token");
+    }
+
+    #[test]
+    fn test_azure_new() {
+        let json_str = "{\"account_name\":\"account\",\"container_name\":\"images\",\"sas_token\":\"?sv=2020-10-02&sig=xxx\",\"proxy\":{\"url\":\"\",\"ping_url\":\"\",\"fallback\":true,\"check_interval\":5},\"timeout\":5,\"connect_timeout\":5,\"retry_limit\":5}";
+        let json: Value = serde_json::from_str(&json_str).unwrap();
+        let azure = Azure::new(json, Some("test-image")).unwrap();
+        assert_eq!(
+            azure.state.endpoint,
+            "https://account.blob.core.windows.net"
+        );
+        assert_eq!(azure.state.sas_token, "sv=2020-10-02&sig=xxx");
+
+        azure.metrics();
+
+        let reader = azure.get_reader("test").unwrap();
+        assert_eq!(reader.retry_limit(), 5);
+
+        azure.shutdown();
+
+        let json: Value = serde_json::from_str("{\"container_name\":\"images\"}").unwrap();
+        assert!(Azure::new(json, Some("test-image")).is_err());
+    }
+}
@@ -0,0 +1,281 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Fault injection of storage backends for resilience testing.
+//!
+//! When the `fault_injection` object is set in the backend configuration, the read requests
+//! randomly fail, get delayed or return corrupted data at the configured rates, to validate the
+//! retry, proxy fallback and data digest validation in staging environments. It must not be
+//! enabled in production.
+
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use nydus_utils::metrics::BackendMetrics;
+
+use crate::backend::{BackendError, BackendResult, BlobBackend, BlobReader};
+
+/// Configuration information for fault injection, the rates are probabilities in [0, 1].
+#[derive(Clone, Debug, Default, Deserialize, Serialize)]
+#[serde(default)]
+pub struct FaultInjectionConfig {
+    /// Probability of a read request to fail.
+    pub error_rate: f64,
+    /// Probability of a read request to be delayed by `latency_ms`.
+    pub latency_rate: f64,
+    /// Injected latency in milliseconds.
+    pub latency_ms: u64,
+    /// Probability of a read request to return data with a corrupted byte.
+    pub corrupt_rate: f64,
+    /// Seed of the random numbers to reproduce faults, seeded by current time if zero.
+    pub seed: u64,
+}
+
+impl FaultInjectionConfig {
+    fn validate(&self) -> std::io::Result<()> {
+        for (name, rate) in &[
+            ("error_rate", self.error_rate),
+            ("latency_rate", self.latency_rate),
+            ("corrupt_rate", self.corrupt_rate),
+        ] {
+            if !(0.0..=1.0).contains(rate) {
+                return Err(einval!(format!(
+                    "fault injection {} {} should be in [0, 1]",
+                    name, rate
+                )));
+            }
+        }
+        Ok(())
+    }
+}
+
+/// A xorshift64* pseudo random number generator, which is good enough to decide faults.
+struct Rng(Mutex<u64>);
+
+impl Rng {
+    fn new(seed: u64) -> Self {
+        let seed = if seed != 0 {
+            seed
+        } else {
+            SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map(|d| d.as_nanos() as u64)
+                .unwrap_or(0)
+        };
+        // The state must not be zero.
+        Rng(Mutex::new(seed | 1))
+    }
+
+    fn next_u64(&self) -> u64 {
+        let mut state = self.0.lock().unwrap();
+        *state ^= *state >> 12;
+        *state ^= *state << 25;
+        *state ^= *state >> 27;
+        state.wrapping_mul(0x2545_f491_4f6c_dd1d)
+    }
+
+    /// Return true with probability of `rate`.
+    fn hit(&self, rate: f64) -> bool {
+        rate > 0.0 && ((self.next_u64() >> 11) as f64 / (1u64 << 53) as f64) < rate
+    }
+}
+
+/// A storage backend injecting faults into the read requests.
+pub struct FaultInjectedBackend {
+    backend: Arc<dyn BlobBackend + Send + Sync>,
+    config: FaultInjectionConfig,
+    rng: Arc<Rng>,
+}
+
+impl FaultInjectedBackend {
+    /// Create a fault injected backend.
+    pub fn new(
+        backend: Arc<dyn BlobBackend + Send + Sync>,
+        config: FaultInjectionConfig,
+    ) -> std::io::Result<Self> {
+        config.validate()?;
+        warn!(
+            "fault injection of storage backend is enabled: {:?}",
+            config
+        );
+
+        Ok(FaultInjectedBackend {
+            backend,
+            rng: Arc::new(Rng::new(config.seed)),
+            config,
+        })
+    }
+}
+
+impl BlobBackend for FaultInjectedBackend {
+    fn shutdown(&self) {
+        self.backend.shutdown()
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        self.backend.metrics()
+    }
+
+    fn get_reader(&self, blob_id: &str) -> BackendResult<Arc<dyn BlobReader>> {
+        let reader = self.backend.get_reader(blob_id)?;
+
+        Ok(Arc::new(FaultInjectedReader {
+            reader,
+            config: self.config.clone(),
+            rng: self.rng.clone(),
+        }))
+    }
+}
+
+// The default `read()` and `readv()` are used, so the injected errors go through the retry of
+// storage backend, and the vectored read of localfs backend is not used.
+struct FaultInjectedReader {
+    reader: Arc<dyn BlobReader>,
+    config: FaultInjectionConfig,
+    rng: Arc<Rng>,
+}
+
+impl BlobReader for FaultInjectedReader {
+    fn blob_size(&self) -> BackendResult<u64> {
+        self.reader.blob_size()
+    }
+
+    fn try_read(&self, buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        if self.rng.hit(self.config.latency_rate) {
+            thread::sleep(Duration::from_millis(self.config.latency_ms));
+        }
+        if self.rng.hit(self.config.error_rate) {
+            return Err(BackendError::FaultInjection(format!(
+                "injected error of reading {} bytes at {}",
+                buf.len(),
+                offset
+            )));
+        }
+
+        let size = self.reader.try_read(buf, offset)?;
+        if size > 0 && self.rng.hit(self.config.corrupt_rate) {
+            let pos = (self.rng.next_u64() % size as u64) as usize;
+            buf[pos] = !buf[pos];
+            debug!("injected corruption at {} of data read at {}", pos, offset);
+        }
+
+        Ok(size)
+    }
+
+    fn prefetch_blob_data_range(&self, ra_offset: u32, ra_size: u32) -> BackendResult<()> {
+        self.reader.prefetch_blob_data_range(ra_offset, ra_size)
+    }
+
+    fn stop_data_prefetch(&self) -> BackendResult<()> {
+        self.reader.stop_data_prefetch()
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        self.reader.metrics()
+    }
+
+    fn retry_limit(&self) -> u8 {
+        self.reader.retry_limit()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct MockReader {
+        metrics: Arc<BackendMetrics>,
+    }
+
+    impl BlobReader for MockReader {
+        fn blob_size(&self) -> BackendResult<u64> {
+            Ok(4096)
+        }
+
+        fn try_read(&self, buf: &mut [u8], _offset: u64) -> BackendResult<usize> {
+            for b in buf.iter_mut() {
+                *b = 0x5a;
+            }
+            Ok(buf.len())
+        }
+
+        fn prefetch_blob_data_range(&self, _ra_offset: u32, _ra_size: u32) -> BackendResult<()> {
+            Ok(())
+        }
+
+        fn stop_data_prefetch(&self) -> BackendResult<()> {
+            Ok(())
+        }
+
+        fn metrics(&self) -> &BackendMetrics {
+            &self.metrics
+        }
+    }
+
+    fn new_reader(config: FaultInjectionConfig) -> FaultInjectedReader {
+        FaultInjectedReader {
+            reader: Arc::new(MockReader {
+                metrics: BackendMetrics::new("fault-test", "mock"),
+            }),
+            rng: Arc::new(Rng::new(config.seed)),
+            config,
+        }
+    }
+
+    #[test]
+    fn test_fault_injection_config() {
+        let config: FaultInjectionConfig =
+            serde_json::from_str(r#"{"error_rate": 0.1, "seed": 1}"#).unwrap();
+        assert!((config.error_rate - 0.1).abs() < f64::EPSILON);
+        assert!(config.corrupt_rate.abs() < f64::EPSILON);
+        assert!(config.validate().is_ok());
+
+        let config = FaultInjectionConfig {
+            corrupt_rate: 1.5,
+            ..Default::default()
+        };
+        assert!(config.validate().is_err());
+    }
+
+    #[test]
+    fn test_fault_injected_reader() {
+        let mut buf = [0u8; 16];
+
+        // No faults at rate 0.
+        let reader = new_reader(FaultInjectionConfig::default());
+        for _ in 0..100 {
+            assert_eq!(reader.try_read(&mut buf, 0).unwrap(), 16);
+            assert!(buf.iter().all(|b| *b == 0x5a));
+        }
+
+        // Always fail at rate 1.
+        let reader = new_reader(FaultInjectionConfig {
+            error_rate: 1.0,
+            seed: 1,
+            ..Default::default()
+        });
+        assert!(reader.try_read(&mut buf, 0).is_err());
+
+        // Exactly one byte is corrupted.
+        let reader = new_reader(FaultInjectionConfig {
+            corrupt_rate: 1.0,
+            seed: 1,
+            ..Default::default()
+        });
+        assert_eq!(reader.try_read(&mut buf, 0).unwrap(), 16);
+        assert_eq!(buf.iter().filter(|b| **b != 0x5a).count(), 1);
+
+        // Roughly half of requests fail at rate 0.5.
+        let reader = new_reader(FaultInjectionConfig {
+            error_rate: 0.5,
+            seed: 1,
+            ..Default::default()
+        });
+        let failed = (0..1000)
+            .filter(|_| reader.try_read(&mut buf, 0).is_err())
+            .count();
+        assert!(failed > 400 && failed < 600);
+    }
+}
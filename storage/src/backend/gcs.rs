@@ -0,0 +1,515 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Storage backend driver to access blobs on Google Cloud Storage.
+use std::env;
+use std::fs;
+use std::io::{Error, Result};
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use nydus_utils::metrics::BackendMetrics;
+use openssl::hash::MessageDigest;
+use openssl::pkey::PKey;
+use openssl::sign::Signer;
+use reqwest::blocking::{Client, RequestBuilder};
+use reqwest::header::HeaderMap;
+use reqwest::Method;
+
+use crate::backend::connection::{Connection, ConnectionError};
+use crate::backend::{BackendError, BackendResult, BlobBackend, BlobReader, CommonConfig};
+
+const HEADER_AUTHORIZATION: &str = "Authorization";
+
+const GCS_ENDPOINT: &str = "https://storage.googleapis.com";
+const GCS_SCOPE: &str = "https://www.googleapis.com/auth/devstorage.read_only";
+const TOKEN_ENDPOINT: &str = "https://oauth2.googleapis.com/token";
+/// Metadata server to get access token of the attached service account on GCE and GKE.
+const METADATA_ENDPOINT: &str =
+    "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token";
+const TOKEN_TIMEOUT: u64 = 30;
+/// Refresh the access token 5 minutes before expiration.
+const TOKEN_REFRESH_SECS: u64 = 300;
+/// Lifetime of the self signed JWT to exchange access token.
+const JWT_LIFETIME_SECS: u64 = 3600;
+
+/// Error codes related to GCS storage backend.
+#[derive(Debug)]
+pub enum GcsError {
+    Auth(Error),
+    Request(ConnectionError),
+    ConstructHeader(String),
+    Transport(reqwest::Error),
+    Response(String),
+}
+
+impl From<GcsError> for BackendError {
+    fn from(error: GcsError) -> Self {
+        BackendError::Gcs(error)
+    }
+}
+
+#[derive(Clone, Deserialize, Serialize)]
+struct GcsConfig {
+    /// Default to `https://storage.googleapis.com`.
+    #[serde(default)]
+    endpoint: String,
+    bucket_name: String,
+    /// Prefix object_prefix to GCS object name, for example the simulation of subdirectory:
+    /// - object_key: sha256:xxx
+    /// - object_prefix: nydus/
+    /// - object_key with object_prefix: nydus/sha256:xxx
+    #[serde(default)]
+    object_prefix: String,
+    /// Service account key or authorized user credentials file, default to
+    /// `GOOGLE_APPLICATION_CREDENTIALS` or the well-known file created by
+    /// `gcloud auth application-default login`. The metadata server is used if no credentials
+    /// file is found.
+    #[serde(default)]
+    credentials_file: String,
+}
+
+#[derive(Clone, Debug, Deserialize)]
+struct GcsCredentialsFile {
+    #[serde(rename = "type")]
+    kind: String,
+    #[serde(default)]
+    client_email: String,
+    #[serde(default)]
+    private_key: String,
+    #[serde(default)]
+    token_uri: String,
+    #[serde(default)]
+    client_id: String,
+    #[serde(default)]
+    client_secret: String,
+    #[serde(default)]
+    refresh_token: String,
+}
+
+#[derive(Deserialize)]
+struct AccessToken {
+    access_token: String,
+    expires_in: u64,
+}
+
+fn now_secs() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+fn find_credentials_file(path: &str) -> Result<Option<GcsCredentialsFile>> {
+    let path = if !path.is_empty() {
+        PathBuf::from(path)
+    } else if let Ok(path) = env::var("GOOGLE_APPLICATION_CREDENTIALS") {
+        PathBuf::from(path)
+    } else {
+        match env::var("HOME") {
+            Ok(home) => {
+                let path =
+                    PathBuf::from(home).join(".config/gcloud/application_default_credentials.json");
+                if !path.exists() {
+                    return Ok(None);
+                }
+                path
+            }
+            Err(_) => return Ok(None),
+        }
+    };
+
+    let data = fs::read(&path)
+        .map_err(|e| eother!(format!("read GCS credentials file {:?}: {}", path, e)))?;
+    let mut creds: GcsCredentialsFile = serde_json::from_slice(&data)
+        .map_err(|e| einval!(format!("parse GCS credentials file {:?}: {}", path, e)))?;
+    if creds.kind != "service_account" && creds.kind != "authorized_user" {
+        return Err(einval!(format!(
+            "unsupported GCS credentials type {}",
+            creds.kind
+        )));
+    }
+    if creds.token_uri.is_empty() {
+        creds.token_uri = TOKEN_ENDPOINT.to_string();
+    }
+
+    Ok(Some(creds))
+}
+
+/// Encode the object name as a path segment of GCS JSON API.
+fn encode_object_name(input: &str) -> String {
+    let mut encoded = String::with_capacity(input.len());
+    for byte in input.bytes() {
+        match byte {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' => {
+                encoded.push(byte as char)
+            }
+            _ => encoded.push_str(&format!("%{:02X}", byte)),
+        }
+    }
+    encoded
+}
+
+#[derive(Debug)]
+struct GcsState {
+    endpoint: String,
+    bucket_name: String,
+    object_prefix: String,
+    credentials: Option<GcsCredentialsFile>,
+    /// The cached access token and its expiration in seconds since epoch.
+    token: Mutex<Option<(String, u64)>>,
+    retry_limit: u8,
+}
+
+impl GcsState {
+    fn url(&self, object_key: &str, media: bool) -> String {
+        let object_name = format!("{}{}", self.object_prefix, object_key);
+        let url = format!(
+            "{}/storage/v1/b/{}/o/{}",
+            self.endpoint,
+            self.bucket_name,
+            encode_object_name(&object_name)
+        );
+        if media {
+            format!("{}?alt=media", url)
+        } else {
+            url
+        }
+    }
+
+    /// Sign a JWT by the private key of service account, see
+    /// https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+    fn sign_jwt(creds: &GcsCredentialsFile, now: u64) -> Result<String> {
+        let header = base64::encode_config(
+            "{\"alg\":\"RS256\",\"typ\":\"JWT\"}",
+            base64::URL_SAFE_NO_PAD,
+        );
+        let claims = serde_json::json!({
+            "iss": creds.client_email,
+            "scope": GCS_SCOPE,
+            "aud": creds.token_uri,
+            "iat": now,
+            "exp": now + JWT_LIFETIME_SECS,
+        });
+        let claims = base64::encode_config(claims.to_string(), base64::URL_SAFE_NO_PAD);
+        let payload = format!("{}.{}", header, claims);
+
+        let key = PKey::private_key_from_pem(creds.private_key.as_bytes())
+            .map_err(|e| einval!(format!("parse GCS private key: {}", e)))?;
+        let mut signer = Signer::new(MessageDigest::sha256(), &key).map_err(|e| eother!(e))?;
+        signer.update(payload.as_bytes()).map_err(|e| eother!(e))?;
+        let signature = signer.sign_to_vec().map_err(|e| eother!(e))?;
+
+        Ok(format!(
+            "{}.{}",
+            payload,
+            base64::encode_config(&signature, base64::URL_SAFE_NO_PAD)
+        ))
+    }
+
+    fn token_request(&self, client: &Client) -> Result<RequestBuilder> {
+        let creds = match self.credentials.as_ref() {
+            Some(creds) => creds,
+            None => {
+                return Ok(client
+                    .get(METADATA_ENDPOINT)
+                    .header("Metadata-Flavor", "Google"))
+            }
+        };
+
+        let req = client.post(creds.token_uri.as_str());
+        if creds.kind == "service_account" {
+            let assertion = Self::sign_jwt(creds, now_secs())?;
+            Ok(req.form(&[
+                ("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer"),
+                ("assertion", assertion.as_str()),
+            ]))
+        } else {
+            Ok(req.form(&[
+                ("grant_type", "refresh_token"),
+                ("client_id", creds.client_id.as_str()),
+                ("client_secret", creds.client_secret.as_str()),
+                ("refresh_token", creds.refresh_token.as_str()),
+            ]))
+        }
+    }
+
+    fn get_token(&self) -> Result<String> {
+        let mut cached = self.token.lock().unwrap();
+        if let Some((token, expiration)) = cached.as_ref() {
+            if *expiration > now_secs() + TOKEN_REFRESH_SECS {
+                return Ok(token.clone());
+            }
+        }
+
+        let client = Client::builder()
+            .timeout(Duration::from_secs(TOKEN_TIMEOUT))
+            .build()
+            .map_err(|e| einval!(e))?;
+        let resp = self
+            .token_request(&client)?
+            .send()
+            .map_err(|e| eother!(format!("get GCS access token: {}", e)))?;
+        if !resp.status().is_success() {
+            return Err(eother!(format!(
+                "get GCS access token: unexpected status {}",
+                resp.status()
+            )));
+        }
+        let token: AccessToken = resp.json().map_err(|e| eother!(e))?;
+        *cached = Some((token.access_token.clone(), now_secs() + token.expires_in));
+
+        Ok(token.access_token)
+    }
+
+    fn sign(&self, headers: &mut HeaderMap) -> Result<()> {
+        let authorization = format!("Bearer {}", self.get_token()?);
+        headers.insert(
+            HEADER_AUTHORIZATION,
+            authorization.as_str().parse().map_err(|e| einval!(e))?,
+        );
+        Ok(())
+    }
+}
+
+#[derive(Deserialize)]
+struct ObjectMetadata {
+    size: String,
+}
+
+struct GcsReader {
+    blob_id: String,
+    connection: Arc<Connection>,
+    state: Arc<GcsState>,
+    metrics: Arc<BackendMetrics>,
+}
+
+impl BlobReader for GcsReader {
+    fn blob_size(&self) -> BackendResult<u64> {
+        let url = self.state.url(&self.blob_id, false);
+        let mut headers = HeaderMap::new();
+        self.state.sign(&mut headers).map_err(GcsError::Auth)?;
+
+        let resp = self
+            .connection
+            .call::<&[u8]>(Method::GET, url.as_str(), None, None, headers, true)
+            .map_err(GcsError::Request)?;
+        let metadata: ObjectMetadata = resp.json().map_err(GcsError::Transport)?;
+
+        Ok(metadata
+            .size
+            .parse::<u64>()
+            .map_err(|err| GcsError::Response(format!("invalid object size: {:?}", err)))?)
+    }
+
+    fn try_read(&self, mut buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        let url = self.state.url(&self.blob_id, true);
+        let mut headers = HeaderMap::new();
+        let end_at = offset + buf.len() as u64 - 1;
+        let range = format!("bytes={}-{}", offset, end_at);
+
+        headers.insert(
+            "Range",
+            range
+                .as_str()
+                .parse()
+                .map_err(|e| GcsError::ConstructHeader(format!("{}", e)))?,
+        );
+        self.state.sign(&mut headers).map_err(GcsError::Auth)?;
+
+        // Safe because the the call() is a synchronous operation.
+        let mut resp = self
+            .connection
+            .call::<&[u8]>(Method::GET, url.as_str(), None, None, headers, true)
+            .map_err(GcsError::Request)?;
+
+        Ok(resp
+            .copy_to(&mut buf)
+            .map_err(GcsError::Transport)
+            .map(|size| size as usize)?)
+    }
+
+    fn prefetch_blob_data_range(&self, _ra_offset: u32, _ra_size: u32) -> BackendResult<()> {
+        Err(BackendError::Unsupported(
+            "GCS backend does not support prefetch as per on-disk blob entries".to_string(),
+        ))
+    }
+
+    fn stop_data_prefetch(&self) -> BackendResult<()> {
+        Err(BackendError::Unsupported(
+            "GCS backend does not support prefetch as per on-disk blob entries".to_string(),
+        ))
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        &self.metrics
+    }
+
+    fn retry_limit(&self) -> u8 {
+        self.state.retry_limit
+    }
+}
+
+/// Storage backend to access data stored in Google Cloud Storage.
+#[derive(Debug)]
+pub struct Gcs {
+    connection: Arc<Connection>,
+    state: Arc<GcsState>,
+    metrics: Option<Arc<BackendMetrics>>,
+    id: Option<String>,
+}
+
+impl Gcs {
+    /// Create a new GCS storage backend.
+    pub fn new(config: serde_json::value::Value, id: Option<&str>) -> Result<Gcs> {
+        let common_config: CommonConfig =
+            serde_json::from_value(config.clone()).map_err(|e| einval!(e))?;
+        let retry_limit = common_config.retry_limit;
+        let connection = Connection::new(&common_config)?;
+        let gcs_config: GcsConfig = serde_json::from_value(config).map_err(|e| einval!(e))?;
+        if gcs_config.bucket_name.is_empty() {
+            return Err(einval!("no bucket is specified for GCS backend"));
+        }
+        let endpoint = if gcs_config.endpoint.is_empty() {
+            GCS_ENDPOINT.to_string()
+        } else {
+            gcs_config.endpoint.trim_end_matches('/').to_string()
+        };
+        let state = Arc::new(GcsState {
+            endpoint,
+            bucket_name: gcs_config.bucket_name,
+            object_prefix: gcs_config.object_prefix,
+            credentials: find_credentials_file(&gcs_config.credentials_file)?,
+            token: Mutex::new(None),
+            retry_limit,
+        });
+        let metrics = id.map(|i| BackendMetrics::new(i, "gcs"));
+
+        Ok(Gcs {
+            state,
+            connection,
+            metrics,
+            id: id.map(|i| i.to_string()),
+        })
+    }
+}
+
+impl BlobBackend for Gcs {
+    fn shutdown(&self) {
+        self.connection.shutdown();
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        // `metrics()` is only used for nydusd, which will always provide valid `blob_id`, thus
+        // `self.metrics` has valid value.
+        self.metrics.as_ref().unwrap()
+    }
+
+    fn get_reader(&self, blob_id: &str) -> BackendResult<Arc<dyn BlobReader>> {
+        if let Some(metrics) = self.metrics.as_ref() {
+            Ok(Arc::new(GcsReader {
+                blob_id: blob_id.to_string(),
+                state: self.state.clone(),
+                connection: self.connection.clone(),
+                metrics: metrics.clone(),
+            }))
+        } else {
+            Err(BackendError::Unsupported(
+                "no metrics object available for GcsReader".to_string(),
+            ))
+        }
+    }
+}
+
+impl Drop for Gcs {
+    fn drop(&mut self) {
+        if let Some(metrics) = self.metrics.as_ref() {
+            metrics.release().unwrap_or_else(|e| error!("{:?}", e));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use openssl::rsa::Rsa;
+    use openssl::sign::Verifier;
+    use serde_json::Value;
+
+    #[test]
+    fn test_gcs_url() {
+        let state = GcsState {
+            endpoint: GCS_ENDPOINT.to_string(),
+            bucket_name: "images".to_string(),
+            object_prefix: "nydus/".to_string(),
+            credentials: None,
+            token: Mutex::new(Some(("token".to_string(), now_secs() + 3600))),
+            retry_limit: 5,
+        };
+        assert_eq!(
+            state.url("sha256:abc", false),
+            "https://storage.googleapis.com/storage/v1/b/images/o/nydus%2Fsha256%3Aabc"
+        );
+        assert_eq!(
+            state.url("abc", true),
+            "https://storage.googleapis.com/storage/v1/b/images/o/nydus%2Fabc?alt=media"
+        );
+
+        let mut headers = HeaderMap::new();
+        state.sign(&mut headers).unwrap();
+        assert_eq!(headers.get(HEADER_AUTHORIZATION).unwrap(), "Bearer token");
+    }
+
+    #[test]
+    fn test_gcs_sign_jwt() {
+        let key = PKey::from_rsa(Rsa::generate(2048).unwrap()).unwrap();
+        let creds = GcsCredentialsFile {
+            kind: "service_account".to_string(),
+            client_email: "nydus@example.iam.gserviceaccount.com".to_string(),
+            private_key: String::from_utf8(key.private_key_to_pem_pkcs8().unwrap()).unwrap(),
+            token_uri: TOKEN_ENDPOINT.to_string(),
+            client_id: "".to_string(),
+            client_secret: "".to_string(),
+            refresh_token: "".to_string(),
+        };
+
+        let jwt = GcsState::sign_jwt(&creds, 1000).unwrap();
+        let parts: Vec<&str> = jwt.split('.').collect();
+        assert_eq!(parts.len(), 3);
+        let claims: Value = serde_json::from_slice(
+            &base64::decode_config(parts[1], base64::URL_SAFE_NO_PAD).unwrap(),
+        )
+        .unwrap();
+        assert_eq!(claims["iss"], "nydus@example.iam.gserviceaccount.com");
+        assert_eq!(claims["aud"], TOKEN_ENDPOINT);
+        assert_eq!(claims["exp"], 1000 + JWT_LIFETIME_SECS);
+
+        let signature = base64::decode_config(parts[2], base64::URL_SAFE_NO_PAD).unwrap();
+        let mut verifier = Verifier::new(MessageDigest::sha256(), &key).unwrap();
+        verifier
+            .update(format!("{}.{}", parts[0], parts[1]).as_bytes())
+            .unwrap();
+        assert!(verifier.verify(&signature).unwrap());
+    }
+
+    #[test]
+    fn test_gcs_new() {
+        let json_str = "{\"bucket_name\":\"images\",\"credentials_file\":\"/nonexistent/credentials.json\",\"proxy\":{\"url\":\"\",\"ping_url\":\"\",\"fallback\":true,\"check_interval\":5},\"timeout\":5,\"connect_timeout\":5,\"retry_limit\":5}";
+        let json: Value = serde_json::from_str(&json_str).unwrap();
+        assert!(Gcs::new(json, Some("test-image")).is_err());
+
+        let json_str = "{\"bucket_name\":\"images\",\"endpoint\":\"http://127.0.0.1:4443/\",\"proxy\":{\"url\":\"\",\"ping_url\":\"\",\"fallback\":true,\"check_interval\":5},\"timeout\":5,\"connect_timeout\":5,\"retry_limit\":5}";
+        let json: Value = serde_json::from_str(&json_str).unwrap();
+        let gcs = Gcs::new(json, Some("test-image")).unwrap();
+        assert_eq!(gcs.state.endpoint, "http://127.0.0.1:4443");
+
+        gcs.metrics();
+
+        let reader = gcs.get_reader("test").unwrap();
+        assert_eq!(reader.retry_limit(), 5);
+
+        gcs.shutdown();
+    }
+}
@@ -0,0 +1,374 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Storage backend driver to access blobs on IPFS through an HTTP gateway.
+//!
+//! The blobs are published to IPFS by `nydusify convert --backend-type ipfs`, which records the
+//! CIDs of the blobs, and fetched by the CIDs from a gateway, normally the local IPFS node. The
+//! blobs are pushed to the registry as well, so a blob without CID or whose CID can't be resolved
+//! by the gateway is read from the registry instead.
+use std::collections::HashMap;
+use std::io::Result;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+
+use nydus_utils::metrics::BackendMetrics;
+use reqwest::header::{HeaderMap, CONTENT_LENGTH};
+use reqwest::Method;
+
+use crate::backend::connection::{Connection, ConnectionError};
+use crate::backend::registry::Registry;
+use crate::backend::{BackendError, BackendResult, BlobBackend, BlobReader, CommonConfig};
+
+const IPFS_GATEWAY: &str = "http://127.0.0.1:8080";
+
+/// Error codes related to IPFS storage backend.
+#[derive(Debug)]
+pub enum IpfsError {
+    Request(ConnectionError),
+    ConstructHeader(String),
+    Transport(reqwest::Error),
+    Response(String),
+    /// The blob has no CID and there's no fallback registry.
+    NoCid(String),
+}
+
+impl From<IpfsError> for BackendError {
+    fn from(error: IpfsError) -> Self {
+        BackendError::Ipfs(error)
+    }
+}
+
+#[derive(Clone, Deserialize, Serialize)]
+struct IpfsConfig {
+    /// Default to `http://127.0.0.1:8080`, the gateway of the local IPFS node.
+    #[serde(default)]
+    gateway: String,
+    /// CIDs of the blobs from the blob IDs.
+    #[serde(default)]
+    cids: HashMap<String, String>,
+    /// Config of the registry backend to read the blobs not available on IPFS.
+    #[serde(default)]
+    fallback: Option<serde_json::value::Value>,
+}
+
+/// Check whether `cid` is a CID in the multibase encodings used by IPFS, so it's safe to be a path
+/// segment of the gateway URL.
+fn valid_cid(cid: &str) -> bool {
+    !cid.is_empty() && cid.bytes().all(|b| b.is_ascii_alphanumeric())
+}
+
+#[derive(Debug)]
+struct IpfsState {
+    gateway: String,
+    cids: HashMap<String, String>,
+    retry_limit: u8,
+}
+
+impl IpfsState {
+    fn url(&self, cid: &str) -> String {
+        format!("{}/ipfs/{}", self.gateway, cid)
+    }
+}
+
+struct IpfsReader {
+    blob_id: String,
+    cid: Option<String>,
+    connection: Arc<Connection>,
+    state: Arc<IpfsState>,
+    fallback: Option<Arc<dyn BlobReader>>,
+    /// Read from the fallback registry once the gateway fails, so reads don't keep waiting for a
+    /// CID the gateway can't resolve.
+    unresolved: AtomicBool,
+    metrics: Arc<BackendMetrics>,
+}
+
+impl IpfsReader {
+    /// Get the CID to read the blob from the gateway, or None to read from the fallback registry.
+    fn cid(&self) -> BackendResult<Option<&str>> {
+        match self.cid.as_deref() {
+            Some(cid) if self.fallback.is_none() || !self.unresolved.load(Ordering::Acquire) => {
+                Ok(Some(cid))
+            }
+            _ if self.fallback.is_some() => Ok(None),
+            _ => Err(IpfsError::NoCid(self.blob_id.clone()).into()),
+        }
+    }
+
+    fn fallback(&self) -> &Arc<dyn BlobReader> {
+        // Safe to unwrap because `cid()` only returns None with a fallback.
+        self.fallback.as_ref().unwrap()
+    }
+
+    /// Switch to the fallback registry on the gateway error `err` if any.
+    fn fall_back(&self, err: IpfsError) -> BackendResult<&Arc<dyn BlobReader>> {
+        match self.fallback.as_ref() {
+            Some(fallback) => {
+                if !self.unresolved.swap(true, Ordering::AcqRel) {
+                    warn!(
+                        "failed to read blob {} from IPFS gateway, fall back to registry: {:?}",
+                        self.blob_id, err
+                    );
+                }
+                Ok(fallback)
+            }
+            None => Err(err.into()),
+        }
+    }
+
+    fn gateway_blob_size(&self, cid: &str) -> std::result::Result<u64, IpfsError> {
+        let url = self.state.url(cid);
+        let resp = self
+            .connection
+            .call::<&[u8]>(
+                Method::HEAD,
+                url.as_str(),
+                None,
+                None,
+                HeaderMap::new(),
+                true,
+            )
+            .map_err(IpfsError::Request)?;
+        let content_length = resp
+            .headers()
+            .get(CONTENT_LENGTH)
+            .ok_or_else(|| IpfsError::Response("invalid content length".to_string()))?;
+
+        content_length
+            .to_str()
+            .map_err(|err| IpfsError::Response(format!("invalid content length: {:?}", err)))?
+            .parse::<u64>()
+            .map_err(|err| IpfsError::Response(format!("invalid content length: {:?}", err)))
+    }
+
+    fn gateway_read(
+        &self,
+        cid: &str,
+        mut buf: &mut [u8],
+        offset: u64,
+    ) -> std::result::Result<usize, IpfsError> {
+        let url = self.state.url(cid);
+        let mut headers = HeaderMap::new();
+        let end_at = offset + buf.len() as u64 - 1;
+        let range = format!("bytes={}-{}", offset, end_at);
+
+        headers.insert(
+            "Range",
+            range
+                .as_str()
+                .parse()
+                .map_err(|e| IpfsError::ConstructHeader(format!("{}", e)))?,
+        );
+
+        // Safe because the the call() is a synchronous operation.
+        let mut resp = self
+            .connection
+            .call::<&[u8]>(Method::GET, url.as_str(), None, None, headers, true)
+            .map_err(IpfsError::Request)?;
+
+        resp.copy_to(&mut buf)
+            .map_err(IpfsError::Transport)
+            .map(|size| size as usize)
+    }
+}
+
+impl BlobReader for IpfsReader {
+    fn blob_size(&self) -> BackendResult<u64> {
+        match self.cid()? {
+            Some(cid) => match self.gateway_blob_size(cid) {
+                Ok(size) => Ok(size),
+                Err(err) => self.fall_back(err)?.blob_size(),
+            },
+            None => self.fallback().blob_size(),
+        }
+    }
+
+    fn try_read(&self, buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        match self.cid()? {
+            Some(cid) => match self.gateway_read(cid, buf, offset) {
+                Ok(size) => Ok(size),
+                Err(err) => self.fall_back(err)?.try_read(buf, offset),
+            },
+            None => self.fallback().try_read(buf, offset),
+        }
+    }
+
+    fn prefetch_blob_data_range(&self, _ra_offset: u32, _ra_size: u32) -> BackendResult<()> {
+        Err(BackendError::Unsupported(
+            "IPFS backend does not support prefetch as per on-disk blob entries".to_string(),
+        ))
+    }
+
+    fn stop_data_prefetch(&self) -> BackendResult<()> {
+        Err(BackendError::Unsupported(
+            "IPFS backend does not support prefetch as per on-disk blob entries".to_string(),
+        ))
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        &self.metrics
+    }
+
+    fn retry_limit(&self) -> u8 {
+        self.state.retry_limit
+    }
+}
+
+/// Storage backend to access data stored in IPFS, with the registry as fallback.
+pub struct Ipfs {
+    connection: Arc<Connection>,
+    state: Arc<IpfsState>,
+    fallback: Option<Registry>,
+    metrics: Option<Arc<BackendMetrics>>,
+}
+
+impl Ipfs {
+    /// Create a new IPFS storage backend.
+    pub fn new(config: serde_json::value::Value, id: Option<&str>) -> Result<Ipfs> {
+        let common_config: CommonConfig =
+            serde_json::from_value(config.clone()).map_err(|e| einval!(e))?;
+        let retry_limit = common_config.retry_limit;
+        let connection = Connection::new(&common_config)?;
+        let ipfs_config: IpfsConfig = serde_json::from_value(config).map_err(|e| einval!(e))?;
+        if let Some(cid) = ipfs_config.cids.values().find(|cid| !valid_cid(cid)) {
+            return Err(einval!(format!("invalid CID {} for IPFS backend", cid)));
+        }
+        let gateway = if ipfs_config.gateway.is_empty() {
+            IPFS_GATEWAY.to_string()
+        } else {
+            ipfs_config.gateway.trim_end_matches('/').to_string()
+        };
+        // The fallback has its own metrics, which must not collide with the ones of the backend.
+        let fallback = match ipfs_config.fallback {
+            Some(config) => {
+                let id = id.map(|i| format!("{}-fallback", i));
+                Some(Registry::new(config, id.as_deref())?)
+            }
+            None => None,
+        };
+        let state = Arc::new(IpfsState {
+            gateway,
+            cids: ipfs_config.cids,
+            retry_limit,
+        });
+        let metrics = id.map(|i| BackendMetrics::new(i, "ipfs"));
+
+        Ok(Ipfs {
+            state,
+            connection,
+            fallback,
+            metrics,
+        })
+    }
+}
+
+impl BlobBackend for Ipfs {
+    fn shutdown(&self) {
+        self.connection.shutdown();
+        if let Some(fallback) = self.fallback.as_ref() {
+            fallback.shutdown();
+        }
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        // `metrics()` is only used for nydusd, which will always provide valid `blob_id`, thus
+        // `self.metrics` has valid value.
+        self.metrics.as_ref().unwrap()
+    }
+
+    fn get_reader(&self, blob_id: &str) -> BackendResult<Arc<dyn BlobReader>> {
+        if let Some(metrics) = self.metrics.as_ref() {
+            let fallback = match self.fallback.as_ref() {
+                Some(fallback) => Some(fallback.get_reader(blob_id)?),
+                None => None,
+            };
+            Ok(Arc::new(IpfsReader {
+                blob_id: blob_id.to_string(),
+                cid: self.state.cids.get(blob_id).cloned(),
+                state: self.state.clone(),
+                connection: self.connection.clone(),
+                fallback,
+                unresolved: AtomicBool::new(false),
+                metrics: metrics.clone(),
+            }))
+        } else {
+            Err(BackendError::Unsupported(
+                "no metrics object available for IpfsReader".to_string(),
+            ))
+        }
+    }
+}
+
+impl Drop for Ipfs {
+    fn drop(&mut self) {
+        if let Some(metrics) = self.metrics.as_ref() {
+            metrics.release().unwrap_or_else(|e| error!("{:?}", e));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::Value;
+
+    #[test]
+    fn test_ipfs_url() {
+        let state = IpfsState {
+            gateway: IPFS_GATEWAY.to_string(),
+            cids: HashMap::new(),
+            retry_limit: 5,
+        };
+        assert_eq!(
+            state.url("bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"),
+            "http://127.0.0.1:8080/ipfs/bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+        );
+
+        assert!(valid_cid(
+            "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+        ));
+        assert!(valid_cid("QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"));
+        assert!(!valid_cid(""));
+        assert!(!valid_cid("../ipns/example.com"));
+    }
+
+    #[test]
+    fn test_ipfs_new() {
+        let json_str = "{\"cids\":{\"blob\":\"Qm/../x\"},\"timeout\":5,\"connect_timeout\":5,\"retry_limit\":5}";
+        let json: Value = serde_json::from_str(&json_str).unwrap();
+        assert!(Ipfs::new(json, Some("test-image-invalid")).is_err());
+
+        let json_str = "{\"gateway\":\"http://127.0.0.1:5001/\",\"cids\":{\"blob\":\"bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku\"},\"timeout\":5,\"connect_timeout\":5,\"retry_limit\":5}";
+        let json: Value = serde_json::from_str(&json_str).unwrap();
+        let ipfs = Ipfs::new(json, Some("test-image")).unwrap();
+        assert_eq!(ipfs.state.gateway, "http://127.0.0.1:5001");
+        assert!(ipfs.fallback.is_none());
+
+        ipfs.metrics();
+
+        let reader = ipfs.get_reader("blob").unwrap();
+        assert_eq!(reader.retry_limit(), 5);
+        // No CID nor fallback registry for the blob.
+        let reader = ipfs.get_reader("other").unwrap();
+        assert!(matches!(
+            reader.blob_size(),
+            Err(BackendError::Ipfs(IpfsError::NoCid(_)))
+        ));
+
+        ipfs.shutdown();
+    }
+
+    #[test]
+    fn test_ipfs_fallback() {
+        let json_str = "{\"fallback\":{\"scheme\":\"http\",\"host\":\"127.0.0.1:5000\",\"repo\":\"library/nginx\",\"retry_limit\":3},\"retry_limit\":5}";
+        let json: Value = serde_json::from_str(&json_str).unwrap();
+        let ipfs = Ipfs::new(json, Some("test-image-fallback")).unwrap();
+        assert!(ipfs.fallback.is_some());
+
+        // Blobs without CIDs are read from the fallback registry.
+        let reader = ipfs.get_reader("blob").unwrap();
+        assert_eq!(reader.retry_limit(), 5);
+        ipfs.shutdown();
+    }
+}
@@ -9,9 +9,21 @@
 //! - [Registry](registry/struct.Registry.html): backend driver to access blobs on container image
 //!   registry.
 //! - [Oss](oss/struct.Oss.html): backend driver to access blobs on Oss(Object Storage System).
+//! - [S3](s3/struct.S3.html): backend driver to access blobs on Amazon S3 and S3 compatible
+//!   storage.
+//! - [Azure](azure/struct.Azure.html): backend driver to access blobs on Azure Blob Storage.
+//! - [Gcs](gcs/struct.Gcs.html): backend driver to access blobs on Google Cloud Storage.
+//! - [Ipfs](ipfs/struct.Ipfs.html): backend driver to access blobs on IPFS through a gateway, with
+//!   the registry as fallback.
 //! - [LocalFs](localfs/struct.LocalFs.html): backend driver to access blobs on local file system.
 //!   The [LocalFs](localfs/struct.LocalFs.html) storage backend supports backend level data
 //!   prefetching, which is to load data into page cache.
+//!
+//! All storage backends are wrapped by [RateLimitedBackend](ratelimit/struct.RateLimitedBackend.html)
+//! to limit the download bandwidth, and by [PriorityBackend](priority/struct.PriorityBackend.html)
+//! to schedule the requests by QoS class.
+//! And the backend may be wrapped by [FaultInjectedBackend](fault/struct.FaultInjectedBackend.html)
+//! for resilience testing.
 
 use std::sync::Arc;
 
@@ -21,14 +33,32 @@ use nydus_utils::metrics::{BackendMetrics, ERROR_HOLDER};
 use crate::utils::copyv;
 use crate::StorageError;
 
-#[cfg(any(feature = "backend-oss", feature = "backend-registry"))]
+#[cfg(feature = "backend-azure")]
+pub mod azure;
+#[cfg(any(
+    feature = "backend-oss",
+    feature = "backend-registry",
+    feature = "backend-s3",
+    feature = "backend-azure",
+    feature = "backend-gcs",
+    feature = "backend-ipfs"
+))]
 pub mod connection;
+pub mod fault;
+#[cfg(feature = "backend-gcs")]
+pub mod gcs;
+#[cfg(feature = "backend-ipfs")]
+pub mod ipfs;
 #[cfg(feature = "backend-localfs")]
 pub mod localfs;
 #[cfg(feature = "backend-oss")]
 pub mod oss;
+pub mod priority;
+pub mod ratelimit;
 #[cfg(feature = "backend-registry")]
 pub mod registry;
+#[cfg(feature = "backend-s3")]
+pub mod s3;
 
 /// Error codes related to storage backend operations.
 #[derive(Debug)]
@@ -37,6 +67,8 @@ pub enum BackendError {
     Unsupported(String),
     /// Failed to copy data from/into blob.
     CopyData(StorageError),
+    /// Error injected for resilience testing.
+    FaultInjection(String),
     #[cfg(feature = "backend-registry")]
     /// Error from Registry storage backend.
     Registry(self::registry::RegistryError),
@@ -46,6 +78,18 @@ pub enum BackendError {
     #[cfg(feature = "backend-oss")]
     /// Error from OSS storage backend.
     Oss(self::oss::OssError),
+    #[cfg(feature = "backend-s3")]
+    /// Error from S3 storage backend.
+    S3(self::s3::S3Error),
+    #[cfg(feature = "backend-azure")]
+    /// Error from Azure storage backend.
+    Azure(self::azure::AzureError),
+    #[cfg(feature = "backend-gcs")]
+    /// Error from GCS storage backend.
+    Gcs(self::gcs::GcsError),
+    #[cfg(feature = "backend-ipfs")]
+    /// Error from IPFS storage backend.
+    Ipfs(self::ipfs::IpfsError),
 }
 
 /// Specialized `Result` for storage backends.
@@ -179,7 +223,7 @@ pub trait BlobReader: Send + Sync {
     ///
     /// This method only prefetch blob data from storage backends, it doesn't cache data in the
     /// blob cache subsystem. So it's useful for disk and file system based storage backends, but
-    /// it may not help for Registry/OSS based storage backends.
+    /// it may not help for Registry/OSS/S3/Azure/GCS based storage backends.
     fn prefetch_blob_data_range(&self, ra_offset: u32, ra_size: u32) -> BackendResult<()>;
 
     /// Stop the background data prefetching tasks.
@@ -206,7 +250,11 @@ pub trait BlobBackend: Send + Sync {
     fn get_reader(&self, blob_id: &str) -> BackendResult<Arc<dyn BlobReader>>;
 }
 
-#[cfg(any(feature = "backend-oss", feature = "backend-registry"))]
+#[cfg(any(
+    feature = "backend-oss",
+    feature = "backend-registry",
+    feature = "backend-s3"
+))]
 /// Get default http scheme for network connection.
 fn default_http_scheme() -> String {
     "https".to_string()
@@ -216,7 +264,11 @@ fn default_http_scheme() -> String {
 mod tests {
     use super::*;
 
-    #[cfg(any(feature = "backend-oss", feature = "backend-registry"))]
+    #[cfg(any(
+        feature = "backend-oss",
+        feature = "backend-registry",
+        feature = "backend-s3"
+    ))]
     #[test]
     fn test_default_http_scheme() {
         assert_eq!(default_http_scheme(), "https");
@@ -0,0 +1,237 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Priority scheduling of requests to storage backends.
+//!
+//! Each Rafs instance is assigned a QoS class by the `qos_class` field of its backend
+//! configuration. When the number of concurrent requests to all storage backends in the process
+//! reaches the limit set by [set_max_concurrent_fetches()](fn.set_max_concurrent_fetches.html),
+//! the waiting requests of higher classes are served first, so that the system-critical images
+//! start fast even during bulk pre-pulls of background images.
+
+use std::sync::{Arc, Condvar, Mutex};
+
+use fuse_backend_rs::transport::FileVolatileSlice;
+use nydus_utils::metrics::BackendMetrics;
+
+use crate::backend::{BackendResult, BlobBackend, BlobReader};
+
+lazy_static::lazy_static! {
+    static ref GLOBAL_SCHEDULER: FetchScheduler = FetchScheduler::new(0);
+}
+
+/// Set the maximum number of concurrent requests to all storage backends, zero means unlimited.
+pub fn set_max_concurrent_fetches(max: usize) {
+    GLOBAL_SCHEDULER.set_max(max);
+}
+
+/// QoS class of requests to storage backends, in order of priority.
+#[derive(Clone, Copy, Debug, Deserialize, Eq, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum QosClass {
+    Critical,
+    Normal,
+    Background,
+}
+
+impl Default for QosClass {
+    fn default() -> Self {
+        QosClass::Normal
+    }
+}
+
+impl QosClass {
+    fn index(self) -> usize {
+        self as usize
+    }
+}
+
+struct SchedulerState {
+    max: usize,
+    inflight: usize,
+    waiting: [usize; 3],
+}
+
+/// A counting semaphore granting permits to the waiters of the highest class first.
+struct FetchScheduler {
+    state: Mutex<SchedulerState>,
+    cond: Condvar,
+}
+
+impl FetchScheduler {
+    fn new(max: usize) -> Self {
+        FetchScheduler {
+            state: Mutex::new(SchedulerState {
+                max,
+                inflight: 0,
+                waiting: [0; 3],
+            }),
+            cond: Condvar::new(),
+        }
+    }
+
+    fn set_max(&self, max: usize) {
+        self.state.lock().unwrap().max = max;
+        self.cond.notify_all();
+    }
+
+    /// Wait until a request of `class` is allowed to be sent to the storage backend.
+    fn acquire(&self, class: QosClass) -> FetchPermit {
+        let idx = class.index();
+        let mut state = self.state.lock().unwrap();
+
+        state.waiting[idx] += 1;
+        while state.max > 0
+            && (state.inflight >= state.max || state.waiting[..idx].iter().any(|w| *w > 0))
+        {
+            state = self.cond.wait(state).unwrap();
+        }
+        state.waiting[idx] -= 1;
+        state.inflight += 1;
+
+        FetchPermit(self)
+    }
+
+    fn release(&self) {
+        self.state.lock().unwrap().inflight -= 1;
+        // The waiters of all classes are woken up, only the ones of the highest class proceed.
+        self.cond.notify_all();
+    }
+}
+
+struct FetchPermit<'a>(&'a FetchScheduler);
+
+impl Drop for FetchPermit<'_> {
+    fn drop(&mut self) {
+        self.0.release();
+    }
+}
+
+/// A storage backend with requests scheduled by the QoS class.
+pub struct PriorityBackend {
+    backend: Arc<dyn BlobBackend + Send + Sync>,
+    class: QosClass,
+}
+
+impl PriorityBackend {
+    /// Create a storage backend with requests of `class`.
+    pub fn new(backend: Arc<dyn BlobBackend + Send + Sync>, class: QosClass) -> Self {
+        PriorityBackend { backend, class }
+    }
+}
+
+impl BlobBackend for PriorityBackend {
+    fn shutdown(&self) {
+        self.backend.shutdown()
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        self.backend.metrics()
+    }
+
+    fn get_reader(&self, blob_id: &str) -> BackendResult<Arc<dyn BlobReader>> {
+        let reader = self.backend.get_reader(blob_id)?;
+
+        Ok(Arc::new(PriorityReader {
+            reader,
+            class: self.class,
+        }))
+    }
+}
+
+struct PriorityReader {
+    reader: Arc<dyn BlobReader>,
+    class: QosClass,
+}
+
+impl BlobReader for PriorityReader {
+    fn blob_size(&self) -> BackendResult<u64> {
+        self.reader.blob_size()
+    }
+
+    fn try_read(&self, buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        let _permit = GLOBAL_SCHEDULER.acquire(self.class);
+        self.reader.try_read(buf, offset)
+    }
+
+    // Forward to the inner reader so that its own retry and vectored read are kept, the permit
+    // is held by the retries.
+    fn read(&self, buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        let _permit = GLOBAL_SCHEDULER.acquire(self.class);
+        self.reader.read(buf, offset)
+    }
+
+    fn readv(
+        &self,
+        bufs: &[FileVolatileSlice],
+        offset: u64,
+        max_size: usize,
+    ) -> BackendResult<usize> {
+        let _permit = GLOBAL_SCHEDULER.acquire(self.class);
+        self.reader.readv(bufs, offset, max_size)
+    }
+
+    fn prefetch_blob_data_range(&self, ra_offset: u32, ra_size: u32) -> BackendResult<()> {
+        self.reader.prefetch_blob_data_range(ra_offset, ra_size)
+    }
+
+    fn stop_data_prefetch(&self) -> BackendResult<()> {
+        self.reader.stop_data_prefetch()
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        self.reader.metrics()
+    }
+
+    fn retry_limit(&self) -> u8 {
+        self.reader.retry_limit()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::thread;
+    use std::time::Duration;
+
+    #[test]
+    fn test_qos_class() {
+        let class: QosClass = serde_json::from_str(r#""critical""#).unwrap();
+        assert_eq!(class, QosClass::Critical);
+        assert!(serde_json::from_str::<QosClass>(r#""urgent""#).is_err());
+        assert_eq!(QosClass::default(), QosClass::Normal);
+    }
+
+    #[test]
+    fn test_fetch_scheduler() {
+        let scheduler = Arc::new(FetchScheduler::new(1));
+        let order = Arc::new(Mutex::new(Vec::new()));
+        let permit = scheduler.acquire(QosClass::Normal);
+
+        let mut handles = Vec::new();
+        for class in &[QosClass::Background, QosClass::Normal, QosClass::Critical] {
+            let class = *class;
+            let s = scheduler.clone();
+            let order = order.clone();
+            handles.push(thread::spawn(move || {
+                let _permit = s.acquire(class);
+                order.lock().unwrap().push(class);
+            }));
+            // Wait until the request is queued.
+            while scheduler.state.lock().unwrap().waiting[class.index()] == 0 {
+                thread::sleep(Duration::from_millis(1));
+            }
+        }
+        drop(permit);
+        for h in handles {
+            h.join().unwrap();
+        }
+
+        assert_eq!(
+            *order.lock().unwrap(),
+            vec![QosClass::Critical, QosClass::Normal, QosClass::Background]
+        );
+        assert_eq!(scheduler.state.lock().unwrap().inflight, 0);
+    }
+}
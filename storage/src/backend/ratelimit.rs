@@ -0,0 +1,220 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Token bucket rate limiting of data downloaded from storage backends.
+//!
+//! The downloads of a storage backend are limited by the `bandwidth_rate` field of the backend
+//! configuration, so each Rafs instance may have its own limit. And the downloads of all storage
+//! backends in the process are limited by the global rate set by
+//! [set_global_bandwidth_rate()](fn.set_global_bandwidth_rate.html), to leave the network
+//! bandwidth of the node for other workloads.
+
+use std::num::NonZeroU32;
+use std::sync::{Arc, RwLock};
+
+use fuse_backend_rs::transport::FileVolatileSlice;
+use futures::executor::block_on;
+use governor::clock::QuantaClock;
+use governor::state::{InMemoryState, NotKeyed};
+use governor::{Quota, RateLimiter};
+use nydus_utils::metrics::BackendMetrics;
+
+use crate::backend::{BackendResult, BlobBackend, BlobReader};
+use crate::RAFS_MAX_CHUNK_SIZE;
+
+lazy_static::lazy_static! {
+    static ref GLOBAL_BUCKET: RwLock<Option<Arc<TokenBucket>>> = RwLock::new(None);
+}
+
+/// Set the bandwidth rate in bytes per second shared by all storage backends, zero means
+/// unlimited.
+pub fn set_global_bandwidth_rate(bandwidth_rate: u64) {
+    *GLOBAL_BUCKET.write().unwrap() = TokenBucket::new(bandwidth_rate).map(Arc::new);
+}
+
+fn global_bucket() -> Option<Arc<TokenBucket>> {
+    GLOBAL_BUCKET.read().unwrap().clone()
+}
+
+/// A token bucket refilled at `rate` bytes per second, with burst size of `rate` bytes but at least
+/// the maximum chunk size.
+struct TokenBucket {
+    limiter: RateLimiter<NotKeyed, InMemoryState, QuantaClock>,
+    burst: u32,
+}
+
+impl TokenBucket {
+    fn new(rate: u64) -> Option<Self> {
+        if rate == 0 {
+            return None;
+        }
+        // A chunk should be downloaded in one request, so make the burst size at least the
+        // maximum chunk size. The bucket is still refilled at `rate`, so a rate lower than the
+        // chunk size is kept on average.
+        let burst = std::cmp::max(rate, RAFS_MAX_CHUNK_SIZE);
+        let burst = std::cmp::min(burst, u32::MAX as u64) as u32;
+        let rate = std::cmp::min(rate, u32::MAX as u64) as u32;
+        // Safe to unwrap because rate and burst are not zero.
+        let quota = Quota::per_second(NonZeroU32::new(rate).unwrap())
+            .allow_burst(NonZeroU32::new(burst).unwrap());
+
+        Some(TokenBucket {
+            limiter: RateLimiter::direct(quota),
+            burst,
+        })
+    }
+
+    /// Wait until `size` bytes are allowed to download.
+    ///
+    /// The merged requests may be bigger than the burst size, which are allowed piece by piece.
+    fn acquire(&self, size: usize) {
+        let mut left = size as u64;
+        while left > 0 {
+            let n = std::cmp::min(left, self.burst as u64) as u32;
+            // Safe to unwrap because n is not zero.
+            let cells = NonZeroU32::new(n).unwrap();
+            if let Err(e) = self
+                .limiter
+                .check_n(cells)
+                .or_else(|_| block_on(self.limiter.until_n_ready(cells)))
+            {
+                // `InsufficientCapacity` is the only possible error, which shouldn't happen
+                // because the piece is never bigger than the burst size.
+                error!("{}: give up rate-limiting", e);
+                return;
+            }
+            left -= n as u64;
+        }
+    }
+}
+
+/// A storage backend with downloads limited by its own bandwidth rate and the global one.
+pub struct RateLimitedBackend {
+    backend: Arc<dyn BlobBackend + Send + Sync>,
+    bucket: Option<Arc<TokenBucket>>,
+}
+
+impl RateLimitedBackend {
+    /// Create a rate limited backend of `bandwidth_rate` bytes per second, zero means unlimited.
+    pub fn new(backend: Arc<dyn BlobBackend + Send + Sync>, bandwidth_rate: u64) -> Self {
+        RateLimitedBackend {
+            backend,
+            bucket: TokenBucket::new(bandwidth_rate).map(Arc::new),
+        }
+    }
+}
+
+impl BlobBackend for RateLimitedBackend {
+    fn shutdown(&self) {
+        self.backend.shutdown()
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        self.backend.metrics()
+    }
+
+    fn get_reader(&self, blob_id: &str) -> BackendResult<Arc<dyn BlobReader>> {
+        let reader = self.backend.get_reader(blob_id)?;
+
+        Ok(Arc::new(RateLimitedReader {
+            reader,
+            bucket: self.bucket.clone(),
+        }))
+    }
+}
+
+struct RateLimitedReader {
+    reader: Arc<dyn BlobReader>,
+    bucket: Option<Arc<TokenBucket>>,
+}
+
+impl RateLimitedReader {
+    fn acquire(&self, size: usize) {
+        if let Some(bucket) = self.bucket.as_ref() {
+            bucket.acquire(size);
+        }
+        if let Some(bucket) = global_bucket() {
+            bucket.acquire(size);
+        }
+    }
+}
+
+impl BlobReader for RateLimitedReader {
+    fn blob_size(&self) -> BackendResult<u64> {
+        self.reader.blob_size()
+    }
+
+    fn try_read(&self, buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        self.acquire(buf.len());
+        self.reader.try_read(buf, offset)
+    }
+
+    // Forward to the inner reader so that its own retry and vectored read are kept, the
+    // retries are not limited.
+    fn read(&self, buf: &mut [u8], offset: u64) -> BackendResult<usize> {
+        self.acquire(buf.len());
+        self.reader.read(buf, offset)
+    }
+
+    fn readv(
+        &self,
+        bufs: &[FileVolatileSlice],
+        offset: u64,
+        max_size: usize,
+    ) -> BackendResult<usize> {
+        let size = bufs.iter().fold(0usize, move |size, s| size + s.len());
+        self.acquire(std::cmp::min(size, max_size));
+        self.reader.readv(bufs, offset, max_size)
+    }
+
+    fn prefetch_blob_data_range(&self, ra_offset: u32, ra_size: u32) -> BackendResult<()> {
+        self.reader.prefetch_blob_data_range(ra_offset, ra_size)
+    }
+
+    fn stop_data_prefetch(&self) -> BackendResult<()> {
+        self.reader.stop_data_prefetch()
+    }
+
+    fn metrics(&self) -> &BackendMetrics {
+        self.reader.metrics()
+    }
+
+    fn retry_limit(&self) -> u8 {
+        self.reader.retry_limit()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Instant;
+
+    #[test]
+    fn test_token_bucket() {
+        assert!(TokenBucket::new(0).is_none());
+
+        let bucket = TokenBucket::new(1).unwrap();
+        assert_eq!(bucket.burst, RAFS_MAX_CHUNK_SIZE as u32);
+        let bucket = TokenBucket::new(u64::MAX).unwrap();
+        assert_eq!(bucket.burst, u32::MAX);
+
+        // The first burst is allowed at once, the next one is refilled in a second.
+        let bucket = TokenBucket::new(RAFS_MAX_CHUNK_SIZE).unwrap();
+        let begin = Instant::now();
+        bucket.acquire(RAFS_MAX_CHUNK_SIZE as usize / 2);
+        assert!(begin.elapsed().as_millis() < 100);
+        bucket.acquire(RAFS_MAX_CHUNK_SIZE as usize);
+        assert!(begin.elapsed().as_millis() >= 400);
+
+        // A rate lower than the chunk size still allows a chunk at once, but is refilled at the
+        // rate instead of the burst size.
+        let bucket = TokenBucket::new(RAFS_MAX_CHUNK_SIZE / 4).unwrap();
+        assert_eq!(bucket.burst, RAFS_MAX_CHUNK_SIZE as u32);
+        let begin = Instant::now();
+        bucket.acquire(RAFS_MAX_CHUNK_SIZE as usize);
+        assert!(begin.elapsed().as_millis() < 100);
+        bucket.acquire(RAFS_MAX_CHUNK_SIZE as usize / 8);
+        assert!(begin.elapsed().as_millis() >= 400);
+    }
+}
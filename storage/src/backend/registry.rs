@@ -4,8 +4,10 @@
 
 //! Storage backend driver to access blobs on container image registry.
 use std::collections::HashMap;
+use std::fs;
 use std::io::{Error, Read, Result};
-use std::sync::{Arc, RwLock};
+use std::sync::{Arc, Mutex, RwLock, Weak};
+use std::time::SystemTime;
 
 use nydus_utils::metrics::BackendMetrics;
 use reqwest::blocking::Response;
@@ -25,6 +27,38 @@ const REGISTRY_CLIENT_ID: &str = "nydus-registry-client";
 const HEADER_AUTHORIZATION: &str = "Authorization";
 const HEADER_WWW_AUTHENTICATE: &str = "www-authenticate";
 
+lazy_static::lazy_static! {
+    // States of all registry backends, to update their credentials at runtime.
+    static ref REGISTRY_STATES: Mutex<Vec<Weak<RegistryState>>> = Mutex::new(Vec::new());
+}
+
+/// Update the credential of the registry backends of `host`, and of `repo` if specified.
+///
+/// The cached authorization of the old credential is dropped, so the following requests,
+/// including the retries of in-flight ones, authenticate again with the new credential.
+/// Return the number of updated backends.
+pub fn update_credential(
+    host: &str,
+    repo: Option<&str>,
+    auth: Option<String>,
+    registry_token: Option<String>,
+) -> Result<usize> {
+    // Validate the credential before updating any backend.
+    Credential::new(trim(auth.clone()))?;
+
+    let mut states = REGISTRY_STATES.lock().unwrap();
+    states.retain(|s| s.strong_count() > 0);
+    let mut count = 0;
+    for state in states.iter().filter_map(|s| s.upgrade()) {
+        if state.host == host && repo.map(|r| r == state.repo).unwrap_or(true) {
+            state.set_credential(auth.clone(), registry_token.clone())?;
+            count += 1;
+        }
+    }
+
+    Ok(count)
+}
+
 /// Error codes related to registry storage backend operations.
 #[derive(Debug)]
 pub enum RegistryError {
@@ -68,6 +102,10 @@ impl Cache {
             *cached_guard = current;
         }
     }
+
+    fn reset(&self, val: String) {
+        *self.0.write().unwrap() = val;
+    }
 }
 
 #[derive(Default)]
@@ -108,6 +146,10 @@ struct RegistryConfig {
     // to authorize registry requests.
     #[serde(default)]
     registry_token: Option<String>,
+    // File containing the base64 encoded auth, reloaded when modified and the registry
+    // responds with 401, to rotate the credential without remount.
+    #[serde(default)]
+    auth_file: Option<String>,
     #[serde(default)]
     blob_url_scheme: String,
     #[serde(default)]
@@ -138,16 +180,35 @@ enum Auth {
     Bearer(BearerAuth),
 }
 
+#[derive(Default)]
+struct Credential {
+    // Base64 encoded registry auth
+    auth: Option<String>,
+    username: String,
+    password: String,
+}
+
+impl Credential {
+    fn new(auth: Option<String>) -> Result<Self> {
+        let (username, password) = Registry::get_authorization_info(&auth)?;
+        Ok(Credential {
+            auth,
+            username,
+            password,
+        })
+    }
+}
+
 struct RegistryState {
     // HTTP scheme like: https, http
     scheme: String,
     host: String,
     // Image repo name like: library/ubuntu
     repo: String,
-    // Base64 encoded registry auth
-    auth: Option<String>,
-    username: String,
-    password: String,
+    credential: RwLock<Credential>,
+    auth_file: Option<String>,
+    // Modification time of `auth_file` when it's loaded.
+    auth_file_mtime: Mutex<Option<SystemTime>>,
     // Retry limit for read operation
     retry_limit: u8,
     // Scheme specified for blob server
@@ -166,6 +227,42 @@ struct RegistryState {
 }
 
 impl RegistryState {
+    fn set_credential(&self, auth: Option<String>, registry_token: Option<String>) -> Result<()> {
+        *self.credential.write().unwrap() = Credential::new(trim(auth))?;
+        self.cached_auth.reset(
+            trim(registry_token)
+                .map(|t| format!("Bearer {}", t))
+                .unwrap_or_default(),
+        );
+        info!("credential of registry {}/{} updated", self.host, self.repo);
+
+        Ok(())
+    }
+
+    /// Reload the credential from `auth_file` if it's modified since loaded.
+    fn reload_auth_file(&self) {
+        let path = match self.auth_file.as_ref() {
+            Some(path) => path,
+            None => return,
+        };
+        let mtime = match fs::metadata(path).and_then(|m| m.modified()) {
+            Ok(mtime) => mtime,
+            Err(e) => {
+                warn!("failed to stat registry auth file {}, {}", path, e);
+                return;
+            }
+        };
+
+        let mut last = self.auth_file_mtime.lock().unwrap();
+        if *last == Some(mtime) {
+            return;
+        }
+        match fs::read_to_string(path).and_then(|auth| self.set_credential(Some(auth), None)) {
+            Ok(_) => *last = Some(mtime),
+            Err(e) => warn!("failed to load registry auth file {}, {}", path, e),
+        }
+    }
+
     fn url(&self, path: &str, query: &[&str]) -> std::result::Result<String, ParseError> {
         let path = if query.is_empty() {
             format!("/v2/{}{}", self.repo, path)
@@ -185,12 +282,16 @@ impl RegistryState {
         // the query and in the body to be compatible with different registry
         // implementations, which have been tested on these platforms:
         // docker hub, harbor, github ghcr, aliyun acr.
+        let (username, password) = {
+            let credential = self.credential.read().unwrap();
+            (credential.username.clone(), credential.password.clone())
+        };
         let query = vec![
             ("service", auth.service.as_str()),
             ("scope", auth.scope.as_str()),
             ("grant_type", "password"),
-            ("username", self.username.as_str()),
-            ("password", self.password.as_str()),
+            ("username", username.as_str()),
+            ("password", password.as_str()),
             ("client_id", REGISTRY_CLIENT_ID),
         ];
 
@@ -226,6 +327,9 @@ impl RegistryState {
     fn get_auth_header(&self, auth: Auth, connection: &Arc<Connection>) -> Result<String> {
         match auth {
             Auth::Basic(_) => self
+                .credential
+                .read()
+                .unwrap()
                 .auth
                 .as_ref()
                 .map(|auth| format!("Basic {}", auth))
@@ -362,7 +466,10 @@ impl RegistryReader {
         if resp.status() == StatusCode::UNAUTHORIZED {
             if let Some(resp_auth_header) = resp.headers().get(HEADER_WWW_AUTHENTICATE) {
                 // Get token from registry authorization server
-                if let Some(auth) = RegistryState::parse_auth(resp_auth_header, &self.state.auth) {
+                // The credential may have been rotated.
+                self.state.reload_auth_file();
+                let auth = self.state.credential.read().unwrap().auth.clone();
+                if let Some(auth) = RegistryState::parse_auth(resp_auth_header, &auth) {
                     let auth_header = self
                         .state
                         .get_auth_header(auth, &self.connection)
@@ -573,7 +680,7 @@ impl Registry {
         let config: RegistryConfig = serde_json::from_value(config).map_err(|e| einval!(e))?;
         let auth = trim(config.auth);
         let registry_token = trim(config.registry_token);
-        let (username, password) = Self::get_authorization_info(&auth)?;
+        let credential = Credential::new(auth)?;
         let cached_auth = if let Some(registry_token) = registry_token {
             // Store the registry bearer token to cached_auth, prefer to
             // use the token stored in cached_auth to request registry.
@@ -586,15 +693,19 @@ impl Registry {
             scheme: config.scheme,
             host: config.host,
             repo: config.repo,
-            auth,
+            credential: RwLock::new(credential),
+            auth_file: trim(config.auth_file),
+            auth_file_mtime: Mutex::new(None),
             cached_auth,
-            username,
-            password,
             retry_limit,
             blob_url_scheme: config.blob_url_scheme,
             blob_redirected_host: config.blob_redirected_host,
             cached_redirect: HashCache::new(),
         });
+        if state.credential.read().unwrap().auth.is_none() {
+            state.reload_auth_file();
+        }
+        REGISTRY_STATES.lock().unwrap().push(Arc::downgrade(&state));
 
         Ok(Registry {
             connection,
@@ -704,9 +815,13 @@ mod tests {
             scheme: "http".to_string(),
             host: "alibaba-inc.com".to_string(),
             repo: "nydus".to_string(),
-            auth: None,
-            username: "test".to_string(),
-            password: "password".to_string(),
+            credential: RwLock::new(Credential {
+                auth: None,
+                username: "test".to_string(),
+                password: "password".to_string(),
+            }),
+            auth_file: None,
+            auth_file_mtime: Mutex::new(None),
             retry_limit: 5,
             blob_url_scheme: "https".to_string(),
             blob_redirected_host: "oss.alibaba-inc.com".to_string(),
@@ -754,6 +869,54 @@ mod tests {
         assert!(RegistryState::parse_auth(&header, &None).is_none());
     }
 
+    #[test]
+    fn test_update_credential() {
+        let auth_file = vmm_sys_util::tempfile::TempFile::new().unwrap();
+        fs::write(auth_file.as_path(), base64::encode("old:password")).unwrap();
+        let config = serde_json::json!({
+            "host": "rotate.example.com",
+            "repo": "nydus",
+            "auth_file": auth_file.as_path().to_str().unwrap(),
+        });
+        let registry = Registry::new(config, Some("test")).unwrap();
+        let username = || registry.state.credential.read().unwrap().username.clone();
+        assert_eq!(username(), "old");
+
+        // The auth file is reloaded only if modified.
+        registry.state.reload_auth_file();
+        assert_eq!(username(), "old");
+        std::thread::sleep(std::time::Duration::from_millis(20));
+        fs::write(auth_file.as_path(), base64::encode("new:password")).unwrap();
+        registry.state.reload_auth_file();
+        assert_eq!(username(), "new");
+
+        let auth = Some(base64::encode("api:password"));
+        assert!(update_credential(
+            "rotate.example.com",
+            None,
+            Some("invalid".to_string()),
+            None
+        )
+        .is_err());
+        assert_eq!(
+            update_credential("rotate.example.com", Some("other"), auth.clone(), None).unwrap(),
+            0
+        );
+        assert_eq!(username(), "new");
+        assert_eq!(
+            update_credential(
+                "rotate.example.com",
+                Some("nydus"),
+                auth,
+                Some("token".to_string())
+            )
+            .unwrap(),
+            1
+        );
+        assert_eq!(username(), "api");
+        assert_eq!(registry.state.cached_auth.get(), "Bearer token");
+    }
+
     #[test]
     fn test_trim() {
         assert_eq!(trim(None), None);
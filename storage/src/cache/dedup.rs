@@ -0,0 +1,172 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Node-wide index of cached chunks to deduplicate them across blobs.
+//!
+//! Images often share chunks with the same digest in different blobs. When a chunk is missing in
+//! the cache file of a blob but ready in the cache file of another blob, it's cloned from there
+//! instead of downloaded from the storage backend. With `FICLONERANGE` on filesystems supporting
+//! reflink, e.g. btrfs and XFS, the cache files share the extents of the chunk, so a single copy
+//! is stored on disk and the filesystem counts its references. Otherwise the data is copied.
+//!
+//! The index only references the opened cache files, so the chunks of a blob are dropped from
+//! the index once its cache file is closed.
+
+use std::collections::HashMap;
+use std::fs::File;
+use std::io::Result;
+use std::os::unix::fs::FileExt;
+use std::os::unix::io::AsRawFd;
+use std::sync::{Arc, Mutex, Weak};
+
+use nydus_utils::digest::{Algorithm, RafsDigest};
+
+use crate::utils::alloc_buf;
+
+lazy_static::lazy_static! {
+    static ref CHUNK_INDEX: ChunkIndex = ChunkIndex::default();
+}
+
+// The argument of ioctl FICLONERANGE.
+#[repr(C)]
+struct FileCloneRange {
+    src_fd: i64,
+    src_offset: u64,
+    src_length: u64,
+    dest_offset: u64,
+}
+
+const FICLONERANGE: libc::c_ulong = 0x4020_940d;
+
+struct CachedChunk {
+    file: Weak<File>,
+    offset: u64,
+    size: u32,
+}
+
+#[derive(Default)]
+struct ChunkIndex {
+    chunks: Mutex<HashMap<(Algorithm, RafsDigest), CachedChunk>>,
+}
+
+impl ChunkIndex {
+    fn insert(&self, key: (Algorithm, RafsDigest), file: &Arc<File>, offset: u64, size: u32) {
+        let chunk = CachedChunk {
+            file: Arc::downgrade(file),
+            offset,
+            size,
+        };
+        self.chunks.lock().unwrap().insert(key, chunk);
+    }
+
+    fn get(&self, key: &(Algorithm, RafsDigest)) -> Option<(Arc<File>, u64, u32)> {
+        let mut chunks = self.chunks.lock().unwrap();
+        let chunk = chunks.get(key)?;
+        match chunk.file.upgrade() {
+            Some(file) => Some((file, chunk.offset, chunk.size)),
+            None => {
+                // The cache file has been closed.
+                chunks.remove(key);
+                None
+            }
+        }
+    }
+
+    fn remove(&self, key: &(Algorithm, RafsDigest)) {
+        self.chunks.lock().unwrap().remove(key);
+    }
+}
+
+/// Record the chunk with `digest` ready in the cache file `file` at `offset`.
+pub(crate) fn record_chunk(
+    digester: Algorithm,
+    digest: &RafsDigest,
+    file: &Arc<File>,
+    offset: u64,
+    size: u32,
+) {
+    CHUNK_INDEX.insert((digester, *digest), file, offset, size);
+}
+
+/// Clone the chunk with `digest` cached by another blob into the cache file `file` at `offset`.
+///
+/// Return false if the chunk isn't in the index, or its data in the other cache file doesn't
+/// match the digest anymore.
+pub(crate) fn clone_chunk(
+    digester: Algorithm,
+    digest: &RafsDigest,
+    file: &Arc<File>,
+    offset: u64,
+    size: u32,
+) -> Result<bool> {
+    let key = (digester, *digest);
+    let (src, src_offset, src_size) = match CHUNK_INDEX.get(&key) {
+        Some(v) => v,
+        None => return Ok(false),
+    };
+    if src_size != size || Arc::ptr_eq(&src, file) {
+        return Ok(false);
+    }
+
+    // Always validate the data, since the chunk may have been evicted or corrupted in the other
+    // cache file.
+    let mut buf = alloc_buf(size as usize);
+    src.read_exact_at(&mut buf, src_offset)?;
+    if RafsDigest::from_buf(&buf, digester) != *digest {
+        CHUNK_INDEX.remove(&key);
+        return Ok(false);
+    }
+
+    let range = FileCloneRange {
+        src_fd: src.as_raw_fd() as i64,
+        src_offset,
+        src_length: size as u64,
+        dest_offset: offset,
+    };
+    // The extents are shared only if the filesystem supports reflink, and the offsets and size
+    // are aligned to its block size.
+    let ret = unsafe { libc::ioctl(file.as_raw_fd(), FICLONERANGE as _, &range) };
+    if ret != 0 {
+        file.write_all_at(&buf, offset)?;
+    }
+
+    Ok(true)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use vmm_sys_util::tempfile::TempFile;
+
+    #[test]
+    fn test_clone_chunk() {
+        let data = vec![0x5au8; 4096];
+        let digest = RafsDigest::from_buf(&data, Algorithm::Blake3);
+        let src = Arc::new(TempFile::new().unwrap().into_file());
+        src.write_all_at(&data, 4096).unwrap();
+        let dst = Arc::new(TempFile::new().unwrap().into_file());
+
+        // Not in the index yet.
+        assert!(!clone_chunk(Algorithm::Blake3, &digest, &dst, 0, 4096).unwrap());
+
+        record_chunk(Algorithm::Blake3, &digest, &src, 4096, 4096);
+        assert!(!clone_chunk(Algorithm::Sha256, &digest, &dst, 0, 4096).unwrap());
+        assert!(!clone_chunk(Algorithm::Blake3, &digest, &src, 0, 4096).unwrap());
+        assert!(clone_chunk(Algorithm::Blake3, &digest, &dst, 0, 4096).unwrap());
+        let mut buf = vec![0u8; 4096];
+        dst.read_exact_at(&mut buf, 0).unwrap();
+        assert_eq!(buf, data);
+
+        // The corrupted chunk is dropped from the index.
+        src.write_all_at(&[0u8; 16], 4096).unwrap();
+        assert!(!clone_chunk(Algorithm::Blake3, &digest, &dst, 8192, 4096).unwrap());
+        src.write_all_at(&data, 4096).unwrap();
+        assert!(!clone_chunk(Algorithm::Blake3, &digest, &dst, 8192, 4096).unwrap());
+
+        // The chunk is dropped from the index once the cache file is closed.
+        record_chunk(Algorithm::Blake3, &digest, &src, 4096, 4096);
+        drop(src);
+        assert!(!clone_chunk(Algorithm::Blake3, &digest, &dst, 8192, 4096).unwrap());
+    }
+}
@@ -27,6 +27,8 @@ use nydus_utils::digest;
 use crate::backend::{BlobBackend, BlobReader};
 use crate::cache::state::{ChunkMap, NoopChunkMap};
 use crate::cache::{BlobCache, BlobCacheMgr};
+#[cfg(feature = "encryption")]
+use crate::crypt::{new_blob_cipher, BlobCipher, KeyProvider};
 use crate::device::{BlobChunkInfo, BlobInfo, BlobIoDesc, BlobIoVec, BlobPrefetchRequest};
 use crate::factory::CacheConfig;
 use crate::utils::{alloc_buf, copyv};
@@ -41,6 +43,8 @@ struct DummyCache {
     is_stargz: bool,
     prefetch: bool,
     validate: bool,
+    #[cfg(feature = "encryption")]
+    cipher: Option<Arc<BlobCipher>>,
 }
 
 impl BlobCache for DummyCache {
@@ -68,6 +72,11 @@ impl BlobCache for DummyCache {
         self.validate
     }
 
+    #[cfg(feature = "encryption")]
+    fn cipher(&self) -> Option<&BlobCipher> {
+        self.cipher.as_deref()
+    }
+
     fn reader(&self) -> &dyn BlobReader {
         &*self.reader
     }
@@ -154,6 +163,8 @@ impl BlobCache for DummyCache {
 /// the data to the clients.
 pub struct DummyCacheMgr {
     backend: Arc<dyn BlobBackend>,
+    #[cfg(feature = "encryption")]
+    keys: Option<Arc<dyn KeyProvider>>,
     cached: bool,
     prefetch: bool,
     validate: bool,
@@ -169,11 +180,19 @@ impl DummyCacheMgr {
     ) -> Result<DummyCacheMgr> {
         Ok(DummyCacheMgr {
             backend,
+            #[cfg(feature = "encryption")]
+            keys: None,
             cached,
             validate: config.cache_validate,
             prefetch: enable_prefetch,
         })
     }
+
+    /// Set the key provider to fetch the data keys of encrypted blobs.
+    #[cfg(feature = "encryption")]
+    pub fn set_key_provider(&mut self, keys: Option<Arc<dyn KeyProvider>>) {
+        self.keys = keys;
+    }
 }
 
 impl BlobCacheMgr for DummyCacheMgr {
@@ -192,6 +211,8 @@ impl BlobCacheMgr for DummyCacheMgr {
     fn get_blob_cache(&self, blob_info: &Arc<BlobInfo>) -> Result<Arc<dyn BlobCache>> {
         let blob_id = blob_info.blob_id().to_owned();
         let reader = self.backend.get_reader(&blob_id).map_err(|e| eother!(e))?;
+        #[cfg(feature = "encryption")]
+        let cipher = new_blob_cipher(self.keys.as_ref(), blob_info)?;
 
         Ok(Arc::new(DummyCache {
             blob_id,
@@ -202,6 +223,8 @@ impl BlobCacheMgr for DummyCacheMgr {
             is_stargz: blob_info.is_stargz(),
             prefetch: self.prefetch,
             validate: self.validate,
+            #[cfg(feature = "encryption")]
+            cipher,
         }))
     }
 }
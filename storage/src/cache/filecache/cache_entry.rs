@@ -3,28 +3,33 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use std::fs::{File, OpenOptions};
+use std::fs::File;
 use std::io::{ErrorKind, Result, Seek, SeekFrom};
 use std::mem::ManuallyDrop;
 use std::os::unix::io::{AsRawFd, FromRawFd, RawFd};
 use std::slice;
 use std::sync::atomic::{AtomicU32, Ordering};
 use std::sync::Arc;
+use std::time::Instant;
 
 use fuse_backend_rs::transport::FileVolatileSlice;
-use nix::sys::uio;
+use nix::sys::uio::{self, IoVec};
 use nix::unistd::dup;
+use nydus_utils::budget::{self, MemoryClass};
 use nydus_utils::digest;
 use nydus_utils::metrics::{BlobcacheMetrics, Metric};
 use tokio::runtime::Runtime;
 
 use crate::backend::BlobReader;
-use crate::cache::filecache::FileCacheMgr;
+use crate::cache::dedup;
+use crate::cache::filecache::{enable_blob_file_verity, open_blob_file, uring, FileCacheMgr};
 use crate::cache::state::{BlobStateMap, ChunkMap, DigestedChunkMap, IndexedChunkMap};
 use crate::cache::worker::{
     AsyncPrefetchConfig, AsyncRequestMessage, AsyncRequestState, AsyncWorkerMgr,
 };
 use crate::cache::{BlobCache, BlobIoMergeState};
+#[cfg(feature = "encryption")]
+use crate::crypt::{new_blob_cipher, BlobCipher};
 use crate::device::{
     BlobChunkInfo, BlobFeatures, BlobInfo, BlobIoChunk, BlobIoDesc, BlobIoRange, BlobIoSegment,
     BlobIoTag, BlobIoVec, BlobObject, BlobPrefetchRequest,
@@ -33,6 +38,9 @@ use crate::meta::{BlobMetaChunk, BlobMetaInfo};
 use crate::utils::{alloc_buf, copyv, readv, MemSliceCursor};
 use crate::{compress, StorageError, StorageResult, RAFS_DEFAULT_CHUNK_SIZE};
 
+// Maximum number of backend requests issued concurrently for a user read.
+const MAX_CONCURRENT_FETCHES: usize = 8;
+
 pub(crate) struct FileCacheEntry {
     blob_info: Arc<BlobInfo>,
     chunk_map: Arc<dyn ChunkMap>,
@@ -47,6 +55,10 @@ pub(crate) struct FileCacheEntry {
     blob_size: u64,
     compressor: compress::Algorithm,
     digester: digest::Algorithm,
+    // Whether to clone missing chunks from the cache files of other blobs.
+    dedup_chunks: bool,
+    // Whether to read the cache file by io_uring.
+    io_uring: bool,
     // Whether `get_blob_object()` is supported.
     is_get_blob_object_supported: bool,
     // The compressed data instead of uncompressed data is cached if `compressed` is true.
@@ -57,6 +69,9 @@ pub(crate) struct FileCacheEntry {
     is_stargz: bool,
     // Data from the file cache should be validated before use.
     need_validate: bool,
+    // Cipher to decrypt the chunks of an encrypted blob.
+    #[cfg(feature = "encryption")]
+    cipher: Option<Arc<BlobCipher>>,
     prefetch_config: Arc<AsyncPrefetchConfig>,
 }
 
@@ -69,18 +84,22 @@ impl FileCacheEntry {
         workers: Arc<AsyncWorkerMgr>,
     ) -> Result<Self> {
         let blob_file_path = format!("{}/{}", mgr.work_dir, blob_info.blob_id());
-        let file = OpenOptions::new()
-            .create(true)
-            .write(true)
-            .read(true)
-            .open(&blob_file_path)?;
+        let file = open_blob_file(&blob_file_path)?;
         let (chunk_map, is_direct_chunkmap) =
             Self::create_chunk_map(mgr, &blob_info, &blob_file_path)?;
+        let file = match chunk_map.as_range_map() {
+            Some(m) if mgr.enable_verity && m.is_range_all_ready() => {
+                enable_blob_file_verity(file, &blob_file_path)?
+            }
+            _ => file,
+        };
         let reader = mgr
             .backend
             .get_reader(blob_info.blob_id())
             .map_err(|_e| eio!("failed to get blob reader"))?;
 
+        #[cfg(feature = "encryption")]
+        let cipher = new_blob_cipher(mgr.keys.as_ref(), &blob_info)?;
         let blob_size = Self::get_blob_size(&reader, &blob_info)?;
         let compressor = blob_info.compressor();
         let digester = blob_info.digester();
@@ -88,6 +107,7 @@ impl FileCacheEntry {
         let is_compressed = mgr.is_compressed || is_stargz;
         let need_validate = (mgr.validate || !is_direct_chunkmap) && !is_stargz;
         let is_get_blob_object_supported = !mgr.is_compressed && is_direct_chunkmap && !is_stargz;
+        let dedup_chunks = mgr.enable_chunk_dedup && !is_compressed;
 
         trace!(
             "comp {} direct {} startgz {}",
@@ -127,11 +147,15 @@ impl FileCacheEntry {
             blob_size,
             compressor,
             digester,
+            dedup_chunks,
+            io_uring: mgr.enable_io_uring,
             is_get_blob_object_supported,
             is_compressed,
             is_direct_chunkmap,
             is_stargz,
             need_validate,
+            #[cfg(feature = "encryption")]
+            cipher,
             prefetch_config,
         })
     }
@@ -198,6 +222,11 @@ impl BlobCache for FileCacheEntry {
         self.need_validate
     }
 
+    #[cfg(feature = "encryption")]
+    fn cipher(&self) -> Option<&BlobCipher> {
+        self.cipher.as_deref()
+    }
+
     fn reader(&self) -> &dyn BlobReader {
         &*self.reader
     }
@@ -345,6 +374,33 @@ impl BlobCache for FileCacheEntry {
         Ok(total_size)
     }
 
+    fn scrub_chunk(&self, chunk: &BlobIoChunk) -> Result<bool> {
+        // Only the persistent chunk map tells which chunks are cached across restarts, and the
+        // stargz data is decompressed as a stream.
+        if self.is_stargz
+            || !self.chunk_map.is_persist()
+            || !self.chunk_map.is_ready(chunk.as_base())?
+        {
+            return Ok(true);
+        }
+
+        let mut buffer = alloc_buf(chunk.uncompress_size() as usize);
+        self.metrics.scrubbed_chunks.inc();
+        if let Err(e) = self.read_file_cache(chunk, &mut buffer, true) {
+            warn!(
+                "evict corrupted chunk {} of blob {} from cache: {}",
+                chunk.id(),
+                self.blob_info.blob_id(),
+                e
+            );
+            self.metrics.scrub_corrupted_chunks.inc();
+            self.chunk_map.clear_ready(chunk.as_base())?;
+            return Ok(false);
+        }
+
+        Ok(true)
+    }
+
     fn read(&self, iovec: &mut BlobIoVec, buffers: &[FileVolatileSlice]) -> Result<usize> {
         debug_assert!(iovec.validate());
         self.metrics.total.inc();
@@ -515,13 +571,35 @@ impl FileCacheEntry {
         let requests = self
             .merge_requests_for_user(bios, RAFS_DEFAULT_CHUNK_SIZE as usize * 2)
             .ok_or_else(|| einval!("Empty bios list"))?;
-        let mut state = FileIoMergeState::new();
+        let mut states = Vec::with_capacity(requests.len());
+        for req in requests.iter() {
+            let mut state = FileIoMergeState::new();
+            self.prepare_one_range(req, &mut state)?;
+            states.push(state);
+        }
+
+        let regions: Vec<&Region> = states.iter().flat_map(|s| s.regions.iter()).collect();
+        if self.io_uring
+            && regions.len() > 1
+            && regions.iter().all(|r| r.r#type == RegionType::CacheFast)
+        {
+            return self.dispatch_cache_fast_batch(buffers, &regions);
+        }
+
+        let mut raw_data = self.fetch_backend_regions(&regions).into_iter();
         let mut cursor = MemSliceCursor::new(buffers);
         let mut total_read: usize = 0;
 
-        for req in requests {
-            total_read += self.dispatch_one_range(&req, &mut cursor, &mut state)?;
-            state.reset();
+        for r in regions {
+            use RegionType::*;
+
+            // Safe to unwrap because there's one entry for each region.
+            let raw = raw_data.next().unwrap();
+            total_read += match r.r#type {
+                CacheFast => self.dispatch_cache_fast(&mut cursor, r)?,
+                CacheSlow => self.dispatch_cache_slow(&mut cursor, r)?,
+                Backend => self.dispatch_backend(&mut cursor, r, raw)?,
+            }
         }
 
         Ok(total_read)
@@ -535,11 +613,36 @@ impl FileCacheEntry {
     ) -> Result<usize> {
         let mut total_read: usize = 0;
 
+        self.prepare_one_range(req, state)?;
+        for r in &state.regions {
+            use RegionType::*;
+
+            total_read += match r.r#type {
+                CacheFast => self.dispatch_cache_fast(cursor, r)?,
+                CacheSlow => self.dispatch_cache_slow(cursor, r)?,
+                Backend => self.dispatch_backend(cursor, r, None)?,
+            }
+        }
+
+        Ok(total_read)
+    }
+
+    fn prepare_one_range(&self, req: &BlobIoRange, state: &mut FileIoMergeState) -> Result<()> {
         trace!("dispatch single io range {:?}", req);
         for (i, chunk) in req.chunks.iter().enumerate() {
             let is_ready = self
                 .chunk_map
                 .check_ready_and_mark_pending(chunk.as_base())?;
+            if is_ready && self.dedup_chunks {
+                // The chunks cached by the previous daemon are recorded when they are read.
+                dedup::record_chunk(
+                    self.digester,
+                    chunk.chunk_id(),
+                    &self.file,
+                    chunk.uncompress_offset(),
+                    chunk.uncompress_size(),
+                );
+            }
 
             // Directly read data from the file cache into the user buffer iff:
             // - the chunk is ready in the file cache
@@ -575,6 +678,16 @@ impl FileCacheEntry {
                     // On slow path, don't try to handle internal(read amplification) IO.
                     self.chunk_map.clear_pending(chunk.as_base());
                 }
+            } else if self.dedup_chunks && self.clone_chunk(chunk) {
+                if req.tags[i].is_user_io() {
+                    state.push(
+                        RegionType::CacheSlow,
+                        chunk.uncompress_offset(),
+                        chunk.uncompress_size(),
+                        req.tags[i].clone(),
+                        Some(req.chunks[i].clone()),
+                    )?;
+                }
             } else {
                 let tag = if let BlobIoTag::User(ref s) = req.tags[i] {
                     BlobIoTag::User(s.clone())
@@ -592,17 +705,105 @@ impl FileCacheEntry {
             }
         }
 
-        for r in &state.regions {
-            use RegionType::*;
+        Ok(())
+    }
 
-            total_read += match r.r#type {
-                CacheFast => self.dispatch_cache_fast(cursor, r)?,
-                CacheSlow => self.dispatch_cache_slow(cursor, r)?,
-                Backend => self.dispatch_backend(cursor, r)?,
+    // Clone the chunk from the cache file of another blob and mark it as ready, return false if
+    // it should be downloaded from the storage backend.
+    fn clone_chunk(&self, chunk: &BlobIoChunk) -> bool {
+        let offset = chunk.uncompress_offset();
+        let size = chunk.uncompress_size();
+        match dedup::clone_chunk(self.digester, chunk.chunk_id(), &self.file, offset, size) {
+            Ok(true) => {}
+            Ok(false) => return false,
+            Err(e) => {
+                warn!(
+                    "failed to clone chunk at {} from other blobs: {}",
+                    offset, e
+                );
+                return false;
             }
         }
+        if let Err(e) = self.chunk_map.set_ready_and_clear_pending(chunk.as_base()) {
+            error!(
+                "Failed change caching state for chunk of offset {}, {:?}",
+                offset, e
+            );
+            return false;
+        }
 
-        Ok(total_read)
+        self.metrics.dedup_chunks.inc();
+        self.metrics.dedup_data_amount.add(size as u64);
+        dedup::record_chunk(self.digester, chunk.chunk_id(), &self.file, offset, size);
+
+        true
+    }
+
+    // Download raw data of backend regions with user io concurrently, so a read spanning many
+    // chunks which are not ready doesn't wait for the backend requests one by one. Each region
+    // covers continuous chunks merged into one backend request.
+    //
+    // Return one entry for each region, which is `None` if the region should be downloaded by
+    // `dispatch_backend()` itself.
+    fn fetch_backend_regions(&self, regions: &[&Region]) -> Vec<Option<Result<Vec<u8>>>> {
+        let mut raw_data: Vec<Option<Result<Vec<u8>>>> = regions.iter().map(|_| None).collect();
+        let targets: Vec<usize> = (0..regions.len())
+            .filter(|i| {
+                let r = regions[*i];
+                r.r#type == RegionType::Backend && r.has_user_io() && !r.chunks.is_empty()
+            })
+            .collect();
+        if targets.len() < 2 {
+            return raw_data;
+        }
+
+        let start = Instant::now();
+        for batch in targets.chunks(MAX_CONCURRENT_FETCHES) {
+            // The first region of the batch is downloaded by the current thread.
+            let handles: Vec<_> = batch[1..]
+                .iter()
+                .map(|i| {
+                    let reader = self.reader.clone();
+                    let offset = regions[*i].blob_address;
+                    let size = regions[*i].blob_len as usize;
+                    std::thread::Builder::new()
+                        .name("nydus_storage_fetcher".to_string())
+                        .spawn(move || Self::fetch_raw_data(reader.as_ref(), offset, size))
+                })
+                .collect();
+
+            let r = regions[batch[0]];
+            raw_data[batch[0]] = Some(Self::fetch_raw_data(
+                self.reader.as_ref(),
+                r.blob_address,
+                r.blob_len as usize,
+            ));
+            for (i, handle) in batch[1..].iter().zip(handles) {
+                raw_data[*i] = Some(match handle {
+                    Ok(h) => h
+                        .join()
+                        .unwrap_or_else(|_| Err(eio!("thread to fetch blob data panicked"))),
+                    Err(e) => Err(e),
+                });
+            }
+        }
+        self.workers.record_ondemand_latency(start.elapsed());
+
+        raw_data
+    }
+
+    fn fetch_raw_data(reader: &dyn BlobReader, offset: u64, size: usize) -> Result<Vec<u8>> {
+        let _permit = budget::acquire_memory(MemoryClass::BackendBuffers, size as u64);
+        let mut buf = alloc_buf(size);
+        let nr_read = reader.read(&mut buf, offset).map_err(|e| eio!(e))?;
+        if nr_read != size {
+            return Err(eio!(format!(
+                "request for {} bytes but got {} bytes",
+                size, nr_read
+            )));
+        }
+
+        Ok(buf)
     }
 
     // Directly read data requested by user from the file cache into the user memory buffer.
@@ -612,7 +813,40 @@ impl FileCacheEntry {
         let iovec = cursor.consume(size);
 
         self.metrics.partial_hits.inc();
-        readv(self.file.as_raw_fd(), &iovec, offset)
+        if self.io_uring {
+            uring::readv(self.file.as_raw_fd(), &iovec, offset)
+        } else {
+            readv(self.file.as_raw_fd(), &iovec, offset)
+        }
+    }
+
+    // Read the cached regions requested by user into the user memory buffer by io_uring, which
+    // are submitted together instead of one syscall for each region.
+    fn dispatch_cache_fast_batch(
+        &self,
+        buffers: &[FileVolatileSlice],
+        regions: &[&Region],
+    ) -> Result<usize> {
+        let mut cursor = MemSliceCursor::new(buffers);
+        let iovecs: Vec<(Vec<IoVec<&mut [u8]>>, u64)> = regions
+            .iter()
+            .map(|r| {
+                self.metrics.partial_hits.inc();
+                let offset = r.blob_address + r.seg.offset as u64;
+                (cursor.consume(r.seg.len as usize), offset)
+            })
+            .collect();
+        let requests: Vec<(&[IoVec<&mut [u8]>], u64)> = iovecs
+            .iter()
+            .map(|(iovec, offset)| (iovec.as_slice(), *offset))
+            .collect();
+
+        let mut total_read = 0;
+        for res in uring::readv_batch(self.file.as_raw_fd(), &requests) {
+            total_read += res?;
+        }
+
+        Ok(total_read)
     }
 
     fn dispatch_cache_slow(&self, cursor: &mut MemSliceCursor, region: &Region) -> Result<usize> {
@@ -630,7 +864,12 @@ impl FileCacheEntry {
         Ok(total_read)
     }
 
-    fn dispatch_backend(&self, mem_cursor: &mut MemSliceCursor, region: &Region) -> Result<usize> {
+    fn dispatch_backend(
+        &self,
+        mem_cursor: &mut MemSliceCursor,
+        region: &Region,
+        raw: Option<Result<Vec<u8>>>,
+    ) -> Result<usize> {
         if region.chunks.is_empty() {
             return Ok(0);
         } else if !region.has_user_io() {
@@ -643,7 +882,15 @@ impl FileCacheEntry {
 
         let blob_size = region.blob_len as usize;
         debug!("total backend data {}KB", blob_size / 1024);
-        let mut chunks = self.read_chunks(region.blob_address, blob_size, &region.chunks)?;
+        let mut chunks = match raw {
+            Some(raw) => self.process_raw_chunks(region.blob_address, &raw?, &region.chunks)?,
+            None => {
+                let start = Instant::now();
+                let chunks = self.read_chunks(region.blob_address, blob_size, &region.chunks)?;
+                self.workers.record_ondemand_latency(start.elapsed());
+                chunks
+            }
+        };
         assert_eq!(region.chunks.len(), chunks.len());
 
         let mut chunk_buffers = Vec::with_capacity(region.chunks.len());
@@ -686,20 +933,37 @@ impl FileCacheEntry {
             chunk_info.uncompress_offset()
         };
         let metrics = self.metrics.clone();
+        let dedup_digester = if self.dedup_chunks {
+            Some(self.digester)
+        } else {
+            None
+        };
 
-        metrics.buffered_backend_size.add(buffer.size() as u64);
-        self.runtime.spawn_blocking(move || {
-            metrics.buffered_backend_size.sub(buffer.size() as u64);
+        let size = buffer.size() as u64;
+        metrics.buffered_backend_size.add(size);
+        let persist = move || {
+            metrics.buffered_backend_size.sub(size);
             match Self::persist_chunk(&file, offset, buffer.slice()) {
-                Ok(_) => delayed_chunk_map
-                    .set_ready_and_clear_pending(chunk_info.as_base())
-                    .unwrap_or_else(|e| {
-                        error!(
-                            "Failed change caching state for chunk of offset {}, {:?}",
-                            chunk_info.compress_offset(),
-                            e
-                        )
-                    }),
+                Ok(_) => {
+                    if let Some(digester) = dedup_digester {
+                        dedup::record_chunk(
+                            digester,
+                            chunk_info.chunk_id(),
+                            &file,
+                            offset,
+                            chunk_info.uncompress_size(),
+                        );
+                    }
+                    delayed_chunk_map
+                        .set_ready_and_clear_pending(chunk_info.as_base())
+                        .unwrap_or_else(|e| {
+                            error!(
+                                "Failed change caching state for chunk of offset {}, {:?}",
+                                chunk_info.compress_offset(),
+                                e
+                            )
+                        })
+                }
                 Err(e) => {
                     error!(
                         "Persist chunk of offset {} failed, {:?}",
@@ -709,7 +973,18 @@ impl FileCacheEntry {
                     delayed_chunk_map.clear_pending(chunk_info.as_base())
                 }
             }
-        });
+        };
+
+        // Persist the chunk synchronously if buffering it would exceed the memory budget.
+        match budget::reserve_memory(MemoryClass::PersistBuffers, size) {
+            Ok(permit) => {
+                self.runtime.spawn_blocking(move || {
+                    persist();
+                    drop(permit);
+                });
+            }
+            Err(_) => persist(),
+        }
     }
 
     /// Persist a single chunk into local blob cache file. We have to write to the cache
@@ -759,7 +1034,7 @@ impl FileCacheEntry {
         // - chunk data validation is enabled.
         // - digested or dummy chunk map is used.
         let try_cache = is_ready || (!self.is_stargz && !self.is_direct_chunkmap);
-        let buffer = if try_cache && self.read_file_cache(chunk, d.mut_slice()).is_ok() {
+        let buffer = if try_cache && self.read_file_cache(chunk, d.mut_slice(), false).is_ok() {
             self.metrics.whole_hits.inc();
             self.chunk_map
                 .set_ready_and_clear_pending(chunk.as_base())?;
@@ -815,7 +1090,12 @@ impl FileCacheEntry {
         Ok(read_size)
     }
 
-    fn read_file_cache(&self, chunk: &BlobIoChunk, buffer: &mut [u8]) -> Result<()> {
+    fn read_file_cache(
+        &self,
+        chunk: &BlobIoChunk,
+        buffer: &mut [u8],
+        force_validation: bool,
+    ) -> Result<()> {
         let offset = if self.is_compressed {
             chunk.compress_offset()
         } else {
@@ -851,21 +1131,27 @@ impl FileCacheEntry {
                 offset,
                 raw_buffer.len()
             );
-            let nr_read = uio::pread(self.file.as_raw_fd(), raw_buffer, offset as i64)
-                .map_err(|_| last_error!())?;
+            let nr_read = if self.io_uring {
+                uring::read(self.file.as_raw_fd(), raw_buffer, offset)?
+            } else {
+                uio::pread(self.file.as_raw_fd(), raw_buffer, offset as i64)
+                    .map_err(|_| last_error!())?
+            };
             if nr_read == 0 || nr_read != raw_buffer.len() {
                 return Err(einval!());
             }
         }
 
         // Try to validate data just fetched from backend inside.
+        // The raw data of chunks is cached if `is_compressed` is true.
         self.process_raw_chunk(
             chunk,
             raw_buffer,
             raw_stream,
             buffer,
             self.is_compressed,
-            false,
+            self.is_compressed,
+            force_validation,
         )?;
 
         Ok(())
@@ -1068,10 +1354,6 @@ impl FileIoMergeState {
             .map_err(|e| einval!(e))
     }
 
-    fn reset(&mut self) {
-        self.regions.truncate(0);
-    }
-
     #[inline]
     fn joinable(&self, region_type: RegionType) -> bool {
         debug_assert!(!self.regions.is_empty());
@@ -3,10 +3,14 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use std::collections::HashMap;
-use std::fs;
-use std::io::Result;
-use std::sync::{Arc, RwLock};
+use std::cmp;
+use std::collections::{HashMap, HashSet};
+use std::fs::{self, File, OpenOptions};
+use std::io::{Error, ErrorKind, Result};
+use std::os::unix::fs::MetadataExt;
+use std::os::unix::io::AsRawFd;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex, RwLock, Weak};
 use std::time::Duration;
 
 use tokio::runtime::{Builder, Runtime};
@@ -16,11 +20,14 @@ use nydus_utils::metrics::BlobcacheMetrics;
 use self::cache_entry::FileCacheEntry;
 use crate::backend::BlobBackend;
 use crate::cache::worker::{AsyncPrefetchConfig, AsyncWorkerMgr};
-use crate::cache::{BlobCache, BlobCacheMgr};
+use crate::cache::{BlobCache, BlobCacheMgr, BlobCacheUsage, CacheUsage};
+#[cfg(feature = "encryption")]
+use crate::crypt::KeyProvider;
 use crate::device::BlobInfo;
 use crate::factory::CacheConfig;
 
 mod cache_entry;
+mod uring;
 
 fn default_work_dir() -> String {
     ".".to_string()
@@ -32,6 +39,16 @@ struct BlobCacheConfig {
     work_dir: String,
     #[serde(default)]
     disable_indexed_map: bool,
+    #[serde(default)]
+    cache_quota: u64,
+    #[serde(default)]
+    pinned_blobs: Vec<String>,
+    #[serde(default)]
+    enable_verity: bool,
+    #[serde(default)]
+    enable_chunk_dedup: bool,
+    #[serde(default)]
+    enable_io_uring: bool,
 }
 
 impl BlobCacheConfig {
@@ -59,12 +76,273 @@ impl BlobCacheConfig {
     }
 }
 
+type BlobMap = RwLock<HashMap<String, Arc<FileCacheEntry>>>;
+
+// A file cache manager using a cache directory.
+struct CacheDirUser {
+    work_dir: String,
+    blobs: Weak<BlobMap>,
+    pinned_blobs: Vec<String>,
+}
+
+lazy_static::lazy_static! {
+    // All file cache managers, so that the blobs used or pinned by any manager sharing the cache
+    // directory are not evicted.
+    static ref CACHE_DIR_USERS: Mutex<Vec<CacheDirUser>> = Mutex::new(Vec::new());
+}
+
+// Get ids of the blobs in `work_dir` used by mounted filesystems, and the pinned ones.
+fn get_blob_states(work_dir: &str) -> (HashSet<String>, HashSet<String>) {
+    let mut in_use = HashSet::new();
+    let mut pinned = HashSet::new();
+    let mut users = CACHE_DIR_USERS.lock().unwrap();
+
+    users.retain(|u| u.blobs.strong_count() > 0);
+    for user in users.iter().filter(|u| u.work_dir == work_dir) {
+        pinned.extend(user.pinned_blobs.iter().cloned());
+        if let Some(blobs) = user.blobs.upgrade() {
+            for (id, entry) in blobs.read().unwrap().iter() {
+                // The entry is referenced by the blob devices of mounted filesystems.
+                if Arc::strong_count(entry) > 1 {
+                    in_use.insert(id.to_owned());
+                }
+            }
+        }
+    }
+
+    (in_use, pinned)
+}
+
+// Lock the file by `flock()`, return false if it's locked by others with `LOCK_NB`.
+fn lock_file(file: &File, operation: libc::c_int) -> Result<bool> {
+    if unsafe { libc::flock(file.as_raw_fd(), operation) } == 0 {
+        return Ok(true);
+    }
+    let err = Error::last_os_error();
+    if err.raw_os_error() == Some(libc::EWOULDBLOCK) {
+        Ok(false)
+    } else {
+        Err(err)
+    }
+}
+
+// Check whether the blob file is locked by this or other daemons sharing the cache directory.
+fn is_blob_file_locked(path: &Path) -> Result<bool> {
+    match File::open(path) {
+        // The lock is released once the file is closed.
+        Ok(file) => Ok(!lock_file(&file, libc::LOCK_EX | libc::LOCK_NB)?),
+        Err(e) if e.kind() == ErrorKind::NotFound => Ok(false),
+        Err(e) => Err(e),
+    }
+}
+
+/// Open the blob file of cache with a shared lock, which is held until the file is closed.
+///
+/// Multiple daemons may share the cache directory, the lock keeps the blob from being evicted by
+/// others while it's used.
+pub(crate) fn open_blob_file(path: &str) -> Result<File> {
+    match open_locked_file(path, true) {
+        // The blob file is read-only once fs-verity is enabled, and it's never written because
+        // fs-verity is only enabled on fully cached blobs.
+        Err(e) if e.raw_os_error() == Some(libc::EPERM) => open_locked_file(path, false),
+        r => r,
+    }
+}
+
+fn open_locked_file(path: &str, writable: bool) -> Result<File> {
+    loop {
+        let file = OpenOptions::new()
+            .create(writable)
+            .write(writable)
+            .read(true)
+            .open(path)?;
+        lock_file(&file, libc::LOCK_SH)?;
+
+        // The blob may be evicted before the lock is taken, then open the new one.
+        let md = file.metadata()?;
+        match fs::metadata(path) {
+            Ok(m) if m.dev() == md.dev() && m.ino() == md.ino() => return Ok(file),
+            Ok(_) => {}
+            Err(e) if e.kind() == ErrorKind::NotFound => {}
+            Err(e) => return Err(e),
+        }
+    }
+}
+
+// struct fsverity_enable_arg of <linux/fsverity.h>.
+#[repr(C)]
+struct FsverityEnableArg {
+    version: u32,
+    hash_algorithm: u32,
+    block_size: u32,
+    salt_size: u32,
+    salt_ptr: u64,
+    sig_size: u32,
+    reserved1: u32,
+    sig_ptr: u64,
+    reserved2: [u64; 11],
+}
+
+const FS_IOC_ENABLE_VERITY: libc::c_ulong = 0x4080_6685;
+const FS_VERITY_HASH_ALG_SHA256: u32 = 1;
+
+/// Enable fs-verity on the fully cached blob file, so that the data modified on disk is detected
+/// by the kernel at read time.
+///
+/// Return the blob file reopened read-only, or reopened for write if fs-verity can't be enabled,
+/// e.g. it's not supported by the filesystem or the file is opened for write by other daemons.
+pub(crate) fn enable_blob_file_verity(file: File, path: &str) -> Result<File> {
+    // The shared lock is kept by the new file, so the blob isn't evicted meanwhile.
+    let ro_file = open_locked_file(path, false)?;
+    // fs-verity can't be enabled while the file is opened for write.
+    drop(file);
+
+    let arg = FsverityEnableArg {
+        version: 1,
+        hash_algorithm: FS_VERITY_HASH_ALG_SHA256,
+        block_size: unsafe { libc::sysconf(libc::_SC_PAGESIZE) } as u32,
+        salt_size: 0,
+        salt_ptr: 0,
+        sig_size: 0,
+        reserved1: 0,
+        sig_ptr: 0,
+        reserved2: [0; 11],
+    };
+    // Building the Merkle tree reads the whole file, which is done only once for each blob file.
+    let ret = unsafe { libc::ioctl(ro_file.as_raw_fd(), FS_IOC_ENABLE_VERITY as _, &arg) };
+    if ret == 0 {
+        info!("fs-verity is enabled on blob file {}", path);
+        return Ok(ro_file);
+    }
+
+    let err = Error::last_os_error();
+    if err.raw_os_error() == Some(libc::EEXIST) {
+        Ok(ro_file)
+    } else {
+        warn!("failed to enable fs-verity on blob file {}: {}", path, err);
+        open_blob_file(path)
+    }
+}
+
+// Scan the cache files in `work_dir`, return the cached blobs and their files, least recently
+// used first.
+fn scan_work_dir(work_dir: &str) -> Result<Vec<(BlobCacheUsage, Vec<PathBuf>)>> {
+    let (in_use, pinned) = get_blob_states(work_dir);
+    let mut blobs: HashMap<String, (BlobCacheUsage, Vec<PathBuf>)> = HashMap::new();
+
+    for entry in fs::read_dir(work_dir)? {
+        let entry = entry?;
+        // The file may be removed meanwhile.
+        let md = match entry.metadata() {
+            Ok(md) => md,
+            Err(_) => continue,
+        };
+        // The blob file is named by the blob id, and the chunk map by the blob id with a suffix.
+        let name = entry.file_name().to_string_lossy().to_string();
+        let blob_id = name.split('.').next().unwrap_or_default().to_string();
+        if !md.is_file() || blob_id.is_empty() {
+            continue;
+        }
+
+        let (usage, files) = blobs.entry(blob_id.clone()).or_insert_with(|| {
+            let usage = BlobCacheUsage {
+                in_use: in_use.contains(&blob_id),
+                pinned: pinned.contains(&blob_id),
+                blob_id,
+                size: 0,
+                last_access: 0,
+            };
+            (usage, Vec::new())
+        });
+        // The blob files are sparse, so count the allocated blocks.
+        usage.size += md.blocks() * 512;
+        usage.last_access = cmp::max(usage.last_access, cmp::max(md.atime(), md.mtime()) as u64);
+        files.push(entry.path());
+    }
+
+    for (usage, _) in blobs.values_mut() {
+        if !usage.in_use {
+            usage.in_use = is_blob_file_locked(&Path::new(work_dir).join(&usage.blob_id))?;
+        }
+    }
+
+    let mut blobs: Vec<(BlobCacheUsage, Vec<PathBuf>)> =
+        blobs.into_iter().map(|(_, v)| v).collect();
+    blobs.sort_by(|(a, _), (b, _)| {
+        a.last_access
+            .cmp(&b.last_access)
+            .then_with(|| a.blob_id.cmp(&b.blob_id))
+    });
+
+    Ok(blobs)
+}
+
+// Evict the least recently used blobs in `work_dir`, which are neither used nor pinned, until
+// the disk usage is below `target` bytes.
+fn trim_work_dir(work_dir: &str, target: u64) -> Result<u64> {
+    let blobs = scan_work_dir(work_dir)?;
+    let mut used: u64 = blobs.iter().map(|(b, _)| b.size).sum();
+    let mut freed = 0;
+
+    for (blob, files) in blobs.iter() {
+        if used <= target {
+            break;
+        }
+        if blob.in_use || blob.pinned {
+            continue;
+        }
+
+        // Hold the lock until all files of the blob are removed, and remove the blob file at
+        // last, so the daemon opening the blob meanwhile waits for the lock and starts over with
+        // a new blob file and chunk map.
+        let blob_file = Path::new(work_dir).join(&blob.blob_id);
+        let _lock = match File::open(&blob_file) {
+            Ok(file) => {
+                if !lock_file(&file, libc::LOCK_EX | libc::LOCK_NB)? {
+                    continue;
+                }
+                Some(file)
+            }
+            // There's only the chunk map left.
+            Err(e) if e.kind() == ErrorKind::NotFound => None,
+            Err(e) => return Err(e),
+        };
+        for file in files.iter().filter(|f| **f != blob_file) {
+            if let Err(e) = fs::remove_file(file) {
+                warn!("failed to remove cache file {:?}: {}", file, e);
+            }
+        }
+        if let Err(e) = fs::remove_file(&blob_file) {
+            if e.kind() != ErrorKind::NotFound {
+                warn!("failed to remove cache file {:?}: {}", blob_file, e);
+            }
+        }
+        info!(
+            "evict blob {} of {} bytes from cache {}",
+            blob.blob_id, blob.size, work_dir
+        );
+        used -= blob.size;
+        freed += blob.size;
+    }
+
+    if used > target {
+        warn!(
+            "cache {} uses {} bytes over target {} bytes by used or pinned blobs",
+            work_dir, used, target
+        );
+    }
+
+    Ok(freed)
+}
+
 /// An implementation of [BlobCacheMgr](../trait.BlobCacheMgr.html) to improve performance by
 /// caching uncompressed blob with local storage.
 #[derive(Clone)]
 pub struct FileCacheMgr {
-    blobs: Arc<RwLock<HashMap<String, Arc<FileCacheEntry>>>>,
+    blobs: Arc<BlobMap>,
     backend: Arc<dyn BlobBackend>,
+    #[cfg(feature = "encryption")]
+    keys: Option<Arc<dyn KeyProvider>>,
     metrics: Arc<BlobcacheMetrics>,
     prefetch_config: Arc<AsyncPrefetchConfig>,
     runtime: Arc<Runtime>,
@@ -73,6 +351,10 @@ pub struct FileCacheMgr {
     validate: bool,
     disable_indexed_map: bool,
     is_compressed: bool,
+    cache_quota: u64,
+    enable_verity: bool,
+    enable_chunk_dedup: bool,
+    enable_io_uring: bool,
 }
 
 impl FileCacheMgr {
@@ -97,10 +379,18 @@ impl FileCacheMgr {
         );
         let prefetch_config: Arc<AsyncPrefetchConfig> = Arc::new(config.prefetch_config.into());
         let worker_mgr = AsyncWorkerMgr::new(metrics.clone(), prefetch_config.clone())?;
+        let blobs = Arc::new(RwLock::new(HashMap::new()));
+        CACHE_DIR_USERS.lock().unwrap().push(CacheDirUser {
+            work_dir: work_dir.to_owned(),
+            blobs: Arc::downgrade(&blobs),
+            pinned_blobs: blob_config.pinned_blobs.clone(),
+        });
 
         Ok(FileCacheMgr {
-            blobs: Arc::new(RwLock::new(HashMap::new())),
+            blobs,
             backend,
+            #[cfg(feature = "encryption")]
+            keys: None,
             metrics,
             prefetch_config,
             runtime,
@@ -109,9 +399,19 @@ impl FileCacheMgr {
             disable_indexed_map: blob_config.disable_indexed_map,
             validate: config.cache_validate,
             is_compressed: config.cache_compressed,
+            cache_quota: blob_config.cache_quota,
+            enable_verity: blob_config.enable_verity,
+            enable_chunk_dedup: blob_config.enable_chunk_dedup,
+            enable_io_uring: blob_config.enable_io_uring,
         })
     }
 
+    /// Set the key provider to fetch the data keys of encrypted blobs.
+    #[cfg(feature = "encryption")]
+    pub fn set_key_provider(&mut self, keys: Option<Arc<dyn KeyProvider>>) {
+        self.keys = keys;
+    }
+
     // Get the file cache entry for the specified blob object.
     fn get(&self, blob: &Arc<BlobInfo>) -> Option<Arc<FileCacheEntry>> {
         self.blobs.read().unwrap().get(blob.blob_id()).cloned()
@@ -132,18 +432,27 @@ impl FileCacheMgr {
             self.worker_mgr.clone(),
         )?;
         let entry = Arc::new(entry);
-        let mut guard = self.blobs.write().unwrap();
-        if let Some(entry) = guard.get(blob.blob_id()) {
-            Ok(entry.clone())
-        } else {
+        {
+            let mut guard = self.blobs.write().unwrap();
+            if let Some(entry) = guard.get(blob.blob_id()) {
+                return Ok(entry.clone());
+            }
             guard.insert(blob.blob_id().to_owned(), entry.clone());
             self.metrics
                 .underlying_files
                 .lock()
                 .unwrap()
                 .insert(blob.blob_id().to_string());
-            Ok(entry)
         }
+
+        // The new blob grows the cache, so evict old blobs if the cache is over quota.
+        if self.cache_quota > 0 {
+            if let Err(e) = self.trim(None) {
+                warn!("failed to trim cache {}: {}", self.work_dir, e);
+            }
+        }
+
+        Ok(entry)
     }
 }
 
@@ -189,6 +498,32 @@ impl BlobCacheMgr for FileCacheMgr {
         self.get_or_create_cache_entry(blob_info)
             .map(|v| v as Arc<dyn BlobCache>)
     }
+
+    fn usage(&self) -> Result<Option<CacheUsage>> {
+        let blobs: Vec<BlobCacheUsage> = scan_work_dir(&self.work_dir)?
+            .into_iter()
+            .map(|(b, _)| b)
+            .collect();
+
+        Ok(Some(CacheUsage {
+            work_dir: self.work_dir.clone(),
+            quota: self.cache_quota,
+            used: blobs.iter().map(|b| b.size).sum(),
+            blobs,
+        }))
+    }
+
+    fn trim(&self, target: Option<u64>) -> Result<u64> {
+        let target = match target {
+            Some(v) => v,
+            None if self.cache_quota > 0 => self.cache_quota,
+            None => return Ok(0),
+        };
+        // Release the blobs not used by any filesystem, so they may be evicted.
+        self.gc();
+
+        trim_work_dir(&self.work_dir, target)
+    }
 }
 
 #[cfg(test)]
@@ -251,6 +586,72 @@ pub mod blob_cache_tests {
         assert!(blob_config.get_work_dir().is_err());
     }
 
+    #[test]
+    fn test_trim_work_dir() {
+        let tmp_dir = TempDir::new().unwrap();
+        let work_dir = tmp_dir.as_path().to_str().unwrap().to_owned();
+        for name in &["aaa", "aaa.chunk_map", "bbb", "ccc"] {
+            fs::write(tmp_dir.as_path().join(name), vec![1u8; 4096]).unwrap();
+            std::thread::sleep(Duration::from_millis(20));
+        }
+        let size = fs::metadata(tmp_dir.as_path().join("bbb"))
+            .unwrap()
+            .blocks()
+            * 512;
+
+        let blobs: Arc<BlobMap> = Arc::new(RwLock::new(HashMap::new()));
+        CACHE_DIR_USERS.lock().unwrap().push(CacheDirUser {
+            work_dir: work_dir.clone(),
+            blobs: Arc::downgrade(&blobs),
+            pinned_blobs: vec!["ccc".to_string()],
+        });
+
+        let usage = scan_work_dir(&work_dir).unwrap();
+        let ids: Vec<&str> = usage.iter().map(|(b, _)| b.blob_id.as_str()).collect();
+        assert_eq!(ids, vec!["aaa", "bbb", "ccc"]);
+        assert_eq!(usage[0].0.size, size * 2);
+        assert!(usage[2].0.pinned);
+
+        // The least recently used blob is evicted with its chunk map.
+        assert_eq!(trim_work_dir(&work_dir, size * 2).unwrap(), size * 2);
+        assert!(!tmp_dir.as_path().join("aaa").exists());
+        assert!(!tmp_dir.as_path().join("aaa.chunk_map").exists());
+        assert!(tmp_dir.as_path().join("bbb").exists());
+
+        // The pinned blob is never evicted.
+        assert_eq!(trim_work_dir(&work_dir, 0).unwrap(), size);
+        assert!(!tmp_dir.as_path().join("bbb").exists());
+        assert!(tmp_dir.as_path().join("ccc").exists());
+    }
+
+    #[test]
+    fn test_shared_blob_file() {
+        let tmp_dir = TempDir::new().unwrap();
+        let work_dir = tmp_dir.as_path().to_str().unwrap().to_owned();
+        let path = format!("{}/ddd", work_dir);
+
+        // Both daemons sharing the cache directory may open the blob.
+        let file1 = open_blob_file(&path).unwrap();
+        let file2 = open_blob_file(&path).unwrap();
+        fs::write(&path, vec![1u8; 4096]).unwrap();
+        fs::write(format!("{}.chunk_map", path), vec![1u8; 4096]).unwrap();
+
+        let usage = scan_work_dir(&work_dir).unwrap();
+        assert_eq!(usage.len(), 1);
+        assert!(usage[0].0.in_use);
+        assert_eq!(trim_work_dir(&work_dir, 0).unwrap(), 0);
+
+        drop(file1);
+        assert_eq!(trim_work_dir(&work_dir, 0).unwrap(), 0);
+        drop(file2);
+        assert!(trim_work_dir(&work_dir, 0).unwrap() > 0);
+        assert!(!Path::new(&path).exists());
+
+        // The evicted blob is created again.
+        let _file = open_blob_file(&path).unwrap();
+        assert!(Path::new(&path).exists());
+    }
+
     /*
        #[test]
        fn test_add() {
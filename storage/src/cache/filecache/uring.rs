@@ -0,0 +1,581 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Read cache files by io_uring.
+//!
+//! Each thread reading the cache files owns a small ring, set up on its first read, so reads from
+//! FUSE worker threads never contend on a lock. The cached regions of a user request are read by
+//! `IORING_OP_READV` requests submitted and waited by a single `io_uring_enter()`, instead of one
+//! `preadv()` for each region. It falls back to `preadv()` if the kernel doesn't support io_uring,
+//! e.g. before 5.1 or with io_uring disabled by seccomp or sysctl.
+#[cfg(test)]
+use std::cell::Cell;
+use std::cell::RefCell;
+use std::io::{Error, ErrorKind, Result};
+use std::os::unix::io::RawFd;
+use std::ptr;
+use std::sync::atomic::{AtomicBool, AtomicU32, Ordering};
+use std::thread;
+use std::time::Duration;
+
+use nix::sys::uio::IoVec;
+
+use crate::utils::readv as preadv;
+
+// Maximum number of requests submitted by one syscall.
+const RING_ENTRIES: u32 = 16;
+
+const IORING_OFF_SQ_RING: libc::off_t = 0;
+const IORING_OFF_CQ_RING: libc::off_t = 0x800_0000;
+const IORING_OFF_SQES: libc::off_t = 0x1000_0000;
+const IORING_ENTER_GETEVENTS: libc::c_uint = 1;
+const IORING_OP_READV: u8 = 1;
+
+#[repr(C)]
+#[derive(Default)]
+#[allow(dead_code)]
+struct SqringOffsets {
+    head: u32,
+    tail: u32,
+    ring_mask: u32,
+    ring_entries: u32,
+    flags: u32,
+    dropped: u32,
+    array: u32,
+    resv1: u32,
+    resv2: u64,
+}
+
+#[repr(C)]
+#[derive(Default)]
+#[allow(dead_code)]
+struct CqringOffsets {
+    head: u32,
+    tail: u32,
+    ring_mask: u32,
+    ring_entries: u32,
+    overflow: u32,
+    cqes: u32,
+    flags: u32,
+    resv1: u32,
+    resv2: u64,
+}
+
+/// `struct io_uring_params` of the kernel uapi.
+#[repr(C)]
+#[derive(Default)]
+#[allow(dead_code)]
+struct IoUringParams {
+    sq_entries: u32,
+    cq_entries: u32,
+    flags: u32,
+    sq_thread_cpu: u32,
+    sq_thread_idle: u32,
+    features: u32,
+    wq_fd: u32,
+    resv: [u32; 3],
+    sq_off: SqringOffsets,
+    cq_off: CqringOffsets,
+}
+
+/// `struct io_uring_sqe` of the kernel uapi, with the fields used by `IORING_OP_READV` only.
+#[repr(C)]
+#[allow(dead_code)]
+struct Sqe {
+    opcode: u8,
+    flags: u8,
+    ioprio: u16,
+    fd: i32,
+    off: u64,
+    addr: u64,
+    len: u32,
+    rw_flags: u32,
+    user_data: u64,
+    buf_index: u16,
+    personality: u16,
+    splice_fd_in: i32,
+    pad: [u64; 2],
+}
+
+/// `struct io_uring_cqe` of the kernel uapi.
+#[repr(C)]
+#[allow(dead_code)]
+struct Cqe {
+    user_data: u64,
+    res: i32,
+    flags: u32,
+}
+
+struct Mmap {
+    addr: *mut libc::c_void,
+    len: usize,
+}
+
+impl Mmap {
+    fn new(fd: RawFd, len: usize, offset: libc::off_t) -> Result<Self> {
+        let addr = unsafe {
+            libc::mmap(
+                ptr::null_mut(),
+                len,
+                libc::PROT_READ | libc::PROT_WRITE,
+                libc::MAP_SHARED | libc::MAP_POPULATE,
+                fd,
+                offset,
+            )
+        };
+        if addr == libc::MAP_FAILED {
+            return Err(last_error!("failed to mmap io_uring"));
+        }
+        Ok(Mmap { addr, len })
+    }
+
+    // Safe because the offsets are given by the kernel for the mapped ring.
+    fn at<T>(&self, offset: u32) -> *mut T {
+        unsafe { (self.addr as *mut u8).add(offset as usize) as *mut T }
+    }
+}
+
+impl Drop for Mmap {
+    fn drop(&mut self) {
+        unsafe { libc::munmap(self.addr, self.len) };
+    }
+}
+
+#[cfg(test)]
+thread_local! {
+    // Make the next `io_uring_enter()` fail after submitting at most the given number of requests
+    // without waiting for them, to test the error path.
+    static ENTER_FAULT: Cell<Option<u32>> = Cell::new(None);
+}
+
+/// An io_uring instance used by its owner thread only, whose requests are completed before
+/// submitting the next ones.
+struct IoUring {
+    fd: RawFd,
+    sq_ring: Mmap,
+    cq_ring: Mmap,
+    sqes: Mmap,
+    params: IoUringParams,
+}
+
+impl IoUring {
+    fn new(entries: u32) -> Result<Self> {
+        let mut params = IoUringParams::default();
+        let fd = unsafe {
+            libc::syscall(
+                libc::SYS_io_uring_setup,
+                entries as libc::c_long,
+                &mut params as *mut IoUringParams,
+            )
+        };
+        if fd < 0 {
+            return Err(Error::last_os_error());
+        }
+        let fd = fd as RawFd;
+
+        let mmaps = Mmap::new(
+            fd,
+            (params.sq_off.array + params.sq_entries * 4) as usize,
+            IORING_OFF_SQ_RING,
+        )
+        .and_then(|sq_ring| {
+            let cq_ring = Mmap::new(
+                fd,
+                params.cq_off.cqes as usize
+                    + params.cq_entries as usize * std::mem::size_of::<Cqe>(),
+                IORING_OFF_CQ_RING,
+            )?;
+            let sqes = Mmap::new(
+                fd,
+                params.sq_entries as usize * std::mem::size_of::<Sqe>(),
+                IORING_OFF_SQES,
+            )?;
+            Ok((sq_ring, cq_ring, sqes))
+        });
+        match mmaps {
+            Ok((sq_ring, cq_ring, sqes)) => Ok(IoUring {
+                fd,
+                sq_ring,
+                cq_ring,
+                sqes,
+                params,
+            }),
+            Err(e) => {
+                unsafe { libc::close(fd) };
+                Err(e)
+            }
+        }
+    }
+
+    fn atomic(&self, ring: &Mmap, offset: u32) -> &AtomicU32 {
+        unsafe { &*ring.at::<AtomicU32>(offset) }
+    }
+
+    fn enter(&self, to_submit: u32, min_complete: u32) -> Result<u32> {
+        #[cfg(test)]
+        {
+            if let Some(n) = ENTER_FAULT.with(|f| f.take()) {
+                if n > 0 {
+                    self.enter(n.min(to_submit), 0)?;
+                }
+                return Err(Error::from_raw_os_error(libc::EBUSY));
+            }
+        }
+
+        let ret = unsafe {
+            libc::syscall(
+                libc::SYS_io_uring_enter,
+                self.fd as libc::c_long,
+                to_submit as libc::c_long,
+                min_complete as libc::c_long,
+                IORING_ENTER_GETEVENTS as libc::c_long,
+                ptr::null::<libc::sigset_t>(),
+                0usize,
+            )
+        };
+        if ret < 0 {
+            Err(Error::last_os_error())
+        } else {
+            Ok(ret as u32)
+        }
+    }
+
+    /// Read `requests` of iovecs and offsets from `fd`, at most `sq_entries` of them. They're
+    /// submitted and waited by one `io_uring_enter()` unless interrupted. Return the results of
+    /// the requests as `preadv()` but the negative errno on error. It fails only if
+    /// `io_uring_enter()` fails, then the requests not submitted yet are withdrawn and the
+    /// submitted ones are waited for, so no request is left in the ring and the buffers are no
+    /// longer written by the kernel once it returns.
+    fn readv(&self, fd: RawFd, requests: &[(&[IoVec<&mut [u8]>], u64)]) -> Result<Vec<i32>> {
+        let sq_off = &self.params.sq_off;
+        let count = requests.len() as u32;
+        debug_assert!(count <= self.params.sq_entries);
+
+        // The ring is never full since the requests are completed before the next ones.
+        let sq_tail = self.atomic(&self.sq_ring, sq_off.tail);
+        let tail = sq_tail.load(Ordering::Relaxed);
+        let mask = unsafe { *self.sq_ring.at::<u32>(sq_off.ring_mask) };
+        for (i, (iovec, offset)) in requests.iter().enumerate() {
+            let index = tail.wrapping_add(i as u32) & mask;
+            unsafe {
+                ptr::write(
+                    self.sqes.at::<Sqe>(0).add(index as usize),
+                    Sqe {
+                        opcode: IORING_OP_READV,
+                        flags: 0,
+                        ioprio: 0,
+                        fd,
+                        off: *offset,
+                        // Safe because `IoVec` is a transparent wrapper of `struct iovec`, and
+                        // the requests are completed before returning.
+                        addr: iovec.as_ptr() as u64,
+                        len: iovec.len() as u32,
+                        rw_flags: 0,
+                        user_data: i as u64,
+                        buf_index: 0,
+                        personality: 0,
+                        splice_fd_in: 0,
+                        pad: [0; 2],
+                    },
+                );
+                *self.sq_ring.at::<u32>(sq_off.array).add(index as usize) = index;
+            }
+        }
+        sq_tail.store(tail.wrapping_add(count), Ordering::Release);
+
+        let mut results = vec![0; requests.len()];
+        let mut to_submit = count;
+        let mut completed = 0;
+        while completed < count {
+            match self.enter(to_submit, count - completed) {
+                Ok(submitted) => to_submit -= submitted.min(to_submit),
+                Err(e) if e.kind() == ErrorKind::Interrupted => {}
+                Err(e) => {
+                    let submitted = count - self.withdraw();
+                    self.wait(&mut results, completed, submitted);
+                    return Err(e);
+                }
+            }
+            completed += self.reap(&mut results);
+        }
+
+        Ok(results)
+    }
+
+    /// Withdraw the requests in the submission queue not consumed by the kernel yet, so they're
+    /// never submitted by a later `io_uring_enter()`. It's safe to move the tail back because the
+    /// kernel only reads the queue in `io_uring_enter()` of the owner thread, without SQPOLL.
+    /// Return the number of withdrawn requests.
+    fn withdraw(&self) -> u32 {
+        let sq_off = &self.params.sq_off;
+        let sq_head = self.atomic(&self.sq_ring, sq_off.head);
+        let sq_tail = self.atomic(&self.sq_ring, sq_off.tail);
+        let head = sq_head.load(Ordering::Acquire);
+        let tail = sq_tail.load(Ordering::Relaxed);
+        sq_tail.store(head, Ordering::Release);
+
+        tail.wrapping_sub(head)
+    }
+
+    /// Wait until `submitted` requests are completed, `completed` of them have been reaped into
+    /// `results`. The completions are still polled if `io_uring_enter()` fails, because the
+    /// kernel posts them without it.
+    fn wait(&self, results: &mut [i32], mut completed: u32, submitted: u32) {
+        while completed < submitted {
+            match self.enter(0, submitted - completed) {
+                Ok(_) => {}
+                Err(e) if e.kind() == ErrorKind::Interrupted => {}
+                Err(_) => thread::sleep(Duration::from_millis(1)),
+            }
+            completed += self.reap(results);
+        }
+    }
+
+    /// Reap the completions in the completion queue into `results` by the user data of requests,
+    /// return the number of them.
+    fn reap(&self, results: &mut [i32]) -> u32 {
+        let cq_off = &self.params.cq_off;
+        let cq_head = self.atomic(&self.cq_ring, cq_off.head);
+        let cq_tail = self.atomic(&self.cq_ring, cq_off.tail);
+        let cq_mask = unsafe { *self.cq_ring.at::<u32>(cq_off.ring_mask) };
+
+        let mut reaped = 0;
+        let mut head = cq_head.load(Ordering::Relaxed);
+        while head != cq_tail.load(Ordering::Acquire) {
+            let cqe = unsafe {
+                &*self
+                    .cq_ring
+                    .at::<Cqe>(cq_off.cqes)
+                    .add((head & cq_mask) as usize)
+            };
+            results[cqe.user_data as usize] = cqe.res;
+            reaped += 1;
+            head = head.wrapping_add(1);
+        }
+        cq_head.store(head, Ordering::Release);
+
+        reaped
+    }
+}
+
+impl Drop for IoUring {
+    fn drop(&mut self) {
+        unsafe { libc::close(self.fd) };
+    }
+}
+
+enum RingState {
+    Uninit,
+    Ready(IoUring),
+    Unavailable,
+}
+
+thread_local! {
+    static RING: RefCell<RingState> = RefCell::new(RingState::Uninit);
+}
+
+// Only warn once when io_uring isn't available, instead of once per thread.
+static WARNED: AtomicBool = AtomicBool::new(false);
+
+fn warn_unavailable(err: &Error) {
+    if !WARNED.swap(true, Ordering::Relaxed) {
+        warn!("io_uring is unavailable, fall back to preadv: {}", err);
+    }
+}
+
+/// Read `requests` of iovecs and offsets from `fd` by the io_uring of current thread, up to
+/// `RING_ENTRIES` requests are issued by one syscall. The requests are read by `preadv()` if
+/// io_uring is unavailable. Return the result of each request.
+pub(crate) fn readv_batch(
+    fd: RawFd,
+    requests: &[(&[IoVec<&mut [u8]>], u64)],
+) -> Vec<Result<usize>> {
+    let mut results = Vec::with_capacity(requests.len());
+
+    for batch in requests.chunks(RING_ENTRIES as usize) {
+        let res = RING.with(|ring| {
+            let mut state = ring.borrow_mut();
+            if let RingState::Uninit = *state {
+                *state = match IoUring::new(RING_ENTRIES) {
+                    Ok(ring) => RingState::Ready(ring),
+                    Err(e) => {
+                        warn_unavailable(&e);
+                        RingState::Unavailable
+                    }
+                };
+            }
+
+            let res = match &*state {
+                RingState::Ready(ring) => ring.readv(fd, batch),
+                _ => return None,
+            };
+            match res {
+                Ok(res) => Some(res),
+                Err(e) => {
+                    // No request is left in the ring, but it can't be used anymore.
+                    warn_unavailable(&e);
+                    *state = RingState::Unavailable;
+                    None
+                }
+            }
+        });
+
+        for (i, (iovec, offset)) in batch.iter().enumerate() {
+            results.push(match res.as_ref().map(|r| r[i]) {
+                Some(res) if res >= 0 => Ok(res as usize),
+                // Retry by preadv on the errors which may come from the io_uring support of
+                // kernel, e.g. an unsupported opcode, preadv returns the same error otherwise.
+                Some(res)
+                    if ![libc::EINVAL, libc::EOPNOTSUPP, libc::EAGAIN, libc::EINTR]
+                        .contains(&-res) =>
+                {
+                    Err(Error::from_raw_os_error(-res))
+                }
+                _ => preadv(fd, iovec, *offset),
+            });
+        }
+    }
+
+    results
+}
+
+/// Read `iovec` from `fd` at `offset` like `preadv()`, see `readv_batch()`.
+pub(crate) fn readv(fd: RawFd, iovec: &[IoVec<&mut [u8]>], offset: u64) -> Result<usize> {
+    // Safe to unwrap because there's one result for the request.
+    readv_batch(fd, &[(iovec, offset)]).pop().unwrap()
+}
+
+/// Read `buf` from `fd` at `offset` like `pread()`, see `readv_batch()`.
+pub(crate) fn read(fd: RawFd, buf: &mut [u8], offset: u64) -> Result<usize> {
+    readv(fd, &[IoVec::from_mut_slice(buf)], offset)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Write;
+    use std::os::unix::io::AsRawFd;
+    use vmm_sys_util::tempfile::TempFile;
+
+    #[test]
+    fn test_uring_readv() {
+        let tmp = TempFile::new().unwrap();
+        let mut file = tmp.into_file();
+        let data: Vec<u8> = (0..0x3000u32).map(|i| i as u8).collect();
+        file.write_all(&data).unwrap();
+
+        let mut buf1 = vec![0u8; 0x800];
+        let mut buf2 = vec![0u8; 0x1000];
+        let iovec = [
+            IoVec::from_mut_slice(&mut buf1),
+            IoVec::from_mut_slice(&mut buf2),
+        ];
+        assert_eq!(readv(file.as_raw_fd(), &iovec, 0x100).unwrap(), 0x1800);
+        assert_eq!(buf1, &data[0x100..0x900]);
+        assert_eq!(buf2, &data[0x900..0x1900]);
+
+        // Short read at the end of file, the ring is reused.
+        let mut buf = vec![0u8; 0x1000];
+        assert_eq!(read(file.as_raw_fd(), &mut buf, 0x2800).unwrap(), 0x800);
+        assert_eq!(&buf[..0x800], &data[0x2800..]);
+        assert_eq!(read(file.as_raw_fd(), &mut buf, 0x4000).unwrap(), 0);
+
+        assert!(read(-1, &mut buf, 0).is_err());
+    }
+
+    #[test]
+    fn test_uring_readv_batch() {
+        let tmp = TempFile::new().unwrap();
+        let mut file = tmp.into_file();
+        let data: Vec<u8> = (0..0x10000u32).map(|i| (i % 251) as u8).collect();
+        file.write_all(&data).unwrap();
+
+        // More requests than the ring entries.
+        let mut bufs: Vec<Vec<u8>> = (0..RING_ENTRIES * 2 + 1)
+            .map(|_| vec![0u8; 0x100])
+            .collect();
+        let iovecs: Vec<Vec<IoVec<&mut [u8]>>> = bufs
+            .iter_mut()
+            .map(|b| vec![IoVec::from_mut_slice(b.as_mut_slice())])
+            .collect();
+        let requests: Vec<(&[IoVec<&mut [u8]>], u64)> = iovecs
+            .iter()
+            .enumerate()
+            .map(|(i, v)| (v.as_slice(), i as u64 * 0x300))
+            .collect();
+        let results = readv_batch(file.as_raw_fd(), &requests);
+        assert_eq!(results.len(), requests.len());
+        assert!(results.iter().all(|r| *r.as_ref().unwrap() == 0x100));
+        drop(requests);
+        drop(iovecs);
+        for (i, b) in bufs.iter().enumerate() {
+            assert_eq!(b.as_slice(), &data[i * 0x300..i * 0x300 + 0x100]);
+        }
+    }
+
+    #[test]
+    fn test_uring_enter_error() {
+        let ring = match IoUring::new(RING_ENTRIES) {
+            Ok(ring) => ring,
+            // io_uring isn't supported by the kernel.
+            Err(_) => return,
+        };
+        let tmp = TempFile::new().unwrap();
+        let mut file = tmp.into_file();
+        let data: Vec<u8> = (0..0x1000u32).map(|i| (i % 251) as u8).collect();
+        file.write_all(&data).unwrap();
+
+        for &submitted in &[0usize, 2] {
+            let mut bufs = vec![vec![0u8; 0x100]; 4];
+            let iovecs: Vec<Vec<IoVec<&mut [u8]>>> = bufs
+                .iter_mut()
+                .map(|b| vec![IoVec::from_mut_slice(b.as_mut_slice())])
+                .collect();
+            let requests: Vec<(&[IoVec<&mut [u8]>], u64)> = iovecs
+                .iter()
+                .enumerate()
+                .map(|(i, v)| (v.as_slice(), i as u64 * 0x300))
+                .collect();
+            ENTER_FAULT.with(|f| f.set(Some(submitted as u32)));
+            assert!(ring.readv(file.as_raw_fd(), &requests).is_err());
+            drop(requests);
+            drop(iovecs);
+            // The submitted requests are completed on return, the others are never submitted.
+            for (i, b) in bufs.iter().enumerate() {
+                if i < submitted {
+                    assert_eq!(b.as_slice(), &data[i * 0x300..i * 0x300 + 0x100]);
+                } else {
+                    assert!(b.iter().all(|c| *c == 0));
+                }
+            }
+
+            // No request is left in the ring, which is still usable.
+            let mut bufs = vec![vec![0u8; 0x80]; 3];
+            let iovecs: Vec<Vec<IoVec<&mut [u8]>>> = bufs
+                .iter_mut()
+                .map(|b| vec![IoVec::from_mut_slice(b.as_mut_slice())])
+                .collect();
+            let requests: Vec<(&[IoVec<&mut [u8]>], u64)> = iovecs
+                .iter()
+                .enumerate()
+                .map(|(i, v)| (v.as_slice(), i as u64 * 0x200 + 0x10))
+                .collect();
+            let results = ring.readv(file.as_raw_fd(), &requests).unwrap();
+            assert_eq!(results, vec![0x80; 3]);
+            drop(requests);
+            drop(iovecs);
+            for (i, b) in bufs.iter().enumerate() {
+                let offset = i * 0x200 + 0x10;
+                assert_eq!(b.as_slice(), &data[offset..offset + 0x80]);
+            }
+        }
+    }
+
+    #[test]
+    fn test_uring_struct_size() {
+        assert_eq!(std::mem::size_of::<IoUringParams>(), 120);
+        assert_eq!(std::mem::size_of::<Sqe>(), 64);
+        assert_eq!(std::mem::size_of::<Cqe>(), 16);
+    }
+}
@@ -26,10 +26,13 @@ use fuse_backend_rs::transport::FileVolatileSlice;
 
 pub use dummycache::DummyCacheMgr;
 pub use filecache::FileCacheMgr;
+use nydus_utils::budget::{self, MemoryClass};
 use nydus_utils::digest;
 
 use crate::backend::{BlobBackend, BlobReader};
 use crate::cache::state::ChunkMap;
+#[cfg(feature = "encryption")]
+use crate::crypt::BlobCipher;
 use crate::device::{
     BlobChunkInfo, BlobInfo, BlobIoChunk, BlobIoDesc, BlobIoRange, BlobIoVec, BlobObject,
     BlobPrefetchRequest,
@@ -37,6 +40,7 @@ use crate::device::{
 use crate::utils::{alloc_buf, digest_check};
 use crate::{compress, StorageResult, RAFS_MAX_CHUNK_SIZE};
 
+mod dedup;
 mod dummycache;
 mod filecache;
 pub mod state;
@@ -45,7 +49,7 @@ mod worker;
 /// Timeout in milli-seconds to retrieve blob data from backend storage.
 pub const SINGLE_INFLIGHT_WAIT_TIMEOUT: u64 = 2000;
 
-struct BlobIoMergeState<'a, F: FnMut(BlobIoRange)> {
+pub(crate) struct BlobIoMergeState<'a, F: FnMut(BlobIoRange)> {
     cb: F,
     size: u32,
     bios: Vec<&'a BlobIoDesc>,
@@ -123,6 +127,39 @@ pub struct BlobPrefetchConfig {
     pub merging_size: usize,
     /// Network bandwidth rate limit in unit of Bytes and Zero means no limit.
     pub bandwidth_rate: u32,
+    /// Latency threshold in milliseconds of on-demand backend reads to throttle prefetching,
+    /// zero means no throttling.
+    pub throttle_latency_ms: u64,
+    /// Idle time in milliseconds without on-demand backend reads to stop throttling.
+    pub throttle_idle_ms: u64,
+}
+
+/// Disk usage of a cached blob.
+#[derive(Clone, Debug, Serialize)]
+pub struct BlobCacheUsage {
+    /// Id of the blob.
+    pub blob_id: String,
+    /// Disk space in bytes used by the blob file and its chunk map.
+    pub size: u64,
+    /// Last access or modification time of the cache files, in seconds since UNIX epoch.
+    pub last_access: u64,
+    /// Whether the blob is used by a mounted filesystem.
+    pub in_use: bool,
+    /// Whether the blob is pinned to never be evicted.
+    pub pinned: bool,
+}
+
+/// Disk usage of a cache directory.
+#[derive(Clone, Debug, Serialize)]
+pub struct CacheUsage {
+    /// The cache directory.
+    pub work_dir: String,
+    /// Size quota in bytes of the cache directory, zero means unlimited.
+    pub quota: u64,
+    /// Disk space in bytes used by all cached blobs.
+    pub used: u64,
+    /// Cached blobs, least recently used first.
+    pub blobs: Vec<BlobCacheUsage>,
 }
 
 /// Trait representing a cache object for a blob on backend storage.
@@ -148,6 +185,12 @@ pub trait BlobCache: Send + Sync {
     /// Check whether need to validate the data chunk by digest value.
     fn need_validate(&self) -> bool;
 
+    /// Get the cipher to decrypt chunks in the blob, `None` if the blob isn't encrypted.
+    #[cfg(feature = "encryption")]
+    fn cipher(&self) -> Option<&BlobCipher> {
+        None
+    }
+
     /// Get the [BlobReader](../backend/trait.BlobReader.html) to read data from storage backend.
     fn reader(&self) -> &dyn BlobReader;
 
@@ -175,6 +218,13 @@ pub trait BlobCache: Send + Sync {
         Err(enosys!("doesn't support prefetch_range()"))
     }
 
+    /// Verify the cached data of the chunk, and evict it from the cache if it's corrupted.
+    ///
+    /// Return false if the cached data is corrupted.
+    fn scrub_chunk(&self, _chunk: &BlobIoChunk) -> Result<bool> {
+        Ok(true)
+    }
+
     /// Read chunk data described by the blob Io descriptors from the blob cache into the buffer.
     fn read(&self, iovec: &mut BlobIoVec, buffers: &[FileVolatileSlice]) -> Result<usize>;
 
@@ -194,6 +244,7 @@ pub trait BlobCache: Send + Sync {
         chunks: &[BlobIoChunk],
     ) -> Result<Vec<Vec<u8>>> {
         // Read requested data from the backend by altogether.
+        let _permit = budget::acquire_memory(MemoryClass::BackendBuffers, blob_size as u64);
         let mut c_buf = alloc_buf(blob_size);
         let nr_read = self
             .reader()
@@ -206,6 +257,19 @@ pub trait BlobCache: Send + Sync {
             )));
         }
 
+        self.process_raw_chunks(blob_offset, &c_buf, chunks)
+    }
+
+    /// Decompress and validate raw data of continuous chunks downloaded by one backend request.
+    ///
+    /// The `c_buf` contains raw data of the range starting from `blob_offset`, which exactly
+    /// matches chunks in `chunks`.
+    fn process_raw_chunks(
+        &self,
+        blob_offset: u64,
+        c_buf: &[u8],
+        chunks: &[BlobIoChunk],
+    ) -> Result<Vec<Vec<u8>>> {
         let mut last = blob_offset;
         let mut buffers: Vec<Vec<u8>> = Vec::with_capacity(chunks.len());
         for chunk in chunks {
@@ -228,7 +292,15 @@ pub trait BlobCache: Send + Sync {
             let buf = &c_buf[offset_merged..end_merged];
             let mut buffer = alloc_buf(d_size);
 
-            self.process_raw_chunk(chunk, buf, None, &mut buffer, chunk.is_compressed(), false)?;
+            self.process_raw_chunk(
+                chunk,
+                buf,
+                None,
+                &mut buffer,
+                true,
+                chunk.is_compressed(),
+                false,
+            )?;
             buffers.push(buffer);
             last = offset + size as u64;
         }
@@ -251,8 +323,12 @@ pub trait BlobCache: Send + Sync {
     ) -> Result<usize> {
         let mut d;
         let offset = chunk.compress_offset();
-        let raw_chunk = if chunk.is_compressed() {
-            // Need a scratch buffer to decompress compressed data.
+        #[cfg(feature = "encryption")]
+        let is_encrypted = self.cipher().is_some();
+        #[cfg(not(feature = "encryption"))]
+        let is_encrypted = false;
+        let raw_chunk = if chunk.is_compressed() || is_encrypted {
+            // Need a scratch buffer to decompress compressed data or decrypt encrypted data.
             let c_size = if self.is_stargz() {
                 let blob_size = self.blob_size()?;
                 let max_size = blob_size.checked_sub(offset).ok_or_else(|| {
@@ -280,6 +356,7 @@ pub trait BlobCache: Send + Sync {
             raw_chunk,
             None,
             buffer,
+            true,
             chunk.is_compressed(),
             force_validation,
         )?;
@@ -293,16 +370,32 @@ pub trait BlobCache: Send + Sync {
     /// Hook point to post-process data received from storage backend.
     ///
     /// This hook method provides a chance to transform data received from storage backend into
-    /// data cached on local disk.
+    /// data cached on local disk. The `raw_buffer` is decrypted first if it's the raw data of an
+    /// encrypted blob, i.e. `is_raw` is true.
+    #[allow(clippy::too_many_arguments)]
     fn process_raw_chunk(
         &self,
         chunk: &dyn BlobChunkInfo,
         raw_buffer: &[u8],
         raw_stream: Option<File>,
         buffer: &mut [u8],
+        is_raw: bool,
         need_decompress: bool,
         force_validation: bool,
     ) -> Result<usize> {
+        #[cfg(feature = "encryption")]
+        let decrypted;
+        #[cfg(feature = "encryption")]
+        let raw_buffer = match self.cipher() {
+            Some(cipher) if is_raw => {
+                decrypted = cipher.decrypt(raw_buffer, chunk.chunk_id().as_ref())?;
+                decrypted.as_slice()
+            }
+            _ => raw_buffer,
+        };
+        #[cfg(not(feature = "encryption"))]
+        let _ = is_raw;
+
         if need_decompress {
             compress::decompress(raw_buffer, raw_stream, buffer, self.compressor()).map_err(
                 |e| {
@@ -347,6 +440,19 @@ pub trait BlobCacheMgr: Send + Sync {
 
     /// Get the blob cache to provide access to the `blob` object.
     fn get_blob_cache(&self, blob_info: &Arc<BlobInfo>) -> Result<Arc<dyn BlobCache>>;
+
+    /// Get the disk usage of the local cache, `None` if there's no local cache.
+    fn usage(&self) -> Result<Option<CacheUsage>> {
+        Ok(None)
+    }
+
+    /// Evict the least recently used blobs, which are neither used nor pinned, until the disk
+    /// usage is below `target` bytes, or the size quota if `target` is `None`.
+    ///
+    /// Return the bytes freed.
+    fn trim(&self, _target: Option<u64>) -> Result<u64> {
+        Ok(0)
+    }
 }
 
 #[cfg(test)]
@@ -152,6 +152,10 @@ where
         }
     }
 
+    fn clear_ready(&self, chunk: &dyn BlobChunkInfo) -> Result<()> {
+        self.c.clear_ready(chunk)
+    }
+
     fn is_persist(&self) -> bool {
         self.c.is_persist()
     }
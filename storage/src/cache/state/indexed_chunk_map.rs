@@ -63,6 +63,10 @@ impl ChunkMap for IndexedChunkMap {
         self.map.set_chunk_ready(chunk.id())
     }
 
+    fn clear_ready(&self, chunk: &dyn BlobChunkInfo) -> Result<()> {
+        self.map.clear_chunk_ready(chunk.id())
+    }
+
     fn is_persist(&self) -> bool {
         true
     }
@@ -343,4 +347,29 @@ mod tests {
         map.set_ready_and_clear_pending(chunk.as_base()).unwrap();
         assert_eq!(map.is_ready(chunk.as_base()).unwrap(), true);
     }
+
+    #[test]
+    fn test_indexed_clear_ready() {
+        let dir = TempDir::new().unwrap();
+        let blob_path = dir.as_path().join("blob-1");
+        let blob_path = blob_path.as_os_str().to_str().unwrap().to_string();
+        let chunk = MockChunkInfo::new();
+
+        let map = IndexedChunkMap::new(&blob_path, 1).unwrap();
+        map.set_ready_and_clear_pending(chunk.as_base()).unwrap();
+        assert_eq!(map.is_range_all_ready(), true);
+
+        map.clear_ready(chunk.as_base()).unwrap();
+        assert_eq!(map.is_range_all_ready(), false);
+        assert_eq!(map.is_ready(chunk.as_base()).unwrap(), false);
+        // Clearing a chunk not ready is a no-op.
+        map.clear_ready(chunk.as_base()).unwrap();
+        assert_eq!(map.map.not_ready_count.load(Ordering::Acquire), 1);
+        drop(map);
+
+        // The cleared state is persisted.
+        let map = IndexedChunkMap::new(&blob_path, 1).unwrap();
+        assert_eq!(map.is_range_all_ready(), false);
+        assert_eq!(map.is_ready(chunk.as_base()).unwrap(), false);
+    }
 }
@@ -76,6 +76,12 @@ pub trait ChunkMap: Any + Send + Sync {
         panic!("no support of clear_pending()");
     }
 
+    /// Clear the ready state of the chunk, to fetch its data again, e.g. when the cached data is
+    /// corrupted.
+    fn clear_ready(&self, _chunk: &dyn BlobChunkInfo) -> Result<()> {
+        Err(enosys!())
+    }
+
     /// Check whether the implementation supports state persistence.
     fn is_persist(&self) -> bool {
         false
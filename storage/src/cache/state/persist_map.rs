@@ -253,6 +253,29 @@ impl PersistMap {
         Ok(())
     }
 
+    pub fn clear_chunk_ready(&self, index: u32) -> Result<()> {
+        let index = self.validate_index(index)?;
+        let mask = Self::index_to_mask(index);
+        let start = HEADER_SIZE + (index as usize >> 3);
+        let atomic_value = unsafe { &*(self.base.add(start) as *const AtomicU8) };
+
+        let prev = atomic_value.fetch_and(!mask, Ordering::AcqRel);
+        if prev & mask == mask && self.not_ready_count.fetch_add(1, Ordering::AcqRel) == 0 {
+            self.clear_all_ready();
+        }
+
+        Ok(())
+    }
+
+    fn clear_all_ready(&self) {
+        let base = self.base as *const c_void as *mut c_void;
+        unsafe {
+            let header = &mut *(self.base as *mut Header);
+            header.all_ready = 0;
+            let _ = libc::msync(base, HEADER_SIZE, libc::MS_SYNC);
+        }
+    }
+
     fn mark_all_ready(&self) {
         let base = self.base as *const c_void as *mut c_void;
         unsafe {
@@ -5,10 +5,10 @@
 
 use std::io::Result;
 use std::num::NonZeroU32;
-use std::sync::atomic::{AtomicBool, AtomicU32, Ordering};
+use std::sync::atomic::{AtomicBool, AtomicU32, AtomicU64, Ordering};
 use std::sync::{Arc, Mutex};
 use std::thread;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
 use futures::executor::block_on;
 use governor::clock::QuantaClock;
@@ -31,6 +31,11 @@ pub(crate) struct AsyncPrefetchConfig {
     pub merging_size: usize,
     /// Network bandwidth for prefetch, in unit of Bytes and Zero means no rate limit is set.
     pub bandwidth_rate: u32,
+    /// Latency threshold of on-demand backend reads in milliseconds to throttle prefetch, Zero
+    /// means no throttling.
+    pub throttle_latency_ms: u64,
+    /// Idle time without on-demand backend reads in milliseconds to stop throttling.
+    pub throttle_idle_ms: u64,
 }
 
 impl From<BlobPrefetchConfig> for AsyncPrefetchConfig {
@@ -40,10 +45,100 @@ impl From<BlobPrefetchConfig> for AsyncPrefetchConfig {
             threads_count: p.threads_count,
             merging_size: p.merging_size,
             bandwidth_rate: p.bandwidth_rate,
+            throttle_latency_ms: p.throttle_latency_ms,
+            throttle_idle_ms: p.throttle_idle_ms,
         }
     }
 }
 
+// The delay before each prefetch request is adjusted at most once per interval.
+const THROTTLE_ADJUST_INTERVAL_MS: u64 = 100;
+const THROTTLE_MIN_DELAY_MS: u64 = 10;
+const THROTTLE_MAX_DELAY_MS: u64 = 1000;
+
+/// Throttle of prefetch requests driven by the latency of on-demand backend reads.
+///
+/// The delay before each prefetch request doubles while the average latency of on-demand reads
+/// exceeds the threshold, and halves when the latency drops below the threshold or there's no
+/// on-demand read for the idle time, so prefetch backs off under user IO and ramps back up when
+/// the node is idle.
+struct PrefetchThrottle {
+    start: Instant,
+    latency_threshold_us: u64,
+    idle_ms: u64,
+    // Moving average of on-demand read latency in microseconds.
+    latency_us: AtomicU64,
+    // Time of the last on-demand read in milliseconds since `start`, plus one.
+    last_read_ms: AtomicU64,
+    last_adjust_ms: AtomicU64,
+    delay_ms: AtomicU64,
+}
+
+impl PrefetchThrottle {
+    fn new(latency_threshold_ms: u64, idle_ms: u64) -> Option<Self> {
+        if latency_threshold_ms == 0 {
+            return None;
+        }
+
+        Some(PrefetchThrottle {
+            start: Instant::now(),
+            latency_threshold_us: latency_threshold_ms * 1000,
+            idle_ms,
+            latency_us: AtomicU64::new(0),
+            last_read_ms: AtomicU64::new(0),
+            last_adjust_ms: AtomicU64::new(0),
+            delay_ms: AtomicU64::new(0),
+        })
+    }
+
+    fn now_ms(&self) -> u64 {
+        self.start.elapsed().as_millis() as u64
+    }
+
+    fn record(&self, latency: Duration, now_ms: u64) {
+        let latency = latency.as_micros() as u64;
+        let average = self.latency_us.load(Ordering::Relaxed);
+        let average = if average == 0 {
+            latency
+        } else {
+            (average * 7 + latency) / 8
+        };
+        self.latency_us.store(average, Ordering::Relaxed);
+        self.last_read_ms.store(now_ms + 1, Ordering::Relaxed);
+    }
+
+    /// Get the delay in milliseconds before the next prefetch request.
+    fn adjust(&self, now_ms: u64) -> u64 {
+        let last_adjust = self.last_adjust_ms.load(Ordering::Relaxed);
+        if now_ms < last_adjust + THROTTLE_ADJUST_INTERVAL_MS
+            || self
+                .last_adjust_ms
+                .compare_exchange(last_adjust, now_ms, Ordering::Relaxed, Ordering::Relaxed)
+                .is_err()
+        {
+            return self.delay_ms.load(Ordering::Relaxed);
+        }
+
+        let last_read = self.last_read_ms.load(Ordering::Relaxed);
+        let idle = last_read == 0 || now_ms + 1 >= last_read + self.idle_ms;
+        let delay = self.delay_ms.load(Ordering::Relaxed);
+        let delay = if !idle && self.latency_us.load(Ordering::Relaxed) > self.latency_threshold_us
+        {
+            std::cmp::min(
+                std::cmp::max(delay * 2, THROTTLE_MIN_DELAY_MS),
+                THROTTLE_MAX_DELAY_MS,
+            )
+        } else if delay > THROTTLE_MIN_DELAY_MS {
+            delay / 2
+        } else {
+            0
+        };
+        self.delay_ms.store(delay, Ordering::Relaxed);
+
+        delay
+    }
+}
+
 /// Status of an asynchronous service request message.
 #[repr(u32)]
 pub(crate) enum AsyncRequestState {
@@ -108,6 +203,7 @@ pub(crate) struct AsyncWorkerMgr {
 
     prefetch_config: Arc<AsyncPrefetchConfig>,
     prefetch_limiter: Option<Arc<RateLimiter<NotKeyed, InMemoryState, QuantaClock>>>,
+    prefetch_throttle: Option<PrefetchThrottle>,
 }
 
 impl AsyncWorkerMgr {
@@ -128,6 +224,16 @@ impl AsyncWorkerMgr {
             info!("Prefetch bandwidth will be limited at {}Bytes/S", v);
             Arc::new(RateLimiter::direct(Quota::per_second(v)))
         });
+        let prefetch_throttle = PrefetchThrottle::new(
+            prefetch_config.throttle_latency_ms,
+            prefetch_config.throttle_idle_ms,
+        );
+        if prefetch_throttle.is_some() {
+            info!(
+                "Prefetch will be throttled when on-demand reads are slower than {}ms",
+                prefetch_config.throttle_latency_ms
+            );
+        }
         let (sender, receiver) = channel::<AsyncRequestMessage>();
 
         Ok(AsyncWorkerMgr {
@@ -141,6 +247,7 @@ impl AsyncWorkerMgr {
 
             prefetch_config,
             prefetch_limiter,
+            prefetch_throttle,
         })
     }
 
@@ -249,12 +356,30 @@ impl AsyncWorkerMgr {
         }
     }
 
+    /// Record the latency of an on-demand read from storage backend to throttle prefetching.
+    pub fn record_ondemand_latency(&self, latency: Duration) {
+        if let Some(throttle) = self.prefetch_throttle.as_ref() {
+            throttle.record(latency, throttle.now_ms());
+        }
+    }
+
+    fn throttle_prefetch(&self) {
+        if let Some(throttle) = self.prefetch_throttle.as_ref() {
+            let delay = throttle.adjust(throttle.now_ms());
+            if delay > 0 {
+                self.metrics.prefetch_throttled_millis.add(delay);
+                thread::sleep(Duration::from_millis(delay));
+            }
+        }
+    }
+
     fn run(&self, rx: Receiver<AsyncRequestMessage>) {
         while let Ok(msg) = rx.recv() {
             match msg {
                 AsyncRequestMessage::FsPrefetch(state, blob_cache, req) => {
                     self.busy_workers.fetch_add(1, Ordering::Relaxed);
                     if state.load(Ordering::Acquire) == AsyncRequestState::Pending as u32 {
+                        self.throttle_prefetch();
                         let _ = self.handle_fs_prefetch_request(&blob_cache, &req);
                     }
                     self.busy_workers.fetch_sub(1, Ordering::Relaxed);
@@ -262,6 +387,7 @@ impl AsyncWorkerMgr {
                 AsyncRequestMessage::BlobPrefetch(state, blob_cache, offset, size) => {
                     self.busy_workers.fetch_add(1, Ordering::Relaxed);
                     if state.load(Ordering::Acquire) == AsyncRequestState::Pending as u32 {
+                        self.throttle_prefetch();
                         let _ = self.handle_blob_prefetch_request(&blob_cache, offset, size);
                     }
                     self.busy_workers.fetch_sub(1, Ordering::Relaxed);
@@ -369,6 +495,8 @@ mod tests {
             threads_count: 2,
             merging_size: 0x100000,
             bandwidth_rate: 0x100000,
+            throttle_latency_ms: 0,
+            throttle_idle_ms: 0,
         });
 
         let mgr = Arc::new(AsyncWorkerMgr::new(metrics, config).unwrap());
@@ -384,6 +512,41 @@ mod tests {
         assert_eq!(mgr.workers.load(Ordering::Relaxed), 0);
     }
 
+    #[test]
+    fn test_prefetch_throttle() {
+        assert!(PrefetchThrottle::new(0, 1000).is_none());
+
+        let throttle = PrefetchThrottle::new(10, 1000).unwrap();
+        // No throttling before any on-demand read.
+        assert_eq!(throttle.adjust(100), 0);
+
+        // Back off while on-demand reads are slow.
+        throttle.record(Duration::from_millis(50), 150);
+        assert_eq!(throttle.adjust(200), THROTTLE_MIN_DELAY_MS);
+        // Adjusted at most once per interval.
+        assert_eq!(throttle.adjust(250), THROTTLE_MIN_DELAY_MS);
+        assert_eq!(throttle.adjust(300), THROTTLE_MIN_DELAY_MS * 2);
+        let mut now = 300;
+        for _ in 0..10 {
+            now += THROTTLE_ADJUST_INTERVAL_MS;
+            throttle.record(Duration::from_millis(50), now);
+            throttle.adjust(now);
+        }
+        assert_eq!(
+            throttle.delay_ms.load(Ordering::Relaxed),
+            THROTTLE_MAX_DELAY_MS
+        );
+
+        // Ramp up after the node gets idle.
+        now += 1000;
+        assert_eq!(throttle.adjust(now), THROTTLE_MAX_DELAY_MS / 2);
+        for _ in 0..10 {
+            now += THROTTLE_ADJUST_INTERVAL_MS;
+            throttle.adjust(now);
+        }
+        assert_eq!(throttle.delay_ms.load(Ordering::Relaxed), 0);
+    }
+
     #[test]
     fn test_worker_mgr_rate_limiter() {
         // TODO
@@ -23,6 +23,7 @@ pub enum Algorithm {
     None,
     Lz4Block,
     GZip,
+    Zstd,
 }
 
 impl Default for Algorithm {
@@ -45,7 +46,10 @@ impl FromStr for Algorithm {
             "none" => Ok(Self::None),
             "lz4_block" => Ok(Self::Lz4Block),
             "gzip" => Ok(Self::GZip),
-            _ => Err(einval!("compression algorithm should be none or lz4_block")),
+            "zstd" => Ok(Self::Zstd),
+            _ => Err(einval!(
+                "compression algorithm should be none, lz4_block, gzip or zstd"
+            )),
         }
     }
 }
@@ -60,6 +64,8 @@ impl TryFrom<u32> for Algorithm {
             Ok(Algorithm::Lz4Block)
         } else if value == Algorithm::GZip as u32 {
             Ok(Algorithm::GZip)
+        } else if value == Algorithm::Zstd as u32 {
+            Ok(Algorithm::Zstd)
         } else {
             Err(())
         }
@@ -80,6 +86,17 @@ impl Algorithm {
 // with data blocks so that we don't really care about lz4 header magic numbers like
 // as being done with all these rust lz4 implementations
 pub fn compress(src: &[u8], algorithm: Algorithm) -> Result<(Cow<[u8]>, bool)> {
+    compress_with_level(src, algorithm, 0)
+}
+
+/// Compress a source slice with provided compression algorithm and level.
+///
+/// The level is only used by zstd, which accepts 1-22 and uses its default level 3 for 0.
+pub fn compress_with_level(
+    src: &[u8],
+    algorithm: Algorithm,
+    level: i32,
+) -> Result<(Cow<[u8]>, bool)> {
     let src_size = src.len();
     if src_size == 0 {
         return Ok((Cow::Borrowed(src), false));
@@ -94,6 +111,7 @@ pub fn compress(src: &[u8], algorithm: Algorithm) -> Result<(Cow<[u8]>, bool)> {
             gz.write_all(src)?;
             gz.finish()?
         }
+        Algorithm::Zstd => zstd::bulk::compress(src, level)?,
     };
 
     // Abandon compressed data when compression ratio greater than COMPRESSION_MINIMUM_RATIO
@@ -127,6 +145,7 @@ pub fn decompress(
             };
             Ok(dst.len())
         }
+        Algorithm::Zstd => zstd::bulk::decompress_to_buffer(src, dst),
     }
 }
 
@@ -171,6 +190,41 @@ mod tests {
         assert_eq!(buf, decompressed);
     }
 
+    #[test]
+    fn test_compress_algorithm_zstd() {
+        let buf = vec![0x2u8; 4095];
+        for level in &[0, 1, 19] {
+            let (compressed, is_compressed) =
+                compress_with_level(&buf, Algorithm::Zstd, *level).unwrap();
+            assert!(is_compressed);
+            assert_ne!(compressed.len(), 0);
+
+            let mut decompressed = vec![0; buf.len()];
+            let sz = decompress(
+                &compressed,
+                None,
+                decompressed.as_mut_slice(),
+                Algorithm::Zstd,
+            )
+            .unwrap();
+            assert_eq!(sz, 4095);
+            assert_eq!(buf, decompressed);
+        }
+
+        // Incompressible data is stored as is.
+        let buf = [0x1u8, 0x2u8, 0x3u8, 0x4u8];
+        let (compressed, is_compressed) = compress(&buf, Algorithm::Zstd).unwrap();
+        assert!(!is_compressed);
+        assert_eq!(buf.to_vec(), compressed.to_vec());
+    }
+
+    #[test]
+    fn test_compress_algorithm_from_str() {
+        assert_eq!("zstd".parse::<Algorithm>().unwrap(), Algorithm::Zstd);
+        assert_eq!(Algorithm::try_from(3), Ok(Algorithm::Zstd));
+        assert!("lz4".parse::<Algorithm>().is_err());
+    }
+
     #[test]
     fn test_compress_algorithm_none() {
         let buf = [
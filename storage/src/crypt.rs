@@ -0,0 +1,383 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Chunk data encryption at rest.
+//!
+//! Chunks of an encrypted blob are encrypted by AES-256-GCM after compression, with the data key
+//! of the blob. Only the key ID is recorded in the blob table of the image metadata, the data key
+//! itself is fetched from a [KeyProvider](trait.KeyProvider.html) by the builder and nydusd, e.g.
+//! an external plugin talking to AWS KMS or Vault.
+//!
+//! An encrypted chunk is stored as `nonce | ciphertext | tag`, so its compressed size grows by
+//! [CIPHER_OVERHEAD](constant.CIPHER_OVERHEAD.html) bytes. The nonce is derived from the key and
+//! the chunk data, so the builder output is still reproducible, and the chunk digest is bound to
+//! the ciphertext as additional authenticated data.
+use std::collections::HashMap;
+use std::fs;
+use std::io::{Result, Write};
+use std::path::PathBuf;
+use std::process::{Command, Stdio};
+use std::sync::{Arc, Mutex};
+
+use openssl::hash::MessageDigest;
+use openssl::pkey::{PKey, Private};
+use openssl::sign::Signer;
+use openssl::symm::{self, Cipher};
+use serde_json::value::Value;
+
+use crate::device::{validate_key_id, BlobInfo};
+use crate::factory::KeyProviderConfig;
+
+/// Size of the AES-256-GCM data key.
+pub const CIPHER_KEY_SIZE: usize = 32;
+/// Size of the nonce stored before the ciphertext.
+pub const CIPHER_NONCE_SIZE: usize = 12;
+/// Size of the authentication tag stored after the ciphertext.
+pub const CIPHER_TAG_SIZE: usize = 16;
+/// Bytes added to each chunk by encryption.
+pub const CIPHER_OVERHEAD: usize = CIPHER_NONCE_SIZE + CIPHER_TAG_SIZE;
+
+/// AES-256-GCM cipher with the data key of a blob.
+pub struct BlobCipher {
+    key_id: String,
+    key: Vec<u8>,
+    nonce_key: PKey<Private>,
+}
+
+impl BlobCipher {
+    /// Create a new instance of `BlobCipher` with data key `key` identified by `key_id`.
+    pub fn new(key_id: &str, key: &[u8]) -> Result<Self> {
+        validate_key_id(key_id)?;
+        if key.len() != CIPHER_KEY_SIZE {
+            return Err(einval!(format!(
+                "invalid size {} of key {}, should be {} bytes",
+                key.len(),
+                key_id,
+                CIPHER_KEY_SIZE
+            )));
+        }
+        // Derive a separate key to generate nonces, instead of using the data key twice.
+        let nonce_key = openssl::sha::sha256(&[b"nydus-chunk-nonce".as_ref(), key].concat());
+        let nonce_key = PKey::hmac(&nonce_key).map_err(|e| eother!(e))?;
+
+        Ok(BlobCipher {
+            key_id: key_id.to_owned(),
+            key: key.to_vec(),
+            nonce_key,
+        })
+    }
+
+    /// Get the ID of the data key.
+    pub fn key_id(&self) -> &str {
+        &self.key_id
+    }
+
+    /// Encrypt chunk `data`, with the chunk digest `aad` as additional authenticated data.
+    pub fn encrypt(&self, data: &[u8], aad: &[u8]) -> Result<Vec<u8>> {
+        let mut signer =
+            Signer::new(MessageDigest::sha256(), &self.nonce_key).map_err(|e| eother!(e))?;
+        signer.update(aad).map_err(|e| eother!(e))?;
+        signer.update(data).map_err(|e| eother!(e))?;
+        let nonce = signer.sign_to_vec().map_err(|e| eother!(e))?;
+        let nonce = &nonce[..CIPHER_NONCE_SIZE];
+
+        let mut tag = [0u8; CIPHER_TAG_SIZE];
+        let ciphertext = symm::encrypt_aead(
+            Cipher::aes_256_gcm(),
+            &self.key,
+            Some(nonce),
+            aad,
+            data,
+            &mut tag,
+        )
+        .map_err(|e| eother!(format!("failed to encrypt chunk: {}", e)))?;
+
+        let mut buf = Vec::with_capacity(data.len() + CIPHER_OVERHEAD);
+        buf.extend_from_slice(nonce);
+        buf.extend_from_slice(&ciphertext);
+        buf.extend_from_slice(&tag);
+        Ok(buf)
+    }
+
+    /// Decrypt chunk `data` encrypted by [encrypt()](#method.encrypt), and verify it with the
+    /// chunk digest `aad`.
+    pub fn decrypt(&self, data: &[u8], aad: &[u8]) -> Result<Vec<u8>> {
+        if data.len() < CIPHER_OVERHEAD {
+            return Err(eio!(format!(
+                "encrypted chunk of {} bytes is too short",
+                data.len()
+            )));
+        }
+        let (nonce, rest) = data.split_at(CIPHER_NONCE_SIZE);
+        let (ciphertext, tag) = rest.split_at(rest.len() - CIPHER_TAG_SIZE);
+
+        symm::decrypt_aead(
+            Cipher::aes_256_gcm(),
+            &self.key,
+            Some(nonce),
+            aad,
+            ciphertext,
+            tag,
+        )
+        .map_err(|e| {
+            eio!(format!(
+                "failed to decrypt chunk with key {}: {}",
+                self.key_id, e
+            ))
+        })
+    }
+}
+
+/// Trait to fetch data keys by the key ID recorded in the image metadata.
+///
+/// It's the extension point for key management services, the keys are fetched when blobs are
+/// opened, and never written to the image metadata or the blob cache.
+pub trait KeyProvider: Send + Sync {
+    /// Get the data key identified by `key_id`.
+    fn get_key(&self, key_id: &str) -> Result<Vec<u8>>;
+}
+
+/// Create a key provider from its configuration.
+pub fn new_key_provider(config: &KeyProviderConfig) -> Result<Arc<dyn KeyProvider>> {
+    let provider: Arc<dyn KeyProvider> = match config.provider_type.as_str() {
+        "file" => Arc::new(FileKeyProvider::new(config.provider_config.clone())?),
+        "exec" => Arc::new(ExecKeyProvider::new(config.provider_config.clone())?),
+        _ => {
+            return Err(einval!(format!(
+                "unsupported key provider type '{}'",
+                config.provider_type
+            )))
+        }
+    };
+
+    Ok(provider)
+}
+
+/// Create the cipher for `blob` with the key from `keys`, `None` if the blob isn't encrypted.
+pub fn new_blob_cipher(
+    keys: Option<&Arc<dyn KeyProvider>>,
+    blob: &BlobInfo,
+) -> Result<Option<Arc<BlobCipher>>> {
+    let key_id = blob.cipher_key_id();
+    if key_id.is_empty() {
+        return Ok(None);
+    }
+    let keys = keys.ok_or_else(|| {
+        einval!(format!(
+            "blob {} is encrypted by key {}, but no key provider is configured",
+            blob.blob_id(),
+            key_id
+        ))
+    })?;
+    if blob.is_stargz() {
+        return Err(einval!("encrypted stargz blob is not supported"));
+    }
+    let key = keys.get_key(key_id)?;
+
+    Ok(Some(Arc::new(BlobCipher::new(key_id, &key)?)))
+}
+
+#[derive(Clone, Debug, Deserialize)]
+struct FileKeyProviderConfig {
+    dir: String,
+}
+
+/// Key provider reading raw data keys from files named by the key ID in a directory.
+pub struct FileKeyProvider {
+    dir: PathBuf,
+}
+
+impl FileKeyProvider {
+    /// Create a new instance of `FileKeyProvider`.
+    pub fn new(config: Value) -> Result<Self> {
+        let config: FileKeyProviderConfig =
+            serde_json::from_value(config).map_err(|e| einval!(e))?;
+        Ok(FileKeyProvider {
+            dir: PathBuf::from(config.dir),
+        })
+    }
+}
+
+impl KeyProvider for FileKeyProvider {
+    fn get_key(&self, key_id: &str) -> Result<Vec<u8>> {
+        validate_key_id(key_id)?;
+        let path = self.dir.join(key_id);
+        fs::read(&path).map_err(|e| einval!(format!("failed to read key file {:?}: {}", path, e)))
+    }
+}
+
+#[derive(Clone, Debug, Deserialize)]
+struct ExecKeyProviderConfig {
+    command: String,
+    #[serde(default)]
+    args: Vec<String>,
+}
+
+#[derive(Serialize)]
+struct ExecKeyRequest<'a> {
+    op: &'a str,
+    key_id: &'a str,
+}
+
+#[derive(Deserialize)]
+struct ExecKeyResponse {
+    key: String,
+}
+
+/// Key provider running a plugin command to fetch the data keys, e.g. from AWS KMS or Vault.
+///
+/// The plugin reads the request `{"op": "get_key", "key_id": "<id>"}` from stdin, and writes the
+/// response `{"key": "<base64 encoded data key>"}` to stdout, or exits with non-zero status on
+/// failure. The keys fetched are kept in memory, so the plugin is run once per key.
+pub struct ExecKeyProvider {
+    command: String,
+    args: Vec<String>,
+    keys: Mutex<HashMap<String, Vec<u8>>>,
+}
+
+impl ExecKeyProvider {
+    /// Create a new instance of `ExecKeyProvider`.
+    pub fn new(config: Value) -> Result<Self> {
+        let config: ExecKeyProviderConfig =
+            serde_json::from_value(config).map_err(|e| einval!(e))?;
+        Ok(ExecKeyProvider {
+            command: config.command,
+            args: config.args,
+            keys: Mutex::new(HashMap::new()),
+        })
+    }
+
+    fn run(&self, key_id: &str) -> Result<Vec<u8>> {
+        let request = serde_json::to_vec(&ExecKeyRequest {
+            op: "get_key",
+            key_id,
+        })
+        .map_err(|e| eother!(e))?;
+
+        let mut child = Command::new(&self.command)
+            .args(&self.args)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .map_err(|e| {
+                eother!(format!(
+                    "failed to run key provider {}: {}",
+                    self.command, e
+                ))
+            })?;
+        // Drop stdin after writing the request, so the plugin sees EOF.
+        if let Some(mut stdin) = child.stdin.take() {
+            stdin.write_all(&request)?;
+        }
+        let output = child.wait_with_output()?;
+        if !output.status.success() {
+            return Err(eother!(format!(
+                "key provider {} failed to get key {}: {}, {}",
+                self.command,
+                key_id,
+                output.status,
+                String::from_utf8_lossy(&output.stderr).trim()
+            )));
+        }
+
+        let response: ExecKeyResponse = serde_json::from_slice(&output.stdout)
+            .map_err(|e| eother!(format!("invalid response of key provider: {}", e)))?;
+        base64::decode(&response.key)
+            .map_err(|e| eother!(format!("invalid key from key provider: {}", e)))
+    }
+}
+
+impl KeyProvider for ExecKeyProvider {
+    fn get_key(&self, key_id: &str) -> Result<Vec<u8>> {
+        validate_key_id(key_id)?;
+        if let Some(key) = self.keys.lock().unwrap().get(key_id) {
+            return Ok(key.clone());
+        }
+
+        let key = self.run(key_id)?;
+        self.keys
+            .lock()
+            .unwrap()
+            .insert(key_id.to_owned(), key.clone());
+
+        Ok(key)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::device::CIPHER_KEY_ID_MAX_LEN;
+    use vmm_sys_util::tempdir::TempDir;
+
+    #[test]
+    fn test_blob_cipher() {
+        let key = [7u8; CIPHER_KEY_SIZE];
+        let cipher = BlobCipher::new("key-1", &key).unwrap();
+        let data = b"data of chunk".to_vec();
+
+        let encrypted = cipher.encrypt(&data, b"digest").unwrap();
+        assert_eq!(encrypted.len(), data.len() + CIPHER_OVERHEAD);
+        assert_ne!(
+            &encrypted[CIPHER_NONCE_SIZE..CIPHER_NONCE_SIZE + data.len()],
+            &data[..]
+        );
+        // The output is reproducible.
+        assert_eq!(cipher.encrypt(&data, b"digest").unwrap(), encrypted);
+        assert_eq!(cipher.decrypt(&encrypted, b"digest").unwrap(), data);
+
+        // Tampered data, digest or key are detected.
+        let mut tampered = encrypted.clone();
+        tampered[CIPHER_NONCE_SIZE] ^= 1;
+        assert!(cipher.decrypt(&tampered, b"digest").is_err());
+        assert!(cipher.decrypt(&encrypted, b"other").is_err());
+        let other = BlobCipher::new("key-2", &[8u8; CIPHER_KEY_SIZE]).unwrap();
+        assert!(other.decrypt(&encrypted, b"digest").is_err());
+        assert!(cipher
+            .decrypt(&encrypted[..CIPHER_OVERHEAD - 1], b"digest")
+            .is_err());
+
+        assert!(BlobCipher::new("key-1", &key[1..]).is_err());
+        assert!(BlobCipher::new("../key", &key).is_err());
+        assert!(BlobCipher::new(&"k".repeat(CIPHER_KEY_ID_MAX_LEN + 1), &key).is_err());
+    }
+
+    #[test]
+    fn test_file_key_provider() {
+        let dir = TempDir::new().unwrap();
+        fs::write(dir.as_path().join("key-1"), &[1u8; CIPHER_KEY_SIZE]).unwrap();
+        let config = KeyProviderConfig {
+            provider_type: "file".to_string(),
+            provider_config: serde_json::json!({ "dir": dir.as_path() }),
+        };
+        let keys = new_key_provider(&config).unwrap();
+
+        assert_eq!(keys.get_key("key-1").unwrap(), vec![1u8; CIPHER_KEY_SIZE]);
+        assert!(keys.get_key("key-2").is_err());
+        assert!(keys.get_key("../key-1").is_err());
+    }
+
+    #[test]
+    fn test_exec_key_provider() {
+        let key = base64::encode(&[2u8; CIPHER_KEY_SIZE]);
+        let config = KeyProviderConfig {
+            provider_type: "exec".to_string(),
+            provider_config: serde_json::json!({
+                "command": "sh",
+                "args": ["-c", format!("grep -q '\"key_id\":\"key-1\"' && echo '{{\"key\": \"{}\"}}'", key)],
+            }),
+        };
+        let keys = new_key_provider(&config).unwrap();
+
+        assert_eq!(keys.get_key("key-1").unwrap(), vec![2u8; CIPHER_KEY_SIZE]);
+        assert!(keys.get_key("key-2").is_err());
+
+        let config = KeyProviderConfig {
+            provider_type: "vault".to_string(),
+            provider_config: Value::Null,
+        };
+        assert!(new_key_provider(&config).is_err());
+    }
+}
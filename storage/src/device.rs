@@ -32,10 +32,13 @@ use fuse_backend_rs::transport::{FileReadWriteVolatile, FileVolatileSlice};
 use nydus_utils::digest::{self, RafsDigest};
 use vm_memory::Bytes;
 
-use crate::cache::BlobCache;
+use crate::cache::{BlobCache, BlobIoMergeState};
 use crate::compress;
 use crate::factory::{FactoryConfig, BLOB_FACTORY};
 
+/// Maximum length of the key ID recorded in the blob table.
+pub const CIPHER_KEY_ID_MAX_LEN: usize = 32;
+
 static ZEROS: &[u8] = &[0u8; 4096]; // why 4096? volatile slice default size, unfortunately
 
 bitflags! {
@@ -52,6 +55,23 @@ impl Default for BlobFeatures {
     }
 }
 
+/// Check whether `key_id` can be recorded in the blob table and used as a file name.
+pub fn validate_key_id(key_id: &str) -> io::Result<()> {
+    if key_id.is_empty()
+        || key_id.len() > CIPHER_KEY_ID_MAX_LEN
+        || key_id.starts_with('.')
+        || !key_id
+            .bytes()
+            .all(|c| c.is_ascii_alphanumeric() || c == b'-' || c == b'_' || c == b'.')
+    {
+        return Err(einval!(format!(
+            "invalid key ID {:?}, should be 1 to {} characters of [A-Za-z0-9._-] not starting with '.'",
+            key_id, CIPHER_KEY_ID_MAX_LEN
+        )));
+    }
+    Ok(())
+}
+
 /// Configuration information for a metadata/data blob object.
 ///
 /// The `BlobInfo` structure provides information for the storage subsystem to manage a blob file
@@ -86,6 +106,8 @@ pub struct BlobInfo {
     validate_data: bool,
     /// The blob is for an stargz image.
     stargz: bool,
+    /// ID of the key to decrypt chunk data, empty if the blob isn't encrypted.
+    cipher_key_id: String,
 
     /// V6: Version number of the blob metadata.
     meta_flags: u32,
@@ -125,6 +147,7 @@ impl BlobInfo {
             readahead_size: 0,
             validate_data: false,
             stargz: false,
+            cipher_key_id: String::new(),
             meta_ci_compressor: 0,
             meta_flags: 0,
             meta_ci_offset: 0,
@@ -262,6 +285,16 @@ impl BlobInfo {
         self.stargz = stargz;
     }
 
+    /// Get the ID of the key to decrypt chunk data, empty if the blob isn't encrypted.
+    pub fn cipher_key_id(&self) -> &str {
+        &self.cipher_key_id
+    }
+
+    /// Set the ID of the key to decrypt chunk data.
+    pub fn set_cipher_key_id(&mut self, key_id: &str) {
+        self.cipher_key_id = key_id.to_owned();
+    }
+
     /// Set metadata information for a blob.
     ///
     /// The compressed blobs are laid out as:
@@ -919,6 +952,35 @@ impl BlobDevice {
         }
     }
 
+    /// Fetch chunk data described by the blob io vector into the cache synchronously.
+    ///
+    /// Continuous chunks are merged into requests up to `merging_size`, it's used to prefetch data
+    /// on demand after the background prefetch workers have been stopped.
+    pub fn fetch(&self, io_vec: &BlobIoVec, merging_size: usize) -> io::Result<()> {
+        if let Some(blob) = self.get_blob_by_iovec(io_vec) {
+            let mut bios = io_vec.bi_vec.clone();
+            bios.sort_by_key(|entry| entry.chunkinfo.compress_offset());
+            bios.dedup_by_key(|entry| entry.chunkinfo.id());
+
+            let mut result = Ok(());
+            BlobIoMergeState::merge_and_issue(&bios, merging_size, |req: BlobIoRange| {
+                if result.is_err() {
+                    return;
+                }
+                let ret = match blob.get_blob_object() {
+                    Some(obj) => obj.fetch_chunks(&req),
+                    None => blob.prefetch_range(&req),
+                };
+                if let Err(e) = ret {
+                    result = Err(e);
+                }
+            });
+            result?;
+        }
+
+        Ok(())
+    }
+
     /// Check all chunks related to the blob io vector are ready.
     pub fn is_all_chunk_ready(&self, io_vecs: &[BlobIoVec]) -> bool {
         for io_vec in io_vecs.iter() {
@@ -937,6 +999,31 @@ impl BlobDevice {
         true
     }
 
+    /// Verify the cached data of chunks related to the blob io vector, and evict the corrupted
+    /// ones from the cache.
+    ///
+    /// Return the number of corrupted chunks.
+    pub fn scrub(&self, io_vec: &BlobIoVec) -> io::Result<usize> {
+        let mut corrupted = 0;
+
+        if let Some(blob) = self.get_blob_by_iovec(io_vec) {
+            let mut last = None;
+            for desc in io_vec.bi_vec.iter() {
+                // Adjacent descriptors may target the same chunk.
+                let id = desc.chunkinfo.id();
+                if last == Some(id) {
+                    continue;
+                }
+                last = Some(id);
+                if !blob.scrub_chunk(&desc.chunkinfo)? {
+                    corrupted += 1;
+                }
+            }
+        }
+
+        Ok(corrupted)
+    }
+
     fn get_blob_by_iovec(&self, iovec: &BlobIoVec) -> Option<Arc<dyn BlobCache>> {
         if let Some(blob_index) = iovec.get_target_blob_index() {
             if (blob_index as usize) < self.blob_count {
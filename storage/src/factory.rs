@@ -10,6 +10,7 @@
 //! [FactoryConfig](struct.FactoryConfig.html). Those cached blob managers may be garbage-collected
 //! by [BlobFactory::gc()](struct.BlobFactory.html#method.gc).
 //! if not used anymore.
+use std::collections::hash_map::DefaultHasher;
 use std::collections::HashMap;
 use std::fs::File;
 use std::hash::{Hash, Hasher};
@@ -20,12 +21,27 @@ use anyhow::{Context, Result};
 use serde::Deserialize;
 use serde_json::value::Value;
 
+#[cfg(feature = "backend-azure")]
+use crate::backend::azure;
+use crate::backend::fault::{FaultInjectedBackend, FaultInjectionConfig};
+#[cfg(feature = "backend-gcs")]
+use crate::backend::gcs;
+#[cfg(feature = "backend-ipfs")]
+use crate::backend::ipfs;
 #[cfg(feature = "backend-oss")]
 use crate::backend::oss;
+use crate::backend::priority::{PriorityBackend, QosClass};
+use crate::backend::ratelimit::RateLimitedBackend;
 #[cfg(feature = "backend-registry")]
 use crate::backend::registry;
+#[cfg(feature = "backend-s3")]
+use crate::backend::s3;
 use crate::backend::{localfs, BlobBackend};
-use crate::cache::{BlobCache, BlobCacheMgr, BlobPrefetchConfig, DummyCacheMgr, FileCacheMgr};
+use crate::cache::{
+    BlobCache, BlobCacheMgr, BlobPrefetchConfig, CacheUsage, DummyCacheMgr, FileCacheMgr,
+};
+#[cfg(feature = "encryption")]
+use crate::crypt;
 use crate::device::BlobInfo;
 
 /// Configuration information for storage backend.
@@ -65,6 +81,35 @@ impl BackendConfig {
     }
 }
 
+/// Configuration information for key provider.
+#[derive(Clone, Debug, Default, Deserialize, Eq, PartialEq, Serialize)]
+pub struct KeyProviderConfig {
+    /// Type of key provider, `file` or `exec`.
+    #[serde(rename = "type")]
+    pub provider_type: String,
+    /// Configuration for key provider.
+    #[serde(default, rename = "config")]
+    pub provider_config: Value,
+}
+
+impl KeyProviderConfig {
+    /// Load key provider configuration from a configuration file.
+    pub fn from_file(path: &str) -> IOResult<Self> {
+        let file = File::open(path).map_err(|e| {
+            einval!(format!(
+                "failed to open key provider config {}: {}",
+                path, e
+            ))
+        })?;
+        serde_json::from_reader(file).map_err(|e| {
+            einval!(format!(
+                "failed to parse key provider config {}: {}",
+                path, e
+            ))
+        })
+    }
+}
+
 /// Configuration information for blob cache manager.
 #[derive(Clone, Default, Deserialize, Eq, PartialEq, Serialize)]
 pub struct CacheConfig {
@@ -96,6 +141,9 @@ pub struct FactoryConfig {
     /// Configuration for blob cache manager.
     #[serde(default)]
     pub cache: CacheConfig,
+    /// Configuration for key provider to decrypt encrypted blobs.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub key_provider: Option<KeyProviderConfig>,
 }
 
 #[derive(Eq, PartialEq)]
@@ -109,9 +157,19 @@ impl Hash for BlobCacheMgrKey {
         self.config.backend.backend_type.hash(state);
         self.config.cache.cache_type.hash(state);
         self.config.cache.prefetch_config.hash(state);
+        // Spread the managers of different registries and repos over the shards.
+        serde_json::to_string(&self.config.backend.backend_config)
+            .unwrap_or_default()
+            .hash(state);
     }
 }
 
+// Number of shards of the blob cache managers, so that concurrent mounts with different
+// configurations don't contend on a single lock.
+const BLOB_FACTORY_SHARDS: usize = 16;
+
+type BlobCacheMgrMap = HashMap<BlobCacheMgrKey, Arc<dyn BlobCacheMgr>>;
+
 lazy_static::lazy_static! {
     /// Default blob factory.
     pub static ref BLOB_FACTORY: BlobFactory = BlobFactory::new();
@@ -119,51 +177,123 @@ lazy_static::lazy_static! {
 
 /// Factory to create blob cache for blob objects.
 pub struct BlobFactory {
-    mgrs: Mutex<HashMap<BlobCacheMgrKey, Arc<dyn BlobCacheMgr>>>,
+    mgrs: Vec<Mutex<BlobCacheMgrMap>>,
 }
 
 impl BlobFactory {
     /// Create a new instance of blob factory object.
     pub fn new() -> Self {
         BlobFactory {
-            mgrs: Mutex::new(HashMap::new()),
+            mgrs: (0..BLOB_FACTORY_SHARDS)
+                .map(|_| Mutex::new(HashMap::new()))
+                .collect(),
         }
     }
 
+    fn shard(&self, key: &BlobCacheMgrKey) -> &Mutex<BlobCacheMgrMap> {
+        let mut hasher = DefaultHasher::new();
+        key.hash(&mut hasher);
+        &self.mgrs[hasher.finish() as usize % self.mgrs.len()]
+    }
+
+    // Get all blob cache managers, without holding the locks while they are used.
+    fn all_mgrs(&self) -> Vec<Arc<dyn BlobCacheMgr>> {
+        self.mgrs
+            .iter()
+            .flat_map(|shard| shard.lock().unwrap().values().cloned().collect::<Vec<_>>())
+            .collect()
+    }
+
     /// Create a blob cache object for a blob with specified configuration.
     pub fn new_blob_cache(
         &self,
         config: &Arc<FactoryConfig>,
         blob_info: &Arc<BlobInfo>,
     ) -> IOResult<Arc<dyn BlobCache>> {
+        #[cfg(not(feature = "encryption"))]
+        if !blob_info.cipher_key_id().is_empty() {
+            return Err(enosys!(format!(
+                "blob {} is encrypted, which is not supported without feature `encryption`",
+                blob_info.blob_id()
+            )));
+        }
         let key = BlobCacheMgrKey {
             config: config.clone(),
         };
-        // Use the existing blob cache manager if there's one with the same configuration.
-        if let Some(mgr) = self.mgrs.lock().unwrap().get(&key) {
+        // Use the existing blob cache manager if there's one with the same configuration. The
+        // blob cache is created out of the lock, since it may open and scan the cache files.
+        let shard = self.shard(&key);
+        let mgr = shard.lock().unwrap().get(&key).cloned();
+        if let Some(mgr) = mgr {
             return mgr.get_blob_cache(blob_info);
         }
 
         let backend = Self::new_backend(key.config.backend.clone(), blob_info.blob_id())?;
+        #[cfg(feature = "encryption")]
+        let keys = match &config.key_provider {
+            Some(c) => Some(crypt::new_key_provider(c)?),
+            None => None,
+        };
+        #[cfg(not(feature = "encryption"))]
+        if config.key_provider.is_some() {
+            return Err(enosys!(
+                "key provider is not supported without feature `encryption`"
+            ));
+        }
         let mgr = match key.config.cache.cache_type.as_str() {
             "blobcache" => {
-                let mgr = FileCacheMgr::new(config.cache.clone(), backend, &config.id)?;
+                #[allow(unused_mut)]
+                let mut mgr = FileCacheMgr::new(config.cache.clone(), backend, &config.id)?;
+                #[cfg(feature = "encryption")]
+                mgr.set_key_provider(keys);
                 mgr.init()?;
                 Arc::new(mgr) as Arc<dyn BlobCacheMgr>
             }
             _ => {
-                let mgr = DummyCacheMgr::new(config.cache.clone(), backend, false, false)?;
+                #[allow(unused_mut)]
+                let mut mgr = DummyCacheMgr::new(config.cache.clone(), backend, false, false)?;
+                #[cfg(feature = "encryption")]
+                mgr.set_key_provider(keys);
                 mgr.init()?;
                 Arc::new(mgr) as Arc<dyn BlobCacheMgr>
             }
         };
 
-        let mut guard = self.mgrs.lock().unwrap();
-        let mgr = guard.entry(key).or_insert_with(|| mgr);
+        let mgr = shard.lock().unwrap().entry(key).or_insert(mgr).clone();
 
         mgr.get_blob_cache(blob_info)
     }
 
+    /// Get the disk usage of all cache directories.
+    pub fn cache_usage(&self) -> IOResult<Vec<CacheUsage>> {
+        let mut usages: Vec<CacheUsage> = Vec::new();
+
+        for mgr in self.all_mgrs() {
+            if let Some(usage) = mgr.usage()? {
+                // Multiple blob cache managers may share the same cache directory.
+                if !usages.iter().any(|u| u.work_dir == usage.work_dir) {
+                    usages.push(usage);
+                }
+            }
+        }
+
+        Ok(usages)
+    }
+
+    /// Evict unused blobs from all cache directories, until the disk usage of each directory
+    /// is below `target` bytes, or its size quota if `target` is `None`.
+    ///
+    /// Return the bytes freed.
+    pub fn trim_cache(&self, target: Option<u64>) -> IOResult<u64> {
+        let mut freed = 0;
+
+        for mgr in self.all_mgrs() {
+            freed += mgr.trim(target)?;
+        }
+
+        Ok(freed)
+    }
+
     /// Garbage-collect unused blob cache managers and blob caches.
     pub fn gc(&self) {
         unimplemented!("TODO")
@@ -174,27 +304,59 @@ impl BlobFactory {
         config: BackendConfig,
         blob_id: &str,
     ) -> IOResult<Arc<dyn BlobBackend + Send + Sync>> {
-        match config.backend_type.as_str() {
+        let bandwidth_rate = match config.backend_config.get("bandwidth_rate") {
+            None => 0,
+            Some(v) => v
+                .as_u64()
+                .ok_or_else(|| einval!(format!("invalid backend bandwidth_rate '{}'", v)))?,
+        };
+        let qos_class = match config.backend_config.get("qos_class") {
+            None => QosClass::default(),
+            Some(v) => serde_json::from_value::<QosClass>(v.clone())
+                .map_err(|e| einval!(format!("invalid backend qos_class: {}", e)))?,
+        };
+        let fault_injection = match config.backend_config.get("fault_injection") {
+            None => None,
+            Some(v) => Some(
+                serde_json::from_value::<FaultInjectionConfig>(v.clone())
+                    .map_err(|e| einval!(format!("invalid backend fault_injection: {}", e)))?,
+            ),
+        };
+        let backend: Arc<dyn BlobBackend + Send + Sync> = match config.backend_type.as_str() {
             #[cfg(feature = "backend-oss")]
-            "oss" => Ok(Arc::new(oss::Oss::new(
-                config.backend_config,
-                Some(blob_id),
-            )?)),
+            "oss" => Arc::new(oss::Oss::new(config.backend_config, Some(blob_id))?),
             #[cfg(feature = "backend-registry")]
-            "registry" => Ok(Arc::new(registry::Registry::new(
+            "registry" => Arc::new(registry::Registry::new(
                 config.backend_config,
                 Some(blob_id),
-            )?)),
+            )?),
             #[cfg(feature = "backend-localfs")]
-            "localfs" => Ok(Arc::new(localfs::LocalFs::new(
-                config.backend_config,
-                Some(blob_id),
-            )?)),
-            _ => Err(einval!(format!(
-                "unsupported backend type '{}'",
-                config.backend_type
-            ))),
-        }
+            "localfs" => Arc::new(localfs::LocalFs::new(config.backend_config, Some(blob_id))?),
+            #[cfg(feature = "backend-s3")]
+            "s3" => Arc::new(s3::S3::new(config.backend_config, Some(blob_id))?),
+            #[cfg(feature = "backend-azure")]
+            "azure" => Arc::new(azure::Azure::new(config.backend_config, Some(blob_id))?),
+            #[cfg(feature = "backend-gcs")]
+            "gcs" => Arc::new(gcs::Gcs::new(config.backend_config, Some(blob_id))?),
+            #[cfg(feature = "backend-ipfs")]
+            "ipfs" => Arc::new(ipfs::Ipfs::new(config.backend_config, Some(blob_id))?),
+            _ => {
+                return Err(einval!(format!(
+                    "unsupported backend type '{}'",
+                    config.backend_type
+                )))
+            }
+        };
+
+        let backend = match fault_injection {
+            None => backend,
+            Some(fault_config) => Arc::new(FaultInjectedBackend::new(backend, fault_config)?),
+        };
+
+        // Always wrap the backend to apply the global concurrency limit and bandwidth rate. The
+        // requests waiting for bandwidth don't occupy the concurrency.
+        let backend = Arc::new(PriorityBackend::new(backend, qos_class));
+        Ok(Arc::new(RateLimitedBackend::new(backend, bandwidth_rate)))
     }
 }
 
@@ -219,4 +381,142 @@ mod tests {
 
         assert_eq!(config, config2);
     }
+
+    #[cfg(feature = "backend-localfs")]
+    #[test]
+    fn test_concurrent_new_blob_cache() {
+        use crate::device::BlobFeatures;
+        use std::thread;
+        use vmm_sys_util::tempdir::TempDir;
+
+        let dirs: Vec<TempDir> = (0..8).map(|_| TempDir::new().unwrap()).collect();
+        let configs: Vec<Arc<FactoryConfig>> = dirs
+            .iter()
+            .map(|dir| {
+                for i in 0..8 {
+                    File::create(dir.as_path().join(format!("blob{}", i))).unwrap();
+                }
+                let backend = serde_json::json!({ "dir": dir.as_path().to_str().unwrap() });
+                Arc::new(FactoryConfig {
+                    backend: BackendConfig {
+                        backend_type: "localfs".to_string(),
+                        backend_config: backend,
+                    },
+                    ..Default::default()
+                })
+            })
+            .collect();
+
+        // Mount images with different backends concurrently, each with a few blobs.
+        let factory = Arc::new(BlobFactory::new());
+        let handles: Vec<_> = (0..64)
+            .map(|i| {
+                let factory = factory.clone();
+                let config = configs[i % configs.len()].clone();
+                thread::spawn(move || {
+                    for j in 0..8 {
+                        let blob_id = format!("blob{}", j);
+                        let blob_info = Arc::new(BlobInfo::new(
+                            j,
+                            blob_id.clone(),
+                            0x1000,
+                            0x1000,
+                            0x1000,
+                            1,
+                            BlobFeatures::empty(),
+                        ));
+                        let blob = factory.new_blob_cache(&config, &blob_info).unwrap();
+                        assert_eq!(blob.blob_id(), blob_id);
+                    }
+                })
+            })
+            .collect();
+        for handle in handles {
+            handle.join().unwrap();
+        }
+
+        // A single manager is kept for each configuration.
+        assert_eq!(factory.all_mgrs().len(), configs.len());
+    }
+
+    #[cfg(feature = "backend-localfs")]
+    #[test]
+    fn test_new_blob_cache_latency() {
+        use crate::device::BlobFeatures;
+        use std::sync::atomic::{AtomicBool, Ordering};
+        use std::thread;
+        use std::time::{Duration, Instant};
+        use vmm_sys_util::tempdir::TempDir;
+
+        const BATCH: usize = 128;
+        const BATCHES: usize = 8;
+
+        let dir = TempDir::new().unwrap();
+        let factory = Arc::new(BlobFactory::new());
+        let stop = Arc::new(AtomicBool::new(false));
+
+        // Poll the cache usage like the daemon API does, which walks all blob cache managers.
+        let poller = {
+            let factory = factory.clone();
+            let stop = stop.clone();
+            thread::spawn(move || {
+                while !stop.load(Ordering::Relaxed) {
+                    factory.cache_usage().unwrap();
+                }
+            })
+        };
+
+        // Mount images with a new backend configuration each, in batches, and measure the
+        // median time to set up the blob cache of a mount as the number of mounts grows.
+        let blob_info = Arc::new(BlobInfo::new(
+            0,
+            "blob0".to_string(),
+            0x1000,
+            0x1000,
+            0x1000,
+            1,
+            BlobFeatures::empty(),
+        ));
+        let mut latencies = Vec::with_capacity(BATCHES);
+        for batch in 0..BATCHES {
+            let mut samples: Vec<Duration> = (0..BATCH)
+                .map(|i| {
+                    let path = dir.as_path().join(format!("mnt{}", batch * BATCH + i));
+                    std::fs::create_dir(&path).unwrap();
+                    File::create(path.join("blob0")).unwrap();
+                    let backend = serde_json::json!({ "dir": path.to_str().unwrap() });
+                    let config = Arc::new(FactoryConfig {
+                        backend: BackendConfig {
+                            backend_type: "localfs".to_string(),
+                            backend_config: backend,
+                        },
+                        ..Default::default()
+                    });
+                    let now = Instant::now();
+                    factory.new_blob_cache(&config, &blob_info).unwrap();
+                    now.elapsed()
+                })
+                .collect();
+            samples.sort();
+            let latency = samples[BATCH / 2];
+            println!(
+                "BlobFactory mount setup with {} mounts: {}us",
+                (batch + 1) * BATCH,
+                latency.as_micros()
+            );
+            latencies.push(latency);
+        }
+        stop.store(true, Ordering::Relaxed);
+        poller.join().unwrap();
+
+        assert_eq!(factory.all_mgrs().len(), BATCH * BATCHES);
+        // The latency should stay flat instead of growing with the number of mounts, leave
+        // enough room for noise of the test machine.
+        let first = latencies[0].max(Duration::from_micros(100));
+        assert!(
+            latencies[BATCHES - 1] < first * 4,
+            "mount setup latency grows with the number of mounts: {:?}",
+            latencies
+        );
+    }
 }
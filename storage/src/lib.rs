@@ -49,6 +49,8 @@ use std::fmt::{Display, Formatter};
 pub mod backend;
 pub mod cache;
 pub mod compress;
+#[cfg(feature = "encryption")]
+pub mod crypt;
 pub mod device;
 pub mod factory;
 pub mod meta;
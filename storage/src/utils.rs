@@ -138,8 +138,11 @@ impl<'a> MemSliceCursor<'a> {
     }
 
     /// Consume `size` bytes of memory content from the cursor.
-    pub fn consume(&mut self, mut size: usize) -> Vec<IoVec<&mut [u8]>> {
-        let mut vectors: Vec<IoVec<&mut [u8]>> = Vec::with_capacity(8);
+    ///
+    /// The returned slices don't overlap with the ones returned by other calls, so they may be
+    /// used together, e.g. by batched reads.
+    pub fn consume(&mut self, mut size: usize) -> Vec<IoVec<&'a mut [u8]>> {
+        let mut vectors: Vec<IoVec<&'a mut [u8]>> = Vec::with_capacity(8);
 
         while size > 0 && self.index < self.mem_slice.len() {
             let slice = self.mem_slice[self.index];
@@ -0,0 +1,212 @@
+// Copyright 2022 Ant Group. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Memory budget of the daemon.
+//!
+//! The budget set by [set_memory_budget()](fn.set_memory_budget.html) covers the metadata of
+//! Rafs instances in cached mode, the buffers of in-flight backend requests and the downloaded
+//! chunks waiting to be persisted into the blobcache. When the usage approaches the budget, new
+//! backend requests wait until the in-flight ones are done, downloaded chunks are persisted
+//! synchronously instead of buffered, and new instances in cached mode are refused.
+//!
+//! The metadata of cached mode can't be evicted while the instance is mounted, so the direct
+//! mode is preferred when many images are mounted, the kernel evicts the pages of its mmapped
+//! bootstrap on memory pressure.
+
+use std::io::{Error, Result};
+use std::sync::{Condvar, Mutex};
+
+lazy_static! {
+    static ref MEMORY_BUDGET: MemoryBudget = MemoryBudget::new(0);
+}
+
+/// Set the memory budget of the daemon in bytes, zero means unlimited.
+pub fn set_memory_budget(budget: u64) {
+    MEMORY_BUDGET.set_budget(budget);
+}
+
+/// Get the memory usage of the daemon by subsystem.
+pub fn memory_usage() -> MemoryUsage {
+    MEMORY_BUDGET.usage()
+}
+
+/// Reserve `size` bytes of the memory budget for `class`, fail if the budget is exceeded.
+pub fn reserve_memory(class: MemoryClass, size: u64) -> Result<MemoryPermit<'static>> {
+    MEMORY_BUDGET.reserve(class, size)
+}
+
+/// Reserve `size` bytes of the memory budget for `class`, wait if the budget is exceeded.
+pub fn acquire_memory(class: MemoryClass, size: u64) -> MemoryPermit<'static> {
+    MEMORY_BUDGET.acquire(class, size)
+}
+
+/// Subsystems sharing the memory budget.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum MemoryClass {
+    /// Metadata of Rafs instances in cached mode.
+    Metadata,
+    /// Buffers of in-flight backend requests.
+    BackendBuffers,
+    /// Downloaded chunks waiting to be persisted into the blobcache.
+    PersistBuffers,
+}
+
+/// Memory usage of the daemon by subsystem, in unit of bytes.
+#[derive(Clone, Debug, Default, Serialize)]
+pub struct MemoryUsage {
+    /// Zero means unlimited.
+    pub budget: u64,
+    pub metadata: u64,
+    pub backend_buffers: u64,
+    pub persist_buffers: u64,
+    /// Backend requests delayed by the budget.
+    pub throttled_requests: u64,
+    /// Reservations refused by the budget.
+    pub refused_reservations: u64,
+}
+
+impl MemoryUsage {
+    fn used(&self) -> u64 {
+        self.metadata + self.backend_buffers + self.persist_buffers
+    }
+
+    fn counter(&mut self, class: MemoryClass) -> &mut u64 {
+        match class {
+            MemoryClass::Metadata => &mut self.metadata,
+            MemoryClass::BackendBuffers => &mut self.backend_buffers,
+            MemoryClass::PersistBuffers => &mut self.persist_buffers,
+        }
+    }
+
+    fn exceeded(&self, size: u64) -> bool {
+        self.budget > 0 && self.used() + size > self.budget
+    }
+}
+
+struct MemoryBudget {
+    state: Mutex<MemoryUsage>,
+    cond: Condvar,
+}
+
+impl MemoryBudget {
+    fn new(budget: u64) -> Self {
+        MemoryBudget {
+            state: Mutex::new(MemoryUsage {
+                budget,
+                ..Default::default()
+            }),
+            cond: Condvar::new(),
+        }
+    }
+
+    fn set_budget(&self, budget: u64) {
+        self.state.lock().unwrap().budget = budget;
+        self.cond.notify_all();
+    }
+
+    fn usage(&self) -> MemoryUsage {
+        self.state.lock().unwrap().clone()
+    }
+
+    fn reserve(&self, class: MemoryClass, size: u64) -> Result<MemoryPermit> {
+        let mut state = self.state.lock().unwrap();
+        if state.exceeded(size) {
+            state.refused_reservations += 1;
+            return Err(Error::from_raw_os_error(libc::ENOMEM));
+        }
+        *state.counter(class) += size;
+
+        Ok(MemoryPermit {
+            budget: self,
+            class,
+            size,
+        })
+    }
+
+    fn acquire(&self, class: MemoryClass, size: u64) -> MemoryPermit {
+        let mut state = self.state.lock().unwrap();
+        // Always let one request go when no buffer is in flight, otherwise a request larger than
+        // the budget or the memory used by metadata would block forever.
+        if state.exceeded(size) && state.backend_buffers + state.persist_buffers > 0 {
+            state.throttled_requests += 1;
+            while state.exceeded(size) && state.backend_buffers + state.persist_buffers > 0 {
+                state = self.cond.wait(state).unwrap();
+            }
+        }
+        *state.counter(class) += size;
+
+        MemoryPermit {
+            budget: self,
+            class,
+            size,
+        }
+    }
+
+    fn release(&self, class: MemoryClass, size: u64) {
+        *self.state.lock().unwrap().counter(class) -= size;
+        self.cond.notify_all();
+    }
+}
+
+/// Memory reserved from the budget, released when dropped.
+pub struct MemoryPermit<'a> {
+    budget: &'a MemoryBudget,
+    class: MemoryClass,
+    size: u64,
+}
+
+impl Drop for MemoryPermit<'_> {
+    fn drop(&mut self) {
+        self.budget.release(self.class, self.size);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Arc;
+    use std::thread;
+    use std::time::Duration;
+
+    #[test]
+    fn test_reserve_memory() {
+        let budget = MemoryBudget::new(0x3000);
+
+        let metadata = budget.reserve(MemoryClass::Metadata, 0x2000).unwrap();
+        assert_eq!(budget.usage().metadata, 0x2000);
+        let err = budget.reserve(MemoryClass::Metadata, 0x2000).err().unwrap();
+        assert_eq!(err.raw_os_error(), Some(libc::ENOMEM));
+        assert_eq!(budget.usage().refused_reservations, 1);
+
+        drop(metadata);
+        assert_eq!(budget.usage().metadata, 0);
+        budget.set_budget(0);
+        let _p = budget.reserve(MemoryClass::Metadata, 0x10000).unwrap();
+    }
+
+    #[test]
+    fn test_acquire_memory() {
+        let budget = Arc::new(MemoryBudget::new(0x3000));
+        let _metadata = budget.reserve(MemoryClass::Metadata, 0x1000).unwrap();
+
+        // Not blocked without buffers in flight, even if the budget is exceeded.
+        let buffers = budget.acquire(MemoryClass::BackendBuffers, 0x3000);
+        let budget2 = budget.clone();
+        let handle = thread::spawn(move || {
+            let _p = budget2.acquire(MemoryClass::PersistBuffers, 0x1000);
+            budget2.usage().persist_buffers
+        });
+        while budget.usage().throttled_requests == 0 {
+            thread::sleep(Duration::from_millis(1));
+        }
+        assert_eq!(budget.usage().persist_buffers, 0);
+
+        drop(buffers);
+        assert_eq!(handle.join().unwrap(), 0x1000);
+        let usage = budget.usage();
+        assert_eq!(usage.backend_buffers, 0);
+        assert_eq!(usage.persist_buffers, 0);
+        assert_eq!(usage.metadata, 0x1000);
+    }
+}
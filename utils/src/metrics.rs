@@ -519,6 +519,15 @@ pub fn export_backend_metrics(name: &Option<String>) -> IoStatsResult<String> {
     }
 }
 
+/// Get the summary of reads from the storage backend of the blob `id`.
+pub fn get_backend_read_stats(id: &str) -> Option<BackendReadStats> {
+    BACKEND_METRICS
+        .read()
+        .unwrap()
+        .get(id)
+        .map(|m| m.read_stats())
+}
+
 pub fn export_blobcache_metrics(id: &Option<String>) -> IoStatsResult<String> {
     let metrics = BLOBCACHE_METRICS.read().unwrap();
 
@@ -680,11 +689,36 @@ impl BackendMetrics {
         }
     }
 
+    /// Get the summary of reads from the storage backend.
+    pub fn read_stats(&self) -> BackendReadStats {
+        BackendReadStats {
+            read_count: self.read_count.count(),
+            read_errors: self.read_errors.count(),
+            read_amount_total: self.read_amount_total.count(),
+        }
+    }
+
     fn export_metrics(&self) -> IoStatsResult<String> {
         serde_json::to_string(self).map_err(IoStatsError::Serialize)
     }
 }
 
+/// Summary of reads from storage backends.
+#[derive(Clone, Copy, Debug, Default, Serialize)]
+pub struct BackendReadStats {
+    pub read_count: u64,
+    pub read_errors: u64,
+    pub read_amount_total: u64,
+}
+
+impl BackendReadStats {
+    pub fn add(&mut self, other: &BackendReadStats) {
+        self.read_count += other.read_count;
+        self.read_errors += other.read_errors;
+        self.read_amount_total += other.read_amount_total;
+    }
+}
+
 #[derive(Debug, Default, Serialize)]
 pub struct BlobcacheMetrics {
     #[serde(skip_serializing, skip_deserializing)]
@@ -710,6 +744,14 @@ pub struct BlobcacheMetrics {
     pub prefetch_workers: AtomicUsize,
     pub prefetch_unmerged_chunks: BasicMetric,
     pub buffered_backend_size: BasicMetric,
+    // Cumulative time in unit of millisecond that prefetch requests are delayed by throttling.
+    pub prefetch_throttled_millis: BasicMetric,
+    // Chunks verified by the background scrubber, and the corrupted ones evicted from the cache.
+    pub scrubbed_chunks: BasicMetric,
+    pub scrub_corrupted_chunks: BasicMetric,
+    // Chunks cloned from the cache files of other blobs instead of downloaded from backend.
+    pub dedup_chunks: BasicMetric,
+    pub dedup_data_amount: BasicMetric,
 }
 
 impl BlobcacheMetrics {
@@ -791,4 +833,26 @@ mod tests {
         g.global_update(StatsFop::Read, 2015520, true);
         assert_eq!(g.block_count_read[3].count(), 2);
     }
+
+    #[test]
+    fn test_backend_read_stats() {
+        let m = BackendMetrics::new("test-backend-read-stats", "localfs");
+        let begin = m.begin();
+        m.end(&begin, 4096, false);
+        m.end(&begin, 0, true);
+
+        let stats = get_backend_read_stats("test-backend-read-stats").unwrap();
+        assert_eq!(stats.read_count, 2);
+        assert_eq!(stats.read_errors, 1);
+        assert_eq!(stats.read_amount_total, 4096);
+
+        let mut total = BackendReadStats::default();
+        total.add(&stats);
+        total.add(&stats);
+        assert_eq!(total.read_count, 4);
+        assert_eq!(total.read_amount_total, 8192);
+
+        m.release().unwrap();
+        assert!(get_backend_read_stats("test-backend-read-stats").is_none());
+    }
 }